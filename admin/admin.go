@@ -0,0 +1,152 @@
+// Package admin provides an authenticated HTTP API for changing runtime
+// settings, such as the log level and the sampling fraction, without
+// restarting tcp-info.
+//
+// All requests must carry the configured token as "Authorization: Bearer <token>".
+// GET requests return the current value, and POST requests with a "value" form
+// parameter change it:
+//
+//	curl -H "Authorization: Bearer $TOKEN" -d value=debug localhost:9991/admin/loglevel
+//	curl -H "Authorization: Bearer $TOKEN" -d value=0.1 localhost:9991/admin/sampling
+//
+// Log budgets, in messages per second, are set per category, "connection", "skip"
+// or "error":
+//
+//	curl -H "Authorization: Bearer $TOKEN" -d category=connection -d value=100 localhost:9991/admin/logbudget
+//
+// The connections in the connection cache, with their SockID, state, byte counts
+// and the time of their latest snapshot, are listed as JSON:
+//
+//	curl -H "Authorization: Bearer $TOKEN" localhost:9991/admin/connections
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/m-lab/tcp-info/loglevel"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/saver"
+)
+
+// Sampler is the interface of objects whose sampling fraction can be changed.
+type Sampler interface {
+	Sampling() float64
+	SetSampling(fraction float64)
+}
+
+// Auditor records changes to runtime settings.
+type Auditor interface {
+	Audit(setting, value, source string)
+}
+
+// ConnectionLister lists the connections in the connection cache.
+type ConnectionLister interface {
+	CachedConnections() []saver.CachedConnection
+}
+
+type handler struct {
+	token   string
+	sampler Sampler
+	auditor Auditor
+	lister  ConnectionLister
+}
+
+// NewHandler returns an http.Handler serving the admin API.  If token is empty,
+// all requests are rejected.
+func NewHandler(token string, sampler Sampler, auditor Auditor, lister ConnectionLister) http.Handler {
+	h := &handler{token: token, sampler: sampler, auditor: auditor, lister: lister}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/loglevel", h.authorized(h.logLevel))
+	mux.HandleFunc("/admin/sampling", h.authorized(h.sampling))
+	mux.HandleFunc("/admin/logbudget", h.authorized(h.logBudget))
+	mux.HandleFunc("/admin/connections", h.authorized(h.connections))
+	return mux
+}
+
+func (h *handler) authorized(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := "Bearer " + h.token
+		actual := r.Header.Get("Authorization")
+		if h.token == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+			metrics.ErrorCount.WithLabelValues("admin unauthorized").Inc()
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodPost:
+			f(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (h *handler) logLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		l, err := loglevel.Parse(r.FormValue("value"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		loglevel.Set(l)
+		h.auditor.Audit("loglevel", l.String(), "admin")
+	}
+	fmt.Fprintln(w, loglevel.Get())
+}
+
+func (h *handler) sampling(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		value := r.FormValue("value")
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 1 {
+			http.Error(w, "value must be between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		h.sampler.SetSampling(f)
+		h.auditor.Audit("sampling", value, "admin")
+	}
+	fmt.Fprintln(w, h.sampler.Sampling())
+}
+
+func (h *handler) logBudget(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		category := r.FormValue("category")
+		value := r.FormValue("value")
+		f, err := strconv.ParseFloat(value, 64)
+		if category == "" || err != nil || f < 0 {
+			http.Error(w, "category and a non-negative value are required", http.StatusBadRequest)
+			return
+		}
+		switch category {
+		case loglevel.Connection, loglevel.Skip, loglevel.Failure:
+		default:
+			http.Error(w, "category must be connection, skip or error", http.StatusBadRequest)
+			return
+		}
+		loglevel.SetBudget(category, f)
+		h.auditor.Audit("logbudget."+category, value, "admin")
+	}
+	budgets := loglevel.Budgets()
+	categories := make([]string, 0, len(budgets))
+	for c := range budgets {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+	for _, c := range categories {
+		fmt.Fprintln(w, c, budgets[c])
+	}
+}
+
+func (h *handler) connections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.lister.CachedConnections())
+}
@@ -0,0 +1,113 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/tcp-info/admin"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/loglevel"
+	"github.com/m-lab/tcp-info/saver"
+)
+
+type fakeSaver struct {
+	sampling float64
+	audits   []string
+}
+
+func (f *fakeSaver) Sampling() float64            { return f.sampling }
+func (f *fakeSaver) SetSampling(fraction float64) { f.sampling = fraction }
+func (f *fakeSaver) Audit(setting, value, source string) {
+	f.audits = append(f.audits, setting+"="+value)
+}
+func (f *fakeSaver) CachedConnections() []saver.CachedConnection {
+	return []saver.CachedConnection{{ID: inetdiag.SockID{SPort: 443, Cookie: 5}, State: "ESTABLISHED", BytesSent: 10}}
+}
+
+func do(h http.Handler, method, path, token, value string) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	if value != "" {
+		body = strings.NewReader(url.Values{"value": {value}}.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	defer loglevel.Set(loglevel.Info)
+	defer loglevel.SetBudget(loglevel.Connection, loglevel.DefaultBudget)
+	f := &fakeSaver{sampling: 1}
+	h := admin.NewHandler("secret", f, f, f)
+
+	tests := []struct {
+		method, path, token, value string
+		code                       int
+		body                       string
+	}{
+		{"GET", "/admin/sampling", "", "", http.StatusUnauthorized, ""},
+		{"GET", "/admin/sampling", "wrong", "", http.StatusUnauthorized, ""},
+		{"GET", "/admin/sampling", "secret", "", http.StatusOK, "1\n"},
+		{"POST", "/admin/sampling", "secret", "0.5", http.StatusOK, "0.5\n"},
+		{"POST", "/admin/sampling", "secret", "1.5", http.StatusBadRequest, ""},
+		{"POST", "/admin/loglevel", "secret", "debug", http.StatusOK, "debug\n"},
+		{"POST", "/admin/loglevel", "secret", "loud", http.StatusBadRequest, ""},
+		{"DELETE", "/admin/loglevel", "secret", "", http.StatusMethodNotAllowed, ""},
+		{"POST", "/admin/logbudget?category=connection", "secret", "5", http.StatusOK, "connection 5\n"},
+		{"POST", "/admin/logbudget?category=connection", "secret", "-1", http.StatusBadRequest, ""},
+		{"POST", "/admin/logbudget?category=test", "secret", "5", http.StatusBadRequest, ""},
+		{"POST", "/admin/logbudget", "secret", "5", http.StatusBadRequest, ""},
+		{"GET", "/admin/connections", "", "", http.StatusUnauthorized, ""},
+		{"POST", "/admin/connections", "secret", "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		rec := do(h, tt.method, tt.path, tt.token, tt.value)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s %q: got %d, want %d", tt.method, tt.path, tt.value, rec.Code, tt.code)
+		}
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s %s %q: got %q, want %q", tt.method, tt.path, tt.value, rec.Body.String(), tt.body)
+		}
+	}
+	if f.sampling != 0.5 || loglevel.Get() != loglevel.Debug {
+		t.Error("Settings were not changed", f.sampling, loglevel.Get())
+	}
+	if len(f.audits) != 3 || f.audits[0] != "sampling=0.5" || f.audits[1] != "loglevel=debug" || f.audits[2] != "logbudget.connection=5" {
+		t.Error("Wrong audits", f.audits)
+	}
+}
+
+func TestEmptyTokenRejectsAll(t *testing.T) {
+	f := &fakeSaver{sampling: 1}
+	h := admin.NewHandler("", f, f, f)
+	if rec := do(h, "GET", "/admin/sampling", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Error("Should be unauthorized", rec.Code)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	f := &fakeSaver{sampling: 1}
+	h := admin.NewHandler("secret", f, f, f)
+	rec := do(h, "GET", "/admin/connections", "secret", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatal("Wrong response", rec.Code, rec.Header())
+	}
+	var conns []saver.CachedConnection
+	if err := json.Unmarshal(rec.Body.Bytes(), &conns); err != nil {
+		t.Fatal("Could not decode", rec.Body.String(), err)
+	}
+	if len(conns) != 1 || conns[0].ID.SPort != 443 || conns[0].State != "ESTABLISHED" || conns[0].BytesSent != 10 {
+		t.Error("Wrong connections", conns)
+	}
+}
@@ -0,0 +1,157 @@
+// Package anonymizer provides the methods of anonymizing the recorded addresses of
+// connections.  In addition to the methods of github.com/m-lab/go/anonymize, which
+// returns the same IPAnonymizer interface, addresses may be truncated to shorter
+// prefixes, or replaced with keyed pseudonyms.
+//
+// As with the netblock method, the addresses of this machine, i.e. those in
+// anonymize.IgnoredIPs, are never anonymized.
+package anonymizer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+)
+
+// The anonymization methods.
+const (
+	None     = "none"     // Addresses are recorded as they are.
+	Netblock = "netblock" // IPv4 addresses are truncated to /24, and IPv6 to /64.
+	Truncate = "truncate" // IPv4 addresses are truncated to /24, and IPv6 to /48.
+	HMAC     = "hmac"     // Addresses are replaced by an HMAC of them, with a rotating key.
+)
+
+// DefaultRotation is the default period of the HMAC keys.
+const DefaultRotation = 24 * time.Hour
+
+// ErrUnknownMethod is returned by New for an unknown method.
+var ErrUnknownMethod = errors.New("unknown anonymization method")
+
+// Config configures the anonymization.
+type Config struct {
+	Method string
+	// Key is the secret from which the key of each Rotation period is derived with
+	// HMAC.  Pseudonyms are then consistent across restarts and machines that share
+	// the Key.  If it is empty, a random key is generated for each period, so
+	// pseudonyms are only consistent within a period of a single process.
+	Key []byte
+	// Rotation is the period of the HMAC keys.  Periods start at multiples of
+	// Rotation since the Unix epoch.  Zero uses DefaultRotation.
+	Rotation time.Duration
+}
+
+// New returns the IPAnonymizer for the configuration.
+func New(c Config) (anonymize.IPAnonymizer, error) {
+	switch c.Method {
+	case "", None:
+		return anonymize.New(anonymize.None), nil
+	case Netblock:
+		return anonymize.New(anonymize.Netblock), nil
+	case Truncate:
+		return truncator{}, nil
+	case HMAC:
+		p := &pseudonymizer{secret: c.Key, rotation: c.Rotation, now: time.Now}
+		if p.rotation <= 0 {
+			p.rotation = DefaultRotation
+		}
+		if _, err := p.currentKey(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownMethod, c.Method)
+}
+
+// ignored returns true if ip is one of the addresses of this machine.
+func ignored(ip net.IP) bool {
+	for _, i := range anonymize.IgnoredIPs {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncator zeroes all but the first 24 bits of IPv4 addresses, and the first 48 bits
+// of IPv6 addresses.
+type truncator struct{}
+
+func (truncator) IP(ip net.IP) {
+	if ip == nil || ignored(ip) {
+		return
+	}
+	if ip.To4() != nil {
+		ip[len(ip)-1] = 0
+		return
+	}
+	if len(ip) == net.IPv6len {
+		for i := 6; i < net.IPv6len; i++ {
+			ip[i] = 0
+		}
+	}
+}
+
+// pseudonymizer replaces addresses with the leading bytes of an HMAC-SHA256 of
+// them, keeping their family.  Its IP method may be called concurrently.
+type pseudonymizer struct {
+	secret   []byte
+	rotation time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	period int64  // The period of key.
+	key    []byte // Nil until the first call.
+}
+
+// currentKey returns the key of the current period, deriving or generating it at
+// the start of each period.
+func (p *pseudonymizer) currentKey() ([]byte, error) {
+	period := p.now().UnixNano() / int64(p.rotation)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.key != nil && period == p.period {
+		return p.key, nil
+	}
+	key := make([]byte, sha256.Size)
+	if len(p.secret) == 0 {
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	} else {
+		mac := hmac.New(sha256.New, p.secret)
+		binary.Write(mac, binary.BigEndian, period)
+		key = mac.Sum(key[:0])
+	}
+	p.period, p.key = period, key
+	return key, nil
+}
+
+func (p *pseudonymizer) IP(ip net.IP) {
+	if ip == nil || ignored(ip) {
+		return
+	}
+	key, err := p.currentKey()
+	if err != nil {
+		// Without a key, nothing must be recorded that identifies the address.
+		for i := range ip {
+			ip[i] = 0
+		}
+		return
+	}
+	mac := hmac.New(sha256.New, key)
+	addr := ip
+	if ip4 := ip.To4(); ip4 != nil {
+		// The prefix of an IPv4-mapped IPv6 address is kept.
+		addr = ip[len(ip)-net.IPv4len:]
+	}
+	mac.Write(addr)
+	copy(addr, mac.Sum(nil))
+}
@@ -0,0 +1,99 @@
+package anonymizer_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/anonymizer"
+)
+
+func anonymized(a anonymize.IPAnonymizer, addr string) string {
+	ip := net.ParseIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	a.IP(ip)
+	return ip.String()
+}
+
+func TestNew(t *testing.T) {
+	for _, m := range []string{"", anonymizer.None, anonymizer.Netblock, anonymizer.Truncate, anonymizer.HMAC} {
+		if _, err := anonymizer.New(anonymizer.Config{Method: m}); err != nil {
+			t.Error(m, err)
+		}
+	}
+	if _, err := anonymizer.New(anonymizer.Config{Method: "rot13"}); !errors.Is(err, anonymizer.ErrUnknownMethod) {
+		t.Error("Expected ErrUnknownMethod, got", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	a, err := anonymizer.New(anonymizer.Config{Method: anonymizer.Truncate})
+	rtx.Must(err, "Could not create anonymizer")
+	tests := []struct{ in, want string }{
+		{"10.1.2.3", "10.1.2.0"},
+		{"::ffff:10.1.2.3", "10.1.2.0"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1::"},
+	}
+	for _, tt := range tests {
+		if got := anonymized(a, tt.in); got != tt.want {
+			t.Errorf("Truncate %s = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+	a.IP(nil) // No crash == success
+
+	old := anonymize.IgnoredIPs
+	defer func() { anonymize.IgnoredIPs = old }()
+	anonymize.IgnoredIPs = []net.IP{net.ParseIP("10.1.2.3")}
+	if got := anonymized(a, "10.1.2.3"); got != "10.1.2.3" {
+		t.Error("The local address should not be anonymized, got", got)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	keyed := func() anonymize.IPAnonymizer {
+		a, err := anonymizer.New(anonymizer.Config{Method: anonymizer.HMAC, Key: []byte("secret"), Rotation: time.Hour})
+		rtx.Must(err, "Could not create anonymizer")
+		anonymizer.SetNow(a, clock)
+		return a
+	}
+	a, b := keyed(), keyed()
+
+	v4 := anonymized(a, "10.1.2.3")
+	if v4 == "10.1.2.3" || net.ParseIP(v4).To4() == nil {
+		t.Error("Bad pseudonym for an IPv4 address:", v4)
+	}
+	v6 := anonymized(a, "2001:db8::1")
+	if v6 == "2001:db8::1" || len(net.ParseIP(v6)) != net.IPv6len {
+		t.Error("Bad pseudonym for an IPv6 address:", v6)
+	}
+	if anonymized(a, "10.1.2.4") == v4 {
+		t.Error("Different addresses should have different pseudonyms")
+	}
+	// Anonymizers with the same key agree.
+	if got := anonymized(b, "10.1.2.3"); got != v4 {
+		t.Errorf("Pseudonyms with the same key differ: %s and %s", got, v4)
+	}
+	// The key changes in the next period.
+	now = now.Add(time.Hour)
+	if got := anonymized(a, "10.1.2.3"); got == v4 {
+		t.Error("The pseudonym did not change when the key rotated")
+	}
+	if got, want := anonymized(a, "10.1.2.3"), anonymized(b, "10.1.2.3"); got != want {
+		t.Errorf("Pseudonyms with the same key differ after rotation: %s and %s", got, want)
+	}
+
+	// Random keys are not shared.
+	r, err := anonymizer.New(anonymizer.Config{Method: anonymizer.HMAC})
+	rtx.Must(err, "Could not create anonymizer")
+	anonymizer.SetNow(r, clock)
+	if first := anonymized(r, "10.1.2.3"); first == anonymized(a, "10.1.2.3") || first != anonymized(r, "10.1.2.3") {
+		t.Error("Pseudonyms with a random key should be consistent, but differ from those of other keys")
+	}
+}
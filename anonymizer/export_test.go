@@ -0,0 +1,12 @@
+package anonymizer
+
+import (
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+)
+
+// SetNow sets the clock of an HMAC anonymizer.
+func SetNow(a anonymize.IPAnonymizer, now func() time.Time) {
+	a.(*pseudonymizer).now = now
+}
@@ -0,0 +1,344 @@
+// Package arrow writes Apache Arrow IPC files, also known as Feather version 2,
+// for vectorized analytics with e.g. pandas, polars or DuckDB.  The columns are
+// derived from a Go struct type, and the schema is embedded in each file, so
+// files are self-describing.
+//
+// Nested structs are flattened into columns with dotted names, e.g.
+// "Snapshot.TCPInfo.RTT", and every column is nullable, so that the columns
+// under a nil pointer are null.  Go types map to Arrow types as follows:
+//   - bool to bool, float32 to float32, and float64 to float64.
+//   - Signed and unsigned integers to integers of the same width and signedness.
+//   - string to utf8, and []byte and byte arrays to binary.
+//   - time.Time to timestamp[us, UTC], with the zero time as null.
+//
+// Exported fields are named as for encoding/json, and fields tagged json:"-" are
+// omitted.  Other slices, maps and so on are not supported.
+package arrow
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Errors returned by the package.
+var (
+	ErrUnsupportedType = errors.New("type has no Arrow equivalent")
+	ErrWrongType       = errors.New("value does not match the schema type")
+)
+
+// DefaultBatchSize is the default number of rows at which a record batch is written.
+const DefaultBatchSize = 64 * 1024
+
+var (
+	magic        = []byte("ARROW1")
+	continuation = []byte{0xFF, 0xFF, 0xFF, 0xFF}
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// column accumulates the values of a leaf field for the current record batch.
+type column struct {
+	name   string
+	index  []int // The field indexes from the root struct, through pointers.
+	typeID uint8
+	width  int // The width of fixed size values, in bytes.
+	signed bool
+	put    func(c *column, v reflect.Value)
+
+	length   int
+	nulls    int
+	validity []byte
+	data     []byte
+	offsets  []byte // For utf8 and binary columns.
+}
+
+// columns returns the leaf columns of a struct type.
+func columns(t reflect.Type, prefix string, index []int) ([]*column, error) {
+	var cols []*column
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		name = prefix + name
+		idx := append(append([]int{}, index...), i)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			sub, err := columns(ft, name+".", idx)
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, sub...)
+			continue
+		}
+		c, err := leaf(ft)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		c.name, c.index = name, idx
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+// leaf returns a column for values of type t, without its name and index.
+func leaf(t reflect.Type) (*column, error) {
+	if t == timeType {
+		return &column{typeID: typeTimestamp, width: 8, signed: true, put: func(c *column, v reflect.Value) {
+			c.data = appendUint64(c.data, uint64(v.Interface().(time.Time).UnixMicro()))
+		}}, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &column{typeID: typeBool, put: func(c *column, v reflect.Value) {
+			if len(c.data) <= c.length/8 {
+				c.data = append(c.data, 0)
+			}
+			if v.Bool() {
+				c.data[c.length/8] |= 1 << (c.length % 8)
+			}
+		}}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &column{typeID: typeInt, width: int(t.Size()), signed: true, put: func(c *column, v reflect.Value) {
+			c.data = appendInt(c.data, uint64(v.Int()), c.width)
+		}}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &column{typeID: typeInt, width: int(t.Size()), put: func(c *column, v reflect.Value) {
+			c.data = appendInt(c.data, v.Uint(), c.width)
+		}}, nil
+	case reflect.Float32:
+		return &column{typeID: typeFloatingPoint, width: 4, put: func(c *column, v reflect.Value) {
+			c.data = appendUint32(c.data, math.Float32bits(float32(v.Float())))
+		}}, nil
+	case reflect.Float64:
+		return &column{typeID: typeFloatingPoint, width: 8, put: func(c *column, v reflect.Value) {
+			c.data = appendUint64(c.data, math.Float64bits(v.Float()))
+		}}, nil
+	case reflect.String:
+		return &column{typeID: typeUtf8, put: func(c *column, v reflect.Value) {
+			c.data = append(c.data, v.String()...)
+		}}, nil
+	case reflect.Array, reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			break
+		}
+		return &column{typeID: typeBinary, put: func(c *column, v reflect.Value) {
+			for i := 0; i < v.Len(); i++ {
+				c.data = append(c.data, byte(v.Index(i).Uint()))
+			}
+		}}, nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+}
+
+func appendInt(b []byte, v uint64, width int) []byte {
+	for i := 0; i < width; i++ {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+// append adds the value of the column's field in v, the root struct.
+func (c *column) append(v reflect.Value) {
+	valid := true
+	for _, i := range c.index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				valid = false
+				break
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	if valid && v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			valid = false
+		} else {
+			v = v.Elem()
+		}
+	}
+	if valid && c.typeID == typeTimestamp && v.Interface().(time.Time).IsZero() {
+		valid = false
+	}
+
+	if c.length%8 == 0 {
+		c.validity = append(c.validity, 0)
+	}
+	if valid {
+		c.validity[c.length/8] |= 1 << (c.length % 8)
+		c.put(c, v)
+	} else {
+		c.nulls++
+		switch {
+		case c.typeID == typeBool:
+			if len(c.data) <= c.length/8 {
+				c.data = append(c.data, 0)
+			}
+		case c.width > 0:
+			c.data = append(c.data, make([]byte, c.width)...)
+		}
+	}
+	if c.typeID == typeUtf8 || c.typeID == typeBinary {
+		if c.length == 0 {
+			c.offsets = appendUint32(c.offsets, 0)
+		}
+		c.offsets = appendUint32(c.offsets, uint32(len(c.data)))
+	}
+	c.length++
+}
+
+// buffers returns the Arrow buffers of the column: the validity bitmap, which is
+// empty when there are no nulls, then the offsets, if any, and the data.
+func (c *column) buffers() [][]byte {
+	validity := c.validity
+	if c.nulls == 0 {
+		validity = nil
+	}
+	if c.typeID == typeUtf8 || c.typeID == typeBinary {
+		return [][]byte{validity, c.offsets, c.data}
+	}
+	return [][]byte{validity, c.data}
+}
+
+func (c *column) reset() {
+	c.length, c.nulls = 0, 0
+	c.validity, c.data, c.offsets = c.validity[:0], c.data[:0], c.offsets[:0]
+}
+
+// Writer writes values of a single struct type to an Arrow IPC file.
+type Writer struct {
+	// BatchSize is the number of rows at which a record batch is written.
+	BatchSize int
+
+	w       io.Writer
+	t       reflect.Type
+	columns []*column
+	offset  int64
+	blocks  []block
+	rows    int
+}
+
+// NewWriter writes the header and schema of an Arrow file for values of the same
+// type as v, which must be a struct or a pointer to one, and returns a Writer for
+// the values.
+func NewWriter(w io.Writer, v interface{}) (*Writer, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct || t == timeType {
+		return nil, fmt.Errorf("%w: %v is not a struct", ErrUnsupportedType, t)
+	}
+	cols, err := columns(t, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	aw := &Writer{BatchSize: DefaultBatchSize, w: w, t: t, columns: cols}
+	// The magic is padded to 8 bytes.
+	err = aw.write(append(append([]byte{}, magic...), 0, 0))
+	if err != nil {
+		return nil, err
+	}
+	_, err = aw.message(schemaMessage(cols))
+	if err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+// message writes an encapsulated message: a continuation marker, the length of
+// the metadata, and the metadata padded to 8 bytes.  It returns the length of all
+// three, as recorded in the file footer.
+func (w *Writer) message(meta []byte) (int32, error) {
+	padded := (len(meta) + 7) &^ 7
+	b := append([]byte{}, continuation...)
+	b = appendUint32(b, uint32(padded))
+	b = append(b, meta...)
+	b = append(b, make([]byte, padded-len(meta))...)
+	return int32(len(b)), w.write(b)
+}
+
+// Append adds v, which must be of the Writer's type or a pointer to it, to the
+// current record batch, and writes the batch if it has reached the BatchSize.
+func (w *Writer) Append(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() || rv.Type() != w.t {
+		return fmt.Errorf("%w: %T", ErrWrongType, v)
+	}
+	for _, c := range w.columns {
+		c.append(rv)
+	}
+	w.rows++
+	if w.rows >= w.BatchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes the current record batch, if it is not empty.
+func (w *Writer) Flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	var nodes []fieldNode
+	var spans []bufferSpan
+	var body []byte
+	for _, c := range w.columns {
+		nodes = append(nodes, fieldNode{int64(c.length), int64(c.nulls)})
+		for _, buf := range c.buffers() {
+			spans = append(spans, bufferSpan{int64(len(body)), int64(len(buf))})
+			body = append(body, buf...)
+			body = append(body, make([]byte, (8-len(body)%8)%8)...)
+		}
+		c.reset()
+	}
+	bl := block{offset: w.offset, bodyLength: int64(len(body))}
+	var err error
+	bl.metaLength, err = w.message(recordBatchMessage(int64(w.rows), nodes, spans, bl.bodyLength))
+	if err != nil {
+		return err
+	}
+	w.blocks = append(w.blocks, bl)
+	w.rows = 0
+	return w.write(body)
+}
+
+// Close writes any buffered values and the file footer.  It does not close the
+// underlying io.Writer.
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	// The end of stream marker, then the footer, its length and the magic.
+	b := append([]byte{}, continuation...)
+	b = appendUint32(b, 0)
+	f := footer(w.columns, w.blocks)
+	b = append(b, f...)
+	b = appendUint32(b, uint32(len(f)))
+	b = append(b, magic...)
+	return w.write(b)
+}
@@ -0,0 +1,296 @@
+package arrow_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/arrow"
+)
+
+type Inner struct {
+	Name string
+	Skip int `json:"-"`
+	Big  uint64
+}
+
+type Row struct {
+	Flag    bool
+	Small   int8
+	Neg     int64
+	Port    uint16
+	Float   float32
+	Double  float64
+	Data    []byte
+	Array   [4]byte
+	Time    time.Time
+	Inner   Inner
+	Ptr     *Inner
+	Opt     *int32
+	Renamed string `json:"renamed,omitempty"`
+	hidden  int
+}
+
+// table reads a flatbuffer table, just enough to check the files.
+type table struct {
+	buf []byte
+	pos int
+}
+
+func u16(b []byte, pos int) int   { return int(binary.LittleEndian.Uint16(b[pos:])) }
+func u32(b []byte, pos int) int   { return int(binary.LittleEndian.Uint32(b[pos:])) }
+func i64(b []byte, pos int) int64 { return int64(binary.LittleEndian.Uint64(b[pos:])) }
+
+func root(b []byte) table {
+	return table{b, u32(b, 0)}
+}
+
+// field returns the position of a field, or 0 if it is absent.
+func (t table) field(slot int) int {
+	vt := t.pos - int(int32(u32(t.buf, t.pos)))
+	if 4+2*slot >= u16(t.buf, vt) {
+		return 0
+	}
+	off := u16(t.buf, vt+4+2*slot)
+	if off == 0 {
+		return 0
+	}
+	return t.pos + off
+}
+
+func (t table) ref(slot int) int {
+	p := t.field(slot)
+	return p + u32(t.buf, p)
+}
+
+func (t table) table(slot int) table {
+	return table{t.buf, t.ref(slot)}
+}
+
+func (t table) string(slot int) string {
+	p := t.ref(slot)
+	return string(t.buf[p+4 : p+4+u32(t.buf, p)])
+}
+
+func (t table) vectorLen(slot int) int {
+	return u32(t.buf, t.ref(slot))
+}
+
+// tables returns the elements of a vector of tables.
+func (t table) tables(slot int) []table {
+	p := t.ref(slot)
+	var out []table
+	for i := 0; i < u32(t.buf, p); i++ {
+		e := p + 4 + 4*i
+		out = append(out, table{t.buf, e + u32(t.buf, e)})
+	}
+	return out
+}
+
+// longs returns the contents of a vector of structs of int64s.
+func (t table) longs(slot int, perStruct int) [][]int64 {
+	p := t.ref(slot)
+	var out [][]int64
+	for i := 0; i < u32(t.buf, p); i++ {
+		var s []int64
+		for j := 0; j < perStruct; j++ {
+			s = append(s, i64(t.buf, p+4+8*(perStruct*i+j)))
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// column holds the decoded buffers of a column in a record batch.
+type column struct {
+	length, nulls int64
+	buffers       [][]byte
+}
+
+func (c column) valid(i int) bool {
+	return c.nulls == 0 || c.buffers[0][i/8]&(1<<(i%8)) != 0
+}
+
+func (c column) bytes(i int) []byte {
+	return c.buffers[2][u32(c.buffers[1], 4*i):u32(c.buffers[1], 4*(i+1))]
+}
+
+// read checks the structure of an Arrow file, and returns its column names and
+// type ids, and the columns of each record batch.
+func read(t *testing.T, b []byte) ([]string, []int, [][]column) {
+	if !bytes.HasPrefix(b, []byte("ARROW1\x00\x00")) || !bytes.HasSuffix(b, []byte("ARROW1")) {
+		t.Fatal("Missing magic")
+	}
+	footerLen := u32(b, len(b)-10)
+	footer := root(b[len(b)-10-footerLen : len(b)-10])
+	if footer.field(0) == 0 || u16(footer.buf, footer.field(0)) != 4 {
+		t.Error("Footer should be version 5")
+	}
+	if footer.vectorLen(2) != 0 {
+		t.Error("Should have no dictionaries")
+	}
+	var names []string
+	var types []int
+	for _, f := range footer.table(1).tables(1) {
+		names = append(names, f.string(0))
+		types = append(types, int(f.buf[f.field(2)]))
+		if f.buf[f.field(1)] != 1 {
+			t.Error("Fields should be nullable", f.string(0))
+		}
+		if f.vectorLen(5) != 0 {
+			t.Error("Fields should have no children", f.string(0))
+		}
+	}
+
+	var batches [][]column
+	for _, bl := range footer.longs(3, 3) {
+		offset, metaLen, bodyLen := int(bl[0]), int(int32(bl[1])), int(bl[2])
+		if offset%8 != 0 || metaLen%8 != 0 || bodyLen%8 != 0 {
+			t.Errorf("Unaligned block %v", bl)
+		}
+		if uint32(u32(b, offset)) != 0xFFFFFFFF || u32(b, offset+4) != metaLen-8 {
+			t.Fatalf("Bad message prefix at %d", offset)
+		}
+		msg := root(b[offset+8 : offset+metaLen])
+		if msg.buf[msg.field(1)] != 3 || i64(msg.buf, msg.field(3)) != int64(bodyLen) {
+			t.Fatal("Not a record batch of the block's length")
+		}
+		rb := msg.table(2)
+		body := b[offset+metaLen : offset+metaLen+bodyLen]
+		length := i64(rb.buf, rb.field(0))
+		bufs := rb.longs(2, 2)
+		var cols []column
+		for _, node := range rb.longs(1, 2) {
+			if node[0] != length {
+				t.Error("Column length", node[0], "differs from batch length", length)
+			}
+			c := column{length: node[0], nulls: node[1]}
+			n := 2
+			if types[len(cols)] == 4 || types[len(cols)] == 5 {
+				n = 3
+			}
+			for _, buf := range bufs[:n] {
+				if buf[0]%8 != 0 {
+					t.Errorf("Unaligned buffer %v", buf)
+				}
+				c.buffers = append(c.buffers, body[buf[0]:buf[0]+buf[1]])
+			}
+			bufs = bufs[n:]
+			cols = append(cols, c)
+		}
+		batches = append(batches, cols)
+	}
+	return names, types, batches
+}
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := arrow.NewWriter(buf, &Row{})
+	rtx.Must(err, "Could not create writer")
+	w.BatchSize = 2
+	opt := int32(-7)
+	ts := time.Date(2019, 4, 2, 14, 12, 37, 511000000, time.UTC)
+	full := Row{
+		Flag: true, Small: -3, Neg: -1, Port: 9091, Float: 1.5, Double: 2.25, Data: []byte("abc"),
+		Array: [4]byte{1, 2, 3, 4}, Time: ts, Inner: Inner{Name: "in", Skip: 7, Big: math.MaxUint64},
+		Ptr: &Inner{Name: "ptr"}, Opt: &opt, Renamed: "r", hidden: 1,
+	}
+	rtx.Must(w.Append(&full), "Could not append")
+	rtx.Must(w.Append(Row{}), "Could not append")
+	rtx.Must(w.Append(full), "Could not append")
+	if err := w.Append(Inner{}); !errors.Is(err, arrow.ErrWrongType) {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+	rtx.Must(w.Close(), "Could not close")
+
+	names, types, batches := read(t, buf.Bytes())
+	wantNames := []string{"Flag", "Small", "Neg", "Port", "Float", "Double", "Data", "Array", "Time",
+		"Inner.Name", "Inner.Big", "Ptr.Name", "Ptr.Big", "Opt", "renamed"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("Columns %v, want %v", names, wantNames)
+	}
+	wantTypes := []int{6, 2, 2, 2, 3, 3, 4, 4, 10, 5, 2, 5, 2, 2, 5}
+	if !reflect.DeepEqual(types, wantTypes) {
+		t.Errorf("Types %v, want %v", types, wantTypes)
+	}
+	if len(batches) != 2 || batches[0][0].length != 2 || batches[1][0].length != 1 {
+		t.Fatal("Expected batches of 2 and 1 rows")
+	}
+
+	cols := batches[0]
+	col := func(name string) column {
+		for i, n := range names {
+			if n == name {
+				return cols[i]
+			}
+		}
+		t.Fatal("No column", name)
+		return column{}
+	}
+	if col("Flag").buffers[1][0] != 1 {
+		t.Error("Wrong Flag bits", col("Flag").buffers[1])
+	}
+	if !bytes.Equal(col("Small").buffers[1], []byte{0xFD, 0}) {
+		t.Error("Wrong Small", col("Small").buffers[1])
+	}
+	if i64(col("Neg").buffers[1], 0) != -1 || u16(col("Port").buffers[1], 0) != 9091 {
+		t.Error("Wrong Neg or Port")
+	}
+	if math.Float32frombits(uint32(u32(col("Float").buffers[1], 0))) != 1.5 ||
+		math.Float64frombits(uint64(i64(col("Double").buffers[1], 0))) != 2.25 {
+		t.Error("Wrong Float or Double")
+	}
+	if string(col("Data").bytes(0)) != "abc" || len(col("Data").bytes(1)) != 0 {
+		t.Error("Wrong Data")
+	}
+	if !bytes.Equal(col("Array").bytes(1), []byte{0, 0, 0, 0}) || col("Array").nulls != 0 {
+		t.Error("Wrong Array")
+	}
+	if c := col("Time"); c.nulls != 1 || !c.valid(0) || c.valid(1) || i64(c.buffers[1], 0) != ts.UnixMicro() {
+		t.Error("Time should be valid only in the first row")
+	}
+	if string(col("Inner.Name").bytes(0)) != "in" || uint64(i64(col("Inner.Big").buffers[1], 0)) != math.MaxUint64 {
+		t.Error("Wrong Inner")
+	}
+	if c := col("Ptr.Name"); c.nulls != 1 || c.valid(1) || string(c.bytes(0)) != "ptr" {
+		t.Error("Ptr.Name should be null in the second row")
+	}
+	if c := col("Opt"); c.nulls != 1 || int32(u32(c.buffers[1], 0)) != -7 || len(c.buffers[1]) != 8 {
+		t.Error("Wrong Opt", c)
+	}
+	if c := col("renamed"); c.nulls != 0 || len(c.buffers[0]) != 0 || string(c.bytes(0)) != "r" {
+		t.Error("Wrong renamed", c)
+	}
+	if string(batches[1][len(names)-1].bytes(0)) != "r" {
+		t.Error("Wrong second batch")
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := arrow.NewWriter(buf, Inner{})
+	rtx.Must(err, "Could not create writer")
+	rtx.Must(w.Close(), "Could not close")
+	names, _, batches := read(t, buf.Bytes())
+	if len(names) != 2 || len(batches) != 0 {
+		t.Error("Expected the schema without batches, got", names, len(batches))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	type withMap struct{ M map[string]int }
+	type withSlice struct{ S []int }
+	type withArray struct{ A [2]int }
+	for _, v := range []interface{}{nil, 1, time.Time{}, withMap{}, withSlice{}, withArray{}} {
+		_, err := arrow.NewWriter(&bytes.Buffer{}, v)
+		if !errors.Is(err, arrow.ErrUnsupportedType) {
+			t.Errorf("NewWriter(%T) = %v, want %v", v, err, arrow.ErrUnsupportedType)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package arrow
+
+import "encoding/binary"
+
+// builder builds a flatbuffer back to front, as the flatbuffers library does, so
+// that every object is complete before anything refers to it.  Offsets are
+// counted from the end of the buffer, and alignment is relative to the end, so
+// the finished buffer is padded to its largest alignment.
+type builder struct {
+	buf        []byte
+	minAlign   int
+	fields     []int // The offsets of the fields of the current table, or 0.
+	tableStart int
+}
+
+func newBuilder() *builder {
+	return &builder{minAlign: 1}
+}
+
+func (b *builder) offset() int {
+	return len(b.buf)
+}
+
+func (b *builder) prepend(p []byte) {
+	buf := make([]byte, len(p)+len(b.buf))
+	copy(buf, p)
+	copy(buf[len(p):], b.buf)
+	b.buf = buf
+}
+
+// prep pads the buffer so that an object of the given alignment is aligned once
+// additional bytes have been prepended.
+func (b *builder) prep(align, additional int) {
+	if align > b.minAlign {
+		b.minAlign = align
+	}
+	b.prepend(make([]byte, (-(len(b.buf) + additional))&(align-1)))
+}
+
+func (b *builder) uint8(v uint8) {
+	b.prep(1, 0)
+	b.prepend([]byte{v})
+}
+
+func (b *builder) uint16(v uint16) {
+	b.prep(2, 0)
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	b.prepend(buf[:])
+}
+
+func (b *builder) uint32(v uint32) {
+	b.prep(4, 0)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	b.prepend(buf[:])
+}
+
+func (b *builder) uint64(v uint64) {
+	b.prep(8, 0)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	b.prepend(buf[:])
+}
+
+// uoffset prepends a reference to the object at off.
+func (b *builder) uoffset(off int) {
+	b.prep(4, 0)
+	b.uint32(uint32(b.offset() + 4 - off))
+}
+
+func (b *builder) string(s string) int {
+	b.prep(4, len(s)+1)
+	b.prepend(append([]byte(s), 0))
+	b.uint32(uint32(len(s)))
+	return b.offset()
+}
+
+// vector prepends a vector of references to objects.
+func (b *builder) vector(offs []int) int {
+	b.prep(4, 4*len(offs))
+	for i := len(offs) - 1; i >= 0; i-- {
+		b.uoffset(offs[i])
+	}
+	b.uint32(uint32(len(offs)))
+	return b.offset()
+}
+
+// structs prepends a vector of n structs, already encoded in data.
+func (b *builder) structs(data []byte, n, align int) int {
+	b.prep(4, len(data))
+	b.prep(align, len(data))
+	b.prepend(data)
+	b.uint32(uint32(n))
+	return b.offset()
+}
+
+func (b *builder) startTable(n int) {
+	b.fields = make([]int, n)
+	b.tableStart = b.offset()
+}
+
+func (b *builder) addUint8(slot int, v uint8) {
+	b.uint8(v)
+	b.fields[slot] = b.offset()
+}
+
+func (b *builder) addInt16(slot int, v int16) {
+	b.uint16(uint16(v))
+	b.fields[slot] = b.offset()
+}
+
+func (b *builder) addInt32(slot int, v int32) {
+	b.uint32(uint32(v))
+	b.fields[slot] = b.offset()
+}
+
+func (b *builder) addInt64(slot int, v int64) {
+	b.uint64(uint64(v))
+	b.fields[slot] = b.offset()
+}
+
+func (b *builder) addBool(slot int, v bool) {
+	if v {
+		b.addUint8(slot, 1)
+	} else {
+		b.addUint8(slot, 0)
+	}
+}
+
+func (b *builder) addOffset(slot int, off int) {
+	b.uoffset(off)
+	b.fields[slot] = b.offset()
+}
+
+// endTable prepends the table's offset to its vtable, and the vtable, which
+// describes where each field is in the table.
+func (b *builder) endTable() int {
+	b.uint32(0)
+	obj := b.offset()
+	vt := make([]byte, 4+2*len(b.fields))
+	binary.LittleEndian.PutUint16(vt, uint16(len(vt)))
+	binary.LittleEndian.PutUint16(vt[2:], uint16(obj-b.tableStart))
+	for i, f := range b.fields {
+		if f != 0 {
+			binary.LittleEndian.PutUint16(vt[4+2*i:], uint16(obj-f))
+		}
+	}
+	b.prepend(vt)
+	binary.LittleEndian.PutUint32(b.buf[b.offset()-obj:], uint32(b.offset()-obj))
+	b.fields = nil
+	return obj
+}
+
+func (b *builder) finish(root int) []byte {
+	b.prep(b.minAlign, 4)
+	b.uoffset(root)
+	return b.buf
+}
+
+// The parts of the Arrow flatbuffer schema (Schema.fbs, Message.fbs and File.fbs)
+// that the Writer uses.
+const (
+	metadataV5 = 4
+
+	headerSchema      = 1
+	headerRecordBatch = 3
+
+	typeInt           = 2
+	typeFloatingPoint = 3
+	typeBinary        = 4
+	typeUtf8          = 5
+	typeBool          = 6
+	typeTimestamp     = 10
+
+	precisionSingle = 1
+	precisionDouble = 2
+
+	unitMicrosecond = 2
+)
+
+// fieldType prepends the type table of a column, and returns its offset.
+func (b *builder) fieldType(c *column) int {
+	var tz int
+	if c.typeID == typeTimestamp {
+		tz = b.string("UTC")
+	}
+	switch c.typeID {
+	case typeInt:
+		b.startTable(2)
+		b.addInt32(0, int32(8*c.width))
+		b.addBool(1, c.signed)
+	case typeFloatingPoint:
+		b.startTable(1)
+		if c.width == 4 {
+			b.addInt16(0, precisionSingle)
+		} else {
+			b.addInt16(0, precisionDouble)
+		}
+	case typeTimestamp:
+		b.startTable(2)
+		b.addOffset(1, tz)
+		b.addInt16(0, unitMicrosecond)
+	default:
+		b.startTable(0)
+	}
+	return b.endTable()
+}
+
+// schema prepends a Schema table for the columns, and returns its offset.
+func (b *builder) schema(columns []*column) int {
+	fields := make([]int, len(columns))
+	for i, c := range columns {
+		name := b.string(c.name)
+		typ := b.fieldType(c)
+		children := b.vector(nil)
+		b.startTable(7)
+		b.addOffset(0, name)
+		b.addOffset(3, typ)
+		b.addOffset(5, children)
+		b.addBool(1, true)
+		b.addUint8(2, c.typeID)
+		fields[i] = b.endTable()
+	}
+	vec := b.vector(fields)
+	b.startTable(4)
+	b.addOffset(1, vec)
+	b.addInt16(0, 0) // Little endian.
+	return b.endTable()
+}
+
+// message returns a Message flatbuffer with the given header.
+func (b *builder) message(headerType uint8, header int, bodyLength int64) []byte {
+	b.startTable(5)
+	b.addInt64(3, bodyLength)
+	b.addOffset(2, header)
+	b.addInt16(0, metadataV5)
+	b.addUint8(1, headerType)
+	return b.finish(b.endTable())
+}
+
+// schemaMessage returns the Message flatbuffer for the schema of the columns.
+func schemaMessage(columns []*column) []byte {
+	b := newBuilder()
+	return b.message(headerSchema, b.schema(columns), 0)
+}
+
+// fieldNode is the length and null count of a column in a record batch.
+type fieldNode struct {
+	length, nulls int64
+}
+
+// bufferSpan is the location of a buffer in the body of a record batch.
+type bufferSpan struct {
+	offset, length int64
+}
+
+// recordBatchMessage returns the Message flatbuffer for a record batch.
+func recordBatchMessage(length int64, nodes []fieldNode, buffers []bufferSpan, bodyLength int64) []byte {
+	b := newBuilder()
+	var data []byte
+	for _, bs := range buffers {
+		data = appendUint64(data, uint64(bs.offset))
+		data = appendUint64(data, uint64(bs.length))
+	}
+	bufs := b.structs(data, len(buffers), 8)
+	data = nil
+	for _, n := range nodes {
+		data = appendUint64(data, uint64(n.length))
+		data = appendUint64(data, uint64(n.nulls))
+	}
+	nds := b.structs(data, len(nodes), 8)
+	b.startTable(5)
+	b.addInt64(0, length)
+	b.addOffset(1, nds)
+	b.addOffset(2, bufs)
+	rb := b.endTable()
+	return b.message(headerRecordBatch, rb, bodyLength)
+}
+
+// block is the location of a record batch in a file.
+type block struct {
+	offset     int64
+	metaLength int32
+	bodyLength int64
+}
+
+// footer returns the Footer flatbuffer of a file.
+func footer(columns []*column, blocks []block) []byte {
+	b := newBuilder()
+	var data []byte
+	for _, bl := range blocks {
+		data = appendUint64(data, uint64(bl.offset))
+		data = appendUint32(data, uint32(bl.metaLength))
+		data = appendUint32(data, 0) // padding
+		data = appendUint64(data, uint64(bl.bodyLength))
+	}
+	batches := b.structs(data, len(blocks), 8)
+	dicts := b.structs(nil, 0, 8)
+	schema := b.schema(columns)
+	b.startTable(5)
+	b.addOffset(1, schema)
+	b.addOffset(2, dicts)
+	b.addOffset(3, batches)
+	b.addInt16(0, metadataV5)
+	return b.finish(b.endTable())
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
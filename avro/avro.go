@@ -0,0 +1,354 @@
+// Package avro writes Avro object container files, for data platforms that
+// prefer Avro to JSON.  The schema is derived from a Go struct type, and embedded
+// in the header of each file, so files are self-describing.
+//
+// Go types map to Avro types as follows:
+//   - bool to boolean, float32 to float, and float64 to double.
+//   - Signed and unsigned integers of up to 16 bits, and int32, to int.
+//   - Other integers to long.  uint64 values above MaxInt64 wrap, like the
+//     cookies in inetdiag.SockID.
+//   - string to string, and []byte and byte arrays to bytes.
+//   - time.Time to long, with the timestamp-micros logical type.
+//   - Slices to arrays, and pointers to unions with null.
+//   - Structs to records named after the type, in a namespace named after the
+//     package.  Exported fields are named as for encoding/json, and fields
+//     tagged json:"-" are omitted.
+package avro
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Codecs for the blocks of a container file.
+const (
+	Null    = "null"
+	Deflate = "deflate"
+)
+
+// Errors returned by the package.
+var (
+	ErrUnsupportedType = errors.New("type has no Avro equivalent")
+	ErrUnknownCodec    = errors.New("unknown codec")
+	ErrWrongType       = errors.New("value does not match the schema type")
+)
+
+// DefaultBlockSize is the default uncompressed size at which blocks are written.
+const DefaultBlockSize = 64 * 1024
+
+var (
+	magic    = []byte("Obj\x01")
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// encoder appends the Avro binary encoding of v to b.
+type encoder func(b []byte, v reflect.Value) []byte
+
+// compiler derives schemas and encoders for types, defining each record type once.
+type compiler struct {
+	records map[reflect.Type]encoder
+}
+
+// Schema returns the Avro schema for a struct type, in JSON.
+func Schema(t reflect.Type) ([]byte, error) {
+	schema, _, err := compile(t)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(schema)
+}
+
+// compile returns the schema and encoder for a struct type.
+func compile(t reflect.Type) (interface{}, encoder, error) {
+	if t.Kind() != reflect.Struct || t == timeType {
+		return nil, nil, fmt.Errorf("%w: %v is not a record", ErrUnsupportedType, t)
+	}
+	c := compiler{records: make(map[reflect.Type]encoder)}
+	return c.compile(t)
+}
+
+func (c *compiler) compile(t reflect.Type) (interface{}, encoder, error) {
+	if t == timeType {
+		schema := map[string]string{"type": "long", "logicalType": "timestamp-micros"}
+		return schema, func(b []byte, v reflect.Value) []byte {
+			return appendLong(b, v.Interface().(time.Time).UnixMicro())
+		}, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean", func(b []byte, v reflect.Value) []byte {
+			if v.Bool() {
+				return append(b, 1)
+			}
+			return append(b, 0)
+		}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return "int", appendInt, nil
+	case reflect.Int, reflect.Int64:
+		return "long", appendInt, nil
+	case reflect.Uint8, reflect.Uint16:
+		return "int", appendUint, nil
+	case reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "long", appendUint, nil
+	case reflect.Float32:
+		return "float", func(b []byte, v reflect.Value) []byte {
+			var buf [4]byte
+			binary.LittleEndian.PutUint32(buf[:], math.Float32bits(float32(v.Float())))
+			return append(b, buf[:]...)
+		}, nil
+	case reflect.Float64:
+		return "double", func(b []byte, v reflect.Value) []byte {
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v.Float()))
+			return append(b, buf[:]...)
+		}, nil
+	case reflect.String:
+		return "string", func(b []byte, v reflect.Value) []byte {
+			b = appendLong(b, int64(v.Len()))
+			return append(b, v.String()...)
+		}, nil
+	case reflect.Array, reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes", appendBytes, nil
+		}
+		if t.Kind() == reflect.Array {
+			break
+		}
+		items, enc, err := c.compile(t.Elem())
+		if err != nil {
+			return nil, nil, err
+		}
+		schema := map[string]interface{}{"type": "array", "items": items}
+		return schema, func(b []byte, v reflect.Value) []byte {
+			if v.Len() > 0 {
+				b = appendLong(b, int64(v.Len()))
+				for i := 0; i < v.Len(); i++ {
+					b = enc(b, v.Index(i))
+				}
+			}
+			return appendLong(b, 0)
+		}, nil
+	case reflect.Ptr:
+		elem, enc, err := c.compile(t.Elem())
+		if err != nil {
+			return nil, nil, err
+		}
+		return []interface{}{"null", elem}, func(b []byte, v reflect.Value) []byte {
+			if v.IsNil() {
+				return appendLong(b, 0)
+			}
+			return enc(appendLong(b, 1), v.Elem())
+		}, nil
+	case reflect.Struct:
+		return c.record(t)
+	}
+	return nil, nil, fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+}
+
+// record returns the schema and encoder for a struct type.  Types that were
+// already defined are referred to by name.
+func (c *compiler) record(t reflect.Type) (interface{}, encoder, error) {
+	if t.Name() == "" {
+		return nil, nil, fmt.Errorf("%w: anonymous struct", ErrUnsupportedType)
+	}
+	name := t.Name()
+	namespace := strings.NewReplacer("-", "_", ".", "_").Replace(path.Base(t.PkgPath()))
+	if _, ok := c.records[t]; ok {
+		// Look up the encoder when it is used, since a recursive type is
+		// still being compiled here.
+		return namespace + "." + name, func(b []byte, v reflect.Value) []byte {
+			return c.records[t](b, v)
+		}, nil
+	}
+	c.records[t] = nil
+
+	var fields []interface{}
+	var index []int
+	var encs []encoder
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		fieldName := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			fieldName = tag
+		}
+		schema, enc, err := c.compile(f.Type)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+		field := map[string]interface{}{"name": fieldName, "type": schema}
+		if f.Type.Kind() == reflect.Ptr {
+			field["default"] = nil
+		}
+		fields = append(fields, field)
+		index = append(index, i)
+		encs = append(encs, enc)
+	}
+	enc := func(b []byte, v reflect.Value) []byte {
+		for i, e := range encs {
+			b = e(b, v.Field(index[i]))
+		}
+		return b
+	}
+	c.records[t] = enc
+	schema := map[string]interface{}{
+		"type":      "record",
+		"name":      name,
+		"namespace": namespace,
+		"fields":    fields,
+	}
+	return schema, enc, nil
+}
+
+// appendLong appends the zig-zag varint encoding used for Avro int and long.
+func appendLong(b []byte, x int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+func appendInt(b []byte, v reflect.Value) []byte {
+	return appendLong(b, v.Int())
+}
+
+func appendUint(b []byte, v reflect.Value) []byte {
+	return appendLong(b, int64(v.Uint()))
+}
+
+func appendBytes(b []byte, v reflect.Value) []byte {
+	b = appendLong(b, int64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		b = append(b, byte(v.Index(i).Uint()))
+	}
+	return b
+}
+
+// Writer writes values of a single struct type to an Avro object container file.
+type Writer struct {
+	// BlockSize is the uncompressed size at which a block of values is written.
+	BlockSize int
+
+	w     io.Writer
+	t     reflect.Type
+	enc   encoder
+	codec string
+	sync  [16]byte
+	block []byte
+	count int
+}
+
+// NewWriter writes the header of a container file for values of the same type as
+// v, which must be a struct or a pointer to one, and returns a Writer for the values.
+// The codec must be Null or Deflate.
+func NewWriter(w io.Writer, v interface{}, codec string) (*Writer, error) {
+	if codec != Null && codec != Deflate {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, codec)
+	}
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return nil, ErrUnsupportedType
+	}
+	schema, enc, err := compile(t)
+	if err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	aw := &Writer{BlockSize: DefaultBlockSize, w: w, t: t, enc: enc, codec: codec}
+	_, err = rand.Read(aw.sync[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The header is the magic, the file metadata as a map of bytes, and the sync marker.
+	header := append([]byte{}, magic...)
+	header = appendLong(header, 2)
+	for _, kv := range [][2]string{{"avro.schema", string(js)}, {"avro.codec", codec}} {
+		header = appendLong(header, int64(len(kv[0])))
+		header = append(header, kv[0]...)
+		header = appendLong(header, int64(len(kv[1])))
+		header = append(header, kv[1]...)
+	}
+	header = appendLong(header, 0)
+	header = append(header, aw.sync[:]...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// Append adds v, which must be of the Writer's type or a pointer to it, to the
+// current block, and writes the block if it has reached the BlockSize.
+func (w *Writer) Append(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() || rv.Type() != w.t {
+		return fmt.Errorf("%w: %T", ErrWrongType, v)
+	}
+	w.block = w.enc(w.block, rv)
+	w.count++
+	if len(w.block) >= w.BlockSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes the current block, if it is not empty.
+func (w *Writer) Flush() error {
+	if w.count == 0 {
+		return nil
+	}
+	data := w.block
+	if w.codec == Deflate {
+		buf := bytes.Buffer{}
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(data)
+		if err != nil {
+			return err
+		}
+		err = fw.Close()
+		if err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	b := appendLong(nil, int64(w.count))
+	b = appendLong(b, int64(len(data)))
+	b = append(b, data...)
+	b = append(b, w.sync[:]...)
+	w.block = w.block[:0]
+	w.count = 0
+	_, err := w.w.Write(b)
+	return err
+}
+
+// Close writes any buffered values.  It does not close the underlying io.Writer.
+func (w *Writer) Close() error {
+	return w.Flush()
+}
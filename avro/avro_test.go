@@ -0,0 +1,184 @@
+package avro_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/avro"
+)
+
+type Inner struct {
+	Count uint32
+}
+
+type Record struct {
+	Name    string `json:"name"`
+	Flag    bool
+	Small   uint8
+	Big     int64
+	Time    time.Time
+	Raw     [2]byte
+	Inner   *Inner
+	List    []Inner
+	Ignored string `json:"-"`
+	private int
+}
+
+// reader decodes the parts of the Avro binary encoding used by the tests.
+type reader struct {
+	t *testing.T
+	b []byte
+}
+
+func (r *reader) long() int64 {
+	x, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.t.Fatal("Bad varint")
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *reader) bytes() []byte {
+	n := r.long()
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *reader) fixed(n int) []byte {
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func TestSchema(t *testing.T) {
+	js, err := avro.Schema(reflect.TypeOf(Record{}))
+	rtx.Must(err, "Could not make schema")
+	var schema struct {
+		Type      string
+		Name      string
+		Namespace string
+		Fields    []struct {
+			Name string
+			Type interface{}
+		}
+	}
+	rtx.Must(json.Unmarshal(js, &schema), "Could not parse schema")
+	if schema.Type != "record" || schema.Name != "Record" || schema.Namespace != "avro_test" {
+		t.Errorf("Wrong schema %s", js)
+	}
+	names := []string{}
+	for _, f := range schema.Fields {
+		names = append(names, f.Name)
+	}
+	want := []string{"name", "Flag", "Small", "Big", "Time", "Raw", "Inner", "List"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Wrong fields %v, want %v", names, want)
+	}
+	// The second use of Inner refers to the first by name.
+	list := schema.Fields[7].Type.(map[string]interface{})
+	if list["items"] != "avro_test.Inner" {
+		t.Errorf("Wrong list items %s", js)
+	}
+
+	_, err = avro.Schema(reflect.TypeOf(struct{ C chan int }{}))
+	if !errors.Is(err, avro.ErrUnsupportedType) {
+		t.Error("Expected ErrUnsupportedType, got", err)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	for _, codec := range []string{avro.Null, avro.Deflate} {
+		buf := bytes.Buffer{}
+		w, err := avro.NewWriter(&buf, &Record{}, codec)
+		rtx.Must(err, "Could not create writer")
+		ts := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+		rtx.Must(w.Append(Record{Name: "a", Flag: true, Small: 200, Big: -3, Time: ts, Raw: [2]byte{1, 2},
+			Inner: &Inner{Count: 7}, List: []Inner{{1}, {2}}}), "Could not append")
+		rtx.Must(w.Append(&Record{Name: "b"}), "Could not append")
+		if err := w.Append(Inner{}); !errors.Is(err, avro.ErrWrongType) {
+			t.Error("Expected ErrWrongType, got", err)
+		}
+		rtx.Must(w.Close(), "Could not close")
+
+		r := reader{t: t, b: buf.Bytes()}
+		if string(r.fixed(4)) != "Obj\x01" {
+			t.Fatal("Bad magic")
+		}
+		meta := map[string]string{}
+		for n := r.long(); n > 0; n = r.long() {
+			for ; n > 0; n-- {
+				k := string(r.bytes())
+				meta[k] = string(r.bytes())
+			}
+		}
+		if meta["avro.codec"] != codec {
+			t.Error("Wrong codec", meta["avro.codec"])
+		}
+		js, err := avro.Schema(reflect.TypeOf(Record{}))
+		rtx.Must(err, "Could not make schema")
+		if meta["avro.schema"] != string(js) {
+			t.Error("Wrong embedded schema", meta["avro.schema"])
+		}
+		sync := r.fixed(16)
+
+		if n := r.long(); n != 2 {
+			t.Fatal("Expected 2 records, got", n)
+		}
+		data := r.bytes()
+		if !bytes.Equal(r.fixed(16), sync) || len(r.b) != 0 {
+			t.Fatal("Bad block trailer")
+		}
+		if codec == avro.Deflate {
+			data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+			rtx.Must(err, "Could not inflate")
+		}
+
+		d := reader{t: t, b: data}
+		got := []interface{}{
+			string(d.bytes()), d.fixed(1)[0], d.long(), d.long(), d.long(), d.bytes(),
+			d.long(), d.long(), // Inner union branch, and Count.
+			d.long(), d.long(), d.long(), d.long(), // List of 2, and the end of the list.
+		}
+		want := []interface{}{
+			"a", byte(1), int64(200), int64(-3), ts.UnixMicro(), []byte{1, 2},
+			int64(1), int64(7),
+			int64(2), int64(1), int64(2), int64(0),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+		// The second record is mostly zero, with a null Inner and an empty List.
+		if string(d.bytes()) != "b" || d.fixed(1)[0] != 0 {
+			t.Error("Wrong second record")
+		}
+		d.long()
+		d.long()
+		if d.long() != (time.Time{}).UnixMicro() {
+			t.Error("Wrong zero time")
+		}
+		if len(d.bytes()) != 2 || d.long() != 0 || d.long() != 0 || len(d.b) != 0 {
+			t.Error("Wrong second record")
+		}
+	}
+}
+
+func TestNewWriterErrors(t *testing.T) {
+	_, err := avro.NewWriter(ioutil.Discard, Record{}, "snappy")
+	if !errors.Is(err, avro.ErrUnknownCodec) {
+		t.Error("Expected ErrUnknownCodec, got", err)
+	}
+	_, err = avro.NewWriter(ioutil.Discard, 3, avro.Null)
+	if !errors.Is(err, avro.ErrUnsupportedType) {
+		t.Error("Expected ErrUnsupportedType, got", err)
+	}
+}
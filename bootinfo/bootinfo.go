@@ -0,0 +1,95 @@
+// Package bootinfo reads the identity of the current boot of the host, its kernel
+// release, and the clocks used for timestamps, so that connection UUIDs (which embed the boot
+// time) and timelines can be validated against other datasets from the host.
+package bootinfo
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock is the clock used for snapshot timestamps, which come from time.Now.
+const Clock = "CLOCK_REALTIME"
+
+// ErrNoBootTime is returned when the boot time is missing from /proc/stat.
+var ErrNoBootTime = errors.New("no btime in /proc/stat")
+
+// The files the Info is read from.  These are variables so that tests may
+// replace them.
+var (
+	BootIDFile      = "/proc/sys/kernel/random/boot_id"
+	StatFile        = "/proc/stat"
+	ClockSourceFile = "/sys/devices/system/clocksource/clocksource0/current_clocksource"
+	OSReleaseFile   = "/proc/sys/kernel/osrelease"
+)
+
+// Info describes the current boot of the host.
+type Info struct {
+	ID          string    // The kernel's random boot id.
+	Time        time.Time // The time the host booted, to the second.
+	ClockSource string    // The kernel clocksource, e.g. "tsc".
+	Kernel      string    // The kernel release, e.g. "5.15.0-91-generic".
+}
+
+// Read returns the Info for the current boot.  If some of it cannot be read, it
+// returns the fields that could be read, along with the first error.
+func Read() (Info, error) {
+	var info Info
+	var errs []error
+	b, err := ioutil.ReadFile(BootIDFile)
+	if err == nil {
+		info.ID = strings.TrimSpace(string(b))
+	} else {
+		errs = append(errs, err)
+	}
+	info.Time, err = bootTime()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	b, err = ioutil.ReadFile(ClockSourceFile)
+	if err == nil {
+		info.ClockSource = strings.TrimSpace(string(b))
+	} else {
+		errs = append(errs, err)
+	}
+	b, err = ioutil.ReadFile(OSReleaseFile)
+	if err == nil {
+		info.Kernel = strings.TrimSpace(string(b))
+	} else {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return info, errs[0]
+	}
+	return info, nil
+}
+
+// bootTime reads the boot time from the btime line of StatFile.
+func bootTime() (time.Time, error) {
+	f, err := os.Open(StatFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 || fields[0] != "btime" {
+			continue
+		}
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	if err := s.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, ErrNoBootTime
+}
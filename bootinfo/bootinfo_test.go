@@ -0,0 +1,53 @@
+package bootinfo_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/bootinfo"
+)
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRead")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	defer func(id, stat, cs, release string) {
+		bootinfo.BootIDFile, bootinfo.StatFile, bootinfo.ClockSourceFile, bootinfo.OSReleaseFile = id, stat, cs, release
+	}(bootinfo.BootIDFile, bootinfo.StatFile, bootinfo.ClockSourceFile, bootinfo.OSReleaseFile)
+
+	bootinfo.BootIDFile = filepath.Join(dir, "boot_id")
+	bootinfo.StatFile = filepath.Join(dir, "stat")
+	bootinfo.ClockSourceFile = filepath.Join(dir, "current_clocksource")
+	bootinfo.OSReleaseFile = filepath.Join(dir, "osrelease")
+	rtx.Must(ioutil.WriteFile(bootinfo.BootIDFile, []byte("b7df2df8-954a-4846-bf1f-c1a87bb0df69\n"), 0644), "Could not write")
+	rtx.Must(ioutil.WriteFile(bootinfo.StatFile, []byte("cpu  1 2 3 4\nbtime 1600000000\nprocesses 10\n"), 0644), "Could not write")
+	rtx.Must(ioutil.WriteFile(bootinfo.ClockSourceFile, []byte("tsc\n"), 0644), "Could not write")
+	rtx.Must(ioutil.WriteFile(bootinfo.OSReleaseFile, []byte("5.15.0-91-generic\n"), 0644), "Could not write")
+
+	info, err := bootinfo.Read()
+	rtx.Must(err, "Could not read")
+	want := bootinfo.Info{
+		ID:          "b7df2df8-954a-4846-bf1f-c1a87bb0df69",
+		Time:        time.Unix(1600000000, 0).UTC(),
+		ClockSource: "tsc",
+		Kernel:      "5.15.0-91-generic",
+	}
+	if info != want {
+		t.Errorf("Read() = %+v, want %+v", info, want)
+	}
+
+	// Missing files result in partial info and an error.
+	rtx.Must(os.Remove(bootinfo.ClockSourceFile), "Could not remove")
+	rtx.Must(ioutil.WriteFile(bootinfo.StatFile, []byte("cpu  1 2 3 4\n"), 0644), "Could not write")
+	info, err = bootinfo.Read()
+	if err != bootinfo.ErrNoBootTime {
+		t.Error("Expected ErrNoBootTime, got", err)
+	}
+	if info.ID != want.ID || !info.Time.IsZero() || info.ClockSource != "" || info.Kernel != want.Kernel {
+		t.Errorf("Wrong partial info %+v", info)
+	}
+}
@@ -0,0 +1,353 @@
+// Package browse provides a web interface for browsing the archive tree written
+// by tcp-info, without any tools other than a browser.  It lists the connections
+// recorded on each day, charts the RTT, congestion window and throughput of each
+// connection, and links to the raw JSONL records.
+//
+// The pages are rendered on the server, with the charts as inline SVG, so the
+// interface has no JavaScript or external dependencies.
+package browse
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// Size of the charts, in pixels.
+const (
+	chartWidth  = 720
+	chartHeight = 160
+)
+
+type handler struct {
+	root string
+}
+
+// NewHandler returns an http.Handler serving the archive tree under root.
+//
+//	/                      the days with recorded connections
+//	/day/<dir>             the connections recorded in a day directory
+//	/conn/<dir>/<uuid>     the charts of a connection
+//	/raw/<dir>/<file>      the decompressed JSONL records of a connection file
+func NewHandler(root string) http.Handler {
+	h := &handler{root: root}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.days)
+	mux.HandleFunc("/day/", h.day)
+	mux.HandleFunc("/conn/", h.conn)
+	mux.HandleFunc("/raw/", h.raw)
+	return mux
+}
+
+// isConnectionFile returns whether name is a connection file, rather than e.g. a
+// daily index or rollup file.
+func isConnectionFile(name string) bool {
+	ok, _ := filepath.Match("*.[0-9][0-9][0-9][0-9][0-9].jsonl.zst", name)
+	return ok
+}
+
+// uuidOf returns the connection UUID of a connection file name.
+func uuidOf(name string) string {
+	name = strings.TrimSuffix(name, ".jsonl.zst")
+	return name[:strings.LastIndexByte(name, '.')]
+}
+
+// local returns the file path of a slash separated path relative to the root.
+// The path is cleaned, so it cannot refer to anything outside the root.
+func (h *handler) local(p string) (string, string) {
+	p = path.Clean("/" + p)[1:]
+	return p, filepath.Join(h.root, filepath.FromSlash(p))
+}
+
+// connectionFiles returns the connection files of a directory, by UUID, in sequence order.
+func connectionFiles(dir string) (map[string][]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]string)
+	for _, e := range entries {
+		if !e.IsDir() && isConnectionFile(e.Name()) {
+			u := uuidOf(e.Name())
+			files[u] = append(files[u], e.Name())
+		}
+	}
+	for _, names := range files {
+		sort.Strings(names)
+	}
+	return files, nil
+}
+
+type dayInfo struct {
+	Dir         string
+	Connections int
+}
+
+// days lists the directories that hold connection files, most recent first.
+func (h *handler) days(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	uuids := make(map[string]map[string]bool)
+	err := filepath.Walk(h.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isConnectionFile(info.Name()) {
+			return err
+		}
+		dir, err := filepath.Rel(h.root, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		dir = filepath.ToSlash(dir)
+		if uuids[dir] == nil {
+			uuids[dir] = make(map[string]bool)
+		}
+		uuids[dir][uuidOf(info.Name())] = true
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var days []dayInfo
+	for dir, u := range uuids {
+		days = append(days, dayInfo{Dir: dir, Connections: len(u)})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Dir > days[j].Dir })
+	render(w, daysTemplate, days)
+}
+
+type connInfo struct {
+	UUID  string
+	Files int
+	Size  int64
+}
+
+// day lists the connections of a day directory.
+func (h *handler) day(w http.ResponseWriter, r *http.Request) {
+	rel, dir := h.local(strings.TrimPrefix(r.URL.Path, "/day/"))
+	files, err := connectionFiles(dir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var conns []connInfo
+	for u, names := range files {
+		c := connInfo{UUID: u, Files: len(names)}
+		for _, name := range names {
+			if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				c.Size += info.Size()
+			}
+		}
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].UUID < conns[j].UUID })
+	render(w, dayTemplate, struct {
+		Dir         string
+		Connections []connInfo
+	}{rel, conns})
+}
+
+// chart is a line chart of a time series, as an SVG polyline.
+type chart struct {
+	Title  string
+	Max    string
+	Points string
+}
+
+func newChart(title, unit string, times []time.Time, values []float64) chart {
+	max := 0.0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	c := chart{Title: title, Max: strconv.FormatFloat(max, 'g', 4, 64) + " " + unit}
+	if len(times) == 0 {
+		return c
+	}
+	span := times[len(times)-1].Sub(times[0]).Seconds()
+	points := make([]string, len(values))
+	for i, v := range values {
+		x, y := 0.0, float64(chartHeight)
+		if span > 0 {
+			x = times[i].Sub(times[0]).Seconds() / span * chartWidth
+		}
+		if max > 0 {
+			y -= v / max * chartHeight
+		}
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	c.Points = strings.Join(points, " ")
+	return c
+}
+
+// charts returns the RTT, congestion window and throughput charts of the snapshots.
+// Throughput is the rate of bytes acknowledged and received between snapshots.
+func charts(snaps []*snapshot.Snapshot) []chart {
+	var times, tputTimes []time.Time
+	var rtt, cwnd, tput []float64
+	var prev *snapshot.Snapshot
+	for _, s := range snaps {
+		if s.TCPInfo == nil {
+			continue
+		}
+		times = append(times, s.Timestamp)
+		rtt = append(rtt, float64(s.TCPInfo.RTT)/1000)
+		cwnd = append(cwnd, float64(s.TCPInfo.SndCwnd))
+		if prev != nil {
+			dt := s.Timestamp.Sub(prev.Timestamp).Seconds()
+			bytes := s.TCPInfo.BytesAcked + s.TCPInfo.BytesReceived - prev.TCPInfo.BytesAcked - prev.TCPInfo.BytesReceived
+			if dt > 0 {
+				tputTimes = append(tputTimes, s.Timestamp)
+				tput = append(tput, float64(bytes)*8/dt/1e6)
+			}
+		}
+		prev = s
+	}
+	return []chart{
+		newChart("RTT", "ms", times, rtt),
+		newChart("Congestion window", "packets", times, cwnd),
+		newChart("Throughput", "Mbit/s", tputTimes, tput),
+	}
+}
+
+// conn renders the charts of a connection.
+func (h *handler) conn(w http.ResponseWriter, r *http.Request) {
+	rel, p := h.local(strings.TrimPrefix(r.URL.Path, "/conn/"))
+	dir, uuid := path.Dir(rel), path.Base(rel)
+	files, err := connectionFiles(filepath.Dir(p))
+	if err != nil || len(files[uuid]) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	var meta *netlink.Metadata
+	var snaps []*snapshot.Snapshot
+	for _, name := range files[uuid] {
+		rdr := zstd.NewReader(filepath.Join(filepath.Dir(p), name))
+		m, s, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+		rdr.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not read %s: %v", name, err), http.StatusInternalServerError)
+			return
+		}
+		if meta == nil {
+			meta = m
+		}
+		snaps = append(snaps, s...)
+	}
+	data := struct {
+		Dir, UUID   string
+		Files       []string
+		Snapshots   int
+		Start, End  time.Time
+		Socket      string
+		Congestion  string
+		Charts      []chart
+		Width       int
+		ChartHeight int
+	}{Dir: dir, UUID: uuid, Files: files[uuid], Snapshots: len(snaps), Charts: charts(snaps),
+		Width: chartWidth, ChartHeight: chartHeight + 2}
+	if meta != nil {
+		data.Start = meta.StartTime
+	}
+	if len(snaps) > 0 {
+		last := snaps[len(snaps)-1]
+		data.End = last.Timestamp
+		if data.Start.IsZero() {
+			data.Start = snaps[0].Timestamp
+		}
+		if last.InetDiagMsg != nil {
+			id := last.InetDiagMsg.ID.GetSockID()
+			data.Socket = fmt.Sprintf("%s:%d - %s:%d", id.SrcIP, id.SPort, id.DstIP, id.DPort)
+		}
+		for _, s := range snaps {
+			if s.CongestionAlgorithm != "" {
+				data.Congestion = s.CongestionAlgorithm
+			}
+		}
+	}
+	render(w, connTemplate, data)
+}
+
+// raw serves the decompressed records of a connection file.
+func (h *handler) raw(w http.ResponseWriter, r *http.Request) {
+	_, p := h.local(strings.TrimPrefix(r.URL.Path, "/raw/"))
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() || !isConnectionFile(info.Name()) {
+		http.NotFound(w, r)
+		return
+	}
+	rdr := zstd.NewReader(p)
+	defer rdr.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, rdr)
+}
+
+func render(w http.ResponseWriter, t *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := t.Execute(w, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+const layout = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>tcp-info</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+svg { border: 1px solid #ccc; margin-bottom: 1em; }
+</style></head>
+<body><p><a href="/">tcp-info archive</a></p>
+{{template "body" .}}
+</body></html>`
+
+func page(body string) *template.Template {
+	t := template.Must(template.New("layout").Parse(layout))
+	return template.Must(t.New("body").Parse(body))
+}
+
+var daysTemplate = page(`
+<h1>Days</h1>
+{{if not .}}<p>No connection files were found.</p>{{end}}
+<table>
+<tr><th>Directory</th><th>Connections</th></tr>
+{{range .}}<tr><td><a href="/day/{{.Dir}}">{{.Dir}}</a></td><td>{{.Connections}}</td></tr>
+{{end}}</table>`)
+
+var dayTemplate = page(`
+<h1>{{.Dir}}</h1>
+<table>
+<tr><th>Connection</th><th>Files</th><th>Bytes</th></tr>
+{{range .Connections}}<tr><td><a href="/conn/{{$.Dir}}/{{.UUID}}">{{.UUID}}</a></td><td>{{.Files}}</td><td>{{.Size}}</td></tr>
+{{end}}</table>`)
+
+var connTemplate = page(`
+<h1>{{.UUID}}</h1>
+<table>
+<tr><th>Socket</th><td>{{.Socket}}</td></tr>
+<tr><th>Congestion control</th><td>{{.Congestion}}</td></tr>
+<tr><th>Start</th><td>{{.Start}}</td></tr>
+<tr><th>Last snapshot</th><td>{{.End}}</td></tr>
+<tr><th>Snapshots</th><td>{{.Snapshots}}</td></tr>
+<tr><th>Raw JSON</th><td>{{range .Files}}<a href="/raw/{{$.Dir}}/{{.}}">{{.}}</a> {{end}}</td></tr>
+</table>
+{{range .Charts}}
+<h2>{{.Title}} <small>(max {{.Max}})</small></h2>
+<svg width="{{$.Width}}" height="{{$.ChartHeight}}" viewBox="0 -1 {{$.Width}} {{$.ChartHeight}}">
+<polyline fill="none" stroke="steelblue" stroke-width="1.5" points="{{.Points}}"/>
+</svg>
+{{end}}`)
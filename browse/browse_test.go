@@ -0,0 +1,72 @@
+package browse_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/browse"
+)
+
+const (
+	uuid     = "ndt-jdczh_1553815964_00000000000003E8"
+	testFile = "../cmd/csvtool/testdata/" + uuid + ".00183.jsonl.zst"
+)
+
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBrowse")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	day := filepath.Join(dir, "2019", "04", "01")
+	rtx.Must(os.MkdirAll(day, 0755), "Could not create day dir")
+	data, err := ioutil.ReadFile(testFile)
+	rtx.Must(err, "Could not read test file")
+	rtx.Must(ioutil.WriteFile(filepath.Join(day, uuid+".00183.jsonl.zst"), data, 0644), "Could not write")
+	rtx.Must(ioutil.WriteFile(filepath.Join(day, uuid+".00184.jsonl.zst"), data, 0644), "Could not write")
+	rtx.Must(ioutil.WriteFile(filepath.Join(day, "20190401T000000Z_index.jsonl.zst"), nil, 0644), "Could not write")
+
+	h := browse.NewHandler(dir)
+	tests := []struct {
+		path string
+		code int
+		want []string
+	}{
+		{"/", http.StatusOK, []string{`href="/day/2019/04/01"`, "<td>1</td>"}},
+		{"/day/2019/04/01", http.StatusOK, []string{`href="/conn/2019/04/01/` + uuid + `"`, "<td>2</td>"}},
+		{"/conn/2019/04/01/" + uuid, http.StatusOK, []string{
+			"192.168.14.134", "<td>302</td>", "RTT", "Congestion window", "Throughput", "<polyline",
+			`href="/raw/2019/04/01/` + uuid + `.00184.jsonl.zst"`,
+		}},
+		{"/raw/2019/04/01/" + uuid + ".00183.jsonl.zst", http.StatusOK, []string{`"UUID":"` + uuid + `"`}},
+		{"/day/2019/04/02", http.StatusNotFound, nil},
+		{"/conn/2019/04/01/unknown", http.StatusNotFound, nil},
+		{"/raw/2019/04/01/20190401T000000Z_index.jsonl.zst", http.StatusNotFound, nil},
+		// The mux redirects to the cleaned path.
+		{"/raw/../../../etc/passwd", http.StatusMovedPermanently, nil},
+		{"/favicon.ico", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		rec := get(h, tt.path)
+		if rec.Code != tt.code {
+			t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.code)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(rec.Body.String(), w) {
+				t.Errorf("GET %s is missing %q", tt.path, w)
+			}
+		}
+	}
+}
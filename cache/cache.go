@@ -1,9 +1,11 @@
 // Package cache keeps a cache of connection info records.
-// Cache is NOT threadsafe.
+// Cache is NOT threadsafe, except for Records, which may be called concurrently
+// with the other methods.
 package cache
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
@@ -16,19 +18,51 @@ var (
 	ErrUnknownMessageType  = errors.New("Unknown netlink message type")
 )
 
+// entry holds the most recent record for a connection, and the cycle in which
+// it was last updated.  Entries are kept in a doubly linked list ordered by the
+// last update, so that EndCycle only needs to visit the stale entries.
+type entry struct {
+	cookie     uint64
+	record     *netlink.ArchivalRecord
+	seen       int64 // The cycle in which the record was last updated.
+	prev, next *entry
+}
+
 // Cache is a cache of all connection status.
 type Cache struct {
-	// Map from inode to ArchivalRecord
-	current  map[uint64]*netlink.ArchivalRecord // Cache of most recent messages.
-	previous map[uint64]*netlink.ArchivalRecord // Cache of previous round of messages.
-	cycles   int64
+	// GraceCycles is the number of consecutive cycles a connection may be missing
+	// before EndCycle treats it as closed.  With the default of zero, a connection is
+	// expired as soon as it is missing from a single cycle, e.g. due to an interrupted dump.
+	GraceCycles int
+
+	lock    sync.Mutex        // Guards entries, for Records.
+	entries map[uint64]*entry // Map from cookie to entry.
+	// Sentinel for the circular list.  head.next is the most recently updated
+	// entry, and head.prev is the least recently updated entry.
+	head   entry
+	count  int // Number of entries updated in the current cycle.
+	cycles int64
 }
 
 // NewCache creates a cache object with capacity of 1000.
 // The map size is adjusted on every sampling round, but we have to start somewhere.
 func NewCache() *Cache {
-	return &Cache{current: make(map[uint64]*netlink.ArchivalRecord, 1000),
-		previous: make(map[uint64]*netlink.ArchivalRecord, 0)}
+	c := &Cache{entries: make(map[uint64]*entry, 1000)}
+	c.head.next = &c.head
+	c.head.prev = &c.head
+	return c
+}
+
+func (c *Cache) unlink(e *entry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+}
+
+func (c *Cache) pushFront(e *entry) {
+	e.prev = &c.head
+	e.next = c.head.next
+	c.head.next.prev = e
+	c.head.next = e
 }
 
 // Update swaps msg with the cache contents, and returns the evicted value.
@@ -38,27 +72,117 @@ func (c *Cache) Update(msg *netlink.ArchivalRecord) (*netlink.ArchivalRecord, er
 		return nil, err
 	}
 	cookie := idm.ID.Cookie()
-	c.current[cookie] = msg
-	evicted, ok := c.previous[cookie]
-	if ok {
-		delete(c.previous, cookie)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[cookie]
+	if !ok {
+		e = &entry{cookie: cookie, record: msg, seen: c.cycles}
+		c.entries[cookie] = e
+		c.pushFront(e)
+		c.count++
+		return nil, nil
 	}
+	evicted := e.record
+	if e.seen != c.cycles {
+		c.count++
+	}
+	e.record = msg
+	e.seen = c.cycles
+	c.unlink(e)
+	c.pushFront(e)
 	return evicted, nil
 }
 
 // EndCycle marks the completion of updates from one set of netlink messages.
 // It returns all messages that did not have corresponding inodes in the most recent
-// batch of messages.
+// batch of messages, or in any of the GraceCycles batches before it.  Only the
+// stale entries at the tail of the list are visited.
 func (c *Cache) EndCycle() map[uint64]*netlink.ArchivalRecord {
-	metrics.CacheSizeHistogram.Observe(float64(len(c.current)))
-	tmp := c.previous
-	c.previous = c.current
-	// Allocate a bit more than previous size, to accommodate new connections.
-	// This will grow and shrink with the number of active connections, but
-	// minimize reallocation.
-	c.current = make(map[uint64]*netlink.ArchivalRecord, len(c.previous)+len(c.previous)/10+10)
+	grace := int64(c.GraceCycles)
+	if grace < 0 {
+		grace = 0
+	}
+	c.lock.Lock()
+	residual := make(map[uint64]*netlink.ArchivalRecord)
+	for e := c.head.prev; e != &c.head && e.seen < c.cycles-grace; e = c.head.prev {
+		residual[e.cookie] = e.record
+		c.unlink(e)
+		delete(c.entries, e.cookie)
+	}
+	metrics.CacheSizeHistogram.Observe(float64(c.count))
+	c.count = 0
 	c.cycles++
-	return tmp
+	c.lock.Unlock()
+	return residual
+}
+
+// Touch marks the connection with the cookie as present in the current cycle,
+// without replacing its record, and returns the record.  It returns nil, and does
+// nothing, if the cache holds no record for the cookie.
+func (c *Cache) Touch(cookie uint64) *netlink.ArchivalRecord {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[cookie]
+	if !ok {
+		return nil
+	}
+	if e.seen != c.cycles {
+		c.count++
+	}
+	e.seen = c.cycles
+	c.unlink(e)
+	c.pushFront(e)
+	return e.record
+}
+
+// Contains returns true if the cache holds a record for the cookie.
+func (c *Cache) Contains(cookie uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.entries[cookie]
+	return ok
+}
+
+// Remove discards the record for the cookie, if any, without returning it from
+// EndCycle.  A subsequent Update for the cookie will be treated as a new connection.
+func (c *Cache) Remove(cookie uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[cookie]
+	if ok {
+		c.unlink(e)
+		delete(c.entries, cookie)
+	}
+}
+
+// Len returns the number of connections in the cache.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Cookies returns the cookies of all connections in the cache.
+func (c *Cache) Cookies() []uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	result := make([]uint64, 0, len(c.entries))
+	for cookie := range c.entries {
+		result = append(result, cookie)
+	}
+	return result
+}
+
+// Records returns the records of all connections in the cache.  It may be called
+// concurrently with Update and EndCycle.
+func (c *Cache) Records() []*netlink.ArchivalRecord {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	result := make([]*netlink.ArchivalRecord, 0, len(c.entries))
+	for _, e := range c.entries {
+		result = append(result, e.record)
+	}
+	return result
 }
 
 // CycleCount returns the number of times EndCycle() has been called.
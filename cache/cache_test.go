@@ -20,7 +20,7 @@ func testFatal(t *testing.T, err error) {
 	}
 }
 
-func fakeMsg(t *testing.T, cookie uint64, dport uint16) netlink.ArchivalRecord {
+func fakeMsg(t testing.TB, cookie uint64, dport uint16) netlink.ArchivalRecord {
 	var json1 = `{"Header":{"Len":356,"Type":20,"Flags":2,"Seq":1,"Pid":148940},"Data":"CgEAAOpWE6cmIAAAEAMEFbM+nWqBv4ehJgf4sEANDAoAAAAAAAAAgQAAAAAdWwAAAAAAAAAAAAAAAAAAAAAAAAAAAAC13zIBBQAIAAAAAAAFAAUAIAAAAAUABgAgAAAAFAABAAAAAAAAAAAAAAAAAAAAAAAoAAcAAAAAAICiBQAAAAAAALQAAAAAAAAAAAAAAAAAAAAAAAAAAAAArAACAAEAAAAAB3gBQIoDAECcAABEBQAAuAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAUCEAAAAAAAAgIQAAQCEAANwFAACsywIAJW8AAIRKAAD///9/CgAAAJQFAAADAAAALMkAAIBwAAAAAAAALnUOAAAAAAD///////////ayBAAAAAAASfQPAAAAAADMEQAANRMAAAAAAABiNQAAxAsAAGMIAABX5AUAAAAAAAoABABjdWJpYwAAAA=="}`
 	nm := netlink.NetlinkMessage{}
 	err := json.Unmarshal([]byte(json1), &nm)
@@ -95,3 +95,160 @@ func TestUpdateWithBadData(t *testing.T) {
 		t.Error("Should have had an error")
 	}
 }
+
+func BenchmarkCycle_100k(b *testing.B) {
+	msgs := make([]netlink.ArchivalRecord, 100000)
+	for i := range msgs {
+		msgs[i] = fakeMsg(b, uint64(i+1), 1)
+	}
+	c := cache.NewCache()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range msgs {
+			c.Update(&msgs[i])
+		}
+		c.EndCycle()
+	}
+}
+
+func TestContainsAndRemove(t *testing.T) {
+	c := cache.NewCache()
+	for cookie := uint64(1); cookie <= 10; cookie++ {
+		pm := fakeMsg(t, cookie, 1)
+		_, err := c.Update(&pm)
+		testFatal(t, err)
+	}
+	if len(c.Cookies()) != 10 {
+		t.Error("Expected 10 cookies, got", len(c.Cookies()))
+	}
+	c.Remove(5)
+	if c.Contains(5) || !c.Contains(6) {
+		t.Error("Wrong contents after Remove")
+	}
+	// A removed connection is not returned by EndCycle.
+	c.EndCycle()
+	leftover := c.EndCycle()
+	if len(leftover) != 9 {
+		t.Error("Expected 9 expired connections, got", len(leftover))
+	}
+	// And is new when it is next updated.
+	pm := fakeMsg(t, 5, 1)
+	old, err := c.Update(&pm)
+	testFatal(t, err)
+	if old != nil {
+		t.Error("old should be nil")
+	}
+}
+
+func TestExpiredConnectionIsNew(t *testing.T) {
+	c := cache.NewCache()
+	pm1 := fakeMsg(t, 0x1234, 1)
+	pm2 := fakeMsg(t, 0x4321, 1)
+	c.Update(&pm1)
+	c.Update(&pm2)
+	c.EndCycle()
+
+	// Only pm2 is updated, so pm1 should expire.
+	c.Update(&pm2)
+	leftover := c.EndCycle()
+	if _, ok := leftover[0x1234]; !ok || len(leftover) != 1 {
+		t.Error("pm1 should have expired", leftover)
+	}
+
+	// When pm1 returns, it should be treated as a new connection.
+	old, err := c.Update(&pm1)
+	testFatal(t, err)
+	if old != nil {
+		t.Error("old should be nil")
+	}
+	old, err = c.Update(&pm2)
+	testFatal(t, err)
+	if old == nil {
+		t.Error("old should NOT be nil")
+	}
+	if leftover := c.EndCycle(); len(leftover) != 0 {
+		t.Error("Should be empty", leftover)
+	}
+}
+
+func TestGraceCycles(t *testing.T) {
+	c := cache.NewCache()
+	c.GraceCycles = 2
+	pm1 := fakeMsg(t, 0x1234, 1)
+	pm2 := fakeMsg(t, 0x4321, 1)
+	c.Update(&pm1)
+	c.Update(&pm2)
+	c.EndCycle()
+
+	// pm1 is missing for two cycles, which is within the grace period.
+	for i := 0; i < 2; i++ {
+		c.Update(&pm2)
+		if leftover := c.EndCycle(); len(leftover) != 0 {
+			t.Error("Should be empty", i, leftover)
+		}
+	}
+	// When pm1 returns, it is still the same connection.
+	old, err := c.Update(&pm1)
+	testFatal(t, err)
+	if old == nil {
+		t.Error("old should NOT be nil")
+	}
+	c.Update(&pm2)
+	c.EndCycle()
+
+	// pm2 is missing for three cycles, so it expires at the end of the third.
+	for i := 0; i < 3; i++ {
+		c.Update(&pm1)
+		leftover := c.EndCycle()
+		if i < 2 && len(leftover) != 0 {
+			t.Error("Should be empty", i, leftover)
+		}
+		if i == 2 {
+			if _, ok := leftover[0x4321]; !ok || len(leftover) != 1 {
+				t.Error("pm2 should have expired", leftover)
+			}
+		}
+	}
+}
+
+func TestTouch(t *testing.T) {
+	c := cache.NewCache()
+	if c.Touch(0x1234) != nil {
+		t.Error("Touch of a missing connection should return nil")
+	}
+	pm1 := fakeMsg(t, 0x1234, 1)
+	pm2 := fakeMsg(t, 0x4321, 1)
+	c.Update(&pm1)
+	c.Update(&pm2)
+	c.EndCycle()
+
+	// A touched connection does not expire, and keeps its record.
+	if got := c.Touch(0x1234); got != &pm1 {
+		t.Error("Touch returned", got)
+	}
+	leftover := c.EndCycle()
+	if _, ok := leftover[0x4321]; !ok || len(leftover) != 1 {
+		t.Error("Only pm2 should have expired", leftover)
+	}
+	pm3 := fakeMsg(t, 0x1234, 1)
+	old, err := c.Update(&pm3)
+	testFatal(t, err)
+	if old != &pm1 {
+		t.Error("Update should return pm1, got", old)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	c := cache.NewCache()
+	if len(c.Records()) != 0 {
+		t.Error("Empty cache should have no records")
+	}
+	pm1 := fakeMsg(t, 0x1234, 1)
+	pm2 := fakeMsg(t, 0x4321, 1)
+	c.Update(&pm1)
+	c.Update(&pm2)
+	records := c.Records()
+	if len(records) != 2 || (records[0] != &pm1 && records[1] != &pm1) || (records[0] != &pm2 && records[1] != &pm2) {
+		t.Error("Wrong records", records)
+	}
+}
@@ -0,0 +1,112 @@
+// Package catalog describes the persisted fields of a struct type, e.g. a
+// snapshot.Snapshot, as a machine-readable field catalog, so that downstream
+// loaders can validate the data they ingest.  The catalog is derived from the
+// struct types and their tags, so it is always in step with them.
+//
+// Each leaf field is described by its dotted path, e.g. TCPInfo.RTT, its type,
+// and, from its struct tags, its units and the kernel field it comes from, e.g.
+//
+//	RTT uint32 `units:"us" kernel:"tcpi_rtt"`
+//
+// The units are "us", "ms", "bytes", "bytes/s", "packets", "segments", or a
+// fixed point scale, e.g. "1/1024".  Fields without units are counts, flags,
+// enumerations or identifiers.  Fields are named as for encoding/json, and fields
+// tagged json:"-" are omitted.  Structs and pointers to structs are flattened.
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedType is returned for the fields whose types have no catalog type.
+var ErrUnsupportedType = errors.New("type has no catalog type")
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Field describes a persisted field.
+type Field struct {
+	Name   string // The dotted path of the field, e.g. TCPInfo.RTT.
+	Type   string // The Go kind, e.g. uint32, or timestamp.
+	Units  string `json:",omitempty"`
+	Kernel string `json:",omitempty"` // The kernel field or attribute, e.g. tcpi_rtt.
+}
+
+// Fields returns the catalog of the leaf fields of a struct type, in the order of
+// the struct.
+func Fields(t reflect.Type) ([]Field, error) {
+	if t == nil || t.Kind() != reflect.Struct || t == timeType {
+		return nil, fmt.Errorf("%w: %v is not a struct", ErrUnsupportedType, t)
+	}
+	return fields(nil, "", t)
+}
+
+func fields(catalog []Field, prefix string, t reflect.Type) ([]Field, error) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		name = prefix + name
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			var err error
+			catalog, err = fields(catalog, name+".", ft)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		typ, err := typeName(ft)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		catalog = append(catalog, Field{Name: name, Type: typ, Units: f.Tag.Get("units"), Kernel: f.Tag.Get("kernel")})
+	}
+	return catalog, nil
+}
+
+// typeName returns the catalog type of a leaf field type.
+func typeName(t reflect.Type) (string, error) {
+	if t == timeType {
+		return "timestamp", nil
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return t.Kind().String(), nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes", nil
+		}
+	}
+	return "", fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+}
+
+// JSON returns the catalog of a struct type as an indented JSON array, ending in a
+// newline.
+func JSON(t reflect.Type) ([]byte, error) {
+	catalog, err := Fields(t)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,80 @@
+package catalog_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/catalog"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+type Inner struct {
+	RTT  uint32 `units:"us" kernel:"tcpi_rtt"`
+	Name string
+}
+
+type Outer struct {
+	Time    time.Time
+	Inner   Inner
+	Ptr     *Inner `json:"renamed"`
+	Data    []byte
+	Skip    int `json:"-"`
+	hidden  int
+	Enabled bool `kernel:"enabled"`
+}
+
+func TestFields(t *testing.T) {
+	fields, err := catalog.Fields(reflect.TypeOf(Outer{}))
+	rtx.Must(err, "Could not derive the catalog")
+	want := []catalog.Field{
+		{Name: "Time", Type: "timestamp"},
+		{Name: "Inner.RTT", Type: "uint32", Units: "us", Kernel: "tcpi_rtt"},
+		{Name: "Inner.Name", Type: "string"},
+		{Name: "renamed.RTT", Type: "uint32", Units: "us", Kernel: "tcpi_rtt"},
+		{Name: "renamed.Name", Type: "string"},
+		{Name: "Data", Type: "bytes"},
+		{Name: "Enabled", Type: "bool", Kernel: "enabled"},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("Fields() = %+v, want %+v", fields, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	type withMap struct{ M map[string]int }
+	type withChan struct{ C chan int }
+	type withInts struct{ I []int }
+	for _, v := range []interface{}{1, time.Time{}, withMap{}, withChan{}, withInts{}} {
+		if _, err := catalog.Fields(reflect.TypeOf(v)); !errors.Is(err, catalog.ErrUnsupportedType) {
+			t.Errorf("Fields(%T) = %v, want %v", v, err, catalog.ErrUnsupportedType)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	b, err := catalog.JSON(reflect.TypeOf(snapshot.Snapshot{}))
+	rtx.Must(err, "Could not derive the catalog")
+	var fields []catalog.Field
+	rtx.Must(json.Unmarshal(b, &fields), "Could not parse the catalog")
+	byName := map[string]catalog.Field{}
+	for _, f := range fields {
+		byName[f.Name] = f
+	}
+	if f := byName["TCPInfo.RTT"]; f.Units != "us" || f.Kernel != "tcpi_rtt" || f.Type != "uint32" {
+		t.Error("Wrong TCPInfo.RTT", f)
+	}
+	if _, ok := byName["InetDiagMsg.ID.IDiagSPort"]; ok {
+		t.Error("The fields tagged json:\"-\" should be omitted")
+	}
+	// Every TCPInfo field comes from the kernel.
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, "TCPInfo.") && f.Kernel == "" {
+			t.Error("No kernel field for", f.Name)
+		}
+	}
+}
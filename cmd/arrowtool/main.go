@@ -0,0 +1,115 @@
+// Main package in arrowtool implements a command line tool for converting ArchiveRecord
+// files to Apache Arrow IPC (Feather) files, with a typed column for each field.
+// See cmd/arrowtool/README.md for more information.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/arrow"
+	"github.com/m-lab/tcp-info/manifest"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/reader"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+var (
+	day = flag.Bool("day", false, "Convert all the connection files under the directory argument, e.g. a day of archives, to one file with a record batch per connection.")
+
+	// A variable to enable mocking for testing.
+	logFatal = log.Fatal
+)
+
+// appendConnection appends the snapshots of a connection as one record batch.
+func appendConnection(aw *arrow.Writer, meta *netlink.Metadata, snapshots []*snapshot.Snapshot) error {
+	for _, s := range snapshots {
+		err := aw.Append(snapshot.NewRow(meta, s))
+		if err != nil {
+			return err
+		}
+	}
+	return aw.Flush()
+}
+
+func toArrow(meta *netlink.Metadata, snapshots []*snapshot.Snapshot, wtr io.Writer) error {
+	aw, err := arrow.NewWriter(wtr, snapshot.Row{})
+	if err != nil {
+		return err
+	}
+	err = appendConnection(aw, meta, snapshots)
+	if err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// dirToArrow converts all the connection files under dir, in lexical order.
+func dirToArrow(dir string, wtr io.Writer) error {
+	aw, err := arrow.NewWriter(wtr, snapshot.Row{})
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if !strings.HasSuffix(path, ".jsonl") && !strings.HasSuffix(path, ".jsonl.zst") || info.Name() == manifest.FileName {
+			return nil
+		}
+		source, err := reader.OpenFile(path)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		meta, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(source))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return appendConnection(aw, meta, snaps)
+	})
+	if err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+
+	if *day {
+		if len(args) != 1 {
+			logFatal("-day requires exactly one directory argument.")
+		}
+		rtx.Must(dirToArrow(args[0], os.Stdout), "Could not convert %q to Arrow", args[0])
+		return
+	}
+
+	var source io.ReadCloser
+	var err error
+	source = os.Stdin
+	if len(args) == 1 {
+		source, err = reader.OpenFile(args[0])
+		rtx.Must(err, "Could not open file %q", args[0])
+	} else if len(args) > 1 {
+		logFatal("Too many command-line arguments.")
+	}
+	defer source.Close()
+
+	arReader := netlink.NewArchiveReader(source)
+	meta, snaps, err := snapshot.LoadAll(arReader)
+	rtx.Must(err, "Could not read snapshots")
+	rtx.Must(toArrow(meta, snaps, os.Stdout), "Could not convert input to Arrow")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/manifest"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/reader"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+const testFile = "../csvtool/testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst"
+
+func TestMainTooManyArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		logFatal = log.Fatal
+	}(os.Args)
+
+	os.Args = []string{"test_arrowtool", "file1", "file2"}
+	logFatal = func(...interface{}) {
+		panic("panic instead of log.Fatal")
+	}
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			t.Error("Should have panicked")
+		}
+	}()
+
+	main()
+}
+
+func TestMain(t *testing.T) {
+	defer func(args []string, stdout *os.File) {
+		os.Args = args
+		os.Stdout = stdout
+		*day = false
+	}(os.Args, os.Stdout)
+
+	// Nothing crashes when we pass in a valid file, or directory.
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	rtx.Must(err, "Could not open %s", os.DevNull)
+	defer devNull.Close()
+	os.Args = []string{"test_arrowtool", testFile}
+	os.Stdout = devNull
+	main()
+
+	os.Args = []string{"test_arrowtool", "-day", filepath.Dir(testFile)}
+	main()
+}
+
+func TestToArrow(t *testing.T) {
+	src, err := reader.OpenFile(testFile)
+	rtx.Must(err, "Could not open file")
+	meta, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
+	rtx.Must(err, "Could not read test data")
+
+	single := &bytes.Buffer{}
+	rtx.Must(toArrow(meta, snaps, single), "Could not convert")
+	out := single.Bytes()
+	if !bytes.HasPrefix(out, []byte("ARROW1\x00\x00")) || !bytes.HasSuffix(out, []byte("ARROW1")) {
+		t.Fatal("Missing Arrow magic")
+	}
+	// The column names are in the schema message and the footer.
+	for _, s := range []string{"UUID", "ID.SrcIP", "Snapshot.Timestamp", "Snapshot.TCPInfo.RTT", "Snapshot.BBRInfo.BW"} {
+		if bytes.Count(out, []byte(s+"\x00")) != 2 {
+			t.Errorf("Schema is missing %q", s)
+		}
+	}
+	if !bytes.Contains(out, []byte(meta.UUID)) {
+		t.Error("Missing the UUID values")
+	}
+
+	// A directory with the same connection twice has twice the data.
+	dir, err := ioutil.TempDir("", "TestToArrow")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(testFile)
+	rtx.Must(err, "Could not read test file")
+	for _, fn := range []string{"a/one.00000.jsonl.zst", "b/two.00000.jsonl.zst"} {
+		rtx.Must(os.MkdirAll(filepath.Join(dir, filepath.Dir(fn)), 0777), "Could not mkdir")
+		rtx.Must(ioutil.WriteFile(filepath.Join(dir, fn), data, 0666), "Could not write")
+	}
+	rtx.Must(ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a connection"), 0666), "Could not write")
+	days := &bytes.Buffer{}
+	rtx.Must(dirToArrow(dir, days), "Could not convert directory")
+	if bytes.Count(days.Bytes(), []byte(meta.UUID)) != 2*bytes.Count(out, []byte(meta.UUID)) {
+		t.Error("Expected the connection twice")
+	}
+
+	// The manifests are not converted, but the files are verified against them.
+	_, err = manifest.WriteTree(dir)
+	rtx.Must(err, "Could not write manifests")
+	rtx.Must(dirToArrow(dir, &bytes.Buffer{}), "Could not convert directory with manifests")
+	rtx.Must(ioutil.WriteFile(filepath.Join(dir, "b/two.00000.jsonl.zst"), data[:len(data)-1], 0666), "Could not write")
+	if err := dirToArrow(dir, &bytes.Buffer{}); !errors.Is(err, manifest.ErrMismatch) {
+		t.Error("Expected ErrMismatch, got", err)
+	}
+	rtx.Must(os.RemoveAll(filepath.Join(dir, "b")), "Could not remove")
+
+	rtx.Must(ioutil.WriteFile(filepath.Join(dir, "bad.jsonl"), []byte("{"), 0666), "Could not write")
+	if dirToArrow(dir, &bytes.Buffer{}) == nil {
+		t.Error("Should have failed on a bad file")
+	}
+}
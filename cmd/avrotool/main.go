@@ -0,0 +1,60 @@
+// Main package in avrotool implements a command line tool for converting ArchiveRecord files to
+// Avro object container files, with the schema embedded in the file header.
+// See cmd/avrotool/README.md for more information.
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/avro"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/reader"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+var (
+	// A variable to enable mocking for testing.
+	logFatal = log.Fatal
+)
+
+func toAvro(meta *netlink.Metadata, snapshots []*snapshot.Snapshot, wtr io.Writer) error {
+	aw, err := avro.NewWriter(wtr, snapshot.Row{}, avro.Deflate)
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		err = aw.Append(snapshot.NewRow(meta, s))
+		if err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+func main() {
+	args := os.Args[1:]
+
+	var source io.ReadCloser
+	var err error
+	source = os.Stdin
+	if len(args) == 1 {
+		source, err = reader.OpenFile(args[0])
+		rtx.Must(err, "Could not open file %q", args[0])
+	} else if len(args) > 1 {
+		logFatal("Too many command-line arguments.")
+	}
+	defer source.Close()
+
+	arReader := netlink.NewArchiveReader(source)
+	meta, snaps, err := snapshot.LoadAll(arReader)
+	rtx.Must(err, "Could not read snapshots")
+	rtx.Must(toAvro(meta, snaps, os.Stdout), "Could not convert input to Avro")
+}
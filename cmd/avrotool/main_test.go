@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/reader"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+const testFile = "../csvtool/testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst"
+
+func TestMainTooManyArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		logFatal = log.Fatal
+	}(os.Args)
+
+	os.Args = []string{"test_avrotool", "file1", "file2"}
+	logFatal = func(...interface{}) {
+		panic("panic instead of log.Fatal")
+	}
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			t.Error("Should have panicked")
+		}
+	}()
+
+	main()
+}
+
+func TestMain(t *testing.T) {
+	defer func(args []string, stdout *os.File) {
+		os.Args = args
+		os.Stdout = stdout
+	}(os.Args, os.Stdout)
+
+	// Nothing crashes when we pass in a valid file.
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	rtx.Must(err, "Could not open %s", os.DevNull)
+	defer devNull.Close()
+	os.Args = []string{"test_avrotool", testFile}
+	os.Stdout = devNull
+	main()
+}
+
+func TestFileToAvro(t *testing.T) {
+	src, err := reader.OpenFile(testFile)
+	rtx.Must(err, "Could not open file")
+	meta, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
+	rtx.Must(err, "Could not read test data")
+
+	buf := bytes.NewBuffer(nil)
+	err = toAvro(meta, snaps, buf)
+	if err != nil {
+		t.Fatal("Conversion problem", err)
+	}
+
+	out := buf.Bytes()
+	if !bytes.HasPrefix(out, []byte("Obj\x01")) {
+		t.Fatal("Missing Avro magic")
+	}
+	for _, s := range []string{"avro.schema", `"name":"Row"`, `"name":"SockID"`, `"name":"LinuxTCPInfo"`, "avro.codec", "deflate"} {
+		if !bytes.Contains(out, []byte(s)) {
+			t.Errorf("Header is missing %q", s)
+		}
+	}
+	// All the snapshots fit in the first block, which follows the 16 byte sync
+	// marker at the end of the header.
+	sync := out[bytes.Index(out, []byte("deflate"))+len("deflate")+1:][:16]
+	block := out[bytes.Index(out, []byte("deflate"))+len("deflate")+1+16:]
+	count, _ := binary.Varint(block)
+	if count != int64(len(snaps)) || count != 151 {
+		t.Errorf("Block has %d records, want %d", count, len(snaps))
+	}
+	if !bytes.HasSuffix(out, sync) {
+		t.Error("Missing sync marker at end of file")
+	}
+}
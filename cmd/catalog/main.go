@@ -0,0 +1,35 @@
+// Main package in catalog implements a command line tool that prints the field
+// catalog of the snapshots, with the name, type, units and kernel source of each
+// persisted field, as JSON, for downstream loaders to validate against.
+// See cmd/catalog/README.md for more information.
+package main
+
+//go:generate sh -c "go run . > catalog.json"
+
+import (
+	"flag"
+	"log"
+	"os"
+	"reflect"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/catalog"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+// generate returns the catalog of the snapshots.
+func generate() ([]byte, error) {
+	return catalog.JSON(reflect.TypeOf(snapshot.Snapshot{}))
+}
+
+func main() {
+	flag.Parse()
+	b, err := generate()
+	rtx.Must(err, "Could not generate the catalog")
+	os.Stdout.Write(b)
+}
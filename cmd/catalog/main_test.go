@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+)
+
+// The checked in catalog must be regenerated with go generate when the structs change.
+func TestCatalogUpToDate(t *testing.T) {
+	b, err := generate()
+	rtx.Must(err, "Could not generate the catalog")
+	checkedIn, err := ioutil.ReadFile("catalog.json")
+	rtx.Must(err, "Could not read catalog.json")
+	if !bytes.Equal(b, checkedIn) {
+		t.Error("catalog.json is out of date, run go generate ./cmd/catalog")
+	}
+}
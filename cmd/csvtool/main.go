@@ -6,13 +6,12 @@ import (
 	"io"
 	"log"
 	"os"
-	"strings"
 
 	"github.com/gocarina/gocsv"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/reader"
 	"github.com/m-lab/tcp-info/snapshot"
-	"github.com/m-lab/tcp-info/zstd"
 )
 
 func init() {
@@ -29,12 +28,10 @@ func toCSV(snapshots []*snapshot.Snapshot, wtr io.Writer) error {
 	return gocsv.Marshal(snapshots, wtr)
 }
 
-// openFile either opens a file, or opens and unzips a file that ends with .zst
+// openFile opens a file with reader.OpenFile, verifying it against the manifest
+// of its directory, and unzipping it if it ends with .zst.
 func openFile(fn string) (io.ReadCloser, error) {
-	if strings.HasSuffix(fn, ".zst") {
-		return zstd.NewReader(fn), nil
-	}
-	return os.Open(fn)
+	return reader.OpenFile(fn)
 }
 
 // TODO handle gs: filenames.
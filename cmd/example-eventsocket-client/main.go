@@ -25,7 +25,7 @@ type event struct {
 	id        *inetdiag.SockID
 }
 
-// handler implements the eventsocket.Handler interface.
+// handler implements the eventsocket.Handler and eventsocket.FinalHandler interfaces.
 type handler struct {
 	events chan event
 }
@@ -50,6 +50,16 @@ func (h *handler) Close(ctx context.Context, timestamp time.Time, uuid string) {
 	log.Println("close", uuid, timestamp)
 }
 
+// FinalClose is called by tcp-info synchronously for every TCP close event,
+// instead of Close, because handler implements eventsocket.FinalHandler.
+func (h *handler) FinalClose(ctx context.Context, timestamp time.Time, uuid string, final *eventsocket.Counters) {
+	if final == nil {
+		h.Close(ctx, timestamp, uuid)
+		return
+	}
+	log.Println("close", uuid, timestamp, final.State, "sent", final.BytesSent, "received", final.BytesReceived)
+}
+
 // ProcessOpenEvents reads and processes events received by the open handler.
 func (h *handler) ProcessOpenEvents(ctx context.Context) {
 	for {
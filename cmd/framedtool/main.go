@@ -0,0 +1,83 @@
+// Main package in framedtool implements a command line tool for converting ArchiveRecord
+// files to framed files, which are quick to read from Python, and for generating the
+// Python reader.
+// See cmd/framedtool/README.md for more information.
+package main
+
+//go:generate sh -c "go run . -python > tcpinfo_framed.py"
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/framed"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/nlproto"
+	"github.com/m-lab/tcp-info/reader"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+var (
+	printSchema = flag.Bool("schema", false, "Print the protobuf schema, instead of converting a file.")
+	printPython = flag.Bool("python", false, "Print the Python reader module, instead of converting a file.")
+
+	// A variable to enable mocking for testing.
+	logFatal = log.Fatal
+)
+
+func toFramed(meta *netlink.Metadata, snapshots []*snapshot.Snapshot, wtr io.Writer) error {
+	fw, err := framed.NewWriter(wtr, nlproto.Row{})
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		err = fw.Append(nlproto.NewRow(meta, s))
+		if err != nil {
+			return err
+		}
+	}
+	return fw.Close()
+}
+
+func main() {
+	flag.Parse()
+	if *printSchema {
+		schema, err := framed.Schema(reflect.TypeOf(nlproto.Row{}))
+		rtx.Must(err, "Could not derive the schema")
+		fmt.Print(schema)
+		return
+	}
+	if *printPython {
+		py, err := framed.Python(reflect.TypeOf(nlproto.Row{}))
+		rtx.Must(err, "Could not generate the reader")
+		os.Stdout.Write(py)
+		return
+	}
+
+	args := flag.Args()
+	var source io.ReadCloser
+	var err error
+	source = os.Stdin
+	if len(args) == 1 {
+		source, err = reader.OpenFile(args[0])
+		rtx.Must(err, "Could not open file %q", args[0])
+	} else if len(args) > 1 {
+		logFatal("Too many command-line arguments.")
+	}
+	defer source.Close()
+
+	arReader := netlink.NewArchiveReader(source)
+	meta, snaps, err := snapshot.LoadAll(arReader)
+	rtx.Must(err, "Could not read snapshots")
+	rtx.Must(toFramed(meta, snaps, os.Stdout), "Could not convert input to framed format")
+}
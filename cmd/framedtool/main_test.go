@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/framed"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/nlproto"
+	"github.com/m-lab/tcp-info/reader"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+const testFile = "../csvtool/testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst"
+
+func TestMainTooManyArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		logFatal = log.Fatal
+	}(os.Args)
+
+	os.Args = []string{"test_framedtool", "file1", "file2"}
+	logFatal = func(...interface{}) {
+		panic("panic instead of log.Fatal")
+	}
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			t.Error("Should have panicked")
+		}
+	}()
+
+	main()
+}
+
+func TestMain(t *testing.T) {
+	defer func(args []string, stdout *os.File) {
+		os.Args = args
+		os.Stdout = stdout
+	}(os.Args, os.Stdout)
+
+	// Nothing crashes when we pass in a valid file.
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	rtx.Must(err, "Could not open %s", os.DevNull)
+	defer devNull.Close()
+	os.Args = []string{"test_framedtool", testFile}
+	os.Stdout = devNull
+	main()
+}
+
+// The checked in reader must be regenerated with go generate when nlproto.Row changes.
+func TestReaderUpToDate(t *testing.T) {
+	py, err := framed.Python(reflect.TypeOf(nlproto.Row{}))
+	rtx.Must(err, "Could not generate reader")
+	checkedIn, err := ioutil.ReadFile("tcpinfo_framed.py")
+	rtx.Must(err, "Could not read tcpinfo_framed.py")
+	if !bytes.Equal(py, checkedIn) {
+		t.Error("tcpinfo_framed.py is out of date, run go generate ./cmd/framedtool")
+	}
+}
+
+func TestPythonReader(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed")
+	}
+	src, err := reader.OpenFile(testFile)
+	rtx.Must(err, "Could not open file")
+	meta, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
+	rtx.Must(err, "Could not read test data")
+
+	dir, err := ioutil.TempDir("", "TestPythonReader")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "connection.framed"))
+	rtx.Must(err, "Could not create file")
+	rtx.Must(toFramed(meta, snaps, f), "Could not convert")
+	f.Close()
+
+	script := `
+import sys
+import tcpinfo_framed
+with open(sys.argv[1], "rb") as f:
+    rows = [tcpinfo_framed.flatten(m) for m in tcpinfo_framed.read(f)]
+last = rows[-1]
+print(len(rows), last["UUID"], last["ID.SrcIP"], last["Snapshot.TCPInfo.BytesAcked"],
+      last["Snapshot.TCPInfo.MaxPacingRate"], last["Snapshot.Timestamp"].isoformat())
+`
+	cmd := exec.Command(python, "-c", script, filepath.Join(dir, "connection.framed"))
+	cmd.Env = append(os.Environ(), "PYTHONPATH=.")
+	out, err := cmd.CombinedOutput()
+	rtx.Must(err, "Python reader failed: %s", out)
+
+	last := snaps[len(snaps)-1]
+	want := strings.Join([]string{
+		"151", meta.UUID, last.InetDiagMsg.ID.GetSockID().SrcIP,
+		strconv.FormatInt(last.TCPInfo.BytesAcked, 10), "-1", last.Timestamp.Format("2006-01-02T15:04:05.000000") + "+00:00",
+	}, " ")
+	if strings.TrimSpace(string(out)) != want {
+		t.Errorf("Python reader got %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,610 @@
+"""Reads tcp-info framed files.
+
+Generated by the tcp-info framed package from the schema below.  Do not edit.
+
+    import tcpinfo_framed
+    df = tcpinfo_framed.read_dataframe("connection.framed")
+
+syntax = "proto3";
+
+// From nlproto.Row.
+message Row {
+  string UUID = 1;
+  sint64 Sequence = 2;
+  SockID ID = 3;
+  Snapshot Snapshot = 4;
+  Metadata Metadata = 5;
+  string Anomaly = 6;
+}
+
+// From inetdiag.SockID.
+message SockID {
+  uint32 SPort = 1;
+  uint32 DPort = 2;
+  string SrcIP = 3;
+  string DstIP = 4;
+  uint32 Interface = 5;
+  sint64 Cookie = 6;
+}
+
+// From snapshot.Snapshot.
+message Snapshot {
+  sint64 Timestamp = 1; // Microseconds since the epoch.
+  uint32 Observed = 2;
+  uint32 NotFullyParsed = 3;
+  InetDiagMsg InetDiagMsg = 4;
+  string CongestionAlgorithm = 5;
+  uint32 TOS = 6;
+  uint32 TClass = 7;
+  uint32 ClassID = 8;
+  uint32 Shutdown = 9;
+  uint32 Protocol = 10;
+  uint32 Mark = 11;
+  sint64 TCPInfoLength = 12;
+  LinuxTCPInfo TCPInfo = 13;
+  MemInfo MemInfo = 14;
+  SocketMemInfo SocketMem = 15;
+  VegasInfo VegasInfo = 16;
+  DCTCPInfo DCTCPInfo = 17;
+  BBRInfo BBRInfo = 18;
+  MPTCPInfo MPTCPInfo = 19;
+  MPTCPSubflowInfo MPTCPSubflow = 20;
+}
+
+// From inetdiag.InetDiagMsg.
+message InetDiagMsg {
+  uint32 IDiagFamily = 1;
+  uint32 IDiagState = 2;
+  uint32 IDiagTimer = 3;
+  uint32 IDiagRetrans = 4;
+  uint32 IDiagExpires = 6;
+  uint32 IDiagRqueue = 7;
+  uint32 IDiagWqueue = 8;
+  uint32 IDiagUID = 9;
+  uint32 IDiagInode = 10;
+}
+
+// From tcp.LinuxTCPInfo.
+message LinuxTCPInfo {
+  uint32 State = 1;
+  uint32 CAState = 2;
+  uint32 Retransmits = 3;
+  uint32 Probes = 4;
+  uint32 Backoff = 5;
+  uint32 Options = 6;
+  uint32 WScale = 7;
+  uint32 AppLimited = 8;
+  uint32 RTO = 9;
+  uint32 ATO = 10;
+  uint32 SndMSS = 11;
+  uint32 RcvMSS = 12;
+  uint32 Unacked = 13;
+  uint32 Sacked = 14;
+  uint32 Lost = 15;
+  uint32 Retrans = 16;
+  uint32 Fackets = 17;
+  uint32 LastDataSent = 18;
+  uint32 LastAckSent = 19;
+  uint32 LastDataRecv = 20;
+  uint32 LastAckRecv = 21;
+  uint32 PMTU = 22;
+  uint32 RcvSsThresh = 23;
+  uint32 RTT = 24;
+  uint32 RTTVar = 25;
+  uint32 SndSsThresh = 26;
+  uint32 SndCwnd = 27;
+  uint32 AdvMSS = 28;
+  uint32 Reordering = 29;
+  uint32 RcvRTT = 30;
+  uint32 RcvSpace = 31;
+  uint32 TotalRetrans = 32;
+  sint64 PacingRate = 33;
+  sint64 MaxPacingRate = 34;
+  sint64 BytesAcked = 35;
+  sint64 BytesReceived = 36;
+  sint32 SegsOut = 37;
+  sint32 SegsIn = 38;
+  uint32 NotsentBytes = 39;
+  uint32 MinRTT = 40;
+  uint32 DataSegsIn = 41;
+  uint32 DataSegsOut = 42;
+  sint64 DeliveryRate = 43;
+  sint64 BusyTime = 44;
+  sint64 RWndLimited = 45;
+  sint64 SndBufLimited = 46;
+  uint32 Delivered = 47;
+  uint32 DeliveredCE = 48;
+  sint64 BytesSent = 49;
+  sint64 BytesRetrans = 50;
+  uint32 DSackDups = 51;
+  uint32 ReordSeen = 52;
+  uint32 RcvOooPack = 53;
+  uint32 SndWnd = 54;
+}
+
+// From inetdiag.MemInfo.
+message MemInfo {
+  uint32 Rmem = 1;
+  uint32 Wmem = 2;
+  uint32 Fmem = 3;
+  uint32 Tmem = 4;
+}
+
+// From inetdiag.SocketMemInfo.
+message SocketMemInfo {
+  uint32 RmemAlloc = 1;
+  uint32 Rcvbuf = 2;
+  uint32 WmemAlloc = 3;
+  uint32 Sndbuf = 4;
+  uint32 FwdAlloc = 5;
+  uint32 WmemQueued = 6;
+  uint32 Optmem = 7;
+  uint32 Backlog = 8;
+  uint32 Drops = 9;
+}
+
+// From inetdiag.VegasInfo.
+message VegasInfo {
+  uint32 Enabled = 1;
+  uint32 RTTCount = 2;
+  uint32 RTT = 3;
+  uint32 MinRTT = 4;
+}
+
+// From inetdiag.DCTCPInfo.
+message DCTCPInfo {
+  uint32 Enabled = 1;
+  uint32 CEState = 2;
+  uint32 Alpha = 3;
+  uint32 ABEcn = 4;
+  uint32 ABTot = 5;
+}
+
+// From inetdiag.BBRInfo.
+message BBRInfo {
+  sint64 BW = 1;
+  uint32 MinRTT = 2;
+  uint32 PacingGain = 3;
+  uint32 CwndGain = 4;
+}
+
+// From inetdiag.MPTCPInfo.
+message MPTCPInfo {
+  uint32 Subflows = 1;
+  uint32 AddAddrSignal = 2;
+  uint32 AddAddrAccepted = 3;
+  uint32 SubflowsMax = 4;
+  uint32 AddAddrSignalMax = 5;
+  uint32 AddAddrAcceptedMax = 6;
+  uint32 Flags = 7;
+  uint32 Token = 8;
+  sint64 WriteSeq = 9;
+  sint64 SndUna = 10;
+  sint64 RcvNxt = 11;
+  uint32 LocalAddrUsed = 12;
+  uint32 LocalAddrMax = 13;
+  uint32 CsumEnabled = 14;
+  uint32 Retransmits = 15;
+  sint64 BytesRetrans = 16;
+  sint64 BytesSent = 17;
+  sint64 BytesReceived = 18;
+  sint64 BytesAcked = 19;
+  uint32 SubflowsTotal = 20;
+  uint32 LastDataSent = 21;
+  uint32 LastDataRecv = 22;
+  uint32 LastAckRecv = 23;
+}
+
+// From inetdiag.MPTCPSubflowInfo.
+message MPTCPSubflowInfo {
+  uint32 TokenRem = 1;
+  uint32 TokenLoc = 2;
+  uint32 RelWriteSeq = 3;
+  sint64 MapSeq = 4;
+  uint32 MapSfSeq = 5;
+  uint32 SsnOffset = 6;
+  uint32 MapDataLen = 7;
+  uint32 Flags = 8;
+  uint32 IDRem = 9;
+  uint32 IDLoc = 10;
+}
+
+// From netlink.Metadata.
+message Metadata {
+  string UUID = 1;
+  sint64 Sequence = 2;
+  sint64 StartTime = 3; // Microseconds since the epoch.
+  string Machine = 4;
+  string Site = 5;
+  string Experiment = 6;
+  string Owner = 7;
+  string Protocol = 8;
+  uint32 MPTCPToken = 9;
+  string BootID = 10;
+  sint64 BootTime = 11; // Microseconds since the epoch.
+  string Clock = 12;
+  string ClockSource = 13;
+  double Sampling = 14;
+  double ShortFlowSampling = 15;
+  repeated AuditEvent Audit = 16;
+  Capabilities Kernel = 17;
+  AttributePolicy AttributePolicy = 18;
+  bool Elephant = 19;
+}
+
+// From netlink.AuditEvent.
+message AuditEvent {
+  sint64 Time = 1; // Microseconds since the epoch.
+  string Setting = 2;
+  string Value = 3;
+  string Source = 4;
+}
+
+// From netlink.Capabilities.
+message Capabilities {
+  repeated string Attributes = 1;
+  sint64 TCPInfoLength = 2;
+}
+
+// From netlink.AttributePolicy.
+message AttributePolicy {
+  repeated string Allow = 1;
+  repeated string Deny = 2;
+}
+"""
+
+import datetime
+import struct
+import sys
+
+MAGIC = "tcp-info framed\n".encode("ascii")
+ROOT = "Row"
+
+# The fields of each message, by number: (name, kind, message, label).
+MESSAGES = {
+    "Row": {
+        1: ("UUID", "string", None, ""),
+        2: ("Sequence", "sint", None, ""),
+        3: ("ID", "message", "SockID", ""),
+        4: ("Snapshot", "message", "Snapshot", ""),
+        5: ("Metadata", "message", "Metadata", ""),
+        6: ("Anomaly", "string", None, ""),
+    },
+    "SockID": {
+        1: ("SPort", "uint", None, ""),
+        2: ("DPort", "uint", None, ""),
+        3: ("SrcIP", "string", None, ""),
+        4: ("DstIP", "string", None, ""),
+        5: ("Interface", "uint", None, ""),
+        6: ("Cookie", "sint", None, ""),
+    },
+    "Snapshot": {
+        1: ("Timestamp", "timestamp", None, ""),
+        2: ("Observed", "uint", None, ""),
+        3: ("NotFullyParsed", "uint", None, ""),
+        4: ("InetDiagMsg", "message", "InetDiagMsg", ""),
+        5: ("CongestionAlgorithm", "string", None, ""),
+        6: ("TOS", "uint", None, ""),
+        7: ("TClass", "uint", None, ""),
+        8: ("ClassID", "uint", None, ""),
+        9: ("Shutdown", "uint", None, ""),
+        10: ("Protocol", "uint", None, ""),
+        11: ("Mark", "uint", None, ""),
+        12: ("TCPInfoLength", "sint", None, ""),
+        13: ("TCPInfo", "message", "LinuxTCPInfo", ""),
+        14: ("MemInfo", "message", "MemInfo", ""),
+        15: ("SocketMem", "message", "SocketMemInfo", ""),
+        16: ("VegasInfo", "message", "VegasInfo", ""),
+        17: ("DCTCPInfo", "message", "DCTCPInfo", ""),
+        18: ("BBRInfo", "message", "BBRInfo", ""),
+        19: ("MPTCPInfo", "message", "MPTCPInfo", ""),
+        20: ("MPTCPSubflow", "message", "MPTCPSubflowInfo", ""),
+    },
+    "InetDiagMsg": {
+        1: ("IDiagFamily", "uint", None, ""),
+        2: ("IDiagState", "uint", None, ""),
+        3: ("IDiagTimer", "uint", None, ""),
+        4: ("IDiagRetrans", "uint", None, ""),
+        6: ("IDiagExpires", "uint", None, ""),
+        7: ("IDiagRqueue", "uint", None, ""),
+        8: ("IDiagWqueue", "uint", None, ""),
+        9: ("IDiagUID", "uint", None, ""),
+        10: ("IDiagInode", "uint", None, ""),
+    },
+    "LinuxTCPInfo": {
+        1: ("State", "uint", None, ""),
+        2: ("CAState", "uint", None, ""),
+        3: ("Retransmits", "uint", None, ""),
+        4: ("Probes", "uint", None, ""),
+        5: ("Backoff", "uint", None, ""),
+        6: ("Options", "uint", None, ""),
+        7: ("WScale", "uint", None, ""),
+        8: ("AppLimited", "uint", None, ""),
+        9: ("RTO", "uint", None, ""),
+        10: ("ATO", "uint", None, ""),
+        11: ("SndMSS", "uint", None, ""),
+        12: ("RcvMSS", "uint", None, ""),
+        13: ("Unacked", "uint", None, ""),
+        14: ("Sacked", "uint", None, ""),
+        15: ("Lost", "uint", None, ""),
+        16: ("Retrans", "uint", None, ""),
+        17: ("Fackets", "uint", None, ""),
+        18: ("LastDataSent", "uint", None, ""),
+        19: ("LastAckSent", "uint", None, ""),
+        20: ("LastDataRecv", "uint", None, ""),
+        21: ("LastAckRecv", "uint", None, ""),
+        22: ("PMTU", "uint", None, ""),
+        23: ("RcvSsThresh", "uint", None, ""),
+        24: ("RTT", "uint", None, ""),
+        25: ("RTTVar", "uint", None, ""),
+        26: ("SndSsThresh", "uint", None, ""),
+        27: ("SndCwnd", "uint", None, ""),
+        28: ("AdvMSS", "uint", None, ""),
+        29: ("Reordering", "uint", None, ""),
+        30: ("RcvRTT", "uint", None, ""),
+        31: ("RcvSpace", "uint", None, ""),
+        32: ("TotalRetrans", "uint", None, ""),
+        33: ("PacingRate", "sint", None, ""),
+        34: ("MaxPacingRate", "sint", None, ""),
+        35: ("BytesAcked", "sint", None, ""),
+        36: ("BytesReceived", "sint", None, ""),
+        37: ("SegsOut", "sint", None, ""),
+        38: ("SegsIn", "sint", None, ""),
+        39: ("NotsentBytes", "uint", None, ""),
+        40: ("MinRTT", "uint", None, ""),
+        41: ("DataSegsIn", "uint", None, ""),
+        42: ("DataSegsOut", "uint", None, ""),
+        43: ("DeliveryRate", "sint", None, ""),
+        44: ("BusyTime", "sint", None, ""),
+        45: ("RWndLimited", "sint", None, ""),
+        46: ("SndBufLimited", "sint", None, ""),
+        47: ("Delivered", "uint", None, ""),
+        48: ("DeliveredCE", "uint", None, ""),
+        49: ("BytesSent", "sint", None, ""),
+        50: ("BytesRetrans", "sint", None, ""),
+        51: ("DSackDups", "uint", None, ""),
+        52: ("ReordSeen", "uint", None, ""),
+        53: ("RcvOooPack", "uint", None, ""),
+        54: ("SndWnd", "uint", None, ""),
+    },
+    "MemInfo": {
+        1: ("Rmem", "uint", None, ""),
+        2: ("Wmem", "uint", None, ""),
+        3: ("Fmem", "uint", None, ""),
+        4: ("Tmem", "uint", None, ""),
+    },
+    "SocketMemInfo": {
+        1: ("RmemAlloc", "uint", None, ""),
+        2: ("Rcvbuf", "uint", None, ""),
+        3: ("WmemAlloc", "uint", None, ""),
+        4: ("Sndbuf", "uint", None, ""),
+        5: ("FwdAlloc", "uint", None, ""),
+        6: ("WmemQueued", "uint", None, ""),
+        7: ("Optmem", "uint", None, ""),
+        8: ("Backlog", "uint", None, ""),
+        9: ("Drops", "uint", None, ""),
+    },
+    "VegasInfo": {
+        1: ("Enabled", "uint", None, ""),
+        2: ("RTTCount", "uint", None, ""),
+        3: ("RTT", "uint", None, ""),
+        4: ("MinRTT", "uint", None, ""),
+    },
+    "DCTCPInfo": {
+        1: ("Enabled", "uint", None, ""),
+        2: ("CEState", "uint", None, ""),
+        3: ("Alpha", "uint", None, ""),
+        4: ("ABEcn", "uint", None, ""),
+        5: ("ABTot", "uint", None, ""),
+    },
+    "BBRInfo": {
+        1: ("BW", "sint", None, ""),
+        2: ("MinRTT", "uint", None, ""),
+        3: ("PacingGain", "uint", None, ""),
+        4: ("CwndGain", "uint", None, ""),
+    },
+    "MPTCPInfo": {
+        1: ("Subflows", "uint", None, ""),
+        2: ("AddAddrSignal", "uint", None, ""),
+        3: ("AddAddrAccepted", "uint", None, ""),
+        4: ("SubflowsMax", "uint", None, ""),
+        5: ("AddAddrSignalMax", "uint", None, ""),
+        6: ("AddAddrAcceptedMax", "uint", None, ""),
+        7: ("Flags", "uint", None, ""),
+        8: ("Token", "uint", None, ""),
+        9: ("WriteSeq", "sint", None, ""),
+        10: ("SndUna", "sint", None, ""),
+        11: ("RcvNxt", "sint", None, ""),
+        12: ("LocalAddrUsed", "uint", None, ""),
+        13: ("LocalAddrMax", "uint", None, ""),
+        14: ("CsumEnabled", "uint", None, ""),
+        15: ("Retransmits", "uint", None, ""),
+        16: ("BytesRetrans", "sint", None, ""),
+        17: ("BytesSent", "sint", None, ""),
+        18: ("BytesReceived", "sint", None, ""),
+        19: ("BytesAcked", "sint", None, ""),
+        20: ("SubflowsTotal", "uint", None, ""),
+        21: ("LastDataSent", "uint", None, ""),
+        22: ("LastDataRecv", "uint", None, ""),
+        23: ("LastAckRecv", "uint", None, ""),
+    },
+    "MPTCPSubflowInfo": {
+        1: ("TokenRem", "uint", None, ""),
+        2: ("TokenLoc", "uint", None, ""),
+        3: ("RelWriteSeq", "uint", None, ""),
+        4: ("MapSeq", "sint", None, ""),
+        5: ("MapSfSeq", "uint", None, ""),
+        6: ("SsnOffset", "uint", None, ""),
+        7: ("MapDataLen", "uint", None, ""),
+        8: ("Flags", "uint", None, ""),
+        9: ("IDRem", "uint", None, ""),
+        10: ("IDLoc", "uint", None, ""),
+    },
+    "Metadata": {
+        1: ("UUID", "string", None, ""),
+        2: ("Sequence", "sint", None, ""),
+        3: ("StartTime", "timestamp", None, ""),
+        4: ("Machine", "string", None, ""),
+        5: ("Site", "string", None, ""),
+        6: ("Experiment", "string", None, ""),
+        7: ("Owner", "string", None, ""),
+        8: ("Protocol", "string", None, ""),
+        9: ("MPTCPToken", "uint", None, ""),
+        10: ("BootID", "string", None, ""),
+        11: ("BootTime", "timestamp", None, ""),
+        12: ("Clock", "string", None, ""),
+        13: ("ClockSource", "string", None, ""),
+        14: ("Sampling", "double", None, ""),
+        15: ("ShortFlowSampling", "double", None, ""),
+        16: ("Audit", "message", "AuditEvent", "repeated"),
+        17: ("Kernel", "message", "Capabilities", ""),
+        18: ("AttributePolicy", "message", "AttributePolicy", ""),
+        19: ("Elephant", "bool", None, ""),
+    },
+    "AuditEvent": {
+        1: ("Time", "timestamp", None, ""),
+        2: ("Setting", "string", None, ""),
+        3: ("Value", "string", None, ""),
+        4: ("Source", "string", None, ""),
+    },
+    "Capabilities": {
+        1: ("Attributes", "string", None, "repeated"),
+        2: ("TCPInfoLength", "sint", None, ""),
+    },
+    "AttributePolicy": {
+        1: ("Allow", "string", None, "repeated"),
+        2: ("Deny", "string", None, "repeated"),
+    },
+}
+
+_EPOCH = datetime.datetime(1970, 1, 1, tzinfo=datetime.timezone.utc)
+_ZERO = {"sint": 0, "uint": 0, "bool": False, "float": 0.0, "double": 0.0, "string": "", "bytes": b""}
+_FLOAT = struct.Struct("<f")
+_DOUBLE = struct.Struct("<d")
+
+
+def _varint(buf, pos):
+    result = 0
+    shift = 0
+    while True:
+        b = buf[pos]
+        pos += 1
+        result |= (b & 0x7F) << shift
+        if b < 0x80:
+            return result, pos
+        shift += 7
+
+
+def _zigzag(n):
+    return (n >> 1) ^ -(n & 1)
+
+
+def _empty(name):
+    msg = {}
+    for fname, kind, _, label in MESSAGES[name].values():
+        if label == "repeated":
+            msg[fname] = []
+        elif kind == "map":
+            msg[fname] = {}
+        elif label == "optional" or kind in ("message", "timestamp"):
+            msg[fname] = None
+        else:
+            msg[fname] = _ZERO[kind]
+    return msg
+
+
+def decode(buf, name=ROOT):
+    """Decodes a message of the named type into a dict.  Missing fields have their
+    zero values, or None for messages, timestamps and optional fields.  Maps are
+    decoded into dicts."""
+    fields = MESSAGES[name]
+    msg = _empty(name)
+    pos, end = 0, len(buf)
+    while pos < end:
+        key, pos = _varint(buf, pos)
+        number, wire = key >> 3, key & 7
+        if wire == 0:
+            value, pos = _varint(buf, pos)
+        elif wire == 1:
+            value, pos = buf[pos:pos + 8], pos + 8
+        elif wire == 2:
+            n, pos = _varint(buf, pos)
+            value, pos = buf[pos:pos + n], pos + n
+        elif wire == 5:
+            value, pos = buf[pos:pos + 4], pos + 4
+        else:
+            raise ValueError("unsupported wire type %d" % wire)
+        field = fields.get(number)
+        if field is None:
+            continue  # A field added after this reader was generated.
+        fname, kind, mname, label = field
+        if kind == "sint":
+            value = _zigzag(value)
+        elif kind == "bool":
+            value = value != 0
+        elif kind == "float":
+            value = _FLOAT.unpack(value)[0]
+        elif kind == "double":
+            value = _DOUBLE.unpack(value)[0]
+        elif kind == "string":
+            value = bytes(value).decode("utf-8")
+        elif kind == "bytes":
+            value = bytes(value)
+        elif kind == "timestamp":
+            value = _EPOCH + datetime.timedelta(microseconds=_zigzag(value))
+        elif kind == "message":
+            value = decode(value, mname)
+        elif kind == "map":
+            entry = decode(value, mname)
+            msg[fname][entry["key"]] = entry["value"]
+            continue
+        if label == "repeated":
+            msg[fname].append(value)
+        else:
+            msg[fname] = value
+    return msg
+
+
+def read(f):
+    """Yields the messages of a framed file object, opened in binary mode, as dicts.
+    Files compressed with zstd require the zstandard module."""
+    data = f.read()
+    if data[:4] == b"\x28\xb5\x2f\xfd":
+        import zstandard
+        data = zstandard.ZstdDecompressor().decompressobj().decompress(data)
+    if not data.startswith(MAGIC):
+        raise ValueError("not a tcp-info framed file")
+    buf = memoryview(data)
+    pos = len(MAGIC)
+    n, pos = _varint(buf, pos)
+    pos += n  # The schema, from which this module was generated.
+    while pos < len(buf):
+        n, pos = _varint(buf, pos)
+        yield decode(buf[pos:pos + n])
+        pos += n
+
+
+def flatten(msg, prefix=""):
+    """Flattens the nested messages of a decoded message, e.g. into "Snapshot.TCPInfo.RTT"."""
+    out = {}
+    for k, v in msg.items():
+        if isinstance(v, dict):
+            out.update(flatten(v, prefix + k + "."))
+        else:
+            out[prefix + k] = v
+    return out
+
+
+def read_dataframe(path):
+    """Returns the messages of a framed file as a pandas DataFrame, with a column
+    for each field."""
+    import pandas
+    with open(path, "rb") as f:
+        return pandas.DataFrame([flatten(m) for m in read(f)])
+
+
+if __name__ == "__main__":
+    for path in sys.argv[1:]:
+        with open(path, "rb") as f:
+            for m in read(f):
+                print(flatten(m))
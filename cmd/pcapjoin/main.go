@@ -0,0 +1,403 @@
+// Main package in pcapjoin implements a command line tool that matches the packets
+// of a pcap file to the connections in a tcp-info archive tree, and writes a CSV join
+// table of packet numbers and connection UUIDs.
+// See cmd/pcapjoin/README.md for more information.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/manifest"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+var (
+	slack = flag.Duration("slack", 10*time.Second, "How far outside the first and last snapshots of a connection its packets may be.")
+
+	// A variable to enable mocking for testing.
+	logFatal = log.Fatal
+)
+
+// Errors returned while reading pcap files.
+var (
+	ErrNotPcap         = errors.New("not a pcap file")
+	ErrPcapNG          = errors.New("pcapng files are not supported, convert with: editcap -F pcap")
+	ErrUnsupportedLink = errors.New("unsupported link type")
+)
+
+// Link types, from https://www.tcpdump.org/linktypes.html
+const (
+	linkEthernet = 1
+	linkRaw      = 101
+	linkRawAlt   = 12 // LINKTYPE_RAW on some platforms.
+	linkSLL      = 113
+	linkSLL2     = 276
+)
+
+// endpoint is an IP address and port.  IPv4 addresses, including IPv4-mapped IPv6
+// addresses, are in dotted quad form, so that they match however they were observed.
+type endpoint struct {
+	ip   string
+	port uint16
+}
+
+func newEndpoint(ip net.IP, port uint16) endpoint {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return endpoint{ip: ip.String(), port: port}
+}
+
+func (e endpoint) String() string {
+	return net.JoinHostPort(e.ip, strconv.Itoa(int(e.port)))
+}
+
+// flowKey identifies the two directions of a TCP flow.  The endpoints are ordered,
+// so that a packet and its reply have the same key.
+type flowKey struct {
+	a, b endpoint
+}
+
+func newFlowKey(src, dst endpoint) flowKey {
+	if dst.String() < src.String() {
+		src, dst = dst, src
+	}
+	return flowKey{a: src, b: dst}
+}
+
+// connection is the time range over which a connection was observed.
+type connection struct {
+	uuid       string
+	local      endpoint // The endpoint of the socket.
+	start, end time.Time
+}
+
+// index holds the connections of an archive tree, by flow.
+type index map[flowKey][]*connection
+
+// add adds the snapshots of one connection file to the index.  Connections that
+// span several files are merged by UUID.
+func (idx index) add(meta *netlink.Metadata, snaps []*snapshot.Snapshot) {
+	if meta == nil {
+		return
+	}
+	for _, s := range snaps {
+		if s.InetDiagMsg == nil {
+			continue
+		}
+		id := s.InetDiagMsg.ID.GetSockID()
+		local := newEndpoint(net.ParseIP(id.SrcIP), id.SPort)
+		key := newFlowKey(local, newEndpoint(net.ParseIP(id.DstIP), id.DPort))
+		var conn *connection
+		for _, c := range idx[key] {
+			if c.uuid == meta.UUID {
+				conn = c
+			}
+		}
+		if conn == nil {
+			conn = &connection{uuid: meta.UUID, local: local, start: s.Timestamp, end: s.Timestamp}
+			idx[key] = append(idx[key], conn)
+		}
+		if s.Timestamp.Before(conn.start) {
+			conn.start = s.Timestamp
+		}
+		if s.Timestamp.After(conn.end) {
+			conn.end = s.Timestamp
+		}
+	}
+}
+
+// find returns the connection of the flow whose time range, extended by slack,
+// contains t.  If several do, the one with the nearest range is returned.
+func (idx index) find(key flowKey, t time.Time, slack time.Duration) *connection {
+	var best *connection
+	var bestDist time.Duration
+	for _, c := range idx[key] {
+		var dist time.Duration
+		if t.Before(c.start) {
+			dist = c.start.Sub(t)
+		} else if t.After(c.end) {
+			dist = t.Sub(c.end)
+		}
+		if dist <= slack && (best == nil || dist < bestDist) {
+			best, bestDist = c, dist
+		}
+	}
+	return best
+}
+
+// indexArchive reads all the connection files under dir.
+func indexArchive(dir string) (index, error) {
+	idx := make(index)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		// Only connection files, not e.g. the daily index files.
+		if ok, _ := filepath.Match("*.[0-9][0-9][0-9][0-9][0-9].jsonl.zst", info.Name()); !ok {
+			return nil
+		}
+		err = manifest.Verify(path)
+		if err != nil {
+			return err
+		}
+		rdr := zstd.NewReader(path)
+		defer rdr.Close()
+		meta, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", path, err)
+		}
+		idx.add(meta, snaps)
+		return nil
+	})
+	return idx, err
+}
+
+// packet is a TCP packet from a pcap file.
+type packet struct {
+	frame    int // Number of the packet in the file, from 1, as shown by Wireshark.
+	time     time.Time
+	length   int // Original length of the packet.
+	src, dst endpoint
+}
+
+// pcapReader reads the packets of a classic pcap file.
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+	frame    int
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var hdr [24]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotPcap, err)
+	}
+	p := &pcapReader{r: r}
+	switch binary.LittleEndian.Uint32(hdr[:4]) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nanos = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, ErrPcapNG
+	default:
+		return nil, ErrNotPcap
+	}
+	p.linkType = p.order.Uint32(hdr[20:24]) & 0xffff
+	switch p.linkType {
+	case linkEthernet, linkRaw, linkRawAlt, linkSLL, linkSLL2:
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedLink, p.linkType)
+	}
+	return p, nil
+}
+
+// next returns the next TCP packet.  Other packets are skipped.
+func (p *pcapReader) next() (*packet, error) {
+	for {
+		var hdr [16]byte
+		_, err := io.ReadFull(p.r, hdr[:])
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("%w: truncated packet header", ErrNotPcap)
+			}
+			return nil, err // Including io.EOF.
+		}
+		sec := int64(p.order.Uint32(hdr[0:4]))
+		frac := int64(p.order.Uint32(hdr[4:8]))
+		if !p.nanos {
+			frac *= 1000
+		}
+		data := make([]byte, p.order.Uint32(hdr[8:12]))
+		_, err = io.ReadFull(p.r, data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: truncated packet", ErrNotPcap)
+		}
+		p.frame++
+		pkt, ok := p.parse(data)
+		if !ok {
+			continue
+		}
+		pkt.frame = p.frame
+		pkt.time = time.Unix(sec, frac).UTC()
+		pkt.length = int(p.order.Uint32(hdr[12:16]))
+		return pkt, nil
+	}
+}
+
+// parse decodes the addresses and ports of a TCP packet.
+func (p *pcapReader) parse(data []byte) (*packet, bool) {
+	var ethertype uint16
+	switch p.linkType {
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		ethertype = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		// Skip any VLAN tags.
+		for (ethertype == 0x8100 || ethertype == 0x88a8) && len(data) >= 4 {
+			ethertype = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case linkSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		ethertype = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case linkSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		ethertype = binary.BigEndian.Uint16(data[0:2])
+		data = data[20:]
+	case linkRaw, linkRawAlt:
+		if len(data) < 1 {
+			return nil, false
+		}
+		ethertype = map[byte]uint16{4: 0x0800, 6: 0x86dd}[data[0]>>4]
+	}
+
+	var src, dst net.IP
+	switch ethertype {
+	case 0x0800:
+		if len(data) < 20 || data[9] != 6 {
+			return nil, false
+		}
+		// Only first fragments have the TCP header.
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			return nil, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		src, dst = net.IP(data[12:16]), net.IP(data[16:20])
+		if len(data) < ihl {
+			return nil, false
+		}
+		data = data[ihl:]
+	case 0x86dd:
+		// Extension headers are not supported, so only packets whose next header is
+		// TCP are matched.
+		if len(data) < 40 || data[6] != 6 {
+			return nil, false
+		}
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:]
+	default:
+		return nil, false
+	}
+	if len(data) < 4 {
+		return nil, false
+	}
+	return &packet{
+		src: newEndpoint(src, binary.BigEndian.Uint16(data[0:2])),
+		dst: newEndpoint(dst, binary.BigEndian.Uint16(data[2:4])),
+	}, true
+}
+
+// join writes a CSV row for each packet in the pcap that matches a connection in
+// the index, and returns the number of packets matched and read.
+func join(idx index, r io.Reader, w io.Writer, slack time.Duration) (int, int, error) {
+	p, err := newPcapReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"frame", "time", "uuid", "direction", "src", "dst", "length"})
+	matched, total := 0, 0
+	for {
+		pkt, err := p.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return matched, total, err
+		}
+		total++
+		conn := idx.find(newFlowKey(pkt.src, pkt.dst), pkt.time, slack)
+		if conn == nil {
+			continue
+		}
+		matched++
+		// The direction is relative to the socket that tcp-info observed.
+		direction := "received"
+		if pkt.src == conn.local {
+			direction = "sent"
+		}
+		out.Write([]string{
+			strconv.Itoa(pkt.frame), pkt.time.Format(time.RFC3339Nano), conn.uuid, direction,
+			pkt.src.String(), pkt.dst.String(), strconv.Itoa(pkt.length),
+		})
+	}
+	out.Flush()
+	return matched, total, out.Error()
+}
+
+// uuids returns the UUIDs in the index, sorted, for logging.
+func (idx index) uuids() []string {
+	seen := map[string]bool{}
+	for _, conns := range idx {
+		for _, c := range conns {
+			seen[c.uuid] = true
+		}
+	}
+	var out []string
+	for u := range seen {
+		out = append(out, u)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		logFatal("Usage: pcapjoin [-slack=10s] FILE.pcap ARCHIVE_DIR")
+		return
+	}
+	idx, err := indexArchive(flag.Arg(1))
+	rtx.Must(err, "Could not index archive %s", flag.Arg(1))
+	log.Println("Indexed", len(idx.uuids()), "connections under", flag.Arg(1))
+
+	f, err := os.Open(flag.Arg(0))
+	rtx.Must(err, "Could not open %s", flag.Arg(0))
+	defer f.Close()
+	matched, total, err := join(idx, bufio.NewReader(f), os.Stdout, *slack)
+	rtx.Must(err, "Could not join %s", flag.Arg(0))
+	log.Println("Matched", matched, "of", total, "TCP packets in", flag.Arg(0))
+	if matched == 0 && total > 0 {
+		log.Println(strings.TrimSpace(`
+No packets matched.  Check that the archive was not recorded with IP anonymization,
+and that the pcap was captured on the same host, at the same time.`))
+	}
+}
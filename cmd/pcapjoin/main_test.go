@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+const testDir = "../csvtool/testdata"
+
+// pcapFile builds a little endian, microsecond pcap file with Ethernet framing.
+type pcapFile struct {
+	bytes.Buffer
+}
+
+func newPcapFile() *pcapFile {
+	p := &pcapFile{}
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkEthernet)
+	p.Write(hdr)
+	return p
+}
+
+// add appends an IPv4 packet with the given protocol, e.g. 6 for TCP.
+func (p *pcapFile) add(t time.Time, proto byte, src, dst endpoint) {
+	frame := make([]byte, 14+20+20)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	ip[9] = proto
+	copy(ip[12:16], net.ParseIP(src.ip).To4())
+	copy(ip[16:20], net.ParseIP(dst.ip).To4())
+	binary.BigEndian.PutUint16(ip[20:22], src.port)
+	binary.BigEndian.PutUint16(ip[22:24], dst.port)
+
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(frame)+1000))
+	p.Write(hdr)
+	p.Write(frame)
+}
+
+func TestJoin(t *testing.T) {
+	idx, err := indexArchive(testDir)
+	rtx.Must(err, "Could not index %s", testDir)
+	if len(idx) != 1 {
+		t.Fatal("Expected one flow, got", len(idx))
+	}
+	var key flowKey
+	var conn *connection
+	for k, conns := range idx {
+		key, conn = k, conns[0]
+	}
+	if conn.uuid != "ndt-jdczh_1553815964_00000000000003E8" || !conn.end.After(conn.start) {
+		t.Fatalf("Bad connection %+v", conn)
+	}
+	remote := key.a
+	if remote == conn.local {
+		remote = key.b
+	}
+	other := endpoint{ip: remote.ip, port: remote.port + 1}
+
+	p := newPcapFile()
+	p.add(conn.start.Add(time.Second), 6, conn.local, remote)  // 1: sent
+	p.add(conn.start.Add(time.Second), 17, remote, conn.local) // 2: UDP, skipped
+	p.add(conn.end.Add(5*time.Second), 6, remote, conn.local)  // 3: received, within slack
+	p.add(conn.end.Add(time.Minute), 6, remote, conn.local)    // 4: too late
+	p.add(conn.start.Add(time.Second), 6, other, conn.local)   // 5: different flow
+
+	out := &bytes.Buffer{}
+	matched, total, err := join(idx, p, out, 10*time.Second)
+	rtx.Must(err, "Could not join")
+	if matched != 2 || total != 4 {
+		t.Errorf("join() = %d, %d, want 2, 4", matched, total)
+	}
+	rows, err := csv.NewReader(out).ReadAll()
+	rtx.Must(err, "Could not read CSV")
+	if len(rows) != 3 {
+		t.Fatal("Expected header and two rows, got", rows)
+	}
+	want := [][]string{
+		{"1", conn.uuid, "sent", conn.local.String(), remote.String(), "1054"},
+		{"3", conn.uuid, "received", remote.String(), conn.local.String(), "1054"},
+	}
+	for i, w := range want {
+		r := rows[i+1]
+		got := []string{r[0], r[2], r[3], r[4], r[5], r[6]}
+		for j := range w {
+			if got[j] != w[j] {
+				t.Errorf("Row %d = %v, want %v", i+1, got, w)
+				break
+			}
+		}
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rows[1][1])
+	rtx.Must(err, "Bad time %q", rows[1][1])
+	if !ts.Equal(conn.start.Add(time.Second).Truncate(time.Microsecond)) {
+		t.Error("Wrong time", ts)
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	pcapng := append([]byte{0x0a, 0x0d, 0x0d, 0x0a}, make([]byte, 20)...)
+	_, _, err := join(index{}, bytes.NewReader(pcapng), &bytes.Buffer{}, 0)
+	if !errors.Is(err, ErrPcapNG) {
+		t.Error("Expected ErrPcapNG, got", err)
+	}
+	_, _, err = join(index{}, bytes.NewReader([]byte("not a pcap file at all!!")), &bytes.Buffer{}, 0)
+	if !errors.Is(err, ErrNotPcap) {
+		t.Error("Expected ErrNotPcap, got", err)
+	}
+	p := newPcapFile()
+	p.Bytes()[20] = 105 // 802.11
+	_, _, err = join(index{}, p, &bytes.Buffer{}, 0)
+	if !errors.Is(err, ErrUnsupportedLink) {
+		t.Error("Expected ErrUnsupportedLink, got", err)
+	}
+	p = newPcapFile()
+	p.add(time.Now(), 6, endpoint{"1.2.3.4", 1}, endpoint{"5.6.7.8", 2})
+	p.Truncate(p.Len() - 10)
+	_, _, err = join(index{}, p, &bytes.Buffer{}, 0)
+	if !errors.Is(err, ErrNotPcap) {
+		t.Error("Expected ErrNotPcap for a truncated packet, got", err)
+	}
+}
+
+func TestMainWrongArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		logFatal = log.Fatal
+	}(os.Args)
+
+	os.Args = []string{"test_pcapjoin", "file.pcap"}
+	logFatal = func(...interface{}) {
+		panic("panic instead of log.Fatal")
+	}
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			t.Error("Should have panicked")
+		}
+	}()
+
+	main()
+}
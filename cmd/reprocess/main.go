@@ -0,0 +1,172 @@
+// Main package in reprocess implements a command line tool that recomputes the
+// derived fields and summaries of archived connections with the current Derivers,
+// and writes them to sidecar files beside the connection files.
+// See cmd/reprocess/README.md for more information.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/manifest"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/reader"
+	"github.com/m-lab/tcp-info/saver"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+// SidecarSuffix is appended to the UUID of a connection to name its sidecar file.
+const SidecarSuffix = ".reprocessed.json"
+
+var (
+	// connectionFile matches the names of the JSONL connection files, e.g.
+	// ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst, or the .udp.jsonl.zst
+	// files of UDP sockets.
+	connectionFile = regexp.MustCompile(`\.[0-9]{5}(\.[a-z]+)?\.jsonl(\.zst)?$`)
+
+	// A variable to enable mocking for testing.
+	logFatal = log.Fatal
+)
+
+// file is a connection file.
+type file struct {
+	path string
+	meta *netlink.Metadata
+}
+
+// readFile returns the Metadata and the snapshots of a connection file, after
+// verifying it against the manifest of its directory, if there is one.  If
+// metaOnly is true, it only reads the Metadata.
+func readFile(path string, metaOnly bool) (*netlink.Metadata, []*netlink.ArchivalRecord, error) {
+	err := manifest.Verify(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta *netlink.Metadata
+	var snapshots []*netlink.ArchivalRecord
+	if metaOnly {
+		r, err := reader.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		meta = r.Metadata()
+		r.Close()
+	} else {
+		meta, snapshots, err = reader.ReadAll(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if meta == nil || meta.UUID == "" {
+		return nil, nil, fmt.Errorf("%s: no metadata", path)
+	}
+	return meta, snapshots, nil
+}
+
+// connections returns the connection files named by paths, or under the
+// directories named by paths, by UUID, in order of sequence number.
+func connections(paths []string) (map[string][]file, error) {
+	conns := make(map[string][]file)
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !connectionFile.MatchString(info.Name()) {
+				return err
+			}
+			meta, _, err := readFile(path, true)
+			if err != nil {
+				return err
+			}
+			conns[meta.UUID] = append(conns[meta.UUID], file{path: path, meta: meta})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, files := range conns {
+		sort.SliceStable(files, func(i, j int) bool { return files[i].meta.Sequence < files[j].meta.Sequence })
+	}
+	return conns, nil
+}
+
+// reprocess computes the Sidecar of a connection from its files.
+func reprocess(files []file, derivers []saver.Deriver) (*saver.Sidecar, error) {
+	r := saver.NewReprocessor(derivers)
+	for _, f := range files {
+		meta, snapshots, err := readFile(f.path, false)
+		if err != nil {
+			return nil, err
+		}
+		r.Add(meta, snapshots)
+	}
+	return r.Sidecar(), nil
+}
+
+// writeSidecar writes the sidecar to the directory dir, replacing any previous one
+// only once it is complete.
+func writeSidecar(dir string, sidecar *saver.Sidecar) error {
+	b, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, sidecar.UUID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, sidecar.UUID+SidecarSuffix))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// run reprocesses the connections with files named by, or under, paths, and
+// writes the sidecar of each beside its last file.  It returns the number of
+// connections reprocessed.
+func run(paths []string, derivers []saver.Deriver) (int, error) {
+	conns, err := connections(paths)
+	if err != nil {
+		return 0, err
+	}
+	for _, files := range conns {
+		sidecar, err := reprocess(files, derivers)
+		if err != nil {
+			return 0, err
+		}
+		err = writeSidecar(filepath.Dir(files[len(files)-1].path), sidecar)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(conns), nil
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		logFatal("Name the connection files, or directories of them, to reprocess.")
+	}
+	derivers := saver.RegisteredDerivers()
+	n, err := run(args, derivers)
+	rtx.Must(err, "Could not reprocess %v", args)
+	log.Printf("Reprocessed %d connections with %d derivers", n, len(derivers))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+const testFile = "../csvtool/testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst"
+
+func TestMainNoArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		logFatal = log.Fatal
+	}(os.Args)
+
+	os.Args = []string{"test_reprocess"}
+	logFatal = func(...interface{}) {
+		panic("panic instead of log.Fatal")
+	}
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			t.Error("Should have panicked")
+		}
+	}()
+
+	main()
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReprocess")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile(testFile)
+	rtx.Must(err, "Could not read %s", testFile)
+	day := filepath.Join(dir, "2019/04/01")
+	rtx.Must(os.MkdirAll(day, 0755), "Could not create %s", day)
+	rtx.Must(ioutil.WriteFile(filepath.Join(day, filepath.Base(testFile)), b, 0644), "Could not copy %s", testFile)
+	// Other files are ignored.
+	rtx.Must(ioutil.WriteFile(filepath.Join(day, "host_sketches_20190401T000000Z.jsonl.zst"), []byte("x"), 0644), "Could not write")
+
+	rtt := saver.Deriver{Name: "rtt_ms", Derive: func(previous, current *snapshot.Snapshot) (float64, bool) {
+		if current.TCPInfo == nil {
+			return 0, false
+		}
+		return float64(current.TCPInfo.RTT) / 1000, true
+	}}
+	for i := 0; i < 2; i++ {
+		// The second run replaces the sidecar of the first.
+		n, err := run([]string{dir}, []saver.Deriver{rtt})
+		rtx.Must(err, "Could not reprocess %s", dir)
+		if n != 1 {
+			t.Errorf("Reprocessed %d connections, want 1", n)
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(day, "*"+SidecarSuffix))
+	rtx.Must(err, "Could not glob")
+	all, err := filepath.Glob(filepath.Join(day, "*"))
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 || len(all) != 3 {
+		t.Fatalf("Wrong files %v", all)
+	}
+
+	meta, snapshots, err := readFile(filepath.Join(day, filepath.Base(testFile)), false)
+	rtx.Must(err, "Could not read %s", testFile)
+	b, err = ioutil.ReadFile(names[0])
+	rtx.Must(err, "Could not read %s", names[0])
+	var sc saver.Sidecar
+	rtx.Must(json.Unmarshal(b, &sc), "Could not parse %s", b)
+	if filepath.Base(names[0]) != meta.UUID+SidecarSuffix || sc.UUID != meta.UUID || sc.Summary.Snapshots != len(snapshots) {
+		t.Errorf("Wrong sidecar %s: %+v", names[0], sc.Summary)
+	}
+	if len(sc.Snapshots) != len(snapshots) || sc.Snapshots[0].Sequence != meta.Sequence || sc.Snapshots[0].Derived["rtt_ms"] == 0 {
+		t.Errorf("Wrong derived snapshots %+v", sc.Snapshots[:1])
+	}
+	if sc.Summary.RTT == nil || sc.Summary.BytesSent == 0 || sc.Summary.FinalState == "" {
+		t.Errorf("Incomplete summary %+v", sc.Summary)
+	}
+
+	if _, err := run([]string{filepath.Join(dir, "missing")}, nil); err == nil {
+		t.Error("Expected an error for a missing path")
+	}
+}
@@ -0,0 +1,93 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+)
+
+// DefaultInterval is the polling interval of a Collector that has none set.
+const DefaultInterval = 10 * time.Millisecond
+
+// A Collector polls the netlink socket for the sockets of its address families,
+// and sends each batch of messages to its Output channel, so that tcp-info can be
+// embedded in other programs.  Its fields should be set before Run is called.
+type Collector struct {
+	// Output receives the messages of each poll.  Run does not close it, and
+	// stops sending to it when the context is canceled, or Stop is called, so that
+	// its reader may stop at the same time.
+	Output chan<- netlink.MessageBlock
+	// Interval is the time between polls.  Zero polls every DefaultInterval.
+	Interval time.Duration
+	// Families are the address families polled, e.g. syscall.AF_INET.  If empty,
+	// both AF_INET6 and AF_INET are polled.
+	Families []uint8
+	// UDP enables the collection of UDP and UDP-Lite sockets, as well as TCP sockets.
+	UDP bool
+	// MPTCP enables the collection of MPTCP connections.  It requires a kernel with
+	// the mptcp_diag module.
+	MPTCP bool
+	// Filter, if not nil, selects the sockets that are sent to Output.  Once Run is
+	// called, it must only be changed with SetFilter.
+	Filter *FilterConfig
+	// UnknownTypes sends the messages of types other than SOCK_DIAG_BY_FAMILY to
+	// Output, for diagnosis by the saver, rather than dropping them.
+	UnknownTypes bool
+	// HostCounters reads the host-wide TCP counters of /proc/net/snmp and
+	// /proc/net/netstat once per poll, and sends them with the messages.
+	HostCounters bool
+	// Pipeline is the number of dumps of a poll that may be received ahead of the
+	// one being filtered, so that the syscalls of one dump overlap the parsing of
+	// the previous one.  Zero receives and filters each dump in turn.
+	Pipeline int
+	// Reps is the number of polls, after which Run returns.  Zero polls until the
+	// context is canceled, or Stop is called.
+	Reps int
+	// Logger, if not nil, logs the cache statistics roughly once per minute.
+	Logger saver.CacheLogger
+
+	lock    sync.Mutex
+	stop    chan struct{} // Closed by Stop.
+	stopped bool
+	running sync.WaitGroup
+}
+
+// done returns the channel that is closed by Stop.
+func (c *Collector) done() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stop == nil {
+		c.stop = make(chan struct{})
+	}
+	return c.stop
+}
+
+// SetFilter replaces the Filter, e.g. when the fleet configuration changes.  It
+// may be called while Run is running, and takes effect from the next dump.
+func (c *Collector) SetFilter(f *FilterConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Filter = f
+}
+
+// currentFilter returns the Filter.
+func (c *Collector) currentFilter() *FilterConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Filter
+}
+
+// Stop stops the Collector, and waits for Run to return, after the current poll.
+// A Collector cannot be restarted.
+func (c *Collector) Stop() {
+	c.done()
+	c.lock.Lock()
+	if !c.stopped {
+		close(c.stop)
+		c.stopped = true
+	}
+	c.lock.Unlock()
+	c.running.Wait()
+}
@@ -2,13 +2,22 @@ package collector
 
 import (
 	"context"
+	"syscall"
 
 	"github.com/m-lab/tcp-info/netlink"
-	"github.com/m-lab/tcp-info/saver"
 )
 
+// Probe does nothing, but needed for compiling on Darwin.
+func Probe() (*netlink.Capabilities, error) {
+	return nil, nil
+}
+
+// DestroyCookie is not supported on Darwin.
+func DestroyCookie(cookie uint64) error {
+	return syscall.EOPNOTSUPP
+}
+
 // Run does nothing, but needed for compiling on Darwin.
-func Run(ctx context.Context, reps int, svrChan chan<- netlink.MessageBlock, cl saver.CacheLogger, skipLocal bool) (localCount, errCount int) {
-	// Does notihg in Darwin
+func (c *Collector) Run(ctx context.Context) (localCount, errCount int) {
 	return 0, 0
 }
@@ -1,6 +1,6 @@
 // Package collector repeatedly queries the netlink socket to discover
-// measurement data about open TCP connections and sends that data down a
-// channel.
+// measurement data about open TCP connections, and optionally UDP sockets and
+// MPTCP connections, and sends that data down a channel.
 package collector
 
 import (
@@ -9,10 +9,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/m-lab/tcp-info/fault"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/loglevel"
 	"github.com/m-lab/tcp-info/metrics"
 
 	"github.com/m-lab/tcp-info/netlink"
-	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/snmp"
 )
 
 var (
@@ -20,68 +23,218 @@ var (
 	localCount = 0
 )
 
-// collectDefaultNamespace collects all AF_INET6 and AF_INET connection stats, and sends them
-// to svr.
-func collectDefaultNamespace(svr chan<- netlink.MessageBlock, skipLocal bool) (int, int) {
+// udpProtocols are the protocols collected when UDP is enabled.
+var udpProtocols = []inetdiag.Protocol{inetdiag.Protocol_IPPROTO_UDP, inetdiag.Protocol_IPPROTO_UDPLITE}
+
+// otherProtocols returns the protocols other than TCP that are collected.
+func (c *Collector) otherProtocols() []inetdiag.Protocol {
+	var protocols []inetdiag.Protocol
+	if c.UDP {
+		protocols = append(protocols, udpProtocols...)
+	}
+	if c.MPTCP {
+		protocols = append(protocols, inetdiag.Protocol_IPPROTO_MPTCP)
+	}
+	return protocols
+}
+
+// filter removes the messages of the sockets not selected by f, in place.
+// Messages that cannot be parsed are kept, so that the saver reports them.
+func filter(f *FilterConfig, msgs []*syscall.NetlinkMessage) []*syscall.NetlinkMessage {
+	if f == nil {
+		return msgs
+	}
+	kept := msgs[:0]
+	for _, m := range msgs {
+		raw, _ := inetdiag.SplitInetDiagMsg(m.Data)
+		idm, err := raw.Parse()
+		if err != nil || f.Match(idm) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// A dumpRequest is a dump of the sockets of an address family and protocol.
+type dumpRequest struct {
+	af       uint8
+	protocol uint16
+}
+
+// A dumpResult is the response to a dumpRequest, with the times at which the dump
+// started and ended.
+type dumpResult struct {
+	dumpRequest
+	start, end time.Time
+	msgs       []*syscall.NetlinkMessage
+	err        error
+}
+
+// requests returns the dumps of a poll: TCP for each family, then each other
+// protocol for each family.
+func (c *Collector) requests(families []uint8) []dumpRequest {
+	var reqs []dumpRequest
+	for _, af := range families {
+		reqs = append(reqs, dumpRequest{af, syscall.IPPROTO_TCP})
+	}
+	for _, p := range c.otherProtocols() {
+		for _, af := range families {
+			reqs = append(reqs, dumpRequest{af, uint16(p)})
+		}
+	}
+	return reqs
+}
+
+// dumps runs the dumps of reqs in order on sock, and returns their results in
+// order.  If the Collector's Pipeline is positive, the dumps run in another
+// goroutine, up to Pipeline of them ahead of the result being filtered, so that
+// the filtering of one dump overlaps the syscalls of the next.  Otherwise, all the
+// dumps run before dumps returns.  The channel is closed after the last result, and
+// must be drained before sock is used again.
+func (c *Collector) dumps(reqs []dumpRequest, sock *dumpSocket) <-chan dumpResult {
+	dump := func(r dumpRequest) dumpResult {
+		start := fault.Now()
+		msgs, err := sock.dump(r.af, r.protocol, c.UnknownTypes)
+		return dumpResult{dumpRequest: r, start: start, end: fault.Now(), msgs: msgs, err: err}
+	}
+	if c.Pipeline <= 0 {
+		results := make(chan dumpResult, len(reqs))
+		for _, r := range reqs {
+			results <- dump(r)
+		}
+		close(results)
+		return results
+	}
+	results := make(chan dumpResult, c.Pipeline-1)
+	go func() {
+		defer close(results)
+		for _, r := range reqs {
+			results <- dump(r)
+		}
+	}()
+	return results
+}
+
+// collect collects the TCP connection stats of the Collector's families, and
+// those of its other protocols, with the reused socket, and sends them to its
+// Output, unless the context is canceled, or the Collector stopped, first.  It
+// returns the number of sockets collected.
+func (c *Collector) collect(ctx context.Context, stop <-chan struct{}, sock *dumpSocket) int {
 	// Preallocate space for up to 500 connections.  We may want to adjust this upwards if profiling
 	// indicates a lot of reallocation.
 	buffer := netlink.MessageBlock{}
 
-	remoteCount := 0
-	res6, err := OneType(syscall.AF_INET6)
-	buffer.V6Time = time.Now()
-	if err != nil {
-		// Properly handle errors
-		// TODO add metric
-		log.Println(err)
-	} else {
-		buffer.V6Messages = res6
-	}
-	res4, err := OneType(syscall.AF_INET)
-	buffer.V4Time = time.Now()
-	if err != nil {
-		// Properly handle errors
-		// TODO add metric
-		log.Println(err)
-	} else {
-		buffer.V4Messages = res4
+	families := c.Families
+	if len(families) == 0 {
+		families = []uint8{syscall.AF_INET6, syscall.AF_INET}
+	}
+	total := 0
+	// The results of the other protocols are in order, so each starts a new
+	// ProtocolMessages when its protocol changes.
+	var other *netlink.ProtocolMessages
+	for res := range c.dumps(c.requests(families), sock) {
+		if res.err != nil {
+			// Properly handle errors
+			// TODO add metric
+			log.Println(res.err)
+		} else {
+			res.msgs = filter(c.currentFilter(), res.msgs)
+		}
+		if res.protocol == syscall.IPPROTO_TCP {
+			if res.err == nil {
+				total += len(res.msgs)
+			}
+			switch res.af {
+			case syscall.AF_INET6:
+				buffer.V6Start, buffer.V6Time, buffer.V6Messages = res.start, res.end, res.msgs
+			case syscall.AF_INET:
+				buffer.V4Start, buffer.V4Time, buffer.V4Messages = res.start, res.end, res.msgs
+			}
+			continue
+		}
+		if other == nil || other.Protocol != inetdiag.Protocol(res.protocol) {
+			buffer.Other = append(buffer.Other, netlink.ProtocolMessages{Protocol: inetdiag.Protocol(res.protocol), Start: res.start})
+			other = &buffer.Other[len(buffer.Other)-1]
+		}
+		other.Time = res.end
+		if res.err == nil {
+			other.Messages = append(other.Messages, res.msgs...)
+			total += len(res.msgs)
+		}
+	}
+
+	metrics.NetlinkSocketFailures.Set(float64(sock.failures))
+
+	if c.HostCounters {
+		counters, err := snmp.Read()
+		if err != nil {
+			loglevel.Limitedln(loglevel.Error, loglevel.Failure, "Could not read host counters:", err)
+			metrics.ErrorCount.WithLabelValues("host counters").Inc()
+		} else {
+			buffer.Host = counters
+		}
 	}
 
 	// Submit full set of message to the marshalling service.
-	svr <- buffer
+	select {
+	case c.Output <- buffer:
+	case <-ctx.Done():
+	case <-stop:
+	}
 
-	return len(res4) + len(res6), remoteCount
+	return total
 }
 
-// Run the collector, either for the specified number of loops, or, if the
-// number specified is infinite, run forever.
-func Run(ctx context.Context, reps int, svrChan chan<- netlink.MessageBlock, cl saver.CacheLogger, skipLocal bool) (localCount, errCount int) {
+// Run runs the Collector until it has polled Reps times, the context is canceled,
+// or Stop is called.
+func (c *Collector) Run(ctx context.Context) (localCount, errCount int) {
+	c.running.Add(1)
+	defer c.running.Done()
+	stop := c.done()
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	// Log the cache stats roughly once per minute.
+	statsEvery := int(time.Minute / interval)
+	if statsEvery < 1 {
+		statsEvery = 1
+	}
 	totalCount := 0
 	remoteCount := 0
 	loops := 0
 
-	// TODO - make this interval programmable.
-	ticker := time.NewTicker(10 * time.Millisecond)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	sock := &dumpSocket{}
+	defer sock.Close()
 
-	lastCollectionTime := time.Now().Add(-10 * time.Millisecond)
+	lastCollectionTime := time.Now().Add(-interval)
 
-	for loops = 0; (reps == 0 || loops < reps) && (ctx.Err() == nil); loops++ {
-		total, remote := collectDefaultNamespace(svrChan, skipLocal)
-		totalCount += total
-		remoteCount += remote
-		// print stats roughly once per minute.
-		if loops%6000 == 0 {
-			cl.LogCacheStats(localCount, errCount)
+loop:
+	for loops = 0; (c.Reps == 0 || loops < c.Reps) && (ctx.Err() == nil); loops++ {
+		select {
+		case <-stop:
+			break loop
+		default:
+		}
+		totalCount += c.collect(ctx, stop, sock)
+		if c.Logger != nil && loops%statsEvery == 0 {
+			c.Logger.LogCacheStats(localCount, errCount)
 		}
 
 		now := time.Now()
-		interval := now.Sub(lastCollectionTime)
+		elapsed := now.Sub(lastCollectionTime)
 		lastCollectionTime = now
-		metrics.PollingHistogram.Observe(interval.Seconds())
+		metrics.PollingHistogram.Observe(elapsed.Seconds())
 
 		// Wait for next tick.
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		case <-stop:
+		}
 	}
 
 	if loops > 0 {
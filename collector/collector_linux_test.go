@@ -6,12 +6,15 @@ import (
 	"log"
 	"net"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/netlink"
+	"golang.org/x/sys/unix"
 )
 
 func init() {
@@ -76,7 +79,8 @@ func TestRun(t *testing.T) {
 
 	go func() {
 		defer wg.Done()
-		collector.Run(ctx, 0, msgChan, &testCacheLogger{}, false)
+		c := &collector.Collector{Output: msgChan, Logger: &testCacheLogger{}}
+		c.Run(ctx)
 		t.Log("Run done.")
 	}()
 
@@ -154,3 +158,174 @@ func TestRun(t *testing.T) {
 	t.Log("Waiting for goroutines to exit")
 	wg.Wait()
 }
+
+func TestFilter(t *testing.T) {
+	port := findPort()
+	listener, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	rtx.Must(err, "Could not listen")
+	defer listener.Close()
+
+	msgs, err := collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not dump sockets")
+	f := &collector.FilterConfig{LocalPorts: []collector.PortRange{{uint16(port), uint16(port)}}}
+	kept := collector.FilterMessages(f, msgs)
+	if len(kept) != 1 {
+		t.Fatalf("Expected only the listener, got %d sockets", len(kept))
+	}
+	raw, _ := inetdiag.SplitInetDiagMsg(kept[0].Data)
+	idm, err := raw.Parse()
+	rtx.Must(err, "Could not parse")
+	if idm.ID.SPort() != uint16(port) {
+		t.Errorf("Kept socket on port %d, want %d", idm.ID.SPort(), port)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	port := findPort()
+	listener, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	rtx.Must(err, "Could not listen")
+	defer listener.Close()
+
+	out := make(chan netlink.MessageBlock, 100)
+	c := &collector.Collector{
+		Output:   out,
+		Interval: time.Millisecond,
+		Families: []uint8{syscall.AF_INET},
+		Filter:   &collector.FilterConfig{LocalPorts: []collector.PortRange{{uint16(port), uint16(port)}}},
+	}
+	done := make(chan int)
+	go func() {
+		local, _ := c.Run(context.Background())
+		done <- local
+	}()
+
+	// Only the AF_INET sockets are polled, and only the listener is kept.
+	for i := 0; i < 3; i++ {
+		mb := <-out
+		if len(mb.V4Messages) != 1 || len(mb.V6Messages) != 0 || !mb.V6Time.IsZero() {
+			t.Errorf("Expected only the listener, got %d IPv4 and %d IPv6 sockets", len(mb.V4Messages), len(mb.V6Messages))
+		}
+	}
+
+	// Run returns after Stop, which may be called again.
+	c.Stop()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	c.Stop()
+
+	// A stopped Collector does not poll.
+	n := len(out)
+	c.Run(context.Background())
+	if len(out) != n {
+		t.Error("A stopped Collector polled")
+	}
+}
+
+func TestCollectorPipeline(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer listener.Close()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer conn.Close()
+
+	// The pipelined dumps are sent in the same order, and grouped by protocol.
+	for _, pipeline := range []int{0, 1, 3} {
+		out := make(chan netlink.MessageBlock, 1)
+		c := &collector.Collector{Output: out, UDP: true, Pipeline: pipeline, Reps: 1}
+		c.Run(context.Background())
+		mb := <-out
+		if len(mb.V4Messages) == 0 || mb.V4Time.Before(mb.V4Start) || mb.V6Time.IsZero() {
+			t.Errorf("Pipeline %d: expected the TCP listener, and both families", pipeline)
+		}
+		if len(mb.Other) != 2 || mb.Other[0].Protocol != inetdiag.Protocol_IPPROTO_UDP || mb.Other[1].Protocol != inetdiag.Protocol_IPPROTO_UDPLITE {
+			t.Fatalf("Pipeline %d: expected UDP and UDP-Lite, got %+v", pipeline, mb.Other)
+		}
+		if len(mb.Other[0].Messages) == 0 || mb.Other[0].Time.Before(mb.Other[0].Start) {
+			t.Errorf("Pipeline %d: expected the UDP socket", pipeline)
+		}
+	}
+}
+
+func TestHostCounters(t *testing.T) {
+	out := make(chan netlink.MessageBlock, 2)
+	c := &collector.Collector{Output: out, Families: []uint8{syscall.AF_INET}, Reps: 1}
+	c.Run(context.Background())
+	if mb := <-out; mb.Host != nil {
+		t.Error("Expected no host counters, got", mb.Host)
+	}
+	c = &collector.Collector{Output: out, Families: []uint8{syscall.AF_INET}, HostCounters: true, Reps: 1}
+	c.Run(context.Background())
+	if mb := <-out; mb.Host == nil || mb.Host.Timestamp.IsZero() {
+		t.Error("Expected host counters, got", mb.Host)
+	}
+}
+
+func TestDumpSocket(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer listener.Close()
+
+	d := &collector.DumpSocket{}
+	defer d.Close()
+	msgs, err := d.Dump(syscall.AF_INET, syscall.IPPROTO_TCP)
+	rtx.Must(err, "Could not dump")
+	if len(msgs) == 0 {
+		t.Error("Expected at least the listener")
+	}
+	s := d.Socket()
+	if s == nil {
+		t.Fatal("Expected an open socket")
+	}
+
+	// The socket is reused for the next dump.
+	_, err = d.Dump(syscall.AF_INET, syscall.IPPROTO_TCP)
+	rtx.Must(err, "Could not dump")
+	if d.Socket() != s {
+		t.Error("Expected the socket to be reused")
+	}
+
+	// A socket that fails the health check is replaced.  Here its descriptor no
+	// longer refers to a socket.
+	null, err := syscall.Open("/dev/null", syscall.O_RDONLY, 0)
+	rtx.Must(err, "Could not open /dev/null")
+	defer syscall.Close(null)
+	rtx.Must(unix.Dup2(null, s.GetFd()), "Could not replace the socket")
+	msgs, err = d.Dump(syscall.AF_INET, syscall.IPPROTO_TCP)
+	rtx.Must(err, "Could not dump")
+	if len(msgs) == 0 || d.Socket() == s || d.Socket() == nil {
+		t.Error("Expected a new socket, and the listener")
+	}
+
+	// After Close, the next dump opens a new socket.
+	d.Close()
+	if d.Socket() != nil {
+		t.Error("Expected no socket after Close")
+	}
+	_, err = d.Dump(syscall.AF_INET, syscall.IPPROTO_TCP)
+	rtx.Must(err, "Could not dump")
+	if d.Socket() == nil {
+		t.Error("Expected a new socket")
+	}
+}
+
+func TestCollectorCancel(t *testing.T) {
+	// The Output is never read, but canceling the context stops the Collector.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &collector.Collector{Output: make(chan netlink.MessageBlock), Interval: time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
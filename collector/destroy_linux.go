@@ -0,0 +1,87 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// Errors returned by Destroy and DestroyCookie.  Other errors from the kernel are
+// returned as wrapped syscall.Errno values, e.g. EOPNOTSUPP if the kernel was built
+// without CONFIG_INET_DIAG_DESTROY.
+var (
+	ErrNotPermitted   = errors.New("destroying sockets requires CAP_NET_ADMIN")
+	ErrSocketNotFound = errors.New("socket not found")
+)
+
+// hasNetAdmin returns true if the process has the CAP_NET_ADMIN capability.
+func hasNetAdmin() (bool, error) {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	err := unix.Capget(&hdr, &data[0])
+	if err != nil {
+		return false, err
+	}
+	return data[0].Effective&(1<<unix.CAP_NET_ADMIN) != 0, nil
+}
+
+// Destroy closes a socket with a SOCK_DESTROY request, as "ss -K" does.  The id is
+// as reported in the InetDiagMsg of the socket, and its cookie must match the
+// socket's, so that a socket reusing the same addresses is not closed instead.
+// Local TCP sockets are closed with ECONNABORTED, and their peers are sent a RST.
+func Destroy(family, protocol uint8, id inetdiag.LinuxSockID) error {
+	ok, err := hasNetAdmin()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotPermitted
+	}
+	req := nl.NewNetlinkRequest(inetdiag.SOCK_DESTROY, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	msg := inetdiag.NewReqV2(family, protocol, tcp.AllFlags)
+	msg.ID = id
+	req.AddData(msg)
+	_, err = req.Execute(syscall.NETLINK_INET_DIAG, 0)
+	switch {
+	case err == nil:
+		log.Println("Destroyed socket", id.Cookie(), id.SrcIP(), id.SPort(), id.DstIP(), id.DPort())
+		return nil
+	case errors.Is(err, syscall.EPERM):
+		return ErrNotPermitted
+	case errors.Is(err, syscall.ENOENT):
+		return ErrSocketNotFound
+	}
+	return fmt.Errorf("SOCK_DESTROY: %w", err)
+}
+
+// DestroyCookie closes the TCP or UDP socket with the cookie, which is also the
+// last component of the UUIDs of its files.
+func DestroyCookie(cookie uint64) error {
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		for _, protocol := range []uint8{syscall.IPPROTO_TCP, syscall.IPPROTO_UDP} {
+			res, err := OneProtocol(family, uint16(protocol))
+			if err != nil {
+				return err
+			}
+			for _, m := range res {
+				raw, _ := inetdiag.SplitInetDiagMsg(m.Data)
+				if raw == nil {
+					continue
+				}
+				idm, err := raw.Parse()
+				if err != nil || idm.ID.Cookie() != cookie {
+					continue
+				}
+				return Destroy(idm.IDiagFamily, protocol, idm.ID)
+			}
+		}
+	}
+	return ErrSocketNotFound
+}
@@ -0,0 +1,57 @@
+package collector_test
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+func TestDestroy(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer l.Close()
+	c, err := net.Dial("tcp4", l.Addr().String())
+	rtx.Must(err, "Could not dial")
+	defer c.Close()
+	s, err := l.Accept()
+	rtx.Must(err, "Could not accept")
+	defer s.Close()
+	port := uint16(c.LocalAddr().(*net.TCPAddr).Port)
+
+	res, err := collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not dump")
+	var cookie uint64
+	for _, m := range res {
+		raw, _ := inetdiag.SplitInetDiagMsg(m.Data)
+		idm, err := raw.Parse()
+		rtx.Must(err, "Could not parse")
+		if idm.ID.SPort() == port {
+			cookie = idm.ID.Cookie()
+		}
+	}
+	if cookie == 0 {
+		t.Fatal("Connection not found")
+	}
+
+	err = collector.DestroyCookie(cookie)
+	if errors.Is(err, collector.ErrNotPermitted) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("SOCK_DESTROY is not available:", err)
+	}
+	rtx.Must(err, "Could not destroy the connection")
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if !errors.Is(err, syscall.ECONNABORTED) {
+		t.Error("Expected ECONNABORTED, got", err)
+	}
+
+	err = collector.DestroyCookie(cookie)
+	if !errors.Is(err, collector.ErrSocketNotFound) {
+		t.Error("Expected ErrSocketNotFound, got", err)
+	}
+}
@@ -1,3 +1,33 @@
 package collector
 
+import (
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
 var ProcessSingleMessage = processSingleMessage
+
+var ParseBatch = parseBatch
+
+var ReceiveBatch = receiveBatch
+
+var MakeReq = makeReq
+
+// FilterMessages filters the messages with f.
+func FilterMessages(f *FilterConfig, msgs []*syscall.NetlinkMessage) []*syscall.NetlinkMessage {
+	return filter(f, msgs)
+}
+
+// DumpSocket is the reused netlink socket of a Collector.
+type DumpSocket = dumpSocket
+
+// Dump dumps the sockets of a family and protocol with d.
+func (d *dumpSocket) Dump(af uint8, protocol uint16) ([]*syscall.NetlinkMessage, error) {
+	return d.dump(af, protocol, false)
+}
+
+// Socket returns the current socket of d, or nil.
+func (d *dumpSocket) Socket() *nl.NetlinkSocket {
+	return d.s
+}
@@ -0,0 +1,91 @@
+//go:build faults
+// +build faults
+
+package collector_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/fault"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// findListener returns the message of the socket listening on port, or nil.
+func findListener(msgs []*syscall.NetlinkMessage, port uint16) *syscall.NetlinkMessage {
+	for _, m := range msgs {
+		raw, _ := inetdiag.SplitInetDiagMsg(m.Data)
+		if raw == nil {
+			continue
+		}
+		idm, err := raw.Parse()
+		if err == nil && idm.ID.SPort() == port {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestTruncatedRead(t *testing.T) {
+	defer fault.Reset()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	msgs, err := collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not dump sockets")
+	full := findListener(msgs, port)
+	if full == nil {
+		t.Fatal("The listener was not found")
+	}
+
+	// The last attribute of each message is cut short.
+	fault.Inject(fault.NetlinkRead, fault.Fault{Truncate: 3})
+	msgs, err = collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not dump sockets")
+	short := findListener(msgs, port)
+	if short == nil {
+		t.Fatal("The listener was not found in the truncated messages")
+	}
+	if len(short.Data) != len(full.Data)-3 {
+		t.Errorf("Expected %d bytes, got %d", len(full.Data)-3, len(short.Data))
+	}
+	for _, m := range msgs {
+		// Truncated messages may fail to parse, but must not panic.
+		netlink.MakeArchivalRecord(m, true)
+	}
+
+	// Messages without any data are errors.
+	fault.Inject(fault.NetlinkRead, fault.Fault{Truncate: 1 << 16})
+	msgs, err = collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not dump sockets")
+	if len(msgs) == 0 {
+		t.Fatal("Expected the empty message of the listener")
+	}
+	for _, m := range msgs {
+		if _, err := netlink.MakeArchivalRecord(m, true); err == nil {
+			t.Error("An empty message should not parse")
+		}
+	}
+}
+
+func TestClockJump(t *testing.T) {
+	defer fault.Reset()
+	fault.Inject(fault.Clock, fault.Fault{Skew: -time.Hour})
+	msgChan := make(chan netlink.MessageBlock, 1)
+	c := &collector.Collector{Output: msgChan, Reps: 1, Logger: &testCacheLogger{}}
+	c.Run(context.Background())
+	block := <-msgChan
+	for _, ts := range []time.Time{block.V4Start, block.V4Time, block.V6Start, block.V6Time} {
+		if d := time.Since(ts); d < time.Hour || d > time.Hour+time.Minute {
+			t.Error("The timestamps of the block should be an hour behind, not", d)
+		}
+	}
+}
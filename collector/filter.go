@@ -0,0 +1,126 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// ErrBadFilter is returned when parsing a malformed port range or ID.
+var ErrBadFilter = errors.New("bad collector filter")
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First, Last uint16
+}
+
+// ParsePortRanges parses ports, e.g. "443", and inclusive ranges of ports, e.g.
+// "9000-9100".
+func ParsePortRanges(s []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, r := range s {
+		first, last, isRange := strings.Cut(r, "-")
+		if !isRange {
+			last = first
+		}
+		f, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%w: port range %q", ErrBadFilter, r)
+		}
+		l, err := strconv.ParseUint(last, 10, 16)
+		if err != nil || l < f {
+			return nil, fmt.Errorf("%w: port range %q", ErrBadFilter, r)
+		}
+		ranges = append(ranges, PortRange{First: uint16(f), Last: uint16(l)})
+	}
+	return ranges, nil
+}
+
+// ParseIDs parses decimal UIDs or inode numbers.
+func ParseIDs(s []string) ([]uint32, error) {
+	var ids []uint32
+	for _, id := range s {
+		v, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: id %q", ErrBadFilter, id)
+		}
+		ids = append(ids, uint32(v))
+	}
+	return ids, nil
+}
+
+// ParseInterfaces parses interface indexes, e.g. "2", and names, e.g. "eth0", which
+// are resolved to their indexes.
+func ParseInterfaces(s []string) ([]uint32, error) {
+	var indexes []uint32
+	for _, name := range s {
+		if v, err := strconv.ParseUint(name, 10, 32); err == nil {
+			indexes = append(indexes, uint32(v))
+			continue
+		}
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: interface %q: %v", ErrBadFilter, name, err)
+		}
+		indexes = append(indexes, uint32(iface.Index))
+	}
+	return indexes, nil
+}
+
+// FilterConfig selects sockets by their ports, owners and interfaces.  A socket is selected if,
+// for each list that is not empty, it matches an entry of the list.  An empty
+// FilterConfig selects all sockets.
+type FilterConfig struct {
+	// LocalPorts are the ranges of the socket's own port.
+	LocalPorts []PortRange
+	// RemotePorts are the ranges of the peer's port.
+	RemotePorts []PortRange
+	// UIDs are the owners of the socket.
+	UIDs []uint32
+	// Inodes are the socket inode numbers.
+	Inodes []uint32
+	// Interfaces are the indexes of the interfaces the socket is bound to.  The
+	// kernel only reports the interface of sockets bound to one, e.g. with
+	// SO_BINDTODEVICE, or with a link-local IPv6 address, so other sockets have
+	// interface 0.
+	Interfaces []uint32
+}
+
+func inRanges(ranges []PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if r.First <= port && port <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(ids []uint32, id uint32) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the socket described by idm is selected by the filter.
+func (f *FilterConfig) Match(idm *inetdiag.InetDiagMsg) bool {
+	if len(f.LocalPorts) > 0 && !inRanges(f.LocalPorts, idm.ID.SPort()) {
+		return false
+	}
+	if len(f.RemotePorts) > 0 && !inRanges(f.RemotePorts, idm.ID.DPort()) {
+		return false
+	}
+	if len(f.UIDs) > 0 && !contains(f.UIDs, idm.IDiagUID) {
+		return false
+	}
+	if len(f.Inodes) > 0 && !contains(f.Inodes, idm.IDiagInode) {
+		return false
+	}
+	return len(f.Interfaces) == 0 || contains(f.Interfaces, idm.ID.IfIndex())
+}
@@ -0,0 +1,77 @@
+package collector_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	got, err := collector.ParsePortRanges([]string{"443", "9000-9100", "0-65535"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []collector.PortRange{{443, 443}, {9000, 9100}, {0, 65535}}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+	for _, bad := range []string{"", "http", "-1", "9100-9000", "1-2-3", "65536", "1-"} {
+		if _, err := collector.ParsePortRanges([]string{bad}); !errors.Is(err, collector.ErrBadFilter) {
+			t.Errorf("ParsePortRanges(%q) returned %v", bad, err)
+		}
+	}
+	if _, err := collector.ParseIDs([]string{"1000", "x"}); !errors.Is(err, collector.ErrBadFilter) {
+		t.Errorf("ParseIDs returned %v", err)
+	}
+}
+
+func TestParseInterfaces(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No loopback interface:", err)
+	}
+	got, err := collector.ParseInterfaces([]string{"lo", "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, []uint32{uint32(lo.Index), 7}); diff != nil {
+		t.Error(diff)
+	}
+	if _, err := collector.ParseInterfaces([]string{"no-such-interface"}); !errors.Is(err, collector.ErrBadFilter) {
+		t.Errorf("ParseInterfaces returned %v", err)
+	}
+}
+
+func TestFilterConfigMatch(t *testing.T) {
+	idm := &inetdiag.InetDiagMsg{IDiagUID: 1000, IDiagInode: 1234}
+	binary.BigEndian.PutUint16(idm.ID.IDiagSPort[:], 443)
+	binary.BigEndian.PutUint16(idm.ID.IDiagDPort[:], 50000)
+	binary.LittleEndian.PutUint32(idm.ID.IDiagIf[:], 3)
+	tests := []struct {
+		name   string
+		filter collector.FilterConfig
+		want   bool
+	}{
+		{"empty", collector.FilterConfig{}, true},
+		{"local port", collector.FilterConfig{LocalPorts: []collector.PortRange{{80, 80}, {443, 443}}}, true},
+		{"other local port", collector.FilterConfig{LocalPorts: []collector.PortRange{{80, 80}}}, false},
+		{"remote range", collector.FilterConfig{RemotePorts: []collector.PortRange{{32768, 60999}}}, true},
+		{"other remote range", collector.FilterConfig{RemotePorts: []collector.PortRange{{9000, 9100}}}, false},
+		{"uid", collector.FilterConfig{UIDs: []uint32{0, 1000}}, true},
+		{"other uid", collector.FilterConfig{UIDs: []uint32{0}}, false},
+		{"inode", collector.FilterConfig{Inodes: []uint32{1234}}, true},
+		{"interface", collector.FilterConfig{Interfaces: []uint32{2, 3}}, true},
+		{"other interface", collector.FilterConfig{Interfaces: []uint32{2}}, false},
+		{"port and other uid", collector.FilterConfig{LocalPorts: []collector.PortRange{{443, 443}}, UIDs: []uint32{0}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(idm); got != tt.want {
+			t.Errorf("%s: Match() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// socketExtensions are requested even if the probe socket does not return them,
+// because they depend on the socket.  VEGASINFO is only returned for congestion
+// control algorithms that report it, e.g. vegas, dctcp or bbr, and TCLASS only
+// for IPv6 sockets.
+const socketExtensions = 1<<(inetdiag.INET_DIAG_VEGASINFO-1) | 1<<(inetdiag.INET_DIAG_TCLASS-1)
+
+// ErrProbeNotFound is returned by Probe if the probe socket is missing from the dump.
+var ErrProbeNotFound = errors.New("probe socket not found")
+
+// Probe discovers the inet_diag attributes the running kernel returns for a TCP
+// socket, and the length of its tcp_info, from a loopback connection.  It exports
+// them as metrics, and subsequent requests only ask for the extensions the kernel
+// returned.  It must be called before Run.
+func Probe() (*netlink.Capabilities, error) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	port := uint16(c.LocalAddr().(*net.TCPAddr).Port)
+
+	res, err := OneType(syscall.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range res {
+		ar, err := netlink.MakeArchivalRecord(msg, false)
+		if err != nil || ar == nil {
+			continue
+		}
+		idm, err := ar.RawIDM.Parse()
+		if err != nil || idm.ID.SPort() != port {
+			continue
+		}
+		return probed(ar), nil
+	}
+	return nil, ErrProbeNotFound
+}
+
+// probed returns the Capabilities shown by the record of the probe socket, and
+// sets the metrics and extensions accordingly.
+func probed(ar *netlink.ArchivalRecord) *netlink.Capabilities {
+	caps := &netlink.Capabilities{}
+	mask := uint8(socketExtensions)
+	for t, a := range ar.Attributes {
+		if a == nil {
+			continue
+		}
+		name, ok := inetdiag.InetDiagType[int32(t)]
+		if !ok {
+			name = fmt.Sprint(t)
+		}
+		caps.Attributes = append(caps.Attributes, name)
+		metrics.KernelAttributes.WithLabelValues(name).Set(1)
+		if t > 0 && t <= 8 {
+			mask |= 1 << (t - 1)
+		}
+	}
+	if ar.HasDiagInfo() {
+		caps.TCPInfoLength = len(ar.Attributes[inetdiag.INET_DIAG_INFO])
+	}
+	metrics.KernelTCPInfoBytes.Set(float64(caps.TCPInfoLength))
+	extensions = mask & allExtensions
+	return caps
+}
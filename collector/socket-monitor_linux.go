@@ -3,7 +3,10 @@ package collector
 // This package is only meaningful in Linux.
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"syscall"
 	"time"
 
@@ -11,27 +14,42 @@ import (
 	"github.com/vishvananda/netlink/nl"
 	"golang.org/x/sys/unix"
 
+	"github.com/m-lab/tcp-info/fault"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/tcp"
 )
 
+// allExtensions are the inet_diag extensions requested by default.
+const allExtensions = 1<<(inetdiag.INET_DIAG_MEMINFO-1) |
+	1<<(inetdiag.INET_DIAG_INFO-1) |
+	1<<(inetdiag.INET_DIAG_VEGASINFO-1) |
+	1<<(inetdiag.INET_DIAG_CONG-1) |
+	1<<(inetdiag.INET_DIAG_TCLASS-1) |
+	1<<(inetdiag.INET_DIAG_TOS-1) |
+	1<<(inetdiag.INET_DIAG_SKMEMINFO-1) |
+	1<<(inetdiag.INET_DIAG_SHUTDOWN-1)
+
+// extensions are the inet_diag extensions requested for each socket.  Probe
+// removes those the kernel does not support.
+var extensions uint8 = allExtensions
+
 // TODO - Figure out why we aren't seeing INET_DIAG_DCTCPINFO or INET_DIAG_BBRINFO messages.
-func makeReq(inetType uint8) *nl.NetlinkRequest {
+func makeReq(inetType uint8, protocol uint16) *nl.NetlinkRequest {
 	req := nl.NewNetlinkRequest(inetdiag.SOCK_DIAG_BY_FAMILY, syscall.NLM_F_DUMP|syscall.NLM_F_REQUEST)
-	msg := inetdiag.NewReqV2(inetType, syscall.IPPROTO_TCP,
-		tcp.AllFlags & ^((1<<uint(tcp.SYN_RECV))|(1<<uint(tcp.TIME_WAIT))|(1<<uint(tcp.CLOSE))))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_MEMINFO - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_INFO - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_VEGASINFO - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_CONG - 1))
-
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_TCLASS - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_TOS - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_SKMEMINFO - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_SHUTDOWN - 1))
+	states := uint32(tcp.AllFlags & ^((1 << uint(tcp.SYN_RECV)) | (1 << uint(tcp.TIME_WAIT)) | (1 << uint(tcp.CLOSE))))
+	if protocol != syscall.IPPROTO_TCP && protocol != unix.IPPROTO_MPTCP {
+		// UDP sockets are ESTABLISHED if they are connected, and otherwise CLOSE.
+		states = tcp.AllFlags
+	}
+	msg := inetdiag.NewReqV2(inetType, uint8(protocol), states)
+	msg.IDiagExt = extensions
 
 	req.AddData(msg)
+	if protocol > 0xff {
+		// The protocol, e.g. IPPROTO_MPTCP, does not fit in the request.
+		req.AddData(nl.NewRtAttr(inetdiag.INET_DIAG_REQ_PROTOCOL, nl.Uint32Attr(uint32(protocol))))
+	}
 	req.NlMsghdr.Type = inetdiag.SOCK_DIAG_BY_FAMILY
 	req.NlMsghdr.Flags |= syscall.NLM_F_DUMP | syscall.NLM_F_REQUEST
 	return req
@@ -48,20 +66,30 @@ func processSingleMessage(m *syscall.NetlinkMessage, seq uint32, pid uint32) (*s
 		metrics.ErrorCount.With(prometheus.Labels{"type": "wrong pid"}).Inc()
 		return nil, false, inetdiag.ErrBadPid
 	}
-	if m.Header.Type == unix.NLMSG_DONE {
-		return nil, false, nil
-	}
-	if m.Header.Type == unix.NLMSG_ERROR {
-		native := nl.NativeEndian()
+	if m.Header.Type == unix.NLMSG_DONE || m.Header.Type == unix.NLMSG_ERROR {
+		// Both hold an error code, which is zero for the end of a successful dump, or
+		// the ACK of a request.  NLMSG_DONE has no payload on older kernels.
 		if len(m.Data) < 4 {
+			if m.Header.Type == unix.NLMSG_DONE {
+				return nil, false, nil
+			}
 			return nil, false, inetdiag.ErrBadMsgData
 		}
-		error := int32(native.Uint32(m.Data[0:4]))
-		if error == 0 {
+		code := int32(nl.NativeEndian().Uint32(m.Data[0:4]))
+		if code == 0 {
 			return nil, false, nil
 		}
-		log.Println(syscall.Errno(-error))
-		metrics.ErrorCount.With(prometheus.Labels{"type": "NLMSG_ERROR"}).Inc()
+		if code < 0 {
+			code = -code
+		}
+		err := &inetdiag.NetlinkError{Type: m.Header.Type, Errno: syscall.Errno(code)}
+		log.Println(err)
+		label := "NLMSG_ERROR"
+		if m.Header.Type == unix.NLMSG_DONE {
+			label = "NLMSG_DONE"
+		}
+		metrics.ErrorCount.With(prometheus.Labels{"type": label}).Inc()
+		return nil, false, err
 	}
 	if m.Header.Flags&unix.NLM_F_MULTI == 0 {
 		return m, false, nil
@@ -72,8 +100,107 @@ func processSingleMessage(m *syscall.NetlinkMessage, seq uint32, pid uint32) (*s
 // OneType handles the request and response for a single type, e.g. INET or INET6
 // TODO maybe move this to top level?
 func OneType(inetType uint8) ([]*syscall.NetlinkMessage, error) {
-	var res []*syscall.NetlinkMessage
+	return OneProtocol(inetType, syscall.IPPROTO_TCP)
+}
+
+// OneProtocol handles the request and response for a single type and protocol,
+// e.g. INET and IPPROTO_UDP.  Messages of types other than SOCK_DIAG_BY_FAMILY are
+// dropped.
+func OneProtocol(inetType uint8, protocol uint16) ([]*syscall.NetlinkMessage, error) {
+	return oneProtocol(inetType, protocol, false)
+}
+
+// oneProtocol is OneProtocol, but also returns the messages of unknown types if
+// keepUnknown is true.  Errors reported by the kernel are returned as a
+// *inetdiag.NetlinkError.
+func oneProtocol(inetType uint8, protocol uint16, keepUnknown bool) ([]*syscall.NetlinkMessage, error) {
+	d := &dumpSocket{}
+	defer d.Close()
+	return d.dump(inetType, protocol, keepUnknown)
+}
+
+// dumpSocket is a netlink socket that is created once, and reused for all the
+// dumps of a Collector, rather than set up for each dump.  It is re-created after
+// a dump fails, or when the health check before a dump finds a pending socket
+// error.  It must not be used concurrently.
+type dumpSocket struct {
+	s        *nl.NetlinkSocket
+	pid      uint32
+	failures int // The number of consecutive dumps that failed.
+
+	// The number of messages of the last dump of each request, which sizes the
+	// result of the next one.
+	sizes map[dumpRequest]int
+}
+
+// open returns the socket and its pid, creating the socket if there is none, or if
+// the current one is unhealthy.
+func (d *dumpSocket) open() (*nl.NetlinkSocket, uint32, error) {
+	if d.s != nil && !d.healthy() {
+		metrics.NetlinkSocketCount.WithLabelValues("unhealthy").Inc()
+		d.Close()
+	}
+	if d.s != nil {
+		return d.s, d.pid, nil
+	}
+	// Copied this from req.Execute in nl_linux.go
+	s, err := nl.Subscribe(syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return nil, 0, err
+	}
+	pid, err := s.GetPid()
+	if err != nil {
+		s.Close()
+		return nil, 0, err
+	}
+	metrics.NetlinkSocketCount.WithLabelValues("created").Inc()
+	d.s, d.pid = s, pid
+	return s, pid, nil
+}
+
+// healthy returns true if the socket has no pending error, e.g. ENOBUFS after the
+// kernel dropped messages that did not fit in the receive buffer.
+func (d *dumpSocket) healthy() bool {
+	code, err := unix.GetsockoptInt(d.s.GetFd(), unix.SOL_SOCKET, unix.SO_ERROR)
+	return err == nil && code == 0
+}
+
+// Close closes the socket, if it is open.  The dumpSocket may still be used, and
+// creates a new socket for the next dump.
+func (d *dumpSocket) Close() {
+	if d.s != nil {
+		d.s.Close()
+		d.s = nil
+	}
+}
+
+// dump handles the request and response for a single type and protocol, like
+// oneProtocol, on the reused socket.  After a socket error, the socket is closed,
+// so that the rest of the failed dump is not read by the next one.  Errors reported
+// by the kernel end the dump, and are not socket errors.
+func (d *dumpSocket) dump(inetType uint8, protocol uint16, keepUnknown bool) ([]*syscall.NetlinkMessage, error) {
+	res, err := d.receive(inetType, protocol, keepUnknown)
+	var nlErr *inetdiag.NetlinkError
+	if errors.As(err, &nlErr) {
+		return res, err
+	}
+	if err != nil {
+		metrics.NetlinkSocketCount.WithLabelValues("error").Inc()
+		d.failures++
+		d.Close()
+	} else {
+		d.failures = 0
+	}
+	return res, err
+}
+
+// receive sends the request for a dump, and receives the messages of the response.
+func (d *dumpSocket) receive(inetType uint8, protocol uint16, keepUnknown bool) ([]*syscall.NetlinkMessage, error) {
+	key := dumpRequest{af: inetType, protocol: protocol}
+	res := make([]*syscall.NetlinkMessage, 0, d.sizes[key])
 
+	// The times at which the first and last batches of messages were received.
+	var first, last time.Time
 	start := time.Now()
 	defer func() {
 		af := "unknown"
@@ -83,48 +210,62 @@ func OneType(inetType uint8) ([]*syscall.NetlinkMessage, error) {
 		case syscall.AF_INET6:
 			af = "ipv6"
 		}
+		switch protocol {
+		case syscall.IPPROTO_UDP:
+			af += "-udp"
+		case unix.IPPROTO_UDPLITE:
+			af += "-udplite"
+		case unix.IPPROTO_MPTCP:
+			af += "-mptcp"
+		}
+		if d.sizes == nil {
+			d.sizes = make(map[dumpRequest]int)
+		}
+		d.sizes[key] = len(res)
 		metrics.SyscallTimeHistogram.With(prometheus.Labels{"af": af}).Observe(time.Since(start).Seconds())
 		metrics.ConnectionCountHistogram.With(prometheus.Labels{"af": af}).Observe(float64(len(res)))
+		if len(res) > 0 {
+			metrics.DumpSkewHistogram.With(prometheus.Labels{"af": af}).Observe(last.Sub(first).Seconds())
+		}
 	}()
 
-	req := makeReq(inetType)
+	req := makeReq(inetType, protocol)
 
-	// Copied this from req.Execute in nl_linux.go
-	sockType := syscall.NETLINK_INET_DIAG
-	s, err := nl.Subscribe(sockType)
+	s, pid, err := d.open()
 	if err != nil {
 		// TODO - all these logs should be metrics instead.
 		log.Println(err)
 		return nil, err
 	}
-	defer s.Close()
 
 	if err := s.Send(req); err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
-	pid, err := s.GetPid()
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-
 	// Adapted this from req.Execute in nl_linux.go
 	for {
-		msgs, _, err := s.Receive()
+		msgs, err := receiveBatch(s)
 		if err != nil {
 			log.Println(err)
 			return nil, err
 		}
-		// TODO avoid the copy.
+		last = time.Now()
+		if first.IsZero() {
+			first = last
+		}
 		for i := range msgs {
+			msgs[i].Data = fault.Truncate(fault.NetlinkRead, msgs[i].Data)
 			m, shouldContinue, err := processSingleMessage(&msgs[i], req.Seq, pid)
 			if err != nil {
 				return res, err
 			}
 			if m != nil {
-				res = append(res, m)
+				if m.Header.Type == inetdiag.SOCK_DIAG_BY_FAMILY || keepUnknown {
+					res = append(res, m)
+				} else {
+					metrics.ErrorCount.With(prometheus.Labels{"type": "unknown message type"}).Inc()
+				}
 			}
 			if !shouldContinue {
 				return res, nil
@@ -135,3 +276,73 @@ func OneType(inetType uint8) ([]*syscall.NetlinkMessage, error) {
 		}
 	}
 }
+
+// receiveBufferSize is the size of the pooled receive buffers, which is enough
+// for the largest batch of messages the kernel sends.
+const receiveBufferSize = nl.RECEIVE_BUFFER_SIZE
+
+// receiveBuffers holds the buffers that batches of messages are received in.  A
+// buffer is only used until its batch is parsed, as the messages are copied out of
+// it, so it is returned to the pool straight away.
+var receiveBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, receiveBufferSize)
+	return &b
+}}
+
+// receiveBatch receives a batch of messages on s, like s.Receive, but in a pooled
+// buffer instead of a new one for each batch.
+func receiveBatch(s *nl.NetlinkSocket) ([]syscall.NetlinkMessage, error) {
+	buf := receiveBuffers.Get().(*[]byte)
+	defer receiveBuffers.Put(buf)
+	n, from, err := unix.Recvfrom(s.GetFd(), *buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := from.(*unix.SockaddrNetlink); !ok {
+		return nil, fmt.Errorf("Error converting to netlink sockaddr: %T", from)
+	}
+	if n < unix.NLMSG_HDRLEN {
+		return nil, fmt.Errorf("Got short response from netlink")
+	}
+	return parseBatch((*buf)[:n])
+}
+
+// parseBatch parses a batch of messages, like syscall.ParseNetlinkMessage, but
+// copies them out of b, which may then be reused.  The data of all the messages is
+// held in a single allocation, and the messages in another, so that a batch of
+// hundreds of messages costs two allocations rather than one for each message.
+// The messages own their data, which lives as long as the records made from it.
+func parseBatch(b []byte) ([]syscall.NetlinkMessage, error) {
+	count := 0
+	for rest := b; len(rest) >= unix.NLMSG_HDRLEN; count++ {
+		l := int(nl.NativeEndian().Uint32(rest[0:4]))
+		if l < unix.NLMSG_HDRLEN || l > len(rest) {
+			return nil, syscall.EINVAL
+		}
+		rest = skipMessage(rest, l)
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	msgs := make([]syscall.NetlinkMessage, count)
+	for i := range msgs {
+		h := &msgs[i].Header
+		h.Len = nl.NativeEndian().Uint32(data[0:4])
+		h.Type = nl.NativeEndian().Uint16(data[4:6])
+		h.Flags = nl.NativeEndian().Uint16(data[6:8])
+		h.Seq = nl.NativeEndian().Uint32(data[8:12])
+		h.Pid = nl.NativeEndian().Uint32(data[12:16])
+		l := int(h.Len)
+		msgs[i].Data = data[unix.NLMSG_HDRLEN:l:l]
+		data = skipMessage(data, l)
+	}
+	return msgs, nil
+}
+
+// skipMessage returns the rest of b after a message of length l, and its padding.
+func skipMessage(b []byte, l int) []byte {
+	l = (l + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+	if l > len(b) {
+		return nil
+	}
+	return b[l:]
+}
@@ -1,16 +1,24 @@
 package collector_test
 
 import (
+	"errors"
 	"io/ioutil"
 	"net"
 	"os"
+	"reflect"
 	"sync"
 	"syscall"
 	"testing"
+	"unsafe"
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/collector"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/vishvananda/netlink/nl"
 	"golang.org/x/sys/unix"
 )
 
@@ -64,6 +72,111 @@ func TestOneType(t *testing.T) {
 	}
 }
 
+func TestOneProtocol(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not open UDP socket")
+	defer conn.Close()
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	// Verify that OneProtocol(AF_INET, IPPROTO_UDP) finds the socket.
+	res, err := collector.OneProtocol(syscall.AF_INET, syscall.IPPROTO_UDP)
+	rtx.Must(err, "Could not dump UDP sockets")
+	found := false
+	for _, msg := range res {
+		raw, _ := inetdiag.SplitInetDiagMsg(msg.Data)
+		idm, err := raw.Parse()
+		rtx.Must(err, "Could not parse message")
+		if idm.ID.SPort() == port {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Did not find the UDP socket on port", port)
+	}
+
+	// The dump's skew was recorded.
+	var m dto.Metric
+	rtx.Must(metrics.DumpSkewHistogram.WithLabelValues("ipv4-udp").(prometheus.Metric).Write(&m), "Could not read histogram")
+	if m.GetHistogram().GetSampleCount() == 0 {
+		t.Error("DumpSkewHistogram has no samples")
+	}
+}
+
+// mptcpTokens returns the MPTCP tokens of the sockets of the protocol on the port.
+func mptcpTokens(protocol inetdiag.Protocol, res []*netlink.NetlinkMessage, port uint16) []uint32 {
+	var tokens []uint32
+	for _, msg := range res {
+		ar, err := netlink.MakeArchivalRecord(msg, false)
+		rtx.Must(err, "Could not parse message")
+		ar.Protocol = protocol
+		idm, err := ar.RawIDM.Parse()
+		rtx.Must(err, "Could not parse message")
+		if idm.ID.SPort() != port && idm.ID.DPort() != port {
+			continue
+		}
+		if token, ok := ar.MPTCPToken(); ok {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+func TestMPTCP(t *testing.T) {
+	l, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, unix.IPPROTO_MPTCP)
+	if err != nil {
+		t.Skip("MPTCP is not available:", err)
+	}
+	defer syscall.Close(l)
+	rtx.Must(syscall.Bind(l, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}), "Could not bind")
+	rtx.Must(syscall.Listen(l, 1), "Could not listen")
+	sa, err := syscall.Getsockname(l)
+	rtx.Must(err, "Could not get the address")
+	c, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, unix.IPPROTO_MPTCP)
+	rtx.Must(err, "Could not open socket")
+	defer syscall.Close(c)
+	rtx.Must(syscall.Connect(c, sa), "Could not connect")
+	a, _, err := syscall.Accept(l)
+	rtx.Must(err, "Could not accept")
+	defer syscall.Close(a)
+	port := uint16(sa.(*syscall.SockaddrInet4).Port)
+
+	// Both ends of the connection are MPTCP sockets, each with a TCP subflow.
+	res, err := collector.OneProtocol(syscall.AF_INET, unix.IPPROTO_MPTCP)
+	rtx.Must(err, "Could not dump MPTCP sockets")
+	msks := mptcpTokens(inetdiag.Protocol_IPPROTO_MPTCP, res, port)
+	res, err = collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not dump TCP sockets")
+	subflows := mptcpTokens(inetdiag.Protocol_IPPROTO_TCP, res, port)
+	if len(msks) != 2 || len(subflows) != 2 {
+		t.Fatalf("Found MPTCP tokens %x and subflow tokens %x, want two of each", msks, subflows)
+	}
+	for _, token := range subflows {
+		if token != msks[0] && token != msks[1] {
+			t.Errorf("Subflow token %x is not that of an MPTCP socket %x", token, msks)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	caps, err := collector.Probe()
+	rtx.Must(err, "Could not probe the kernel")
+	found := false
+	for _, a := range caps.Attributes {
+		if a == "TCPInfo" {
+			found = true
+		}
+	}
+	// Every supported kernel has the fields up to tcpi_total_retrans.
+	if !found || caps.TCPInfoLength < 104 {
+		t.Errorf("Probe() = %+v, want TCPInfo of at least 104 bytes", caps)
+	}
+	var m dto.Metric
+	rtx.Must(metrics.KernelTCPInfoBytes.Write(&m), "Could not read gauge")
+	if m.GetGauge().GetValue() != float64(caps.TCPInfoLength) {
+		t.Errorf("KernelTCPInfoBytes = %v, want %d", m.GetGauge().GetValue(), caps.TCPInfoLength)
+	}
+}
+
 func TestProcessSingleMessageErrorPaths(t *testing.T) {
 	var m syscall.NetlinkMessage
 	m.Header.Seq = 1
@@ -87,16 +200,165 @@ func TestProcessSingleMessageErrorPaths(t *testing.T) {
 	if ok {
 		t.Error("Should not be ok is")
 	}
-	m.Data = []byte{0, 0, 0, 1}
+	// The kernel's error code is returned, and ends the dump.
+	m.Data = []byte{0xfe, 0xff, 0xff, 0xff} // -ENOENT
+	m.Header.Flags |= unix.NLM_F_MULTI
 	_, ok, err = collector.ProcessSingleMessage(&m, 1, 2)
-	rtx.Must(err, "An error message should be fine")
+	var nlErr *inetdiag.NetlinkError
+	if !errors.As(err, &nlErr) || nlErr.Type != unix.NLMSG_ERROR || !errors.Is(err, syscall.ENOENT) {
+		t.Error("Should have had ENOENT not", err)
+	}
 	if ok {
 		t.Error("Should not be ok but is")
 	}
-	m.Header.Flags |= unix.NLM_F_MULTI
+
+	// NLMSG_DONE ends the dump, and holds the error code of a dump that failed.
+	m.Header.Type = unix.NLMSG_DONE
+	m.Data = nil
+	msg, ok, err := collector.ProcessSingleMessage(&m, 1, 2)
+	if msg != nil || ok || err != nil {
+		t.Error("Should have ended the dump, not", msg, ok, err)
+	}
+	m.Data = []byte{0xf4, 0xff, 0xff, 0xff} // -ENOMEM
 	_, ok, err = collector.ProcessSingleMessage(&m, 1, 2)
-	rtx.Must(err, "An error message should be fine")
-	if !ok {
+	if !errors.As(err, &nlErr) || nlErr.Type != unix.NLMSG_DONE || !errors.Is(err, syscall.ENOMEM) {
+		t.Error("Should have had ENOMEM not", err)
+	}
+	if ok {
+		t.Error("Should not be ok but is")
+	}
+
+	// Other messages continue the dump, if there are more.
+	m.Header.Type = inetdiag.SOCK_DIAG_BY_FAMILY
+	msg, ok, err = collector.ProcessSingleMessage(&m, 1, 2)
+	rtx.Must(err, "A message should be fine")
+	if msg != &m || !ok {
 		t.Error("Should be ok but isn't")
 	}
+	m.Header.Flags &^= unix.NLM_F_MULTI
+	msg, ok, err = collector.ProcessSingleMessage(&m, 1, 2)
+	rtx.Must(err, "A message should be fine")
+	if msg != &m || ok {
+		t.Error("Should not be ok but is")
+	}
+}
+
+// makeBatch returns a batch of count messages of size bytes, as received from the
+// kernel.
+func makeBatch(count, size int) []byte {
+	b := make([]byte, 0, count*size)
+	for i := 0; i < count; i++ {
+		m := make([]byte, size)
+		hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&m[0]))
+		hdr.Len = uint32(size)
+		hdr.Type = inetdiag.SOCK_DIAG_BY_FAMILY
+		hdr.Flags = unix.NLM_F_MULTI
+		hdr.Seq = uint32(i)
+		m[unix.NLMSG_HDRLEN] = byte(i)
+		b = append(b, m...)
+	}
+	return b
+}
+
+func TestParseBatch(t *testing.T) {
+	b := makeBatch(10, benchMessageSize)
+	want, err := syscall.ParseNetlinkMessage(makeBatch(10, benchMessageSize))
+	rtx.Must(err, "Could not parse batch")
+	got, err := collector.ParseBatch(b)
+	rtx.Must(err, "Could not parse batch")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseBatch() = %v, want %v", got, want)
+	}
+	// The messages must not share the batch, which is reused.
+	for i := range b {
+		b[i] = 0xff
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("ParseBatch() messages share the batch")
+	}
+
+	// A message that is longer than the batch is an error, as for ParseNetlinkMessage.
+	b = makeBatch(2, benchMessageSize)
+	b = b[:len(b)-1]
+	if _, err := collector.ParseBatch(b); err != syscall.EINVAL {
+		t.Error("Should have had EINVAL not", err)
+	}
+}
+
+// The size of a typical TCP message, with the extensions that are requested.
+const benchMessageSize = 404
+
+// openConnections opens n loopback connections, and returns a function that closes
+// them.
+func openConnections(b *testing.B, n int) func() {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	accepted := make(chan net.Conn, n)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	conns := make([]net.Conn, 0, 2*n)
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp4", ln.Addr().String())
+		rtx.Must(err, "Could not dial")
+		conns = append(conns, conn, <-accepted)
+	}
+	return func() {
+		ln.Close()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// benchmarkDump dumps the IPv4 TCP sockets, including those of 4000 loopback
+// connections, receiving the batches of each dump with receive.  Each op is a
+// dump, so the B/op and allocs/op are the garbage of a dump.
+func benchmarkDump(b *testing.B, receive func(s *nl.NetlinkSocket) ([]syscall.NetlinkMessage, error)) {
+	const connections = 4000
+	defer openConnections(b, connections)()
+	s, err := nl.Subscribe(syscall.NETLINK_INET_DIAG)
+	rtx.Must(err, "Could not open netlink socket")
+	defer s.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rtx.Must(s.Send(collector.MakeReq(syscall.AF_INET, syscall.IPPROTO_TCP)), "Could not send request")
+		count := 0
+	dump:
+		for {
+			msgs, err := receive(s)
+			rtx.Must(err, "Could not receive")
+			for j := range msgs {
+				if msgs[j].Header.Type == unix.NLMSG_DONE {
+					break dump
+				}
+				count++
+			}
+		}
+		if count < 2*connections {
+			b.Fatal("Missing messages", count)
+		}
+	}
+}
+
+// BenchmarkDumpReceive receives each batch as nl.NetlinkSocket.Receive does, in a
+// new buffer.
+func BenchmarkDumpReceive(b *testing.B) {
+	benchmarkDump(b, func(s *nl.NetlinkSocket) ([]syscall.NetlinkMessage, error) {
+		msgs, _, err := s.Receive()
+		return msgs, err
+	})
+}
+
+// BenchmarkDumpReceiveBatch receives each batch as the collector does, in a pooled
+// buffer.
+func BenchmarkDumpReceiveBatch(b *testing.B) {
+	benchmarkDump(b, collector.ReceiveBatch)
 }
@@ -0,0 +1,213 @@
+// Package config loads deployment configuration for tcp-info, either from a
+// file (e.g. a mounted Kubernetes ConfigMap) or from a GCE instance metadata
+// attribute, and periodically reloads it so that a fleet can be retuned without
+// rebuilding or restarting the container.
+//
+// The configuration is a JSON object, e.g.
+//
+//	{"Sampling": 0.1, "Filters": {"LocalPorts": ["443"]}, "OutputBucket": "my-project-tcpinfo"}
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// Errors generated by config functions.
+var (
+	ErrBadSampling = errors.New("Sampling must be between 0 and 1")
+	ErrBadBucket   = errors.New("OutputBucket is not a valid bucket name")
+)
+
+// bucketName matches the names of Cloud Storage buckets.
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,220}[a-z0-9]$`)
+
+// MetadataURL is the base URL of the GCE metadata server instance attributes.
+// It is a variable to allow testing.
+var MetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/attributes/"
+
+// Config contains the settings that may be changed across a fleet at runtime.
+// Fields that are absent from the source are left nil, and the corresponding
+// settings are not changed.
+type Config struct {
+	// Sampling is the fraction of new connections that are recorded.
+	Sampling *float64 `json:",omitempty"`
+	// Filters, if present, replace the collector filters described by the -filter
+	// flags.
+	Filters *CollectorFilters `json:",omitempty"`
+	// OutputBucket, if present, replaces -gcs.bucket.  Changing it moves the new
+	// files to the new bucket.  Switching between a bucket and local files, i.e. an
+	// empty name, takes effect on restart.
+	OutputBucket *string `json:",omitempty"`
+	// Pipeline, if present, replaces the pipeline described by the flags.
+	Pipeline *Pipeline `json:",omitempty"`
+}
+
+// Validate checks whether the configuration values are in range.
+func (c *Config) Validate() error {
+	if c.Sampling != nil && (*c.Sampling < 0 || *c.Sampling > 1) {
+		return ErrBadSampling
+	}
+	if c.Filters != nil {
+		if _, err := c.Filters.Collector(); err != nil {
+			return err
+		}
+	}
+	if c.OutputBucket != nil && *c.OutputBucket != "" && !bucketName.MatchString(*c.OutputBucket) {
+		return ErrBadBucket
+	}
+	if c.Pipeline != nil {
+		return c.Pipeline.validate()
+	}
+	return nil
+}
+
+// CollectorFilters select the sockets that are collected, in the same format as
+// the -filter flags.  A socket is collected if, for each list that is not empty,
+// it matches an entry of the list.
+type CollectorFilters struct {
+	LocalPorts  []string `json:",omitempty"` // Ports, e.g. "443", or ranges, e.g. "9000-9100".
+	RemotePorts []string `json:",omitempty"`
+	UIDs        []string `json:",omitempty"`
+	Inodes      []string `json:",omitempty"`
+	Interfaces  []string `json:",omitempty"` // Names, e.g. "eth0", or indexes.
+}
+
+// Collector returns the collector filter, or nil if f selects all sockets.
+func (f *CollectorFilters) Collector() (*collector.FilterConfig, error) {
+	if len(f.LocalPorts)+len(f.RemotePorts)+len(f.UIDs)+len(f.Inodes)+len(f.Interfaces) == 0 {
+		return nil, nil
+	}
+	c := &collector.FilterConfig{}
+	var err error
+	if c.LocalPorts, err = collector.ParsePortRanges(f.LocalPorts); err != nil {
+		return nil, err
+	}
+	if c.RemotePorts, err = collector.ParsePortRanges(f.RemotePorts); err != nil {
+		return nil, err
+	}
+	if c.UIDs, err = collector.ParseIDs(f.UIDs); err != nil {
+		return nil, err
+	}
+	if c.Inodes, err = collector.ParseIDs(f.Inodes); err != nil {
+		return nil, err
+	}
+	if c.Interfaces, err = collector.ParseInterfaces(f.Interfaces); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Source provides the raw configuration bytes.
+type Source interface {
+	Fetch(ctx context.Context) ([]byte, error)
+}
+
+type fileSource string
+
+// FileSource returns a Source that reads the named file.  Kubernetes updates
+// mounted ConfigMaps in place, so the file is reread on every Fetch.
+func FileSource(filename string) Source {
+	return fileSource(filename)
+}
+
+func (f fileSource) Fetch(ctx context.Context) ([]byte, error) {
+	return ioutil.ReadFile(string(f))
+}
+
+type metadataSource string
+
+// MetadataSource returns a Source that reads the named attribute from the GCE
+// instance metadata server.
+func MetadataSource(attribute string) Source {
+	return metadataSource(attribute)
+}
+
+func (m metadataSource) Fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, MetadataURL+string(m), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata attribute %q: %s", string(m), resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Load fetches and parses a Config from the source.
+func Load(ctx context.Context, src Source) (*Config, error) {
+	b, err := src.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// Loader periodically loads the configuration from a Source, and calls Apply
+// whenever it changes.
+type Loader struct {
+	Source   Source
+	Interval time.Duration
+	Apply    func(*Config)
+
+	current *Config
+}
+
+// Reload loads the configuration once, and applies it if it has changed since
+// the last successful load.
+func (l *Loader) Reload(ctx context.Context) error {
+	c, err := Load(ctx, l.Source)
+	if err != nil {
+		metrics.ErrorCount.WithLabelValues("config load").Inc()
+		return err
+	}
+	if reflect.DeepEqual(c, l.current) {
+		return nil
+	}
+	b, _ := json.Marshal(c)
+	log.Println("Applying configuration:", string(b))
+	l.current = c
+	l.Apply(c)
+	return nil
+}
+
+// Run reloads the configuration every Interval until the context is canceled.
+// It does not perform an initial load, so callers should call Reload first
+// if they need the configuration at startup.
+func (l *Loader) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := l.Reload(ctx)
+			if err != nil {
+				log.Println("Could not reload configuration:", err)
+			}
+		}
+	}
+}
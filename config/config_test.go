@@ -0,0 +1,169 @@
+package config_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/config"
+)
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFileSource")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	rtx.Must(ioutil.WriteFile(filename, []byte(`{"Sampling": 0.25}`), 0644), "Could not write config")
+
+	applied := 0
+	var sampling float64
+	l := config.Loader{
+		Source: config.FileSource(filename),
+		Apply: func(c *config.Config) {
+			applied++
+			sampling = *c.Sampling
+		},
+	}
+	rtx.Must(l.Reload(context.Background()), "Could not load config")
+	rtx.Must(l.Reload(context.Background()), "Could not load config")
+	if applied != 1 || sampling != 0.25 {
+		t.Error("Config should be applied once", applied, sampling)
+	}
+
+	rtx.Must(ioutil.WriteFile(filename, []byte(`{"Sampling": 0.5}`), 0644), "Could not write config")
+	rtx.Must(l.Reload(context.Background()), "Could not load config")
+	if applied != 2 || sampling != 0.5 {
+		t.Error("Changed config should be applied", applied, sampling)
+	}
+
+	// Invalid configurations are not applied.
+	rtx.Must(ioutil.WriteFile(filename, []byte(`{"Sampling": 2}`), 0644), "Could not write config")
+	if l.Reload(context.Background()) != config.ErrBadSampling || applied != 2 {
+		t.Error("Invalid config should not be applied")
+	}
+}
+
+func TestMetadataSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/attributes/tcpinfo-config" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Sampling": 0.1}`))
+	}))
+	defer srv.Close()
+	config.MetadataURL = srv.URL + "/attributes/"
+
+	c, err := config.Load(context.Background(), config.MetadataSource("tcpinfo-config"))
+	rtx.Must(err, "Could not load config")
+	if c.Sampling == nil || *c.Sampling != 0.1 {
+		t.Error("Wrong config", c)
+	}
+	_, err = config.Load(context.Background(), config.MetadataSource("missing"))
+	if err == nil {
+		t.Error("Missing attribute should be an error")
+	}
+}
+
+func TestLoadOwners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLoadOwners")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "owners.json")
+	rtx.Must(ioutil.WriteFile(filename, []byte(`{"1000": "ndt-server", "0": "root"}`), 0644), "Could not write owners")
+
+	owners, err := config.LoadOwners(filename)
+	rtx.Must(err, "Could not load owners")
+	if len(owners) != 2 || owners[1000] != "ndt-server" || owners[0] != "root" {
+		t.Error("Wrong owners", owners)
+	}
+
+	rtx.Must(ioutil.WriteFile(filename, []byte(`{"ndt": "ndt-server"}`), 0644), "Could not write owners")
+	_, err = config.LoadOwners(filename)
+	if !errors.Is(err, config.ErrBadUID) {
+		t.Error("Expected ErrBadUID, got", err)
+	}
+	_, err = config.LoadOwners(filepath.Join(dir, "missing.json"))
+	if err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestPipeline")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	rtx.Must(ioutil.WriteFile(filename, []byte(`{"Pipeline": {
+		"Filters": [{"Type": "sampling", "Fraction": 0.5}],
+		"Cache": {"GraceCycles": 4},
+		"Sinks": [{"Type": "files"}, {"Type": "nats", "URL": "nats://localhost:4222"}]}}`), 0644), "Could not write config")
+	c, err := config.Load(context.Background(), config.FileSource(filename))
+	rtx.Must(err, "Could not load config")
+	p := c.Pipeline
+	if c.Sampling != nil || p == nil || len(p.Filters) != 1 || p.Cache.GraceCycles != 4 || len(p.Sinks) != 2 || p.Sinks[1].URL != "nats://localhost:4222" {
+		t.Errorf("Wrong config %+v", c)
+	}
+
+	rtx.Must(ioutil.WriteFile(filename, []byte(`{"Pipeline": {"Filters": [{"Type": "sampling", "Fraction": 2}]}}`), 0644), "Could not write config")
+	_, err = config.Load(context.Background(), config.FileSource(filename))
+	if err != config.ErrBadSampling {
+		t.Error("Expected ErrBadSampling, got", err)
+	}
+}
+
+func TestFiltersAndBucket(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.json")
+	rtx.Must(ioutil.WriteFile(filename, []byte(`{
+		"Filters": {"LocalPorts": ["443", "9000-9100"], "UIDs": ["1000"], "Interfaces": ["1"]},
+		"OutputBucket": "my-project-tcpinfo"}`), 0644), "Could not write config")
+	c, err := config.Load(context.Background(), config.FileSource(filename))
+	rtx.Must(err, "Could not load config")
+	if c.Sampling != nil || c.OutputBucket == nil || *c.OutputBucket != "my-project-tcpinfo" {
+		t.Errorf("Wrong config %+v", c)
+	}
+	f, err := c.Filters.Collector()
+	rtx.Must(err, "Could not build the collector filter")
+	want := &collector.FilterConfig{
+		LocalPorts: []collector.PortRange{{First: 443, Last: 443}, {First: 9000, Last: 9100}},
+		UIDs:       []uint32{1000},
+		Interfaces: []uint32{1},
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("Wrong filter %+v, want %+v", f, want)
+	}
+
+	// Empty filters select all sockets, and an empty bucket means local files.
+	c = &config.Config{Filters: &config.CollectorFilters{}, OutputBucket: new(string)}
+	rtx.Must(c.Validate(), "Empty filters and bucket should be valid")
+	if f, err := c.Filters.Collector(); f != nil || err != nil {
+		t.Error("Empty filters should select all sockets", f, err)
+	}
+
+	for _, tt := range []struct {
+		config string
+		err    error
+	}{
+		{`{"Filters": {"LocalPorts": ["9100-9000"]}}`, collector.ErrBadFilter},
+		{`{"Filters": {"RemotePorts": ["http"]}}`, collector.ErrBadFilter},
+		{`{"Filters": {"Inodes": ["-1"]}}`, collector.ErrBadFilter},
+		{`{"Filters": {"Interfaces": ["no-such-interface"]}}`, collector.ErrBadFilter},
+		{`{"OutputBucket": "Not_A_Bucket!"}`, config.ErrBadBucket},
+		{`{"OutputBucket": "ab"}`, config.ErrBadBucket},
+	} {
+		rtx.Must(ioutil.WriteFile(filename, []byte(tt.config), 0644), "Could not write config")
+		_, err := config.Load(context.Background(), config.FileSource(filename))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Load(%s) = %v, want %v", tt.config, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// ErrBadUID is returned when an owner mapping key is not a valid UID.
+var ErrBadUID = errors.New("owner mapping keys must be numeric UIDs")
+
+// LoadOwners reads a mapping from UID to a logical owner or service name from
+// filename.  The file is a JSON object whose keys are decimal UIDs, e.g.
+//
+//	{"1000": "ndt-server", "1001": "neubot"}
+func LoadOwners(filename string) (map[uint32]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]string{}
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[uint32]string, len(raw))
+	for k, v := range raw {
+		uid, err := strconv.ParseUint(k, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrBadUID, k)
+		}
+		owners[uint32(uid)] = v
+	}
+	return owners, nil
+}
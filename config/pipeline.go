@@ -0,0 +1,83 @@
+package config
+
+// Pipeline describes the stages that snapshots pass through, from the collector,
+// through the filters and the connection cache, to the sinks.  Unlike the other
+// settings, it is only read at startup, so changes take effect on restart.
+//
+// For example,
+//
+//	{"Pipeline": {
+//	  "Filters": [
+//	    {"Type": "owner", "Owners": ["ndt-server"]},
+//	    {"Type": "cidr", "Direction": "source", "Allow": ["192.0.2.0/24"]}
+//	  ],
+//	  "Cache": {"GraceCycles": 1},
+//	  "Sinks": [{"Type": "files"}, {"Type": "nats", "URL": "nats://localhost:4222"}]
+//	}}
+type Pipeline struct {
+	// Filters select the connections that are recorded.  A connection must pass
+	// every filter.
+	Filters []Filter `json:",omitempty"`
+	Cache   Cache
+	// Sinks receive the recorded snapshots.  All of them are active at once.
+	Sinks []Sink
+}
+
+// Filter is a stage that selects connections.  Type is "owner", "sampling", "cidr",
+// "priority" or "sockopt".  A priority filter does not exclude connections, but
+// assigns its Priority to those with one of its Owners, if any, that pass its cidr
+// fields.  Nor does a sockopt filter, which selects the connections, in the same
+// way, whose snapshots record the socket options reported by their applications
+// to the eventsocket sink.
+type Filter struct {
+	Type     string
+	Owners   []string `json:",omitempty"` // owner: the owners whose connections are recorded.
+	Fraction float64  `json:",omitempty"` // sampling: the fraction of connections recorded.
+	// cidr: the address checked, "source" (local), "destination" (remote), or empty
+	// for either, and the networks, e.g. "192.0.2.0/24", one of which it must be in,
+	// if Allow is not empty, and none of which it may be in.
+	Direction string   `json:",omitempty"`
+	Allow     []string `json:",omitempty"`
+	Deny      []string `json:",omitempty"`
+	Priority  string   `json:",omitempty"` // priority: "low", "normal" or "high".
+}
+
+// Cache configures the connection cache stage.
+type Cache struct {
+	GraceCycles int `json:",omitempty"` // Polling cycles a connection may be missing before it is closed.
+}
+
+// Sink is a stage that receives snapshots.  Type is "files", "eventsocket",
+// "nats", "pubsub", "syslog", "journal", "grafana" or "grpc", and determines which of
+// the other fields are used.  Fields that are not set have the same defaults as the
+// corresponding flags.
+type Sink struct {
+	Type string
+
+	Path       string `json:",omitempty"` // eventsocket, journal: the unix domain socket.
+	Address    string `json:",omitempty"` // grafana: the listen address of the datasource.  grpc: of the Watch service.
+	URL        string `json:",omitempty"` // nats: the server.  syslog: the server, e.g. udp://loghost:514, or "local".
+	Subject    string `json:",omitempty"` // nats: the subject prefix.
+	Partitions int    `json:",omitempty"` // nats: the subjects per record type.
+	Topic      string `json:",omitempty"` // pubsub: the full topic name.
+	Endpoint   string `json:",omitempty"` // pubsub: the API endpoint.
+	BatchCount int    `json:",omitempty"` // pubsub: the maximum records per request.
+	BatchBytes int    `json:",omitempty"` // pubsub: the maximum bytes per request.
+	BatchDelay string `json:",omitempty"` // pubsub: the maximum batching delay, e.g. "100ms".
+	Buffer     int    `json:",omitempty"` // nats, pubsub, syslog, journal: the records buffered.  grafana: the snapshots kept per connection.  grpc: the messages buffered per Watch call.
+	// Encodings compress the records published, e.g. ["lz4", "snappy"].  nats: the
+	// encodings offered to the receivers, in order of preference.  pubsub: the one
+	// encoding, which all subscribers must support.
+	Encodings []string `json:",omitempty"`
+}
+
+// validate checks whether the pipeline values are in range.  The stage types are
+// checked when the pipeline is built.
+func (p *Pipeline) validate() error {
+	for _, f := range p.Filters {
+		if f.Type == "sampling" && (f.Fraction < 0 || f.Fraction > 1) {
+			return ErrBadSampling
+		}
+	}
+	return nil
+}
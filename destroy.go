@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/tcp-info/collector"
+)
+
+// parseCookie returns the socket cookie of a connection, given either the UUID
+// of its files, or the cookie itself, in hex.
+func parseCookie(s string) (uint64, error) {
+	hex := s[strings.LastIndex(s, "_")+1:]
+	hex = strings.TrimPrefix(strings.TrimPrefix(hex, "0x"), "0X")
+	cookie, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil || cookie == 0 {
+		return 0, fmt.Errorf("bad UUID or cookie %q", s)
+	}
+	return cookie, nil
+}
+
+// runDestroy closes the connections, identified by the UUIDs of their files or
+// by their cookies.  It attempts all of them, and returns an error if any failed.
+func runDestroy(ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("no connections to destroy")
+	}
+	failed := 0
+	for _, id := range ids {
+		cookie, err := parseCookie(id)
+		if err == nil {
+			err = collector.DestroyCookie(cookie)
+		}
+		if err != nil {
+			log.Println("Could not destroy", id, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d connections were not destroyed", failed, len(ids))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestParseCookie(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{in: "ndt-7hhhv_1559749627_0000000000062D84", want: 0x62D84},
+		{in: "62d84", want: 0x62D84},
+		{in: "0x62D84", want: 0x62D84},
+		{in: "ndt-7hhhv_1559749627_", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "xyz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCookie(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseCookie(%q) = %x, %v", tt.in, got, err)
+		}
+	}
+}
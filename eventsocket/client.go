@@ -29,6 +29,41 @@ type Handler interface {
 	Close(ctx context.Context, timestamp time.Time, uuid string)
 }
 
+// FinalHandler may also be implemented by a Handler that wants the final counters
+// of closed connections.  If it is, FinalClose is called on Close events instead of
+// Close.  final is nil if the server sent no counters.
+type FinalHandler interface {
+	FinalClose(ctx context.Context, timestamp time.Time, uuid string, final *Counters)
+}
+
+// SockOptReporter may also be implemented by a Handler that reports the socket
+// options of its connections.  Each SockOpts received from the channel returned by
+// Reports is sent to the server, until the channel is closed, or the context is
+// cancelled.
+type SockOptReporter interface {
+	Reports() <-chan *SockOpts
+}
+
+// report sends the SockOpts received from reports to the server over c.
+func report(ctx context.Context, c net.Conn, reports <-chan *SockOpts) {
+	enc := json.NewEncoder(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case opts, ok := <-reports:
+			if !ok {
+				return
+			}
+			// Encode terminates each report with a newline.
+			if err := enc.Encode(opts); err != nil {
+				log.Println("Could not send socket options:", err)
+				return
+			}
+		}
+	}
+}
+
 // MustRun will read from the passed-in socket filename until the context is
 // cancelled. Any errors are fatal.
 func MustRun(ctx context.Context, socket string, handler Handler) {
@@ -42,17 +77,25 @@ func MustRun(ctx context.Context, socket string, handler Handler) {
 		<-ctx.Done()
 		c.Close()
 	}()
+	if r, ok := handler.(SockOptReporter); ok {
+		go report(ctx, c, r.Reports())
+	}
 
 	// By default bufio.Scanner is based on newlines, which is perfect for our JSONL protocol.
+	fh, hasFinal := handler.(FinalHandler)
 	s := bufio.NewScanner(c)
 	for s.Scan() {
-		var event FlowEvent
+		var event FinalEvent
 		rtx.Must(json.Unmarshal(s.Bytes(), &event), "Could not unmarshall")
 		switch event.Event {
 		case Open:
 			handler.Open(ctx, event.Timestamp, event.UUID, event.ID)
 		case Close:
-			handler.Close(ctx, event.Timestamp, event.UUID)
+			if hasFinal {
+				fh.FinalClose(ctx, event.Timestamp, event.UUID, event.Final)
+			} else {
+				handler.Close(ctx, event.Timestamp, event.UUID)
+			}
 		default:
 			log.Println("Unknown event type:", event.Event)
 		}
@@ -27,6 +27,37 @@ func (t *testHandler) Close(ctx context.Context, timestamp time.Time, uuid strin
 	t.wg.Done()
 }
 
+type finalHandler struct {
+	testHandler
+	finals []*Counters
+}
+
+func (t *finalHandler) FinalClose(ctx context.Context, timestamp time.Time, uuid string, final *Counters) {
+	t.finals = append(t.finals, final)
+	t.wg.Done()
+}
+
+// reportingHandler reports socket options for each connection opened.
+type reportingHandler struct {
+	testHandler
+	reports chan *SockOpts
+}
+
+func (t *reportingHandler) Open(ctx context.Context, timestamp time.Time, uuid string, id *inetdiag.SockID) {
+	t.reports <- &SockOpts{UUID: uuid, Timestamp: timestamp, Options: map[string]int64{"SO_SNDBUF": 87040}}
+}
+
+func (t *reportingHandler) Reports() <-chan *SockOpts {
+	return t.reports
+}
+
+// sockOptChan sends the SockOpts it handles to a channel.
+type sockOptChan chan *SockOpts
+
+func (c sockOptChan) SockOpts(opts *SockOpts) {
+	c <- opts
+}
+
 func TestClient(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -65,3 +96,94 @@ func TestClient(t *testing.T) {
 	cancel()
 	clientWg.Wait()
 }
+
+func TestClientFinal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "TestEventSocketClientFinal")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	srv := New(dir + "/tcpevents.sock").(*server)
+	srv.Listen()
+	srvCtx, srvCancel := context.WithCancel(context.Background())
+	go srv.Serve(srvCtx)
+	defer srvCancel()
+
+	th := &finalHandler{}
+	clientWg := sync.WaitGroup{}
+	clientWg.Add(1)
+	go func() {
+		MustRun(ctx, dir+"/tcpevents.sock", th)
+		clientWg.Done()
+	}()
+	th.wg.Add(2)
+
+	// Wait for the client to connect, so that no event is missed.
+	for {
+		srv.mutex.Lock()
+		length := len(srv.clients)
+		srv.mutex.Unlock()
+		if length > 0 {
+			break
+		}
+	}
+	srv.FlowDeletedWithCounters(time.Now(), "fakeuuid", &Counters{State: "FIN_WAIT2", BytesSent: 1000})
+	srv.FlowDeleted(time.Now(), "fakeuuid2")
+	th.wg.Wait()
+
+	cancel()
+	clientWg.Wait()
+	if th.closes != 0 {
+		t.Error("Close should not be called on a FinalHandler, but was called", th.closes, "times")
+	}
+	if len(th.finals) != 2 || th.finals[0] == nil || th.finals[0].BytesSent != 1000 || th.finals[1] != nil {
+		t.Errorf("Wrong final counters: %+v", th.finals)
+	}
+}
+
+func TestClientSockOpts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "TestEventSocketClientSockOpts")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	srv := New(dir + "/tcpevents.sock").(*server)
+	srv.Listen()
+	srvCtx, srvCancel := context.WithCancel(context.Background())
+	go srv.Serve(srvCtx)
+	defer srvCancel()
+	received := make(sockOptChan, 1)
+	srv.HandleSockOpts(received)
+
+	th := &reportingHandler{reports: make(chan *SockOpts, 1)}
+	clientWg := sync.WaitGroup{}
+	clientWg.Add(1)
+	go func() {
+		MustRun(ctx, dir+"/tcpevents.sock", th)
+		clientWg.Done()
+	}()
+	for {
+		srv.mutex.Lock()
+		length := len(srv.clients)
+		srv.mutex.Unlock()
+		if length > 0 {
+			break
+		}
+	}
+
+	// The client reports the options of the opened connection to the server.
+	srv.FlowCreated(time.Now(), "fakeuuid", inetdiag.SockID{})
+	select {
+	case opts := <-received:
+		if opts.UUID != "fakeuuid" || opts.Options["SO_SNDBUF"] != 87040 {
+			t.Errorf("Wrong socket options %+v", opts)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The socket options were not received")
+	}
+
+	cancel()
+	clientWg.Wait()
+}
@@ -1,6 +1,7 @@
 package eventsocket
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -37,6 +38,45 @@ type FlowEvent struct {
 	ID        *inetdiag.SockID //`json:",omitempty"`
 }
 
+// FinalEvent is the form of a Close event sent by a FinalServer.  Final is only
+// sent if a snapshot of the connection was seen, so a FinalEvent can be read as a
+// FlowEvent by clients that don't want the counters.
+type FinalEvent struct {
+	FlowEvent
+	Final *Counters `json:",omitempty"`
+}
+
+// Counters are the final counters of a closed connection, from the last snapshot
+// of it that was seen.  A connection that closes between two polls may have sent
+// and received more than its last snapshot shows.
+type Counters struct {
+	State         string // The TCP state of the last snapshot, e.g. FIN_WAIT2.
+	BytesSent     int64
+	BytesAcked    int64
+	BytesReceived int64
+	BytesRetrans  int64
+	SegsOut       int32
+	SegsIn        int32
+	TotalRetrans  uint32
+	MinRTT        uint32 // In microseconds.
+}
+
+// SockOpts are the socket options of a connection, read by its application with
+// getsockopt, e.g. {"SO_SNDBUF": 87040, "TCP_NOTSENT_LOWAT": 16384}.  Clients may
+// send them to the server in JSONL form, at any time after the Open event of the
+// connection, so that they are recorded with its snapshots.
+type SockOpts struct {
+	UUID      string
+	Timestamp time.Time // When the options were read.
+	Options   map[string]int64
+}
+
+// SockOptHandler receives the SockOpts sent by the clients of a Server.  It is
+// called concurrently by the goroutines reading each client.
+type SockOptHandler interface {
+	SockOpts(opts *SockOpts)
+}
+
 // Server is the interface that has the methods that actually serve the events
 // over the unix domain socket. You should make new Server objects with
 // eventsocket.New or eventsocket.NullServer.
@@ -47,13 +87,34 @@ type Server interface {
 	FlowDeleted(timestamp time.Time, uuid string)
 }
 
+// FinalServer may also be implemented by a Server that sends the final counters
+// of connections with their Close events.  The Servers returned by New and
+// NullServer implement it.
+type FinalServer interface {
+	// FlowDeletedWithCounters is FlowDeleted, with the final counters of the flow,
+	// if they are known.
+	FlowDeletedWithCounters(timestamp time.Time, uuid string, final *Counters)
+}
+
+// SockOptServer may also be implemented by a Server that accepts the SockOpts sent
+// by its clients.  The Servers returned by New and NullServer implement it.
+type SockOptServer interface {
+	// HandleSockOpts sets the handler of the SockOpts sent by clients.  Those
+	// received without a handler are discarded.
+	HandleSockOpts(h SockOptHandler)
+}
+
 type server struct {
-	eventC       chan *FlowEvent
+	eventC       chan interface{} // A *FlowEvent or *FinalEvent.
 	filename     string
 	clients      map[net.Conn]struct{}
 	unixListener net.Listener
 	mutex        sync.Mutex
 	servingWG    sync.WaitGroup
+
+	// The handler is not guarded by mutex, which is held while writing to clients.
+	handlerLock sync.Mutex
+	handler     SockOptHandler
 }
 
 func (s *server) addClient(c net.Conn) {
@@ -61,6 +122,27 @@ func (s *server) addClient(c net.Conn) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.clients[c] = struct{}{}
+	go s.readClient(c)
+}
+
+// readClient passes the SockOpts sent by the client c to the handler, until the
+// connection is closed.  Malformed lines are logged and skipped.
+func (s *server) readClient(c net.Conn) {
+	r := bufio.NewScanner(c)
+	for r.Scan() {
+		var opts SockOpts
+		err := json.Unmarshal(r.Bytes(), &opts)
+		if err != nil || opts.UUID == "" {
+			log.Printf("Bad socket options %q from client %v (err: %v)\n", r.Text(), c, err)
+			continue
+		}
+		s.handlerLock.Lock()
+		h := s.handler
+		s.handlerLock.Unlock()
+		if h != nil {
+			h.SockOpts(&opts)
+		}
+	}
 }
 
 func (s *server) removeClient(c net.Conn) {
@@ -101,7 +183,7 @@ func (s *server) notifyClients(ctx context.Context) {
 		var b []byte
 		var err error
 		if event != nil {
-			b, err = json.Marshal(*event)
+			b, err = json.Marshal(event)
 		}
 		if event == nil || err != nil {
 			log.Printf("WARNING: Bad event received %v (err: %v)\n", event, err)
@@ -183,9 +265,29 @@ func (s *server) FlowDeleted(timestamp time.Time, uuid string) {
 	}
 }
 
+// FlowDeletedWithCounters is FlowDeleted, with the final counters of the flow, if
+// they are known.
+func (s *server) FlowDeletedWithCounters(timestamp time.Time, uuid string, final *Counters) {
+	s.eventC <- &FinalEvent{
+		FlowEvent: FlowEvent{
+			Event:     Close,
+			Timestamp: timestamp,
+			UUID:      uuid,
+		},
+		Final: final,
+	}
+}
+
+// HandleSockOpts sets the handler of the SockOpts sent by clients.
+func (s *server) HandleSockOpts(h SockOptHandler) {
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+	s.handler = h
+}
+
 // New makes a new server that serves clients on the provided Unix domain socket.
 func New(filename string) Server {
-	c := make(chan *FlowEvent, 100)
+	c := make(chan interface{}, 100)
 	return &server{
 		filename: filename,
 		eventC:   c,
@@ -196,10 +298,12 @@ func New(filename string) Server {
 type nullServer struct{}
 
 // Empty implementations that do no harm.
-func (nullServer) Listen() error                                                    { return nil }
-func (nullServer) Serve(context.Context) error                                      { return nil }
-func (nullServer) FlowCreated(timestamp time.Time, uuid string, id inetdiag.SockID) {}
-func (nullServer) FlowDeleted(timestamp time.Time, uuid string)                     {}
+func (nullServer) Listen() error                                                             { return nil }
+func (nullServer) Serve(context.Context) error                                               { return nil }
+func (nullServer) FlowCreated(timestamp time.Time, uuid string, id inetdiag.SockID)          {}
+func (nullServer) FlowDeleted(timestamp time.Time, uuid string)                              {}
+func (nullServer) FlowDeletedWithCounters(timestamp time.Time, uuid string, final *Counters) {}
+func (nullServer) HandleSockOpts(h SockOptHandler)                                           {}
 
 // NullServer returns a Server that does nothing. It is made so that code that
 // may or may not want to use a eventsocket can receive a Server interface and
@@ -0,0 +1,42 @@
+// Package fault injects faults, e.g. failing writes, slow compressors, truncated
+// netlink reads and clock jumps, at hooks in the saver, collector and compressors,
+// so that tests can exercise their error handling.
+//
+// Faults can only be injected in binaries built with the faults tag, e.g. with
+//
+//	go test -tags=faults ./...
+//
+// Otherwise the hooks do nothing, and are inlined by the compiler.
+package fault
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInjected is the error of an injected fault without an Err.
+var ErrInjected = errors.New("injected fault")
+
+// Point identifies a hook at which faults can be injected.
+type Point string
+
+// The hooks.
+const (
+	FileCreate  Point = "file-create"  // Creation of connection files.  Uses Err.
+	FileWrite   Point = "file-write"   // Writes to connection files.  Uses Err.
+	Compress    Point = "compress"     // Writes to the zstd compressors.  Uses Delay.
+	NetlinkRead Point = "netlink-read" // Messages read from netlink.  Uses Truncate.
+	Clock       Point = "clock"        // The clock of the collector and saver.  Uses Skew.
+)
+
+// Fault describes a fault injected at a Point.  It fires on the hits of the hook
+// after the first After, and at most Count times, if Count is not zero.
+type Fault struct {
+	Err      error         // The error returned, or ErrInjected if nil.
+	Delay    time.Duration // The delay added.
+	Truncate int           // The number of bytes removed from the end of a read.
+	Skew     time.Duration // The jump of the clock.
+
+	After int
+	Count int
+}
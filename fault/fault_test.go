@@ -0,0 +1,123 @@
+//go:build faults
+// +build faults
+
+package fault_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/fault"
+)
+
+func TestError(t *testing.T) {
+	defer fault.Reset()
+	if err := fault.Error(fault.FileCreate); err != nil {
+		t.Error("No fault was injected, but got", err)
+	}
+	errFull := errors.New("disk full")
+	fault.Inject(fault.FileCreate, fault.Fault{Err: errFull, After: 1, Count: 2})
+	var got []error
+	for i := 0; i < 5; i++ {
+		got = append(got, fault.Error(fault.FileCreate))
+	}
+	want := []error{nil, errFull, errFull, nil, nil}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Hit %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+	if n := fault.Fired(fault.FileCreate); n != 2 {
+		t.Error("Expected 2 faults, got", n)
+	}
+
+	fault.Inject(fault.FileCreate, fault.Fault{})
+	if err := fault.Error(fault.FileCreate); err != fault.ErrInjected {
+		t.Error("Expected ErrInjected, got", err)
+	}
+	fault.Clear(fault.FileCreate)
+	if err := fault.Error(fault.FileCreate); err != nil || fault.Fired(fault.FileCreate) != 0 {
+		t.Error("The fault was not cleared", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	defer fault.Reset()
+	b := []byte("0123456789")
+	fault.Inject(fault.NetlinkRead, fault.Fault{Truncate: 4, Count: 1})
+	if got := fault.Truncate(fault.NetlinkRead, b); string(got) != "012345" {
+		t.Error("Expected 6 bytes, got", string(got))
+	}
+	if got := fault.Truncate(fault.NetlinkRead, b); len(got) != len(b) {
+		t.Error("The fault should only fire once, got", string(got))
+	}
+	fault.Inject(fault.NetlinkRead, fault.Fault{Truncate: 20})
+	if got := fault.Truncate(fault.NetlinkRead, b); len(got) != 0 {
+		t.Error("Expected an empty read, got", string(got))
+	}
+}
+
+func TestNow(t *testing.T) {
+	defer fault.Reset()
+	fault.Inject(fault.Clock, fault.Fault{Skew: -time.Hour, After: 1})
+	if d := time.Since(fault.Now()); d > time.Minute {
+		t.Error("The clock should not jump before After hits, but is", d, "behind")
+	}
+	if d := time.Since(fault.Now()); d < time.Hour {
+		t.Error("The clock did not jump back, it is", d, "behind")
+	}
+}
+
+func TestSleep(t *testing.T) {
+	defer fault.Reset()
+	fault.Inject(fault.Compress, fault.Fault{Delay: 50 * time.Millisecond})
+	start := time.Now()
+	fault.Sleep(fault.Compress)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Error("Sleep returned after", d)
+	}
+}
+
+type buffer struct {
+	bytes.Buffer
+	err error
+}
+
+func (*buffer) Close() error { return nil }
+func (n *buffer) Err() error { return n.err }
+
+func TestWriter(t *testing.T) {
+	defer fault.Reset()
+	buf := &buffer{}
+	w := fault.Writer(fault.FileWrite, buf)
+	f := w.(interface{ Err() error })
+	fault.Inject(fault.FileWrite, fault.Fault{After: 1, Count: 1})
+	if _, err := w.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if f.Err() != nil {
+		t.Error("Unexpected error", f.Err())
+	}
+	// Once a write fails, the writer stays failed.
+	for i := 0; i < 2; i++ {
+		if _, err := w.Write([]byte("b")); err != fault.ErrInjected {
+			t.Error("Expected ErrInjected, got", err)
+		}
+	}
+	if f.Err() != fault.ErrInjected {
+		t.Error("Expected ErrInjected from Err, got", f.Err())
+	}
+	if buf.String() != "a" {
+		t.Error("Failed writes should not be written, got", buf.String())
+	}
+
+	// Errors of the underlying writer are reported.
+	buf = &buffer{err: io.ErrClosedPipe}
+	w = fault.Writer(fault.FileWrite, buf)
+	if err := w.(interface{ Err() error }).Err(); err != io.ErrClosedPipe {
+		t.Error("Expected the error of the underlying writer, got", err)
+	}
+}
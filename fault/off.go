@@ -0,0 +1,28 @@
+//go:build !faults
+// +build !faults
+
+package fault
+
+import (
+	"io"
+	"time"
+)
+
+// Enabled is true if faults can be injected, i.e. the binary was built with the
+// faults tag.
+const Enabled = false
+
+// Error returns the error of the fault at p.
+func Error(p Point) error { return nil }
+
+// Sleep sleeps for the delay of the fault at p.
+func Sleep(p Point) {}
+
+// Truncate returns b, truncated by the fault at p.
+func Truncate(p Point, b []byte) []byte { return b }
+
+// Now returns the current time, skewed by the fault at Clock.
+func Now() time.Time { return time.Now() }
+
+// Writer returns w, with its writes failing with the fault at p.
+func Writer(p Point, w io.WriteCloser) io.WriteCloser { return w }
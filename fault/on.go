@@ -0,0 +1,154 @@
+//go:build faults
+// +build faults
+
+package fault
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Enabled is true if faults can be injected, i.e. the binary was built with the
+// faults tag.
+const Enabled = true
+
+// injected is a Fault, and its hooks so far.
+type injected struct {
+	Fault
+	hits, fired int
+}
+
+var (
+	mu     sync.Mutex
+	faults = make(map[Point]*injected)
+)
+
+// Inject injects f at p, replacing any fault already injected at p.
+func Inject(p Point, f Fault) {
+	mu.Lock()
+	defer mu.Unlock()
+	faults[p] = &injected{Fault: f}
+}
+
+// Clear removes the fault at p.
+func Clear(p Point) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(faults, p)
+}
+
+// Reset removes all faults.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	faults = make(map[Point]*injected)
+}
+
+// Fired returns the number of times the fault at p has fired.
+func Fired(p Point) int {
+	mu.Lock()
+	defer mu.Unlock()
+	if f, ok := faults[p]; ok {
+		return f.fired
+	}
+	return 0
+}
+
+// fire returns the fault at p, and true if it fires on this hit of the hook.
+func fire(p Point) (Fault, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	f, ok := faults[p]
+	if !ok {
+		return Fault{}, false
+	}
+	f.hits++
+	if f.hits <= f.After || (f.Count > 0 && f.fired >= f.Count) {
+		return Fault{}, false
+	}
+	f.fired++
+	return f.Fault, true
+}
+
+// Error returns the error of the fault at p.
+func Error(p Point) error {
+	f, ok := fire(p)
+	if !ok {
+		return nil
+	}
+	if f.Err == nil {
+		return ErrInjected
+	}
+	return f.Err
+}
+
+// Sleep sleeps for the delay of the fault at p.
+func Sleep(p Point) {
+	if f, ok := fire(p); ok {
+		time.Sleep(f.Delay)
+	}
+}
+
+// Truncate returns b, truncated by the fault at p.
+func Truncate(p Point, b []byte) []byte {
+	f, ok := fire(p)
+	if !ok || f.Truncate <= 0 {
+		return b
+	}
+	if f.Truncate >= len(b) {
+		return b[:0]
+	}
+	return b[:len(b)-f.Truncate]
+}
+
+// Now returns the current time, skewed by the fault at Clock.
+func Now() time.Time {
+	if f, ok := fire(Clock); ok {
+		return time.Now().Add(f.Skew)
+	}
+	return time.Now()
+}
+
+// Writer returns w, with its writes failing with the fault at p.  Once a write
+// fails, all later writes fail, and the error is reported by the Err method, as
+// for an asynchronous failure of the writer.
+func Writer(p Point, w io.WriteCloser) io.WriteCloser {
+	return &writer{WriteCloser: w, point: p}
+}
+
+type writer struct {
+	io.WriteCloser
+	point Point
+
+	mu  sync.Mutex // Err may be called concurrently with Write.
+	err error
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = Error(w.point)
+	}
+	err := w.err
+	w.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return w.WriteCloser.Write(b)
+}
+
+// Err returns the error of the first failed write, or that reported by the
+// underlying writer, if it has an Err method.
+func (w *writer) Err() error {
+	w.mu.Lock()
+	err := w.err
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if f, ok := w.WriteCloser.(interface{ Err() error }); ok {
+		return f.Err()
+	}
+	return nil
+}
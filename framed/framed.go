@@ -0,0 +1,461 @@
+// Package framed writes framed files, a stream of length-prefixed protobuf
+// messages that is simpler and faster to read from Python than the JSONL archive
+// records, whose attributes are raw netlink structs.  The protobuf schema is
+// derived from a Go struct type, and embedded at the start of each file, and the
+// same schema generates a small reference reader for Python.
+//
+// A framed file is the Magic, followed by frames.  Each frame is the length of its
+// content, as a protobuf varint, followed by the content.  The first frame is the
+// schema, in the proto3 language, and the others are the messages, as
+// produced by e.g. Java's writeDelimitedTo.
+//
+// Go types map to protobuf types as follows:
+//   - bool to bool, float32 to float, and float64 to double.
+//   - Signed integers of up to 32 bits to sint32, and other signed integers to sint64.
+//   - Unsigned integers of up to 32 bits to uint32, and others to uint64.
+//   - string to string, and []byte and byte arrays to bytes.
+//   - time.Time to sint64, in microseconds since the epoch.
+//   - Slices to repeated fields, and pointers to optional fields.
+//   - Maps with string or integer keys to map fields, in order of key.
+//   - Structs to messages named after the type.  Exported fields are named as for
+//     encoding/json, and fields tagged json:"-" are omitted.  The fields of an
+//     untagged embedded struct are promoted into the message, as for encoding/json.
+//
+// The number of each field is its position in the struct, from 1, with the fields
+// of an embedded struct counted in its place, so fields must only be added at the
+// end of a struct, and not to an embedded struct, for the files to remain readable.
+package framed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Magic begins every framed file.
+var Magic = []byte("tcp-info framed\n")
+
+// Errors returned by the package.
+var (
+	ErrUnsupportedType = errors.New("type has no protobuf equivalent")
+	ErrWrongType       = errors.New("value does not match the schema type")
+	ErrNameConflict    = errors.New("types in different packages have the same name")
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// encoder appends the protobuf encoding of v, without a tag, to b.
+type encoder func(b []byte, v reflect.Value) []byte
+
+// field describes a field of a message.
+type field struct {
+	name   string
+	number protowire.Number
+	index  []int
+	kind   string // One of sint, uint, bool, float, double, string, bytes, timestamp, message, or map.
+	proto  string // The protobuf type, e.g. sint64, or the message name.
+	label  string // "", "optional" or "repeated".
+	wire   protowire.Type
+	enc    encoder
+	// key and value describe the entries of a map, as fields 1 and 2 of a message.
+	key, value *field
+}
+
+// message describes a message type.
+type message struct {
+	name   string
+	goType reflect.Type
+	fields []field
+}
+
+// compiler derives the messages for types, defining each message once.
+type compiler struct {
+	messages []*message
+	byType   map[reflect.Type]*message
+}
+
+// compile returns the messages of a struct type, the root first.
+func compile(t reflect.Type) ([]*message, error) {
+	if t == nil || t.Kind() != reflect.Struct || t == timeType {
+		return nil, fmt.Errorf("%w: %v is not a message", ErrUnsupportedType, t)
+	}
+	c := compiler{byType: make(map[reflect.Type]*message)}
+	_, err := c.message(t)
+	return c.messages, err
+}
+
+func (c *compiler) message(t reflect.Type) (*message, error) {
+	if m, ok := c.byType[t]; ok {
+		return m, nil
+	}
+	if t.Name() == "" {
+		return nil, fmt.Errorf("%w: anonymous struct", ErrUnsupportedType)
+	}
+	for _, m := range c.messages {
+		if m.name == t.Name() {
+			return nil, fmt.Errorf("%w: %v and %v", ErrNameConflict, m.goType, t)
+		}
+	}
+	m := &message{name: t.Name(), goType: t}
+	c.byType[t] = m
+	c.messages = append(c.messages, m)
+	_, err := c.fields(m, t, nil, 0)
+	return m, err
+}
+
+// fields appends the fields of the struct type t, at index within the message's
+// type, numbered after the n fields before it, and returns the number of the last.
+func (c *compiler) fields(m *message, t reflect.Type, index []int, n int) (int, error) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fi := append(index[:len(index):len(index)], i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct && f.Type != timeType {
+			var err error
+			n, err = c.fields(m, f.Type, fi, n)
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		n++
+		if f.PkgPath != "" || tag == "-" {
+			continue // unexported or omitted
+		}
+		name := f.Name
+		if tag != "" {
+			name = tag
+		}
+		fd, err := c.field(f.Type)
+		if err != nil {
+			return n, fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+		fd.name, fd.number, fd.index = name, protowire.Number(n), fi
+		m.fields = append(m.fields, fd)
+	}
+	return n, nil
+}
+
+// field returns the description of a field of type t, without its name and number.
+func (c *compiler) field(t reflect.Type) (field, error) {
+	if t == timeType {
+		return field{kind: "timestamp", proto: "sint64", wire: protowire.VarintType, enc: func(b []byte, v reflect.Value) []byte {
+			return protowire.AppendVarint(b, protowire.EncodeZigZag(v.Interface().(time.Time).UnixMicro()))
+		}}, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return field{kind: "bool", proto: "bool", wire: protowire.VarintType, enc: func(b []byte, v reflect.Value) []byte {
+			return protowire.AppendVarint(b, protowire.EncodeBool(v.Bool()))
+		}}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return field{kind: "sint", proto: "sint32", wire: protowire.VarintType, enc: appendSint}, nil
+	case reflect.Int, reflect.Int64:
+		return field{kind: "sint", proto: "sint64", wire: protowire.VarintType, enc: appendSint}, nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return field{kind: "uint", proto: "uint32", wire: protowire.VarintType, enc: appendUint}, nil
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		return field{kind: "uint", proto: "uint64", wire: protowire.VarintType, enc: appendUint}, nil
+	case reflect.Float32:
+		return field{kind: "float", proto: "float", wire: protowire.Fixed32Type, enc: func(b []byte, v reflect.Value) []byte {
+			return protowire.AppendFixed32(b, math.Float32bits(float32(v.Float())))
+		}}, nil
+	case reflect.Float64:
+		return field{kind: "double", proto: "double", wire: protowire.Fixed64Type, enc: func(b []byte, v reflect.Value) []byte {
+			return protowire.AppendFixed64(b, math.Float64bits(v.Float()))
+		}}, nil
+	case reflect.String:
+		return field{kind: "string", proto: "string", wire: protowire.BytesType, enc: func(b []byte, v reflect.Value) []byte {
+			return protowire.AppendString(b, v.String())
+		}}, nil
+	case reflect.Array, reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return field{kind: "bytes", proto: "bytes", wire: protowire.BytesType, enc: appendBytes}, nil
+		}
+		if t.Kind() == reflect.Array {
+			break
+		}
+		f, err := c.field(t.Elem())
+		if err != nil {
+			return f, err
+		}
+		if f.label != "" || f.kind == "map" {
+			return f, fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+		}
+		f.label = "repeated"
+		return f, nil
+	case reflect.Ptr:
+		f, err := c.field(t.Elem())
+		if err != nil {
+			return f, err
+		}
+		if f.label != "" || f.kind == "map" {
+			return f, fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+		}
+		if f.kind != "message" {
+			f.label = "optional"
+		}
+		enc, elem := f.enc, t.Elem()
+		f.enc = func(b []byte, v reflect.Value) []byte {
+			if v.IsNil() {
+				return enc(b, reflect.Zero(elem)) // Only in repeated fields.
+			}
+			return enc(b, v.Elem())
+		}
+		return f, nil
+	case reflect.Map:
+		return c.mapField(t)
+	case reflect.Struct:
+		m, err := c.message(t)
+		if err != nil {
+			return field{}, err
+		}
+		return field{kind: "message", proto: m.name, wire: protowire.BytesType, enc: func(b []byte, v reflect.Value) []byte {
+			return protowire.AppendBytes(b, m.encode(nil, v))
+		}}, nil
+	}
+	return field{}, fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+}
+
+// mapField returns the description of a map field.  Protobuf map keys are strings
+// or integers, and the values may not be repeated.
+func (c *compiler) mapField(t reflect.Type) (field, error) {
+	key, err := c.field(t.Key())
+	if err != nil {
+		return key, err
+	}
+	if key.kind != "string" && key.kind != "sint" && key.kind != "uint" && key.kind != "bool" {
+		return field{}, fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+	}
+	value, err := c.field(t.Elem())
+	if err != nil {
+		return value, err
+	}
+	if value.label != "" || value.kind == "map" {
+		return field{}, fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+	}
+	key.name, key.number = "key", 1
+	value.name, value.number = "value", 2
+	return field{kind: "map", proto: fmt.Sprintf("map<%s, %s>", key.proto, value.proto), wire: protowire.BytesType,
+		key: &key, value: &value}, nil
+}
+
+// entry returns the encoding of an entry of a map field, a message with the key
+// and value, which are always present.
+func (f *field) entry(k, v reflect.Value) []byte {
+	b := protowire.AppendTag(nil, f.key.number, f.key.wire)
+	b = f.key.enc(b, k)
+	b = protowire.AppendTag(b, f.value.number, f.value.wire)
+	return f.value.enc(b, v)
+}
+
+// sortedKeys returns the keys of a map, in order.
+func sortedKeys(v reflect.Value) []reflect.Value {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch a.Kind() {
+		case reflect.String:
+			return a.String() < b.String()
+		case reflect.Bool:
+			return !a.Bool() && b.Bool()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return a.Int() < b.Int()
+		}
+		return a.Uint() < b.Uint()
+	})
+	return keys
+}
+
+func appendSint(b []byte, v reflect.Value) []byte {
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(v.Int()))
+}
+
+func appendUint(b []byte, v reflect.Value) []byte {
+	return protowire.AppendVarint(b, v.Uint())
+}
+
+func appendBytes(b []byte, v reflect.Value) []byte {
+	b = protowire.AppendVarint(b, uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		b = append(b, byte(v.Index(i).Uint()))
+	}
+	return b
+}
+
+// encode appends the encoding of v, a struct of the message's type, to b.  Fields
+// with zero values, nil pointers, and empty slices and maps are omitted, as in proto3.
+func (m *message) encode(b []byte, v reflect.Value) []byte {
+	for i := range m.fields {
+		f := &m.fields[i]
+		fv := v.FieldByIndex(f.index)
+		switch {
+		case f.label == "repeated" && fv.Kind() == reflect.Slice:
+			for j := 0; j < fv.Len(); j++ {
+				b = protowire.AppendTag(b, f.number, f.wire)
+				b = f.enc(b, fv.Index(j))
+			}
+		case f.kind == "map":
+			for _, k := range sortedKeys(fv) {
+				b = protowire.AppendTag(b, f.number, f.wire)
+				b = protowire.AppendBytes(b, f.entry(k, fv.MapIndex(k)))
+			}
+		case fv.Kind() == reflect.Ptr:
+			if !fv.IsNil() {
+				b = protowire.AppendTag(b, f.number, f.wire)
+				b = f.enc(b, fv)
+			}
+		case f.kind == "message" || !fv.IsZero():
+			b = protowire.AppendTag(b, f.number, f.wire)
+			b = f.enc(b, fv)
+		}
+	}
+	return b
+}
+
+// Schema returns the proto3 schema for a struct type.
+func Schema(t reflect.Type) (string, error) {
+	messages, err := compile(t)
+	if err != nil {
+		return "", err
+	}
+	return schema(messages), nil
+}
+
+func schema(messages []*message) string {
+	var sb strings.Builder
+	sb.WriteString("syntax = \"proto3\";\n")
+	for _, m := range messages {
+		fmt.Fprintf(&sb, "\n// From %v.\nmessage %s {\n", m.goType, m.name)
+		for _, f := range m.fields {
+			label := ""
+			if f.label != "" {
+				label = f.label + " "
+			}
+			comment := ""
+			if f.kind == "timestamp" {
+				comment = " // Microseconds since the epoch."
+			}
+			fmt.Fprintf(&sb, "  %s%s %s = %d;%s\n", label, f.proto, f.name, f.number, comment)
+		}
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
+
+// Encoder encodes values of a single struct type as frames, for callers that
+// write the frames themselves.
+type Encoder struct {
+	t      reflect.Type
+	m      *message
+	header []byte
+}
+
+// NewEncoder returns an Encoder for values of the same type as v, which must be a
+// struct or a pointer to one.
+func NewEncoder(v interface{}) (*Encoder, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	messages, err := compile(t)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte{}, Magic...)
+	header = appendFrame(header, []byte(schema(messages)))
+	return &Encoder{t: t, m: messages[0], header: header}, nil
+}
+
+// Header returns the start of a framed file, i.e. the Magic and the schema frame.
+// It must not be modified.
+func (e *Encoder) Header() []byte {
+	return e.header
+}
+
+// encode appends the message encoding of v, without a length, to b.
+func (e *Encoder) encode(b []byte, v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() || rv.Type() != e.t {
+		return b, fmt.Errorf("%w: %T", ErrWrongType, v)
+	}
+	return e.m.encode(b, rv), nil
+}
+
+// Marshal returns the message encoding of v, which must be of the Encoder's type or
+// a pointer to it, without a frame, e.g. for use as an RPC message.
+func (e *Encoder) Marshal(v interface{}) ([]byte, error) {
+	return e.encode(nil, v)
+}
+
+// Append appends the frame of v, which must be of the Encoder's type or a pointer
+// to it, to b.
+func (e *Encoder) Append(b []byte, v interface{}) ([]byte, error) {
+	msg, err := e.encode(nil, v)
+	if err != nil {
+		return b, err
+	}
+	return appendFrame(b, msg), nil
+}
+
+// appendFrame appends a frame with the content msg to b.
+func appendFrame(b []byte, msg []byte) []byte {
+	b = protowire.AppendVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// Writer writes values of a single struct type to a framed file.
+type Writer struct {
+	w   *bufio.Writer
+	enc *Encoder
+	buf []byte
+}
+
+// NewWriter writes the header of a framed file for values of the same type as v,
+// which must be a struct or a pointer to one, and returns a Writer for the values.
+func NewWriter(w io.Writer, v interface{}) (*Writer, error) {
+	enc, err := NewEncoder(v)
+	if err != nil {
+		return nil, err
+	}
+	fw := &Writer{w: bufio.NewWriter(w), enc: enc}
+	_, err = fw.w.Write(enc.Header())
+	return fw, err
+}
+
+func (w *Writer) frame(b []byte) error {
+	var n [binary.MaxVarintLen64]byte
+	_, err := w.w.Write(protowire.AppendVarint(n[:0], uint64(len(b))))
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(b)
+	return err
+}
+
+// Append writes v, which must be of the Writer's type or a pointer to it.
+func (w *Writer) Append(v interface{}) error {
+	var err error
+	w.buf, err = w.enc.encode(w.buf[:0], v)
+	if err != nil {
+		return err
+	}
+	return w.frame(w.buf)
+}
+
+// Close writes any buffered frames.  It does not close the underlying writer.
+func (w *Writer) Close() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,300 @@
+package framed_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/m-lab/tcp-info/framed"
+)
+
+type Inner struct {
+	Name string
+	Skip int `json:"-"`
+	Big  uint64
+}
+
+type Outer struct {
+	Flag    bool
+	Small   int8
+	Neg     int64
+	Float   float32
+	Double  float64
+	Data    []byte
+	Array   [4]byte
+	Time    time.Time
+	Inner   Inner
+	Ptr     *Inner
+	Opt     *int32
+	Inners  []Inner
+	Ints    []uint16
+	Renamed string `json:"renamed,omitempty"`
+	hidden  int
+	Map     map[string]int32
+}
+
+// fields returns the values of a message by field number, with nested messages
+// as []byte.
+func fields(t *testing.T, b []byte) map[protowire.Number][]interface{} {
+	out := make(map[protowire.Number][]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		rtx.PanicOnError(protowire.ParseError(n), "Bad tag")
+		b = b[n:]
+		var v interface{}
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			v, n = protowire.ConsumeFixed32(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		}
+		rtx.PanicOnError(protowire.ParseError(n), "Bad value")
+		b = b[n:]
+		out[num] = append(out[num], v)
+	}
+	return out
+}
+
+// frames returns the frames of a framed file.
+func frames(t *testing.T, b []byte) [][]byte {
+	if !bytes.HasPrefix(b, framed.Magic) {
+		t.Fatal("Missing magic")
+	}
+	b = b[len(framed.Magic):]
+	var out [][]byte
+	for len(b) > 0 {
+		f, n := protowire.ConsumeBytes(b)
+		rtx.PanicOnError(protowire.ParseError(n), "Bad frame")
+		out = append(out, f)
+		b = b[n:]
+	}
+	return out
+}
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := framed.NewWriter(buf, &Outer{})
+	rtx.Must(err, "Could not create writer")
+	opt := int32(0)
+	ts := time.Date(2019, 4, 2, 14, 12, 37, 511000000, time.UTC)
+	full := Outer{
+		Flag: true, Small: -3, Neg: -1, Float: 1.5, Double: 2.25, Data: []byte("abc"),
+		Array: [4]byte{1, 2, 3, 4}, Time: ts, Inner: Inner{Name: "in", Skip: 7, Big: math.MaxUint64},
+		Ptr: &Inner{}, Opt: &opt, Inners: []Inner{{Name: "a"}, {Name: "b"}}, Ints: []uint16{5, 0, 6},
+		Renamed: "r", hidden: 1, Map: map[string]int32{"b": -2, "a": 1},
+	}
+	rtx.Must(w.Append(&full), "Could not append")
+	rtx.Must(w.Append(Outer{}), "Could not append")
+	if err := w.Append(Inner{}); !errors.Is(err, framed.ErrWrongType) {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+	rtx.Must(w.Close(), "Could not close")
+
+	fr := frames(t, buf.Bytes())
+	if len(fr) != 3 {
+		t.Fatal("Expected the schema and two messages, got", len(fr))
+	}
+	if !strings.Contains(string(fr[0]), "message Outer {") {
+		t.Error("First frame is not the schema", string(fr[0]))
+	}
+
+	f := fields(t, fr[1])
+	want := map[protowire.Number][]interface{}{
+		1:  {uint64(1)},
+		2:  {protowire.EncodeZigZag(-3)},
+		3:  {protowire.EncodeZigZag(-1)},
+		4:  {math.Float32bits(1.5)},
+		5:  {math.Float64bits(2.25)},
+		6:  {[]byte("abc")},
+		7:  {[]byte{1, 2, 3, 4}},
+		8:  {protowire.EncodeZigZag(ts.UnixMicro())},
+		10: {[]byte{}},  // Ptr to a zero message is present.
+		11: {uint64(0)}, // Opt is present, although zero.
+		13: {uint64(5), uint64(0), uint64(6)},
+		14: {[]byte("r")},
+	}
+	for num, w := range want {
+		if !reflect.DeepEqual(f[num], w) {
+			t.Errorf("Field %d = %v, want %v", num, f[num], w)
+		}
+	}
+	inner := fields(t, f[9][0].([]byte))
+	if string(inner[1][0].([]byte)) != "in" || inner[2] != nil || inner[3][0] != uint64(math.MaxUint64) {
+		t.Errorf("Wrong inner message %v", inner)
+	}
+	if len(f[12]) != 2 || string(fields(t, f[12][1].([]byte))[1][0].([]byte)) != "b" {
+		t.Errorf("Wrong repeated message %v", f[12])
+	}
+	// The map entries are in order of key.
+	if len(f[16]) != 2 {
+		t.Fatalf("Wrong map %v", f[16])
+	}
+	for i, w := range []map[protowire.Number][]interface{}{
+		{1: {[]byte("a")}, 2: {protowire.EncodeZigZag(1)}},
+		{1: {[]byte("b")}, 2: {protowire.EncodeZigZag(-2)}},
+	} {
+		if entry := fields(t, f[16][i].([]byte)); !reflect.DeepEqual(entry, w) {
+			t.Errorf("Map entry %d = %v, want %v", i, entry, w)
+		}
+	}
+
+	// Zero values are omitted, except for messages.
+	f = fields(t, fr[2])
+	if len(f) != 1 || len(f[9]) != 1 {
+		t.Errorf("Zero value should only have the Inner message, got %v", f)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	// An Encoder produces the same bytes as a Writer.
+	in := Outer{Flag: true, Small: -3, Inner: Inner{Name: "in"}, Ints: []uint16{5}}
+	buf := &bytes.Buffer{}
+	w, err := framed.NewWriter(buf, Outer{})
+	rtx.Must(err, "Could not create writer")
+	rtx.Must(w.Append(in), "Could not append")
+	rtx.Must(w.Close(), "Could not close")
+
+	enc, err := framed.NewEncoder(&Outer{})
+	rtx.Must(err, "Could not create encoder")
+	b := append([]byte{}, enc.Header()...)
+	b, err = enc.Append(b, &in)
+	rtx.Must(err, "Could not append")
+	if !bytes.Equal(b, buf.Bytes()) {
+		t.Errorf("Encoder produced %q, want %q", b, buf.Bytes())
+	}
+	// Marshal produces the content of the frame.
+	msg, err := enc.Marshal(in)
+	rtx.Must(err, "Could not marshal")
+	if !bytes.HasSuffix(b, msg) || int(b[len(b)-len(msg)-1]) != len(msg) {
+		t.Errorf("Marshal produced %q, not the last frame of %q", msg, b)
+	}
+	if _, err := enc.Append(nil, Inner{}); !errors.Is(err, framed.ErrWrongType) {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema, err := framed.Schema(reflect.TypeOf(Outer{}))
+	rtx.Must(err, "Could not derive schema")
+	for _, s := range []string{
+		`syntax = "proto3";`,
+		"message Outer {", "message Inner {",
+		"  bool Flag = 1;", "  sint32 Small = 2;", "  sint64 Neg = 3;", "  float Float = 4;",
+		"  double Double = 5;", "  bytes Data = 6;", "  bytes Array = 7;",
+		"  sint64 Time = 8; // Microseconds since the epoch.", "  Inner Inner = 9;", "  Inner Ptr = 10;",
+		"  optional sint32 Opt = 11;", "  repeated Inner Inners = 12;", "  repeated uint32 Ints = 13;",
+		"  string renamed = 14;", "  map<string, sint32> Map = 16;", "  string Name = 1;", "  uint64 Big = 3;",
+	} {
+		if !strings.Contains(schema, s+"\n") {
+			t.Errorf("Schema is missing %q", s)
+		}
+	}
+	if strings.Contains(schema, "Skip") || strings.Contains(schema, "hidden") {
+		t.Error("Schema should omit json:\"-\" and unexported fields")
+	}
+	if strings.Count(schema, "message Inner {") != 1 {
+		t.Error("Inner should be defined once")
+	}
+}
+
+type Embedding struct {
+	First string
+	Inner
+	Last int32
+}
+
+func TestEmbedded(t *testing.T) {
+	schema, err := framed.Schema(reflect.TypeOf(Embedding{}))
+	rtx.Must(err, "Could not derive schema")
+	for _, s := range []string{"  string First = 1;", "  string Name = 2;", "  uint64 Big = 4;", "  sint32 Last = 5;"} {
+		if !strings.Contains(schema, s+"\n") {
+			t.Errorf("Schema is missing %q", s)
+		}
+	}
+	if strings.Contains(schema, "message Inner {") {
+		t.Error("The embedded fields should be promoted, not a message", schema)
+	}
+
+	enc, err := framed.NewEncoder(Embedding{})
+	rtx.Must(err, "Could not create encoder")
+	b, err := enc.Marshal(&Embedding{First: "f", Inner: Inner{Name: "n", Skip: 7, Big: 8}, Last: -1})
+	rtx.Must(err, "Could not marshal")
+	want := map[protowire.Number][]interface{}{
+		1: {[]byte("f")}, 2: {[]byte("n")}, 4: {uint64(8)}, 5: {protowire.EncodeZigZag(-1)},
+	}
+	if f := fields(t, b); !reflect.DeepEqual(f, want) {
+		t.Errorf("Got %v, want %v", f, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	type withMap struct{ M map[float64]int }
+	type withMapOfSlices struct{ M map[string][]int }
+	type withMaps struct{ M []map[string]int }
+	type withChan struct{ C chan int }
+	type withArray struct{ A [2]int }
+	type withPtrs struct{ P []*int }
+	type withAnon struct{ S struct{ X int } }
+	type Inner struct{ X int }
+	type withConflict struct {
+		A Outer
+		B Inner
+	}
+	tests := []struct {
+		v    interface{}
+		want error
+	}{
+		{1, framed.ErrUnsupportedType},
+		{time.Time{}, framed.ErrUnsupportedType},
+		{withMap{}, framed.ErrUnsupportedType},
+		{withMapOfSlices{}, framed.ErrUnsupportedType},
+		{withMaps{}, framed.ErrUnsupportedType},
+		{withChan{}, framed.ErrUnsupportedType},
+		{withArray{}, framed.ErrUnsupportedType},
+		{withPtrs{}, framed.ErrUnsupportedType},
+		{withAnon{}, framed.ErrUnsupportedType},
+		{withConflict{}, framed.ErrNameConflict},
+	}
+	for _, tt := range tests {
+		_, err := framed.NewWriter(&bytes.Buffer{}, tt.v)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("NewWriter(%T) = %v, want %v", tt.v, err, tt.want)
+		}
+		_, err = framed.Python(reflect.TypeOf(tt.v))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Python(%T) = %v, want %v", tt.v, err, tt.want)
+		}
+	}
+}
+
+func TestPython(t *testing.T) {
+	py, err := framed.Python(reflect.TypeOf(Outer{}))
+	rtx.Must(err, "Could not generate reader")
+	for _, s := range []string{
+		`MAGIC = "tcp-info framed\n".encode("ascii")`,
+		`ROOT = "Outer"`,
+		`        9: ("Inner", "message", "Inner", ""),`,
+		`        11: ("Opt", "sint", None, "optional"),`,
+		`        13: ("Ints", "uint", None, "repeated"),`,
+		`        8: ("Time", "timestamp", None, ""),`,
+		`        16: ("Map", "map", "Outer.Map", ""),`,
+		`    "Outer.Map": {`,
+		`        2: ("value", "sint", None, ""),`,
+		`message Outer {`,
+	} {
+		if !bytes.Contains(py, []byte(s+"\n")) {
+			t.Errorf("Reader is missing %q", s)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package framed
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"text/template"
+)
+
+// Python returns the source of a Python module that reads framed files of a struct
+// type.  It needs only the standard library, and pandas for read_dataframe, and
+// zstandard for compressed files.
+func Python(t reflect.Type) ([]byte, error) {
+	messages, err := compile(t)
+	if err != nil {
+		return nil, err
+	}
+	type pyField struct {
+		Number                     int
+		Name, Kind, Message, Label string
+	}
+	type pyMessage struct {
+		Name   string
+		Fields []pyField
+	}
+	pyFieldOf := func(f *field) pyField {
+		pf := pyField{Number: int(f.number), Name: f.name, Kind: f.kind, Label: f.label}
+		if f.kind == "message" {
+			pf.Message = f.proto
+		}
+		return pf
+	}
+	var pm, entries []pyMessage
+	for _, m := range messages {
+		p := pyMessage{Name: m.name}
+		for i := range m.fields {
+			f := &m.fields[i]
+			pf := pyFieldOf(f)
+			if f.kind == "map" {
+				// The entries of a map are messages with the key and value.
+				pf.Message = m.name + "." + f.name
+				entries = append(entries, pyMessage{Name: pf.Message, Fields: []pyField{pyFieldOf(f.key), pyFieldOf(f.value)}})
+			}
+			p.Fields = append(p.Fields, pf)
+		}
+		pm = append(pm, p)
+	}
+	pm = append(pm, entries...)
+	buf := bytes.Buffer{}
+	err = pythonTemplate.Execute(&buf, struct {
+		Magic    string
+		Root     string
+		Messages []pyMessage
+		Schema   string
+	}{string(Magic), messages[0].name, pm, schema(messages)})
+	return buf.Bytes(), err
+}
+
+var pythonTemplate = template.Must(template.New("python").Funcs(template.FuncMap{
+	"quote": func(s string) string { return fmt.Sprintf("%q", s) },
+}).Parse(`"""Reads tcp-info framed files.
+
+Generated by the tcp-info framed package from the schema below.  Do not edit.
+
+    import tcpinfo_framed
+    df = tcpinfo_framed.read_dataframe("connection.framed")
+
+{{.Schema}}"""
+
+import datetime
+import struct
+import sys
+
+MAGIC = {{quote .Magic}}.encode("ascii")
+ROOT = {{quote .Root}}
+
+# The fields of each message, by number: (name, kind, message, label).
+MESSAGES = {
+{{- range .Messages}}
+    {{quote .Name}}: {
+{{- range .Fields}}
+        {{.Number}}: ({{quote .Name}}, {{quote .Kind}}, {{if .Message}}{{quote .Message}}{{else}}None{{end}}, {{quote .Label}}),
+{{- end}}
+    },
+{{- end}}
+}
+
+_EPOCH = datetime.datetime(1970, 1, 1, tzinfo=datetime.timezone.utc)
+_ZERO = {"sint": 0, "uint": 0, "bool": False, "float": 0.0, "double": 0.0, "string": "", "bytes": b""}
+_FLOAT = struct.Struct("<f")
+_DOUBLE = struct.Struct("<d")
+
+
+def _varint(buf, pos):
+    result = 0
+    shift = 0
+    while True:
+        b = buf[pos]
+        pos += 1
+        result |= (b & 0x7F) << shift
+        if b < 0x80:
+            return result, pos
+        shift += 7
+
+
+def _zigzag(n):
+    return (n >> 1) ^ -(n & 1)
+
+
+def _empty(name):
+    msg = {}
+    for fname, kind, _, label in MESSAGES[name].values():
+        if label == "repeated":
+            msg[fname] = []
+        elif kind == "map":
+            msg[fname] = {}
+        elif label == "optional" or kind in ("message", "timestamp"):
+            msg[fname] = None
+        else:
+            msg[fname] = _ZERO[kind]
+    return msg
+
+
+def decode(buf, name=ROOT):
+    """Decodes a message of the named type into a dict.  Missing fields have their
+    zero values, or None for messages, timestamps and optional fields.  Maps are
+    decoded into dicts."""
+    fields = MESSAGES[name]
+    msg = _empty(name)
+    pos, end = 0, len(buf)
+    while pos < end:
+        key, pos = _varint(buf, pos)
+        number, wire = key >> 3, key & 7
+        if wire == 0:
+            value, pos = _varint(buf, pos)
+        elif wire == 1:
+            value, pos = buf[pos:pos + 8], pos + 8
+        elif wire == 2:
+            n, pos = _varint(buf, pos)
+            value, pos = buf[pos:pos + n], pos + n
+        elif wire == 5:
+            value, pos = buf[pos:pos + 4], pos + 4
+        else:
+            raise ValueError("unsupported wire type %d" % wire)
+        field = fields.get(number)
+        if field is None:
+            continue  # A field added after this reader was generated.
+        fname, kind, mname, label = field
+        if kind == "sint":
+            value = _zigzag(value)
+        elif kind == "bool":
+            value = value != 0
+        elif kind == "float":
+            value = _FLOAT.unpack(value)[0]
+        elif kind == "double":
+            value = _DOUBLE.unpack(value)[0]
+        elif kind == "string":
+            value = bytes(value).decode("utf-8")
+        elif kind == "bytes":
+            value = bytes(value)
+        elif kind == "timestamp":
+            value = _EPOCH + datetime.timedelta(microseconds=_zigzag(value))
+        elif kind == "message":
+            value = decode(value, mname)
+        elif kind == "map":
+            entry = decode(value, mname)
+            msg[fname][entry["key"]] = entry["value"]
+            continue
+        if label == "repeated":
+            msg[fname].append(value)
+        else:
+            msg[fname] = value
+    return msg
+
+
+def read(f):
+    """Yields the messages of a framed file object, opened in binary mode, as dicts.
+    Files compressed with zstd require the zstandard module."""
+    data = f.read()
+    if data[:4] == b"\x28\xb5\x2f\xfd":
+        import zstandard
+        data = zstandard.ZstdDecompressor().decompressobj().decompress(data)
+    if not data.startswith(MAGIC):
+        raise ValueError("not a tcp-info framed file")
+    buf = memoryview(data)
+    pos = len(MAGIC)
+    n, pos = _varint(buf, pos)
+    pos += n  # The schema, from which this module was generated.
+    while pos < len(buf):
+        n, pos = _varint(buf, pos)
+        yield decode(buf[pos:pos + n])
+        pos += n
+
+
+def flatten(msg, prefix=""):
+    """Flattens the nested messages of a decoded message, e.g. into "Snapshot.TCPInfo.RTT"."""
+    out = {}
+    for k, v in msg.items():
+        if isinstance(v, dict):
+            out.update(flatten(v, prefix + k + "."))
+        else:
+            out[prefix + k] = v
+    return out
+
+
+def read_dataframe(path):
+    """Returns the messages of a framed file as a pandas DataFrame, with a column
+    for each field."""
+    import pandas
+    with open(path, "rb") as f:
+        return pandas.DataFrame([flatten(m) for m in read(f)])
+
+
+if __name__ == "__main__":
+    for path in sys.argv[1:]:
+        with open(path, "rb") as f:
+            for m in read(f):
+                print(flatten(m))
+`))
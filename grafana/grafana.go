@@ -0,0 +1,251 @@
+// Package grafana serves the time series of individual connections to Grafana,
+// with the simple JSON datasource protocol, so that flows can be charted without
+// an intermediate time series database.  The protocol is that of the
+// grafana-simple-json-datasource plugin:
+//
+//	POST /search   the targets of the connections with recent snapshots
+//	POST /query    the datapoints of the requested targets and time range
+//
+// A target is a connection UUID and a field, e.g. "host_1553815964_00000000000003E8/rtt".
+// The series are read from the recent snapshots of open connections, and from
+// the connection files of the archive tree, for the last maxArchiveDays days of
+// the time range.
+package grafana
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// ErrBadTarget is returned for targets that are not a UUID and a known field.
+var ErrBadTarget = errors.New("bad target")
+
+// Limits on the work done by a single request.
+const (
+	maxArchiveDays   = 7
+	maxSearchResults = 1000
+)
+
+// field returns a value of a snapshot, and whether it is valid.  prev is the
+// preceding snapshot of the connection, or nil.
+type field func(prev, s *snapshot.Snapshot) (float64, bool)
+
+// ms returns a duration in milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// mbps returns a rate in Mbit/s.
+func mbps(r tcp.Rate) float64 {
+	return r.BitsPerSecond() / 1e6
+}
+
+// fields are the values that can be charted, by name.
+var fields = map[string]field{
+	"rtt":            func(_, s *snapshot.Snapshot) (float64, bool) { return ms(s.NormalizedTCPInfo().RTT), true },
+	"min_rtt":        func(_, s *snapshot.Snapshot) (float64, bool) { return ms(s.NormalizedTCPInfo().MinRTT), true },
+	"cwnd":           func(_, s *snapshot.Snapshot) (float64, bool) { return float64(s.TCPInfo.SndCwnd), true },
+	"delivery_rate":  func(_, s *snapshot.Snapshot) (float64, bool) { return mbps(s.NormalizedTCPInfo().DeliveryRate), true },
+	"bytes_acked":    func(_, s *snapshot.Snapshot) (float64, bool) { return float64(s.TCPInfo.BytesAcked), true },
+	"bytes_received": func(_, s *snapshot.Snapshot) (float64, bool) { return float64(s.TCPInfo.BytesReceived), true },
+	"total_retrans":  func(_, s *snapshot.Snapshot) (float64, bool) { return float64(s.TCPInfo.TotalRetrans), true },
+	// throughput is the rate of bytes acknowledged and received since the
+	// preceding snapshot, in Mbit/s.
+	"throughput": func(prev, s *snapshot.Snapshot) (float64, bool) {
+		if prev == nil {
+			return 0, false
+		}
+		dt := s.Timestamp.Sub(prev.Timestamp).Seconds()
+		if dt <= 0 {
+			return 0, false
+		}
+		bytes := s.TCPInfo.BytesAcked + s.TCPInfo.BytesReceived - prev.TCPInfo.BytesAcked - prev.TCPInfo.BytesReceived
+		return float64(bytes) * 8 / dt / 1e6, true
+	},
+}
+
+type handler struct {
+	recent *Recent
+	root   string
+}
+
+// NewHandler returns an http.Handler implementing the simple JSON datasource
+// protocol, for the connections in recent, and the archive tree under root.
+func NewHandler(recent *Recent, root string) http.Handler {
+	h := &handler{recent: recent, root: root}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.test)
+	mux.HandleFunc("/search", h.search)
+	mux.HandleFunc("/query", h.query)
+	mux.HandleFunc("/annotations", h.annotations)
+	return mux
+}
+
+// test responds to the datasource connection test.
+func (h *handler) test(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+func (h *handler) search(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "bad search request", http.StatusBadRequest)
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	targets := []string{}
+	for _, uuid := range h.recent.UUIDs() {
+		for _, name := range names {
+			t := uuid + "/" + name
+			if strings.Contains(t, req.Target) && len(targets) < maxSearchResults {
+				targets = append(targets, t)
+			}
+		}
+	}
+	writeJSON(w, targets)
+}
+
+type queryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	MaxDataPoints int `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+type series struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"` // Value, and time in milliseconds.
+}
+
+func (h *handler) query(w http.ResponseWriter, r *http.Request) {
+	var req queryRequest
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "bad query request", http.StatusBadRequest)
+		return
+	}
+	out := []series{}
+	for _, t := range req.Targets {
+		s, err := h.series(t.Target, req.Range.From, req.Range.To, req.MaxDataPoints)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out = append(out, s)
+	}
+	writeJSON(w, out)
+}
+
+// annotations responds to annotation queries, of which there are none.
+func (h *handler) annotations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, []struct{}{})
+}
+
+// series returns up to maxPoints datapoints of a target between from and to.
+func (h *handler) series(target string, from, to time.Time, maxPoints int) (series, error) {
+	s := series{Target: target, Datapoints: [][2]float64{}}
+	i := strings.LastIndexByte(target, '/')
+	// The UUID is part of a file pattern, so it must not contain a path or pattern.
+	if i <= 0 || fields[target[i+1:]] == nil || strings.ContainsAny(target[:i], `/\*?[`) {
+		return s, fmt.Errorf("%w: %q", ErrBadTarget, target)
+	}
+	uuid, f := target[:i], fields[target[i+1:]]
+
+	snaps := merge(h.archived(uuid, from, to), h.recent.Snapshots(uuid))
+	var prev *snapshot.Snapshot
+	for _, snap := range snaps {
+		if !snap.Timestamp.Before(from) && !snap.Timestamp.After(to) {
+			if v, ok := f(prev, snap); ok {
+				s.Datapoints = append(s.Datapoints, [2]float64{v, float64(snap.Timestamp.UnixNano() / int64(time.Millisecond))})
+			}
+		}
+		prev = snap
+	}
+	if maxPoints > 0 && len(s.Datapoints) > maxPoints {
+		step := (len(s.Datapoints) + maxPoints - 1) / maxPoints
+		kept := s.Datapoints[:0]
+		for i := 0; i < len(s.Datapoints); i += step {
+			kept = append(kept, s.Datapoints[i])
+		}
+		s.Datapoints = kept
+	}
+	return s, nil
+}
+
+// archived returns the archived snapshots of a connection, from the connection
+// files in the day directories between from and to.  The day directories may be
+// below up to three directories of the experiment, site and machine.
+func (h *handler) archived(uuid string, from, to time.Time) []*snapshot.Snapshot {
+	if earliest := to.AddDate(0, 0, -maxArchiveDays); from.Before(earliest) {
+		from = earliest
+	}
+	var files []string
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to); day = day.AddDate(0, 0, 1) {
+		pattern := filepath.Join(day.Format("2006/01/02"), uuid+".[0-9][0-9][0-9][0-9][0-9].jsonl.zst")
+		for depth := 0; depth <= 3; depth++ {
+			matches, _ := filepath.Glob(filepath.Join(h.root, strings.Repeat("*/", depth), pattern))
+			files = append(files, matches...)
+		}
+	}
+	sort.Strings(files)
+	var snaps []*snapshot.Snapshot
+	for _, name := range files {
+		rdr := zstd.NewReader(name)
+		_, s, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+		rdr.Close()
+		if err == nil {
+			snaps = append(snaps, s...)
+		}
+	}
+	return snaps
+}
+
+// merge returns the snapshots of a and b that have tcp_info, in time order, without
+// duplicates.  The recent snapshots of an open connection may also have been
+// written to its file.
+func merge(a, b []*snapshot.Snapshot) []*snapshot.Snapshot {
+	var all []*snapshot.Snapshot
+	for _, s := range append(a, b...) {
+		if s.TCPInfo != nil {
+			all = append(all, s)
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Timestamp.Before(all[j].Timestamp) })
+	out := all[:0]
+	for _, s := range all {
+		if len(out) > 0 && out[len(out)-1].Timestamp.Equal(s.Timestamp) {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,162 @@
+package grafana_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/grafana"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+const (
+	uuid     = "ndt-jdczh_1553815964_00000000000003E8"
+	testFile = "../cmd/csvtool/testdata/" + uuid + ".00183.jsonl.zst"
+)
+
+// records returns the records of the test file.
+func records(t *testing.T) [][]byte {
+	rdr := zstd.NewReader(testFile)
+	defer rdr.Close()
+	var out [][]byte
+	sc := bufio.NewScanner(rdr)
+	for sc.Scan() {
+		out = append(out, append([]byte{}, sc.Bytes()...))
+	}
+	rtx.Must(sc.Err(), "Could not read test file")
+	return out
+}
+
+func post(h http.Handler, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return rec
+}
+
+type series struct {
+	Target     string
+	Datapoints [][2]float64
+}
+
+func query(t *testing.T, h http.Handler, target string, maxPoints int) series {
+	body := `{"range": {"from": "2019-04-02T00:00:00Z", "to": "2019-04-03T00:00:00Z"},
+		"maxDataPoints": ` + strconv.Itoa(maxPoints) + `,
+		"targets": [{"target": "` + target + `", "refId": "A", "type": "timeserie"}]}`
+	rec := post(h, "/query", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Query %s = %d %s", target, rec.Code, rec.Body.String())
+	}
+	var out []series
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &out), "Could not decode %s", rec.Body.String())
+	if len(out) != 1 || out[0].Target != target {
+		t.Fatal("Wrong series", out)
+	}
+	return out[0]
+}
+
+func TestRecent(t *testing.T) {
+	recs := records(t)
+	r := grafana.NewRecent(10)
+	for _, b := range recs[:20] {
+		r.Publish(sink.Record{UUID: "live", Type: sink.Snapshot, Time: time.Now(), Data: b})
+	}
+	r.Publish(sink.Record{UUID: "closed", Type: sink.Snapshot, Time: time.Now(), Data: recs[0]})
+	r.Publish(sink.Record{UUID: "closed", Type: sink.ConnectionSummary, Time: time.Now(), Data: []byte("{}")})
+
+	if uuids := r.UUIDs(); len(uuids) != 1 || uuids[0] != "live" {
+		t.Error("Expected only the live connection, got", uuids)
+	}
+	snaps := r.Snapshots("live")
+	if len(snaps) != 10 {
+		t.Fatal("Expected the last 10 snapshots, got", len(snaps))
+	}
+	for i := 1; i < len(snaps); i++ {
+		if snaps[i].Timestamp.Before(snaps[i-1].Timestamp) {
+			t.Error("Snapshots out of order at", i)
+		}
+	}
+	if len(r.Snapshots("closed")) != 0 {
+		t.Error("Closed connection should be forgotten")
+	}
+	rtx.Must(r.Close(), "Could not close")
+}
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestGrafana")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	day := filepath.Join(dir, "lga03", "2019", "04", "02")
+	rtx.Must(os.MkdirAll(day, 0755), "Could not create day dir")
+	data, err := ioutil.ReadFile(testFile)
+	rtx.Must(err, "Could not read test file")
+	rtx.Must(ioutil.WriteFile(filepath.Join(day, uuid+".00183.jsonl.zst"), data, 0644), "Could not write")
+
+	recent := grafana.NewRecent(100)
+	for _, b := range records(t) {
+		// The recent snapshots duplicate the archived ones.
+		recent.Publish(sink.Record{UUID: uuid, Type: sink.Snapshot, Time: time.Now(), Data: b})
+		recent.Publish(sink.Record{UUID: "live", Type: sink.Snapshot, Time: time.Now(), Data: b})
+	}
+	h := grafana.NewHandler(recent, dir)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("Test connection failed", rec.Code)
+	}
+
+	rec = post(h, "/search", `{"target": "live/"}`)
+	var targets []string
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &targets), "Could not decode %s", rec.Body.String())
+	want := "live/bytes_acked live/bytes_received live/cwnd live/delivery_rate live/min_rtt live/rtt live/throughput live/total_retrans"
+	if strings.Join(targets, " ") != want {
+		t.Errorf("Search = %v, want %v", targets, want)
+	}
+
+	rtt := query(t, h, uuid+"/rtt", 0)
+	// One of the 151 records has only metadata.
+	if len(rtt.Datapoints) != 150 {
+		t.Error("Expected 150 datapoints, got", len(rtt.Datapoints))
+	}
+	for i := 1; i < len(rtt.Datapoints); i++ {
+		if rtt.Datapoints[i][1] <= rtt.Datapoints[i-1][1] {
+			t.Fatal("Datapoints not in order, or duplicated, at", i)
+		}
+	}
+	if live := query(t, h, "live/rtt", 0); len(live.Datapoints) != 100 {
+		t.Error("Expected the 100 recent datapoints, got", len(live.Datapoints))
+	}
+	if tput := query(t, h, uuid+"/throughput", 0); len(tput.Datapoints) != 149 {
+		t.Error("Expected 149 throughput datapoints, got", len(tput.Datapoints))
+	}
+	if cwnd := query(t, h, uuid+"/cwnd", 50); len(cwnd.Datapoints) > 50 || len(cwnd.Datapoints) < 40 {
+		t.Error("Expected about 50 datapoints, got", len(cwnd.Datapoints))
+	}
+	if unknown := query(t, h, "unknown/rtt", 0); len(unknown.Datapoints) != 0 {
+		t.Error("Expected no datapoints, got", unknown.Datapoints)
+	}
+
+	for _, target := range []string{uuid + "/color", "rtt", "../" + uuid + "/rtt", "*/rtt"} {
+		rec := post(h, "/query", `{"targets": [{"target": "`+target+`"}]}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Query %q = %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if rec := post(h, "/query", "not json"); rec.Code != http.StatusBadRequest {
+		t.Error("Expected bad request, got", rec.Code)
+	}
+	if rec := post(h, "/annotations", "{}"); rec.Body.String() != "[]\n" {
+		t.Error("Expected no annotations, got", rec.Body.String())
+	}
+}
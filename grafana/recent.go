@@ -0,0 +1,111 @@
+package grafana
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+// Connections that have not had a snapshot for recentMaxAge are forgotten, even
+// if they have not closed, e.g. because they are idle.  Their snapshots can still
+// be read from the archive.
+var recentMaxAge = 10 * time.Minute
+
+// Recent is a sink.Sink that keeps the most recent snapshots of each open
+// connection in memory.  Connections are forgotten when they close.
+type Recent struct {
+	size int
+
+	mu        sync.Mutex
+	conns     map[string]*recentConn
+	lastPrune time.Time
+}
+
+// recentConn is a ring buffer of the most recent snapshot records of a connection.
+type recentConn struct {
+	records [][]byte
+	next    int // Index of the oldest record, once the buffer is full.
+	last    time.Time
+}
+
+// NewRecent returns a Recent that keeps up to size snapshots per connection.
+func NewRecent(size int) *Recent {
+	return &Recent{size: size, conns: make(map[string]*recentConn)}
+}
+
+// Publish implements sink.Sink.
+func (r *Recent) Publish(rec sink.Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch rec.Type {
+	case sink.Snapshot:
+		c, ok := r.conns[rec.UUID]
+		if !ok {
+			c = &recentConn{}
+			r.conns[rec.UUID] = c
+		}
+		c.last = rec.Time
+		if len(c.records) < r.size {
+			c.records = append(c.records, rec.Data)
+		} else if r.size > 0 {
+			c.records[c.next] = rec.Data
+			c.next = (c.next + 1) % r.size
+		}
+	case sink.ConnectionSummary:
+		delete(r.conns, rec.UUID)
+	}
+	if rec.Time.Sub(r.lastPrune) > time.Minute {
+		for uuid, c := range r.conns {
+			if rec.Time.Sub(c.last) > recentMaxAge {
+				delete(r.conns, uuid)
+			}
+		}
+		r.lastPrune = rec.Time
+	}
+}
+
+// Close implements sink.Sink.
+func (r *Recent) Close() error {
+	return nil
+}
+
+// UUIDs returns the UUIDs of the connections with recent snapshots, sorted.
+func (r *Recent) UUIDs() []string {
+	r.mu.Lock()
+	uuids := make([]string, 0, len(r.conns))
+	for uuid := range r.conns {
+		uuids = append(uuids, uuid)
+	}
+	r.mu.Unlock()
+	sort.Strings(uuids)
+	return uuids
+}
+
+// Snapshots returns the recent snapshots of a connection, oldest first.
+func (r *Recent) Snapshots(uuid string) []*snapshot.Snapshot {
+	r.mu.Lock()
+	var records [][]byte
+	if c, ok := r.conns[uuid]; ok {
+		records = append(records, c.records[c.next:]...)
+		records = append(records, c.records[:c.next]...)
+	}
+	r.mu.Unlock()
+
+	snaps := make([]*snapshot.Snapshot, 0, len(records))
+	for _, b := range records {
+		var ar netlink.ArchivalRecord
+		if json.Unmarshal(b, &ar) != nil {
+			continue
+		}
+		_, s, err := snapshot.Decode(&ar)
+		if err == nil {
+			snaps = append(snaps, s)
+		}
+	}
+	return snaps
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+)
+
+var (
+	importTime     = flag.String("import.time", "", "Time of the first capture being imported, in RFC3339 format.  If empty, the modification time of each capture is used.")
+	importInterval = flag.Duration("import.interval", 10*time.Second, "Time between consecutive captures, when -import.time is set.")
+)
+
+// ErrBadCapture is returned when a capture is not a sequence of netlink messages.
+var ErrBadCapture = errors.New("not a netlink capture")
+
+// readCapture reads a capture of raw inet_diag netlink messages, as written by
+// e.g. ss --diag, and returns them as a MessageBlock received at time t.  Dump
+// terminators and messages of other types are skipped.
+func readCapture(rdr io.Reader, t time.Time) (netlink.MessageBlock, error) {
+	block := netlink.MessageBlock{V4Time: t, V6Time: t}
+	for {
+		msg, err := netlink.LoadRawNetlinkMessage(rdr)
+		if err == io.EOF {
+			return block, nil
+		}
+		if err != nil {
+			return block, fmt.Errorf("%w: %v", ErrBadCapture, err)
+		}
+		// Messages are padded to a multiple of 4 bytes.
+		if pad := (4 - msg.Header.Len%4) % 4; pad > 0 {
+			_, err = io.CopyN(io.Discard, rdr, int64(pad))
+			if err != nil && err != io.EOF {
+				return block, fmt.Errorf("%w: %v", ErrBadCapture, err)
+			}
+		}
+		if msg.Header.Type != inetdiag.SOCK_DIAG_BY_FAMILY || len(msg.Data) == 0 {
+			continue
+		}
+		switch msg.Data[0] {
+		case syscall.AF_INET:
+			block.V4Messages = append(block.V4Messages, msg)
+		case syscall.AF_INET6:
+			block.V6Messages = append(block.V6Messages, msg)
+		}
+	}
+}
+
+// importCaptures converts captures of raw inet_diag netlink messages, e.g. from
+// ss --diag, into the standard archive layout in the working directory.  Each
+// capture is treated as one polling cycle, in the order given, so a connection
+// that is missing from a capture is closed.  Each capture is timestamped with
+// its modification time, or if start is not zero, with start plus interval for
+// each preceding capture.
+func importCaptures(files []string, svr *saver.Saver, start time.Time, interval time.Duration) error {
+	svrChan := make(chan netlink.MessageBlock)
+	go svr.MessageSaverLoop(svrChan)
+	defer func() {
+		close(svrChan)
+		svr.Done.Wait()
+	}()
+	for i, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		t := start.Add(time.Duration(i) * interval)
+		if start.IsZero() {
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return err
+			}
+			t = info.ModTime()
+		}
+		block, err := readCapture(f, t)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Println("Importing", len(block.V4Messages)+len(block.V6Messages), "sockets from", name)
+		svrChan <- block
+	}
+	return nil
+}
+
+// runImport imports the captures named on the command line, with the saver
+// configured by the flags.
+func runImport(files []string) error {
+	var start time.Time
+	if *importTime != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, *importTime)
+		if err != nil {
+			return err
+		}
+	}
+	anon, err := flagAnonymizer()
+	if err != nil {
+		return err
+	}
+	template, err := saver.ParseNameTemplate(*outTemplate)
+	if err != nil {
+		return err
+	}
+	svr := saver.NewSaver(*machine, *site, 3, eventsocket.NullServer(), anon, saver.WithNameTemplate(template))
+	svr.Experiment = *experiment
+	svr.InProcessCompression = *inProcess
+	svr.CompressionFrameSize = *frameSize
+	svr.MaxFileSize = *maxFileSize
+	svr.DeltaInterval = *deltaIntvl
+	svr.ColumnBlock = *colBlock
+	svr.MinSnapshots = *minSnaps
+	svr.ShortFlowRollup = *shortFlows
+	err = svr.SetOutputFormat(*outFormat)
+	if err != nil {
+		return err
+	}
+	err = svr.SetAttributePolicy(allowAttrs, denyAttrs)
+	if err != nil {
+		return err
+	}
+	return importCaptures(files, svr, start, *importInterval)
+}
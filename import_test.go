@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// writeCapture writes the messages in the raw netlink format, followed by a dump
+// terminator, as ss --diag does.
+func writeCapture(t *testing.T, filename string, msgs []*netlink.NetlinkMessage) {
+	buf := bytes.Buffer{}
+	for _, m := range msgs {
+		rtx.Must(binary.Write(&buf, binary.LittleEndian, m.Header), "Could not write header")
+		buf.Write(m.Data)
+	}
+	done := netlink.NlMsghdr{Len: 20, Type: 3, Flags: 2}
+	rtx.Must(binary.Write(&buf, binary.LittleEndian, done), "Could not write header")
+	buf.Write([]byte{0, 0, 0, 0})
+	rtx.Must(ioutil.WriteFile(filename, buf.Bytes(), 0644), "Could not write capture")
+}
+
+func TestImport(t *testing.T) {
+	rdr := zstd.NewReader("netlink/testdata/testdata.zst")
+	var msgs []*netlink.NetlinkMessage
+	for {
+		m, err := netlink.LoadRawNetlinkMessage(rdr)
+		if err == io.EOF {
+			break
+		}
+		rtx.Must(err, "Could not read test data")
+		msgs = append(msgs, m)
+	}
+	rdr.Close()
+
+	dir, err := ioutil.TempDir("", "TestImport")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	writeCapture(t, filepath.Join(dir, "capture1"), msgs)
+	writeCapture(t, filepath.Join(dir, "capture2"), msgs[:10])
+
+	block, err := readCapture(bytes.NewReader(nil), time.Time{})
+	if err != nil || len(block.V4Messages)+len(block.V6Messages) != 0 {
+		t.Error("Empty capture should have no messages", err)
+	}
+	f, err := os.Open(filepath.Join(dir, "capture1"))
+	rtx.Must(err, "Could not open capture")
+	block, err = readCapture(f, time.Time{})
+	f.Close()
+	rtx.Must(err, "Could not read capture")
+	if len(block.V4Messages)+len(block.V6Messages) != len(msgs) {
+		t.Error("Expected", len(msgs), "messages, got", len(block.V4Messages)+len(block.V6Messages))
+	}
+	_, err = readCapture(bytes.NewReader([]byte{4, 0, 0, 0, 20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), time.Time{})
+	if !errors.Is(err, ErrBadCapture) {
+		t.Error("Expected ErrBadCapture, got", err)
+	}
+
+	out := filepath.Join(dir, "out")
+	rtx.Must(os.Mkdir(out, 0755), "Could not create output dir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(out), "Could not switch to %s", out)
+	defer os.Chdir(oldDir)
+
+	svr := saver.NewSaver("mlab1", "lga03", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	start := time.Date(2019, 6, 5, 15, 47, 7, 0, time.UTC)
+	err = importCaptures([]string{filepath.Join(dir, "capture1"), filepath.Join(dir, "capture2")}, svr, start, time.Minute)
+	rtx.Must(err, "Could not import")
+
+	files, err := filepath.Glob("2019/06/05/*.jsonl.zst")
+	rtx.Must(err, "Could not list files")
+	if len(files) == 0 {
+		t.Fatal("No connection files were written")
+	}
+	zr := zstd.NewReader(files[0])
+	defer zr.Close()
+	records, err := netlink.LoadAllArchivalRecords(zr)
+	rtx.Must(err, "Could not read %s", files[0])
+	if len(records) < 2 || !records[0].Metadata.StartTime.Equal(start) || !records[1].Timestamp.Equal(start) {
+		t.Errorf("Wrong records in %s: %+v", files[0], records)
+	}
+}
@@ -0,0 +1,132 @@
+package inetdiag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Netlink messages are in the byte order and struct layout of the host that
+// produced them.  By default, they are decoded by mapping the structs onto the
+// message bytes, which is fast, but only correct for messages from a host like
+// this one.  The other decoders copy each field from its offset in the kernel
+// struct with encoding/binary, in an explicit byte order, so that files saved on
+// hosts of other architectures can be parsed.
+
+// Decoder selects how netlink messages are decoded.
+type Decoder int32
+
+// The decoders.
+const (
+	// Unsafe maps the structs onto the message bytes.  It is the default.
+	Unsafe Decoder = iota
+	// Native decodes each field, in the byte order of this host.
+	Native
+	// LittleEndian decodes each field, in little endian byte order, e.g. for files
+	// saved on amd64 or arm64 hosts.
+	LittleEndian
+	// BigEndian decodes each field, in big endian byte order, e.g. for files saved
+	// on s390x hosts.
+	BigEndian
+)
+
+var decoderNames = []string{"unsafe", "native", "little-endian", "big-endian"}
+
+// nativeOrder is the byte order of this host.
+var nativeOrder binary.ByteOrder = binary.BigEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 1 {
+		nativeOrder = binary.LittleEndian
+	}
+}
+
+func (d Decoder) String() string {
+	if d < 0 || int(d) >= len(decoderNames) {
+		return fmt.Sprintf("Decoder(%d)", int32(d))
+	}
+	return decoderNames[d]
+}
+
+// Set sets the decoder from its name, so that it can be used as a flag.Value.
+func (d *Decoder) Set(s string) error {
+	for i, name := range decoderNames {
+		if s == name {
+			*d = Decoder(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown netlink decoder %q", s)
+}
+
+// ByteOrder returns the byte order of the decoder, or nil for Unsafe.
+func (d Decoder) ByteOrder() binary.ByteOrder {
+	switch d {
+	case Native:
+		return nativeOrder
+	case LittleEndian:
+		return binary.LittleEndian
+	case BigEndian:
+		return binary.BigEndian
+	}
+	return nil
+}
+
+var decoder int32
+
+// SetDecoder selects the decoder of the netlink messages, and their attributes,
+// for the whole process.  It should be called before any messages are parsed.
+func SetDecoder(d Decoder) {
+	atomic.StoreInt32(&decoder, int32(d))
+}
+
+// CurrentDecoder returns the decoder selected with SetDecoder.
+func CurrentDecoder() Decoder {
+	return Decoder(atomic.LoadInt32(&decoder))
+}
+
+// Offsets of the fields of struct inet_diag_msg, in linux/inet_diag.h.
+const (
+	idmSPortOffset   = 4
+	idmDPortOffset   = 6
+	idmSrcOffset     = 8
+	idmDstOffset     = 24
+	idmIfOffset      = 40
+	idmCookieOffset  = 44
+	idmExpiresOffset = 52
+	idmRqueueOffset  = 56
+	idmWqueueOffset  = 60
+	idmUIDOffset     = 64
+	idmInodeOffset   = 68
+)
+
+// decodeInetDiagMsg decodes an InetDiagMsg from raw, which must be at least 72
+// bytes, in the given byte order.  The ports and addresses are in network byte
+// order, and are copied as they are.  The interface and cookie are host order
+// integers, which the LinuxSockID keeps in the little endian encoding of the
+// hosts that recorded the existing archives, so they are re-encoded that way.
+func decodeInetDiagMsg(raw []byte, order binary.ByteOrder) *InetDiagMsg {
+	msg := &InetDiagMsg{
+		IDiagFamily:  raw[0],
+		IDiagState:   raw[1],
+		IDiagTimer:   raw[2],
+		IDiagRetrans: raw[3],
+		IDiagExpires: order.Uint32(raw[idmExpiresOffset:]),
+		IDiagRqueue:  order.Uint32(raw[idmRqueueOffset:]),
+		IDiagWqueue:  order.Uint32(raw[idmWqueueOffset:]),
+		IDiagUID:     order.Uint32(raw[idmUIDOffset:]),
+		IDiagInode:   order.Uint32(raw[idmInodeOffset:]),
+	}
+	id := &msg.ID
+	copy(id.IDiagSPort[:], raw[idmSPortOffset:])
+	copy(id.IDiagDPort[:], raw[idmDPortOffset:])
+	copy(id.IDiagSrc[:], raw[idmSrcOffset:])
+	copy(id.IDiagDst[:], raw[idmDstOffset:])
+	binary.LittleEndian.PutUint32(id.IDiagIf[:], order.Uint32(raw[idmIfOffset:]))
+	// The cookie is an array of two __u32, with the low half first.
+	cookie := uint64(order.Uint32(raw[idmCookieOffset:])) | uint64(order.Uint32(raw[idmCookieOffset+4:]))<<32
+	binary.LittleEndian.PutUint64(id.IDiagCookie[:], cookie)
+	return msg
+}
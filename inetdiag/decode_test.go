@@ -0,0 +1,125 @@
+package inetdiag
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestDecoderFlag(t *testing.T) {
+	var d Decoder
+	for _, name := range []string{"unsafe", "native", "little-endian", "big-endian"} {
+		rtx.Must(d.Set(name), "Could not set %q", name)
+		if d.String() != name {
+			t.Errorf("Set(%q) = %v", name, d)
+		}
+	}
+	if d.Set("middle-endian") == nil {
+		t.Error("Set should fail for unknown decoders")
+	}
+	if Decoder(7).String() != "Decoder(7)" || Decoder(7).ByteOrder() != nil || Unsafe.ByteOrder() != nil {
+		t.Error("Wrong unknown or Unsafe decoder")
+	}
+	if Native.ByteOrder() != binary.LittleEndian && Native.ByteOrder() != binary.BigEndian {
+		t.Error("Unknown native byte order")
+	}
+}
+
+// bigEndianMsg returns the bytes of an InetDiagMsg saved on a big endian host.
+func bigEndianMsg() []byte {
+	raw := make([]byte, 72)
+	raw[0], raw[1] = AF_INET, 3
+	binary.BigEndian.PutUint16(raw[idmSPortOffset:], 443)
+	binary.BigEndian.PutUint16(raw[idmDPortOffset:], 55555)
+	copy(raw[idmSrcOffset:], []byte{192, 0, 2, 1})
+	copy(raw[idmDstOffset:], []byte{198, 51, 100, 2})
+	binary.BigEndian.PutUint32(raw[idmIfOffset:], 2)
+	binary.BigEndian.PutUint32(raw[idmCookieOffset:], 0x89ABCDEF)
+	binary.BigEndian.PutUint32(raw[idmCookieOffset+4:], 0x01234567)
+	binary.BigEndian.PutUint32(raw[idmRqueueOffset:], 10)
+	binary.BigEndian.PutUint32(raw[idmUIDOffset:], 1000)
+	binary.BigEndian.PutUint32(raw[idmInodeOffset:], 123456)
+	return raw
+}
+
+func TestParseBigEndian(t *testing.T) {
+	defer SetDecoder(Unsafe)
+	SetDecoder(BigEndian)
+	raw := RawInetDiagMsg(bigEndianMsg())
+	msg, err := raw.Parse()
+	rtx.Must(err, "Could not parse")
+	if msg.IDiagFamily != AF_INET || msg.IDiagState != 3 || msg.IDiagRqueue != 10 || msg.IDiagUID != 1000 || msg.IDiagInode != 123456 {
+		t.Errorf("Wrong fields %+v", msg)
+	}
+	id := msg.ID.GetSockID()
+	want := SockID{SPort: 443, DPort: 55555, SrcIP: "192.0.2.1", DstIP: "198.51.100.2", Interface: 0x02000000, Cookie: 0x0123456789ABCDEF}
+	if id != want {
+		t.Errorf("GetSockID() = %+v, want %+v", id, want)
+	}
+	if msg.ID.IfIndex() != 2 {
+		t.Errorf("IfIndex() = %d, want 2", msg.ID.IfIndex())
+	}
+
+	// The little endian decoder gives the same values as the unsafe decoder, on
+	// the little endian hosts where the existing archives were recorded.
+	le := make([]byte, len(raw))
+	copy(le, raw)
+	for _, off := range []int{idmIfOffset, idmCookieOffset, idmCookieOffset + 4, idmRqueueOffset, idmUIDOffset, idmInodeOffset} {
+		binary.LittleEndian.PutUint32(le[off:], binary.BigEndian.Uint32(le[off:]))
+	}
+	SetDecoder(LittleEndian)
+	msg, err = RawInetDiagMsg(le).Parse()
+	rtx.Must(err, "Could not parse")
+	if msg.ID.GetSockID() != want || msg.IDiagInode != 123456 {
+		t.Errorf("Little endian GetSockID() = %+v, want %+v", msg.ID.GetSockID(), want)
+	}
+
+	if _, err := raw[:40].Parse(); err != ErrParseFailed {
+		t.Error("Expected ErrParseFailed, got", err)
+	}
+}
+
+func TestAnonymizeDecoded(t *testing.T) {
+	defer SetDecoder(Unsafe)
+	SetDecoder(BigEndian)
+	raw := RawInetDiagMsg(bigEndianMsg())
+	// The addresses are anonymized in the raw bytes, not in a decoded copy.
+	rtx.Must(raw.Anonymize(anonymize.New(anonymize.Netblock)), "Could not anonymize")
+	msg, err := raw.Parse()
+	rtx.Must(err, "Could not parse")
+	if !msg.ID.SrcIP().Equal(net.ParseIP("192.0.2.0")) || !msg.ID.DstIP().Equal(net.ParseIP("198.51.100.0")) {
+		t.Error("Addresses were not anonymized", msg.ID.SrcIP(), msg.ID.DstIP())
+	}
+	if raw[:40].Anonymize(anonymize.New(anonymize.Netblock)) != ErrParseFailed {
+		t.Error("Short messages should fail")
+	}
+}
+
+// FuzzParse checks that the native decoder agrees with the unsafe decoder, and
+// that no decoder panics, whatever the message.
+func FuzzParse(f *testing.F) {
+	f.Add(bigEndianMsg())
+	f.Add(make([]byte, 72))
+	f.Add([]byte{AF_INET6, 1, 2})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer SetDecoder(Unsafe)
+		raw := RawInetDiagMsg(data)
+		SetDecoder(Unsafe)
+		want, err := raw.Parse()
+		if err != nil {
+			return
+		}
+		SetDecoder(Native)
+		got, err := raw.Parse()
+		rtx.Must(err, "Native decoder failed where the unsafe decoder did not")
+		if *got != *want {
+			t.Errorf("Native decoder %+v != unsafe decoder %+v", got, want)
+		}
+		SetDecoder(BigEndian)
+		_, err = raw.Parse()
+		rtx.Must(err, "Big endian decoder failed where the unsafe decoder did not")
+	})
+}
@@ -81,6 +81,7 @@ var InetDiagType = map[int32]string{
 	INET_DIAG_BBRINFO:   "BBRInfo",
 	INET_DIAG_CLASS_ID:  "ClassID",
 	INET_DIAG_MD5SIG:    "MD5Sig",
+	INET_DIAG_ULP_INFO:  "ULPInfo",
 }
 
 var diagFamilyMap = map[uint8]string{
@@ -88,8 +89,9 @@ var diagFamilyMap = map[uint8]string{
 	AF_INET6: "tcp6", // because darwin values for AF_INET6 are incorrect.
 }
 
-// Protocol defines the type corresponding to INET_DIAG_PROTOCOL 8 bit field.
-type Protocol uint8
+// Protocol defines the type corresponding to INET_DIAG_PROTOCOL 8 bit field.  It is
+// 16 bits, like the protocol of a linux socket, to hold IPPROTO_MPTCP.
+type Protocol uint16
 
 const (
 	// Protocol_IPPROTO_UNUSED ...
@@ -100,12 +102,18 @@ const (
 	Protocol_IPPROTO_UDP Protocol = 17
 	// Protocol_IPPROTO_DCCP indicates DCCP traffic.
 	Protocol_IPPROTO_DCCP Protocol = 33
+	// Protocol_IPPROTO_UDPLITE indicates UDP-Lite traffic.
+	Protocol_IPPROTO_UDPLITE Protocol = 136
+	// Protocol_IPPROTO_MPTCP indicates MPTCP connections.
+	Protocol_IPPROTO_MPTCP Protocol = 262
 )
 
 // ProtocolName is used to convert Protocol values to strings.
 var ProtocolName = map[int32]string{
-	0:  "IPPROTO_UNUSED",
-	6:  "IPPROTO_TCP",
-	17: "IPPROTO_UDP",
-	33: "IPPROTO_DCCP",
+	0:   "IPPROTO_UNUSED",
+	6:   "IPPROTO_TCP",
+	17:  "IPPROTO_UDP",
+	33:  "IPPROTO_DCCP",
+	136: "IPPROTO_UDPLITE",
+	262: "IPPROTO_MPTCP",
 }
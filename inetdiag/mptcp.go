@@ -0,0 +1,93 @@
+package inetdiag
+
+// MPTCP connections are dumped like TCP connections, but with IPPROTO_MPTCP, which
+// does not fit in the protocol field of ReqV2, so it is requested in an
+// INET_DIAG_REQ_PROTOCOL attribute.  Their INET_DIAG_INFO attribute holds a struct
+// mptcp_info, rather than a struct tcp_info.  Their TCP subflows are dumped with the
+// other TCP connections, and identify the MPTCP connection they belong to in their
+// INET_DIAG_ULP_INFO attribute.  See uapi/linux/mptcp.h.
+
+// Attribute types newer than INET_DIAG_MAX.
+const (
+	// INET_DIAG_ULP_INFO holds the state of the upper layer protocol of a TCP
+	// socket, e.g. of an MPTCP subflow, from linux 5.3.
+	INET_DIAG_ULP_INFO = 19
+)
+
+// INET_DIAG_REQ_PROTOCOL is the request attribute holding the protocol, as a
+// uint32, when it does not fit in ReqV2.
+const INET_DIAG_REQ_PROTOCOL = 3
+
+// Attributes nested in INET_DIAG_ULP_INFO.
+const (
+	INET_ULP_INFO_NAME  = 1 // The name of the ULP, e.g. "mptcp" or "tls".
+	INET_ULP_INFO_TLS   = 2
+	INET_ULP_INFO_MPTCP = 3 // The MPTCP_SUBFLOW_ATTR attributes of a subflow.
+)
+
+// Attributes nested in INET_ULP_INFO_MPTCP.
+const (
+	MPTCP_SUBFLOW_ATTR_UNSPEC = iota
+	MPTCP_SUBFLOW_ATTR_TOKEN_REM
+	MPTCP_SUBFLOW_ATTR_TOKEN_LOC
+	MPTCP_SUBFLOW_ATTR_RELWRITE_SEQ
+	MPTCP_SUBFLOW_ATTR_MAP_SEQ
+	MPTCP_SUBFLOW_ATTR_MAP_SFSEQ
+	MPTCP_SUBFLOW_ATTR_SSN_OFFSET
+	MPTCP_SUBFLOW_ATTR_MAP_DATALEN
+	MPTCP_SUBFLOW_ATTR_FLAGS
+	MPTCP_SUBFLOW_ATTR_ID_REM
+	MPTCP_SUBFLOW_ATTR_ID_LOC
+	MPTCP_SUBFLOW_ATTR_PAD
+)
+
+// MPTCPInfo implements the struct associated with the INET_DIAG_INFO attribute of
+// an MPTCP socket, corresponding with linux struct mptcp_info in uapi/linux/mptcp.h.
+// Older kernels report a shorter struct, without the byte counts and times.
+type MPTCPInfo struct {
+	Subflows           uint8  `csv:"MPTCP.Subflows" kernel:"mptcpi_subflows"`
+	AddAddrSignal      uint8  `csv:"MPTCP.AddAddrSignal" kernel:"mptcpi_add_addr_signal"`
+	AddAddrAccepted    uint8  `csv:"MPTCP.AddAddrAccepted" kernel:"mptcpi_add_addr_accepted"`
+	SubflowsMax        uint8  `csv:"MPTCP.SubflowsMax" kernel:"mptcpi_subflows_max"`
+	AddAddrSignalMax   uint8  `csv:"MPTCP.AddAddrSignalMax" kernel:"mptcpi_add_addr_signal_max"`
+	AddAddrAcceptedMax uint8  `csv:"MPTCP.AddAddrAcceptedMax" kernel:"mptcpi_add_addr_accepted_max"`
+	Flags              uint32 `csv:"MPTCP.Flags" kernel:"mptcpi_flags"`
+	Token              uint32 `csv:"MPTCP.Token" kernel:"mptcpi_token"` // The local token, shared with the subflows.
+
+	// NOTE: In linux, these are uint64, but we make them int64 here for compatibility with BigQuery
+	WriteSeq int64 `csv:"MPTCP.WriteSeq" kernel:"mptcpi_write_seq"`
+	SndUna   int64 `csv:"MPTCP.SndUna" kernel:"mptcpi_snd_una"`
+	RcvNxt   int64 `csv:"MPTCP.RcvNxt" kernel:"mptcpi_rcv_nxt"`
+
+	LocalAddrUsed uint8  `csv:"MPTCP.LocalAddrUsed" kernel:"mptcpi_local_addr_used"`
+	LocalAddrMax  uint8  `csv:"MPTCP.LocalAddrMax" kernel:"mptcpi_local_addr_max"`
+	CsumEnabled   uint8  `csv:"MPTCP.CsumEnabled" kernel:"mptcpi_csum_enabled"`
+	Retransmits   uint32 `csv:"MPTCP.Retransmits" units:"packets" kernel:"mptcpi_retransmits"` // offset 44
+
+	// NOTE: In linux, these are uint64, but we make them int64 here for compatibility with BigQuery
+	BytesRetrans  int64 `csv:"MPTCP.BytesRetrans" units:"bytes" kernel:"mptcpi_bytes_retrans"`
+	BytesSent     int64 `csv:"MPTCP.BytesSent" units:"bytes" kernel:"mptcpi_bytes_sent"`
+	BytesReceived int64 `csv:"MPTCP.BytesReceived" units:"bytes" kernel:"mptcpi_bytes_received"`
+	BytesAcked    int64 `csv:"MPTCP.BytesAcked" units:"bytes" kernel:"mptcpi_bytes_acked"`
+
+	SubflowsTotal uint8  `csv:"MPTCP.SubflowsTotal" kernel:"mptcpi_subflows_total"`           // Followed by 3 reserved bytes.
+	LastDataSent  uint32 `csv:"MPTCP.LastDataSent" units:"ms" kernel:"mptcpi_last_data_sent"` // offset 84
+	LastDataRecv  uint32 `csv:"MPTCP.LastDataRecv" units:"ms" kernel:"mptcpi_last_data_recv"`
+	LastAckRecv   uint32 `csv:"MPTCP.LastAckRecv" units:"ms" kernel:"mptcpi_last_ack_recv"`
+}
+
+// MPTCPSubflowInfo is the MPTCP state of a TCP subflow, from the MPTCP_SUBFLOW_ATTR
+// attributes in its INET_DIAG_ULP_INFO attribute.
+type MPTCPSubflowInfo struct {
+	TokenRem    uint32 `csv:"Subflow.TokenRem" kernel:"MPTCP_SUBFLOW_ATTR_TOKEN_REM"`
+	TokenLoc    uint32 `csv:"Subflow.TokenLoc" kernel:"MPTCP_SUBFLOW_ATTR_TOKEN_LOC"` // The Token of the MPTCP connection.
+	RelWriteSeq uint32 `csv:"Subflow.RelWriteSeq" kernel:"MPTCP_SUBFLOW_ATTR_RELWRITE_SEQ"`
+	// NOTE: In linux, this is uint64, but we make it int64 here for compatibility with BigQuery
+	MapSeq     int64  `csv:"Subflow.MapSeq" kernel:"MPTCP_SUBFLOW_ATTR_MAP_SEQ"`
+	MapSfSeq   uint32 `csv:"Subflow.MapSfSeq" kernel:"MPTCP_SUBFLOW_ATTR_MAP_SFSEQ"`
+	SsnOffset  uint32 `csv:"Subflow.SsnOffset" kernel:"MPTCP_SUBFLOW_ATTR_SSN_OFFSET"`
+	MapDataLen uint16 `csv:"Subflow.MapDataLen" units:"bytes" kernel:"MPTCP_SUBFLOW_ATTR_MAP_DATALEN"`
+	Flags      uint32 `csv:"Subflow.Flags" kernel:"MPTCP_SUBFLOW_ATTR_FLAGS"`
+	IDRem      uint8  `csv:"Subflow.IDRem" kernel:"MPTCP_SUBFLOW_ATTR_ID_REM"`
+	IDLoc      uint8  `csv:"Subflow.IDLoc" kernel:"MPTCP_SUBFLOW_ATTR_ID_LOC"`
+}
@@ -31,6 +31,7 @@ import (
 	"log"
 	"net"
 	"runtime"
+	"syscall"
 	"unsafe"
 
 	"github.com/m-lab/go/anonymize"
@@ -39,6 +40,10 @@ import (
 // Constants from linux.
 const (
 	SOCK_DIAG_BY_FAMILY = 20 // uapi/linux/sock_diag.h
+	SOCK_DESTROY        = 21 // uapi/linux/sock_diag.h
+
+	NLMSG_ERROR = 2 // uapi/linux/netlink.h
+	NLMSG_DONE  = 3 // uapi/linux/netlink.h
 )
 
 var (
@@ -52,6 +57,26 @@ var (
 	ErrBadMsgData = errors.New("bad message data from netlink message")
 )
 
+// NetlinkError is the error code reported by the kernel in an NLMSG_ERROR message,
+// or in the NLMSG_DONE message ending a dump that failed.  It unwraps to the
+// syscall.Errno, e.g. ENOENT if the kernel does not support the protocol.
+type NetlinkError struct {
+	Type  uint16 // NLMSG_ERROR or NLMSG_DONE.
+	Errno syscall.Errno
+}
+
+func (e *NetlinkError) Error() string {
+	if e.Type == NLMSG_DONE {
+		return "netlink dump failed: " + e.Errno.Error()
+	}
+	return "netlink error: " + e.Errno.Error()
+}
+
+// Unwrap returns the Errno.
+func (e *NetlinkError) Unwrap() error {
+	return e.Errno
+}
+
 // ReqV2 is the Netlink request struct, as in linux/inet_diag.h
 // Note that netlink messages use host byte ordering, unless NLA_F_NET_BYTEORDER flag is present.
 type ReqV2 struct {
@@ -168,6 +193,13 @@ func (id *LinuxSockID) Interface() uint32 {
 	return binary.BigEndian.Uint32(id.IDiagIf[:])
 }
 
+// IfIndex returns the index of the interface the socket is bound to, e.g. with
+// SO_BINDTODEVICE, or zero if it is not bound to one.  The index is a host order
+// integer, kept in the little endian encoding, so it is Interface byte swapped.
+func (id *LinuxSockID) IfIndex() uint32 {
+	return binary.LittleEndian.Uint32(id.IDiagIf[:])
+}
+
 // SrcIP returns a golang net encoding of source address.
 func (id *LinuxSockID) SrcIP() net.IP {
 	return ip(id.IDiagSrc)
@@ -241,19 +273,19 @@ type MarkCond struct { // inet_diag_markcond
 // InetDiagMsg is the linux binary representation of a InetDiag message header, as in linux/inet_diag.h
 // Note that netlink messages use host byte ordering, unless NLA_F_NET_BYTEORDER flag is present.
 type InetDiagMsg struct {
-	IDiagFamily  uint8 `csv:"IDM.Family"`
-	IDiagState   uint8 `csv:"IDM.State"`
-	IDiagTimer   uint8 `csv:"IDM.Timer"`
-	IDiagRetrans uint8 `csv:"IDM.Retrans"`
+	IDiagFamily  uint8 `csv:"IDM.Family" kernel:"idiag_family"`
+	IDiagState   uint8 `csv:"IDM.State" kernel:"idiag_state"`
+	IDiagTimer   uint8 `csv:"IDM.Timer" kernel:"idiag_timer"`
+	IDiagRetrans uint8 `csv:"IDM.Retrans" kernel:"idiag_retrans"`
 	// The ID is handled separately for both CSV and BigQuery, so they are tagged with "-"
 	// See TCPRow.SockID in tcpinfo repo.
 	// Field also suppressed in json, for use in BQ load exports.
 	ID           LinuxSockID `csv:"-" bigquery:"-" json:"-"`
-	IDiagExpires uint32      `csv:"IDM.Expires"`
-	IDiagRqueue  uint32      `csv:"IDM.Rqueue"`
-	IDiagWqueue  uint32      `csv:"IDM.Wqueue"`
-	IDiagUID     uint32      `csv:"IDM.UID"`
-	IDiagInode   uint32      `csv:"IDM.Inode"`
+	IDiagExpires uint32      `csv:"IDM.Expires" units:"ms" kernel:"idiag_expires"`
+	IDiagRqueue  uint32      `csv:"IDM.Rqueue" units:"bytes" kernel:"idiag_rqueue"`
+	IDiagWqueue  uint32      `csv:"IDM.Wqueue" units:"bytes" kernel:"idiag_wqueue"`
+	IDiagUID     uint32      `csv:"IDM.UID" kernel:"idiag_uid"`
+	IDiagInode   uint32      `csv:"IDM.Inode" kernel:"idiag_inode"`
 }
 
 const (
@@ -287,6 +319,8 @@ var ErrParseFailed = errors.New("Unable to parse InetDiagMsg")
 
 // Parse returns the InetDiagMsg itself
 // Modified from original to also return attribute data array.
+// With the Unsafe decoder, the InetDiagMsg refers to the raw bytes.  With the
+// others, it is a copy.
 func (raw RawInetDiagMsg) Parse() (*InetDiagMsg, error) {
 	// TODO - why using rtaAlign on InetDiagMsg ???
 
@@ -294,6 +328,9 @@ func (raw RawInetDiagMsg) Parse() (*InetDiagMsg, error) {
 	if len(raw) < align {
 		return nil, ErrParseFailed
 	}
+	if order := CurrentDecoder().ByteOrder(); order != nil {
+		return decodeInetDiagMsg(raw, order), nil
+	}
 	return (*InetDiagMsg)(unsafe.Pointer(&raw[0])), nil
 }
 
@@ -306,23 +343,26 @@ var ErrUnknownAF = errors.New("unknown address family")
 // NOTE: references to the InetDiagMsg are modified in-place. Cached references
 // may change unexpectedly.
 func (raw RawInetDiagMsg) Anonymize(anon anonymize.IPAnonymizer) error {
-	msg, err := raw.Parse()
-	if err != nil {
-		return err
+	if len(raw) < rtaAlignOf(int(unsafe.Sizeof(InetDiagMsg{}))) {
+		return ErrParseFailed
 	}
+	// The addresses are modified through the raw bytes, rather than a parsed
+	// InetDiagMsg, which may be a copy.
+	src := raw[idmSrcOffset : idmSrcOffset+net.IPv6len]
+	dst := raw[idmDstOffset : idmDstOffset+net.IPv6len]
 	// IDiagSrc and IDiagDst addresses encode IPv4 addresses in the first 4 bytes
 	// of a 16 byte array. Unfortunately the net.IP package expects IPv4 addresses
 	// to be encoded in the last 4 bytes of a 16 byte array. As a result, we must
 	// pass only 4 bytes to net.IP for AF_INET.
-	switch msg.IDiagFamily {
+	switch family := raw[0]; family {
 	case AF_INET6:
-		anon.IP(net.IP(msg.ID.IDiagSrc[:]))
-		anon.IP(net.IP(msg.ID.IDiagDst[:]))
+		anon.IP(net.IP(src))
+		anon.IP(net.IP(dst))
 	case AF_INET:
-		anon.IP(net.IP(msg.ID.IDiagSrc[:4]))
-		anon.IP(net.IP(msg.ID.IDiagDst[:4]))
+		anon.IP(net.IP(src[:net.IPv4len]))
+		anon.IP(net.IP(dst[:net.IPv4len]))
 	default:
-		log.Println(ErrUnknownAF, msg.IDiagFamily)
+		log.Println(ErrUnknownAF, family)
 		return ErrUnknownAF
 	}
 	return nil
@@ -332,52 +372,52 @@ func (raw RawInetDiagMsg) Anonymize(anon anonymize.IPAnonymizer) error {
 // Haven't found a corresponding linux struct, but the message is described
 // in https://manpages.debian.org/stretch/manpages/sock_diag.7.en.html
 type SocketMemInfo struct {
-	RmemAlloc  uint32 `csv:"SKMemInfo.RmemAlloc"`
-	Rcvbuf     uint32 `csv:"SKMemInfo.Rcvbuf"`
-	WmemAlloc  uint32 `csv:"SKMemInfo.WmemAlloc"`
-	Sndbuf     uint32 `csv:"SKMemInfo.Sndbug"`
-	FwdAlloc   uint32 `csv:"SKMemInfo.FwdAlloc"`
-	WmemQueued uint32 `csv:"SKMemInfo.WmemQueued"`
-	Optmem     uint32 `csv:"SKMemInfo.Optmem"`
-	Backlog    uint32 `csv:"SKMemInfo.Backlog"`
-	Drops      uint32 `csv:"SKMemInfo.Drops"`
+	RmemAlloc  uint32 `csv:"SKMemInfo.RmemAlloc" units:"bytes" kernel:"SK_MEMINFO_RMEM_ALLOC"`
+	Rcvbuf     uint32 `csv:"SKMemInfo.Rcvbuf" units:"bytes" kernel:"SK_MEMINFO_RCVBUF"`
+	WmemAlloc  uint32 `csv:"SKMemInfo.WmemAlloc" units:"bytes" kernel:"SK_MEMINFO_WMEM_ALLOC"`
+	Sndbuf     uint32 `csv:"SKMemInfo.Sndbug" units:"bytes" kernel:"SK_MEMINFO_SNDBUF"`
+	FwdAlloc   uint32 `csv:"SKMemInfo.FwdAlloc" units:"bytes" kernel:"SK_MEMINFO_FWD_ALLOC"`
+	WmemQueued uint32 `csv:"SKMemInfo.WmemQueued" units:"bytes" kernel:"SK_MEMINFO_WMEM_QUEUED"`
+	Optmem     uint32 `csv:"SKMemInfo.Optmem" units:"bytes" kernel:"SK_MEMINFO_OPTMEM"`
+	Backlog    uint32 `csv:"SKMemInfo.Backlog" units:"packets" kernel:"SK_MEMINFO_BACKLOG"`
+	Drops      uint32 `csv:"SKMemInfo.Drops" units:"packets" kernel:"SK_MEMINFO_DROPS"`
 }
 
 // MemInfo implements the struct associated with INET_DIAG_MEMINFO, corresponding with
 // linux struct inet_diag_meminfo in uapi/linux/inet_diag.h.
 type MemInfo struct {
-	Rmem uint32 `csv:"MemInfo.Rmem"`
-	Wmem uint32 `csv:"MemInfo.Wmem"`
-	Fmem uint32 `csv:"MemInfo.Fmem"`
-	Tmem uint32 `csv:"MemInfo.Tmem"`
+	Rmem uint32 `csv:"MemInfo.Rmem" units:"bytes" kernel:"idiag_rmem"`
+	Wmem uint32 `csv:"MemInfo.Wmem" units:"bytes" kernel:"idiag_wmem"`
+	Fmem uint32 `csv:"MemInfo.Fmem" units:"bytes" kernel:"idiag_fmem"`
+	Tmem uint32 `csv:"MemInfo.Tmem" units:"bytes" kernel:"idiag_tmem"`
 }
 
 // VegasInfo implements the struct associated with INET_DIAG_VEGASINFO, corresponding with
 // linux struct tcpvegas_info in uapi/linux/inet_diag.h.
 type VegasInfo struct {
-	Enabled  uint32 `csv:"Vegas.Enabled"`
-	RTTCount uint32 `csv:"Vegas.RTTCount"`
-	RTT      uint32 `csv:"Vegas.RTT"`
-	MinRTT   uint32 `csv:"Vegas.MinRTT"`
+	Enabled  uint32 `csv:"Vegas.Enabled" kernel:"tcpv_enabled"`
+	RTTCount uint32 `csv:"Vegas.RTTCount" kernel:"tcpv_rttcnt"`
+	RTT      uint32 `csv:"Vegas.RTT" units:"us" kernel:"tcpv_rtt"`
+	MinRTT   uint32 `csv:"Vegas.MinRTT" units:"us" kernel:"tcpv_minrtt"`
 }
 
 // DCTCPInfo implements the struct associated with INET_DIAG_DCTCPINFO attribute, corresponding with
 // linux struct tcp_dctcp_info in uapi/linux/inet_diag.h.
 type DCTCPInfo struct {
-	Enabled uint16 `csv:"DCTCP.Enabled"`
-	CEState uint16 `csv:"DCTCP.CEState"`
-	Alpha   uint32 `csv:"DCTCP.Alpha"`
-	ABEcn   uint32 `csv:"DCTCP.ABEcn"`
-	ABTot   uint32 `csv:"DCTCP.ABTot"`
+	Enabled uint16 `csv:"DCTCP.Enabled" kernel:"dctcp_enabled"`            // Zero if the connection fell back to Reno, without ECN
+	CEState uint16 `csv:"DCTCP.CEState" kernel:"dctcp_ce_state"`           // Whether the last packet received was CE marked
+	Alpha   uint32 `csv:"DCTCP.Alpha" units:"1/1024" kernel:"dctcp_alpha"` // Fraction of bytes marked, scaled by 1024
+	ABEcn   uint32 `csv:"DCTCP.ABEcn" units:"bytes" kernel:"dctcp_ab_ecn"` // Bytes acked with ECE, in the current observation window
+	ABTot   uint32 `csv:"DCTCP.ABTot" units:"bytes" kernel:"dctcp_ab_tot"` // Bytes acked, in the current observation window
 }
 
 // BBRInfo implements the struct associated with INET_DIAG_BBRINFO attribute, corresponding with
 // linux struct tcp_bbr_info in uapi/linux/inet_diag.h.
 type BBRInfo struct {
-	BW         int64  `csv:"BBR.BW"`         // Max-filtered BW (app throughput) estimate in bytes/second
-	MinRTT     uint32 `csv:"BBR.MinRTT"`     // Min-filtered RTT in uSec
-	PacingGain uint32 `csv:"BBR.PacingGain"` // Pacing gain shifted left 8 bits
-	CwndGain   uint32 `csv:"BBR.CwndGain"`   // Cwnd gain shifted left 8 bits
+	BW         int64  `csv:"BBR.BW" units:"bytes/s" kernel:"bbr_bw_lo,bbr_bw_hi"`   // Max-filtered BW (app throughput) estimate in bytes/second
+	MinRTT     uint32 `csv:"BBR.MinRTT" units:"us" kernel:"bbr_min_rtt"`            // Min-filtered RTT in uSec
+	PacingGain uint32 `csv:"BBR.PacingGain" units:"1/256" kernel:"bbr_pacing_gain"` // Pacing gain shifted left 8 bits
+	CwndGain   uint32 `csv:"BBR.CwndGain" units:"1/256" kernel:"bbr_cwnd_gain"`     // Cwnd gain shifted left 8 bits
 }
 
 // LOCALS and PEERS contain an array of sockaddr_storage elements.
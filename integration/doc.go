@@ -0,0 +1,10 @@
+// Package integration contains end to end tests of the collector and saver, which
+// generate real TCP traffic between two network namespaces, connected by a veth
+// pair, and check the connection files that are recorded.
+//
+// The tests create namespaces and qdiscs, so they need root, or CAP_NET_ADMIN and
+// CAP_SYS_ADMIN, and the ip and tc commands.  They only build with the integration
+// tag, on linux:
+//
+//	sudo go test -tags=integration ./integration
+package integration
@@ -0,0 +1,286 @@
+//go:build integration && linux
+// +build integration,linux
+
+package integration_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+const (
+	clientAddr = "10.213.0.1"
+	serverAddr = "10.213.0.2"
+	serverPort = 4000
+	rate       = 2 << 20 // Bytes per second the client may send, i.e. 16Mbit/s.
+	transfer   = 2 << 20 // Bytes sent by the client.
+)
+
+var serverEndpoint = net.JoinHostPort(serverAddr, fmt.Sprint(serverPort))
+
+// topology is a pair of network namespaces, connected by a veth pair.
+type topology struct {
+	client, server string // The namespace names.
+}
+
+func run(t *testing.T, name string, args ...string) {
+	t.Helper()
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %v failed: %v\n%s", name, args, err, out)
+	}
+}
+
+// newTopology creates the namespaces, which are deleted when the test ends.  The
+// client's side of the veth pair is shaped to the rate.
+func newTopology(t *testing.T) *topology {
+	if os.Geteuid() != 0 {
+		t.Skip("Creating network namespaces requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("The ip command is not available")
+	}
+	if _, err := exec.LookPath("tc"); err != nil {
+		t.Skip("The tc command is not available")
+	}
+	id := os.Getpid()
+	topo := &topology{
+		client: fmt.Sprintf("tcpinfo-client-%d", id),
+		server: fmt.Sprintf("tcpinfo-server-%d", id),
+	}
+	// Interface names are limited to 15 characters.
+	clientLink, serverLink := fmt.Sprintf("ti-c-%d", id), fmt.Sprintf("ti-s-%d", id)
+
+	run(t, "ip", "netns", "add", topo.client)
+	t.Cleanup(func() { exec.Command("ip", "netns", "del", topo.client).Run() })
+	run(t, "ip", "netns", "add", topo.server)
+	t.Cleanup(func() { exec.Command("ip", "netns", "del", topo.server).Run() })
+
+	run(t, "ip", "link", "add", clientLink, "type", "veth", "peer", "name", serverLink)
+	run(t, "ip", "link", "set", clientLink, "netns", topo.client)
+	run(t, "ip", "link", "set", serverLink, "netns", topo.server)
+	for _, c := range []struct{ ns, link, addr string }{
+		{topo.client, clientLink, clientAddr},
+		{topo.server, serverLink, serverAddr},
+	} {
+		run(t, "ip", "-n", c.ns, "addr", "add", c.addr+"/24", "dev", c.link)
+		run(t, "ip", "-n", c.ns, "link", "set", c.link, "up")
+		run(t, "ip", "-n", c.ns, "link", "set", "lo", "up")
+	}
+	run(t, "ip", "netns", "exec", topo.client, "tc", "qdisc", "add", "dev", clientLink,
+		"root", "tbf", "rate", fmt.Sprintf("%dbit", rate*8), "burst", "32kb", "latency", "100ms")
+	return topo
+}
+
+// inNetns calls f on an OS thread in the namespace, and returns when f does.
+// Sockets stay in the namespace in which they were created, so they may be used
+// from any goroutine once f has created them.  The thread is not reused, as it is
+// still locked when its goroutine exits.
+func inNetns(t *testing.T, ns string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		fd, err := unix.Open("/var/run/netns/"+ns, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			t.Error("Could not open namespace", ns, err)
+			return
+		}
+		defer unix.Close(fd)
+		if err := unix.Setns(fd, unix.CLONE_NEWNET); err != nil {
+			t.Error("Could not enter namespace", ns, err)
+			return
+		}
+		f()
+	}()
+	<-done
+}
+
+type nullCacheLogger struct{}
+
+func (nullCacheLogger) LogCacheStats(_, _ int) {}
+
+// loadConnections returns the snapshots in each of the connection files, but not
+// the index files.
+func loadConnections(t *testing.T) map[string][]*snapshot.Snapshot {
+	names, err := filepath.Glob("*/*/*/*.[0-9][0-9][0-9][0-9][0-9].jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	conns := make(map[string][]*snapshot.Snapshot)
+	for _, name := range names {
+		rdr, err := zstd.NewInProcessReader(name)
+		rtx.Must(err, "Could not open %s", name)
+		_, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+		rdr.Close()
+		if err != nil && err != io.EOF {
+			t.Fatal("Could not load", name, err)
+		}
+		// The header record has only Metadata.
+		for _, s := range snaps {
+			if s.InetDiagMsg != nil {
+				conns[name] = append(conns[name], s)
+			}
+		}
+	}
+	return conns
+}
+
+func TestCollector(t *testing.T) {
+	topo := newTopology(t)
+
+	dir, err := ioutil.TempDir("", "tcp-info_integration")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.InProcessCompression = true
+	svrChan := make(chan netlink.MessageBlock, 100)
+	go svr.MessageSaverLoop(svrChan)
+
+	// The collector polls the client's namespace until the connection is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Only the test connection is recorded.
+	c := &collector.Collector{
+		Output: svrChan,
+		Filter: &collector.FilterConfig{RemotePorts: []collector.PortRange{{First: serverPort, Last: serverPort}}},
+		Logger: nullCacheLogger{},
+	}
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		inNetns(t, topo.client, func() {
+			c.Run(ctx)
+		})
+	}()
+
+	var listener net.Listener
+	inNetns(t, topo.server, func() {
+		listener, err = net.Listen("tcp", serverEndpoint)
+	})
+	rtx.Must(err, "Could not listen in %s", topo.server)
+	defer listener.Close()
+	// The server reads until the client shuts down its side, and closes its own side
+	// when hangup is closed.
+	received := make(chan int64)
+	hangup := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error("Could not accept", err)
+			received <- 0
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+		<-hangup
+	}()
+
+	var conn net.Conn
+	inNetns(t, topo.client, func() {
+		conn, err = net.Dial("tcp", serverEndpoint)
+	})
+	rtx.Must(err, "Could not connect from %s", topo.client)
+	start := time.Now()
+	_, err = conn.Write(make([]byte, transfer))
+	rtx.Must(err, "Could not send")
+	rtx.Must(conn.(*net.TCPConn).CloseWrite(), "Could not shut down")
+	if n := <-received; n != transfer {
+		t.Errorf("Server received %d bytes, want %d", n, transfer)
+	}
+	// The shaping allows a burst, so the transfer may be slightly faster than the rate.
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond*transfer/rate {
+		t.Errorf("Transfer took %v, which is faster than the shaped rate", elapsed)
+	}
+
+	// Give the collector time to see the half closed connection, once all the data
+	// is acknowledged, and then to see it close, and disappear.
+	time.Sleep(100 * time.Millisecond)
+	close(hangup)
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Error("Expected EOF from the server, got", err)
+	}
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-collected
+	close(svrChan)
+	svr.Done.Wait()
+
+	conns := loadConnections(t)
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection file, got %d: %v", len(conns), conns)
+	}
+	for name, snaps := range conns {
+		if len(snaps) < 2 {
+			t.Fatalf("%s: expected several snapshots, got %d", name, len(snaps))
+		}
+		first, last := snaps[0], snaps[len(snaps)-1]
+		id := &first.InetDiagMsg.ID
+		if id.DstIP().String() != serverAddr || id.DPort() != serverPort {
+			t.Errorf("%s: remote is %s:%d, want %s:%d", name, id.DstIP(), id.DPort(), serverAddr, serverPort)
+		}
+		if id.SrcIP().String() != clientAddr {
+			t.Errorf("%s: local address is %s, want %s", name, id.SrcIP(), clientAddr)
+		}
+		if state := tcp.State(first.InetDiagMsg.IDiagState); state != tcp.ESTABLISHED {
+			t.Errorf("%s: first state is %s, want ESTABLISHED", name, state)
+		}
+		if state := tcp.State(last.InetDiagMsg.IDiagState); state == tcp.ESTABLISHED {
+			t.Errorf("%s: final snapshot is still ESTABLISHED", name)
+		}
+
+		// The snapshots follow the transfer, at about the shaped rate.
+		var acked int64
+		var from *snapshot.Snapshot
+		for _, s := range snaps {
+			if s.TCPInfo == nil {
+				continue
+			}
+			if s.TCPInfo.BytesAcked < acked {
+				t.Errorf("%s: BytesAcked decreased from %d to %d", name, acked, s.TCPInfo.BytesAcked)
+			}
+			acked = s.TCPInfo.BytesAcked
+			if from == nil && acked > 0 {
+				from = s
+			}
+			if from != nil && acked < transfer && s.Timestamp.Sub(from.Timestamp) > 100*time.Millisecond {
+				elapsed := s.Timestamp.Sub(from.Timestamp).Seconds()
+				if r := float64(acked-from.TCPInfo.BytesAcked) / elapsed; r > 1.5*rate {
+					t.Errorf("%s: %.0f bytes per second were acknowledged, want at most about %d", name, r, rate)
+				}
+			}
+		}
+		if acked < transfer {
+			t.Errorf("%s: BytesAcked is %d, want at least %d", name, acked, transfer)
+		}
+	}
+}
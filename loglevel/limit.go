@@ -0,0 +1,108 @@
+package loglevel
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// Categories of high volume messages, each with its own budget.
+const (
+	Connection = "connection" // Connection lifecycle events, e.g. new and closed connections.
+	Skip       = "skip"       // Messages and connections that are skipped.
+	Failure    = "error"      // Errors processing individual messages or connections.
+)
+
+// DefaultBudget is the number of messages per second allowed in a category that
+// has no budget set.
+const DefaultBudget = 10
+
+// budget is a token bucket limiting the messages in a category.  The bucket
+// holds up to one second of messages.
+type budget struct {
+	perSecond  float64
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+var (
+	budgetLock sync.Mutex
+	budgets    = map[string]*budget{}
+)
+
+func getBudget(category string) *budget {
+	b, ok := budgets[category]
+	if !ok {
+		b = &budget{perSecond: DefaultBudget, tokens: DefaultBudget}
+		budgets[category] = b
+	}
+	return b
+}
+
+// SetBudget sets the number of messages per second logged in category.  Zero
+// suppresses all messages in the category, and +Inf removes the limit.
+func SetBudget(category string, perSecond float64) {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	b := getBudget(category)
+	b.perSecond = perSecond
+	b.tokens = math.Min(b.tokens, perSecond)
+}
+
+// Budgets returns the current budgets of all categories that have been used or set.
+func Budgets() map[string]float64 {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	result := make(map[string]float64, len(budgets))
+	for c, b := range budgets {
+		result[c] = b.perSecond
+	}
+	return result
+}
+
+// allow returns whether a message in category may be logged now, and how many
+// messages were suppressed since the last one that was logged.
+func allow(category string, now time.Time) (bool, int) {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	b := getBudget(category)
+	if math.IsInf(b.perSecond, 1) {
+		return true, 0
+	}
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.perSecond, b.tokens+now.Sub(b.last).Seconds()*b.perSecond)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		b.suppressed++
+		metrics.SuppressedLogCount.WithLabelValues(category).Inc()
+		return false, 0
+	}
+	b.tokens--
+	suppressed := b.suppressed
+	b.suppressed = 0
+	return true, suppressed
+}
+
+// Limitedln logs the arguments like Println, if level l is enabled, and the
+// category is within its budget.  Messages over budget are counted, and the count
+// is reported with the next message that is logged in the category.
+func Limitedln(l Level, category string, v ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	ok, suppressed := allow(category, time.Now())
+	if !ok {
+		return
+	}
+	msg := fmt.Sprintln(v...)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("(%d %s messages suppressed) %s", suppressed, category, msg)
+	}
+	log.Output(2, msg)
+}
@@ -0,0 +1,54 @@
+package loglevel_test
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/loglevel"
+)
+
+func TestLimitedln(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	loglevel.SetBudget("test", 3)
+	for i := 0; i < 10; i++ {
+		loglevel.Limitedln(loglevel.Info, "test", "message", i)
+	}
+	if n := strings.Count(buf.String(), "message"); n != 3 {
+		t.Error("Expected 3 messages within budget, got", n, buf.String())
+	}
+
+	// After the budget is replenished, the suppressed count is reported.
+	time.Sleep(400 * time.Millisecond)
+	buf.Reset()
+	loglevel.Limitedln(loglevel.Info, "test", "message", 10)
+	if !strings.Contains(buf.String(), "(7 test messages suppressed) message 10") {
+		t.Error("Expected suppressed count, got", buf.String())
+	}
+
+	// Disabled levels are not logged, or counted.
+	buf.Reset()
+	loglevel.Limitedln(loglevel.Debug, "test", "debug")
+	if buf.Len() != 0 {
+		t.Error("Debug message should not be logged", buf.String())
+	}
+
+	loglevel.SetBudget("test", math.Inf(1))
+	buf.Reset()
+	for i := 0; i < 100; i++ {
+		loglevel.Limitedln(loglevel.Info, "test", "message", i)
+	}
+	if n := strings.Count(buf.String(), "message"); n != 100 {
+		t.Error("Expected all messages without limit, got", n)
+	}
+	if loglevel.Budgets()["test"] != math.Inf(1) {
+		t.Error("Wrong budgets", loglevel.Budgets())
+	}
+}
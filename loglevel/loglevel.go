@@ -0,0 +1,80 @@
+// Package loglevel provides a process wide logging verbosity that can be
+// changed at runtime, e.g. through the admin API.
+package loglevel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is a logging verbosity level.  Messages are logged if their level is
+// less than or equal to the current level.
+type Level int32
+
+// The supported levels.
+const (
+	Error Level = iota // Only errors.
+	Info               // Errors and connection lifecycle events.  This is the default.
+	Debug              // Everything.
+)
+
+// ErrUnknownLevel is returned when parsing an unrecognized level name.
+var ErrUnknownLevel = errors.New("unknown log level")
+
+var levelName = map[Level]string{
+	Error: "error",
+	Info:  "info",
+	Debug: "debug",
+}
+
+func (l Level) String() string {
+	s, ok := levelName[l]
+	if !ok {
+		return fmt.Sprintf("level%d", l)
+	}
+	return s
+}
+
+// Parse converts a level name into a Level.
+func Parse(name string) (Level, error) {
+	for l, s := range levelName {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return Error, ErrUnknownLevel
+}
+
+var current = int32(Info)
+
+// Set changes the current level.
+func Set(l Level) {
+	atomic.StoreInt32(&current, int32(l))
+}
+
+// Get returns the current level.
+func Get() Level {
+	return Level(atomic.LoadInt32(&current))
+}
+
+// Enabled returns true if messages at level l should be logged.
+func Enabled(l Level) bool {
+	return l <= Get()
+}
+
+// Println logs the arguments with log.Println if level l is enabled.
+func Println(l Level, v ...interface{}) {
+	if Enabled(l) {
+		log.Output(2, fmt.Sprintln(v...))
+	}
+}
+
+// Printf logs the arguments with log.Printf if level l is enabled.
+func Printf(l Level, format string, v ...interface{}) {
+	if Enabled(l) {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
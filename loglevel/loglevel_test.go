@@ -0,0 +1,35 @@
+package loglevel_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/logx"
+	"github.com/m-lab/tcp-info/loglevel"
+)
+
+func TestLevels(t *testing.T) {
+	defer loglevel.Set(loglevel.Info)
+	for _, name := range []string{"error", "INFO", "Debug"} {
+		l, err := loglevel.Parse(name)
+		if err != nil || !strings.EqualFold(l.String(), name) {
+			t.Error("Could not parse", name, l, err)
+		}
+	}
+	if _, err := loglevel.Parse("verbose"); err != loglevel.ErrUnknownLevel {
+		t.Error("Should not parse unknown level")
+	}
+
+	loglevel.Set(loglevel.Error)
+	out, _ := logx.CaptureLog(nil, func() {
+		loglevel.Println(loglevel.Info, "hidden")
+		loglevel.Printf(loglevel.Error, "shown %d", 1)
+	})
+	if strings.Contains(out, "hidden") || !strings.Contains(out, "shown 1") {
+		t.Error("Wrong output", out)
+	}
+	loglevel.Set(loglevel.Debug)
+	if !loglevel.Enabled(loglevel.Debug) {
+		t.Error("Debug should be enabled")
+	}
+}
@@ -4,16 +4,28 @@ package main
 // sudo ss -timep | grep -A1 -v -e 127.0.0.1 -e skmem | tail
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"runtime"
 	"runtime/trace"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/m-lab/tcp-info/eventsocket"
 
 	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
 
@@ -21,9 +33,23 @@ import (
 
 	_ "net/http/pprof" // Support profiling
 
+	"github.com/m-lab/tcp-info/admin"
+	"github.com/m-lab/tcp-info/anonymizer"
+	"github.com/m-lab/tcp-info/bootinfo"
+	"github.com/m-lab/tcp-info/browse"
 	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/config"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/loglevel"
+	"github.com/m-lab/tcp-info/manifest"
+	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/pipeline"
+	"github.com/m-lab/tcp-info/recovery"
+	"github.com/m-lab/tcp-info/remotewrite"
 	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/zstd"
 )
 
 /*
@@ -54,6 +80,25 @@ flat  flat%   sum%        cum   cum%
 func init() {
 	// Always prepend the filename and line number.
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Var(&logBudgets, "log.budget", "Messages per second logged in a category, e.g. connection=10,skip=1,error=5.  May be repeated.")
+	flag.Var(&remoteWriteLabels, "remote-write.label", "Label added to every series written with -remote-write.url, e.g. instance=mlab1.lga03.  May be repeated.")
+	flag.Var(&natsEncodings, "nats.encoding", "Compression offered to the NATS receivers for the records, \"snappy\" or \"lz4\", in order of preference.  Records are not compressed if no receiver supports one.  May be repeated, or comma separated.")
+	flag.Var(&recordOwners, "record-owner", "Record only connections with this owner, from the -owners mapping.  May be repeated, or comma separated.")
+	flag.Var(&srcAllow, "cidr.src-allow", "Record only connections whose local address is in this network, e.g. 192.0.2.0/24.  May be repeated, or comma separated.")
+	flag.Var(&srcDeny, "cidr.src-deny", "Do not record connections whose local address is in this network.  May be repeated, or comma separated.")
+	flag.Var(&dstAllow, "cidr.dst-allow", "Record only connections whose remote address is in this network.  May be repeated, or comma separated.")
+	flag.Var(&dstDeny, "cidr.dst-deny", "Do not record connections whose remote address is in this network.  May be repeated, or comma separated.")
+	flag.Var(&highOwners, "priority.high-owner", "Give connections with this owner high priority, so that their snapshots are not dropped when the saver falls behind.  May be repeated, or comma separated.")
+	flag.Var(&lowOwners, "priority.low-owner", "Give connections with this owner low priority, so that their snapshots are dropped first when the saver falls behind.  May be repeated, or comma separated.")
+	flag.Var(&sockOptOwners, "sockopt.owner", "Record the socket options reported through -tcpinfo.eventsocket by the applications of connections with this owner.  May be repeated, or comma separated.")
+	flag.Var(&localPorts, "filter.local-port", "Collect only sockets whose local port is this port, or in this range, e.g. 443 or 9000-9100.  May be repeated, or comma separated.")
+	flag.Var(&remotePorts, "filter.remote-port", "Collect only sockets whose remote port is this port, or in this range.  May be repeated, or comma separated.")
+	flag.Var(&filterUIDs, "filter.uid", "Collect only sockets owned by this UID.  May be repeated, or comma separated.")
+	flag.Var(&filterInodes, "filter.inode", "Collect only the socket with this inode number.  May be repeated, or comma separated.")
+	flag.Var(&filterIfaces, "filter.interface", "Collect only sockets bound to this interface, given by name, e.g. eth0, or index.  May be repeated, or comma separated.")
+	flag.Var(&allowAttrs, "attribute.allow", "Record only this inet_diag attribute, e.g. TCPInfo, in the connection files.  May be repeated, or comma separated.  TCPInfo is always required.")
+	flag.Var(&denyAttrs, "attribute.deny", "Drop this inet_diag attribute, e.g. SKMemInfo, from the connection files.  May be repeated, or comma separated.")
+	flag.Var(&decoder, "netlink.decoder", "Decoding of the netlink messages and attributes: \"unsafe\", which maps the structs onto the bytes, or, field by field, \"native\", \"little-endian\" or \"big-endian\", e.g. to browse files saved on hosts of another byte order.")
 }
 
 // NOTES:
@@ -63,21 +108,297 @@ func init() {
 
 var (
 	reps        = flag.Int("reps", 0, "How many cycles should be recorded, 0 means continuous")
+	pollIntvl   = flag.Duration("poll-interval", collector.DefaultInterval, "Time between polls of the netlink socket.")
+	pollPipe    = flag.Int("poll-pipeline", 0, "Number of the netlink dumps of a poll that may be received ahead of the one being filtered.  Zero receives and filters each dump in turn.")
 	enableTrace = flag.Bool("trace", false, "Enable trace")
 	outputDir   = flag.String("output", "", "Directory in which to put the resulting tree of data.  Default is the current directory.")
+	machine     = flag.String("machine", "", "Name of this machine, recorded in file metadata and paths, e.g. mlab1.")
+	site        = flag.String("site", "", "Name of the site, recorded in file metadata and paths, e.g. lga03.")
+	experiment  = flag.String("experiment", "", "Name of the experiment, recorded in file metadata and paths, e.g. ndt.")
+	checkpoint  = flag.String("checkpoint", "", "File in which to persist connection file sequence numbers across restarts.")
+	reconcile   = flag.Duration("reconcile-interval", time.Minute, "How often to reconcile open connection files with the connection cache.  Zero disables reconciliation.")
+	hostSketch  = flag.Duration("host-sketch-interval", 0, "How often to write the sketches of the RTT and delivery rate of all connections to the daily host sketch files.  Zero disables the files, but the quantiles are still exported as metrics.")
+	hostCounter = flag.Bool("host-counters", false, "Read the host-wide TCP counters of /proc/net/snmp and /proc/net/netstat, e.g. RetransSegs and ListenDrops, once per poll, and write them to the daily host counter files whenever they change.")
+	queueDepth  = flag.Int("marshal.queue-depth", saver.DefaultQueueDepth, "Capacity of each marshalling queue.  Deeper queues absorb longer writer stalls, e.g. of a slow disk, before the polling is delayed.")
+	dropFull    = flag.Bool("marshal.drop-when-full", false, "Drop the snapshots that would wait for room in a full marshalling queue, instead of delaying the polling.  The first, final and state change snapshots are never dropped.  The drops are counted by tcpinfo_marshal_dropped_total.")
+	batchSize   = flag.Int("batch-size", 32*1024, "Bytes of records buffered per connection before writing to the compressor.  Zero disables batching.")
+	batchDelay  = flag.Duration("batch-delay", time.Second, "Maximum time records are buffered before writing to the compressor.")
+	inProcess   = flag.Bool("in-process-compression", false, "Compress files in process, instead of with an external zstd process per file.")
+	outTemplate = flag.String("output-template", saver.IdentityNameTemplate, "Template of the connection file names under -output, with the tokens {experiment}, {pod}, {host}, {uuid}, {seq}, {date}, {timestamp} and {format}.  It must include {uuid} and {seq}, and the names should end in .{seq} for the command line tools.  The protocol suffix and extension, e.g. .jsonl.zst, are appended.")
+	outFormat   = flag.String("output-format", saver.JSONL, "Format of the connection files, \"jsonl\", \"framed\", i.e. length-delimited nl-proto messages of the parsed snapshots, \"csv\", i.e. rows of selected TCPInfo fields, or \"parquet\", i.e. rows of the InetDiagMsg and TCPInfo.")
+	frameSize   = flag.Int("compression-frame-size", zstd.DefaultFrameSize, "Bytes buffered by each in-process compressor.  Buffered data is written when the buffer fills, or the file is closed.")
+	fileAge     = flag.Duration("file-age-limit", 10*time.Minute, "Age after which a connection continues in a new file.  Zero disables age based rotation.")
+	maxFileSize = flag.Int64("max-file-size", 0, "Uncompressed bytes after which a connection continues in a new file.  Zero disables size based rotation.")
+	deltaIntvl  = flag.Int("delta-interval", 0, "Write every Nth snapshot of each connection file in full, and those in between as changes from the previous snapshot.  Zero or one writes all snapshots in full.")
+	colBlock    = flag.Int("column-block", 0, "Buffer N snapshots of each connection, and write them together as a columnar block, which compresses better.  Zero or one writes each snapshot as it is taken.")
+	minSnaps    = flag.Int("min-snapshots", 0, "Minimum number of snapshots for a connection to be written to its own file.")
+	minDuration = flag.Duration("min-duration", 0, "Minimum duration of a connection for it to be written to its own file.")
+	shortFlows  = flag.Bool("short-flow-rollup", false, "Record connections with fewer than -min-snapshots snapshots, or shorter than -min-duration, in daily short flow rollup files, instead of discarding them.")
+	shortSample = flag.Float64("short-flow-sampling", 0, "Fraction of the connections with fewer than -min-snapshots snapshots, or shorter than -min-duration, that are written to their own files when they end, instead of being rolled up or discarded.")
+	graceCycles = flag.Int("expiry-grace-cycles", 0, "Number of consecutive polling cycles a connection may be missing before it is considered closed.")
+	idleCycles  = flag.Int("idle-cycles", 0, "Number of consecutive polling cycles without a significant change after which a connection is polled only every -idle-interval cycles.  Zero polls all connections every cycle.")
+	idleIntvl   = flag.Int("idle-interval", 10, "Number of polling cycles between the snapshots processed for an idle connection.")
+	udp         = flag.Bool("udp", false, "Also record UDP and UDP-Lite sockets, in files with .udp and .udplite suffixes, e.g. <uuid>.00000.udp.jsonl.zst.")
+	mptcp       = flag.Bool("mptcp", false, "Also record MPTCP connections, in files with the .mptcp suffix.  Their TCP subflows are recorded as TCP connections, and share the MPTCPToken of their metadata.")
+	strict      = flag.Bool("strict", false, "Exit on anomalies in the netlink messages, e.g. attribute types beyond those kept, repeated attributes, messages too short to parse, and sockets without a cookie, with a hex dump of the message, instead of logging and skipping them.  For development and CI.")
+	diagDir     = flag.String("diagnostics.dir", "", "Directory to which the netlink messages that cannot be parsed are written, with the polling cycle, timestamp and kernel release, to reproduce the failures offline.  Disabled if empty.")
+	diagFiles   = flag.Int("diagnostics.max-files", saver.DefaultMaxDiagnostics, "Number of files kept in -diagnostics.dir, of which the oldest are removed.")
+	unknownMsgs = flag.Bool("diagnostics.unknown-types", false, "Pass the netlink messages of types other than SOCK_DIAG_BY_FAMILY to the saver, which logs them, and writes them to -diagnostics.dir, instead of dropping them.")
+
+	configFile     = flag.String("config.file", "", "JSON configuration file, e.g. a mounted ConfigMap, that is periodically reloaded.")
+	configMetadata = flag.String("config.metadata", "", "Name of a GCE instance metadata attribute holding the JSON configuration.")
+	configInterval = flag.Duration("config.interval", 5*time.Minute, "How often to reload the configuration.")
+
+	anonMethod   = flag.String("anonymize.method", "", "Anonymization of the recorded addresses: \"none\", \"netblock\", \"truncate\" (IPv4 /24 and IPv6 /48) or \"hmac\" (pseudonyms with a rotating key).  Overrides -anonymize.ip if set.")
+	anonKeyFile  = flag.String("anonymize.key-file", "", "File holding the secret from which the hmac keys are derived.  If empty, random keys are used, so pseudonyms are only consistent within each key rotation period.")
+	anonRotation = flag.Duration("anonymize.rotation", anonymizer.DefaultRotation, "Period of the hmac keys.")
+
+	elephantBytes = flag.Uint64("elephant.bytes", 0, "Bytes sent and received after which a connection is an elephant flow, whose every snapshot is recorded, with all attributes.  Zero disables the byte threshold.")
+	elephantRate  = flag.Float64("elephant.rate", 0, "Average bytes sent and received per second above which a connection is an elephant flow.  Zero disables the rate threshold.")
+
+	adminAddress = flag.String("admin.listen-address", "", "Address for the admin API.  The admin API is disabled if empty.")
+	adminToken   = flag.String("admin.token", "", "Bearer token required by the admin API.")
+
+	grafanaAddress = flag.String("grafana.listen-address", "", "Address of the Grafana simple JSON datasource, which serves the time series of recent and archived connections.  Disabled if empty.")
+	grafanaBuffer  = flag.Int("grafana.snapshots", pipeline.DefaultGrafanaBuffer, "Number of recent snapshots of each open connection kept for the Grafana datasource.")
+
+	grpcAddress = flag.String("grpc.listen-address", "", "Address of the gRPC service that streams the new and changed snapshots as they are recorded.  Disabled if empty.")
+	grpcBuffer  = flag.Int("grpc.buffer", pipeline.DefaultWatchBuffer, "Number of messages buffered for each gRPC Watch call.  Messages are dropped for clients that fall further behind.")
+
+	browseAddress = flag.String("browse.listen-address", "localhost:8080", "Address of the web interface served by \"tcp-info browse\".")
+
+	recoveryWindow     = flag.Duration("recovery.window", time.Hour, "At startup, check files modified within this window for incomplete writes, e.g. due to a crash.  Zero disables the scan.")
+	recoveryQuarantine = flag.String("recovery.quarantine", "", "Directory for unrecoverable files found by the startup scan.  If empty, they are renamed with a .corrupt suffix.")
+
+	natsURL        = flag.String("nats.url", "", "URL of a NATS server, to which records are published with JetStream.  Disabled if empty.")
+	natsSubject    = flag.String("nats.subject", pipeline.DefaultNATSSubject, "Prefix of the NATS subjects, which are <prefix>.<type>.<partition>.")
+	natsPartitions = flag.Int("nats.partitions", pipeline.DefaultNATSPartitions, "Number of NATS subjects per record type, over which connections are partitioned by UUID.")
+	natsEncodings  flagx.StringArray
+	natsBuffer     = flag.Int("nats.buffer", pipeline.DefaultNATSBuffer, "Number of records buffered for NATS.  Records are dropped if the buffer is full.")
+
+	pubsubTopic      = flag.String("pubsub.topic", "", "Pub/Sub topic to which records are published, e.g. projects/my-project/topics/tcpinfo.  Disabled if empty.")
+	pubsubEndpoint   = flag.String("pubsub.endpoint", sink.DefaultPubSubSettings.Endpoint, "Pub/Sub API endpoint.  Message ordering requires a regional endpoint, e.g. https://us-east1-pubsub.googleapis.com.")
+	pubsubBatchCount = flag.Int("pubsub.batch-count", sink.DefaultPubSubSettings.CountThreshold, "Maximum records per Pub/Sub publish request, up to 1000.")
+	pubsubBatchBytes = flag.Int("pubsub.batch-bytes", sink.DefaultPubSubSettings.ByteThreshold, "Maximum bytes of records per Pub/Sub publish request.")
+	pubsubBatchDelay = flag.Duration("pubsub.batch-delay", sink.DefaultPubSubSettings.DelayThreshold, "Maximum time a record waits for its Pub/Sub batch to fill.")
+	pubsubEncoding   = flag.String("pubsub.encoding", sink.Identity, "Compression of the Pub/Sub message data, \"identity\", \"snappy\" or \"lz4\".  All subscribers must support it.")
+	pubsubBuffer     = flag.Int("pubsub.buffer", sink.DefaultPubSubSettings.BufferSize, "Number of records buffered for Pub/Sub.  Records are dropped if the buffer is full.")
+
+	gcsBucket    = flag.String("gcs.bucket", "", "Google Cloud Storage bucket to which connection files are uploaded, instead of being written to -output.  Disabled if empty.")
+	gcsPrefix    = flag.String("gcs.prefix", "", "Prefix of the uploaded object names, e.g. tcpinfo/.")
+	gcsEndpoint  = flag.String("gcs.endpoint", sink.DefaultGCSSettings.Endpoint, "Cloud Storage API endpoint.")
+	gcsUploaders = flag.Int("gcs.uploaders", sink.DefaultGCSSettings.Uploaders, "Number of concurrent uploads to Cloud Storage.")
+	gcsBuffer    = flag.Int("gcs.buffer", sink.DefaultGCSSettings.BufferSize, "Number of files waiting for an uploader.  Files are dropped if the buffer is full.")
+	gcsChunk     = flag.Int("gcs.chunk-size", sink.DefaultGCSSettings.ChunkSize, "Compressed bytes buffered for each open file, which are streamed to Cloud Storage in chunks of this size.  Rounded down to a multiple of 256 KiB.")
+
+	summarySyslog  = flag.String("summary.syslog", "", "Syslog server for closed connection summaries, e.g. udp://loghost:514, or \"local\" for the local syslog daemon.  Disabled if empty.")
+	summaryJournal = flag.Bool("summary.journal", false, "Write closed connection summaries to the systemd journal.")
+	summaryBuffer  = flag.Int("summary.buffer", pipeline.DefaultSummaryBuffer, "Number of connection summaries buffered for each of syslog and the journal.  Summaries are dropped if the buffer is full.")
+
+	remoteWriteURL      = flag.String("remote-write.url", "", "Prometheus remote write endpoint to which the aggregate metrics are pushed.  Disabled if empty.")
+	remoteWriteInterval = flag.Duration("remote-write.interval", time.Minute, "How often to push metrics to -remote-write.url.")
+	remoteWriteLabels   flagx.KeyValue
+
+	ownersFile    = flag.String("owners", "", "JSON file mapping UIDs to owner or service names, e.g. {\"1000\": \"ndt-server\"}.")
+	recordOwners  flagx.StringArray
+	srcAllow      flagx.StringArray
+	srcDeny       flagx.StringArray
+	dstAllow      flagx.StringArray
+	dstDeny       flagx.StringArray
+	highOwners    flagx.StringArray
+	lowOwners     flagx.StringArray
+	sockOptOwners flagx.StringArray
+	localPorts    flagx.StringArray
+	remotePorts   flagx.StringArray
+	filterUIDs    flagx.StringArray
+	filterInodes  flagx.StringArray
+	filterIfaces  flagx.StringArray
+	allowAttrs    flagx.StringArray
+	denyAttrs     flagx.StringArray
+	logBudgets    flagx.KeyValue
+	decoder       inetdiag.Decoder
 
 	ctx, cancel = context.WithCancel(context.Background())
 )
 
+// flagPipeline returns the pipeline described by the flags.
+func flagPipeline() *config.Pipeline {
+	spec := &config.Pipeline{
+		Cache: config.Cache{GraceCycles: *graceCycles},
+		Sinks: []config.Sink{{Type: "files"}},
+	}
+	if len(recordOwners) > 0 {
+		spec.Filters = append(spec.Filters, config.Filter{Type: "owner", Owners: recordOwners})
+	}
+	if len(srcAllow) > 0 || len(srcDeny) > 0 {
+		spec.Filters = append(spec.Filters, config.Filter{Type: "cidr", Direction: "source", Allow: srcAllow, Deny: srcDeny})
+	}
+	if len(dstAllow) > 0 || len(dstDeny) > 0 {
+		spec.Filters = append(spec.Filters, config.Filter{Type: "cidr", Direction: "destination", Allow: dstAllow, Deny: dstDeny})
+	}
+	if len(highOwners) > 0 {
+		spec.Filters = append(spec.Filters, config.Filter{Type: "priority", Priority: "high", Owners: highOwners})
+	}
+	if len(lowOwners) > 0 {
+		spec.Filters = append(spec.Filters, config.Filter{Type: "priority", Priority: "low", Owners: lowOwners})
+	}
+	if len(sockOptOwners) > 0 {
+		spec.Filters = append(spec.Filters, config.Filter{Type: "sockopt", Owners: sockOptOwners})
+	}
+	if *eventsocket.Filename != "" {
+		spec.Sinks = append(spec.Sinks, config.Sink{Type: "eventsocket", Path: *eventsocket.Filename})
+	}
+	if *natsURL != "" {
+		spec.Sinks = append(spec.Sinks, config.Sink{Type: "nats", URL: *natsURL, Subject: *natsSubject, Partitions: *natsPartitions, Buffer: *natsBuffer, Encodings: natsEncodings})
+	}
+	if *summarySyslog != "" {
+		spec.Sinks = append(spec.Sinks, config.Sink{Type: "syslog", URL: *summarySyslog, Buffer: *summaryBuffer})
+	}
+	if *summaryJournal {
+		spec.Sinks = append(spec.Sinks, config.Sink{Type: "journal", Buffer: *summaryBuffer})
+	}
+	if *grafanaAddress != "" {
+		spec.Sinks = append(spec.Sinks, config.Sink{Type: "grafana", Address: *grafanaAddress, Buffer: *grafanaBuffer})
+	}
+	if *grpcAddress != "" {
+		spec.Sinks = append(spec.Sinks, config.Sink{Type: "grpc", Address: *grpcAddress, Buffer: *grpcBuffer})
+	}
+	if *pubsubTopic != "" {
+		spec.Sinks = append(spec.Sinks, config.Sink{
+			Type:       "pubsub",
+			Topic:      *pubsubTopic,
+			Endpoint:   *pubsubEndpoint,
+			BatchCount: *pubsubBatchCount,
+			BatchBytes: *pubsubBatchBytes,
+			BatchDelay: pubsubBatchDelay.String(),
+			Buffer:     *pubsubBuffer,
+			Encodings:  []string{*pubsubEncoding},
+		})
+	}
+	return spec
+}
+
+// flagAnonymizer returns the IPAnonymizer configured by the flags.
+func flagAnonymizer() (anonymize.IPAnonymizer, error) {
+	c := anonymizer.Config{Method: *anonMethod, Rotation: *anonRotation}
+	if c.Method == "" {
+		c.Method = anonymize.IPAnonymizationFlag.String()
+	}
+	if *anonKeyFile != "" {
+		key, err := ioutil.ReadFile(*anonKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Key = bytes.TrimSpace(key)
+	}
+	return anonymizer.New(c)
+}
+
+// flagFilters returns the collector filters described by the flags.
+func flagFilters() *config.CollectorFilters {
+	return &config.CollectorFilters{
+		LocalPorts:  localPorts,
+		RemotePorts: remotePorts,
+		UIDs:        filterUIDs,
+		Inodes:      filterInodes,
+		Interfaces:  filterIfaces,
+	}
+}
+
+// cancelOnSignal cancels the context on SIGTERM or SIGINT, so that the collector
+// and saver stop, and all the files are closed, rather than being left with
+// truncated zstd frames.  A second signal exits immediately.
+func cancelOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Println("Received", sig, "- shutting down")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+}
+
 func main() {
 	flag.Parse()
 	flagx.ArgsFromEnv(flag.CommandLine)
+	rtx.Must(netlink.CheckLayout(), "The netlink structs are not supported on this platform")
+	inetdiag.SetDecoder(decoder)
+	netlink.SetStrict(*strict)
+	cancelOnSignal()
+
+	// "tcp-info selftest" validates the deployment, and exits.
+	if flag.Arg(0) == "selftest" {
+		rtx.Must(selfTest(ctx), "Self test failed")
+		log.Println("Self test passed")
+		return
+	}
+
+	// "tcp-info soak" runs against synthetic churn to detect resource leaks, and exits.
+	if flag.Arg(0) == "soak" {
+		limits := soakLimits{Heap: *soakMaxHeap, Goroutines: *soakMaxRoutines, FDs: *soakMaxFDs, Connections: *soakMaxConns}
+		rtx.Must(soakTest(ctx, *soakDuration, *soakConnections, *soakChurn, limits), "Soak test failed")
+		log.Println("Soak test passed")
+		return
+	}
 
 	if *outputDir != "" {
 		rtx.PanicOnError(os.MkdirAll(*outputDir, 0755), "Could not create the output dir %s", *outputDir)
 		rtx.Must(os.Chdir(*outputDir), "Could not change to the directory %s", *outputDir)
 	}
 
+	// "tcp-info import FILE..." converts raw inet_diag captures, e.g. from ss --diag,
+	// into the archive layout, and exits.
+	if flag.Arg(0) == "import" {
+		rtx.Must(runImport(flag.Args()[1:]), "Import failed")
+		return
+	}
+
+	// "tcp-info destroy <uuid or cookie>..." closes the connections with SOCK_DESTROY,
+	// and exits.  It requires CAP_NET_ADMIN.
+	if flag.Arg(0) == "destroy" {
+		rtx.Must(runDestroy(flag.Args()[1:]), "Destroy failed")
+		return
+	}
+
+	// "tcp-info manifest" writes the manifest of each directory in the archive tree,
+	// e.g. before the tree is bundled or uploaded, and exits.
+	if flag.Arg(0) == "manifest" {
+		n, err := manifest.WriteTree(".")
+		rtx.Must(err, "Could not write manifests")
+		log.Println("Wrote manifests of", n, "files")
+		return
+	}
+
+	// "tcp-info watch" exports each file as soon as it is finalized, until killed.
+	if flag.Arg(0) == "watch" {
+		rtx.Must(runWatch(ctx, ".", strings.Fields(*watchCommand), *watchPattern, *watchParallel, *watchManifest), "Watch failed")
+		return
+	}
+
+	// "tcp-info browse" serves a web interface for the archive tree, until killed.
+	if flag.Arg(0) == "browse" {
+		log.Println("Serving the archive browser on", *browseAddress)
+		rtx.Must(http.ListenAndServe(*browseAddress, browse.NewHandler(".")), "Could not serve the archive browser")
+		return
+	}
+
+	for category, value := range logBudgets.Get() {
+		perSecond, err := strconv.ParseFloat(value, 64)
+		rtx.Must(err, "Bad log budget for %s: %q", category, value)
+		loglevel.SetBudget(category, perSecond)
+	}
+
+	// Repair any files left incomplete by a previous crash.
+	if *recoveryWindow > 0 {
+		stats, err := recovery.Scan(".", recovery.Options{Since: time.Now().Add(-*recoveryWindow), QuarantineDir: *recoveryQuarantine})
+		rtx.Must(err, "Could not scan for incomplete files")
+		log.Printf("Recovery scan checked %d files, finalized %d, quarantined %d\n", stats.Checked, stats.Finalized, stats.Quarantined)
+	}
+
 	// Performance instrumentation.
 	runtime.SetBlockProfileRate(1000000) // 1 sample/msec
 	runtime.SetMutexProfileFraction(1000)
@@ -86,6 +407,12 @@ func main() {
 	promSrv := prometheusx.MustServeMetrics()
 	defer promSrv.Shutdown(ctx)
 
+	// Push the metrics as well, for environments without scraping.
+	if *remoteWriteURL != "" {
+		rw := &remotewrite.Client{URL: *remoteWriteURL, Interval: *remoteWriteInterval, Labels: remoteWriteLabels.Get()}
+		go rw.Run(ctx)
+	}
+
 	if *enableTrace {
 		traceFile, err := os.Create("trace")
 		rtx.Must(err, "Could not create trace file")
@@ -93,24 +420,184 @@ func main() {
 		defer trace.Stop()
 	}
 
-	// Make and start the event server.
-	eventSrv := eventsocket.NullServer()
-	if *eventsocket.Filename != "" {
-		eventSrv = eventsocket.New(*eventsocket.Filename)
+	// The configuration source, if any, may replace the pipeline described by the flags.
+	var configSource config.Source
+	if *configFile != "" {
+		configSource = config.FileSource(*configFile)
+	} else if *configMetadata != "" {
+		configSource = config.MetadataSource(*configMetadata)
+	}
+	spec := flagPipeline()
+	filters := flagFilters()
+	bucket := *gcsBucket
+	var configured *config.Pipeline
+	if configSource != nil {
+		c, err := config.Load(ctx, configSource)
+		rtx.Must(err, "Could not load configuration")
+		if c.Pipeline != nil {
+			spec = c.Pipeline
+			configured = c.Pipeline
+		}
+		if c.Filters != nil {
+			filters = c.Filters
+		}
+		if c.OutputBucket != nil {
+			bucket = *c.OutputBucket
+		}
 	}
-	rtx.Must(eventSrv.Listen(), "Could not listen on", *eventsocket.Filename)
-	go eventSrv.Serve(ctx)
 
-	// Make the saver and construct the message channel, buffering up to 2 batches
+	// Build the pipeline, and construct the message channel, buffering up to 2 batches
 	// of messages without stalling producer. We may want to increase the buffer if
 	// we observe main() stalling.
 	svrChan := make(chan netlink.MessageBlock, 2)
-	anon := anonymize.New(anonymize.IPAnonymizationFlag)
-	svr := saver.NewSaver("host", "pod", 3, eventSrv, anon)
-	go svr.MessageSaverLoop(svrChan)
+	anon, err := flagAnonymizer()
+	rtx.Must(err, "Could not configure the anonymization")
+	template, err := saver.ParseNameTemplate(*outTemplate)
+	rtx.Must(err, "Bad -output-template")
+	p, err := pipeline.Build(spec, pipeline.Options{Host: *machine, Site: *site, Marshallers: 3, Anonymizer: anon, NameTemplate: template, QueueDepth: *queueDepth})
+	rtx.Must(err, "Could not build the pipeline")
+
+	// Start the event server.
+	eventSrv := p.Events
+	rtx.Must(eventSrv.Listen(), "Could not listen on the event socket")
+	go eventSrv.Serve(ctx)
+
+	svr := p.Saver
+	svr.Experiment = *experiment
+	svr.Boot, err = bootinfo.Read()
+	if err != nil {
+		log.Println("Could not read boot info:", err)
+		metrics.ErrorCount.WithLabelValues("bootinfo").Inc()
+	}
+	svr.CheckpointFile = *checkpoint
+	svr.ReconcileInterval = *reconcile
+	svr.HostSketchInterval = *hostSketch
+	svr.FileAgeLimit = *fileAge
+	svr.MaxFileSize = *maxFileSize
+	svr.DeltaInterval = *deltaIntvl
+	svr.ColumnBlock = *colBlock
+	svr.IdleCycles = *idleCycles
+	svr.IdleInterval = *idleIntvl
+	svr.DropWhenFull = *dropFull
+	svr.BatchSize = *batchSize
+	svr.BatchDelay = *batchDelay
+	svr.InProcessCompression = *inProcess
+	svr.CompressionFrameSize = *frameSize
+	svr.MinSnapshots = *minSnaps
+	svr.MinDuration = *minDuration
+	svr.ShortFlowRollup = *shortFlows
+	svr.ShortFlowSampling = *shortSample
+	svr.ElephantBytes = *elephantBytes
+	svr.ElephantRate = *elephantRate
+	svr.DiagnosticsDir = *diagDir
+	svr.MaxDiagnostics = *diagFiles
+	rtx.Must(svr.SetOutputFormat(*outFormat), "Bad -output-format")
+	rtx.Must(svr.SetAttributePolicy(allowAttrs, denyAttrs), "Bad -attribute.allow or -attribute.deny")
+	var gcs *sink.GCS
+	if bucket != "" {
+		gcs = sink.NewGCS(sink.GCSSettings{
+			Endpoint:   *gcsEndpoint,
+			Bucket:     bucket,
+			Prefix:     *gcsPrefix,
+			Uploaders:  *gcsUploaders,
+			BufferSize: *gcsBuffer,
+			ChunkSize:  *gcsChunk,
+			FrameSize:  *frameSize,
+		})
+		svr.WriterFactory = gcs
+	}
+	if *ownersFile != "" {
+		owners, err := config.LoadOwners(*ownersFile)
+		rtx.Must(err, "Could not load owners from %s", *ownersFile)
+		svr.Owners = owners
+	}
+	// Probe the kernel, so that only the supported extensions are requested, and
+	// its features are recorded in the file headers.
+	kernel, err := collector.Probe()
+	if err != nil {
+		log.Println("Could not probe the kernel:", err)
+	}
+	svr.Kernel = kernel
+	go svr.Run(ctx, svrChan)
+
+	// The collector is configured before the fleet configuration is applied, so that
+	// the configuration may change its filter.
+	filter, err := filters.Collector()
+	rtx.Must(err, "Bad collector filter")
+	c := &collector.Collector{
+		Output:       svrChan,
+		Interval:     *pollIntvl,
+		UDP:          *udp,
+		MPTCP:        *mptcp,
+		Filter:       filter,
+		UnknownTypes: *unknownMsgs,
+		HostCounters: *hostCounter,
+		Pipeline:     *pollPipe,
+		Reps:         *reps,
+		Logger:       svr,
+	}
+
+	// Keep the fleet configuration, if any, up to date.
+	if configSource != nil {
+		loader := &config.Loader{
+			Source:   configSource,
+			Interval: *configInterval,
+			Apply: func(cfg *config.Config) {
+				if !reflect.DeepEqual(cfg.Pipeline, configured) {
+					log.Println("Pipeline changes take effect on restart")
+				}
+				if cfg.Sampling != nil {
+					svr.SetSampling(*cfg.Sampling)
+					svr.Audit("sampling", fmt.Sprint(*cfg.Sampling), "config")
+				}
+				if cfg.Filters != nil {
+					f, err := cfg.Filters.Collector()
+					if err != nil {
+						log.Println("Could not apply the collector filters:", err)
+					} else {
+						c.SetFilter(f)
+						b, _ := json.Marshal(cfg.Filters)
+						svr.Audit("filters", string(b), "config")
+					}
+				}
+				if cfg.OutputBucket != nil {
+					if gcs != nil && *cfg.OutputBucket != "" {
+						gcs.SetBucket(*cfg.OutputBucket)
+						svr.Audit("outputbucket", *cfg.OutputBucket, "config")
+					} else if (gcs != nil) != (*cfg.OutputBucket != "") {
+						log.Println("Switching between GCS and local files takes effect on restart")
+					}
+				}
+			},
+		}
+		rtx.Must(loader.Reload(ctx), "Could not load configuration")
+		go loader.Run(ctx)
+	}
+
+	// Serve the Grafana datasource, if enabled.
+	if p.Grafana != nil {
+		rtx.Must(httpx.ListenAndServeAsync(p.Grafana), "Could not start Grafana datasource")
+		defer p.Grafana.Shutdown(ctx)
+	}
+
+	// Serve the gRPC Watch service, if enabled.
+	if p.Watch != nil {
+		rtx.Must(p.Watch.ListenAndServeAsync(), "Could not start gRPC service")
+		defer p.Watch.Stop()
+	}
+
+	// Serve the admin API, if enabled.
+	if *adminAddress != "" {
+		adminSrv := &http.Server{
+			Addr:    *adminAddress,
+			Handler: admin.NewHandler(*adminToken, svr, svr, svr),
+		}
+		rtx.Must(httpx.ListenAndServeAsync(adminSrv), "Could not start admin server")
+		defer adminSrv.Shutdown(ctx)
+	}
 
 	// Run the collector, possibly forever.
-	totalSeen, totalErr := collector.Run(ctx, *reps, svrChan, svr, true)
+	totalSeen, totalErr := c.Run(ctx)
 
 	// Shut down and clean up after the collector terminates.
 	close(svrChan)
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/m-lab/go/osx"
 	"github.com/m-lab/go/rtx"
@@ -32,3 +35,37 @@ func TestMain(t *testing.T) {
 	// REPS=1 should cause main to run once and then exit.
 	main()
 }
+
+func TestSelfTest(t *testing.T) {
+	if _, err := testAddress(); err != nil {
+		t.Skip("No address for a test connection", err)
+	}
+	err := selfTest(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSoak(t *testing.T) {
+	if _, err := testAddress(); err != nil {
+		t.Skip("No address for a test connection", err)
+	}
+	limits := soakLimits{Heap: 1 << 30, Goroutines: 1000, FDs: 4096}
+	err := soakTest(context.Background(), 2*time.Second, 20, 5, limits)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Limits that can't be met should fail promptly.
+	limits.Goroutines = 1
+	err = soakTest(context.Background(), time.Minute, 20, 5, limits)
+	if err == nil {
+		t.Error("Expected goroutine limit to be exceeded")
+	}
+	limits.Goroutines = 1000
+	limits.Connections = 1
+	err = soakTest(context.Background(), time.Minute, 20, 5, limits)
+	if err == nil || !strings.Contains(err.Error(), "connection count") {
+		t.Error("Expected connection limit to be exceeded", err)
+	}
+}
@@ -0,0 +1,215 @@
+// Package manifest writes and verifies manifests of the files in the archive
+// tree, so that corruption in transport, e.g. by an upload, is detectable when
+// the files are read.
+//
+// Each directory has its own manifest, named manifest.jsonl, with one JSON
+// Entry per line, giving the name, size, and SHA256 of a file in the directory.
+// Entries may be appended as files are finalized, and a later entry for a file
+// replaces any earlier one.
+package manifest
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileName is the name of the manifest in each directory.
+const FileName = "manifest.jsonl"
+
+// ErrMismatch is returned when a file does not match its manifest entry.
+var ErrMismatch = errors.New("file does not match its manifest entry")
+
+// Entry describes one file in a manifest.
+type Entry struct {
+	Name   string // Name of the file, relative to the directory of the manifest.
+	Size   int64
+	SHA256 string // Hex encoded SHA256 of the file contents.
+}
+
+// NewEntry returns the Entry for the file at path.
+func NewEntry(path string) (Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Name: filepath.Base(path), Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Append appends the entry for the file at path to the manifest of its directory.
+func Append(path string) error {
+	e, err := NewEntry(path)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(path), FileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Write replaces the manifest of dir with the entries of all the other regular
+// files in dir, sorted by name.  It returns the number of entries.
+func Write(dir string) (int, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(dir, FileName+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	count := 0
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || name == FileName {
+			continue
+		}
+		e, err := NewEntry(filepath.Join(dir, name))
+		if err != nil {
+			tmp.Close()
+			return 0, err
+		}
+		err = enc.Encode(e)
+		if err != nil {
+			tmp.Close()
+			return 0, err
+		}
+		count++
+	}
+	err = w.Flush()
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return 0, err
+	}
+	return count, os.Rename(tmp.Name(), filepath.Join(dir, FileName))
+}
+
+// WriteTree writes the manifest of each directory under root that contains any
+// files.  It returns the number of files in all the manifests.
+func WriteTree(root string) (int, error) {
+	total := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		n, err := Write(path)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// Don't leave empty manifests in directories of directories.
+			return os.Remove(filepath.Join(path, FileName))
+		}
+		total += n
+		return nil
+	})
+	return total, err
+}
+
+// Load reads the manifest of dir.  If dir has no manifest, it returns an empty
+// map and an error satisfying errors.Is(err, os.ErrNotExist).
+func Load(dir string) (map[string]Entry, error) {
+	entries := map[string]Entry{}
+	f, err := os.Open(filepath.Join(dir, FileName))
+	if err != nil {
+		return entries, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var e Entry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		entries[e.Name] = e
+	}
+}
+
+// Verifier verifies files against the manifests of their directories, loading
+// each manifest once.  Manifests changed after they are loaded are not reread.
+type Verifier struct {
+	mu        sync.Mutex
+	manifests map[string]map[string]Entry
+}
+
+// Verify checks that the file at path matches its entry in the manifest of its
+// directory.  Files without a manifest, or without an entry, are not verified,
+// and return nil.
+func (v *Verifier) Verify(path string) error {
+	dir := filepath.Dir(path)
+	v.mu.Lock()
+	if v.manifests == nil {
+		v.manifests = map[string]map[string]Entry{}
+	}
+	entries, ok := v.manifests[dir]
+	if !ok {
+		var err error
+		entries, err = Load(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			v.mu.Unlock()
+			return err
+		}
+		// A missing manifest is not cached, since it may be written later.
+		if err == nil {
+			v.manifests[dir] = entries
+		}
+	}
+	v.mu.Unlock()
+
+	want, ok := entries[filepath.Base(path)]
+	if !ok {
+		return nil
+	}
+	got, err := NewEntry(path)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s has size %d and SHA256 %s, not %d and %s",
+			ErrMismatch, path, got.Size, got.SHA256, want.Size, want.SHA256)
+	}
+	return nil
+}
+
+var defaultVerifier Verifier
+
+// Verify checks the file at path with a shared Verifier.  See Verifier.Verify.
+func Verify(path string) error {
+	return defaultVerifier.Verify(path)
+}
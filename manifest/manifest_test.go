@@ -0,0 +1,71 @@
+package manifest_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/manifest"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestManifest")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	day := filepath.Join(dir, "2019/04/01")
+	rtx.Must(os.MkdirAll(day, 0777), "Could not mkdir")
+	a := filepath.Join(day, "a.00000.jsonl.zst")
+	b := filepath.Join(day, "b.00000.jsonl.zst")
+	rtx.Must(ioutil.WriteFile(a, []byte("abc"), 0666), "Could not write")
+	rtx.Must(ioutil.WriteFile(b, []byte("def"), 0666), "Could not write")
+
+	n, err := manifest.WriteTree(dir)
+	rtx.Must(err, "Could not write manifests")
+	if n != 2 {
+		t.Error("Expected 2 entries, got", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2019", manifest.FileName)); err == nil {
+		t.Error("Directories without files should have no manifest")
+	}
+	entries, err := manifest.Load(day)
+	rtx.Must(err, "Could not load manifest")
+	want := manifest.Entry{Name: "a.00000.jsonl.zst", Size: 3, SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}
+	if len(entries) != 2 || entries["a.00000.jsonl.zst"] != want {
+		t.Errorf("Wrong entries %+v", entries)
+	}
+
+	// A new file is appended.
+	c := filepath.Join(day, "c.00000.jsonl.zst")
+	rtx.Must(ioutil.WriteFile(c, []byte("ghi"), 0666), "Could not write")
+	rtx.Must(manifest.Append(c), "Could not append")
+	entries, err = manifest.Load(day)
+	rtx.Must(err, "Could not load manifest")
+	if len(entries) != 3 || entries["c.00000.jsonl.zst"].Size != 3 {
+		t.Errorf("Wrong entries %+v", entries)
+	}
+
+	v := manifest.Verifier{}
+	for _, path := range []string{a, b, c, filepath.Join(dir, "unlisted")} {
+		rtx.Must(v.Verify(path), "Could not verify %s", path)
+	}
+	rtx.Must(ioutil.WriteFile(b, []byte("deF"), 0666), "Could not write")
+	if err := v.Verify(b); !errors.Is(err, manifest.ErrMismatch) {
+		t.Error("Expected ErrMismatch, got", err)
+	}
+	rtx.Must(ioutil.WriteFile(c, []byte("ghij"), 0666), "Could not write")
+	if err := manifest.Verify(c); !errors.Is(err, manifest.ErrMismatch) {
+		t.Error("Expected ErrMismatch, got", err)
+	}
+
+	rtx.Must(ioutil.WriteFile(filepath.Join(day, manifest.FileName), []byte("{"), 0666), "Could not write")
+	if _, err := manifest.Load(day); err == nil {
+		t.Error("Should fail on a bad manifest")
+	}
+	if err := (&manifest.Verifier{}).Verify(a); err == nil {
+		t.Error("Should fail on a bad manifest")
+	}
+}
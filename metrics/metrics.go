@@ -30,6 +30,44 @@ var (
 		},
 		[]string{"af"})
 
+	// DumpSkewHistogram tracks the time between receiving the first and the last
+	// messages of each netlink dump, i.e. the skew between the snapshots of the
+	// connections in the same polling cycle.
+	DumpSkewHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "tcpinfo_dump_skew_histogram",
+			Help: "netlink dump first to last message time distribution (seconds)",
+			Buckets: []float64{
+				0.0001, 0.0002, 0.0005,
+				0.001, 0.00125, 0.0016, 0.002, 0.0025, 0.0032, 0.004, 0.005, 0.0063, 0.0079,
+				0.01, 0.0125, 0.016, 0.02, 0.025, 0.032, 0.04, 0.05, 0.063, 0.079,
+				0.1, 0.125, 0.16, 0.2,
+			},
+		},
+		[]string{"af"})
+
+	// NetlinkSocketCount counts the events of the netlink socket reused by the
+	// collector: "created" when it is opened, "error" when a dump fails, after
+	// which it is re-created, and "unhealthy" when the health check before a dump
+	// finds a pending socket error.
+	NetlinkSocketCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_netlink_socket_events_total",
+			Help: "Number of netlink socket events, by event.",
+		},
+		[]string{"event"},
+	)
+
+	// NetlinkSocketFailures is the number of consecutive dumps that failed, which is
+	// zero while the netlink socket is working, so persistent failures are distinct
+	// from the occasional error.
+	NetlinkSocketFailures = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_netlink_socket_consecutive_failures",
+			Help: "Number of consecutive netlink dumps that failed.",
+		},
+	)
+
 	// PollingHistogram tracks the interval between polling cycles.
 	PollingHistogram = promauto.NewHistogram(
 		prometheus.HistogramOpts{
@@ -153,6 +191,348 @@ var (
 		},
 	)
 
+	// SaverSnapshotCount counts the snapshots processed by the saver, by type: "total"
+	// for all of them, "new" for those of new connections, and "diff" for those that
+	// changed significantly.  It mirrors the counts the saver logs.
+	SaverSnapshotCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_saver_snapshots_total",
+			Help: "Number of snapshots processed by the saver, by type.",
+		},
+		[]string{"type"},
+	)
+
+	// SaverExpiredCount counts the connections the saver found closed.
+	SaverExpiredCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_saver_expired_connections_total",
+			Help: "Number of connections expired by the saver.",
+		},
+	)
+
+	// SaverOpenFiles is the number of connection files open, i.e. created and not
+	// yet queued to be closed.
+	SaverOpenFiles = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_saver_open_files",
+			Help: "Number of open connection files.",
+		},
+	)
+
+	// SaverQueuedTasks is the number of marshalling tasks queued for all the
+	// marshallers, after each polling cycle.  A growing queue means the marshallers
+	// are falling behind.
+	SaverQueuedTasks = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_saver_queued_tasks",
+			Help: "Number of marshalling tasks queued.",
+		},
+	)
+
+	// SaverBytesWritten counts the uncompressed bytes written to the connection
+	// files, by format, e.g. "jsonl".
+	SaverBytesWritten = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_saver_bytes_written_total",
+			Help: "Uncompressed bytes written to connection files, by format.",
+		},
+		[]string{"format"},
+	)
+
+	// MarshalDropCount counts the snapshots dropped because their marshalling queue
+	// was full, when the saver is configured not to wait for room.
+	MarshalDropCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_marshal_dropped_total",
+			Help: "Number of snapshots dropped because their marshalling queue was full.",
+		},
+	)
+
+	// MarshalQueueLength is the number of tasks queued for each marshaller, by its
+	// index, after each polling cycle.
+	MarshalQueueLength = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_marshal_queue_length",
+			Help: "Number of tasks queued for each marshaller.",
+		},
+		[]string{"marshaller"},
+	)
+
+	// UnsampledConnectionCount counts the connections that were not recorded
+	// because they were excluded by sampling.
+	UnsampledConnectionCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_unsampled_connection_total",
+			Help: "Number of connections not recorded due to sampling.",
+		},
+	)
+
+	// ExcludedOwnerConnectionCount counts the connections that were not recorded
+	// because their owner is not in the set of recorded owners.
+	ExcludedOwnerConnectionCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_excluded_owner_connection_total",
+			Help: "Number of connections not recorded due to their owner.",
+		},
+	)
+
+	// OwnerConnectionCount counts the recorded connections by owner, from the UID
+	// to owner mapping.  The owner is "unknown" for unmapped UIDs.
+	OwnerConnectionCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_owner_connection_total",
+			Help: "Number of connections recorded, by owner.",
+		}, []string{"owner"},
+	)
+
+	// SettingChangeCount counts runtime changes to settings, e.g. through the admin API.
+	SettingChangeCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_setting_change_total",
+			Help: "Number of runtime setting changes.",
+		}, []string{"setting", "source"},
+	)
+
+	// SamplingFraction is the current fraction of new connections that are recorded.
+	SamplingFraction = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_sampling_fraction",
+			Help: "Fraction of new connections that are recorded.",
+		},
+	)
+
+	// CompressorRestartCount counts the connection files that were ended early, and
+	// continued in a new file, because the compression process failed.
+	CompressorRestartCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_compressor_restart_total",
+			Help: "Number of compression processes replaced after failure.",
+		},
+	)
+
+	// IdleSkipCount counts the snapshots of idle connections that were not
+	// processed, because the connections are sampled at a reduced rate.
+	IdleSkipCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_idle_snapshot_skipped_total",
+			Help: "Number of snapshots of idle connections skipped by adaptive pacing.",
+		},
+	)
+
+	// ElephantCount counts the connections upgraded to the highest fidelity because
+	// they exceeded the elephant flow thresholds.
+	ElephantCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_elephant_flow_total",
+			Help: "Number of connections upgraded to full fidelity as elephant flows.",
+		},
+	)
+
+	// PriorityDropCount counts the snapshots dropped because the marshalling queues
+	// were under pressure, by the priority of their connections.
+	PriorityDropCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_priority_snapshot_dropped_total",
+			Help: "Number of snapshots dropped under queue pressure, by connection priority.",
+		},
+		[]string{"priority"},
+	)
+
+	// SockOptReportCount counts the socket option reports received from eventsocket
+	// clients, by whether they were kept for the next snapshot of a connection, or
+	// ignored because the connection is not selected, or not open.
+	SockOptReportCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_sockopt_reports_total",
+			Help: "Number of socket option reports received, by action.",
+		},
+		[]string{"action"},
+	)
+
+	// FinalSnapshotCount counts the final snapshots of connections that were written
+	// when the connections ended, because they had not been written before.
+	FinalSnapshotCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_final_snapshot_total",
+			Help: "Number of final connection snapshots written when the connections ended.",
+		},
+	)
+
+	// HandshakeOnlyCount counts the connections that ended without completing the
+	// handshake, and were therefore not recorded.
+	HandshakeOnlyCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_handshake_only_connection_total",
+			Help: "Number of connections that ended during the handshake, without a file.",
+		},
+	)
+
+	// ShortFlowCount counts the connections that ended with fewer than the minimum
+	// number of snapshots, or before the minimum duration, by whether they were
+	// discarded, added to the rollup, or sampled and written to their own files.
+	ShortFlowCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_short_flow_total",
+			Help: "Number of connections ended before reaching the minimum snapshots or duration.",
+		}, []string{"action"},
+	)
+
+	// OrphanCount counts the inconsistencies found between the saver connections
+	// and the connection cache, by type.  Each orphan is repaired when it is found.
+	OrphanCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_orphan_total",
+			Help: "Number of orphaned connections found by reconciliation.",
+		}, []string{"type"},
+	)
+
+	// CookieReuseCount counts the connections found to reuse the cookie of a
+	// previous connection still in the cache.
+	CookieReuseCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_cookie_reuse_total",
+			Help: "Number of connections that reused a cached cookie.",
+		},
+	)
+
+	// KernelAttributes is 1 for each inet_diag attribute the kernel returned for
+	// the probe socket at startup.
+	KernelAttributes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_kernel_attributes",
+			Help: "Whether the kernel supports each inet_diag attribute.",
+		}, []string{"attribute"},
+	)
+
+	// KernelTCPInfoBytes is the length of the kernel's struct tcp_info, as probed
+	// at startup.
+	KernelTCPInfoBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_kernel_tcpinfo_bytes",
+			Help: "Length of the kernel's struct tcp_info.",
+		},
+	)
+
+	// SinkRecordCount counts the records handled by each sink, by result, e.g.
+	// "published", "retried", "dropped" (because the sink's buffer was full, or
+	// delivery failed), "rejected" (because the sink's circuit breaker was open) or
+	// "failed" (because the destination refused them, e.g. with 403 Forbidden).
+	SinkRecordCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_sink_records_total",
+			Help: "Number of records handled by each sink, by result.",
+		}, []string{"sink", "result"},
+	)
+
+	// SinkLag is the time between publishing a record to a sink and its delivery,
+	// for the most recently delivered record.
+	SinkLag = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_sink_lag_seconds",
+			Help: "Delay in delivering the most recent record, by sink.",
+		}, []string{"sink"},
+	)
+
+	// SinkBreakerOpen is 1 while the circuit breaker of a sink is open, and records
+	// are dropped without being sent.
+	SinkBreakerOpen = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_sink_breaker_open",
+			Help: "Whether the circuit breaker of each sink is open.",
+		}, []string{"sink"},
+	)
+
+	// UploadFailureCount counts the failures to upload files to cloud storage, by
+	// result, i.e. "failed" for each failed attempt, or "dropped" for each file that
+	// was not uploaded (because the upload buffer was full, the circuit breaker was
+	// open, or the upload did not succeed before shutdown).
+	UploadFailureCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_upload_failures_total",
+			Help: "Number of failed file uploads, by result.",
+		}, []string{"result"},
+	)
+
+	// StateAnomalyCount counts the impossible TCP state transitions observed between
+	// consecutive snapshots of a connection, by transition, e.g. "TIME_WAIT->ESTABLISHED".
+	StateAnomalyCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_state_anomaly_total",
+			Help: "Number of invalid TCP state transitions observed.",
+		}, []string{"transition"},
+	)
+
+	// SuppressedLogCount counts the log messages dropped because their category
+	// exceeded its budget.
+	SuppressedLogCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_suppressed_log_total",
+			Help: "Number of log messages suppressed by rate limiting.",
+		}, []string{"category"},
+	)
+
+	// RecoveryFileCount counts the incomplete files found by the startup recovery
+	// scan, by whether they were finalized or quarantined.
+	RecoveryFileCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_recovery_file_total",
+			Help: "Number of incomplete files repaired at startup.",
+		}, []string{"action"},
+	)
+
+	// ExportFileCount counts the finalized files passed to the export command of
+	// "tcp-info watch", by whether the command succeeded.
+	ExportFileCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_export_file_total",
+			Help: "Number of finalized files exported.",
+		}, []string{"status"},
+	)
+
+	// ShutdownConnectionsClosed is the number of connections that were still open,
+	// and were closed, when the saver shut down.
+	ShutdownConnectionsClosed = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_shutdown_connections_closed",
+			Help: "Number of open connections closed at shutdown.",
+		},
+	)
+
+	// ShutdownTasksFlushed is the number of marshalling tasks that were queued when
+	// the saver shut down.
+	ShutdownTasksFlushed = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_shutdown_tasks_flushed",
+			Help: "Number of queued marshalling tasks flushed at shutdown.",
+		},
+	)
+
+	// ShutdownDuration is the time taken to shut down the saver, and close all files.
+	ShutdownDuration = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_shutdown_duration_seconds",
+			Help: "Time taken to close all files at shutdown.",
+		},
+	)
+
+	// HostRTT is the distribution of the smoothed RTT of all the TCP connections in
+	// the most recent polling cycle, estimated from a quantile sketch, by quantile.
+	HostRTT = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_host_rtt_seconds",
+			Help: "Quantiles of the smoothed RTT of the connections in the last polling cycle.",
+		}, []string{"quantile"},
+	)
+
+	// HostDeliveryRate is the distribution of the delivery rate of all the TCP
+	// connections in the most recent polling cycle, by quantile.
+	HostDeliveryRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_host_delivery_rate_bytes_per_second",
+			Help: "Quantiles of the delivery rate of the connections in the last polling cycle.",
+		}, []string{"quantile"},
+	)
+
 	// LargeNetlinkMsgTotal counts the total number of snapshots collected across all connections.
 	LargeNetlinkMsgTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -11,5 +11,19 @@ func TestPrometheusMetrics(t *testing.T) {
 	metrics.ConnectionCountHistogram.WithLabelValues("x")
 	metrics.ErrorCount.WithLabelValues("x")
 	metrics.SyscallTimeHistogram.WithLabelValues("x")
+	metrics.DumpSkewHistogram.WithLabelValues("x")
+	metrics.SettingChangeCount.WithLabelValues("x", "y")
+	metrics.OrphanCount.WithLabelValues("x")
+	metrics.ShortFlowCount.WithLabelValues("x")
+	metrics.OwnerConnectionCount.WithLabelValues("x")
+	metrics.RecoveryFileCount.WithLabelValues("x")
+	metrics.ExportFileCount.WithLabelValues("x")
+	metrics.SuppressedLogCount.WithLabelValues("x")
+	metrics.StateAnomalyCount.WithLabelValues("x")
+	metrics.KernelAttributes.WithLabelValues("x")
+	metrics.SinkRecordCount.WithLabelValues("x", "x")
+	metrics.UploadFailureCount.WithLabelValues("x")
+	metrics.SinkLag.WithLabelValues("x")
+	metrics.SinkBreakerOpen.WithLabelValues("x")
 	promtest.LintMetrics(nil)
 }
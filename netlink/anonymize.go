@@ -0,0 +1,106 @@
+package netlink
+
+import (
+	"net"
+	"unsafe"
+
+	"github.com/m-lab/go/anonymize"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// Layouts of the attributes that contain addresses.  INET_DIAG_LOCALS and
+// INET_DIAG_PEERS, which are only sent for SCTP sockets, are arrays of struct
+// sockaddr_storage, and INET_DIAG_MD5SIG is an array of struct tcp_diag_md5sig.
+const (
+	sockaddrSize        = 128 // sizeof(struct sockaddr_storage)
+	sockaddrIn4Offset   = 4   // offsetof(struct sockaddr_in, sin_addr)
+	sockaddrIn6Offset   = 8   // offsetof(struct sockaddr_in6, sin6_addr)
+	md5sigSize          = 100 // sizeof(struct tcp_diag_md5sig)
+	md5sigAddrOffset    = 4   // offsetof(struct tcp_diag_md5sig, tcpm_addr)
+	md5sigKeyOffset     = 20  // offsetof(struct tcp_diag_md5sig, tcpm_key)
+	md5sigFamilyOffset  = 0   // offsetof(struct tcp_diag_md5sig, tcpm_family)
+	sockaddrFamilyBytes = 2   // sizeof(sa_family_t)
+)
+
+// Anonymized returns a copy of the record, in which the addresses of the socket in
+// the RawIDM, and the addresses in the INET_DIAG_LOCALS, INET_DIAG_PEERS and
+// INET_DIAG_MD5SIG attributes, are anonymized, and the MD5 keys are zeroed.  The
+// record is not modified, as it may be shared, e.g. with the connection cache, and
+// only the rewritten byte slices are copied.
+func (pm *ArchivalRecord) Anonymized(anon anonymize.IPAnonymizer) (*ArchivalRecord, error) {
+	c := *pm
+	c.RawIDM = append(inetdiag.RawInetDiagMsg(nil), pm.RawIDM...)
+	if err := c.RawIDM.Anonymize(anon); err != nil {
+		return nil, err
+	}
+	copied := false
+	for _, t := range []int{inetdiag.INET_DIAG_LOCALS, inetdiag.INET_DIAG_PEERS, inetdiag.INET_DIAG_MD5SIG} {
+		if t >= len(pm.Attributes) || len(pm.Attributes[t]) == 0 {
+			continue
+		}
+		if !copied {
+			c.Attributes = append([][]byte(nil), pm.Attributes...)
+			copied = true
+		}
+		b := append([]byte(nil), pm.Attributes[t]...)
+		if t == inetdiag.INET_DIAG_MD5SIG {
+			anonymizeMD5Sig(b, anon)
+		} else {
+			anonymizeSockaddrs(b, anon)
+		}
+		c.Attributes[t] = b
+	}
+	return &c, nil
+}
+
+// addr returns the address of the family at offset in b, or nil.
+func addr(b []byte, family uint16, offset4, offset6 int) net.IP {
+	switch family {
+	case inetdiag.AF_INET:
+		return net.IP(b[offset4 : offset4+net.IPv4len])
+	case inetdiag.AF_INET6:
+		return net.IP(b[offset6 : offset6+net.IPv6len])
+	}
+	return nil
+}
+
+// zero zeroes b.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// anonymizeSockaddrs anonymizes an array of struct sockaddr_storage in place.
+// Addresses of other families, and any trailing partial entry, are zeroed.
+func anonymizeSockaddrs(b []byte, anon anonymize.IPAnonymizer) {
+	for ; len(b) >= sockaddrSize; b = b[sockaddrSize:] {
+		family := *(*uint16)(unsafe.Pointer(&b[0]))
+		if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+			family = order.Uint16(b)
+		}
+		if ip := addr(b, family, sockaddrIn4Offset, sockaddrIn6Offset); ip != nil {
+			anon.IP(ip)
+		} else {
+			zero(b[sockaddrFamilyBytes:sockaddrSize])
+		}
+	}
+	zero(b)
+}
+
+// anonymizeMD5Sig anonymizes an array of struct tcp_diag_md5sig in place, and
+// zeroes the keys, which must never be recorded.  Addresses of other families, and
+// any trailing partial entry, are zeroed.
+func anonymizeMD5Sig(b []byte, anon anonymize.IPAnonymizer) {
+	for ; len(b) >= md5sigSize; b = b[md5sigSize:] {
+		family := uint16(b[md5sigFamilyOffset])
+		if ip := addr(b, family, md5sigAddrOffset, md5sigAddrOffset); ip != nil {
+			anon.IP(ip)
+		} else {
+			zero(b[md5sigAddrOffset:md5sigKeyOffset])
+		}
+		zero(b[md5sigKeyOffset:md5sigSize])
+	}
+	zero(b)
+}
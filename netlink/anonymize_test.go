@@ -0,0 +1,93 @@
+package netlink_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"unsafe"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// zeroAnonymizer zeroes all addresses.
+type zeroAnonymizer struct{}
+
+func (zeroAnonymizer) IP(ip net.IP) {
+	for i := range ip {
+		ip[i] = 0
+	}
+}
+
+func TestAnonymized(t *testing.T) {
+	idm := inetdiag.InetDiagMsg{IDiagFamily: inetdiag.AF_INET}
+	copy(idm.ID.IDiagSrc[:], net.ParseIP("192.168.1.1").To4())
+	copy(idm.ID.IDiagDst[:], net.ParseIP("10.1.2.3").To4())
+	raw := inetdiag.RawInetDiagMsg((*[unsafe.Sizeof(idm)]byte)(unsafe.Pointer(&idm))[:])
+
+	// An SCTP peer, and an MD5 key for an IPv6 peer.
+	peers := make([]byte, 2*128)
+	*(*uint16)(unsafe.Pointer(&peers[0])) = inetdiag.AF_INET
+	copy(peers[4:], net.ParseIP("10.1.2.3").To4())
+	*(*uint16)(unsafe.Pointer(&peers[128])) = inetdiag.AF_INET6
+	copy(peers[128+8:], net.ParseIP("2001:db8::1"))
+	md5 := make([]byte, 100)
+	md5[0] = inetdiag.AF_INET6
+	copy(md5[4:], net.ParseIP("2001:db8::1"))
+	copy(md5[20:], "secret")
+
+	attrs := make([][]byte, inetdiag.INET_DIAG_MAX)
+	attrs[inetdiag.INET_DIAG_INFO] = []byte{1, 2, 3}
+	attrs[inetdiag.INET_DIAG_PEERS] = peers
+	attrs[inetdiag.INET_DIAG_MD5SIG] = md5
+	ar := &netlink.ArchivalRecord{RawIDM: raw, Attributes: attrs}
+	orig := append([]byte(nil), raw...)
+	origPeers := append([]byte(nil), peers...)
+	origMD5 := append([]byte(nil), md5...)
+
+	anon, err := ar.Anonymized(zeroAnonymizer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ar.RawIDM, orig) || !bytes.Equal(peers, origPeers) || !bytes.Equal(md5, origMD5) {
+		t.Error("Anonymized modified the record")
+	}
+	aidm, err := anon.RawIDM.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aidm.ID.SrcIP().Equal(net.IPv4zero) || !aidm.ID.DstIP().Equal(net.IPv4zero) {
+		t.Error("Socket addresses were not anonymized:", aidm.ID.SrcIP(), aidm.ID.DstIP())
+	}
+	if &anon.Attributes[inetdiag.INET_DIAG_INFO][0] != &attrs[inetdiag.INET_DIAG_INFO][0] {
+		t.Error("Attributes without addresses should not be copied")
+	}
+	p := anon.Attributes[inetdiag.INET_DIAG_PEERS]
+	if !bytes.Equal(p[4:8], make([]byte, 4)) || !bytes.Equal(p[128+8:128+24], make([]byte, 16)) {
+		t.Error("Peer addresses were not anonymized")
+	}
+	if *(*uint16)(unsafe.Pointer(&p[128])) != inetdiag.AF_INET6 {
+		t.Error("Peer families should be kept")
+	}
+	m := anon.Attributes[inetdiag.INET_DIAG_MD5SIG]
+	if !bytes.Equal(m[4:100], make([]byte, 96)) {
+		t.Error("MD5 address and key were not removed:", m)
+	}
+
+	// Without address attributes, the attributes are shared.
+	ar.Attributes = attrs[:inetdiag.INET_DIAG_INFO+1]
+	anon, err = ar.Anonymized(anonymize.New(anonymize.None))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &anon.Attributes[0] != &ar.Attributes[0] {
+		t.Error("The attributes should not be copied")
+	}
+
+	// A message that can not be parsed is an error.
+	ar.RawIDM = raw[:8]
+	if _, err := ar.Anonymized(zeroAnonymizer{}); err == nil {
+		t.Error("Expected an error for a short RawIDM")
+	}
+}
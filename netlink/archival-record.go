@@ -6,10 +6,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"time"
 	"unsafe"
 
@@ -28,6 +31,78 @@ type Metadata struct {
 	UUID      string
 	Sequence  int
 	StartTime time.Time
+
+	// Identifiers of the machine, site and experiment that produced the data, so
+	// that archives are self-describing when copied off-host.
+	Machine    string `json:",omitempty"`
+	Site       string `json:",omitempty"`
+	Experiment string `json:",omitempty"`
+
+	// Owner is the logical owner or service of the connection, from the UID mapping.
+	Owner string `json:",omitempty"`
+
+	// Protocol names the protocol of the socket, e.g. "udp", if it is not TCP.
+	Protocol string `json:",omitempty"`
+	// MPTCPToken is the local token of the MPTCP connection, for the files of an
+	// MPTCP connection, and of its TCP subflows, so they can be grouped.
+	MPTCPToken uint32 `json:",omitempty"`
+
+	// The boot of the host that produced the data, whose time is also embedded in
+	// the UUID, and the clocks used for the Timestamps.  Clock is the clock read by
+	// the collector, and ClockSource the kernel clocksource backing it.
+	BootID      string `json:",omitempty"`
+	BootTime    time.Time
+	Clock       string `json:",omitempty"`
+	ClockSource string `json:",omitempty"`
+
+	// Sampling is the fraction of connections being recorded when the file was
+	// created.  It is omitted when all connections are recorded.
+	Sampling float64 `json:",omitempty"`
+	// ShortFlowSampling is the fraction of short connections, those that ended
+	// before the minimum duration or number of snapshots, that are recorded.  It is
+	// only present in the files of such connections.
+	ShortFlowSampling float64 `json:",omitempty"`
+	// Audit lists the runtime setting changes made since the previous file of
+	// the same connection was created, or since the connection started.
+	Audit []AuditEvent `json:",omitempty"`
+
+	// Kernel describes the inet_diag features of the running kernel, as probed by
+	// the collector at startup.
+	Kernel *Capabilities `json:",omitempty"`
+	// AttributePolicy, if present, describes the attributes intentionally omitted
+	// from the records of the file.
+	AttributePolicy *AttributePolicy `json:",omitempty"`
+	// Elephant is true if the connection was an elephant flow when the file was
+	// created, so that every snapshot is recorded, with all of its attributes.
+	Elephant bool `json:",omitempty"`
+}
+
+// Capabilities are the inet_diag features of a kernel.
+type Capabilities struct {
+	// Attributes names the attributes the kernel returned for a TCP socket, e.g.
+	// "TCPInfo", in order of their types.
+	Attributes []string
+	// TCPInfoLength is the length of the kernel's struct tcp_info, which may differ
+	// from that of tcp.LinuxTCPInfo.
+	TCPInfoLength int
+}
+
+// AttributePolicy describes which attributes are kept in the records of a file.
+// Attributes are named as in inetdiag.InetDiagType, e.g. "SKMemInfo", or by their
+// type number if they have no name.
+type AttributePolicy struct {
+	// Allow, if not empty, lists the only attributes that are kept.
+	Allow []string `json:",omitempty"`
+	// Deny lists the attributes that are dropped.
+	Deny []string `json:",omitempty"`
+}
+
+// AuditEvent records a change to a runtime setting, such as the sampling fraction.
+type AuditEvent struct {
+	Time    time.Time
+	Setting string
+	Value   string
+	Source  string // Where the change came from, e.g. "admin" or "config".
 }
 
 // ArchivalRecord is a container for parsed InetDiag messages and attributes.
@@ -41,10 +116,34 @@ type ArchivalRecord struct {
 	RawIDM inetdiag.RawInetDiagMsg `json:",omitempty"` // RawInetDiagMsg within NLMsg
 	// Saving just the .Value fields reduces Marshalling by 1.9 usec.
 	Attributes [][]byte `json:",omitempty"` // byte slices from RouteAttr.Value, backed by NLMsg
+	// Delta, if present, encodes the RawIDM and Attributes as the changes from the
+	// previous snapshot in the file.  NewArchiveReader reconstructs them.
+	Delta []byte `json:",omitempty"`
+	// Columns, if present, holds a block of consecutive snapshots in a columnar
+	// layout, in place of the RawIDM and Attributes.  NewArchiveReader returns the
+	// snapshots of the block in turn.  See ColumnBlock.
+	Columns []byte `json:",omitempty"`
 
 	// Metadata contains connection level metadata.  It is typically included in the very first record
 	// in a file.
 	Metadata *Metadata `json:",omitempty"`
+
+	// Anomaly describes anything impossible observed in this snapshot, relative to the
+	// previous snapshot of the connection, e.g. "state TIME_WAIT->ESTABLISHED".
+	Anomaly string `json:",omitempty"`
+
+	// Derived holds the fields computed from this snapshot and the previous one of
+	// the connection by the Derivers of the saver, by name.
+	Derived map[string]float64 `json:",omitempty"`
+
+	// SockOpts holds the socket options of the connection reported by its
+	// application, e.g. SO_SNDBUF, if a new report was received since the previous
+	// snapshot written.
+	SockOpts map[string]int64 `json:",omitempty"`
+
+	// Protocol is the protocol of the socket, if it is not TCP, e.g. for UDP
+	// sockets.  It is not archived, since it is recorded in the file Metadata.
+	Protocol inetdiag.Protocol `json:"-"`
 }
 
 // ParseRouteAttr parses a byte array into slice of NetlinkRouteAttr struct.
@@ -58,6 +157,10 @@ func ParseRouteAttr(b []byte) ([]NetlinkRouteAttr, error) {
 		}
 		ra := NetlinkRouteAttr{Attr: RtAttr(*a), Value: vbuf[:int(a.Len)-SizeofRtAttr]}
 		attrs = append(attrs, ra)
+		if alen > len(b) {
+			// The last attribute may not be padded.
+			break
+		}
 		b = b[alen:]
 	}
 	return attrs, nil
@@ -68,12 +171,24 @@ func ParseRouteAttr(b []byte) ([]NetlinkRouteAttr, error) {
 // Note that Parse does not populate the Timestamp field, so caller should do so.
 func MakeArchivalRecord(msg *NetlinkMessage, skipLocal bool) (*ArchivalRecord, error) {
 	if msg.Header.Type != 20 {
-		return nil, ErrNotType20
+		return nil, fmt.Errorf("%w: %d", ErrNotType20, msg.Header.Type)
 	}
 	raw, attrBytes := inetdiag.SplitInetDiagMsg(msg.Data)
 	if raw == nil {
+		if Strict() {
+			return nil, strictError(msg, "short message")
+		}
 		return nil, ErrParseFailed
 	}
+	if Strict() {
+		idm, err := raw.Parse()
+		if err != nil {
+			return nil, strictError(msg, "%v", err)
+		}
+		if idm.ID.Cookie() == 0 {
+			return nil, strictError(msg, "socket has no cookie")
+		}
+	}
 	if skipLocal {
 		idm, err := raw.Parse()
 		if err != nil {
@@ -89,6 +204,9 @@ func MakeArchivalRecord(msg *NetlinkMessage, skipLocal bool) (*ArchivalRecord, e
 
 	attrs, err := ParseRouteAttr(attrBytes)
 	if err != nil {
+		if Strict() {
+			return nil, strictError(msg, "%v", err)
+		}
 		return nil, err
 	}
 	maxAttrType := uint16(0)
@@ -105,10 +223,16 @@ func MakeArchivalRecord(msg *NetlinkMessage, skipLocal bool) (*ArchivalRecord, e
 	for _, a := range attrs {
 		t := a.Attr.Type
 		if t > maxAttrType {
+			if Strict() {
+				return nil, strictError(msg, "attribute type %d is too large", t)
+			}
 			log.Println("Error!! Received RouteAttr with very large Type:", t)
 			continue
 		}
 		if record.Attributes[t] != nil {
+			if Strict() {
+				return nil, strictError(msg, "attribute type %d appears more than once", t)
+			}
 			// TODO - add metric so we can alert on these.
 			log.Println("Parse error - Attribute appears more than once:", t)
 		}
@@ -132,6 +256,8 @@ const (
 	PacketCountChange               // One of the packet/byte/segment counts (or other late field) changed
 	PreviousWasNil                  // The previous message was nil
 	Other                           // Some other attribute changed
+	DCTCPChange                     // The DCTCP alpha, CE state or ECN byte counts changed
+	CongestionChange                // The congestion control algorithm changed
 )
 
 // Useful offsets for Compare
@@ -141,8 +267,23 @@ const (
 	busytimeOffset      = unsafe.Offsetof(tcp.LinuxTCPInfo{}.BusyTime)
 	bytesReceivedOffset = unsafe.Offsetof(tcp.LinuxTCPInfo{}.BytesReceived) // 128
 	bytesSentOffset     = unsafe.Offsetof(tcp.LinuxTCPInfo{}.BytesSent)     // 200
+	appLimitedOffset    = unsafe.Offsetof(tcp.LinuxTCPInfo{}.AppLimited)    // 7
+	deliveryRateOffset  = unsafe.Offsetof(tcp.LinuxTCPInfo{}.DeliveryRate)  // 160
+	rttOffset           = unsafe.Offsetof(tcp.LinuxTCPInfo{}.RTT)           // 68
 )
 
+// span returns raw[lo:hi], truncated to the length of raw, which is shorter on
+// older kernels.
+func span(raw []byte, lo, hi uintptr) []byte {
+	if hi > uintptr(len(raw)) {
+		hi = uintptr(len(raw))
+	}
+	if lo > hi {
+		lo = hi
+	}
+	return raw[lo:hi]
+}
+
 func isLocal(addr net.IP) bool {
 	return addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsMulticast() || addr.IsUnspecified()
 }
@@ -181,27 +322,38 @@ func (pm *ArchivalRecord) Compare(previous *ArchivalRecord) (ChangeType, error)
 
 	// TODO - should we validate that ID matches?  Otherwise, we shouldn't even be comparing the rest.
 
-	// We now allocate only the size
-	if len(previous.Attributes) <= inetdiag.INET_DIAG_INFO || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
-		return NoTCPInfo, nil
-	}
-	a := previous.Attributes[inetdiag.INET_DIAG_INFO]
-	b := pm.Attributes[inetdiag.INET_DIAG_INFO]
-	if a == nil || b == nil {
-		return NoTCPInfo, nil
-	}
+	// Other protocols have no TCPInfo, so only their other attributes, e.g. the
+	// SKMEMINFO queue sizes and drops, or the mptcp_info of MPTCP sockets, are
+	// compared.
+	if pm.IsTCP() {
+		// We now allocate only the size
+		if len(previous.Attributes) <= inetdiag.INET_DIAG_INFO || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
+			return NoTCPInfo, nil
+		}
+		a := previous.Attributes[inetdiag.INET_DIAG_INFO]
+		b := pm.Attributes[inetdiag.INET_DIAG_INFO]
+		if a == nil || b == nil {
+			return NoTCPInfo, nil
+		}
 
-	// If any of the byte/segment/package counters have changed, that is what we are most
-	// interested in.
-	// NOTE: There are more fields beyond BusyTime, but for now we are ignoring them for diffing purposes.
-	if 0 != bytes.Compare(a[pmtuOffset:busytimeOffset], b[pmtuOffset:busytimeOffset]) {
-		return StateOrCounterChange, nil
-	}
+		// The length of struct tcp_info depends on the kernel, so it should not change, but
+		// if it does, the fields cannot be compared.
+		if len(a) != len(b) {
+			return AttributeLength, nil
+		}
+
+		// If any of the byte/segment/package counters have changed, that is what we are most
+		// interested in.
+		// NOTE: There are more fields beyond BusyTime, but for now we are ignoring them for diffing purposes.
+		if 0 != bytes.Compare(span(a, pmtuOffset, busytimeOffset), span(b, pmtuOffset, busytimeOffset)) {
+			return StateOrCounterChange, nil
+		}
 
-	// Check all the earlier fields, too.  Usually these won't change unless the counters above
-	// change, but this way we won't miss something subtle.
-	if 0 != bytes.Compare(a[:lastDataSentOffset], b[:lastDataSentOffset]) {
-		return StateOrCounterChange, nil
+		// Check all the earlier fields, too.  Usually these won't change unless the counters above
+		// change, but this way we won't miss something subtle.
+		if 0 != bytes.Compare(span(a, 0, lastDataSentOffset), span(b, 0, lastDataSentOffset)) {
+			return StateOrCounterChange, nil
+		}
 	}
 
 	// If any attributes have been added or removed, that is likely significant.
@@ -218,7 +370,36 @@ func (pm *ArchivalRecord) Compare(previous *ArchivalRecord) (ChangeType, error)
 		}
 		switch tp {
 		case inetdiag.INET_DIAG_INFO:
-			// Handled explicitly above.
+			// Handled explicitly above, for TCP.
+			if pm.IsMPTCP() {
+				// The last_* times of the mptcp_info are rapidly changing, like those of
+				// the tcp_info.
+				a, b := previous.Attributes[tp], pm.Attributes[tp]
+				if len(a) != len(b) {
+					return AttributeLength, nil
+				}
+				if 0 != bytes.Compare(span(a, 0, mptcpLastDataSentOffset), span(b, 0, mptcpLastDataSentOffset)) {
+					return Other, nil
+				}
+			}
+		case inetdiag.INET_DIAG_CONG:
+			// The congestion control of a connection may be switched at runtime, e.g.
+			// from cubic to bbr.
+			a, b := previous.Attributes[tp], pm.Attributes[tp]
+			if a != nil && b != nil && previous.CongestionAlgorithm() != pm.CongestionAlgorithm() {
+				return CongestionChange, nil
+			}
+			fallthrough
+		case inetdiag.INET_DIAG_DCTCPINFO:
+			// The DCTCP alpha and the ECN marked byte counts are the congestion signal
+			// of datacenter connections, so their changes are reported as such.
+			// Attributes that are missing or too short are compared as bytes below.
+			x, _ := previous.ParseDCTCPInfo()
+			y, _ := pm.ParseDCTCPInfo()
+			if x != nil && y != nil && *x != *y {
+				return DCTCPChange, nil
+			}
+			fallthrough
 		default:
 			// Detect any change in anything other than INET_DIAG_INFO
 			a := previous.Attributes[tp]
@@ -260,6 +441,9 @@ func LoadRawNetlinkMessage(rdr io.Reader) (*NetlinkMessage, error) {
 		// Note that this may be EOF
 		return nil, err
 	}
+	if header.Len < uint32(binary.Size(header)) {
+		return nil, ErrParseFailed
+	}
 	data := make([]byte, header.Len-uint32(binary.Size(header)))
 	err = binary.Read(rdr, binary.LittleEndian, data)
 	if err != nil {
@@ -294,10 +478,16 @@ func (raw *rawReader) Next() (*ArchivalRecord, error) {
 }
 
 type archiveReader struct {
-	scanner *bufio.Scanner
+	scanner  *bufio.Scanner
+	previous *ArchivalRecord   // The previous snapshot, from which deltas are reconstructed.
+	block    []*ArchivalRecord // The snapshots of the current columnar block not yet returned.
+	protocol inetdiag.Protocol // The protocol named in the most recent Metadata.
 }
 
-// NewArchiveReader wraps a source of JSONL ArchiveRecords to create ArchiveReader
+// NewArchiveReader wraps a source of JSONL ArchiveRecords to create ArchiveReader.
+// Delta encoded records are reconstructed from the preceding snapshot, and the
+// snapshots of columnar blocks are returned individually.  The Protocol of each
+// record is set from the file Metadata.
 func NewArchiveReader(rdr io.Reader) ArchiveReader {
 	sc := bufio.NewScanner(rdr)
 	return &archiveReader{scanner: sc}
@@ -305,6 +495,11 @@ func NewArchiveReader(rdr io.Reader) ArchiveReader {
 
 // Next decodes and returns the next ArchivalRecord.
 func (ar *archiveReader) Next() (*ArchivalRecord, error) {
+	if len(ar.block) > 0 {
+		next := ar.block[0]
+		ar.block = ar.block[1:]
+		return next, nil
+	}
 	if !ar.scanner.Scan() {
 		return nil, io.EOF
 	}
@@ -315,6 +510,26 @@ func (ar *archiveReader) Next() (*ArchivalRecord, error) {
 	if err != nil {
 		return nil, err
 	}
+	if record.Metadata != nil {
+		ar.protocol = protocolOf(record.Metadata.Protocol)
+	}
+	record.Protocol = ar.protocol
+	err = record.Undelta(ar.previous)
+	if err != nil {
+		return nil, err
+	}
+	if record.Columns != nil {
+		block, err := record.Snapshots()
+		if err != nil {
+			return nil, err
+		}
+		ar.previous = block[len(block)-1]
+		ar.block = block[1:]
+		return block[0], nil
+	}
+	if record.RawIDM != nil {
+		ar.previous = &record
+	}
 	return &record, nil
 }
 
@@ -336,6 +551,91 @@ func LoadAllArchivalRecords(rdr io.Reader) ([]*ArchivalRecord, error) {
 	}
 }
 
+// ErrShortBBRInfo is returned when the INET_DIAG_BBRINFO attribute is too short.
+var ErrShortBBRInfo = errors.New("INET_DIAG_BBRINFO is shorter than struct tcp_bbr_info")
+
+// sizeofBBRInfo is the size of linux struct tcp_bbr_info, in which the bandwidth is
+// split into two 32 bit fields, so it is smaller than BBRInfo, which is padded.
+const sizeofBBRInfo = 20
+
+// ParseBBRInfo returns the BBR state from the INET_DIAG_BBRINFO attribute, or nil
+// if the connection is not using BBR.
+func (pm *ArchivalRecord) ParseBBRInfo() (*inetdiag.BBRInfo, error) {
+	if len(pm.Attributes) <= inetdiag.INET_DIAG_BBRINFO || pm.Attributes[inetdiag.INET_DIAG_BBRINFO] == nil {
+		return nil, nil
+	}
+	raw := pm.Attributes[inetdiag.INET_DIAG_BBRINFO]
+	if len(raw) < sizeofBBRInfo {
+		return nil, ErrShortBBRInfo
+	}
+	return &inetdiag.BBRInfo{
+		BW:         int64(binary.LittleEndian.Uint64(raw[0:8])),
+		MinRTT:     binary.LittleEndian.Uint32(raw[8:12]),
+		PacingGain: binary.LittleEndian.Uint32(raw[12:16]),
+		CwndGain:   binary.LittleEndian.Uint32(raw[16:20]),
+	}, nil
+}
+
+// CongestionAlgorithm returns the name of the congestion control algorithm of the
+// connection, e.g. "cubic" or "bbr", from the INET_DIAG_CONG attribute, or "" if it
+// was not collected.
+func (pm *ArchivalRecord) CongestionAlgorithm() string {
+	if len(pm.Attributes) <= inetdiag.INET_DIAG_CONG {
+		return ""
+	}
+	// The name is NUL terminated.
+	return strings.TrimRight(string(pm.Attributes[inetdiag.INET_DIAG_CONG]), "\x00")
+}
+
+// ErrShortDCTCPInfo is returned when the INET_DIAG_DCTCPINFO attribute is too short.
+var ErrShortDCTCPInfo = errors.New("INET_DIAG_DCTCPINFO is shorter than struct tcp_dctcp_info")
+
+// ParseDCTCPInfo returns the DCTCP state from the INET_DIAG_DCTCPINFO attribute, or
+// nil if the connection is not using DCTCP.
+func (pm *ArchivalRecord) ParseDCTCPInfo() (*inetdiag.DCTCPInfo, error) {
+	if len(pm.Attributes) <= inetdiag.INET_DIAG_DCTCPINFO || pm.Attributes[inetdiag.INET_DIAG_DCTCPINFO] == nil {
+		return nil, nil
+	}
+	raw := pm.Attributes[inetdiag.INET_DIAG_DCTCPINFO]
+	if len(raw) < int(unsafe.Sizeof(inetdiag.DCTCPInfo{})) {
+		return nil, ErrShortDCTCPInfo
+	}
+	order := attributeOrder()
+	return &inetdiag.DCTCPInfo{
+		Enabled: order.Uint16(raw[0:2]),
+		CEState: order.Uint16(raw[2:4]),
+		Alpha:   order.Uint32(raw[4:8]),
+		ABEcn:   order.Uint32(raw[8:12]),
+		ABTot:   order.Uint32(raw[12:16]),
+	}, nil
+}
+
+// ParseSocketMemInfo returns the socket memory usage from the INET_DIAG_SKMEMINFO
+// attribute, or nil if it was not collected.  Older kernels report fewer fields,
+// e.g. no Drops, and the missing fields are zero.
+func (pm *ArchivalRecord) ParseSocketMemInfo() *inetdiag.SocketMemInfo {
+	if len(pm.Attributes) <= inetdiag.INET_DIAG_SKMEMINFO || pm.Attributes[inetdiag.INET_DIAG_SKMEMINFO] == nil {
+		return nil
+	}
+	raw := pm.Attributes[inetdiag.INET_DIAG_SKMEMINFO]
+	// The attribute is an array of uint32, in the order of the SocketMemInfo fields.
+	var v [9]uint32
+	for i := range v {
+		if len(raw) >= 4*i+4 {
+			v[i] = binary.LittleEndian.Uint32(raw[4*i:])
+		}
+	}
+	return &inetdiag.SocketMemInfo{
+		RmemAlloc: v[0], Rcvbuf: v[1], WmemAlloc: v[2], Sndbuf: v[3], FwdAlloc: v[4],
+		WmemQueued: v[5], Optmem: v[6], Backlog: v[7], Drops: v[8],
+	}
+}
+
+// IsTCP returns true if the record is for a TCP socket.
+func (pm *ArchivalRecord) IsTCP() bool {
+	return pm.Protocol == 0 || pm.Protocol == inetdiag.Protocol_IPPROTO_TCP
+}
+
 // HasDiagInfo returns true if there is a DIAG_INFO message.
 func (pm *ArchivalRecord) HasDiagInfo() bool {
 	return len(pm.Attributes) > inetdiag.INET_DIAG_INFO
@@ -344,9 +644,11 @@ func (pm *ArchivalRecord) HasDiagInfo() bool {
 var sendLogger = logx.NewLogEvery(nil, time.Second)
 var rcvLogger = logx.NewLogEvery(nil, time.Second)
 
-// GetStats returns basic stats from the TCPInfo snapshot.
+// GetStats returns basic stats from the TCPInfo snapshot.  Other protocols, including
+// MPTCP, whose bytes are counted in its TCP subflows, have no TCPInfo, so their stats
+// are zero.
 func (pm *ArchivalRecord) GetStats() (uint64, uint64) {
-	if len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
+	if !pm.IsTCP() || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
 		return 0, 0
 	}
 	raw := pm.Attributes[inetdiag.INET_DIAG_INFO]
@@ -360,6 +662,36 @@ func (pm *ArchivalRecord) GetStats() (uint64, uint64) {
 	return s, r
 }
 
+// GetDeliveryRate returns the delivery rate of the most recent sample of the
+// sender, in bytes per second, and whether the sample was application limited,
+// i.e. limited by the data the application supplied rather than by the network.
+// ok is false if there is no TCPInfo, or the kernel does not report the rate.
+func (pm *ArchivalRecord) GetDeliveryRate() (rate uint64, appLimited bool, ok bool) {
+	if !pm.IsTCP() || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
+		return 0, false, false
+	}
+	raw := pm.Attributes[inetdiag.INET_DIAG_INFO]
+	if len(raw) < int(deliveryRateOffset+8) {
+		return 0, false, false
+	}
+	rate = *(*uint64)(unsafe.Pointer(&raw[deliveryRateOffset]))
+	// The flag is the low bit of the byte, which it shares with fastopen_client_fail.
+	return rate, raw[appLimitedOffset]&1 != 0, true
+}
+
+// GetRTT returns the smoothed RTT of the connection, in microseconds.  ok is false
+// if there is no TCPInfo.  The RTT is zero until the first sample.
+func (pm *ArchivalRecord) GetRTT() (rtt uint32, ok bool) {
+	if !pm.IsTCP() || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
+		return 0, false
+	}
+	raw := pm.Attributes[inetdiag.INET_DIAG_INFO]
+	if len(raw) < int(rttOffset+4) {
+		return 0, false
+	}
+	return *(*uint32)(unsafe.Pointer(&raw[rttOffset])), true
+}
+
 // SetBytesReceived sets the field for hacking unit tests.
 func (pm *ArchivalRecord) SetBytesReceived(value uint64) uint64 {
 	if flag.Lookup("test.v") == nil {
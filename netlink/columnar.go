@@ -0,0 +1,285 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// ErrBadColumns is returned when reading a malformed columnar block.
+var ErrBadColumns = errors.New("malformed columnar block")
+
+// columnsVersion is the first byte of every columnar block.  Blocks of version 1,
+// which have no Derived fields, and of version 2, which have no SockOpts, are also
+// read.
+const columnsVersion = 3
+
+// appendVarint appends the zig-zag varint encoding of v to b.
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// ColumnBlock returns a record holding the snapshots recs, which are typically
+// consecutive snapshots of the same connection, in a columnar layout.  The block
+// has the Timestamp of the first snapshot.
+//
+// The block is the number of snapshots, their Timestamps, as the nanoseconds
+// since the previous one, their Anomalies, their Derived fields, their SockOpts,
+// and their numbers of sections.  These
+// are followed by the sections, the RawIDM and then each attribute in order of
+// type.  Each section is the lengths of the snapshots' values, and then their
+// bytes, ordered by offset and then by snapshot, so that the bytes of a field that
+// changes slowly from one snapshot to the next are adjacent, and compress well.
+// Each byte is XORed with the byte at the same offset of the previous snapshot's
+// value, so that unchanged bytes are zero.
+func ColumnBlock(recs []*ArchivalRecord) *ArchivalRecord {
+	c := []byte{columnsVersion}
+	c = appendUvarint(c, uint64(len(recs)))
+	var last int64
+	for _, r := range recs {
+		ns := r.Timestamp.UnixNano()
+		c = appendVarint(c, ns-last)
+		last = ns
+	}
+	for _, r := range recs {
+		c = appendUvarint(c, uint64(len(r.Anomaly)))
+		c = append(c, r.Anomaly...)
+	}
+	for _, r := range recs {
+		c = appendDerived(c, r.Derived)
+	}
+	for _, r := range recs {
+		c = appendSockOpts(c, r.SockOpts)
+	}
+	secs := make([][][]byte, len(recs))
+	n := 0
+	for i, r := range recs {
+		secs[i] = sections(r)
+		c = appendUvarint(c, uint64(len(secs[i])))
+		if len(secs[i]) > n {
+			n = len(secs[i])
+		}
+	}
+	for s := 0; s < n; s++ {
+		longest := 0
+		for _, sec := range secs {
+			if s >= len(sec) {
+				continue
+			}
+			if sec[s] == nil {
+				c = appendUvarint(c, 0)
+				continue
+			}
+			c = appendUvarint(c, uint64(len(sec[s])+1))
+			if len(sec[s]) > longest {
+				longest = len(sec[s])
+			}
+		}
+		for j := 0; j < longest; j++ {
+			var prev []byte
+			for _, sec := range secs {
+				if s < len(sec) && j < len(sec[s]) {
+					c = append(c, sec[s][j]^byteAt(prev, j))
+				}
+				if s < len(sec) {
+					prev = sec[s]
+				}
+			}
+		}
+	}
+	rec := &ArchivalRecord{Columns: c}
+	if len(recs) > 0 {
+		rec.Timestamp = recs[0].Timestamp
+		rec.Protocol = recs[0].Protocol
+	}
+	return rec
+}
+
+// Snapshots returns the snapshots held by a columnar block, or pm itself if it is
+// not a block.  The snapshots do not share memory with pm.
+func (pm *ArchivalRecord) Snapshots() ([]*ArchivalRecord, error) {
+	if pm.Columns == nil {
+		return []*ArchivalRecord{pm}, nil
+	}
+	r := &deltaReader{b: pm.Columns}
+	v := r.bytes(1)
+	if r.err != nil || v[0] < 1 || v[0] > columnsVersion {
+		return nil, ErrBadColumns
+	}
+	version := v[0]
+	count := r.uvarint()
+	// Every snapshot has at least a byte of timestamp.
+	if r.err != nil || count == 0 || count > len(r.b) {
+		return nil, ErrBadColumns
+	}
+	recs := make([]*ArchivalRecord, count)
+	var last int64
+	for i := range recs {
+		d, n := binary.Varint(r.b)
+		if n <= 0 {
+			return nil, ErrBadColumns
+		}
+		r.b = r.b[n:]
+		last += d
+		recs[i] = &ArchivalRecord{Timestamp: time.Unix(0, last).UTC(), Protocol: pm.Protocol}
+	}
+	for _, rec := range recs {
+		rec.Anomaly = string(r.bytes(r.uvarint()))
+	}
+	if version > 1 {
+		for _, rec := range recs {
+			rec.Derived = r.derived()
+		}
+	}
+	if version > 2 {
+		for _, rec := range recs {
+			rec.SockOpts = r.sockOpts()
+		}
+	}
+	secs := make([][][]byte, count)
+	n := 0
+	for i := range secs {
+		l := r.uvarint()
+		if r.err != nil || l == 0 || l > 1+2*inetdiag.INET_DIAG_MAX+1 {
+			return nil, ErrBadColumns
+		}
+		secs[i] = make([][]byte, l)
+		if l > n {
+			n = l
+		}
+	}
+	lengths := make([]int, count)
+	for s := 0; s < n; s++ {
+		longest := 0
+		for i, sec := range secs {
+			lengths[i] = -1
+			if s >= len(sec) {
+				continue
+			}
+			if l := r.uvarint(); l > 0 {
+				lengths[i] = l - 1
+				sec[s] = make([]byte, 0, l-1)
+				if l-1 > longest {
+					longest = l - 1
+				}
+			}
+		}
+		if r.err != nil {
+			return nil, ErrBadColumns
+		}
+		for j := 0; j < longest; j++ {
+			var prev []byte
+			for i, sec := range secs {
+				if j < lengths[i] {
+					if b := r.bytes(1); b != nil {
+						sec[s] = append(sec[s], b[0]^byteAt(prev, j))
+					}
+				}
+				if s < len(sec) {
+					prev = sec[s]
+				}
+			}
+		}
+	}
+	if r.err != nil || len(r.b) > 0 {
+		return nil, ErrBadColumns
+	}
+	for i, rec := range recs {
+		if secs[i][0] == nil {
+			return nil, ErrBadColumns
+		}
+		rec.RawIDM = secs[i][0]
+		if len(secs[i]) > 1 {
+			rec.Attributes = secs[i][1:]
+		}
+	}
+	return recs, nil
+}
+
+// appendDerived appends the number of derived fields, and then the name and the
+// bits of the value of each, in order of name.
+func appendDerived(c []byte, derived map[string]float64) []byte {
+	names := make([]string, 0, len(derived))
+	for name := range derived {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c = appendUvarint(c, uint64(len(names)))
+	var buf [8]byte
+	for _, name := range names {
+		c = appendUvarint(c, uint64(len(name)))
+		c = append(c, name...)
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(derived[name]))
+		c = append(c, buf[:]...)
+	}
+	return c
+}
+
+// derived reads the derived fields appended by appendDerived, or returns nil if
+// there are none.
+func (r *deltaReader) derived() map[string]float64 {
+	n := r.uvarint()
+	if n == 0 || r.err != nil {
+		return nil
+	}
+	derived := make(map[string]float64, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		name := string(r.bytes(r.uvarint()))
+		if b := r.bytes(8); b != nil {
+			derived[name] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+	}
+	return derived
+}
+
+// appendSockOpts appends the number of socket options, and then the name and the
+// varint value of each, in order of name.
+func appendSockOpts(c []byte, opts map[string]int64) []byte {
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c = appendUvarint(c, uint64(len(names)))
+	for _, name := range names {
+		c = appendUvarint(c, uint64(len(name)))
+		c = append(c, name...)
+		c = appendVarint(c, opts[name])
+	}
+	return c
+}
+
+// sockOpts reads the socket options appended by appendSockOpts, or returns nil if
+// there are none.
+func (r *deltaReader) sockOpts() map[string]int64 {
+	n := r.uvarint()
+	if n == 0 || r.err != nil {
+		return nil
+	}
+	opts := make(map[string]int64, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		name := string(r.bytes(r.uvarint()))
+		v, k := binary.Varint(r.b)
+		if k <= 0 {
+			r.err = ErrBadDelta
+			r.b = nil
+			break
+		}
+		r.b = r.b[k:]
+		opts[name] = v
+	}
+	return opts
+}
+
+// byteAt returns b[i], or zero if i is beyond the end of b.
+func byteAt(b []byte, i int) byte {
+	if i < len(b) {
+		return b[i]
+	}
+	return 0
+}
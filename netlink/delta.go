@@ -0,0 +1,190 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// Errors returned when reconstructing delta encoded records.
+var (
+	ErrNoDeltaBase = errors.New("delta record does not follow a snapshot")
+	ErrBadDelta    = errors.New("malformed delta record")
+)
+
+// deltaVersion is the first byte of every delta, so that it is never empty.
+const deltaVersion = 1
+
+// deltaGap is the largest run of unchanged bytes that is included in a changed run,
+// instead of starting a new run, which costs at least two bytes.
+const deltaGap = 2
+
+// appendUvarint appends the varint encoding of v to b.
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// The RawIDM and Attributes of a record are encoded as sections, with the RawIDM
+// first, followed by each attribute in order of type.
+func sections(pm *ArchivalRecord) [][]byte {
+	s := make([][]byte, 1+len(pm.Attributes))
+	s[0] = pm.RawIDM
+	copy(s[1:], pm.Attributes)
+	return s
+}
+
+// appendRuns appends the runs of bytes of b that differ from a, as the number of
+// runs, and for each the number of unchanged bytes preceding it, its length, and
+// its bytes.  Bytes beyond the end of a are compared to zero.
+func appendRuns(d []byte, a, b []byte) []byte {
+	at := func(i int) byte {
+		if i < len(a) {
+			return a[i]
+		}
+		return 0
+	}
+	var runs [][2]int // The start and end of each run.
+	for i := 0; i < len(b); i++ {
+		if b[i] == at(i) {
+			continue
+		}
+		if n := len(runs); n > 0 && i-runs[n-1][1] <= deltaGap {
+			runs[n-1][1] = i + 1
+		} else {
+			runs = append(runs, [2]int{i, i + 1})
+		}
+	}
+	d = appendUvarint(d, uint64(len(runs)))
+	end := 0
+	for _, r := range runs {
+		d = appendUvarint(d, uint64(r[0]-end))
+		d = appendUvarint(d, uint64(r[1]-r[0]))
+		d = append(d, b[r[0]:r[1]]...)
+		end = r[1]
+	}
+	return d
+}
+
+// DeltaFrom returns a record with the Timestamp, Anomaly and Derived fields of pm,
+// and its RawIDM and Attributes encoded as the changes from those of previous,
+// which is typically the previous snapshot of the same connection.  A delta for a record with the
+// same Attributes as previous is typically a few tens of bytes, instead of several
+// hundred.
+func (pm *ArchivalRecord) DeltaFrom(previous *ArchivalRecord) *ArchivalRecord {
+	prev := sections(previous)
+	next := sections(pm)
+	d := []byte{deltaVersion}
+	d = appendUvarint(d, uint64(len(next)))
+	for i, b := range next {
+		var a []byte
+		if i < len(prev) {
+			a = prev[i]
+		}
+		if (a == nil) == (b == nil) && string(a) == string(b) {
+			continue
+		}
+		d = appendUvarint(d, uint64(i))
+		if b == nil {
+			d = appendUvarint(d, 0)
+			continue
+		}
+		d = appendUvarint(d, uint64(len(b)+1))
+		d = appendRuns(d, a, b)
+	}
+	return &ArchivalRecord{Timestamp: pm.Timestamp, Anomaly: pm.Anomaly, Derived: pm.Derived, SockOpts: pm.SockOpts, Delta: d, Protocol: pm.Protocol}
+}
+
+// deltaReader reads the varints of a delta.
+type deltaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *deltaReader) uvarint() int {
+	v, n := binary.Uvarint(r.b)
+	// No section, or run within one, is longer than a netlink attribute.
+	if n <= 0 || v > 1<<16 {
+		r.err = ErrBadDelta
+		r.b = nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return int(v)
+}
+
+func (r *deltaReader) bytes(n int) []byte {
+	if n > len(r.b) {
+		r.err = ErrBadDelta
+		r.b = nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// Undelta reconstructs the RawIDM and Attributes of a delta encoded record from
+// previous, the record preceding it in the file, and clears the Delta.  It does
+// nothing if pm is not delta encoded.  The reconstructed slices do not share
+// memory with previous.
+func (pm *ArchivalRecord) Undelta(previous *ArchivalRecord) error {
+	if pm.Delta == nil {
+		return nil
+	}
+	if previous == nil || previous.RawIDM == nil {
+		return ErrNoDeltaBase
+	}
+	r := &deltaReader{b: pm.Delta}
+	if v := r.bytes(1); r.err != nil || v[0] != deltaVersion {
+		return ErrBadDelta
+	}
+	prev := sections(previous)
+	next := make([][]byte, r.uvarint())
+	if r.err != nil || len(next) == 0 || len(next) > 1+2*inetdiag.INET_DIAG_MAX+1 {
+		return ErrBadDelta
+	}
+	for i := range next {
+		if i < len(prev) && prev[i] != nil {
+			next[i] = append([]byte{}, prev[i]...)
+		}
+	}
+	last := -1
+	for len(r.b) > 0 {
+		i := r.uvarint()
+		n := r.uvarint()
+		if r.err != nil || i <= last || i >= len(next) {
+			return ErrBadDelta
+		}
+		last = i
+		if n == 0 {
+			next[i] = nil
+			continue
+		}
+		b := make([]byte, n-1)
+		copy(b, next[i])
+		next[i] = b
+		end := 0
+		for runs := r.uvarint(); runs > 0 && r.err == nil; runs-- {
+			start := end + r.uvarint()
+			length := r.uvarint()
+			run := r.bytes(length)
+			if r.err != nil || start+length > len(b) {
+				return ErrBadDelta
+			}
+			copy(b[start:], run)
+			end = start + length
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+	if next[0] == nil {
+		return ErrBadDelta
+	}
+	pm.RawIDM = next[0]
+	pm.Attributes = next[1:]
+	pm.Delta = nil
+	return nil
+}
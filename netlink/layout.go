@@ -0,0 +1,73 @@
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// ErrLayout is returned by CheckLayout when a struct does not match the kernel.
+var ErrLayout = errors.New("struct layout does not match the kernel")
+
+// fieldLayout is the expected size or offset of a struct or field, as in the
+// kernel headers.
+type fieldLayout struct {
+	name string
+	got  uintptr
+	want uintptr
+}
+
+// layouts are the sizes of the structs that raw netlink messages and attributes
+// are cast to, and the offsets of their 64-bit fields, and of the fields read
+// directly by Compare.  On 32-bit platforms, Go aligns 64-bit fields to 4 bytes,
+// so a 64-bit field following an odd number of 32-bit fields would not be padded
+// as it is in the kernel, and it and the following fields would move.
+//
+// The size of BBRInfo is not listed, because the kernel's tcp_bbr_info is 20 bytes, with its
+// bandwidth in two 32-bit fields, and is padded to 24 bytes on 64-bit platforms.
+// Attributes shorter than the Go struct are copied before they are cast, so only
+// the offsets matter.
+var layouts = []fieldLayout{
+	{"inetdiag.ReqV2", unsafe.Sizeof(inetdiag.ReqV2{}), 56},
+	{"inetdiag.LinuxSockID", unsafe.Sizeof(inetdiag.LinuxSockID{}), 48},
+	{"inetdiag.InetDiagMsg", unsafe.Sizeof(inetdiag.InetDiagMsg{}), 72},
+	{"inetdiag.MemInfo", unsafe.Sizeof(inetdiag.MemInfo{}), 16},
+	{"inetdiag.VegasInfo", unsafe.Sizeof(inetdiag.VegasInfo{}), 16},
+	{"inetdiag.DCTCPInfo", unsafe.Sizeof(inetdiag.DCTCPInfo{}), 16},
+	{"inetdiag.SocketMemInfo", unsafe.Sizeof(inetdiag.SocketMemInfo{}), 36},
+	{"inetdiag.BBRInfo.MinRTT", unsafe.Offsetof(inetdiag.BBRInfo{}.MinRTT), 8},
+	{"inetdiag.BBRInfo.CwndGain", unsafe.Offsetof(inetdiag.BBRInfo{}.CwndGain), 16},
+	{"inetdiag.MPTCPInfo", unsafe.Sizeof(inetdiag.MPTCPInfo{}), 96},
+	{"inetdiag.MPTCPInfo.WriteSeq", unsafe.Offsetof(inetdiag.MPTCPInfo{}.WriteSeq), 16},
+	{"inetdiag.MPTCPInfo.BytesRetrans", unsafe.Offsetof(inetdiag.MPTCPInfo{}.BytesRetrans), 48},
+	{"inetdiag.MPTCPInfo.LastDataSent", mptcpLastDataSentOffset, 84},
+	{"tcp.LinuxTCPInfo", unsafe.Sizeof(tcp.LinuxTCPInfo{}), 232},
+	{"tcp.LinuxTCPInfo.LastDataSent", lastDataSentOffset, 44},
+	{"tcp.LinuxTCPInfo.PMTU", pmtuOffset, 60},
+	{"tcp.LinuxTCPInfo.PacingRate", unsafe.Offsetof(tcp.LinuxTCPInfo{}.PacingRate), 104},
+	{"tcp.LinuxTCPInfo.MaxPacingRate", unsafe.Offsetof(tcp.LinuxTCPInfo{}.MaxPacingRate), 112},
+	{"tcp.LinuxTCPInfo.BytesAcked", unsafe.Offsetof(tcp.LinuxTCPInfo{}.BytesAcked), 120},
+	{"tcp.LinuxTCPInfo.BytesReceived", bytesReceivedOffset, 128},
+	{"tcp.LinuxTCPInfo.DeliveryRate", unsafe.Offsetof(tcp.LinuxTCPInfo{}.DeliveryRate), 160},
+	{"tcp.LinuxTCPInfo.BusyTime", busytimeOffset, 168},
+	{"tcp.LinuxTCPInfo.RWndLimited", unsafe.Offsetof(tcp.LinuxTCPInfo{}.RWndLimited), 176},
+	{"tcp.LinuxTCPInfo.SndBufLimited", unsafe.Offsetof(tcp.LinuxTCPInfo{}.SndBufLimited), 184},
+	{"tcp.LinuxTCPInfo.BytesSent", bytesSentOffset, 200},
+	{"tcp.LinuxTCPInfo.BytesRetrans", unsafe.Offsetof(tcp.LinuxTCPInfo{}.BytesRetrans), 208},
+}
+
+// CheckLayout verifies that the structs used to parse netlink messages have the
+// same layout as in the kernel, on the platform the binary was built for.  It
+// should be called at startup, so that a build for a new architecture fails
+// immediately, rather than recording garbage.
+func CheckLayout() error {
+	for _, l := range layouts {
+		if l.got != l.want {
+			return fmt.Errorf("%w: %s is %d, not %d", ErrLayout, l.name, l.got, l.want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// Useful offsets of struct mptcp_info.
+const (
+	mptcpTokenOffset        = unsafe.Offsetof(inetdiag.MPTCPInfo{}.Token)        // 12
+	mptcpLastDataSentOffset = unsafe.Offsetof(inetdiag.MPTCPInfo{}.LastDataSent) // 84
+)
+
+// IsMPTCP returns true if the record is for an MPTCP socket, rather than one of its
+// TCP subflows.
+func (pm *ArchivalRecord) IsMPTCP() bool {
+	return pm.Protocol == inetdiag.Protocol_IPPROTO_MPTCP
+}
+
+// attributeOrder returns the byte order of the integers in attributes.
+func attributeOrder() binary.ByteOrder {
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		return order
+	}
+	return inetdiag.Native.ByteOrder()
+}
+
+// ParseMPTCPSubflow returns the MPTCP state of a TCP subflow from its
+// INET_DIAG_ULP_INFO attribute, or nil if the socket does not have the MPTCP ULP.
+// Attributes the kernel did not report, e.g. all of them for the TCP listener of
+// an MPTCP listener, are zero.
+func ParseMPTCPSubflow(ulp []byte) (*inetdiag.MPTCPSubflowInfo, error) {
+	attrs, err := ParseRouteAttr(ulp)
+	if err != nil {
+		return nil, err
+	}
+	isMPTCP := false
+	var nested []byte
+	for _, a := range attrs {
+		// Nested attributes may have the NLA_F_NESTED flag.
+		switch a.Attr.Type & nlaTypeMask {
+		case inetdiag.INET_ULP_INFO_NAME:
+			isMPTCP = strings.TrimRight(string(a.Value), "\x00") == "mptcp"
+		case inetdiag.INET_ULP_INFO_MPTCP:
+			nested = a.Value
+		}
+	}
+	if !isMPTCP {
+		return nil, nil
+	}
+	attrs, err = ParseRouteAttr(nested)
+	if err != nil {
+		return nil, err
+	}
+	order := attributeOrder()
+	sf := &inetdiag.MPTCPSubflowInfo{}
+	for _, a := range attrs {
+		v := a.Value
+		switch a.Attr.Type & nlaTypeMask {
+		case inetdiag.MPTCP_SUBFLOW_ATTR_TOKEN_REM:
+			sf.TokenRem = u32(order, v)
+		case inetdiag.MPTCP_SUBFLOW_ATTR_TOKEN_LOC:
+			sf.TokenLoc = u32(order, v)
+		case inetdiag.MPTCP_SUBFLOW_ATTR_RELWRITE_SEQ:
+			sf.RelWriteSeq = u32(order, v)
+		case inetdiag.MPTCP_SUBFLOW_ATTR_MAP_SEQ:
+			if len(v) >= 8 {
+				sf.MapSeq = int64(order.Uint64(v))
+			}
+		case inetdiag.MPTCP_SUBFLOW_ATTR_MAP_SFSEQ:
+			sf.MapSfSeq = u32(order, v)
+		case inetdiag.MPTCP_SUBFLOW_ATTR_SSN_OFFSET:
+			sf.SsnOffset = u32(order, v)
+		case inetdiag.MPTCP_SUBFLOW_ATTR_MAP_DATALEN:
+			if len(v) >= 2 {
+				sf.MapDataLen = order.Uint16(v)
+			}
+		case inetdiag.MPTCP_SUBFLOW_ATTR_FLAGS:
+			sf.Flags = u32(order, v)
+		case inetdiag.MPTCP_SUBFLOW_ATTR_ID_REM:
+			if len(v) >= 1 {
+				sf.IDRem = v[0]
+			}
+		case inetdiag.MPTCP_SUBFLOW_ATTR_ID_LOC:
+			if len(v) >= 1 {
+				sf.IDLoc = v[0]
+			}
+		}
+	}
+	return sf, nil
+}
+
+// nlaTypeMask masks the NLA_F_NESTED and NLA_F_NET_BYTEORDER flags of an attribute type.
+const nlaTypeMask = 0x3fff
+
+// u32 returns the uint32 at the start of v, or zero if v is too short.
+func u32(order binary.ByteOrder, v []byte) uint32 {
+	if len(v) < 4 {
+		return 0
+	}
+	return order.Uint32(v)
+}
+
+// MPTCPToken returns the local token of the MPTCP connection of the record, which
+// is that of an MPTCP socket, or of one of its TCP subflows.  ok is false for other
+// sockets, and for MPTCP sockets that have not yet connected.
+func (pm *ArchivalRecord) MPTCPToken() (token uint32, ok bool) {
+	if pm.IsMPTCP() {
+		if len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
+			return 0, false
+		}
+		raw := pm.Attributes[inetdiag.INET_DIAG_INFO]
+		if len(raw) < int(mptcpTokenOffset+4) {
+			return 0, false
+		}
+		token = attributeOrder().Uint32(raw[mptcpTokenOffset:])
+		return token, token != 0
+	}
+	if !pm.IsTCP() || len(pm.Attributes) <= inetdiag.INET_DIAG_ULP_INFO || pm.Attributes[inetdiag.INET_DIAG_ULP_INFO] == nil {
+		return 0, false
+	}
+	sf, err := ParseMPTCPSubflow(pm.Attributes[inetdiag.INET_DIAG_ULP_INFO])
+	if sf == nil || err != nil {
+		return 0, false
+	}
+	return sf.TokenLoc, sf.TokenLoc != 0
+}
+
+// protocolOf returns the protocol named in the Metadata of a file, e.g. "udp", as
+// named by the saver.
+func protocolOf(name string) inetdiag.Protocol {
+	if name == "" {
+		return 0
+	}
+	for p, n := range inetdiag.ProtocolName {
+		if strings.EqualFold(n, "IPPROTO_"+name) {
+			return inetdiag.Protocol(p)
+		}
+	}
+	p, _ := strconv.ParseUint(name, 10, 16)
+	return inetdiag.Protocol(p)
+}
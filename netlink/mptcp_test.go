@@ -0,0 +1,112 @@
+package netlink_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// rtattr returns a netlink attribute, padded to 4 bytes.
+func rtattr(typ uint16, value []byte) []byte {
+	b := make([]byte, 4, 4+len(value)+3)
+	binary.LittleEndian.PutUint16(b, uint16(4+len(value)))
+	binary.LittleEndian.PutUint16(b[2:], typ)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func TestParseMPTCPSubflow(t *testing.T) {
+	name := rtattr(inetdiag.INET_ULP_INFO_NAME, []byte("mptcp\x00"))
+	// The kernel may set NLA_F_NESTED on the nested attribute.
+	nested := rtattr(inetdiag.INET_ULP_INFO_MPTCP|0x8000, append(append(append(
+		rtattr(inetdiag.MPTCP_SUBFLOW_ATTR_TOKEN_REM, u32(0xaabbccdd)),
+		rtattr(inetdiag.MPTCP_SUBFLOW_ATTR_TOKEN_LOC, u32(0x01020304))...),
+		rtattr(inetdiag.MPTCP_SUBFLOW_ATTR_MAP_DATALEN, []byte{0x10, 0x00})...),
+		rtattr(inetdiag.MPTCP_SUBFLOW_ATTR_ID_LOC, []byte{3})...))
+
+	sf, err := netlink.ParseMPTCPSubflow(append(append([]byte{}, name...), nested...))
+	rtx.Must(err, "Could not parse")
+	want := inetdiag.MPTCPSubflowInfo{TokenRem: 0xaabbccdd, TokenLoc: 0x01020304, MapDataLen: 16, IDLoc: 3}
+	if sf == nil || *sf != want {
+		t.Errorf("ParseMPTCPSubflow() = %+v, want %+v", sf, want)
+	}
+
+	// The TCP socket of an MPTCP listener has the ULP, but no subflow state.
+	sf, err = netlink.ParseMPTCPSubflow(name)
+	rtx.Must(err, "Could not parse")
+	if sf == nil || *sf != (inetdiag.MPTCPSubflowInfo{}) {
+		t.Errorf("ParseMPTCPSubflow() = %+v, want an empty struct", sf)
+	}
+
+	sf, err = netlink.ParseMPTCPSubflow(rtattr(inetdiag.INET_ULP_INFO_NAME, []byte("tls\x00")))
+	if sf != nil || err != nil {
+		t.Error("Other ULPs should be ignored", sf, err)
+	}
+}
+
+func TestMPTCPToken(t *testing.T) {
+	info := make([]byte, 96)
+	binary.LittleEndian.PutUint32(info[12:], 0x01020304)
+	ulp := append(rtattr(inetdiag.INET_ULP_INFO_NAME, []byte("mptcp\x00")),
+		rtattr(inetdiag.INET_ULP_INFO_MPTCP, rtattr(inetdiag.MPTCP_SUBFLOW_ATTR_TOKEN_LOC, u32(0x01020304)))...)
+	attrs := make([][]byte, inetdiag.INET_DIAG_ULP_INFO+1)
+
+	msk := &netlink.ArchivalRecord{Protocol: inetdiag.Protocol_IPPROTO_MPTCP, Attributes: attrs[:inetdiag.INET_DIAG_INFO+1]}
+	if _, ok := msk.MPTCPToken(); ok {
+		t.Error("An MPTCP socket without mptcp_info has no token")
+	}
+	msk.Attributes[inetdiag.INET_DIAG_INFO] = info
+	if token, ok := msk.MPTCPToken(); !ok || token != 0x01020304 || !msk.IsMPTCP() || msk.IsTCP() {
+		t.Errorf("MPTCPToken() = %x, %v", token, ok)
+	}
+
+	subflow := &netlink.ArchivalRecord{Protocol: inetdiag.Protocol_IPPROTO_TCP, Attributes: make([][]byte, len(attrs))}
+	if _, ok := subflow.MPTCPToken(); ok {
+		t.Error("A TCP socket without the ULP has no token")
+	}
+	subflow.Attributes[inetdiag.INET_DIAG_ULP_INFO] = ulp
+	if token, ok := subflow.MPTCPToken(); !ok || token != 0x01020304 || subflow.IsMPTCP() {
+		t.Errorf("MPTCPToken() = %x, %v", token, ok)
+	}
+}
+
+func TestCompareMPTCP(t *testing.T) {
+	info := make([]byte, 96)
+	idm := make(inetdiag.RawInetDiagMsg, unsafe.Sizeof(inetdiag.InetDiagMsg{}))
+	a := &netlink.ArchivalRecord{Protocol: inetdiag.Protocol_IPPROTO_MPTCP, RawIDM: idm, Attributes: [][]byte{inetdiag.INET_DIAG_INFO: info}}
+	b := &netlink.ArchivalRecord{Protocol: inetdiag.Protocol_IPPROTO_MPTCP, RawIDM: idm, Attributes: [][]byte{inetdiag.INET_DIAG_INFO: append([]byte{}, info...)}}
+
+	// The last_* times are ignored.
+	b.Attributes[inetdiag.INET_DIAG_INFO][90] = 1
+	diff, err := b.Compare(a)
+	rtx.Must(err, "")
+	if diff != netlink.NoMajorChange {
+		t.Error("Last field changes should not be detected:", diff)
+	}
+	// Counters are not.
+	b.Attributes[inetdiag.INET_DIAG_INFO][56] = 1
+	diff, err = b.Compare(a)
+	rtx.Must(err, "")
+	if diff != netlink.Other {
+		t.Error("Counter change not detected:", diff)
+	}
+	b.Attributes[inetdiag.INET_DIAG_INFO] = info[:84]
+	diff, err = b.Compare(a)
+	rtx.Must(err, "")
+	if diff != netlink.AttributeLength {
+		t.Error("Length change not detected:", diff)
+	}
+}
@@ -1,12 +1,38 @@
 package netlink
 
-import "time"
+import (
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/snmp"
+)
 
 // MessageBlock contains timestamps and message arrays for v4 and v6 from a single collection cycle.
+// If the start times are set, each message is timestamped by interpolating between the start
+// time and the receive time, according to its position in the dump.  Otherwise all the messages
+// are timestamped with the receive time.
 type MessageBlock struct {
+	V4Start    time.Time         // Time at which the netlink dump was requested.
 	V4Time     time.Time         // Time at which netlink message block was received.
 	V4Messages []*NetlinkMessage // Array of raw messages.
 
+	V6Start    time.Time
 	V6Time     time.Time
 	V6Messages []*NetlinkMessage
+
+	// Other holds the messages for protocols other than TCP, e.g. UDP, if they
+	// are collected.
+	Other []ProtocolMessages
+
+	// Host holds the host-wide TCP counters read in the same cycle, if they are
+	// collected.
+	Host *snmp.Counters
+}
+
+// ProtocolMessages contains the messages of both families for a protocol other than TCP.
+type ProtocolMessages struct {
+	Protocol inetdiag.Protocol
+	Start    time.Time
+	Time     time.Time
+	Messages []*NetlinkMessage
 }
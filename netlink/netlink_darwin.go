@@ -5,6 +5,8 @@ import (
 	"errors"
 	"syscall"
 	"unsafe"
+
+	"github.com/m-lab/tcp-info/inetdiag"
 )
 
 /*******************************************************************************************/
@@ -62,8 +64,17 @@ func rtaAlignOf(attrlen int) int {
 	return (attrlen + RTA_ALIGNTO - 1) & ^(RTA_ALIGNTO - 1)
 }
 
+// netlinkRouteAttrAndValue returns the header and value of the route attribute at
+// the start of b, and the aligned length of the attribute, decoding the header
+// with the inetdiag.CurrentDecoder.
 func netlinkRouteAttrAndValue(b []byte) (*RtAttr, []byte, int, error) {
+	if len(b) < SizeofRtAttr {
+		return nil, nil, 0, EINVAL
+	}
 	a := (*RtAttr)(unsafe.Pointer(&b[0]))
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		a = &RtAttr{Len: order.Uint16(b[0:2]), Type: order.Uint16(b[2:4])}
+	}
 	if int(a.Len) < SizeofRtAttr || int(a.Len) > len(b) {
 		return nil, nil, 0, EINVAL
 	}
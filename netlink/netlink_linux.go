@@ -6,6 +6,7 @@ import (
 	"syscall"
 	"unsafe"
 
+	"github.com/m-lab/tcp-info/inetdiag"
 	"golang.org/x/sys/unix"
 )
 
@@ -39,8 +40,17 @@ func rtaAlignOf(attrlen int) int {
 	return (attrlen + unix.RTA_ALIGNTO - 1) & ^(unix.RTA_ALIGNTO - 1)
 }
 
+// netlinkRouteAttrAndValue returns the header and value of the route attribute at
+// the start of b, and the aligned length of the attribute, decoding the header
+// with the inetdiag.CurrentDecoder.
 func netlinkRouteAttrAndValue(b []byte) (*unix.RtAttr, []byte, int, error) {
+	if len(b) < unix.SizeofRtAttr {
+		return nil, nil, 0, unix.EINVAL
+	}
 	a := (*unix.RtAttr)(unsafe.Pointer(&b[0]))
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		a = &unix.RtAttr{Len: order.Uint16(b[0:2]), Type: order.Uint16(b[2:4])}
+	}
 	if int(a.Len) < unix.SizeofRtAttr || int(a.Len) > len(b) {
 		return nil, nil, 0, unix.EINVAL
 	}
@@ -1,6 +1,8 @@
 package netlink_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -15,6 +17,7 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
 	"github.com/m-lab/tcp-info/tcp"
 	"github.com/m-lab/tcp-info/zstd"
 )
@@ -103,6 +106,32 @@ func TestParseGarbage(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// FuzzParseRouteAttr checks that the native decoder parses attributes as the
+// unsafe decoder does, and that the parser never panics.
+func FuzzParseRouteAttr(f *testing.F) {
+	f.Add([]byte{8, 0, 1, 0, 1, 2, 3, 4, 5, 0, 2, 0, 9, 0, 0, 0})
+	f.Add([]byte{3, 0, 1, 0})
+	// The last attribute is not padded.
+	f.Add([]byte{5, 0, 1, 0, 9})
+	f.Add([]byte{255, 255, 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		defer inetdiag.SetDecoder(inetdiag.Unsafe)
+		inetdiag.SetDecoder(inetdiag.Unsafe)
+		want, wantErr := netlink.ParseRouteAttr(b)
+		inetdiag.SetDecoder(inetdiag.Native)
+		got, err := netlink.ParseRouteAttr(b)
+		if err != wantErr {
+			t.Fatalf("Native decoder error %v != unsafe decoder error %v", err, wantErr)
+		}
+		if diff := deep.Equal(got, want); diff != nil {
+			t.Error("Native decoder differs:", diff)
+		}
+		inetdiag.SetDecoder(inetdiag.BigEndian)
+		netlink.ParseRouteAttr(b)
+	})
+}
+
 func TestReader(t *testing.T) {
 	// Cache info new 140  err 0 same 277 local 789 diff 3 total 1209
 	// 1209 sockets 143 remotes 403 per iteration
@@ -178,6 +207,25 @@ func TestCompare(t *testing.T) {
 		t.Error("Late field change not detected:", deep.Equal(mp1.Attributes[inetdiag.INET_DIAG_INFO],
 			mp2.Attributes[inetdiag.INET_DIAG_INFO]))
 	}
+
+	// Older kernels report shorter structs, which end before BusyTime, or even PMTU.
+	for _, length := range []int{104, 60} {
+		mp1.Attributes[inetdiag.INET_DIAG_INFO] = mp1.Attributes[inetdiag.INET_DIAG_INFO][:length]
+		mp2.Attributes[inetdiag.INET_DIAG_INFO] = append([]byte{}, mp1.Attributes[inetdiag.INET_DIAG_INFO]...)
+		diff, err = mp1.Compare(mp2)
+		rtx.Must(err, "")
+		if diff != netlink.NoMajorChange {
+			t.Error("Short TCPInfo should compare equal:", length, diff)
+		}
+		mp2.Attributes[inetdiag.INET_DIAG_INFO][length-1]++
+		if diff, _ = mp1.Compare(mp2); length > int(pmtuOffset) && diff != netlink.StateOrCounterChange {
+			t.Error("Short TCPInfo change not detected:", length, diff)
+		}
+		mp2.Attributes[inetdiag.INET_DIAG_INFO] = mp2.Attributes[inetdiag.INET_DIAG_INFO][:length-4]
+		if diff, _ = mp1.Compare(mp2); diff != netlink.AttributeLength {
+			t.Error("TCPInfo length change not detected:", length, diff)
+		}
+	}
 }
 
 func TestNLMsgSerialize(t *testing.T) {
@@ -436,6 +484,256 @@ func TestGetStats(t *testing.T) {
 	}
 }
 
+func TestGetDeliveryRate(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read test data")
+	limited := 0
+	for i, ar := range msgs {
+		rate, appLimited, ok := ar.GetDeliveryRate()
+		_, snap, err := snapshot.Decode(ar)
+		rtx.Must(err, "Could not decode record %d", i)
+		if !ok {
+			if snap.TCPInfo != nil {
+				t.Errorf("Record %d has TCPInfo, but no delivery rate", i)
+			}
+			continue
+		}
+		if rate != uint64(snap.TCPInfo.DeliveryRate) || appLimited != (snap.TCPInfo.AppLimited&1 != 0) {
+			t.Errorf("Record %d: got %d %v, want %d %d", i, rate, appLimited, snap.TCPInfo.DeliveryRate, snap.TCPInfo.AppLimited)
+		}
+		if appLimited {
+			limited++
+		}
+	}
+	// The NDT test has samples that were app limited, and samples that were not.
+	if limited == 0 || limited == len(msgs) {
+		t.Error("Expected some app limited samples, got", limited, "of", len(msgs))
+	}
+	if _, _, ok := (&netlink.ArchivalRecord{}).GetDeliveryRate(); ok {
+		t.Error("A record without TCPInfo has no delivery rate")
+	}
+}
+
+func TestGetRTT(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read test data")
+	for i, ar := range msgs {
+		rtt, ok := ar.GetRTT()
+		_, snap, err := snapshot.Decode(ar)
+		rtx.Must(err, "Could not decode record %d", i)
+		if ok != (snap.TCPInfo != nil) || ok && rtt != snap.TCPInfo.RTT {
+			t.Errorf("Record %d: got %d %v", i, rtt, ok)
+		}
+	}
+	if _, ok := (&netlink.ArchivalRecord{}).GetRTT(); ok {
+		t.Error("A record without TCPInfo has no RTT")
+	}
+}
+
+func TestParseBBRInfo(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read test data")
+	ar := msgs[1]
+	bbr, err := ar.ParseBBRInfo()
+	if bbr != nil || err != nil {
+		t.Error("Expected no BBRInfo, got", bbr, err)
+	}
+
+	// struct tcp_bbr_info, with a bandwidth above 2^32 bytes per second.
+	raw := []byte{
+		0x10, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // bbr_bw_lo, bbr_bw_hi
+		0xE8, 0x03, 0x00, 0x00, // bbr_min_rtt
+		0xB9, 0x02, 0x00, 0x00, // bbr_pacing_gain
+		0x00, 0x02, 0x00, 0x00, // bbr_cwnd_gain
+	}
+	for len(ar.Attributes) <= inetdiag.INET_DIAG_BBRINFO {
+		ar.Attributes = append(ar.Attributes, nil)
+	}
+	ar.Attributes[inetdiag.INET_DIAG_BBRINFO] = raw
+	bbr, err = ar.ParseBBRInfo()
+	rtx.Must(err, "Could not parse BBRInfo")
+	want := inetdiag.BBRInfo{BW: 1<<32 + 16, MinRTT: 1000, PacingGain: 697, CwndGain: 512}
+	if *bbr != want {
+		t.Errorf("ParseBBRInfo() = %+v, want %+v", *bbr, want)
+	}
+
+	// The Snapshot decodes the same values, and includes them in its JSON.
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode snapshot")
+	if snap.BBRInfo == nil || *snap.BBRInfo != want {
+		t.Errorf("Snapshot.BBRInfo = %+v, want %+v", snap.BBRInfo, want)
+	}
+	j, err := json.Marshal(snap)
+	rtx.Must(err, "Could not marshal snapshot")
+	if !strings.Contains(string(j), `"BBRInfo":{"BW":4294967312,"MinRTT":1000,"PacingGain":697,"CwndGain":512}`) {
+		t.Error("Missing BBRInfo in", string(j))
+	}
+
+	ar.Attributes[inetdiag.INET_DIAG_BBRINFO] = raw[:16]
+	if _, err := ar.ParseBBRInfo(); err != netlink.ErrShortBBRInfo {
+		t.Error("Expected ErrShortBBRInfo, got", err)
+	}
+}
+
+func TestParseDCTCPInfo(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read test data")
+	ar := msgs[1]
+	dctcp, err := ar.ParseDCTCPInfo()
+	if dctcp != nil || err != nil {
+		t.Error("Expected no DCTCPInfo, got", dctcp, err)
+	}
+
+	// struct tcp_dctcp_info
+	raw := []byte{
+		0x01, 0x00, 0x01, 0x00, // dctcp_enabled, dctcp_ce_state
+		0x00, 0x01, 0x00, 0x00, // dctcp_alpha
+		0xA8, 0x05, 0x00, 0x00, // dctcp_ab_ecn
+		0x50, 0x46, 0x00, 0x00, // dctcp_ab_tot
+	}
+	for len(ar.Attributes) <= inetdiag.INET_DIAG_DCTCPINFO {
+		ar.Attributes = append(ar.Attributes, nil)
+	}
+	ar.Attributes[inetdiag.INET_DIAG_DCTCPINFO] = raw
+	dctcp, err = ar.ParseDCTCPInfo()
+	rtx.Must(err, "Could not parse DCTCPInfo")
+	want := inetdiag.DCTCPInfo{Enabled: 1, CEState: 1, Alpha: 256, ABEcn: 1448, ABTot: 18000}
+	if *dctcp != want {
+		t.Errorf("ParseDCTCPInfo() = %+v, want %+v", *dctcp, want)
+	}
+
+	// The Snapshot decodes the same values, and includes them in its JSON.
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode snapshot")
+	if snap.DCTCPInfo == nil || *snap.DCTCPInfo != want {
+		t.Errorf("Snapshot.DCTCPInfo = %+v, want %+v", snap.DCTCPInfo, want)
+	}
+	j, err := json.Marshal(snap)
+	rtx.Must(err, "Could not marshal snapshot")
+	if !strings.Contains(string(j), `"DCTCPInfo":{"Enabled":1,"CEState":1,"Alpha":256,"ABEcn":1448,"ABTot":18000}`) {
+		t.Error("Missing DCTCPInfo in", string(j))
+	}
+
+	// A change in alpha, or in the ECN counters, is a significant change.
+	prev := *ar
+	prev.Attributes = append([][]byte(nil), ar.Attributes...)
+	if diff, err := ar.Compare(&prev); diff != netlink.NoMajorChange || err != nil {
+		t.Error("Expected no change, got", diff, err)
+	}
+	changed := append([]byte(nil), raw...)
+	changed[4] = 0x80 // dctcp_alpha
+	prev.Attributes[inetdiag.INET_DIAG_DCTCPINFO] = changed
+	if diff, err := ar.Compare(&prev); diff != netlink.DCTCPChange || err != nil {
+		t.Error("Expected DCTCPChange, got", diff, err)
+	}
+	changed = append([]byte(nil), raw...)
+	changed[12] = 0xA0 // dctcp_ab_tot
+	prev.Attributes[inetdiag.INET_DIAG_DCTCPINFO] = changed
+	if diff, err := ar.Compare(&prev); diff != netlink.DCTCPChange || err != nil {
+		t.Error("Expected DCTCPChange, got", diff, err)
+	}
+	prev.Attributes[inetdiag.INET_DIAG_DCTCPINFO] = raw[:12]
+	if diff, err := ar.Compare(&prev); diff != netlink.AttributeLength || err != nil {
+		t.Error("Expected AttributeLength, got", diff, err)
+	}
+
+	ar.Attributes[inetdiag.INET_DIAG_DCTCPINFO] = raw[:12]
+	if _, err := ar.ParseDCTCPInfo(); err != netlink.ErrShortDCTCPInfo {
+		t.Error("Expected ErrShortDCTCPInfo, got", err)
+	}
+}
+
+func TestCongestionAlgorithm(t *testing.T) {
+	if cc := (&netlink.ArchivalRecord{}).CongestionAlgorithm(); cc != "" {
+		t.Error("Expected no congestion algorithm, got", cc)
+	}
+	rdr := zstd.NewReader("testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read test data")
+	ar := msgs[1]
+	if cc := ar.CongestionAlgorithm(); cc != "cubic" {
+		t.Errorf("CongestionAlgorithm() = %q, want cubic", cc)
+	}
+
+	// A switch of congestion control is a significant change.
+	prev := *ar
+	prev.Attributes = append([][]byte(nil), ar.Attributes...)
+	if diff, err := ar.Compare(&prev); diff != netlink.NoMajorChange || err != nil {
+		t.Error("Expected no change, got", diff, err)
+	}
+	prev.Attributes[inetdiag.INET_DIAG_CONG] = []byte("bbr\x00")
+	if diff, err := ar.Compare(&prev); diff != netlink.CongestionChange || err != nil {
+		t.Error("Expected CongestionChange, got", diff, err)
+	}
+	if cc := prev.CongestionAlgorithm(); cc != "bbr" {
+		t.Errorf("CongestionAlgorithm() = %q, want bbr", cc)
+	}
+	prev.Attributes[inetdiag.INET_DIAG_CONG] = nil
+	if diff, err := ar.Compare(&prev); diff != netlink.NewAttribute || err != nil {
+		t.Error("Expected NewAttribute, got", diff, err)
+	}
+
+	// The Snapshot decodes the same name.
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode snapshot")
+	if snap.CongestionAlgorithm != "cubic" {
+		t.Errorf("Snapshot.CongestionAlgorithm = %q, want cubic", snap.CongestionAlgorithm)
+	}
+}
+
+func TestParseSocketMemInfo(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read test data")
+	// The typed fields agree with the Snapshot, which maps the struct onto the attribute.
+	n := 0
+	for _, ar := range msgs {
+		mem := ar.ParseSocketMemInfo()
+		if mem == nil {
+			continue
+		}
+		n++
+		_, snap, err := snapshot.Decode(ar)
+		rtx.Must(err, "Could not decode snapshot")
+		if snap.SocketMem == nil || *mem != *snap.SocketMem {
+			t.Fatalf("ParseSocketMemInfo() = %+v, Snapshot has %+v", *mem, snap.SocketMem)
+		}
+	}
+	if n == 0 {
+		t.Fatal("No SKMEMINFO in the test data")
+	}
+
+	ar := &netlink.ArchivalRecord{}
+	if ar.ParseSocketMemInfo() != nil {
+		t.Error("Expected nil for a record without SKMEMINFO")
+	}
+	// Kernels before 2.6.34 reported no Drops.
+	ar.Attributes = make([][]byte, inetdiag.INET_DIAG_SKMEMINFO+1)
+	ar.Attributes[inetdiag.INET_DIAG_SKMEMINFO] = []byte{1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 5, 0, 0, 0, 6, 0, 0, 0, 7, 0, 0, 0, 8, 0, 0, 0}
+	want := inetdiag.SocketMemInfo{RmemAlloc: 1, Rcvbuf: 2, WmemAlloc: 3, Sndbuf: 4, FwdAlloc: 5, WmemQueued: 6, Optmem: 7, Backlog: 8}
+	if mem := ar.ParseSocketMemInfo(); *mem != want {
+		t.Errorf("ParseSocketMemInfo() = %+v, want %+v", *mem, want)
+	}
+}
+
+func TestCheckLayout(t *testing.T) {
+	// This fails if the structs do not match the kernel on the GOARCH under test,
+	// e.g. GOARCH=386 go test ./netlink.
+	if err := netlink.CheckLayout(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestLoadAllArchivalRecords(t *testing.T) {
 	source := "testdata/testdata.zst"
 	log.Println("Reading messages from", source)
@@ -458,3 +756,182 @@ func TestLoadAllArchivalRecords(t *testing.T) {
 		t.Error("Wrong count:", parsed)
 	}
 }
+
+func TestDelta(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read records")
+
+	// Write the snapshots as deltas, and read them back.
+	var buf bytes.Buffer
+	var full, deltas int
+	var prev *netlink.ArchivalRecord
+	for _, rec := range records {
+		b, err := json.Marshal(rec)
+		rtx.Must(err, "Could not marshal")
+		full += len(b)
+		if prev != nil && rec.RawIDM != nil {
+			b, err = json.Marshal(rec.DeltaFrom(prev))
+			rtx.Must(err, "Could not marshal")
+		}
+		deltas += len(b)
+		buf.Write(append(b, '\n'))
+		if rec.RawIDM != nil {
+			prev = rec
+		}
+	}
+	got, err := netlink.LoadAllArchivalRecords(&buf)
+	rtx.Must(err, "Could not read deltas")
+	if diff := deep.Equal(got, records); diff != nil {
+		t.Error("Reconstructed records differ:", diff)
+	}
+	t.Logf("Full records are %d bytes, and deltas %d", full, deltas)
+	if deltas*3 > full {
+		t.Errorf("Deltas are %d bytes, and full records %d", deltas, full)
+	}
+}
+
+func TestUndelta(t *testing.T) {
+	base := &netlink.ArchivalRecord{
+		RawIDM:     []byte{1, 2, 3, 4},
+		Attributes: [][]byte{nil, {1, 2}, {3, 4, 5, 6, 7, 8, 9, 10}},
+	}
+	tests := []struct {
+		name string
+		rec  *netlink.ArchivalRecord
+	}{
+		{"same", &netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3, 4}, Attributes: [][]byte{nil, {1, 2}, {3, 4, 5, 6, 7, 8, 9, 10}}}},
+		{"changed", &netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3, 5}, Attributes: [][]byte{nil, {1, 2}, {0, 4, 5, 6, 7, 8, 9, 11}}}},
+		{"longer", &netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3, 4}, Attributes: [][]byte{nil, {1, 2, 0, 0, 7}, {3, 4, 5, 6, 7, 8, 9, 10}}}},
+		{"shorter", &netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3, 4}, Attributes: [][]byte{nil, {1, 2}, {3, 4}}}},
+		{"empty", &netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3, 4}, Attributes: [][]byte{nil, {}, {3, 4, 5, 6, 7, 8, 9, 10}}}},
+		{"added", &netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3, 4}, Attributes: [][]byte{{0, 0}, {1, 2}, {3, 4, 5, 6, 7, 8, 9, 10}, nil, {6}}}},
+		{"removed", &netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3, 4}, Attributes: [][]byte{nil, nil}}},
+		{"anomaly", &netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3, 4}, Attributes: [][]byte{nil, {1, 2}}, Anomaly: "state"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.rec.DeltaFrom(base))
+			rtx.Must(err, "Could not marshal")
+			var got netlink.ArchivalRecord
+			rtx.Must(json.Unmarshal(b, &got), "Could not unmarshal")
+			rtx.Must(got.Undelta(base), "Could not undelta")
+			if diff := deep.Equal(&got, tt.rec); diff != nil {
+				t.Error(diff)
+			}
+			// The base is not modified.
+			if base.Attributes[2][0] != 3 {
+				t.Error("The base was modified")
+			}
+		})
+	}
+
+	rec := &netlink.ArchivalRecord{Delta: []byte{1, 1}}
+	if err := rec.Undelta(nil); err != netlink.ErrNoDeltaBase {
+		t.Error("Expected ErrNoDeltaBase, got", err)
+	}
+	for _, d := range [][]byte{
+		{0, 1},                   // Bad version.
+		{1, 0},                   // No sections.
+		{1, 2, 1, 3, 1, 0},       // Run beyond the end of the section.
+		{1, 2, 1, 3, 1, 0, 2, 7}, // Truncated run.
+		{1, 2, 2, 0},             // Section out of range.
+		{1, 2, 0, 0},             // No RawIDM.
+		{1, 2, 1, 0, 1, 0},       // Sections out of order.
+	} {
+		rec := &netlink.ArchivalRecord{Delta: d}
+		if err := rec.Undelta(base); err != netlink.ErrBadDelta {
+			t.Errorf("Undelta(%v) = %v, want ErrBadDelta", d, err)
+		}
+	}
+}
+
+func TestColumnBlock(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read records")
+
+	// Write the snapshots in blocks of 16, and read them back.
+	compressed := func(recs []*netlink.ArchivalRecord) (*bytes.Buffer, int) {
+		var buf, z bytes.Buffer
+		for _, rec := range recs {
+			b, err := json.Marshal(rec)
+			rtx.Must(err, "Could not marshal")
+			buf.Write(append(b, '\n'))
+		}
+		w := zstd.NewInProcessStreamWriter(&z, 0)
+		_, err := w.Write(buf.Bytes())
+		rtx.Must(err, "Could not compress")
+		rtx.Must(w.Close(), "Could not compress")
+		return &buf, z.Len()
+	}
+	blocks := []*netlink.ArchivalRecord{records[0]}
+	for i := 1; i < len(records); i += 16 {
+		end := i + 16
+		if end > len(records) {
+			end = len(records)
+		}
+		blocks = append(blocks, netlink.ColumnBlock(records[i:end]))
+	}
+	_, full := compressed(records)
+	buf, columnar := compressed(blocks)
+	got, err := netlink.LoadAllArchivalRecords(buf)
+	rtx.Must(err, "Could not read blocks")
+	if diff := deep.Equal(got, records); diff != nil {
+		t.Error("Reconstructed records differ:", diff)
+	}
+	t.Logf("Compressed records are %d bytes, and blocks %d", full, columnar)
+	if columnar*5 > full*4 {
+		t.Errorf("Compressed blocks are %d bytes, and records %d", columnar, full)
+	}
+
+	// Truncated and corrupted blocks are rejected.
+	block := netlink.ColumnBlock(records[1:5])
+	for i := 0; i < len(block.Columns); i++ {
+		bad := &netlink.ArchivalRecord{Columns: block.Columns[:i]}
+		if _, err := bad.Snapshots(); err != netlink.ErrBadColumns {
+			t.Errorf("Snapshots() of %d bytes returned %v", i, err)
+		}
+	}
+	bad := &netlink.ArchivalRecord{Columns: append(append([]byte{}, block.Columns...), 0)}
+	if _, err := bad.Snapshots(); err != netlink.ErrBadColumns {
+		t.Errorf("Snapshots() with trailing bytes returned %v", err)
+	}
+
+	// Derived fields and SockOpts are kept, in blocks and deltas.
+	recs := []*netlink.ArchivalRecord{records[1], records[2]}
+	recs[1] = &netlink.ArchivalRecord{Timestamp: records[2].Timestamp, RawIDM: records[2].RawIDM, Attributes: records[2].Attributes,
+		Derived:  map[string]float64{"rate": 1.5, "cwnd_change": -2},
+		SockOpts: map[string]int64{"SO_SNDBUF": 87040, "SO_MARK": -1}}
+	got, err = netlink.ColumnBlock(recs).Snapshots()
+	rtx.Must(err, "Could not read block")
+	if diff := deep.Equal(got, recs); diff != nil {
+		t.Error("Reconstructed records differ:", diff)
+	}
+	if d := recs[1].DeltaFrom(recs[0]); d.Derived["rate"] != 1.5 || d.SockOpts["SO_SNDBUF"] != 87040 {
+		t.Errorf("Wrong delta %+v", d)
+	}
+
+	// Blocks of version 1 have no Derived fields, and those of version 2 no
+	// SockOpts, after the Anomalies.
+	block = netlink.ColumnBlock(records[1:3])
+	var buf2 [binary.MaxVarintLen64]byte
+	k := 2 + binary.PutVarint(buf2[:], records[1].Timestamp.UnixNano()) +
+		binary.PutVarint(buf2[:], records[2].Timestamp.UnixNano()-records[1].Timestamp.UnixNano()) + 2
+	v1 := append([]byte{1}, block.Columns[1:k]...)
+	v1 = append(v1, block.Columns[k+4:]...)
+	got, err = (&netlink.ArchivalRecord{Columns: v1}).Snapshots()
+	rtx.Must(err, "Could not read version 1 block")
+	if diff := deep.Equal(got, records[1:3]); diff != nil {
+		t.Error("Version 1 records differ:", diff)
+	}
+	v2 := append([]byte{2}, block.Columns[1:k+2]...)
+	v2 = append(v2, block.Columns[k+4:]...)
+	got, err = (&netlink.ArchivalRecord{Columns: v2}).Snapshots()
+	rtx.Must(err, "Could not read version 2 block")
+	if diff := deep.Equal(got, records[1:3]); diff != nil {
+		t.Error("Version 2 records differ:", diff)
+	}
+}
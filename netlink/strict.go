@@ -0,0 +1,42 @@
+package netlink
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Anomalies in the netlink messages, e.g. attribute types beyond those kept,
+// repeated attributes, messages too short to parse, and sockets without a cookie,
+// are normally logged, and the message, or attribute, skipped.  In strict mode,
+// for development and CI, they are errors that include a hex dump of the whole
+// message, so that gaps in the parser cannot be missed.
+
+// ErrStrict is wrapped by the errors returned for anomalies in strict mode.
+var ErrStrict = errors.New("strict mode")
+
+var strict int32
+
+// SetStrict enables or disables strict mode for the whole process.  It should be
+// called before any messages are parsed.
+func SetStrict(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&strict, v)
+}
+
+// Strict returns true if strict mode is enabled.
+func Strict() bool {
+	return atomic.LoadInt32(&strict) != 0
+}
+
+// strictError returns an error wrapping ErrStrict, describing an anomaly in msg,
+// with a hex dump of the message.
+func strictError(msg *NetlinkMessage, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s, in message of type %d, length %d, flags %#x, seq %d:\n%s",
+		ErrStrict, fmt.Sprintf(format, args...),
+		msg.Header.Type, msg.Header.Len, msg.Header.Flags, msg.Header.Seq, hex.Dump(msg.Data))
+}
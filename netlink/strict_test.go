@@ -0,0 +1,90 @@
+package netlink_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// strictMsg returns a netlink message for a TCP socket, with the given changes
+// applied to a copy of its data.
+func strictMsg(t *testing.T, change func([]byte) []byte) *netlink.NetlinkMessage {
+	const j = `{"Header":{"Len":356,"Type":20,"Flags":2,"Seq":1,"Pid":148940},"Data":"CgEAAOpWE6cmIAAAEAMEFbM+nWqBv4ehJgf4sEANDAoAAAAAAAAAgQAAAAAdWwAAAAAAAAAAAAAAAAAAAAAAAAAAAAC13zIBBQAIAAAAAAAFAAUAIAAAAAUABgAgAAAAFAABAAAAAAAAAAAAAAAAAAAAAAAoAAcAAAAAAICiBQAAAAAAALQAAAAAAAAAAAAAAAAAAAAAAAAAAAAArAACAAEAAAAAB3gBQIoDAECcAABEBQAAuAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAUCEAAAAAAAAgIQAAQCEAANwFAACsywIAJW8AAIRKAAD///9/CgAAAJQFAAADAAAALMkAAIBwAAAAAAAALnUOAAAAAAD///////////ayBAAAAAAASfQPAAAAAADMEQAANRMAAAAAAABiNQAAxAsAAGMIAABX5AUAAAAAAAoABABjdWJpYwAAAA=="}`
+	nm := netlink.NetlinkMessage{}
+	rtx.Must(json.Unmarshal([]byte(j), &nm), "Could not unmarshal message")
+	nm.Data = change(append([]byte(nil), nm.Data...))
+	return &nm
+}
+
+func TestStrict(t *testing.T) {
+	defer netlink.SetStrict(false)
+	tests := []struct {
+		name   string
+		change func([]byte) []byte
+		want   string
+	}{
+		{
+			name:   "short",
+			change: func(b []byte) []byte { return b[:20] },
+			want:   "short message",
+		},
+		{
+			name: "no cookie",
+			change: func(b []byte) []byte {
+				copy(b[44:52], make([]byte, 8))
+				return b
+			},
+			want: "socket has no cookie",
+		},
+		{
+			name: "large type",
+			change: func(b []byte) []byte {
+				return append(b, 4, 0, 100, 0)
+			},
+			want: "attribute type 100 is too large",
+		},
+		{
+			name: "repeated",
+			change: func(b []byte) []byte {
+				// A second INET_DIAG_CONG attribute.
+				return append(b, 8, 0, 4, 0, 'b', 'b', 'r', 0)
+			},
+			want: "attribute type 4 appears more than once",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := strictMsg(t, tt.change)
+			netlink.SetStrict(false)
+			if _, err := netlink.MakeArchivalRecord(msg, false); errors.Is(err, netlink.ErrStrict) {
+				t.Error("Expected no strict error, got", err)
+			}
+			netlink.SetStrict(true)
+			_, err := netlink.MakeArchivalRecord(msg, false)
+			if !errors.Is(err, netlink.ErrStrict) {
+				t.Fatal("Expected a strict error, got", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Error %q does not contain %q", err, tt.want)
+			}
+			// The error includes a hex dump of the message.
+			if !strings.Contains(err.Error(), "00000000  0a 01 00 00") {
+				t.Error("Missing hex dump in", err)
+			}
+		})
+	}
+
+	// Messages without anomalies are parsed as usual.
+	netlink.SetStrict(true)
+	ar, err := netlink.MakeArchivalRecord(strictMsg(t, func(b []byte) []byte { return b }), false)
+	if err != nil || ar == nil {
+		t.Error("Expected a record, got", ar, err)
+	}
+	if !netlink.Strict() {
+		t.Error("Expected strict mode")
+	}
+}
@@ -0,0 +1,55 @@
+// Package nlproto defines the nl-proto messages, the protobuf form of the parsed
+// netlink messages of the connection files.  Each Row holds a decoded snapshot, so
+// that pipelines can read the snapshots without parsing JSON, or decoding the raw
+// netlink structs of the archive records.
+//
+// The messages are derived from the Go types by package framed, which writes them
+// as a length-delimited stream, with the proto3 schema embedded at the start of
+// each file.  Fields are only ever added at the end of a message, so older readers
+// can read newer files.
+package nlproto
+
+import (
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+// Row is the message for each snapshot.  It is the snapshot.Row of the other
+// exported formats, whose fields are promoted into the message, with the metadata.
+type Row struct {
+	snapshot.Row
+	// Metadata is the connection level metadata.  The saver writes it, with the UUID
+	// and Sequence, in a Row without a snapshot at the start of each file, rather
+	// than in every Row.
+	Metadata *netlink.Metadata
+	// Anomaly describes anything impossible observed in the snapshot, relative to
+	// the previous snapshot of the connection.
+	Anomaly string
+}
+
+// NewRow returns the Row of the snapshot s of the connection described by meta,
+// which may be nil.
+func NewRow(meta *netlink.Metadata, s *snapshot.Snapshot) *Row {
+	return &Row{Row: *snapshot.NewRow(meta, s)}
+}
+
+// FromRecord returns the Row of an archive record.  The Row of a record with
+// metadata, e.g. the first record of a file, has the Metadata, UUID and Sequence,
+// and the Row of a record with a socket has its ID and Snapshot.
+func FromRecord(rec *netlink.ArchivalRecord) (*Row, error) {
+	meta, s, err := snapshot.Decode(rec)
+	if err != nil {
+		return nil, err
+	}
+	row := &Row{Anomaly: rec.Anomaly}
+	if rec.RawIDM != nil {
+		row = NewRow(nil, s)
+		row.Anomaly = rec.Anomaly
+	}
+	if meta != nil {
+		row.UUID = meta.UUID
+		row.Sequence = meta.Sequence
+		row.Metadata = meta
+	}
+	return row, nil
+}
@@ -0,0 +1,41 @@
+package nlproto_test
+
+import (
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/nlproto"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+const testFile = "../cmd/csvtool/testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst"
+
+func TestFromRecord(t *testing.T) {
+	rdr := zstd.NewReader(testFile)
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", testFile)
+
+	// The first record has the metadata, and no snapshot.
+	row, err := nlproto.FromRecord(records[0])
+	rtx.Must(err, "Could not convert the metadata")
+	if row.Metadata == nil || row.UUID != "ndt-jdczh_1553815964_00000000000003E8" || row.Sequence != 183 || row.ID != nil || row.Snapshot.InetDiagMsg != nil {
+		t.Errorf("Wrong metadata row %+v", row)
+	}
+
+	last := records[len(records)-1]
+	last.Anomaly = "state TIME_WAIT->ESTABLISHED"
+	row, err = nlproto.FromRecord(last)
+	rtx.Must(err, "Could not convert the snapshot")
+	if row.Metadata != nil || row.UUID != "" || row.ID == nil || row.ID.SrcIP == "" || row.Snapshot.TCPInfo == nil || row.Anomaly != last.Anomaly {
+		t.Errorf("Wrong snapshot row %+v", row)
+	}
+	if !row.Snapshot.Timestamp.Equal(last.Timestamp) {
+		t.Errorf("Wrong timestamp %v, want %v", row.Snapshot.Timestamp, last.Timestamp)
+	}
+
+	if _, err := nlproto.FromRecord(&netlink.ArchivalRecord{}); err == nil {
+		t.Error("An empty record should be an error")
+	}
+}
@@ -0,0 +1,478 @@
+// Package parquet writes Apache Parquet files, for loading into data warehouses
+// such as BigQuery and Athena without a conversion job.  The schema is derived
+// from a Go struct type, and embedded in the footer of each file, so files are
+// self-describing.
+//
+// Structs are written as groups, e.g. the column "TCPInfo.RTT" is the RTT field of
+// the TCPInfo group, and every field is optional, so that the fields under a nil
+// pointer are null.  Go types map to Parquet types as follows:
+//   - bool to BOOLEAN, float32 to FLOAT, and float64 to DOUBLE.
+//   - Integers of up to 32 bits to INT32, and other integers to INT64, annotated
+//     with their width and signedness, e.g. UINT_16, where it is not implied.
+//   - string to BYTE_ARRAY annotated UTF8, and []byte and byte arrays to BYTE_ARRAY.
+//   - time.Time to INT64 annotated TIMESTAMP_MICROS, with the zero time as null.
+//
+// Exported fields are named as for encoding/json, and fields tagged json:"-" are
+// omitted.  Other slices, maps and so on are not supported.  Each column chunk is a
+// single data page, with PLAIN values and RLE definition levels.
+package parquet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs for the pages of a file.
+const (
+	Uncompressed = "uncompressed"
+	Zstd         = "zstd"
+)
+
+// Errors returned by the package.
+var (
+	ErrUnsupportedType = errors.New("type has no Parquet equivalent")
+	ErrUnknownCodec    = errors.New("unknown codec")
+	ErrWrongType       = errors.New("value does not match the schema type")
+)
+
+// DefaultRowGroupSize is the default number of rows at which a row group is written.
+const DefaultRowGroupSize = 64 * 1024
+
+// CreatedBy identifies the writer in the file metadata.
+const CreatedBy = "github.com/m-lab/tcp-info/parquet"
+
+var (
+	magic    = []byte("PAR1")
+	timeType = reflect.TypeOf(time.Time{})
+	// encoder compresses the pages of all files.  EncodeAll is safe for
+	// concurrent use.
+	encoder, _ = zstd.NewWriter(nil)
+)
+
+// Enum values of the Parquet format, from parquet.thrift.
+const (
+	// Physical types.
+	typeBoolean   = 0
+	typeInt32     = 1
+	typeInt64     = 2
+	typeFloat     = 4
+	typeDouble    = 5
+	typeByteArray = 6
+
+	// Converted types, i.e. annotations.
+	convertedNone            = -1
+	convertedUTF8            = 0
+	convertedTimestampMicros = 10
+	convertedUint8           = 11
+	convertedInt8            = 15
+
+	repetitionOptional = 1
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	codecZstd         = 6
+
+	pageData = 0
+)
+
+// column accumulates the values of a leaf field for the current row group.
+type column struct {
+	path      []string
+	index     []int // The field indexes from the root struct, through pointers.
+	typ       int32
+	converted int32
+	isTime    bool
+	put       func(c *column, v reflect.Value)
+
+	levels []byte // The definition level of each row.
+	values []byte // The PLAIN encoding of the values that are not null.
+	count  int    // The number of values that are not null.
+}
+
+// element returns the encoded SchemaElement of a column, or of a group if children
+// is not negative.
+func element(name string, typ, converted int32, children int) []byte {
+	var c compact
+	if children < 0 {
+		c.i32(1, typ)
+	}
+	c.i32(3, repetitionOptional)
+	c.string(4, name)
+	if children >= 0 {
+		c.i32(5, int32(children))
+	}
+	if converted != convertedNone {
+		c.i32(6, converted)
+	}
+	return c.bytes()
+}
+
+// schema returns the schema elements and the leaf columns of the fields of a struct
+// type, depth first.  It also returns the number of fields, the children of the
+// group of the struct.
+func schema(t reflect.Type, path []string, index []int) ([][]byte, []*column, int, error) {
+	var elems [][]byte
+	var cols []*column
+	children := 0
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		p := append(append([]string{}, path...), name)
+		idx := append(append([]int{}, index...), i)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			sub, subCols, n, err := schema(ft, p, idx)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			if n == 0 {
+				continue // Parquet groups must have fields.
+			}
+			elems = append(elems, element(name, 0, convertedNone, n))
+			elems = append(elems, sub...)
+			cols = append(cols, subCols...)
+			children++
+			continue
+		}
+		c, err := leaf(ft)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("%s: %w", strings.Join(p, "."), err)
+		}
+		c.path, c.index = p, idx
+		elems = append(elems, element(name, c.typ, c.converted, -1))
+		cols = append(cols, c)
+		children++
+	}
+	return elems, cols, children, nil
+}
+
+// leaf returns a column for values of type t, without its path and index.
+func leaf(t reflect.Type) (*column, error) {
+	if t == timeType {
+		return &column{typ: typeInt64, converted: convertedTimestampMicros, isTime: true, put: func(c *column, v reflect.Value) {
+			c.values = appendUint64(c.values, uint64(v.Interface().(time.Time).UnixMicro()))
+		}}, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &column{typ: typeBoolean, converted: convertedNone, put: func(c *column, v reflect.Value) {
+			// Booleans are bit packed, least significant bit first.
+			if c.count%8 == 0 {
+				c.values = append(c.values, 0)
+			}
+			if v.Bool() {
+				c.values[len(c.values)-1] |= 1 << (c.count % 8)
+			}
+		}}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		c := &column{typ: typeInt64, converted: convertedNone, put: func(c *column, v reflect.Value) {
+			c.values = appendUint64(c.values, uint64(v.Int()))
+		}}
+		if t.Size() <= 4 {
+			c.typ, c.put = typeInt32, func(c *column, v reflect.Value) {
+				c.values = appendUint32(c.values, uint32(v.Int()))
+			}
+		}
+		if t.Size() < 4 {
+			c.converted = convertedInt8 + int32(bits.TrailingZeros(uint(t.Size())))
+		}
+		return c, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		c := &column{typ: typeInt64, put: func(c *column, v reflect.Value) {
+			c.values = appendUint64(c.values, v.Uint())
+		}}
+		if t.Size() <= 4 {
+			c.typ, c.put = typeInt32, func(c *column, v reflect.Value) {
+				c.values = appendUint32(c.values, uint32(v.Uint()))
+			}
+		}
+		// UINT_8, UINT_16, UINT_32 and UINT_64 are consecutive.
+		c.converted = convertedUint8 + int32(bits.TrailingZeros(uint(t.Size())))
+		return c, nil
+	case reflect.Float32:
+		return &column{typ: typeFloat, converted: convertedNone, put: func(c *column, v reflect.Value) {
+			c.values = appendUint32(c.values, math.Float32bits(float32(v.Float())))
+		}}, nil
+	case reflect.Float64:
+		return &column{typ: typeDouble, converted: convertedNone, put: func(c *column, v reflect.Value) {
+			c.values = appendUint64(c.values, math.Float64bits(v.Float()))
+		}}, nil
+	case reflect.String:
+		return &column{typ: typeByteArray, converted: convertedUTF8, put: func(c *column, v reflect.Value) {
+			c.values = appendUint32(c.values, uint32(v.Len()))
+			c.values = append(c.values, v.String()...)
+		}}, nil
+	case reflect.Array, reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			break
+		}
+		return &column{typ: typeByteArray, converted: convertedNone, put: func(c *column, v reflect.Value) {
+			c.values = appendUint32(c.values, uint32(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				c.values = append(c.values, byte(v.Index(i).Uint()))
+			}
+		}}, nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnsupportedType, t)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+// append adds the value of the column's field in v, the root struct.  The
+// definition level is the number of fields on the path to the value, including the
+// value itself, that are not null.
+func (c *column) append(v reflect.Value) {
+	level := 0
+	for _, i := range c.index {
+		v = v.Field(i)
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				break
+			}
+			v = v.Elem()
+		}
+		level++
+	}
+	if level == len(c.path) && c.isTime && v.Interface().(time.Time).IsZero() {
+		level--
+	}
+	c.levels = append(c.levels, byte(level))
+	if level == len(c.path) {
+		c.put(c, v)
+		c.count++
+	}
+}
+
+// page returns the uncompressed data of the column's data page: the length of the
+// definition levels, the levels in RLE runs, and the values.
+func (c *column) page() []byte {
+	var levels []byte
+	// The levels are at most 1 byte wide, so each run is its length, shifted to
+	// mark it as a run, and its level.
+	for i := 0; i < len(c.levels); {
+		j := i
+		for j < len(c.levels) && c.levels[j] == c.levels[i] {
+			j++
+		}
+		levels = appendUvarint(levels, uint64(j-i)<<1)
+		levels = append(levels, c.levels[i])
+		i = j
+	}
+	b := appendUint32(nil, uint32(len(levels)))
+	b = append(b, levels...)
+	return append(b, c.values...)
+}
+
+func (c *column) reset() {
+	c.levels, c.values, c.count = c.levels[:0], c.values[:0], 0
+}
+
+// Writer writes values of a single struct type to a Parquet file.
+type Writer struct {
+	// RowGroupSize is the number of rows at which a row group is written.
+	RowGroupSize int
+
+	w         io.Writer
+	t         reflect.Type
+	codec     string
+	schema    [][]byte
+	columns   []*column
+	metadata  [][2]string
+	offset    int64
+	rowGroups [][]byte
+	rows      int
+	total     int64
+}
+
+// NewWriter writes the magic at the start of a Parquet file for values of the same
+// type as v, which must be a struct or a pointer to one, and returns a Writer for
+// the values.  The codec must be Uncompressed or Zstd.
+func NewWriter(w io.Writer, v interface{}, codec string) (*Writer, error) {
+	if codec != Uncompressed && codec != Zstd {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, codec)
+	}
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct || t == timeType {
+		return nil, fmt.Errorf("%w: %v is not a struct", ErrUnsupportedType, t)
+	}
+	elems, cols, n, err := schema(t, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w: %v has no fields", ErrUnsupportedType, t)
+	}
+	// The root of the schema is the group of all the fields.
+	var root compact
+	root.string(4, "schema")
+	root.i32(5, int32(n))
+	elems = append([][]byte{root.bytes()}, elems...)
+	pw := &Writer{RowGroupSize: DefaultRowGroupSize, w: w, t: t, codec: codec, schema: elems, columns: cols}
+	err = pw.write(magic)
+	if err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+// SetMetadata adds a key and value to the key-value metadata of the file, which is
+// written in the footer.
+func (w *Writer) SetMetadata(key, value string) {
+	for i := range w.metadata {
+		if w.metadata[i][0] == key {
+			w.metadata[i][1] = value
+			return
+		}
+	}
+	w.metadata = append(w.metadata, [2]string{key, value})
+}
+
+// Append adds v, which must be of the Writer's type or a pointer to it, to the
+// current row group, and writes the row group if it has reached the RowGroupSize.
+func (w *Writer) Append(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() || rv.Type() != w.t {
+		return fmt.Errorf("%w: %T", ErrWrongType, v)
+	}
+	for _, c := range w.columns {
+		c.append(rv)
+	}
+	w.rows++
+	if w.rows >= w.RowGroupSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes the current row group, if it is not empty.
+func (w *Writer) Flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	codec := int32(codecUncompressed)
+	if w.codec == Zstd {
+		codec = codecZstd
+	}
+	var chunks [][]byte
+	var size int64
+	for _, c := range w.columns {
+		data := c.page()
+		compressed := data
+		if codec == codecZstd {
+			compressed = encoder.EncodeAll(data, nil)
+		}
+		var dph compact
+		dph.i32(1, int32(w.rows))
+		dph.i32(2, encodingPlain)
+		dph.i32(3, encodingRLE) // Definition levels.
+		dph.i32(4, encodingRLE) // Repetition levels, of which there are none.
+		var ph compact
+		ph.i32(1, pageData)
+		ph.i32(2, int32(len(data)))
+		ph.i32(3, int32(len(compressed)))
+		ph.strct(5, &dph)
+		header := ph.bytes()
+
+		offset := w.offset
+		err := w.write(append(header, compressed...))
+		if err != nil {
+			return err
+		}
+		var path [][]byte
+		for _, name := range c.path {
+			path = append(path, appendString(nil, name))
+		}
+		var md compact
+		md.i32(1, c.typ)
+		md.list(2, typeI32, [][]byte{appendVarint(nil, encodingPlain), appendVarint(nil, encodingRLE)})
+		md.list(3, typeBinary, path)
+		md.i32(4, codec)
+		md.i64(5, int64(w.rows))
+		md.i64(6, int64(len(header)+len(data)))
+		md.i64(7, int64(len(header)+len(compressed)))
+		md.i64(9, offset)
+		var cc compact
+		cc.i64(2, offset)
+		cc.strct(3, &md)
+		chunks = append(chunks, cc.bytes())
+		size += int64(len(header) + len(data))
+		c.reset()
+	}
+	var rg compact
+	rg.list(1, typeStruct, chunks)
+	rg.i64(2, size)
+	rg.i64(3, int64(w.rows))
+	w.rowGroups = append(w.rowGroups, rg.bytes())
+	w.total += int64(w.rows)
+	w.rows = 0
+	return nil
+}
+
+// Close writes any buffered values and the file footer.  It does not close the
+// underlying io.Writer.
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	var fmd compact
+	fmd.i32(1, 1) // The version of the format.
+	fmd.list(2, typeStruct, w.schema)
+	fmd.i64(3, w.total)
+	fmd.list(4, typeStruct, w.rowGroups)
+	if len(w.metadata) > 0 {
+		var kvs [][]byte
+		for _, kv := range w.metadata {
+			var c compact
+			c.string(1, kv[0])
+			c.string(2, kv[1])
+			kvs = append(kvs, c.bytes())
+		}
+		fmd.list(5, typeStruct, kvs)
+	}
+	fmd.string(6, CreatedBy)
+	// The footer is the file metadata, its length and the magic.
+	b := fmd.bytes()
+	b = appendUint32(b, uint32(len(b)))
+	b = append(b, magic...)
+	return w.write(b)
+}
@@ -0,0 +1,276 @@
+package parquet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/parquet"
+)
+
+type Inner struct {
+	Name string
+	Skip int `json:"-"`
+	Big  uint64
+}
+
+type Row struct {
+	Flag    bool
+	Small   int8
+	Neg     int64
+	Port    uint16
+	Float   float32
+	Double  float64
+	Data    []byte
+	Time    time.Time
+	Inner   Inner
+	Ptr     *Inner
+	Opt     *int32
+	Renamed string `json:"renamed,omitempty"`
+	hidden  int
+}
+
+// thrift decodes the Thrift compact protocol, just enough to check the files.
+// Structs are decoded to maps from field ids to values, lists to slices, integers
+// to int64 and binary fields to strings.
+type thrift struct {
+	b   []byte
+	pos int
+}
+
+func (t *thrift) varint() int64 {
+	v, n := binary.Varint(t.b[t.pos:])
+	t.pos += n
+	return v
+}
+
+func (t *thrift) uvarint() uint64 {
+	v, n := binary.Uvarint(t.b[t.pos:])
+	t.pos += n
+	return v
+}
+
+func (t *thrift) value(typ byte) interface{} {
+	switch typ {
+	case 5, 6:
+		return t.varint()
+	case 8:
+		n := int(t.uvarint())
+		t.pos += n
+		return string(t.b[t.pos-n : t.pos])
+	case 9:
+		h := t.b[t.pos]
+		t.pos++
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(t.uvarint())
+		}
+		var list []interface{}
+		for i := 0; i < n; i++ {
+			list = append(list, t.value(h&0xF))
+		}
+		return list
+	case 12:
+		return t.strct()
+	}
+	panic("unexpected type")
+}
+
+func (t *thrift) strct() map[int]interface{} {
+	s := make(map[int]interface{})
+	id := 0
+	for {
+		h := t.b[t.pos]
+		t.pos++
+		if h == 0 {
+			return s
+		}
+		if h>>4 == 0 {
+			id = int(t.varint())
+		} else {
+			id += int(h >> 4)
+		}
+		s[id] = t.value(h & 0xF)
+	}
+}
+
+func field(v interface{}, ids ...int) interface{} {
+	for _, id := range ids {
+		v = v.(map[int]interface{})[id]
+	}
+	return v
+}
+
+// footer checks the magic and returns the decoded file metadata of a file.
+func footer(t *testing.T, b []byte) map[int]interface{} {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+		t.Fatal("Missing magic")
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	th := &thrift{b: b[len(b)-8-n : len(b)-8]}
+	fmd := th.strct()
+	if th.pos != n {
+		t.Fatalf("The file metadata is %d bytes, not %d", th.pos, n)
+	}
+	return fmd
+}
+
+// page returns the definition levels and the values of a column chunk.
+func page(t *testing.T, b []byte, chunk interface{}) ([]byte, []byte) {
+	t.Helper()
+	th := &thrift{b: b, pos: int(field(chunk, 3, 9).(int64))}
+	header := th.strct()
+	data := b[th.pos : th.pos+int(field(header, 3).(int64))]
+	if field(chunk, 3, 4).(int64) == 6 {
+		dec, err := zstd.NewReader(nil)
+		rtx.Must(err, "Could not create decoder")
+		data, err = dec.DecodeAll(data, nil)
+		rtx.Must(err, "Could not decompress page")
+	}
+	if len(data) != int(field(header, 2).(int64)) {
+		t.Fatal("Wrong uncompressed size", len(data))
+	}
+	n := int(field(header, 5, 1).(int64))
+	// Expand the runs of levels.
+	rle := &thrift{b: data[4 : 4+binary.LittleEndian.Uint32(data)]}
+	var levels []byte
+	for rle.pos < len(rle.b) {
+		run := int(rle.uvarint() >> 1)
+		levels = append(levels, bytes.Repeat([]byte{rle.b[rle.pos]}, run)...)
+		rle.pos++
+	}
+	if len(levels) != n {
+		t.Fatalf("Expected %d levels, got %d", n, len(levels))
+	}
+	return levels, data[4+len(rle.b):]
+}
+
+func TestWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	w, err := parquet.NewWriter(&buf, Row{}, parquet.Zstd)
+	rtx.Must(err, "Could not create writer")
+	w.RowGroupSize = 2
+	w.SetMetadata("uuid", "a")
+	w.SetMetadata("uuid", "b")
+	opt := int32(-7)
+	ts := time.Date(2019, 4, 1, 0, 0, 0, 5000, time.UTC)
+	rows := []Row{
+		{Flag: true, Small: -1, Neg: -2, Port: 443, Float: 1.5, Double: -2.5, Data: []byte{1, 2},
+			Time: ts, Inner: Inner{Name: "x", Big: math.MaxUint64}, Ptr: &Inner{Name: "y"}, Opt: &opt, Renamed: "r"},
+		{},
+		{Flag: true, Ptr: &Inner{Big: 3}},
+	}
+	for i := range rows {
+		rtx.Must(w.Append(&rows[i]), "Could not append")
+	}
+	rtx.Must(w.Close(), "Could not close")
+	b := buf.Bytes()
+
+	fmd := footer(t, b)
+	if fmd[3].(int64) != 3 {
+		t.Error("Expected 3 rows, got", fmd[3])
+	}
+	if fmd[5].([]interface{})[0].(map[int]interface{})[2] != "b" {
+		t.Error("Wrong metadata", fmd[5])
+	}
+	var names []string
+	for _, e := range fmd[2].([]interface{}) {
+		names = append(names, field(e, 4).(string))
+	}
+	want := []string{"schema", "Flag", "Small", "Neg", "Port", "Float", "Double", "Data", "Time",
+		"Inner", "Name", "Big", "Ptr", "Name", "Big", "Opt", "renamed"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Wrong schema %v", names)
+	}
+	groups := fmd[4].([]interface{})
+	if len(groups) != 2 || field(groups[0], 3).(int64) != 2 || field(groups[1], 3).(int64) != 1 {
+		t.Fatal("Expected row groups of 2 and 1 rows, got", groups)
+	}
+	chunks := field(groups[0], 1).([]interface{})
+	if len(chunks) != 14 {
+		t.Fatal("Expected 14 columns, got", len(chunks))
+	}
+	path := field(chunks[11], 3, 3).([]interface{})
+	if len(path) != 2 || path[0] != "Ptr" || path[1] != "Big" {
+		t.Error("Wrong path", path)
+	}
+
+	// Time is null in the second row.
+	levels, values := page(t, b, chunks[7])
+	if !bytes.Equal(levels, []byte{1, 0}) || int64(binary.LittleEndian.Uint64(values)) != ts.UnixMicro() || len(values) != 8 {
+		t.Error("Wrong Time", levels, values)
+	}
+	// Ptr.Big is null in the first row group, where the value is 0 and Ptr is nil.
+	levels, values = page(t, b, chunks[11])
+	if !bytes.Equal(levels, []byte{2, 0}) || !bytes.Equal(values, make([]byte, 8)) {
+		t.Error("Wrong Ptr.Big", levels, values)
+	}
+	levels, values = page(t, b, field(groups[1], 1).([]interface{})[11])
+	if !bytes.Equal(levels, []byte{2}) || binary.LittleEndian.Uint64(values) != 3 {
+		t.Error("Wrong Ptr.Big", levels, values)
+	}
+	// Strings are prefixed by their length.
+	levels, values = page(t, b, chunks[8])
+	if !bytes.Equal(levels, []byte{2, 2}) || !bytes.Equal(values, []byte("\x01\x00\x00\x00x\x00\x00\x00\x00")) {
+		t.Error("Wrong Inner.Name", levels, values)
+	}
+	// Booleans are bit packed.
+	levels, values = page(t, b, chunks[0])
+	if !bytes.Equal(levels, []byte{1, 1}) || !bytes.Equal(values, []byte{1}) {
+		t.Error("Wrong Flag", levels, values)
+	}
+}
+
+func TestUncompressed(t *testing.T) {
+	buf := bytes.Buffer{}
+	w, err := parquet.NewWriter(&buf, &Inner{}, parquet.Uncompressed)
+	rtx.Must(err, "Could not create writer")
+	rtx.Must(w.Append(Inner{Name: "abc"}), "Could not append")
+	rtx.Must(w.Close(), "Could not close")
+	b := buf.Bytes()
+	chunk := field(footer(t, b)[4].([]interface{})[0], 1).([]interface{})[0]
+	if field(chunk, 3, 4).(int64) != 0 {
+		t.Error("Expected no compression, got", field(chunk, 3, 4))
+	}
+	if !bytes.Contains(b, []byte("abc")) {
+		t.Error("The values should not be compressed")
+	}
+
+	// An empty file has no row groups.
+	buf.Reset()
+	w, err = parquet.NewWriter(&buf, &Inner{}, parquet.Zstd)
+	rtx.Must(err, "Could not create writer")
+	rtx.Must(w.Close(), "Could not close")
+	fmd := footer(t, buf.Bytes())
+	if fmd[3].(int64) != 0 || fmd[4] == nil || len(fmd[4].([]interface{})) != 0 {
+		t.Error("Expected no rows", fmd)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	buf := bytes.Buffer{}
+	if _, err := parquet.NewWriter(&buf, Row{}, "snappy"); !errors.Is(err, parquet.ErrUnknownCodec) {
+		t.Error("Expected ErrUnknownCodec, got", err)
+	}
+	for _, v := range []interface{}{nil, 1, time.Time{}, struct{ M map[string]int }{}, struct{ hidden int }{}} {
+		if _, err := parquet.NewWriter(&buf, v, parquet.Zstd); !errors.Is(err, parquet.ErrUnsupportedType) {
+			t.Errorf("Expected ErrUnsupportedType for %T, got %v", v, err)
+		}
+	}
+	w, err := parquet.NewWriter(&buf, Row{}, parquet.Zstd)
+	rtx.Must(err, "Could not create writer")
+	if err := w.Append(Inner{}); !errors.Is(err, parquet.ErrWrongType) {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+	if err := w.Append((*Row)(nil)); !errors.Is(err, parquet.ErrWrongType) {
+		t.Error("Expected ErrWrongType for nil, got", err)
+	}
+}
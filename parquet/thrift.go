@@ -0,0 +1,85 @@
+package parquet
+
+import "encoding/binary"
+
+// Thrift compact protocol types, of fields and list elements.
+const (
+	typeI32    = 5
+	typeI64    = 6
+	typeBinary = 8
+	typeList   = 9
+	typeStruct = 12
+)
+
+// compact encodes a struct in the Thrift compact protocol, in which the page
+// headers and the file metadata are written.  Fields must be added in increasing
+// order of their ids.
+type compact struct {
+	b    []byte
+	last int16 // The id of the previous field.
+}
+
+func appendVarint(b []byte, x int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+// field appends a field header, with the id as a delta from the previous field if
+// it is small enough.
+func (c *compact) field(id int16, typ byte) {
+	if d := id - c.last; d > 0 && d <= 15 {
+		c.b = append(c.b, byte(d)<<4|typ)
+	} else {
+		c.b = appendVarint(append(c.b, typ), int64(id))
+	}
+	c.last = id
+}
+
+func (c *compact) i32(id int16, v int32) {
+	c.field(id, typeI32)
+	c.b = appendVarint(c.b, int64(v))
+}
+
+func (c *compact) i64(id int16, v int64) {
+	c.field(id, typeI64)
+	c.b = appendVarint(c.b, v)
+}
+
+func (c *compact) string(id int16, s string) {
+	c.field(id, typeBinary)
+	c.b = appendString(c.b, s)
+}
+
+func (c *compact) strct(id int16, s *compact) {
+	c.field(id, typeStruct)
+	c.b = append(c.b, s.bytes()...)
+}
+
+// list appends a list of elements of the type, each already encoded.
+func (c *compact) list(id int16, typ byte, elems [][]byte) {
+	c.field(id, typeList)
+	if len(elems) < 15 {
+		c.b = append(c.b, byte(len(elems))<<4|typ)
+	} else {
+		c.b = appendUvarint(append(c.b, 0xF0|typ), uint64(len(elems)))
+	}
+	for _, e := range elems {
+		c.b = append(c.b, e...)
+	}
+}
+
+// bytes returns the encoded struct, terminated by the stop field.
+func (c *compact) bytes() []byte {
+	return append(c.b, 0)
+}
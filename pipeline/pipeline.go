@@ -0,0 +1,324 @@
+// Package pipeline constructs the stages of the collector from a config.Pipeline:
+// the filters and connection cache of the Saver, and the sinks that receive the
+// recorded snapshots.
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+
+	"github.com/m-lab/tcp-info/config"
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/grafana"
+	"github.com/m-lab/tcp-info/rpc"
+	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/sink"
+)
+
+// Errors returned by Build.
+var (
+	ErrUnknownStage = errors.New("unknown pipeline stage")
+	ErrNoFiles      = errors.New("pipeline must have exactly one files sink")
+	ErrBadStage     = errors.New("bad pipeline stage")
+)
+
+// Defaults for the sink fields that are not set.
+const (
+	DefaultNATSSubject    = "tcpinfo"
+	DefaultNATSPartitions = 16
+	DefaultNATSBuffer     = 10000
+	DefaultSummaryBuffer  = 1000 // For the syslog and journal sinks.
+	DefaultGrafanaBuffer  = 1000 // Snapshots kept per connection.
+	DefaultWatchBuffer    = 1000 // Messages buffered per Watch call of the grpc sink.
+)
+
+// Options are the settings of the Saver that are not part of the pipeline.
+type Options struct {
+	Host        string // mlabN
+	Site        string // 3 alpha + 2 decimal
+	Marshallers int    // Number of marshalling goroutines.
+	Anonymizer  anonymize.IPAnonymizer
+	// OutputDir is the directory under which the files are written.  If empty, they
+	// are written under the working directory.
+	OutputDir string
+	// NameTemplate names the connection files.  If nil, saver.DefaultNameTemplate
+	// is used.
+	NameTemplate *saver.NameTemplate
+	// QueueDepth is the capacity of each marshalling queue.  Zero uses
+	// saver.DefaultQueueDepth.
+	QueueDepth int
+}
+
+// Pipeline holds the constructed stages.
+type Pipeline struct {
+	Saver *saver.Saver
+	// Events is the event server of the eventsocket sink, or a null server if
+	// there is none.  The caller must Listen and Serve.
+	Events eventsocket.Server
+	// Grafana is the server of the grafana sink, or nil if there is none.  It
+	// serves the archive tree in the working directory.  The caller must start it.
+	Grafana *http.Server
+	// Watch is the gRPC server of the grpc sink, or nil if there is none.  The caller
+	// must start it.
+	Watch *rpc.Server
+}
+
+// Build constructs the stages described by spec.  The files sink is the Saver
+// itself, so the pipeline must have exactly one.
+func Build(spec *config.Pipeline, opts Options) (*Pipeline, error) {
+	files := 0
+	events := eventsocket.NullServer()
+	hasEvents := false
+	for _, s := range spec.Sinks {
+		switch s.Type {
+		case "files":
+			files++
+		case "eventsocket":
+			if s.Path == "" {
+				return nil, fmt.Errorf("%w: eventsocket requires a Path", ErrBadStage)
+			}
+			events = eventsocket.New(s.Path)
+			hasEvents = true
+		}
+	}
+	if files != 1 {
+		return nil, ErrNoFiles
+	}
+
+	saverOpts := []saver.Option{saver.WithOutputDir(opts.OutputDir), saver.WithNameTemplate(opts.NameTemplate)}
+	if opts.QueueDepth > 0 {
+		saverOpts = append(saverOpts, saver.WithQueueDepth(opts.QueueDepth))
+	}
+	svr := saver.NewSaver(opts.Host, opts.Site, opts.Marshallers, events, opts.Anonymizer, saverOpts...)
+	svr.Derivers = saver.RegisteredDerivers()
+	err := applyFilters(svr, spec.Filters)
+	if err != nil {
+		return nil, err
+	}
+	if len(svr.SockOptRules) > 0 {
+		// The socket options are reported by the clients of the eventsocket.
+		so, ok := events.(eventsocket.SockOptServer)
+		if !hasEvents || !ok {
+			return nil, fmt.Errorf("%w: sockopt filters require an eventsocket sink", ErrBadStage)
+		}
+		so.HandleSockOpts(svr)
+	}
+	svr.ExpiryGraceCycles = spec.Cache.GraceCycles
+
+	p := &Pipeline{Saver: svr, Events: events}
+	for _, s := range spec.Sinks {
+		if s.Type == "files" || s.Type == "eventsocket" {
+			continue
+		}
+		snk, err := p.newSink(s)
+		if err != nil {
+			for _, snk := range svr.Sinks {
+				snk.Close()
+			}
+			return nil, err
+		}
+		svr.Sinks = append(svr.Sinks, snk)
+	}
+	return p, nil
+}
+
+// applyFilters configures the Saver to record only the connections that pass
+// every filter.
+func applyFilters(svr *saver.Saver, filters []config.Filter) error {
+	fraction := 1.0
+	for _, f := range filters {
+		switch f.Type {
+		case "owner":
+			owners := make(map[string]bool)
+			for _, o := range f.Owners {
+				// Connections must have an owner allowed by every owner filter.
+				if svr.RecordOwners == nil || svr.RecordOwners[o] {
+					owners[o] = true
+				}
+			}
+			svr.RecordOwners = owners
+			if len(owners) == 0 {
+				return fmt.Errorf("%w: owner filters exclude every owner", ErrBadStage)
+			}
+		case "sampling":
+			fraction *= f.Fraction
+		case "cidr":
+			cf, err := cidrFilter(f)
+			if err != nil {
+				return err
+			}
+			svr.CIDRFilters = append(svr.CIDRFilters, cf)
+		case "priority":
+			p, err := saver.ParsePriority(f.Priority)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrBadStage, err)
+			}
+			cf, err := cidrFilter(f)
+			if err != nil {
+				return err
+			}
+			rule := saver.PriorityRule{Priority: p, CIDRFilter: cf}
+			if len(f.Owners) > 0 {
+				rule.Owners = make(map[string]bool)
+				for _, o := range f.Owners {
+					rule.Owners[o] = true
+				}
+			}
+			svr.PriorityRules = append(svr.PriorityRules, rule)
+		case "sockopt":
+			cf, err := cidrFilter(f)
+			if err != nil {
+				return err
+			}
+			rule := saver.SockOptRule{CIDRFilter: cf}
+			if len(f.Owners) > 0 {
+				rule.Owners = make(map[string]bool)
+				for _, o := range f.Owners {
+					rule.Owners[o] = true
+				}
+			}
+			svr.SockOptRules = append(svr.SockOptRules, rule)
+		default:
+			return fmt.Errorf("%w: filter %q", ErrUnknownStage, f.Type)
+		}
+	}
+	svr.SetSampling(fraction)
+	return nil
+}
+
+// cidrFilter returns the saver.CIDRFilter described by a cidr filter stage.
+func cidrFilter(f config.Filter) (saver.CIDRFilter, error) {
+	cf := saver.CIDRFilter{Direction: f.Direction}
+	switch f.Direction {
+	case saver.EitherAddress, saver.SourceAddress, saver.DestinationAddress:
+	default:
+		return cf, fmt.Errorf("%w: cidr direction %q", ErrBadStage, f.Direction)
+	}
+	for _, list := range []struct {
+		cidrs []string
+		nets  *[]*net.IPNet
+	}{{f.Allow, &cf.Allow}, {f.Deny, &cf.Deny}} {
+		for _, c := range list.cidrs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return cf, fmt.Errorf("%w: %v", ErrBadStage, err)
+			}
+			*list.nets = append(*list.nets, n)
+		}
+	}
+	return cf, nil
+}
+
+// newSink constructs a sink other than files or eventsocket, which are part of
+// the Saver.
+func (p *Pipeline) newSink(s config.Sink) (sink.Sink, error) {
+	switch s.Type {
+	case "nats":
+		subject, partitions, buffer := s.Subject, s.Partitions, s.Buffer
+		if subject == "" {
+			subject = DefaultNATSSubject
+		}
+		if partitions == 0 {
+			partitions = DefaultNATSPartitions
+		}
+		if buffer == 0 {
+			buffer = DefaultNATSBuffer
+		}
+		if err := sink.CheckEncodings(s.Encodings); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadStage, err)
+		}
+		return sink.NewNATS(s.URL, subject, partitions, buffer, s.Encodings)
+	case "pubsub":
+		if s.Topic == "" {
+			return nil, fmt.Errorf("%w: pubsub requires a Topic", ErrBadStage)
+		}
+		settings := sink.DefaultPubSubSettings
+		settings.Topic = s.Topic
+		if s.Endpoint != "" {
+			settings.Endpoint = s.Endpoint
+		}
+		if s.BatchCount != 0 {
+			settings.CountThreshold = s.BatchCount
+		}
+		if s.BatchBytes != 0 {
+			settings.ByteThreshold = s.BatchBytes
+		}
+		if s.BatchDelay != "" {
+			d, err := time.ParseDuration(s.BatchDelay)
+			if err != nil {
+				return nil, fmt.Errorf("%w: pubsub BatchDelay: %v", ErrBadStage, err)
+			}
+			settings.DelayThreshold = d
+		}
+		if s.Buffer != 0 {
+			settings.BufferSize = s.Buffer
+		}
+		if len(s.Encodings) > 1 {
+			return nil, fmt.Errorf("%w: pubsub cannot negotiate among Encodings", ErrBadStage)
+		}
+		if len(s.Encodings) == 1 {
+			if err := sink.CheckEncodings(s.Encodings); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrBadStage, err)
+			}
+			settings.Encoding = s.Encodings[0]
+		}
+		return sink.NewPubSub(settings), nil
+	case "syslog":
+		var network, raddr string
+		if s.URL != "local" {
+			u, err := url.Parse(s.URL)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("%w: syslog URL %q", ErrBadStage, s.URL)
+			}
+			network, raddr = u.Scheme, u.Host
+		}
+		return sink.NewSyslog(network, raddr, summaryBuffer(s))
+	case "journal":
+		path := s.Path
+		if path == "" {
+			path = sink.DefaultJournalSocket
+		}
+		return sink.NewJournal(path, summaryBuffer(s))
+	case "grafana":
+		if s.Address == "" {
+			return nil, fmt.Errorf("%w: grafana requires an Address", ErrBadStage)
+		}
+		if p.Grafana != nil {
+			return nil, fmt.Errorf("%w: only one grafana sink is allowed", ErrBadStage)
+		}
+		size := s.Buffer
+		if size == 0 {
+			size = DefaultGrafanaBuffer
+		}
+		recent := grafana.NewRecent(size)
+		p.Grafana = &http.Server{Addr: s.Address, Handler: grafana.NewHandler(recent, ".")}
+		return recent, nil
+	case "grpc":
+		if s.Address == "" {
+			return nil, fmt.Errorf("%w: grpc requires an Address", ErrBadStage)
+		}
+		if p.Watch != nil {
+			return nil, fmt.Errorf("%w: only one grpc sink is allowed", ErrBadStage)
+		}
+		buffer := s.Buffer
+		if buffer == 0 {
+			buffer = DefaultWatchBuffer
+		}
+		p.Watch = rpc.NewServer(s.Address, buffer)
+		return p.Watch, nil
+	}
+	return nil, fmt.Errorf("%w: sink %q", ErrUnknownStage, s.Type)
+}
+
+func summaryBuffer(s config.Sink) int {
+	if s.Buffer == 0 {
+		return DefaultSummaryBuffer
+	}
+	return s.Buffer
+}
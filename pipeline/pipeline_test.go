@@ -0,0 +1,133 @@
+package pipeline_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/config"
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/pipeline"
+	"github.com/m-lab/tcp-info/saver"
+)
+
+func TestBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBuild")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	syslog, err := net.ListenPacket("udp", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer syslog.Close()
+	journal, err := net.ListenPacket("unixgram", filepath.Join(dir, "journal"))
+	rtx.Must(err, "Could not listen")
+	defer journal.Close()
+
+	spec := &config.Pipeline{
+		Filters: []config.Filter{
+			{Type: "owner", Owners: []string{"a", "b"}},
+			{Type: "sampling", Fraction: 0.5},
+			{Type: "owner", Owners: []string{"b", "c"}},
+			{Type: "sampling", Fraction: 0.5},
+			{Type: "cidr", Direction: "destination", Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.128/25", "2001:db8::/32"}},
+			{Type: "priority", Priority: "high", Owners: []string{"b"}},
+			{Type: "priority", Priority: "low", Direction: "source", Allow: []string{"198.51.100.0/24"}},
+			{Type: "sockopt", Owners: []string{"b"}, Direction: "destination", Allow: []string{"192.0.2.0/25"}},
+		},
+		Cache: config.Cache{GraceCycles: 2},
+		Sinks: []config.Sink{
+			{Type: "files"},
+			{Type: "eventsocket", Path: filepath.Join(dir, "events")},
+			{Type: "syslog", URL: "udp://" + syslog.LocalAddr().String()},
+			{Type: "journal", Path: filepath.Join(dir, "journal")},
+			{Type: "pubsub", Topic: "projects/p/topics/t", BatchDelay: "10ms"},
+			{Type: "grafana", Address: "localhost:0"},
+			{Type: "grpc", Address: "localhost:0"},
+		},
+	}
+	template, err := saver.ParseNameTemplate("{date}/{uuid}.{seq}")
+	rtx.Must(err, "Could not parse template")
+	p, err := pipeline.Build(spec, pipeline.Options{Host: "mlab1", Site: "lga03", Marshallers: 1, Anonymizer: anonymize.New(anonymize.None),
+		OutputDir: dir, NameTemplate: template})
+	rtx.Must(err, "Could not build pipeline")
+	svr := p.Saver
+	if svr.Host != "mlab1" || svr.Pod != "lga03" || svr.ExpiryGraceCycles != 2 ||
+		svr.OutputDir != dir || svr.NameTemplate != template {
+		t.Errorf("Wrong saver settings %+v", svr)
+	}
+	if !reflect.DeepEqual(svr.RecordOwners, map[string]bool{"b": true}) {
+		t.Error("Owner filters should intersect, got", svr.RecordOwners)
+	}
+	if svr.Sampling() != 0.25 {
+		t.Error("Sampling filters should multiply, got", svr.Sampling())
+	}
+	if len(svr.CIDRFilters) != 1 || len(svr.CIDRFilters[0].Allow) != 1 || len(svr.CIDRFilters[0].Deny) != 2 ||
+		svr.CIDRFilters[0].Direction != saver.DestinationAddress || svr.CIDRFilters[0].Allow[0].String() != "192.0.2.0/24" {
+		t.Errorf("Wrong CIDR filters %+v", svr.CIDRFilters)
+	}
+	if len(svr.PriorityRules) != 2 || svr.PriorityRules[0].Priority != saver.HighPriority || !svr.PriorityRules[0].Owners["b"] ||
+		svr.PriorityRules[1].Priority != saver.LowPriority || svr.PriorityRules[1].Owners != nil || len(svr.PriorityRules[1].Allow) != 1 {
+		t.Errorf("Wrong priority rules %+v", svr.PriorityRules)
+	}
+	if len(svr.SockOptRules) != 1 || !svr.SockOptRules[0].Owners["b"] || len(svr.SockOptRules[0].Allow) != 1 ||
+		svr.SockOptRules[0].Direction != saver.DestinationAddress {
+		t.Errorf("Wrong sockopt rules %+v", svr.SockOptRules)
+	}
+	if len(svr.Sinks) != 5 {
+		t.Error("Expected 5 sinks, got", len(svr.Sinks))
+	}
+	if p.Watch == nil || p.Watch.Addr != "localhost:0" {
+		t.Error("Expected a gRPC server, got", p.Watch)
+	}
+	if p.Grafana == nil || p.Grafana.Addr != "localhost:0" {
+		t.Error("Expected a grafana server, got", p.Grafana)
+	}
+	if reflect.DeepEqual(p.Events, eventsocket.NullServer()) {
+		t.Error("Expected an event server")
+	}
+	for _, s := range svr.Sinks {
+		rtx.Must(s.Close(), "Could not close sink")
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	files := config.Sink{Type: "files"}
+	tests := []struct {
+		name string
+		spec config.Pipeline
+		want error
+	}{
+		{"no files", config.Pipeline{}, pipeline.ErrNoFiles},
+		{"two files", config.Pipeline{Sinks: []config.Sink{files, files}}, pipeline.ErrNoFiles},
+		{"kafka", config.Pipeline{Sinks: []config.Sink{files, {Type: "kafka"}}}, pipeline.ErrUnknownStage},
+		{"filter", config.Pipeline{Sinks: []config.Sink{files}, Filters: []config.Filter{{Type: "port"}}}, pipeline.ErrUnknownStage},
+		{"owners", config.Pipeline{Sinks: []config.Sink{files}, Filters: []config.Filter{
+			{Type: "owner", Owners: []string{"a"}}, {Type: "owner", Owners: []string{"b"}}}}, pipeline.ErrBadStage},
+		{"cidr", config.Pipeline{Sinks: []config.Sink{files}, Filters: []config.Filter{{Type: "cidr", Allow: []string{"192.0.2.0"}}}}, pipeline.ErrBadStage},
+		{"direction", config.Pipeline{Sinks: []config.Sink{files}, Filters: []config.Filter{{Type: "cidr", Direction: "up"}}}, pipeline.ErrBadStage},
+		{"priority", config.Pipeline{Sinks: []config.Sink{files}, Filters: []config.Filter{{Type: "priority", Priority: "urgent"}}}, pipeline.ErrBadStage},
+		{"eventsocket", config.Pipeline{Sinks: []config.Sink{files, {Type: "eventsocket"}}}, pipeline.ErrBadStage},
+		{"sockopt", config.Pipeline{Sinks: []config.Sink{files}, Filters: []config.Filter{{Type: "sockopt"}}}, pipeline.ErrBadStage},
+		{"pubsub", config.Pipeline{Sinks: []config.Sink{files, {Type: "pubsub"}}}, pipeline.ErrBadStage},
+		{"delay", config.Pipeline{Sinks: []config.Sink{files, {Type: "pubsub", Topic: "t", BatchDelay: "soon"}}}, pipeline.ErrBadStage},
+		{"syslog", config.Pipeline{Sinks: []config.Sink{files, {Type: "syslog", URL: "loghost"}}}, pipeline.ErrBadStage},
+		{"grafana", config.Pipeline{Sinks: []config.Sink{files, {Type: "grafana"}}}, pipeline.ErrBadStage},
+		{"two grafana", config.Pipeline{Sinks: []config.Sink{files, {Type: "grafana", Address: ":1"}, {Type: "grafana", Address: ":2"}}}, pipeline.ErrBadStage},
+		{"grpc", config.Pipeline{Sinks: []config.Sink{files, {Type: "grpc"}}}, pipeline.ErrBadStage},
+		{"two grpc", config.Pipeline{Sinks: []config.Sink{files, {Type: "grpc", Address: ":1"}, {Type: "grpc", Address: ":2"}}}, pipeline.ErrBadStage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pipeline.Build(&tt.spec, pipeline.Options{Marshallers: 1, Anonymizer: anonymize.New(anonymize.None)})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Build() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Package reader reads the connection files written by the saver, e.g.
+// <uuid>.00000.jsonl.zst, back into their Metadata header and a stream of
+// ArchivalRecords, or decoded snapshots, for round trip tests and offline analysis.
+//
+// Delta encoded records and columnar blocks are reconstructed, so the records are
+// those the saver was given, whatever the options it wrote them with.  Files in the
+// framed format are not supported.
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/m-lab/tcp-info/manifest"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// ErrUnsupportedFormat is returned by Open for files that are not JSONL.
+var ErrUnsupportedFormat = errors.New("unsupported connection file format")
+
+// Reader reads the records of a connection file.
+type Reader struct {
+	closer io.Closer // The file, if the Reader opened it.
+	ar     netlink.ArchiveReader
+	meta   *netlink.Metadata
+	next   *netlink.ArchivalRecord // The first snapshot, read with the header.
+	err    error                   // The error reading the first record.
+}
+
+// Open opens a connection file, which is decompressed in process if its name ends
+// in .zst, and reads its header.
+func Open(name string) (*Reader, error) {
+	base := strings.TrimSuffix(name, ".zst")
+	if !strings.HasSuffix(base, ".jsonl") {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, name)
+	}
+	var rc io.ReadCloser
+	var err error
+	if base != name {
+		rc, err = zstd.NewInProcessReader(name)
+	} else {
+		rc, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := New(rc)
+	r.closer = rc
+	return r, nil
+}
+
+// New returns a Reader of the uncompressed JSONL records from rdr, and reads the
+// header, if there is one.
+func New(rdr io.Reader) *Reader {
+	r := &Reader{ar: netlink.NewArchiveReader(rdr)}
+	first, err := r.ar.Next()
+	switch {
+	case err != nil:
+		r.err = err
+	case first.Metadata != nil:
+		r.meta = first.Metadata
+	default:
+		r.next = first
+	}
+	return r
+}
+
+// Metadata returns the header of the file, or nil if it has none.
+func (r *Reader) Metadata() *netlink.Metadata {
+	return r.meta
+}
+
+// Next returns the next snapshot, or nil and io.EOF at the end of the file.
+func (r *Reader) Next() (*netlink.ArchivalRecord, error) {
+	if r.next != nil {
+		next := r.next
+		r.next = nil
+		return next, nil
+	}
+	if r.err != nil {
+		err := r.err
+		r.err = nil
+		return nil, err
+	}
+	for {
+		ar, err := r.ar.Next()
+		if err != nil {
+			return nil, err
+		}
+		if ar.Metadata == nil {
+			return ar, nil
+		}
+		// A later header, e.g. in files that were concatenated, replaces the first.
+		r.meta = ar.Metadata
+	}
+}
+
+// NextSnapshot returns the next snapshot, decoded, or nil and io.EOF at the end of
+// the file.
+func (r *Reader) NextSnapshot() (*snapshot.Snapshot, error) {
+	ar, err := r.Next()
+	if err != nil {
+		return nil, err
+	}
+	_, snap, err := snapshot.Decode(ar)
+	return snap, err
+}
+
+// Close closes the file, if the Reader was returned by Open.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// OpenFile opens a file, which is decompressed if its name ends in .zst, after
+// verifying it against the manifest of its directory, if there is one.
+func OpenFile(name string) (io.ReadCloser, error) {
+	err := manifest.Verify(name)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(name, ".zst") {
+		return zstd.NewReader(name), nil
+	}
+	return os.Open(name)
+}
+
+// ReadAll returns the header and all the snapshots of a connection file.
+func ReadAll(name string) (*netlink.Metadata, []*netlink.ArchivalRecord, error) {
+	r, err := Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	var records []*netlink.ArchivalRecord
+	for {
+		ar, err := r.Next()
+		if err == io.EOF {
+			return r.Metadata(), records, nil
+		}
+		if err != nil {
+			return r.Metadata(), records, err
+		}
+		records = append(records, ar)
+	}
+}
@@ -0,0 +1,175 @@
+package reader_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/reader"
+	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func TestOpen(t *testing.T) {
+	r, err := reader.Open("../netlink/testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	rtx.Must(err, "Could not open")
+	defer r.Close()
+	if meta := r.Metadata(); meta == nil || meta.UUID != "ndt-7hhhv_1559749627_0000000000062D84" {
+		t.Fatalf("Wrong header %+v", meta)
+	}
+	n := 0
+	for {
+		snap, err := r.NextSnapshot()
+		if err == io.EOF {
+			break
+		}
+		rtx.Must(err, "Could not read snapshot %d", n)
+		if snap.InetDiagMsg == nil || snap.InetDiagMsg.ID.Cookie() != 0x62D84 {
+			t.Fatalf("Snapshot %d has the wrong socket %+v", n, snap.InetDiagMsg)
+		}
+		n++
+	}
+	if n != 891 {
+		t.Error("Expected 891 snapshots, got", n)
+	}
+}
+
+func TestNew(t *testing.T) {
+	// Records without a header, and a header after the first record.
+	input := `{"Timestamp":"2019-07-01T00:00:12Z","RawIDM":"CgEBAILDwkIAAAAAAAAAAAAA//8/8/BlAAAAAAAAAAAAAP//rPsXygAAAACELQYAAAAAAFYBAAAAAAAA5hcAAAAAAABZMC1W"}
+{"Metadata":{"UUID":"later"}}
+{"Timestamp":"2019-07-01T00:00:13Z","RawIDM":"CgEBAILDwkIAAAAAAAAAAAAA//8/8/BlAAAAAAAAAAAAAP//rPsXygAAAACELQYAAAAAAFYBAAAAAAAA5hcAAAAAAABZMC1W"}
+`
+	r := reader.New(strings.NewReader(input))
+	if r.Metadata() != nil {
+		t.Error("Expected no header, got", r.Metadata())
+	}
+	for i := 0; i < 2; i++ {
+		ar, err := r.Next()
+		rtx.Must(err, "Could not read record %d", i)
+		if ar.RawIDM == nil || ar.Timestamp.Second() != 12+i {
+			t.Errorf("Wrong record %d %+v", i, ar)
+		}
+	}
+	if r.Metadata() == nil || r.Metadata().UUID != "later" {
+		t.Error("Expected the later header, got", r.Metadata())
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Error("Expected EOF, got", err)
+	}
+	rtx.Must(r.Close(), "Could not close")
+
+	r = reader.New(strings.NewReader(""))
+	if _, err := r.Next(); err != io.EOF {
+		t.Error("Expected EOF for an empty file, got", err)
+	}
+	r = reader.New(strings.NewReader("{"))
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Error("Expected an error for a bad record, got", err)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, name := range []string{"a.00000.framed.zst", "a.00000.zst", "index_2019.csv"} {
+		if _, err := reader.Open(name); !errors.Is(err, reader.ErrUnsupportedFormat) {
+			t.Errorf("Open(%q) = %v, want ErrUnsupportedFormat", name, err)
+		}
+	}
+	if _, err := reader.Open("missing.jsonl"); !os.IsNotExist(err) {
+		t.Error("Expected a missing file error, got", err)
+	}
+}
+
+// TestRoundTrip checks that the records written by the saver are read back.
+func TestRoundTrip(t *testing.T) {
+	// A single dump of the sockets of a host.
+	rdr, err := zstd.NewInProcessReader("../netlink/testdata/testdata.zst")
+	rtx.Must(err, "Could not open test data")
+	var msgs []*netlink.NetlinkMessage
+	want := make(map[uint64]*netlink.ArchivalRecord)
+	for {
+		msg, err := netlink.LoadRawNetlinkMessage(rdr)
+		if err == io.EOF {
+			break
+		}
+		rtx.Must(err, "Could not load test data")
+		ar, err := netlink.MakeArchivalRecord(msg, true)
+		rtx.Must(err, "Could not parse test data")
+		if ar == nil {
+			continue // A local connection, which the saver skips.
+		}
+		idm, err := ar.RawIDM.Parse()
+		rtx.Must(err, "Could not parse test data")
+		if _, ok := want[idm.ID.Cookie()]; ok {
+			break // The start of the next dump.
+		}
+		want[idm.ID.Cookie()] = ar
+		msgs = append(msgs, msg)
+	}
+	rdr.Close()
+	if len(want) == 0 {
+		t.Fatal("No connections in the test data")
+	}
+
+	dir, err := ioutil.TempDir("", "tcp-info_reader_TestRoundTrip")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("mlab1", "lga03", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.InProcessCompression = true
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2019, 07, 01, 0, 0, 12, 0, time.UTC)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: msgs}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2019/07/01/*.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != len(want) {
+		t.Fatalf("Expected %d files, got %d", len(want), len(names))
+	}
+	for _, name := range names {
+		meta, records, err := reader.ReadAll(name)
+		rtx.Must(err, "Could not read %s", name)
+		if meta == nil || !strings.HasPrefix(filepath.Base(name), meta.UUID+".") || meta.Machine != "mlab1" {
+			t.Errorf("%s: wrong header %+v", name, meta)
+		}
+		if len(records) != 1 {
+			t.Fatalf("%s: expected 1 snapshot, got %d", name, len(records))
+		}
+		idm, err := records[0].RawIDM.Parse()
+		rtx.Must(err, "Could not parse %s", name)
+		w := want[idm.ID.Cookie()]
+		if w == nil || !bytes.Equal(records[0].RawIDM, w.RawIDM) || !records[0].Timestamp.Equal(date) {
+			t.Errorf("%s: wrong snapshot %+v", name, records[0])
+			continue
+		}
+		for i := range w.Attributes {
+			var got []byte
+			if i < len(records[0].Attributes) {
+				got = records[0].Attributes[i]
+			}
+			if !bytes.Equal(got, w.Attributes[i]) {
+				t.Errorf("%s: attribute %d differs", name, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package recovery finds and repairs files left incomplete by a crash, so that
+// crash artifacts don't confuse uploaders and readers.
+//
+// Connection files that are not valid zstd streams, e.g. because the compressor
+// was killed before writing the end of the stream, are finalized by rewriting the
+// complete records that can be recovered, i.e. the lines of JSONL and CSV files,
+// and the frames of framed files.  The compressed files that the saver was still
+// writing, which have a .tmp suffix until they are closed, are finalized in the
+// same way under their final names.  Files that have no recoverable records, files
+// of other formats, and other temporary files, are quarantined.
+package recovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/framed"
+	"github.com/m-lab/tcp-info/manifest"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// QuarantineSuffix is appended to the names of quarantined files when there is
+// no quarantine directory.
+const QuarantineSuffix = ".corrupt"
+
+// Options control a recovery scan.
+type Options struct {
+	// Since limits the scan to files modified after this time.  Files that were
+	// open at the time of a crash will have been modified shortly before it.
+	Since time.Time
+	// QuarantineDir, if not empty, is the directory to which quarantined files
+	// are moved, preserving their relative paths.  Otherwise, quarantined files are
+	// renamed in place with the QuarantineSuffix.
+	QuarantineDir string
+}
+
+// Stats summarizes the results of a recovery scan.
+type Stats struct {
+	Checked     int // Number of compressed files checked.
+	Finalized   int // Number of files rewritten with their recoverable lines.
+	Quarantined int // Number of files quarantined.
+}
+
+// tempSuffix is the suffix of the files still being written by the saver, which
+// is removed when they are closed.  It matches saver.TempSuffix.
+const tempSuffix = ".tmp"
+
+// tempPatterns match the names of the temporary files created in the archive
+// tree, by the saver, by ioutil.TempFile for its checkpoint and the manifests, and
+// by finalize.
+var tempPatterns = []string{"*" + tempSuffix, "checkpoint.json.tmp*", manifest.FileName + ".tmp*", "*.recovering"}
+
+// isTemp returns true for the names of temporary files, which are never complete.
+func isTemp(name string) bool {
+	for _, p := range tempPatterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// completeRecords returns the prefix of the decoded data of the named file that
+// ends with a complete record.  It is empty for the formats whose records cannot
+// be delimited.
+func completeRecords(name string, data []byte) []byte {
+	name = strings.TrimSuffix(name, tempSuffix)
+	switch {
+	case strings.HasSuffix(name, ".jsonl.zst"), strings.HasSuffix(name, ".csv.zst"):
+		return data[:bytes.LastIndexByte(data, '\n')+1]
+	case strings.HasSuffix(name, ".framed.zst"):
+		if !bytes.HasPrefix(data, framed.Magic) {
+			return nil
+		}
+		end := len(framed.Magic)
+		for {
+			n, size := binary.Uvarint(data[end:])
+			if size <= 0 || uint64(len(data)-end-size) < n {
+				break
+			}
+			end += size + int(n)
+		}
+		if end == len(framed.Magic) {
+			return nil
+		}
+		return data[:end]
+	}
+	return nil
+}
+
+// recoverable reads filename, and returns the complete records that can be
+// decoded, and whether the whole file was valid.
+func recoverable(filename string) ([]byte, bool, error) {
+	r, err := zstd.NewInProcessReader(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err == nil {
+		return data, true, nil
+	}
+	return completeRecords(filepath.Base(filename), data), false, nil
+}
+
+// finalize atomically replaces filename with a valid file containing data.
+func finalize(filename string, data []byte) error {
+	tmp := filename + ".recovering"
+	w, err := zstd.NewInProcessWriter(tmp, 0)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	closeErr := w.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// finalizeTemp finalizes the compressed temporary file at path under its final
+// name, without the tempSuffix.  It returns false if the file has no recoverable
+// records, or the final name is already taken, so that the file should be
+// quarantined.
+func finalizeTemp(path string) (bool, error) {
+	final := strings.TrimSuffix(path, tempSuffix)
+	if _, err := os.Stat(final); err == nil {
+		return false, nil
+	}
+	data, valid, err := recoverable(path)
+	if err != nil {
+		return false, err
+	}
+	if valid {
+		// The file was closed, but not renamed.
+		return true, os.Rename(path, final)
+	}
+	if len(data) == 0 {
+		return false, nil
+	}
+	err = finalize(final, data)
+	if err != nil {
+		return false, err
+	}
+	return true, os.Remove(path)
+}
+
+func quarantine(root, path string, opts *Options) error {
+	if opts.QuarantineDir == "" {
+		return os.Rename(path, path+QuarantineSuffix)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(opts.QuarantineDir, rel)
+	err = os.MkdirAll(filepath.Dir(dest), 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, dest)
+}
+
+// Scan checks the compressed files under root, finalizing or quarantining any
+// that were left incomplete.  Errors handling individual files are logged and
+// counted, and do not stop the scan.
+func Scan(root string, opts Options) (Stats, error) {
+	stats := Stats{}
+	quarantineDir, _ := filepath.Abs(opts.QuarantineDir)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if opts.QuarantineDir != "" {
+				if abs, _ := filepath.Abs(path); abs == quarantineDir {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if info.ModTime().Before(opts.Since) {
+			return nil
+		}
+		name := info.Name()
+		switch {
+		case strings.HasSuffix(name, ".zst"+tempSuffix):
+			stats.Checked++
+			var ok bool
+			ok, err = finalizeTemp(path)
+			if err != nil {
+				break
+			}
+			if ok {
+				log.Println("Finalized temporary file", path)
+				metrics.RecoveryFileCount.WithLabelValues("finalized").Inc()
+				stats.Finalized++
+				break
+			}
+			err = quarantine(root, path, &opts)
+			if err == nil {
+				log.Println("Quarantined unrecoverable temporary file", path)
+				metrics.RecoveryFileCount.WithLabelValues("quarantined").Inc()
+				stats.Quarantined++
+			}
+		case isTemp(name):
+			err = quarantine(root, path, &opts)
+			if err == nil {
+				log.Println("Quarantined temporary file", path)
+				metrics.RecoveryFileCount.WithLabelValues("quarantined").Inc()
+				stats.Quarantined++
+			}
+		case strings.HasSuffix(name, ".zst"):
+			stats.Checked++
+			var data []byte
+			var valid bool
+			data, valid, err = recoverable(path)
+			if err != nil || valid {
+				break
+			}
+			if len(data) == 0 {
+				err = quarantine(root, path, &opts)
+				if err == nil {
+					log.Println("Quarantined unrecoverable file", path)
+					metrics.RecoveryFileCount.WithLabelValues("quarantined").Inc()
+					stats.Quarantined++
+				}
+				break
+			}
+			err = finalize(path, data)
+			if err == nil {
+				log.Println("Finalized incomplete file", path)
+				metrics.RecoveryFileCount.WithLabelValues("finalized").Inc()
+				stats.Finalized++
+			}
+		}
+		if err != nil {
+			log.Println("Could not recover", path, err)
+			metrics.ErrorCount.WithLabelValues("recovery").Inc()
+		}
+		return nil
+	})
+	return stats, err
+}
@@ -0,0 +1,234 @@
+package recovery_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/framed"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/recovery"
+	"github.com/m-lab/tcp-info/zstd"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func writeZstd(t *testing.T, filename string, lines int, frameSize int) {
+	w, err := zstd.NewInProcessWriter(filename, frameSize)
+	rtx.Must(err, "Could not create %s", filename)
+	for i := 0; i < lines; i++ {
+		w.Write([]byte(strings.Repeat("x", 99) + "\n"))
+	}
+	rtx.Must(w.Close(), "Could not close %s", filename)
+}
+
+func read(t *testing.T, filename string) string {
+	r, err := zstd.NewInProcessReader(filename)
+	rtx.Must(err, "Could not open %s", filename)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	rtx.Must(err, "Could not read %s", filename)
+	return string(b)
+}
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestScan")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	rtx.Must(os.MkdirAll(data+"/2018/02/06", 0777), "Could not create dirs")
+
+	// A valid file, a truncated file, an unrecoverable file, and a temp file.
+	valid := data + "/2018/02/06/valid.00000.jsonl.zst"
+	writeZstd(t, valid, 10, 0)
+	truncated := data + "/2018/02/06/truncated.00000.jsonl.zst"
+	writeZstd(t, truncated, 10, 250)
+	info, err := os.Stat(truncated)
+	rtx.Must(err, "Could not stat")
+	rtx.Must(os.Truncate(truncated, info.Size()-5), "Could not truncate")
+	garbage := data + "/2018/02/06/garbage.00000.jsonl.zst"
+	rtx.Must(ioutil.WriteFile(garbage, []byte("not zstd"), 0644), "Could not write")
+	temp := data + "/checkpoint.json.tmp123"
+	rtx.Must(ioutil.WriteFile(temp, []byte("{"), 0644), "Could not write")
+	// An old file is not checked.
+	old := data + "/2018/02/06/old.00000.jsonl.zst"
+	rtx.Must(ioutil.WriteFile(old, []byte("not zstd"), 0644), "Could not write")
+	rtx.Must(os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)), "Could not set time")
+
+	quarantine := filepath.Join(dir, "quarantine")
+	stats, err := recovery.Scan(data, recovery.Options{Since: time.Now().Add(-time.Minute), QuarantineDir: quarantine})
+	rtx.Must(err, "Scan failed")
+	if stats.Checked != 3 || stats.Finalized != 1 || stats.Quarantined != 2 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+
+	if len(read(t, valid)) != 1000 {
+		t.Error("Valid file was changed")
+	}
+	// The last frame is lost, leaving 7 complete lines and a partial line.
+	if len(read(t, truncated)) != 700 {
+		t.Error("Expected 7 complete lines, got", len(read(t, truncated)))
+	}
+	for _, name := range []string{"2018/02/06/garbage.00000.jsonl.zst", "checkpoint.json.tmp123"} {
+		if _, err := os.Stat(filepath.Join(quarantine, name)); err != nil {
+			t.Error("Missing quarantined file", name, err)
+		}
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Error("Old file should not be touched", err)
+	}
+
+	// Without a quarantine directory, files are renamed in place.
+	rtx.Must(ioutil.WriteFile(garbage, []byte("not zstd"), 0644), "Could not write")
+	_, err = recovery.Scan(data, recovery.Options{Since: time.Now().Add(-time.Minute)})
+	rtx.Must(err, "Scan failed")
+	if _, err := os.Stat(garbage + recovery.QuarantineSuffix); err != nil {
+		t.Error("Missing quarantined file", err)
+	}
+}
+
+func TestScanTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestScanTemp")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	day := filepath.Join(dir, "2018/02/06")
+	rtx.Must(os.MkdirAll(day, 0777), "Could not create dirs")
+
+	// A temporary file that was closed but not renamed, one that was truncated by
+	// a crash, one with nothing to recover, and one whose final name is taken.
+	closed := day + "/closed.00000.jsonl.zst"
+	writeZstd(t, closed+".tmp", 10, 0)
+	truncated := day + "/truncated.00000.jsonl.zst"
+	writeZstd(t, truncated+".tmp", 10, 250)
+	info, err := os.Stat(truncated + ".tmp")
+	rtx.Must(err, "Could not stat")
+	rtx.Must(os.Truncate(truncated+".tmp", info.Size()-5), "Could not truncate")
+	garbage := day + "/garbage.00000.jsonl.zst"
+	rtx.Must(ioutil.WriteFile(garbage+".tmp", []byte("not zstd"), 0644), "Could not write")
+	taken := day + "/taken.00000.jsonl.zst"
+	writeZstd(t, taken, 10, 0)
+	writeZstd(t, taken+".tmp", 5, 0)
+
+	stats, err := recovery.Scan(dir, recovery.Options{Since: time.Now().Add(-time.Minute)})
+	rtx.Must(err, "Scan failed")
+	if stats.Checked != 5 || stats.Finalized != 2 || stats.Quarantined != 2 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+
+	if len(read(t, closed)) != 1000 {
+		t.Error("Expected 10 lines, got", len(read(t, closed)))
+	}
+	if len(read(t, truncated)) != 700 {
+		t.Error("Expected 7 complete lines, got", len(read(t, truncated)))
+	}
+	if len(read(t, taken)) != 1000 {
+		t.Error("Existing file was changed")
+	}
+	for _, name := range []string{closed, truncated} {
+		if _, err := os.Stat(name + ".tmp"); !os.IsNotExist(err) {
+			t.Error("Temporary file was not removed", name, err)
+		}
+	}
+	for _, name := range []string{garbage, taken} {
+		if _, err := os.Stat(name + ".tmp" + recovery.QuarantineSuffix); err != nil {
+			t.Error("Missing quarantined file", name, err)
+		}
+	}
+}
+
+func TestScanFinalizeError(t *testing.T) {
+	dir := t.TempDir()
+	truncated := dir + "/truncated.00000.jsonl.zst"
+	writeZstd(t, truncated, 10, 250)
+	info, err := os.Stat(truncated)
+	rtx.Must(err, "Could not stat")
+	rtx.Must(os.Truncate(truncated, info.Size()-5), "Could not truncate")
+	// A directory in the way of the file that finalize writes makes it fail.
+	rtx.Must(os.Mkdir(truncated+".recovering", 0777), "Could not create dir")
+
+	var m dto.Metric
+	rtx.Must(metrics.ErrorCount.WithLabelValues("recovery").Write(&m), "Could not read counter")
+	before := m.GetCounter().GetValue()
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	stats, err := recovery.Scan(dir, recovery.Options{Since: time.Now().Add(-time.Minute)})
+	rtx.Must(err, "Scan failed")
+	if stats.Checked != 1 || stats.Finalized != 0 || stats.Quarantined != 0 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	if !strings.Contains(buf.String(), "Could not recover "+truncated) {
+		t.Errorf("The error was not logged: %q", buf.String())
+	}
+	rtx.Must(metrics.ErrorCount.WithLabelValues("recovery").Write(&m), "Could not read counter")
+	if m.GetCounter().GetValue() != before+1 {
+		t.Error("The error was not counted", m.GetCounter().GetValue(), before)
+	}
+}
+
+type message struct {
+	N int
+	S string
+}
+
+func TestScanFramed(t *testing.T) {
+	dir := t.TempDir()
+	enc, err := framed.NewEncoder(&message{})
+	rtx.Must(err, "Could not create encoder")
+	data := enc.Header()
+	for i := 0; i < 10; i++ {
+		data, err = enc.Append(data, &message{N: i, S: strings.Repeat("x", 99)})
+		rtx.Must(err, "Could not encode")
+	}
+	// A framed file and a file of an unknown format, truncated in the middle of a
+	// record, and a file with .tmp in the middle of its name.
+	truncated := dir + "/truncated.00000.framed.zst"
+	other := dir + "/other.00000.zst"
+	for _, name := range []string{truncated + ".tmp", other} {
+		w, err := zstd.NewInProcessWriter(name, 250)
+		rtx.Must(err, "Could not create %s", name)
+		w.Write(data)
+		rtx.Must(w.Close(), "Could not close %s", name)
+		info, err := os.Stat(name)
+		rtx.Must(err, "Could not stat")
+		rtx.Must(os.Truncate(name, info.Size()-5), "Could not truncate")
+	}
+	notTemp := dir + "/a.tmpdir.00000.jsonl.zst"
+	writeZstd(t, notTemp, 10, 0)
+
+	stats, err := recovery.Scan(dir, recovery.Options{Since: time.Now().Add(-time.Minute)})
+	rtx.Must(err, "Scan failed")
+	if stats.Checked != 3 || stats.Finalized != 1 || stats.Quarantined != 1 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+
+	// The framed file is cut after its last complete frame.
+	got := []byte(read(t, truncated))
+	if len(got) == 0 || len(got) >= len(data) || !bytes.Equal(got, data[:len(got)]) {
+		t.Fatalf("Expected a prefix of the file, got %d of %d bytes", len(got), len(data))
+	}
+	frames := 0
+	for b := got[len(framed.Magic):]; len(b) > 0; frames++ {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || uint64(len(b)-size) < n {
+			t.Fatal("Truncated frame")
+		}
+		b = b[size+int(n):]
+	}
+	if frames < 2 || frames > 10 {
+		t.Error("Expected the schema and some records, got", frames, "frames")
+	}
+	if _, err := os.Stat(other + recovery.QuarantineSuffix); err != nil {
+		t.Error("The file of an unknown format was not quarantined", err)
+	}
+	if len(read(t, notTemp)) != 1000 {
+		t.Error("The file with .tmp in its name was changed")
+	}
+}
@@ -0,0 +1,194 @@
+// Package remotewrite pushes the collector's aggregate Prometheus metrics to an
+// endpoint that implements the Prometheus remote write protocol, for environments
+// where the metrics cannot be scraped.
+//
+// Only the registered metrics are sent.  They describe the collector as a whole,
+// and carry no per-connection data.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// Client periodically gathers metrics and writes them to a remote write endpoint.
+type Client struct {
+	URL      string            // URL of the remote write endpoint.
+	Interval time.Duration     // Time between writes.
+	Labels   map[string]string // Labels added to every series, e.g. instance.
+
+	// Gatherer provides the metrics.  If nil, prometheus.DefaultGatherer is used.
+	Gatherer prometheus.Gatherer
+	// HTTPClient makes the requests.  If nil, a client with a timeout of Interval is used.
+	HTTPClient *http.Client
+}
+
+// label is a name and value pair of a series.
+type label struct {
+	name, value string
+}
+
+// series is a single sample of a time series.
+type series struct {
+	labels []label
+	value  float64
+}
+
+// Push gathers the metrics once, and writes them to the endpoint.
+func (c *Client) Push(ctx context.Context) error {
+	g := c.Gatherer
+	if g == nil {
+		g = prometheus.DefaultGatherer
+	}
+	families, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	body := s2.EncodeSnappy(nil, encode(c.series(families), time.Now().UnixNano()/int64(time.Millisecond)))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "tcp-info")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	client := c.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: c.Interval}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("remote write to %s: %s: %s", c.URL, resp.Status, msg)
+	}
+	return nil
+}
+
+// Run pushes the metrics every Interval until the context is canceled.
+func (c *Client) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := c.Push(ctx)
+			if err != nil {
+				metrics.ErrorCount.WithLabelValues("remote write").Inc()
+				log.Println("Could not write metrics:", err)
+			}
+		}
+	}
+}
+
+// series flattens the metric families into series, as a scrape would.  Histograms
+// and summaries become several series, with the _bucket, _sum and _count suffixes.
+func (c *Client) series(families []*dto.MetricFamily) []series {
+	var out []series
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			base := make([]label, 0, len(m.GetLabel())+len(c.Labels)+2)
+			for k, v := range c.Labels {
+				base = append(base, label{k, v})
+			}
+			for _, lp := range m.GetLabel() {
+				base = append(base, label{lp.GetName(), lp.GetValue()})
+			}
+			add := func(name string, value float64, extra ...label) {
+				ls := append([]label{{"__name__", name}}, base...)
+				ls = append(ls, extra...)
+				sort.Slice(ls, func(i, j int) bool { return ls[i].name < ls[j].name })
+				out = append(out, series{labels: ls, value: value})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return out
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encode returns the protobuf encoding of a prometheus.WriteRequest holding the
+// series, each with a single sample at the timestamp, in milliseconds.
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encode(ss []series, timestamp int64) []byte {
+	var req, ts, msg []byte
+	for _, s := range ss {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
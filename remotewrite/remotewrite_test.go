@@ -0,0 +1,108 @@
+package remotewrite_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/m-lab/tcp-info/remotewrite"
+)
+
+// fields decodes the length delimited and fixed64 fields of a protobuf message.
+func fields(t *testing.T, b []byte) map[protowire.Number][][]byte {
+	out := map[protowire.Number][][]byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal("Bad tag")
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			out[num] = append(out[num], v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			out[num] = append(out[num], b[:8])
+			b = b[8:]
+		case protowire.VarintType:
+			_, n := protowire.ConsumeVarint(b)
+			b = b[n:]
+		default:
+			t.Fatal("Unexpected wire type", typ)
+		}
+	}
+	return out
+}
+
+func TestPush(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "test"}, []string{"kind"})
+	hist := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "test", Buckets: []float64{1}})
+	reg.MustRegister(counter, hist)
+	counter.WithLabelValues("a").Add(3)
+	hist.Observe(0.5)
+
+	var body []byte
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		b, err := ioutil.ReadAll(r.Body)
+		rtx.Must(err, "Could not read body")
+		body, err = s2.Decode(nil, b)
+		rtx.Must(err, "Could not decode snappy")
+	}))
+	defer srv.Close()
+
+	c := &remotewrite.Client{URL: srv.URL, Interval: time.Second, Labels: map[string]string{"instance": "host"}, Gatherer: reg}
+	rtx.Must(c.Push(context.Background()), "Could not push")
+	if header.Get("Content-Encoding") != "snappy" || header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Error("Wrong headers", header)
+	}
+
+	got := map[string]float64{}
+	for _, ts := range fields(t, body)[1] {
+		f := fields(t, ts)
+		var ls []string
+		for _, l := range f[1] {
+			lf := fields(t, l)
+			ls = append(ls, string(lf[1][0])+"="+string(lf[2][0]))
+		}
+		sample := fields(t, f[2][0])
+		got[strings.Join(ls, ",")] = math.Float64frombits(binary.LittleEndian.Uint64(sample[1][0]))
+	}
+	want := map[string]float64{
+		"__name__=test_total,instance=host,kind=a":           3,
+		"__name__=test_seconds_bucket,instance=host,le=1":    1,
+		"__name__=test_seconds_bucket,instance=host,le=+Inf": 1,
+		"__name__=test_seconds_sum,instance=host":            0.5,
+		"__name__=test_seconds_count,instance=host":          1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+func TestPushError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	c := &remotewrite.Client{URL: srv.URL, Interval: time.Second, Gatherer: prometheus.NewRegistry()}
+	err := c.Push(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "out of order sample") {
+		t.Error("Expected an error with the response, got", err)
+	}
+}
@@ -0,0 +1,8 @@
+package rpc
+
+// Watchers returns the number of Watch calls in progress.
+func (s *Server) Watchers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.watchers)
+}
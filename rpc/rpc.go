@@ -0,0 +1,385 @@
+// Package rpc streams the snapshots recorded by the saver over gRPC, so that
+// consumers, e.g. anomaly detectors, receive new and changed connections as they
+// are recorded, rather than tailing the compressed connection files.
+//
+// The tcpinfo.TCPInfo service has a single server streaming method, Watch, which
+// streams a ParsedMessage for each snapshot.  The messages are derived from the Go
+// types with package framed, and Schema returns their proto3 definition, from which
+// protoc can generate clients.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/m-lab/tcp-info/framed"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+// ServiceName is the full name of the gRPC service.
+const ServiceName = "tcpinfo.TCPInfo"
+
+// WatchMethod is the full name of the Watch method, as used by gRPC clients.
+const WatchMethod = "/" + ServiceName + "/Watch"
+
+// ErrWrongMessage is returned when marshalling or unmarshalling a message of a type
+// that is not part of the service.
+var ErrWrongMessage = errors.New("not a tcpinfo message")
+
+// WatchRequest selects the connections streamed by Watch.  A connection is selected
+// if, for each list that is not empty, its port is in the list.
+type WatchRequest struct {
+	LocalPorts  []uint16
+	RemotePorts []uint16
+}
+
+// ParsedMessage is a snapshot of a connection, as streamed by Watch.
+type ParsedMessage struct {
+	UUID     string // The UUID of the connection, as in the file names.
+	Cookie   uint64
+	SrcIP    string
+	SPort    uint16
+	DstIP    string
+	DPort    uint16
+	Snapshot snapshot.Snapshot
+}
+
+var (
+	requestEncoder = mustEncoder(&WatchRequest{})
+	messageEncoder = mustEncoder(&ParsedMessage{})
+)
+
+func mustEncoder(v interface{}) *framed.Encoder {
+	enc, err := framed.NewEncoder(v)
+	if err != nil {
+		panic(err)
+	}
+	return enc
+}
+
+// Schema returns the proto3 definition of the service and its messages.
+func Schema() string {
+	req, _ := framed.Schema(reflect.TypeOf(WatchRequest{}))
+	msg, _ := framed.Schema(reflect.TypeOf(ParsedMessage{}))
+	_, req, _ = strings.Cut(req, "\n")
+	return msg + req + "\nservice TCPInfo {\n  rpc Watch(WatchRequest) returns (stream ParsedMessage);\n}\n"
+}
+
+// rawMessage is a message that is already encoded.
+type rawMessage []byte
+
+// codec marshals the messages of the service with package framed, which has no
+// decoder, so only WatchRequests are unmarshalled, and ParsedMessages are received
+// still encoded.
+type codec struct{}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case rawMessage:
+		return m, nil
+	case *WatchRequest:
+		return requestEncoder.Marshal(m)
+	}
+	return nil, fmt.Errorf("%w: %T", ErrWrongMessage, v)
+}
+
+func (codec) Unmarshal(b []byte, v interface{}) error {
+	switch m := v.(type) {
+	case *[]byte:
+		*m = append((*m)[:0], b...)
+		return nil
+	case *WatchRequest:
+		return unmarshalRequest(b, m)
+	}
+	return fmt.Errorf("%w: %T", ErrWrongMessage, v)
+}
+
+var _ encoding.Codec = codec{}
+
+// unmarshalRequest decodes a WatchRequest, whose ports may be packed or not.
+func unmarshalRequest(b []byte, req *WatchRequest) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var ports *[]uint16
+		switch num {
+		case 1:
+			ports = &req.LocalPorts
+		case 2:
+			ports = &req.RemotePorts
+		}
+		switch {
+		case ports != nil && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*ports = append(*ports, uint16(v))
+			b = b[n:]
+		case ports != nil && typ == protowire.BytesType:
+			packed, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			for len(packed) > 0 {
+				v, m := protowire.ConsumeVarint(packed)
+				if m < 0 {
+					return protowire.ParseError(m)
+				}
+				*ports = append(*ports, uint16(v))
+				packed = packed[m:]
+			}
+			b = b[n:]
+		default:
+			// Unknown fields are skipped, as in proto3.
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func hasPort(ports []uint16, port uint16) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// watcher is a Watch call in progress.
+type watcher struct {
+	req      *WatchRequest
+	messages chan rawMessage
+}
+
+func (w *watcher) selects(m *ParsedMessage) bool {
+	if len(w.req.LocalPorts) > 0 && !hasPort(w.req.LocalPorts, m.SPort) {
+		return false
+	}
+	return len(w.req.RemotePorts) == 0 || hasPort(w.req.RemotePorts, m.DPort)
+}
+
+// Server is a sink.Sink that streams the snapshots published to it to the Watch
+// calls of its gRPC server.  Each call has a buffer of messages, and messages are
+// dropped when it is full, so that a slow client cannot slow the saver.
+type Server struct {
+	// Addr is the listen address.  ListenAndServeAsync updates it with the address
+	// actually used, e.g. if its port is 0.
+	Addr string
+
+	buffer int
+	grpc   *grpc.Server
+
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+	closed   bool
+}
+
+// NewServer returns a Server for the listen address addr, which buffers up to
+// buffer messages for each Watch call.
+func NewServer(addr string, buffer int) *Server {
+	s := &Server{
+		Addr:     addr,
+		buffer:   buffer,
+		grpc:     grpc.NewServer(grpc.ForceServerCodec(codec{})),
+		watchers: make(map[*watcher]struct{}),
+	}
+	s.grpc.RegisterService(&serviceDesc, s)
+	return s
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Watch",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := &WatchRequest{}
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(*Server).watch(req, stream)
+		},
+	}},
+}
+
+// ListenAndServeAsync listens on Addr, and serves in the background until Stop is
+// called.
+func (s *Server) ListenAndServeAsync() error {
+	lis, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.Addr = lis.Addr().String()
+	go s.grpc.Serve(lis)
+	return nil
+}
+
+// Stop ends all Watch calls, and stops the server.
+func (s *Server) Stop() {
+	s.Close()
+	s.grpc.GracefulStop()
+}
+
+// watch streams the messages selected by req, until the client cancels the call,
+// or the Server is closed.
+func (s *Server) watch(req *WatchRequest, stream grpc.ServerStream) error {
+	w := &watcher{req: req, messages: make(chan rawMessage, s.buffer)}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case m, ok := <-w.messages:
+			if !ok {
+				return nil
+			}
+			if err := stream.SendMsg(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parse returns the ParsedMessage for a snapshot record.
+func parse(rec sink.Record) (*ParsedMessage, error) {
+	var ar netlink.ArchivalRecord
+	if err := json.Unmarshal(rec.Data, &ar); err != nil {
+		return nil, err
+	}
+	_, snap, err := snapshot.Decode(&ar)
+	if err != nil {
+		return nil, err
+	}
+	if snap.InetDiagMsg == nil {
+		// Records with only Metadata are not snapshots.
+		return nil, snapshot.ErrEmptyRecord
+	}
+	id := &snap.InetDiagMsg.ID
+	return &ParsedMessage{
+		UUID:     rec.UUID,
+		Cookie:   id.Cookie(),
+		SrcIP:    id.SrcIP().String(),
+		SPort:    id.SPort(),
+		DstIP:    id.DstIP().String(),
+		DPort:    id.DPort(),
+		Snapshot: *snap,
+	}, nil
+}
+
+// Publish implements sink.Sink.  Only snapshots are streamed.
+func (s *Server) Publish(rec sink.Record) {
+	if rec.Type != sink.Snapshot {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.watchers) == 0 {
+		return
+	}
+	m, err := parse(rec)
+	if errors.Is(err, snapshot.ErrEmptyRecord) {
+		return
+	}
+	if err != nil {
+		metrics.SinkRecordCount.WithLabelValues("grpc", "dropped").Inc()
+		return
+	}
+	b, err := messageEncoder.Marshal(m)
+	if err != nil {
+		metrics.SinkRecordCount.WithLabelValues("grpc", "dropped").Inc()
+		return
+	}
+	for w := range s.watchers {
+		if !w.selects(m) {
+			continue
+		}
+		select {
+		case w.messages <- b:
+			metrics.SinkRecordCount.WithLabelValues("grpc", "published").Inc()
+		default:
+			metrics.SinkRecordCount.WithLabelValues("grpc", "dropped").Inc()
+		}
+	}
+}
+
+// Close implements sink.Sink.  It ends the Watch calls once they have sent the
+// buffered messages.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		for w := range s.watchers {
+			close(w.messages)
+		}
+	}
+	return nil
+}
+
+// WatchStream receives the messages of a Watch call.
+type WatchStream struct {
+	stream grpc.ClientStream
+}
+
+// Watch starts a Watch call on cc.  The call ends when ctx is cancelled.
+func Watch(ctx context.Context, cc grpc.ClientConnInterface, req *WatchRequest) (*WatchStream, error) {
+	stream, err := cc.NewStream(ctx, &serviceDesc.Streams[0], WatchMethod, grpc.ForceCodec(codec{}))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &WatchStream{stream: stream}, nil
+}
+
+// Recv returns the protobuf encoding of the next ParsedMessage, or io.EOF when the
+// server ends the call.
+func (w *WatchStream) Recv() ([]byte, error) {
+	var b []byte
+	if err := w.stream.RecvMsg(&b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
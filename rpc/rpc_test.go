@@ -0,0 +1,130 @@
+package rpc_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/m-lab/tcp-info/rpc"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+const (
+	uuid     = "ndt-jdczh_1553815964_00000000000003E8"
+	testFile = "../cmd/csvtool/testdata/" + uuid + ".00183.jsonl.zst"
+)
+
+// records returns the records of the test file.
+func records(t *testing.T) [][]byte {
+	rdr := zstd.NewReader(testFile)
+	defer rdr.Close()
+	var out [][]byte
+	sc := bufio.NewScanner(rdr)
+	for sc.Scan() {
+		out = append(out, append([]byte{}, sc.Bytes()...))
+	}
+	rtx.Must(sc.Err(), "Could not read test file")
+	return out
+}
+
+// fields returns the string and varint fields of an encoded message by number.
+func fields(t *testing.T, b []byte) map[protowire.Number]interface{} {
+	out := make(map[protowire.Number]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal("Bad tag", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			out[num] = v
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			out[num] = string(v)
+			b = b[n:]
+		default:
+			t.Fatal("Unexpected wire type", typ)
+		}
+	}
+	return out
+}
+
+func TestWatch(t *testing.T) {
+	s := rpc.NewServer("localhost:0", 1000)
+	rtx.Must(s.ListenAndServeAsync(), "Could not serve")
+	defer s.Stop()
+	cc, err := grpc.Dial(s.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	rtx.Must(err, "Could not dial")
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	all, err := rpc.Watch(ctx, cc, &rpc.WatchRequest{})
+	rtx.Must(err, "Could not watch")
+	none, err := rpc.Watch(ctx, cc, &rpc.WatchRequest{RemotePorts: []uint16{1}})
+	rtx.Must(err, "Could not watch")
+	for s.Watchers() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	recs := records(t)
+	// The first record is the metadata, which is not a snapshot.
+	for _, r := range recs {
+		s.Publish(sink.Record{UUID: uuid, Type: sink.Snapshot, Time: time.Now(), Data: r})
+	}
+	s.Publish(sink.Record{UUID: uuid, Type: sink.ConnectionSummary, Time: time.Now(), Data: []byte("{}")})
+	rtx.Must(s.Close(), "Could not close")
+
+	n := 0
+	for {
+		b, err := all.Recv()
+		if err == io.EOF {
+			break
+		}
+		rtx.Must(err, "Could not receive")
+		f := fields(t, b)
+		if f[1] != uuid || f[2] != uint64(0x3E8) || f[3] == "" || f[5] == "" {
+			t.Errorf("Wrong message %v", f)
+		}
+		if _, ok := f[7].(string); !ok {
+			t.Error("Missing snapshot in", f)
+		}
+		n++
+	}
+	if n != len(recs)-1 {
+		t.Errorf("Received %d messages, want %d", n, len(recs)-1)
+	}
+	if _, err := none.Recv(); err != io.EOF {
+		t.Error("Expected no messages, got", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := rpc.Schema()
+	for _, want := range []string{
+		"message ParsedMessage {",
+		"  Snapshot Snapshot = 7;",
+		"message WatchRequest {",
+		"  repeated uint32 LocalPorts = 1;",
+		"rpc Watch(WatchRequest) returns (stream ParsedMessage);",
+	} {
+		if !strings.Contains(schema, want) {
+			t.Errorf("Schema does not contain %q:\n%s", want, schema)
+		}
+	}
+	if strings.Count(schema, "syntax") != 1 {
+		t.Error("Schema should have one syntax statement:\n", schema)
+	}
+}
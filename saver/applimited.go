@@ -0,0 +1,78 @@
+package saver
+
+import (
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sink"
+)
+
+// A sender is application limited when it has less data to send than its
+// congestion window allows, so the delivery rate it measures reflects the
+// application, not the network.  The kernel marks each delivery rate sample taken
+// while it was, in tcpi_delivery_rate_app_limited.  The saver tracks the periods of
+// consecutive app-limited snapshots of each recorded connection, and publishes them
+// in its sink.Summary, so that throughput analyses can separate network-limited
+// from app-limited behavior without decoding every snapshot.
+
+// maxAppLimitedPeriods bounds the periods listed in the summary of a connection.
+const maxAppLimitedPeriods = 100
+
+// appLimited tracks the app-limited periods of a connection.
+type appLimited struct {
+	periods []sink.AppLimitedPeriod
+	total   time.Duration // The total duration of the periods, listed or not.
+	open    bool          // Whether current has not ended.
+	current sink.AppLimitedPeriod
+	// maxRate is the highest delivery rate of the samples that were not app limited.
+	maxRate uint64
+	last    time.Time // Timestamp of the last snapshot.
+}
+
+// observe updates the periods with a snapshot of the connection.
+func (a *appLimited) observe(ar *netlink.ArchivalRecord) {
+	rate, limited, ok := ar.GetDeliveryRate()
+	if !ok || ar.Timestamp.Before(a.last) {
+		return
+	}
+	a.last = ar.Timestamp
+	switch {
+	case limited && !a.open:
+		a.open = true
+		a.current = sink.AppLimitedPeriod{Start: ar.Timestamp, End: ar.Timestamp, MaxDeliveryRate: rate}
+	case limited:
+		a.current.End = ar.Timestamp
+		if rate > a.current.MaxDeliveryRate {
+			a.current.MaxDeliveryRate = rate
+		}
+	case a.open:
+		// The period ends with the first sample that is not app limited.
+		a.current.End = ar.Timestamp
+		a.end()
+		fallthrough
+	default:
+		if rate > a.maxRate {
+			a.maxRate = rate
+		}
+	}
+}
+
+// end adds the current period to the periods.
+func (a *appLimited) end() {
+	a.open = false
+	a.total += a.current.End.Sub(a.current.Start)
+	if len(a.periods) < maxAppLimitedPeriods {
+		a.periods = append(a.periods, a.current)
+	}
+}
+
+// summarize sets the app-limited fields of the summary of the connection, ending
+// any period that is still open at its last snapshot.
+func (a *appLimited) summarize(sum *sink.Summary) {
+	if a.open {
+		a.end()
+	}
+	sum.AppLimited = a.periods
+	sum.AppLimitedTime = a.total
+	sum.MaxDeliveryRate = a.maxRate
+}
@@ -0,0 +1,119 @@
+package saver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// Errors returned by SetAttributePolicy.
+var (
+	ErrUnknownAttribute = errors.New("unknown attribute")
+	// TCPInfo is used to detect changes, and to account for the bytes of each
+	// connection, so it cannot be dropped.
+	ErrRequiredAttribute = errors.New("attribute cannot be dropped")
+)
+
+// maxAttribute is the largest attribute type kept by netlink.MakeArchivalRecord.
+const maxAttribute = 2 * inetdiag.INET_DIAG_MAX
+
+// attributeType returns the type of the attribute with the name, ignoring case, or
+// the type number.
+func attributeType(name string) (int, error) {
+	for t, n := range inetdiag.InetDiagType {
+		if strings.EqualFold(n, name) {
+			return int(t), nil
+		}
+	}
+	t, err := strconv.Atoi(name)
+	if err != nil || t <= 0 || t > maxAttribute {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownAttribute, name)
+	}
+	return t, nil
+}
+
+// attributeName returns the name of the attribute type, as recorded in the
+// AttributePolicy.
+func attributeName(t int) string {
+	if n, ok := inetdiag.InetDiagType[int32(t)]; ok {
+		return n
+	}
+	return strconv.Itoa(t)
+}
+
+// attributeFilter drops the attributes excluded by its policy from records,
+// before they are cached, so that changes to them are also ignored.
+type attributeFilter struct {
+	policy *netlink.AttributePolicy
+	drop   [maxAttribute + 1]bool
+}
+
+// newAttributeFilter returns the filter that keeps only the allowed attributes, if
+// any are listed, and drops the denied ones.  It returns nil if both are empty.
+func newAttributeFilter(allow, deny []string) (*attributeFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &attributeFilter{policy: &netlink.AttributePolicy{}}
+	if len(allow) > 0 {
+		for t := range f.drop {
+			f.drop[t] = true
+		}
+	}
+	for _, name := range allow {
+		t, err := attributeType(name)
+		if err != nil {
+			return nil, err
+		}
+		f.drop[t] = false
+		f.policy.Allow = append(f.policy.Allow, attributeName(t))
+	}
+	for _, name := range deny {
+		t, err := attributeType(name)
+		if err != nil {
+			return nil, err
+		}
+		f.drop[t] = true
+		f.policy.Deny = append(f.policy.Deny, attributeName(t))
+	}
+	if f.drop[inetdiag.INET_DIAG_INFO] {
+		return nil, fmt.Errorf("%w: %s", ErrRequiredAttribute, attributeName(inetdiag.INET_DIAG_INFO))
+	}
+	return f, nil
+}
+
+// apply removes the dropped attributes from ar, and trims the trailing empty ones.
+func (f *attributeFilter) apply(ar *netlink.ArchivalRecord) {
+	if f == nil {
+		return
+	}
+	attrs := ar.Attributes
+	for t := range attrs {
+		if t < len(f.drop) && f.drop[t] {
+			attrs[t] = nil
+		}
+	}
+	n := len(attrs)
+	for n > 0 && attrs[n-1] == nil {
+		n--
+	}
+	ar.Attributes = attrs[:n]
+}
+
+// SetAttributePolicy drops attributes from the records, to reduce their size.  If
+// allow is not empty, only the listed attributes are kept.  Those listed in deny
+// are dropped.  Attributes are named as in inetdiag.InetDiagType, ignoring case,
+// or by their type number.  The policy is recorded in every file header.  It must
+// be called before MessageSaverLoop is started.
+func (svr *Saver) SetAttributePolicy(allow, deny []string) error {
+	f, err := newAttributeFilter(allow, deny)
+	if err != nil {
+		return err
+	}
+	svr.attributes = f
+	return nil
+}
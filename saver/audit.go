@@ -0,0 +1,50 @@
+package saver
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// maxAuditEvents bounds the number of audit events retained in memory.
+const maxAuditEvents = 1000
+
+// auditLog holds the most recent runtime setting changes.  It is threadsafe.
+type auditLog struct {
+	lock   sync.Mutex
+	events []netlink.AuditEvent
+}
+
+func (a *auditLog) add(e netlink.AuditEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.events = append(a.events, e)
+	if len(a.events) > maxAuditEvents {
+		a.events = a.events[len(a.events)-maxAuditEvents:]
+	}
+}
+
+// since returns the events that occurred after t.
+func (a *auditLog) since(t time.Time) []netlink.AuditEvent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var result []netlink.AuditEvent
+	for i := range a.events {
+		if a.events[i].Time.After(t) {
+			result = append(result, a.events[i])
+		}
+	}
+	return result
+}
+
+// Audit records a change to a runtime setting.  The change is logged, counted in
+// metrics, and recorded in the metadata of subsequently created files.  It is
+// safe to call concurrently with MessageSaverLoop.
+func (svr *Saver) Audit(setting, value, source string) {
+	log.Printf("Setting %s changed to %q by %s\n", setting, value, source)
+	metrics.SettingChangeCount.WithLabelValues(setting, source).Inc()
+	svr.audit.add(netlink.AuditEvent{Time: time.Now(), Setting: setting, Value: value, Source: source})
+}
@@ -0,0 +1,81 @@
+package saver
+
+import (
+	"io"
+	"time"
+)
+
+// batchFlushInterval is how often each marshaller checks for batches that have
+// exceeded their delay.
+const batchFlushInterval = 100 * time.Millisecond
+
+// batchWriter accumulates small writes, and passes them to the underlying writer
+// in a single Write once the batch reaches maxSize bytes, or has been pending for
+// maxDelay.  This reduces the number of pipe writes to the compressor for
+// connections that produce many snapshots.
+//
+// A batchWriter is not safe for concurrent use.  All writes after the file header
+// are made by the connection's marshaller, which also flushes delayed batches.
+type batchWriter struct {
+	io.WriteCloser
+	buf      []byte
+	maxSize  int
+	maxDelay time.Duration
+	since    time.Time // Time of the first write in the current batch.
+}
+
+func newBatchWriter(w io.WriteCloser, maxSize int, maxDelay time.Duration) *batchWriter {
+	return &batchWriter{WriteCloser: w, maxSize: maxSize, maxDelay: maxDelay}
+}
+
+func (w *batchWriter) Write(b []byte) (int, error) {
+	if len(w.buf) == 0 {
+		w.since = time.Now()
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.maxSize {
+		err := w.Flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// pending returns true if the batch holds data not yet written.
+func (w *batchWriter) pending() bool {
+	return len(w.buf) > 0
+}
+
+// due returns true if the batch has been pending for at least maxDelay.
+func (w *batchWriter) due(now time.Time) bool {
+	return w.pending() && now.Sub(w.since) >= w.maxDelay
+}
+
+// Flush writes any pending data to the underlying writer.
+func (w *batchWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.WriteCloser.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Err returns the error reported by the underlying writer, if it has an Err method.
+func (w *batchWriter) Err() error {
+	if f, ok := w.WriteCloser.(failer); ok {
+		return f.Err()
+	}
+	return nil
+}
+
+// Close flushes any pending data, and closes the underlying writer.
+func (w *batchWriter) Close() error {
+	err := w.Flush()
+	closeErr := w.WriteCloser.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
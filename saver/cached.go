@@ -0,0 +1,44 @@
+package saver
+
+import (
+	"sort"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// CachedConnection describes the most recent snapshot of a connection in the
+// connection cache, for inspecting the live state.
+type CachedConnection struct {
+	ID            inetdiag.SockID // With the addresses anonymized, as in the files.
+	State         string          // e.g. ESTABLISHED.
+	BytesSent     uint64
+	BytesReceived uint64
+	LastUpdate    time.Time // The Timestamp of the snapshot.
+}
+
+// CachedConnections returns the connections in the connection cache, including
+// those that are not recorded, ordered by cookie.  It may be called concurrently
+// with MessageSaverLoop.
+func (svr *Saver) CachedConnections() []CachedConnection {
+	records := svr.cache.Records()
+	conns := make([]CachedConnection, 0, len(records))
+	for _, ar := range records {
+		idm, err := ar.RawIDM.Parse()
+		if err != nil {
+			continue
+		}
+		cc := CachedConnection{
+			ID:         svr.anonymizeID(idm.ID.GetSockID()),
+			State:      tcp.State(idm.IDiagState).String(),
+			LastUpdate: ar.Timestamp,
+		}
+		cc.BytesSent, cc.BytesReceived = ar.GetStats()
+		conns = append(conns, cc)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID.CookieUint64() < conns[j].ID.CookieUint64()
+	})
+	return conns
+}
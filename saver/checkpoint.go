@@ -0,0 +1,72 @@
+package saver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointEntry records the file sequence state of a connection that has been
+// closed, so that if the same cookie reappears, either after the grace period is
+// exceeded or after a restart, the connection continues its existing file series
+// instead of starting over at sequence zero.
+type checkpointEntry struct {
+	Sequence  int       // The sequence number of the next file.
+	StartTime time.Time // The StartTime of the original connection.
+	Expired   time.Time // The time at which the connection was closed.
+	// Generation of the connection, if its cookie was reused.
+	Generation int `json:",omitempty"`
+}
+
+// checkpoint maps connection cookies to checkpointEntries.
+type checkpoint map[uint64]checkpointEntry
+
+// loadCheckpoint reads a checkpoint from filename.  A missing file results in an
+// empty checkpoint.
+func loadCheckpoint(filename string) (checkpoint, error) {
+	cp := make(checkpoint)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	err = json.Unmarshal(b, &cp)
+	return cp, err
+}
+
+// prune removes all entries that expired before the cutoff time.
+func (cp checkpoint) prune(cutoff time.Time) {
+	for cookie, e := range cp {
+		if e.Expired.Before(cutoff) {
+			delete(cp, cookie)
+		}
+	}
+}
+
+// save atomically writes the checkpoint to filename.
+func (cp checkpoint) save(filename string) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
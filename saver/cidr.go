@@ -0,0 +1,72 @@
+package saver
+
+import (
+	"net"
+
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// The addresses of a connection checked by a CIDRFilter.  The source is the local
+// address, and the destination the remote one.
+const (
+	EitherAddress      = ""
+	SourceAddress      = "source"
+	DestinationAddress = "destination"
+)
+
+// CIDRFilter selects connections by the networks of their addresses.
+type CIDRFilter struct {
+	// Direction is SourceAddress, DestinationAddress, or EitherAddress.
+	Direction string
+	// Allow, if not empty, lists the networks one of which an address must be in.
+	Allow []*net.IPNet
+	// Deny lists the networks that no address may be in.
+	Deny []*net.IPNet
+}
+
+// contains returns true if any of the networks contains any of the addresses.
+func contains(nets []*net.IPNet, addrs []net.IP) bool {
+	for _, n := range nets {
+		for _, a := range addrs {
+			if n.Contains(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Pass returns true if a connection with the addresses passes the filter.
+func (f *CIDRFilter) Pass(src, dst net.IP) bool {
+	var addrs []net.IP
+	switch f.Direction {
+	case SourceAddress:
+		addrs = []net.IP{src}
+	case DestinationAddress:
+		addrs = []net.IP{dst}
+	default:
+		addrs = []net.IP{src, dst}
+	}
+	if len(f.Allow) > 0 && !contains(f.Allow, addrs) {
+		return false
+	}
+	return !contains(f.Deny, addrs)
+}
+
+// recorded returns true if the record passes all the CIDRFilters.
+func (svr *Saver) recorded(ar *netlink.ArchivalRecord) bool {
+	if len(svr.CIDRFilters) == 0 {
+		return true
+	}
+	idm, err := ar.RawIDM.Parse()
+	if err != nil {
+		return false
+	}
+	src, dst := idm.ID.SrcIP(), idm.ID.DstIP()
+	for i := range svr.CIDRFilters {
+		if !svr.CIDRFilters[i].Pass(src, dst) {
+			return false
+		}
+	}
+	return true
+}
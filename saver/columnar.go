@@ -0,0 +1,50 @@
+package saver
+
+import (
+	"io"
+
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// columnBlock is the snapshots buffered for one file.
+type columnBlock struct {
+	records []*netlink.ArchivalRecord
+	format  *format
+}
+
+// columnBlocks holds the snapshots of the files written by a marshaller until they
+// are written as columnar blocks.  All the records of a file are written by the
+// same marshaller, in order.
+type columnBlocks map[io.Writer]*columnBlock
+
+// add buffers a copy of rec for w, and returns the block to write to w if it then
+// holds size snapshots, or nil.
+func (c columnBlocks) add(w io.Writer, rec *netlink.ArchivalRecord, f *format, size int) *netlink.ArchivalRecord {
+	b, ok := c[w]
+	if !ok {
+		b = &columnBlock{format: f}
+		c[w] = b
+	}
+	// The record may be modified after it is queued, e.g. by the cache.
+	b.records = append(b.records, copyRecord(rec))
+	if len(b.records) < size {
+		return nil
+	}
+	rec, _ = c.flush(w)
+	return rec
+}
+
+// flush returns the record to write to w for the snapshots buffered for it, and
+// its format, and forgets them.  A single snapshot is written as is.  It returns
+// nil if there are none.
+func (c columnBlocks) flush(w io.Writer) (*netlink.ArchivalRecord, *format) {
+	b, ok := c[w]
+	if !ok {
+		return nil, nil
+	}
+	delete(c, w)
+	if len(b.records) == 1 {
+		return b.records[0], b.format
+	}
+	return netlink.ColumnBlock(b.records), b.format
+}
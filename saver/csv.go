@@ -0,0 +1,50 @@
+package saver
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// csvHeader names the columns of the CSV format.  rtt is in microseconds,
+// retransmits is the total number of retransmitted segments, and pacing_rate is in
+// bytes per second.
+const csvHeader = "timestamp,state,rtt,cwnd,bytes_acked,bytes_received,retransmits,pacing_rate\n"
+
+var csvFormat = &format{ext: ".csv", header: []byte(csvHeader), append: appendCSV, rows: true}
+
+// appendCSV appends the CSV row of rec, and a newline, to b.  Records without a
+// socket, i.e. the file header, have no row, so the connection is identified by the
+// file name.  The TCPInfo columns are empty if rec has no TCPInfo.
+func appendCSV(b []byte, rec *netlink.ArchivalRecord) ([]byte, error) {
+	if rec.RawIDM == nil {
+		return b, nil
+	}
+	_, snap, err := snapshot.Decode(rec)
+	if err != nil {
+		return b, err
+	}
+	b = rec.Timestamp.UTC().AppendFormat(b, time.RFC3339Nano)
+	b = append(b, ',')
+	b = append(b, tcp.State(snap.InetDiagMsg.IDiagState).String()...)
+	if info := snap.TCPInfo; info != nil {
+		b = append(b, ',')
+		b = strconv.AppendUint(b, uint64(info.RTT), 10)
+		b = append(b, ',')
+		b = strconv.AppendUint(b, uint64(info.SndCwnd), 10)
+		b = append(b, ',')
+		b = strconv.AppendInt(b, info.BytesAcked, 10)
+		b = append(b, ',')
+		b = strconv.AppendInt(b, info.BytesReceived, 10)
+		b = append(b, ',')
+		b = strconv.AppendUint(b, uint64(info.TotalRetrans), 10)
+		b = append(b, ',')
+		b = strconv.AppendInt(b, info.PacingRate, 10)
+	} else {
+		b = append(b, ",,,,,,"...)
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,75 @@
+package saver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// dailyFile is a JSONL file of saver level records, e.g. the short flow rollup,
+// that is replaced at the start of each day.  Files are placed in the date
+// directory of a separate daily/ tree, so consumers of the connection files
+// don't pick them up, and named with the kind of record, and the time they were
+// created.  The daily/ tree is under the directories of the NameTemplate that
+// identify the Saver, e.g. the experiment, site and machine.
+type dailyFile struct {
+	kind string         // e.g. "short_flows"
+	w    io.WriteCloser // The current file, or nil.
+	date string         // The date directory of the current file.
+}
+
+// write appends v to the file for the current day, creating the file if
+// necessary.  It must be called from the MessageSaverLoop goroutine.
+func (svr *Saver) writeDaily(d *dailyFile, v interface{}) error {
+	now := time.Now().UTC()
+	date := now.Format("2006/01/02")
+	if d.w != nil && d.date != date {
+		d.close()
+	}
+	if d.w == nil {
+		dir := svr.nameTemplate().saverDir(&netlink.Metadata{Machine: svr.Host, Site: svr.Pod, Experiment: svr.Experiment}) + "daily/" + date
+		w, err := svr.writerFactory().NewWriter(fmt.Sprintf("%s/%s_%s.jsonl.zst", dir, d.kind, now.Format("20060102T150405Z")))
+		if err != nil {
+			return err
+		}
+		d.w = w
+		d.date = date
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = d.w.Write(append(b, '\n'))
+	return err
+}
+
+func (d *dailyFile) close() {
+	if d.w == nil {
+		return
+	}
+	err := d.w.Close()
+	if err != nil {
+		log.Println("Could not close", d.kind, "file:", err)
+	}
+	d.w = nil
+}
+
+// writerFactory returns the WriterFactory used to create files.
+func (svr *Saver) writerFactory() WriterFactory {
+	if svr.WriterFactory != nil {
+		return svr.WriterFactory
+	}
+	return &FileWriterFactory{Dir: svr.OutputDir, InProcess: svr.InProcessCompression, FrameSize: svr.CompressionFrameSize}
+}
+
+// nameTemplate returns the NameTemplate used to name files.
+func (svr *Saver) nameTemplate() *NameTemplate {
+	if svr.NameTemplate != nil {
+		return svr.NameTemplate
+	}
+	return defaultTemplate
+}
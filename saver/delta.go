@@ -0,0 +1,60 @@
+package saver
+
+import (
+	"io"
+
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// deltaFile is the state of the delta encoding of one file.
+type deltaFile struct {
+	previous *netlink.ArchivalRecord // A copy of the previous snapshot written.
+	count    int                     // Snapshots written since the last full one, including it.
+}
+
+// deltaFiles tracks the delta encoding of the files written by a marshaller.  All
+// the records of a file are written by the same marshaller, in order.
+type deltaFiles map[io.Writer]*deltaFile
+
+// encode returns the record to write to w for rec.  The first snapshot of each
+// file, and every interval'th after it, is written in full, and the others as
+// deltas from the previous snapshot.
+func (d deltaFiles) encode(w io.Writer, rec *netlink.ArchivalRecord, interval int) *netlink.ArchivalRecord {
+	f, ok := d[w]
+	if !ok {
+		f = &deltaFile{}
+		d[w] = f
+	}
+	out := rec
+	if f.previous != nil && f.count < interval {
+		out = rec.DeltaFrom(f.previous)
+		f.count++
+	} else {
+		f.count = 1
+	}
+	// The record may be modified after it is written, e.g. by the cache, so the
+	// base of the next delta is a copy.
+	f.previous = copyRecord(rec)
+	return out
+}
+
+// copyRecord returns a copy of the snapshot rec that does not share memory with it.
+func copyRecord(rec *netlink.ArchivalRecord) *netlink.ArchivalRecord {
+	c := &netlink.ArchivalRecord{
+		Timestamp: rec.Timestamp,
+		RawIDM:    append([]byte{}, rec.RawIDM...),
+		Anomaly:   rec.Anomaly,
+		Derived:   rec.Derived,
+		SockOpts:  rec.SockOpts,
+		Protocol:  rec.Protocol,
+	}
+	if rec.Attributes != nil {
+		c.Attributes = make([][]byte, len(rec.Attributes))
+		for i, a := range rec.Attributes {
+			if a != nil {
+				c.Attributes[i] = append([]byte{}, a...)
+			}
+		}
+	}
+	return c
+}
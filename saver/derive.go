@@ -0,0 +1,74 @@
+package saver
+
+import (
+	"math"
+	"sync"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+// Derivers compute fields from consecutive snapshots of a connection, e.g. rates,
+// or site specific classifications, inline, so that the analyses that need them
+// do not have to reread the files.  The fields are recorded in the Derived map of
+// each snapshot written, which is kept by the delta and columnar encodings, and
+// published to the Sinks.  The csv and parquet formats do not record them.
+
+// A Deriver computes a derived field of the snapshots of the connections.
+type Deriver struct {
+	// Name is the key of the field in the Derived map of the records.
+	Name string
+	// Derive returns the value of the field for the current snapshot, given the
+	// previous snapshot of the connection, which is nil for its first snapshot.
+	// ok is false if the field has no value for the current snapshot.  It is
+	// called by the saver goroutine, so it must be quick, and it must not modify
+	// the snapshots.
+	Derive func(previous, current *snapshot.Snapshot) (value float64, ok bool)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []Deriver
+)
+
+// RegisterDeriver adds a Deriver to the current set, which pipeline.Build gives
+// the Saver, and the reprocess command applies to existing archives.  It is
+// typically called from the init function of a package of site specific
+// Derivers, which the binaries then import.
+func RegisterDeriver(d Deriver) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, d)
+}
+
+// RegisteredDerivers returns the current set of Derivers, in the order they were
+// registered.
+func RegisteredDerivers() []Deriver {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	return append([]Deriver(nil), registry...)
+}
+
+// derive returns the Derived fields of a snapshot of a connection, and the decoded
+// snapshot, from which the fields of the next one are derived.  previous is the
+// decoded previous snapshot, which is returned again if the snapshot cannot be
+// decoded.  Values that are not finite cannot be encoded in JSON, so they are
+// dropped.
+func derive(derivers []Deriver, previous *snapshot.Snapshot, ar *netlink.ArchivalRecord) (map[string]float64, *snapshot.Snapshot) {
+	_, current, err := snapshot.Decode(ar)
+	if err != nil {
+		return nil, previous
+	}
+	var derived map[string]float64
+	for _, d := range derivers {
+		v, ok := d.Derive(previous, current)
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		if derived == nil {
+			derived = make(map[string]float64, len(derivers))
+		}
+		derived[d.Name] = v
+	}
+	return derived, current
+}
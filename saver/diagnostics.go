@@ -0,0 +1,106 @@
+package saver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// The netlink messages that cannot be parsed are normally only logged, or, in
+// strict mode, fatal.  If DiagnosticsDir is set, they are also written there, one
+// Diagnostic per file, so that parser bugs seen in production can be reproduced
+// offline.  Only the newest MaxDiagnostics files are kept.
+
+// DefaultMaxDiagnostics is the number of diagnostic files kept if MaxDiagnostics is
+// not set.
+const DefaultMaxDiagnostics = 100
+
+// diagnosticSuffix ends the names of the diagnostic files.
+const diagnosticSuffix = ".diagnostic.json"
+
+// Diagnostic is the record of a netlink message that could not be parsed.
+type Diagnostic struct {
+	Error     string
+	Cycle     int64             // The polling cycle of the saver in which the message was received.
+	Timestamp time.Time         // When the message was received, as it would be recorded.
+	Protocol  inetdiag.Protocol `json:",omitempty"`
+	Kernel    string            // The kernel release of the host.
+	BootID    string
+	// Message unmarshals to the netlink.NetlinkMessage, so that it can be parsed
+	// again with netlink.MakeArchivalRecord.
+	Message *netlink.NetlinkMessage
+	HexDump []string // The lines of a hex dump of the message data, for reading.
+}
+
+// saveDiagnostic writes a Diagnostic for msg, which could not be parsed, to the
+// DiagnosticsDir, and removes the oldest diagnostic files beyond MaxDiagnostics.
+func (svr *Saver) saveDiagnostic(msg *netlink.NetlinkMessage, parseErr error, timestamp time.Time, protocol inetdiag.Protocol) {
+	if svr.DiagnosticsDir == "" {
+		return
+	}
+	cycle := svr.cache.CycleCount()
+	d := &Diagnostic{
+		Error:     parseErr.Error(),
+		Cycle:     cycle,
+		Timestamp: timestamp,
+		Protocol:  protocol,
+		Kernel:    svr.Boot.Kernel,
+		BootID:    svr.Boot.ID,
+		Message:   msg,
+		HexDump:   strings.Split(strings.TrimSuffix(hex.Dump(msg.Data), "\n"), "\n"),
+	}
+	err := svr.writeDiagnostic(d)
+	if err != nil {
+		log.Println("Could not write diagnostic:", err)
+		metrics.ErrorCount.WithLabelValues("diagnostic").Inc()
+	}
+}
+
+func (svr *Saver) writeDiagnostic(d *Diagnostic) error {
+	err := os.MkdirAll(svr.DiagnosticsDir, 0755)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	svr.diagnostics++
+	// The names sort in the order the diagnostics were written.
+	name := fmt.Sprintf("%s.%010d.%06d%s", d.Timestamp.UTC().Format("20060102T150405.000000000Z"), d.Cycle, svr.diagnostics%1000000, diagnosticSuffix)
+	err = ioutil.WriteFile(filepath.Join(svr.DiagnosticsDir, name), append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return svr.pruneDiagnostics()
+}
+
+// pruneDiagnostics removes the oldest diagnostic files beyond MaxDiagnostics.
+func (svr *Saver) pruneDiagnostics() error {
+	max := svr.MaxDiagnostics
+	if max <= 0 {
+		max = DefaultMaxDiagnostics
+	}
+	names, err := filepath.Glob(filepath.Join(svr.DiagnosticsDir, "*"+diagnosticSuffix))
+	if err != nil || len(names) <= max {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names[:len(names)-max] {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
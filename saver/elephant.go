@@ -0,0 +1,59 @@
+package saver
+
+import (
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// Connections that carry the most traffic are recorded at the highest fidelity.
+// Once a recorded connection has sent and received ElephantBytes, or averaged
+// ElephantRate since it started, it is an elephant flow for the rest of its life.
+// Its current file is closed, and it continues in files whose headers are marked
+// Elephant, in which every snapshot is written, whether or not it shows a
+// significant change, with all of its attributes.  Elephants are never paced.
+
+// elephantRateWindow is the time a connection must have been recorded before its
+// average rate is compared with ElephantRate, so that the rate of its first few
+// snapshots does not make it an elephant.
+const elephantRateWindow = 1.0 // seconds
+
+// elephant returns true if the connection of ar is an elephant flow, and upgrades
+// it if it has just become one.  It must be called before the attribute policy is
+// applied to ar.
+func (svr *Saver) elephant(ar *netlink.ArchivalRecord) bool {
+	if svr.ElephantBytes == 0 && svr.ElephantRate <= 0 {
+		return false
+	}
+	idm, err := ar.RawIDM.Parse()
+	if err != nil {
+		return false
+	}
+	conn, ok := svr.Connections[idm.ID.Cookie()]
+	if !ok || conn.ID != idm.ID.GetSockID() {
+		// A connection that is not recorded yet, or that reused the cookie.
+		return false
+	}
+	if conn.elephant {
+		return true
+	}
+	sent, received := ar.GetStats()
+	bytes := sent + received
+	elapsed := ar.Timestamp.Sub(conn.StartTime).Seconds()
+	if (svr.ElephantBytes == 0 || bytes < svr.ElephantBytes) &&
+		(svr.ElephantRate <= 0 || elapsed < elephantRateWindow || float64(bytes)/elapsed < svr.ElephantRate) {
+		return false
+	}
+	conn.elephant = true
+	metrics.ElephantCount.Inc()
+	if conn.Writer != nil {
+		// Continue in a new file, whose header records the upgrade.
+		svr.closeFile(conn)
+	}
+	return true
+}
+
+// isElephant returns true if the connection with the cookie is an elephant flow.
+func (svr *Saver) isElephant(cookie uint64) bool {
+	conn, ok := svr.Connections[cookie]
+	return ok && conn.elephant
+}
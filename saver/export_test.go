@@ -0,0 +1,32 @@
+package saver
+
+import (
+	"io"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// NewRenamingWriter returns the writer of a FileWriterFactory, which renames tmp to
+// name when w is closed.
+func NewRenamingWriter(w io.WriteCloser, tmp, name string) io.WriteCloser {
+	return &renamingWriter{WriteCloser: w, tmp: tmp, name: name}
+}
+
+func NewBatchWriter(w io.WriteCloser, maxSize int, maxDelay time.Duration) io.WriteCloser {
+	return newBatchWriter(w, maxSize, maxDelay)
+}
+
+// SetLogFatal replaces the function reporting the anomalies found in strict mode,
+// and returns a function that restores it.
+func SetLogFatal(f func(...interface{})) func() {
+	prev := logFatal
+	logFatal = f
+	return func() { logFatal = prev }
+}
+
+// SaverDir returns the leading directories of the names of t that depend only on
+// the Saver.
+func (t *NameTemplate) SaverDir(meta *netlink.Metadata) string {
+	return t.saverDir(meta)
+}
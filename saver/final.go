@@ -0,0 +1,69 @@
+package saver
+
+import (
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// The first and final snapshots of a recorded connection anchor the analysis of
+// the connection, so they are always written.  The first snapshot is never shed,
+// and the final one, i.e. the last snapshot seen before the connection ends, is
+// written when it ends, or the Saver is closed, if it was not written already,
+// e.g. because Compare found no significant change, or it was shed.  Snapshots
+// skipped by adaptive pacing are never seen, so the final snapshot of an idle
+// connection may be up to IdleInterval cycles old.
+
+// reservedCapacity returns the capacity of q kept free by shed for the snapshots
+// that are never shed, so that they do not have to wait for room in q.
+func reservedCapacity(q MarshalChan) int {
+	return cap(q) / 10
+}
+
+// flushFinal queues the final snapshot of the connection with the cookie, if the
+// connection is recorded, and the snapshot has not been queued.  It must be called
+// before the connection is ended.
+func (svr *Saver) flushFinal(cookie uint64, final *netlink.ArchivalRecord) {
+	conn, ok := svr.Connections[cookie]
+	if !ok || conn.Writer == nil || final == nil || conn.last == final {
+		return
+	}
+	metrics.FinalSnapshotCount.Inc()
+	if len(svr.Derivers) > 0 {
+		final.Derived, conn.derivedFrom = derive(svr.Derivers, conn.derivedFrom, final)
+	}
+	final.SockOpts = svr.newSockOpts(conn)
+	svr.MarshalChanFor(cookie) <- svr.task(conn, final)
+	conn.last = final
+}
+
+// finalCounters returns the counters of the last snapshot of conn, for its close
+// event, or nil if there is none.  A connection that ended before its file was
+// created has only held snapshots.
+func finalCounters(conn *Connection) *eventsocket.Counters {
+	last := conn.last
+	if last == nil && len(conn.pending) > 0 {
+		last = conn.pending[len(conn.pending)-1]
+	}
+	if last == nil {
+		return nil
+	}
+	_, snap, err := snapshot.Decode(last)
+	if err != nil || snap.InetDiagMsg == nil {
+		return nil
+	}
+	c := &eventsocket.Counters{State: tcp.State(snap.InetDiagMsg.IDiagState).String()}
+	if info := snap.TCPInfo; info != nil {
+		c.BytesSent = info.BytesSent
+		c.BytesAcked = info.BytesAcked
+		c.BytesReceived = info.BytesReceived
+		c.BytesRetrans = info.BytesRetrans
+		c.SegsOut = info.SegsOut
+		c.SegsIn = info.SegsIn
+		c.TotalRetrans = info.TotalRetrans
+		c.MinRTT = info.MinRTT
+	}
+	return c
+}
@@ -0,0 +1,113 @@
+package saver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/m-lab/tcp-info/framed"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/nlproto"
+)
+
+// Output formats of the connection files.
+const (
+	// JSONL files have one JSON encoded ArchivalRecord per line.  It is the default.
+	JSONL = "jsonl"
+	// Framed files are length-delimited nl-proto messages, i.e. protobuf Rows of
+	// the parsed snapshots, with the schema embedded at the start of each file.  The
+	// first Row of each file has the metadata.  See packages nlproto and framed.
+	Framed = "framed"
+	// CSV files have a row of selected TCPInfo fields for each snapshot, for
+	// analysis with tools such as R and pandas.  See csvHeader.
+	CSV = "csv"
+	// Parquet files have a row of the InetDiagMsg and TCPInfo of each snapshot,
+	// for loading into BigQuery or Athena.  See parquetRow.
+	Parquet = "parquet"
+)
+
+// ErrUnknownFormat is returned by SetOutputFormat for an unsupported format.
+var ErrUnknownFormat = errors.New("unknown output format")
+
+// format encodes the records of the connection files.
+type format struct {
+	ext    string // The file name extension, before the compression extension.
+	header []byte // Written at the start of each file, before the metadata record.
+	append func(b []byte, rec *netlink.ArchivalRecord) ([]byte, error)
+	// rows is true if each record is encoded as a flat row, from which deltas and
+	// columnar blocks could not be reconstructed, so they are not used.
+	rows bool
+	// open, if not nil, returns the writer of a file whose records are encoded
+	// together, e.g. in row groups, instead of one at a time by append.  Such
+	// files compress their own data, so they are not named .zst.
+	open func(w io.WriteCloser) (recordWriter, error)
+}
+
+// recordWriter writes the records of a file in a format that encodes them
+// together.  The metadata record is written first.
+type recordWriter interface {
+	io.WriteCloser
+	writeRecord(rec *netlink.ArchivalRecord) error
+}
+
+var jsonlFormat = &format{ext: ".jsonl", append: appendJSON}
+
+// appendJSON appends the JSON encoding of rec, and a newline, to b.
+func appendJSON(b []byte, rec *netlink.ArchivalRecord) ([]byte, error) {
+	j, err := json.Marshal(rec)
+	if err != nil {
+		return b, err
+	}
+	return append(append(b, j...), '\n'), nil
+}
+
+// newFormat returns the format with the name.
+func newFormat(name string) (*format, error) {
+	switch name {
+	case "", JSONL:
+		return jsonlFormat, nil
+	case Framed:
+		enc, err := framed.NewEncoder(&nlproto.Row{})
+		if err != nil {
+			return nil, err
+		}
+		return &format{
+			ext:    ".framed",
+			header: enc.Header(),
+			append: func(b []byte, rec *netlink.ArchivalRecord) ([]byte, error) {
+				row, err := nlproto.FromRecord(rec)
+				if err != nil {
+					return b, err
+				}
+				return enc.Append(b, row)
+			},
+			rows: true,
+		}, nil
+	case CSV:
+		return csvFormat, nil
+	case Parquet:
+		return parquetFormat, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, name)
+}
+
+// orJSONL returns f, or the JSONL format if f is nil.
+func (f *format) orJSONL() *format {
+	if f == nil {
+		return jsonlFormat
+	}
+	return f
+}
+
+// SetOutputFormat sets the format of the connection files, JSONL, Framed, CSV or
+// Parquet.  It must be called before MessageSaverLoop is started.  The records
+// published to the Sinks, and the daily files, are always JSON.
+func (svr *Saver) SetOutputFormat(name string) error {
+	f, err := newFormat(name)
+	if err != nil {
+		return err
+	}
+	svr.format = f
+	return nil
+}
@@ -0,0 +1,41 @@
+package saver
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/snmp"
+)
+
+// If the collector reads the host-wide TCP counters, e.g. the retransmitted
+// segments and listen drops, the saver writes those of each polling cycle in which
+// they changed to the daily host counter files, next to the short flow rollup, and
+// publishes them to the Sinks, so that the connection records can be interpreted
+// against the congestion and drops of the whole host.
+
+// writeHostCounters records c, the counters of the current polling cycle, if they
+// differ from those last recorded.
+func (svr *Saver) writeHostCounters(c *snmp.Counters) {
+	if c == nil || (svr.lastCounters != nil && svr.lastCounters.Equal(c)) {
+		return
+	}
+	svr.lastCounters = c
+	err := svr.writeDaily(&svr.counterFile, c)
+	if err != nil {
+		log.Println("Could not write host counters:", err)
+		metrics.ErrorCount.WithLabelValues("host counters").Inc()
+	}
+	if len(svr.Sinks) > 0 {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return
+		}
+		b = append(b, '\n')
+		for _, s := range svr.Sinks {
+			s.Publish(sink.Record{UUID: svr.Host, Type: sink.HostCounters, Time: time.Now(), Data: b})
+		}
+	}
+}
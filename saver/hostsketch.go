@@ -0,0 +1,99 @@
+package saver
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sketch"
+)
+
+// The saver sketches the RTT and delivery rate of the snapshots of all the TCP
+// connections in each polling cycle, so that the distributions over the host are
+// exported as a few Prometheus gauges, rather than a series per connection.  If
+// HostSketchInterval is set, the sketches of the cycles are also merged, and written
+// to the daily host sketch files, from which accurate distributions can be computed
+// over any number of intervals and hosts.
+
+// hostQuantiles are the quantiles exported as gauges.
+var hostQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// HostSketches are the sketches of the snapshots of all the connections over an
+// interval, written one JSON object per line to the daily host sketch files.
+type HostSketches struct {
+	Start        time.Time      // Time of the first polling cycle in the interval.
+	End          time.Time      // Time of the last polling cycle.
+	Cycles       int            // Number of polling cycles.
+	RTT          *sketch.Sketch // Smoothed RTTs, in microseconds.
+	DeliveryRate *sketch.Sketch // Delivery rates, in bytes per second.
+}
+
+// hostSketches are the sketches of the current cycle, and of the current interval.
+type hostSketches struct {
+	rtt      sketch.Sketch
+	rate     sketch.Sketch
+	interval HostSketches
+}
+
+// observe adds the RTT and delivery rate of a snapshot to the sketches of the cycle.
+func (h *hostSketches) observe(ar *netlink.ArchivalRecord) {
+	if rtt, ok := ar.GetRTT(); ok && rtt > 0 {
+		h.rtt.Add(float64(rtt))
+	}
+	if rate, _, ok := ar.GetDeliveryRate(); ok && rate > 0 {
+		h.rate.Add(float64(rate))
+	}
+}
+
+// setQuantiles sets the gauges of the quantiles of s, multiplied by scale, unless
+// s is empty.
+func setQuantiles(g *prometheus.GaugeVec, s *sketch.Sketch, scale float64) {
+	if s.Count() == 0 {
+		return
+	}
+	for _, q := range hostQuantiles {
+		g.WithLabelValues(strconv.FormatFloat(q, 'g', -1, 64)).Set(scale * s.Quantile(q))
+	}
+}
+
+// endHostCycle exports the quantiles of the polling cycle at t, and adds its
+// sketches to those of the interval, which are written if it has ended.
+func (svr *Saver) endHostCycle(t time.Time) {
+	h := &svr.hostSketches
+	setQuantiles(metrics.HostRTT, &h.rtt, 1e-6)
+	setQuantiles(metrics.HostDeliveryRate, &h.rate, 1)
+	if svr.HostSketchInterval > 0 {
+		iv := &h.interval
+		if iv.Cycles == 0 {
+			*iv = HostSketches{Start: t, RTT: &sketch.Sketch{}, DeliveryRate: &sketch.Sketch{}}
+		}
+		iv.End = t
+		iv.Cycles++
+		iv.RTT.Merge(&h.rtt)
+		iv.DeliveryRate.Merge(&h.rate)
+		if t.Sub(iv.Start) >= svr.HostSketchInterval {
+			svr.writeHostSketches()
+		}
+	}
+	h.rtt.Reset()
+	h.rate.Reset()
+}
+
+// writeHostSketches writes the sketches of the interval, if it has any cycles, and
+// starts the next interval.
+func (svr *Saver) writeHostSketches() {
+	iv := &svr.hostSketches.interval
+	if iv.Cycles == 0 {
+		return
+	}
+	err := svr.writeDaily(&svr.hostSketchFile, iv)
+	if err != nil {
+		log.Println("Could not write host sketches:", err)
+		metrics.ErrorCount.WithLabelValues("host sketches").Inc()
+	}
+	*iv = HostSketches{}
+}
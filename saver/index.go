@@ -0,0 +1,60 @@
+package saver
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// IndexEntry describes one connection file.  IndexEntries are written, one JSON
+// object per line, to daily index files when each connection file is closed, so that
+// downstream pipelines can discover and select files without listing them all.
+type IndexEntry struct {
+	UUID      string
+	ID        inetdiag.SockID
+	StartTime time.Time // The start time of the connection.
+	EndTime   time.Time // The time the file was closed.
+	Sequence  int
+	Path      string // The path of the file, relative to the output directory.
+}
+
+// anonymizeID returns a copy of id with the addresses anonymized.
+func (svr *Saver) anonymizeID(id inetdiag.SockID) inetdiag.SockID {
+	for _, addr := range []*string{&id.SrcIP, &id.DstIP} {
+		ip := net.ParseIP(*addr)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		svr.anon.IP(ip)
+		*addr = ip.String()
+	}
+	return id
+}
+
+// closeFile queues the close of the current file of conn, and records the file in
+// the daily index.
+func (svr *Saver) closeFile(conn *Connection) {
+	svr.MarshalChanFor(conn.ID.CookieUint64()) <- Task{Message: nil, Writer: conn.Writer}
+	conn.Writer = nil
+	conn.written = nil
+	metrics.SaverOpenFiles.Dec()
+	entry := IndexEntry{
+		UUID:      conn.UUID(),
+		ID:        svr.anonymizeID(conn.ID),
+		StartTime: conn.StartTime,
+		EndTime:   time.Now(),
+		Sequence:  conn.Sequence - 1,
+		Path:      conn.filename,
+	}
+	err := svr.writeDaily(&svr.index, entry)
+	if err != nil {
+		log.Println("Could not write index:", err)
+		metrics.ErrorCount.WithLabelValues("index").Inc()
+	}
+}
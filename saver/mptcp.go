@@ -0,0 +1,77 @@
+package saver
+
+import (
+	"sort"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sink"
+)
+
+// An MPTCP connection is recorded like any other socket, in files with the .mptcp
+// suffix, and each of its TCP subflows is recorded as a TCP connection.  They share
+// the local token of the MPTCP connection, which the saver records in the Metadata
+// of all their files, and uses to group the subflows under the MPTCP connection, so
+// that its summary lists them.
+
+// mptcpGroup is an MPTCP connection and its TCP subflows.
+type mptcpGroup struct {
+	conn     uint64            // The cookie of the MPTCP connection, or zero if it is not recorded.
+	subflows map[uint64]string // The UUIDs of the subflows, by cookie.
+}
+
+// joinMPTCP groups a recorded connection with the others that share the MPTCP token
+// of its snapshot, if it has one.  Subflows that are not yet established, and MPTCP
+// connections that have not yet connected, have no token.
+func (svr *Saver) joinMPTCP(cookie uint64, conn *Connection, ar *netlink.ArchivalRecord) {
+	token, ok := ar.MPTCPToken()
+	if !ok || token == conn.mptcpToken {
+		return
+	}
+	svr.leaveMPTCP(cookie, conn)
+	conn.mptcpToken = token
+	g, ok := svr.mptcp[token]
+	if !ok {
+		g = &mptcpGroup{subflows: make(map[uint64]string)}
+		svr.mptcp[token] = g
+	}
+	if ar.IsMPTCP() {
+		g.conn = cookie
+	} else {
+		g.subflows[cookie] = conn.UUID()
+	}
+}
+
+// leaveMPTCP removes a connection that has ended from its group.  The subflows are
+// kept until the MPTCP connection ends, to be listed in its summary.
+func (svr *Saver) leaveMPTCP(cookie uint64, conn *Connection) {
+	g, ok := svr.mptcp[conn.mptcpToken]
+	if !ok {
+		return
+	}
+	if g.conn == cookie {
+		delete(svr.mptcp, conn.mptcpToken)
+		return
+	}
+	if g.conn == 0 {
+		delete(g.subflows, cookie)
+		if len(g.subflows) == 0 {
+			delete(svr.mptcp, conn.mptcpToken)
+		}
+	}
+}
+
+// mptcpSummary returns the MPTCP summary of a connection, or nil if it is neither
+// an MPTCP connection nor a subflow of one.
+func (svr *Saver) mptcpSummary(cookie uint64, conn *Connection) *sink.MPTCPSummary {
+	if conn.mptcpToken == 0 {
+		return nil
+	}
+	sum := &sink.MPTCPSummary{Token: conn.mptcpToken}
+	if g, ok := svr.mptcp[conn.mptcpToken]; ok && g.conn == cookie {
+		for _, uuid := range g.subflows {
+			sum.Subflows = append(sum.Subflows, uuid)
+		}
+		sort.Strings(sum.Subflows)
+	}
+	return sum
+}
@@ -0,0 +1,173 @@
+package saver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// The connection files are named by a NameTemplate, relative to the output
+// directory, followed by the protocol suffix, if the connection is not TCP, and
+// the extension of the format, e.g. ".udp.jsonl.zst".  The tokens of the template
+// are
+//
+//	{experiment}  the Experiment of the Saver
+//	{pod}         the Pod, i.e. the site, of the Saver
+//	{host}        the Host, i.e. the machine, of the Saver
+//	{uuid}        the UUID of the connection
+//	{seq}         the sequence number of the file, e.g. 00003
+//	{date}        the date of the file, e.g. 2019/04/01
+//	{timestamp}   the time of the file, e.g. 20190401T153012Z
+//	{format}      the format of the file, e.g. jsonl
+//
+// The time of the first file of a connection is its start time, and of the others
+// the time they were created.  Path components that are empty, e.g. because the
+// Saver has no Experiment, are omitted.  The command line tools expect the names
+// to end in .{seq}, as they do by default.
+
+// DefaultNameTemplate is the template of the connection file names if the Saver
+// has no NameTemplate, e.g. 2019/04/01/<uuid>.00000, the layout of the date
+// directories of earlier versions.
+const DefaultNameTemplate = "{date}/{uuid}.{seq}"
+
+// IdentityNameTemplate places the date directories under the experiment, site and
+// machine, e.g. ndt/lga03/mlab1/2019/04/01/<uuid>.00000, so that the files of many
+// machines can be copied to one place.
+const IdentityNameTemplate = "{experiment}/{pod}/{host}/{date}/{uuid}.{seq}"
+
+// ErrBadTemplate is returned by ParseNameTemplate for an invalid template.
+var ErrBadTemplate = errors.New("bad name template")
+
+// nameValues are the values of the tokens of a NameTemplate.
+type nameValues struct {
+	meta     *netlink.Metadata
+	uuid     string
+	sequence int
+	time     time.Time
+	format   string
+}
+
+var nameTokens = map[string]func(v *nameValues) string{
+	"experiment": func(v *nameValues) string { return v.meta.Experiment },
+	"pod":        func(v *nameValues) string { return v.meta.Site },
+	"host":       func(v *nameValues) string { return v.meta.Machine },
+	"uuid":       func(v *nameValues) string { return v.uuid },
+	"seq":        func(v *nameValues) string { return fmt.Sprintf("%05d", v.sequence) },
+	"date":       func(v *nameValues) string { return v.time.Format("2006/01/02") },
+	"timestamp":  func(v *nameValues) string { return v.time.UTC().Format("20060102T150405Z") },
+	"format":     func(v *nameValues) string { return v.format },
+}
+
+// NameTemplate names the connection files.  See DefaultNameTemplate.
+type NameTemplate struct {
+	text   string
+	parts  []string // Alternating literal text and token names, starting with text.
+	tokens []func(v *nameValues) string
+}
+
+// ParseNameTemplate parses a template of connection file names.  The template
+// must include {uuid} and {seq}, so that each file has a unique name, and may not
+// include ".." path components.
+func ParseNameTemplate(text string) (*NameTemplate, error) {
+	t := &NameTemplate{text: text}
+	found := make(map[string]bool)
+	rest := text
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, rest)
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unterminated token in %q", ErrBadTemplate, text)
+		}
+		name := rest[open+1 : open+end]
+		token, ok := nameTokens[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown token {%s} in %q", ErrBadTemplate, name, text)
+		}
+		found[name] = true
+		t.parts = append(t.parts, rest[:open])
+		t.tokens = append(t.tokens, token)
+		rest = rest[open+end+1:]
+	}
+	if !found["uuid"] || !found["seq"] {
+		return nil, fmt.Errorf("%w: %q must include {uuid} and {seq}", ErrBadTemplate, text)
+	}
+	for _, p := range t.parts {
+		for _, c := range strings.Split(p, "/") {
+			if c == ".." {
+				return nil, fmt.Errorf("%w: %q may not include ..", ErrBadTemplate, text)
+			}
+		}
+	}
+	return t, nil
+}
+
+// String returns the text of the template.
+func (t *NameTemplate) String() string {
+	return t.text
+}
+
+// name returns the name of a file, without the protocol suffix or extension.
+func (t *NameTemplate) name(v *nameValues) string {
+	var b strings.Builder
+	for i, p := range t.parts {
+		b.WriteString(p)
+		if i < len(t.tokens) {
+			b.WriteString(t.tokens[i](v))
+		}
+	}
+	components := strings.Split(b.String(), "/")
+	kept := components[:0]
+	for _, c := range components {
+		if c != "" {
+			kept = append(kept, c)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+// saverDir returns the leading directories of the names that depend only on the
+// Saver, e.g. ndt/lga03/mlab1/ for the IdentityNameTemplate, with a trailing
+// slash, or "" if there are none.
+func (t *NameTemplate) saverDir(meta *netlink.Metadata) string {
+	v := &nameValues{meta: meta}
+	dir := ""
+	for _, c := range strings.Split(t.text, "/") {
+		var b strings.Builder
+		for rest := c; rest != ""; {
+			open := strings.IndexByte(rest, '{')
+			if open < 0 {
+				b.WriteString(rest)
+				break
+			}
+			end := strings.IndexByte(rest[open:], '}')
+			name := rest[open+1 : open+end]
+			if name != "experiment" && name != "pod" && name != "host" {
+				return dir
+			}
+			b.WriteString(rest[:open])
+			b.WriteString(nameTokens[name](v))
+			rest = rest[open+end+1:]
+		}
+		if b.Len() > 0 {
+			dir += b.String() + "/"
+		}
+	}
+	return dir
+}
+
+var defaultTemplate *NameTemplate
+
+func init() {
+	var err error
+	defaultTemplate, err = ParseNameTemplate(DefaultNameTemplate)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,60 @@
+package saver
+
+import (
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// Connections are paced adaptively if IdleCycles is set.  A connection becomes idle
+// once IdleCycles consecutive snapshots have shown no significant change, and its
+// snapshots are then only processed in every IdleInterval'th cycle, staggered by
+// cookie so that the idle connections are spread across the cycles.  In the other
+// cycles, the connection is only marked as present in the cache, unless its state
+// has changed.  The first significant change returns it to the full rate.
+
+// paced returns true if the connection of msg is idle, and its snapshot is skipped
+// in the current cycle.  It also returns the cached record of the connection, which
+// stands in for the snapshot in the byte counts.
+func (svr *Saver) paced(msg *netlink.NetlinkMessage) (*netlink.ArchivalRecord, bool) {
+	if svr.IdleCycles <= 0 || svr.IdleInterval <= 1 {
+		return nil, false
+	}
+	raw, _ := inetdiag.SplitInetDiagMsg(msg.Data)
+	idm, err := raw.Parse()
+	if err != nil {
+		return nil, false
+	}
+	cookie := idm.ID.Cookie()
+	if svr.isElephant(cookie) {
+		return nil, false
+	}
+	if svr.unchanged[cookie] < svr.IdleCycles || (uint64(svr.cache.CycleCount())+cookie)%uint64(svr.IdleInterval) == 0 {
+		return nil, false
+	}
+	cached := svr.cache.Touch(cookie)
+	if cached == nil {
+		return nil, false
+	}
+	// A reused cookie is a new connection, and a change of state, e.g. as the
+	// connection closes, is a significant change, so both are processed at once.
+	cachedIDM, err := cached.RawIDM.Parse()
+	if err != nil || reused(cachedIDM, idm) || idm.IDiagState != cachedIDM.IDiagState {
+		return nil, false
+	}
+	metrics.IdleSkipCount.Inc()
+	return cached, true
+}
+
+// paceChange records whether the latest snapshot of the connection showed a
+// significant change.
+func (svr *Saver) paceChange(cookie uint64, changed bool) {
+	if svr.IdleCycles <= 0 {
+		return
+	}
+	if changed {
+		delete(svr.unchanged, cookie)
+	} else {
+		svr.unchanged[cookie]++
+	}
+}
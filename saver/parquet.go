@@ -0,0 +1,102 @@
+package saver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/parquet"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// parquetMetadataKey is the key of the JSON encoded file header, in the key-value
+// metadata of Parquet files.
+const parquetMetadataKey = "tcp-info.metadata"
+
+// parquetRow is the row of each snapshot in the Parquet format.  The socket ID is
+// not exported from the InetDiagMsg, so it is added here, along with the UUID and
+// sequence number of the file, so that the files of many connections can be loaded
+// into one table.  Fields may be added, but not removed or renamed, to keep the
+// schema of the tables stable.
+type parquetRow struct {
+	UUID        string
+	Sequence    int
+	Timestamp   time.Time
+	ID          *inetdiag.SockID
+	InetDiagMsg *inetdiag.InetDiagMsg
+	TCPInfo     *tcp.LinuxTCPInfo
+}
+
+var parquetFormat = &format{ext: ".parquet", rows: true, open: newParquetFile}
+
+var errParquetWrite = errors.New("parquet files are only written by record")
+
+// parquetFile writes the records of a connection file as Parquet rows, which are
+// buffered, and written in row groups.  The footer is written when it is closed.
+type parquetFile struct {
+	w    io.WriteCloser
+	pw   *parquet.Writer
+	meta *netlink.Metadata
+}
+
+func newParquetFile(w io.WriteCloser) (recordWriter, error) {
+	pw, err := parquet.NewWriter(w, &parquetRow{}, parquet.Zstd)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetFile{w: w, pw: pw}, nil
+}
+
+// writeRecord adds the row of a snapshot, or, for the metadata record, records it
+// in the file metadata, and in the UUID and Sequence columns of later rows.
+func (f *parquetFile) writeRecord(rec *netlink.ArchivalRecord) error {
+	if rec.Metadata != nil {
+		j, err := json.Marshal(rec.Metadata)
+		if err != nil {
+			return err
+		}
+		f.pw.SetMetadata(parquetMetadataKey, string(j))
+		f.meta = rec.Metadata
+		return nil
+	}
+	if rec.RawIDM == nil {
+		return nil
+	}
+	_, snap, err := snapshot.Decode(rec)
+	if err != nil {
+		return err
+	}
+	row := parquetRow{Timestamp: rec.Timestamp, InetDiagMsg: snap.InetDiagMsg, TCPInfo: snap.TCPInfo}
+	if f.meta != nil {
+		row.UUID, row.Sequence = f.meta.UUID, f.meta.Sequence
+	}
+	id := snap.InetDiagMsg.ID.GetSockID()
+	row.ID = &id
+	return f.pw.Append(&row)
+}
+
+// Write fails, as the records must be written with writeRecord.
+func (f *parquetFile) Write(b []byte) (int, error) {
+	return 0, errParquetWrite
+}
+
+// Close writes the buffered rows and the footer, and closes the file.
+func (f *parquetFile) Close() error {
+	err := f.pw.Close()
+	if cerr := f.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Err returns the error reported by the file, if it has an Err method.
+func (f *parquetFile) Err() error {
+	if fl, ok := f.w.(failer); ok {
+		return fl.Err()
+	}
+	return nil
+}
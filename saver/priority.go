@@ -0,0 +1,97 @@
+package saver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// ErrUnknownPriority is returned when parsing a priority other than "low", "normal"
+// or "high".
+var ErrUnknownPriority = errors.New("unknown priority")
+
+// Priority determines which snapshots are dropped first when the marshalling
+// queues are under pressure.
+type Priority int
+
+// The priorities of connections.  Connections that match no PriorityRule have
+// NormalPriority.
+const (
+	LowPriority Priority = iota - 1
+	NormalPriority
+	HighPriority
+)
+
+func (p Priority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case HighPriority:
+		return "high"
+	}
+	return "normal"
+}
+
+// ParsePriority parses "low", "normal" or "high".  The empty string is NormalPriority.
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "low":
+		return LowPriority, nil
+	case "", "normal":
+		return NormalPriority, nil
+	case "high":
+		return HighPriority, nil
+	}
+	return NormalPriority, fmt.Errorf("%w: %q", ErrUnknownPriority, s)
+}
+
+// PriorityRule assigns a Priority to the connections it matches.  A connection
+// matches if its owner is in Owners, when Owners is not empty, and its addresses
+// pass the CIDRFilter.  A rule with neither matches every connection.
+type PriorityRule struct {
+	Priority Priority
+	Owners   map[string]bool
+	CIDRFilter
+}
+
+// priority returns the Priority of the first rule the connection matches.
+func (svr *Saver) priority(idm *inetdiag.InetDiagMsg, owner string) Priority {
+	var src, dst net.IP
+	for i := range svr.PriorityRules {
+		r := &svr.PriorityRules[i]
+		if len(r.Owners) > 0 && !r.Owners[owner] {
+			continue
+		}
+		if src == nil {
+			src, dst = idm.ID.SrcIP(), idm.ID.DstIP()
+		}
+		if r.Pass(src, dst) {
+			return r.Priority
+		}
+	}
+	return NormalPriority
+}
+
+// shed returns true if a snapshot of conn should be dropped, rather than queued to
+// q, because q is under pressure.  Snapshots are only dropped if PriorityRules are
+// set.  Those of low priority connections are dropped once q is half full, and those
+// of normal priority connections once only the reservedCapacity is left.  Snapshots
+// of high priority connections, and those that record a state change, are never
+// dropped, and wait for room in q instead, as do all snapshots if q is not buffered.
+func (svr *Saver) shed(conn *Connection, q MarshalChan, stateChange bool) bool {
+	if len(svr.PriorityRules) == 0 || stateChange || conn.priority == HighPriority || cap(q) == 0 {
+		return false
+	}
+	limit := cap(q) - reservedCapacity(q)
+	if conn.priority == LowPriority {
+		limit = cap(q) / 2
+	}
+	if len(q) < limit {
+		return false
+	}
+	metrics.PriorityDropCount.WithLabelValues(conn.priority.String()).Inc()
+	return true
+}
@@ -0,0 +1,49 @@
+package saver
+
+import (
+	"log"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// reconcile compares the saver Connections with the connection cache, and repairs
+// any inconsistencies, which would otherwise leak memory or file descriptors.
+//
+// A connection that is no longer in the cache will never be expired, so its
+// file is closed and it is removed.  A cache entry without a connection (that was not
+// excluded by sampling or owner) is not being recorded, so it is removed from the cache,
+// and will be recorded as a new connection when it is next observed.
+//
+// It must be called from the MessageSaverLoop goroutine.
+func (svr *Saver) reconcile() {
+	for cookie, conn := range svr.Connections {
+		if svr.cache.Contains(cookie) {
+			continue
+		}
+		log.Println("Closing orphaned connection", cookie)
+		metrics.OrphanCount.WithLabelValues("connection").Inc()
+		if conn.Writer != nil {
+			svr.endConn(cookie)
+		} else {
+			svr.leaveMPTCP(cookie, conn)
+			svr.forgetSockOpts(conn)
+			delete(svr.Connections, cookie)
+		}
+		delete(svr.generations, cookie)
+		delete(svr.unchanged, cookie)
+	}
+	for _, cookie := range svr.cache.Cookies() {
+		if _, ok := svr.Connections[cookie]; ok {
+			continue
+		}
+		if _, ok := svr.excluded[cookie]; ok {
+			continue
+		}
+		log.Println("Removing orphaned cache entry", cookie)
+		metrics.OrphanCount.WithLabelValues("cache").Inc()
+		svr.cache.Remove(cookie)
+		delete(svr.unchanged, cookie)
+	}
+	svr.lastReconcile = time.Now()
+}
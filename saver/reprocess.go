@@ -0,0 +1,118 @@
+package saver
+
+import (
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// The Derived fields and the summary of a connection are computed when it is
+// recorded, so improvements to the Derivers, or to the summaries, only apply to
+// connections recorded after them.  A Reprocessor computes them again from the
+// snapshots in the files of an existing connection, for the reprocess command,
+// which writes them to a Sidecar file beside the connection files, rather than
+// rewriting the archive.
+
+// DerivedSnapshot holds the Derived fields of a snapshot.
+type DerivedSnapshot struct {
+	Sequence  int // The sequence number of the file holding the snapshot.
+	Timestamp time.Time
+	Derived   map[string]float64
+}
+
+// Sidecar holds the Derived fields and the summary of a connection, as computed by
+// the current Derivers, from the snapshots in its files.
+type Sidecar struct {
+	UUID        string
+	Reprocessed time.Time // When the Sidecar was computed.
+	// Derivers are the names of the Derivers applied, so that readers can tell a
+	// field that has no value from one that was not computed.
+	Derivers []string `json:",omitempty"`
+	Summary  sink.Summary
+	// Snapshots are those of the snapshots that have Derived fields, in order.
+	Snapshots []DerivedSnapshot `json:",omitempty"`
+}
+
+// A Reprocessor computes the Sidecar of a connection from the snapshots in its
+// files, as the saver computes the Derived fields and summary of a connection it
+// records.  The MPTCP subflows of a connection are in other files, so they are not
+// listed in its summary.
+type Reprocessor struct {
+	derivers []Deriver
+	conn     Connection
+	sidecar  Sidecar
+	stats    TcpStats                // The byte counts of the last snapshot that has them.
+	last     *netlink.ArchivalRecord // The last snapshot added.
+}
+
+// NewReprocessor returns a Reprocessor that applies the derivers.
+func NewReprocessor(derivers []Deriver) *Reprocessor {
+	r := &Reprocessor{derivers: derivers}
+	for _, d := range derivers {
+		r.sidecar.Derivers = append(r.sidecar.Derivers, d.Name)
+	}
+	return r
+}
+
+// Add adds the snapshots of a file of the connection.  The files must be added in
+// order of sequence number, each with its Metadata.
+func (r *Reprocessor) Add(meta *netlink.Metadata, snapshots []*netlink.ArchivalRecord) {
+	seq := 0
+	if meta != nil {
+		seq = meta.Sequence
+		if r.sidecar.UUID == "" {
+			r.sidecar.UUID = meta.UUID
+			r.sidecar.Summary.UUID = meta.UUID
+			r.sidecar.Summary.Owner = meta.Owner
+			r.sidecar.Summary.StartTime = meta.StartTime
+			if meta.MPTCPToken != 0 {
+				r.sidecar.Summary.MPTCP = &sink.MPTCPSummary{Token: meta.MPTCPToken}
+			}
+		}
+	}
+	for _, ar := range snapshots {
+		if r.last == nil {
+			if idm, err := ar.RawIDM.Parse(); err == nil {
+				r.sidecar.Summary.ID = idm.ID.GetSockID()
+			}
+		}
+		r.last = ar
+		r.conn.snapshots++
+		r.conn.appLimited.observe(ar)
+		r.conn.rtt.observe(ar)
+		if ar.HasDiagInfo() {
+			r.stats.Sent, r.stats.Received = ar.GetStats()
+		}
+		if len(r.derivers) == 0 {
+			continue
+		}
+		var derived map[string]float64
+		derived, r.conn.derivedFrom = derive(r.derivers, r.conn.derivedFrom, ar)
+		if derived != nil {
+			r.sidecar.Snapshots = append(r.sidecar.Snapshots, DerivedSnapshot{Sequence: seq, Timestamp: ar.Timestamp, Derived: derived})
+		}
+	}
+}
+
+// Sidecar returns the Sidecar of the snapshots added so far.
+func (r *Reprocessor) Sidecar() *Sidecar {
+	s := r.sidecar
+	s.Reprocessed = time.Now().UTC()
+	sum := &s.Summary
+	sum.Snapshots = r.conn.snapshots
+	sum.BytesSent, sum.BytesReceived = r.stats.Sent, r.stats.Received
+	if r.last != nil {
+		sum.EndTime = r.last.Timestamp
+		if idm, err := r.last.RawIDM.Parse(); err == nil {
+			sum.FinalState = tcp.State(idm.IDiagState).String()
+		}
+	}
+	// The trackers are copied, so that summarizing does not end their open periods.
+	a := r.conn.appLimited
+	a.periods = append([]sink.AppLimitedPeriod(nil), a.periods...)
+	a.summarize(sum)
+	r.conn.rtt.summarize(sum)
+	return &s
+}
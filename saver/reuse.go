@@ -0,0 +1,63 @@
+package saver
+
+import (
+	"fmt"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/loglevel"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/uuid"
+)
+
+// reused returns true if the two messages with the same cookie describe different
+// sockets, i.e. the kernel has reused the cookie of the old socket for a new one.
+// The inode is only compared if both are known, since it is zero after the socket
+// is released, e.g. in TIME_WAIT.
+func reused(old, new *inetdiag.InetDiagMsg) bool {
+	if old.ID.GetSockID() != new.ID.GetSockID() {
+		return true
+	}
+	return old.IDiagInode != 0 && new.IDiagInode != 0 && old.IDiagInode != new.IDiagInode
+}
+
+// restart ends the connection currently recorded for a reused cookie, whose last
+// snapshot was old, so that the next snapshot starts a new connection, with a new
+// UUID and file series.
+func (svr *Saver) restart(cookie uint64, old *netlink.ArchivalRecord) {
+	loglevel.Limitedln(loglevel.Info, loglevel.Connection, "Cookie reused:", cookie)
+	metrics.CookieReuseCount.Inc()
+	var stats TcpStats
+	if old.HasDiagInfo() {
+		stats.Sent, stats.Received = old.GetStats()
+	}
+	svr.summarize(cookie, old, stats)
+	svr.flushFinal(cookie, old)
+	svr.endConn(cookie)
+	// The new connection must not continue the file series of the old one, nor
+	// inherit its sampling decision.
+	delete(svr.checkpoint, cookie)
+	delete(svr.excluded, cookie)
+	delete(svr.unchanged, cookie)
+	svr.generations[cookie]++
+}
+
+// withGeneration distinguishes the UUIDs of connections that reuse a cookie.
+func withGeneration(cookie uint64, generation int) string {
+	id := uuid.FromCookie(cookie)
+	if generation > 0 {
+		id = fmt.Sprintf("%s-%d", id, generation)
+	}
+	return id
+}
+
+// uuid returns the UUID of the current connection with the cookie.
+func (svr *Saver) uuid(cookie uint64) string {
+	return withGeneration(cookie, svr.generations[cookie])
+}
+
+// UUID returns the UUID of the connection.  It is derived from the cookie, with a
+// generation suffix if the cookie was previously used by another connection.
+func (conn *Connection) UUID() string {
+	return withGeneration(conn.ID.CookieUint64(), conn.Generation)
+}
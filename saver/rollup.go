@@ -0,0 +1,110 @@
+package saver
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// ShortFlow is the aggregate record of a connection that ended with fewer than
+// MinSnapshots snapshots, and therefore has no file of its own.  ShortFlows are
+// written, one JSON object per line, to a daily short flow rollup file.
+type ShortFlow struct {
+	UUID          string
+	ID            inetdiag.SockID
+	StartTime     time.Time
+	EndTime       time.Time // Timestamp of the last snapshot.
+	FinalState    string
+	Snapshots     int
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// shortFlow returns the ShortFlow for a connection from its held snapshots.
+func (svr *Saver) shortFlow(conn *Connection) (*ShortFlow, error) {
+	last := conn.pending[len(conn.pending)-1]
+	// Anonymize a copy, since the snapshot may be shared with the cache.
+	raw := make(inetdiag.RawInetDiagMsg, len(last.RawIDM))
+	copy(raw, last.RawIDM)
+	err := raw.Anonymize(svr.anon)
+	if err != nil {
+		return nil, err
+	}
+	idm, err := raw.Parse()
+	if err != nil {
+		return nil, err
+	}
+	sf := &ShortFlow{
+		UUID:       conn.UUID(),
+		ID:         idm.ID.GetSockID(),
+		StartTime:  conn.StartTime,
+		EndTime:    last.Timestamp,
+		FinalState: tcp.State(idm.IDiagState).String(),
+		Snapshots:  len(conn.pending),
+	}
+	sf.BytesSent, sf.BytesReceived = last.GetStats()
+	return sf, nil
+}
+
+// shortFlowSampled returns true if the short flow with the given cookie should be
+// written to its own file.  The decision is independent of that of sampled.
+func (svr *Saver) shortFlowSampled(cookie uint64) bool {
+	if svr.ShortFlowSampling <= 0 {
+		return false
+	}
+	return float64(mix(mix(cookie))) < svr.ShortFlowSampling*math.MaxUint64
+}
+
+// saveShortFlow writes the held snapshots of a sampled short flow to its own file.
+func (svr *Saver) saveShortFlow(conn *Connection) {
+	meta := svr.metadata(conn)
+	meta.ShortFlowSampling = svr.ShortFlowSampling
+	err := conn.Rotate(meta, svr.FileAgeLimit)
+	if err != nil {
+		log.Println("Could not record short flow:", err)
+		metrics.ErrorCount.WithLabelValues("short flow file").Inc()
+		return
+	}
+	q := svr.MarshalChanFor(conn.ID.CookieUint64())
+	for _, p := range conn.pending {
+		q <- svr.task(conn, p)
+	}
+	conn.last = conn.pending[len(conn.pending)-1]
+	conn.pending = nil
+	svr.closeFile(conn)
+	metrics.ShortFlowCount.WithLabelValues("sampled").Inc()
+}
+
+// endShortFlow handles a connection that ended before it reached MinSnapshots.
+func (svr *Saver) endShortFlow(conn *Connection) {
+	if !svr.ShortFlowRollup {
+		metrics.ShortFlowCount.WithLabelValues("discarded").Inc()
+		return
+	}
+	sf, err := svr.shortFlow(conn)
+	if err == nil {
+		err = svr.writeDaily(&svr.shortFlows, sf)
+	}
+	if err != nil {
+		log.Println("Could not record short flow:", err)
+		metrics.ErrorCount.WithLabelValues("short flow rollup").Inc()
+		return
+	}
+	metrics.ShortFlowCount.WithLabelValues("rollup").Inc()
+	if len(svr.Sinks) > 0 {
+		b, err := json.Marshal(sf)
+		if err != nil {
+			return
+		}
+		b = append(b, '\n')
+		for _, s := range svr.Sinks {
+			s.Publish(sink.Record{UUID: sf.UUID, Type: sink.ShortFlow, Time: time.Now(), Data: b})
+		}
+	}
+}
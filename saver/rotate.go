@@ -0,0 +1,40 @@
+package saver
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// countingWriter counts the uncompressed bytes written to a connection file, so
+// that the saver loop can rotate files that exceed Saver.MaxFileSize.  Writes are
+// made by the connection's marshaller, so the count is accessed atomically.
+type countingWriter struct {
+	n int64 // Accessed atomically, so it must be the first field.
+	io.WriteCloser
+	// bytes, if not nil, also counts the bytes written, for the metrics.
+	bytes prometheus.Counter
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	atomic.AddInt64(&w.n, int64(n))
+	if w.bytes != nil {
+		w.bytes.Add(float64(n))
+	}
+	return n, err
+}
+
+// size returns the number of bytes written so far.
+func (w *countingWriter) size() int64 {
+	return atomic.LoadInt64(&w.n)
+}
+
+// Err returns the error reported by the underlying writer, if it has an Err method.
+func (w *countingWriter) Err() error {
+	if f, ok := w.WriteCloser.(failer); ok {
+		return f.Err()
+	}
+	return nil
+}
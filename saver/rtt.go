@@ -0,0 +1,41 @@
+package saver
+
+import (
+	"math"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/sketch"
+)
+
+// rttSketch tracks the distribution of the smoothed RTT of a connection, over every
+// snapshot of it that the saver receives, whether or not it is written, so that
+// latency can be reported from the summaries without reading the files.
+type rttSketch struct {
+	sketch sketch.Sketch
+	last   time.Time // Timestamp of the last snapshot.
+}
+
+// observe adds the RTT of a snapshot of the connection, unless it has no RTT yet.
+func (r *rttSketch) observe(ar *netlink.ArchivalRecord) {
+	rtt, ok := ar.GetRTT()
+	if !ok || rtt == 0 || !ar.Timestamp.After(r.last) {
+		return
+	}
+	r.last = ar.Timestamp
+	r.sketch.Add(float64(rtt))
+}
+
+// summarize sets the RTT percentiles of the summary of the connection.
+func (r *rttSketch) summarize(sum *sink.Summary) {
+	if r.sketch.Count() == 0 {
+		return
+	}
+	sum.RTT = &sink.RTTPercentiles{
+		Samples: r.sketch.Count(),
+		P50:     uint32(math.Round(r.sketch.Quantile(0.5))),
+		P95:     uint32(math.Round(r.sketch.Quantile(0.95))),
+		P99:     uint32(math.Round(r.sketch.Quantile(0.99))),
+	}
+}
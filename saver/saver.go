@@ -9,26 +9,32 @@
 package saver
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/m-lab/go/anonymize"
 
+	"github.com/m-lab/tcp-info/bootinfo"
 	"github.com/m-lab/tcp-info/cache"
 	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/fault"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/loglevel"
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/snmp"
 	"github.com/m-lab/tcp-info/tcp"
-	"github.com/m-lab/tcp-info/zstd"
-	"github.com/m-lab/uuid"
 )
 
 // This is the maximum switch/network if speed in bits/sec.  It is used to check for illogical bit rate observations.
@@ -47,11 +53,32 @@ var (
 	ErrNoMarshallers = errors.New("Saver has zero Marshallers")
 )
 
+// logFatal reports the anomalies found in strict mode.  A variable to enable
+// mocking for testing.
+var logFatal = log.Fatal
+
 // Task represents a single marshalling task, specifying the message and the writer.
 type Task struct {
 	// nil message means close the writer.
 	Message *netlink.ArchivalRecord
 	Writer  io.WriteCloser
+	// Sinks also receive the marshalled message, for the connection with the UUID.
+	UUID  string
+	Sinks []sink.Sink
+
+	format *format // The format of the file.  If nil, the message is written as JSONL.
+	// delta, if greater than one, is the interval between the snapshots written in
+	// full.  Those in between are written as deltas from the previous snapshot.
+	delta int
+	// block, if greater than one, is the number of snapshots buffered and written
+	// together as a columnar block.
+	block int
+}
+
+// failer is implemented by writers that can fail asynchronously, e.g. the
+// zstd.Writer when its compression process exits.
+type failer interface {
+	Err() error
 }
 
 // CacheLogger is any object with a LogCacheStats method.
@@ -59,33 +86,174 @@ type CacheLogger interface {
 	LogCacheStats(localCount, errCount int)
 }
 
-// MarshalChan is a channel of marshalling tasks.
+// MessageSaver is any object that saves the messages of each polling cycle, e.g. a
+// Saver, or the in-memory fake of the savertest package, so that programs that
+// embed tcp-info can be tested without writing files.
+type MessageSaver interface {
+	// QueueMessages processes the messages of one polling cycle.  It is not called
+	// concurrently, or after Close.
+	QueueMessages(msgs netlink.MessageBlock)
+	// Close ends all the connections, and releases all resources.
+	Close()
+	// Stats returns the counts of the snapshots processed so far.  It may be called
+	// concurrently with the other methods.
+	Stats() Stats
+}
+
+// Stats are the counts of the snapshots processed by a MessageSaver.
+type Stats struct {
+	TotalCount   int64 // All the snapshots.
+	NewCount     int64 // The snapshots of new connections.
+	DiffCount    int64 // The snapshots that changed significantly.
+	ExpiredCount int64 // The connections that closed.
+}
+
+// Serve passes the messages received from readerChannel to s, until it is closed,
+// or the context is canceled, and then closes s.
+func Serve(ctx context.Context, s MessageSaver, readerChannel <-chan netlink.MessageBlock) {
+	for {
+		var msgs netlink.MessageBlock
+		ok := false
+		select {
+		case msgs, ok = <-readerChannel:
+		case <-ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		s.QueueMessages(msgs)
+	}
+	s.Close()
+}
+
+// MarshalChan is a channel of marshalling tasks.  Each MarshalChan is served
+// by a single marshaller goroutine, which performs its tasks strictly in the order
+// they were queued.
+//
+// All tasks for a connection, including data, rotation and close tasks, must be
+// queued on the same MarshalChan, which is selected by Saver.MarshalChanFor.  This
+// guarantees that every record is written to the writer it was queued with, before
+// that writer is closed, and in the order the records were queued.
 type MarshalChan chan<- Task
 
 func runMarshaller(taskChan <-chan Task, wg *sync.WaitGroup, anon anonymize.IPAnonymizer) {
-	for task := range taskChan {
+	// Batched writers that hold unwritten data.
+	pending := make(map[*batchWriter]struct{})
+	deltas := make(deltaFiles)
+	blocks := make(columnBlocks)
+	ticker := time.NewTicker(batchFlushInterval)
+	defer ticker.Stop()
+	for {
+		var task Task
+		var ok bool
+		select {
+		case task, ok = <-taskChan:
+		case now := <-ticker.C:
+			for w := range pending {
+				if w.due(now) {
+					w.Flush()
+				}
+				if !w.pending() {
+					delete(pending, w)
+				}
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+		bw, batched := task.Writer.(*batchWriter)
 		if task.Message == nil {
+			if batched {
+				delete(pending, bw)
+			}
+			delete(deltas, task.Writer)
+			if rec, f := blocks.flush(task.Writer); rec != nil {
+				writeRecord(task.Writer, f, rec, nil)
+			}
 			task.Writer.Close()
 			continue
 		}
 		if task.Writer == nil {
 			log.Fatal("Nil writer")
 		}
-		err := task.Message.RawIDM.Anonymize(anon)
+		// The message may be shared with the connection cache, so a copy is
+		// anonymized, and nothing that is not anonymized is marshalled.
+		msg, err := task.Message.Anonymized(anon)
 		if err != nil {
-			log.Println("Failed to anonymize message:", err)
+			loglevel.Limitedln(loglevel.Error, loglevel.Failure, "Failed to anonymize message:", err)
 			continue
 		}
-		b, _ := json.Marshal(task.Message) // FIXME: don't ignore error
-		task.Writer.Write(b)
-		task.Writer.Write([]byte("\n"))
+		rec := msg
+		if task.block > 1 {
+			rec = blocks.add(task.Writer, rec, task.format, task.block)
+		} else if task.delta > 1 {
+			rec = deltas.encode(task.Writer, rec, task.delta)
+		}
+		f := task.format.orJSONL()
+		var b []byte
+		if rec != nil {
+			buf := recordBuffers.Get().(*[]byte)
+			b, err = writeRecord(task.Writer, f, rec, (*buf)[:0])
+			if len(task.Sinks) == 0 || f != jsonlFormat || rec != msg {
+				// The record is not published, so its buffer is no longer used once
+				// it is written.
+				if b != nil {
+					*buf = b
+				}
+				recordBuffers.Put(buf)
+				b = nil
+			}
+			if err != nil {
+				continue
+			}
+		}
+		if len(task.Sinks) > 0 && b == nil {
+			// The sinks always receive complete JSON records.
+			b, _ = appendJSON(nil, msg)
+		}
+		for _, s := range task.Sinks {
+			s.Publish(sink.Record{UUID: task.UUID, Type: sink.Snapshot, Time: time.Now(), Data: b})
+		}
+		if batched && bw.pending() {
+			pending[bw] = struct{}{}
+		}
 	}
 	log.Println("Marshaller Done")
 	wg.Done()
 }
 
-func newMarshaller(wg *sync.WaitGroup, anon anonymize.IPAnonymizer) MarshalChan {
-	marshChan := make(chan Task, 100)
+// recordBuffers holds the buffers that records are encoded in.  A buffer is reused
+// once its record is written, unless the record is also published to sinks, which
+// may retain it.
+var recordBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// writeRecord writes rec to w in the format f, encoding it by appending to buf, and
+// returns the bytes written, or nil if w is a recordWriter.  w must not retain the
+// bytes, as for io.Writer.
+func writeRecord(w io.Writer, f *format, rec *netlink.ArchivalRecord, buf []byte) ([]byte, error) {
+	if rw, ok := w.(recordWriter); ok {
+		err := rw.writeRecord(rec)
+		if err != nil {
+			loglevel.Limitedln(loglevel.Error, loglevel.Failure, "Failed to write record:", err)
+		}
+		return nil, err
+	}
+	b, err := f.orJSONL().append(buf, rec)
+	if err != nil {
+		loglevel.Limitedln(loglevel.Error, loglevel.Failure, "Failed to marshal message:", err)
+		return nil, err
+	}
+	w.Write(b)
+	return b, nil
+}
+
+// DefaultQueueDepth is the capacity of each marshalling queue of a Saver created
+// without WithQueueDepth.
+const DefaultQueueDepth = 100
+
+func newMarshaller(wg *sync.WaitGroup, anon anonymize.IPAnonymizer, depth int) MarshalChan {
+	marshChan := make(chan Task, depth)
 	wg.Add(1)
 	go runMarshaller(marshChan, wg, anon)
 	return marshChan
@@ -101,11 +269,47 @@ type Connection struct {
 	Sequence   int       // Typically zero, but increments for long running connections.
 	Expiration time.Time // Time we will swap files and increment Sequence.
 	Writer     io.WriteCloser
+	Generation int // Number of previous connections that used the same cookie.
+	// Protocol is the protocol of the socket, if it is not TCP.
+	Protocol inetdiag.Protocol
+
+	lastHeader time.Time // Time the most recent file header was written.
+	// writers creates the writer for each file.  If nil, a FileWriterFactory is used.
+	writers  WriterFactory
+	format   *format // The format of the files.  If nil, files are JSONL.
+	filename string  // The name of the current file.
+	// written counts the bytes written to the current file.
+	written *countingWriter
+	// pending holds the snapshots queued before the file is created.
+	pending []*netlink.ArchivalRecord
+	// snapshots is the number of snapshots queued for the connection.
+	snapshots int
+	// priority determines whether its snapshots are shed under queue pressure.
+	priority Priority
+	// last is the most recent snapshot queued for the current file.
+	last *netlink.ArchivalRecord
+	// elephant is true once the connection is an elephant flow.
+	elephant bool
+	// appLimited tracks the app-limited periods, for the summary.
+	appLimited appLimited
+	// rtt tracks the RTT distribution, for the summary.
+	rtt rttSketch
+	// mptcpToken is the token of the MPTCP connection, if it is one, or a subflow of one.
+	mptcpToken uint32
+	// derivedFrom is the most recent snapshot from which fields were derived.
+	derivedFrom *snapshot.Snapshot
+	// template names its files.  If nil, the DefaultNameTemplate is used.
+	template *NameTemplate
+	// probed is true if the connection is selected by the SockOptRules.
+	probed bool
+	// sockOpts is the most recent socket option report recorded.
+	sockOpts *eventsocket.SockOpts
 }
 
 func newConnection(info *inetdiag.InetDiagMsg, timestamp time.Time) *Connection {
+	// The header of its first file records the audit events since it was created.
 	conn := Connection{Inode: info.IDiagInode, ID: info.ID.GetSockID(), UID: info.IDiagUID, Slice: "", StartTime: timestamp, Sequence: 0,
-		Expiration: time.Now()}
+		Expiration: time.Now(), lastHeader: time.Now()}
 	return &conn
 }
 
@@ -117,42 +321,96 @@ func newConnection(info *inetdiag.InetDiagMsg, timestamp time.Time) *Connection
 // therefore likely have data in multiple date directories.
 // (This behavior is new as of April 2020. Prior to then, all files were
 // placed in the directory corresponding to the StartTime.)
-func (conn *Connection) Rotate(Host string, Pod string, FileAgeLimit time.Duration) error {
-	datePath := conn.StartTime.Format("2006/01/02")
+// The header is based on meta, with the connection specific fields filled in.
+// The file is named by the NameTemplate of the connection, or by default placed in
+// the date directory.  With the IdentityNameTemplate, the date directories are
+// placed under <Experiment>/<Site>/<Machine>.
+// The file expires FileAgeLimit after the previous one, or, if that has already
+// passed, FileAgeLimit from now.  If FileAgeLimit is zero, the file never expires.
+func (conn *Connection) Rotate(meta netlink.Metadata, FileAgeLimit time.Duration) error {
+	fileTime := conn.StartTime
 	// For first block, date directory is based on the connection start time.
 	// For all other blocks, (sequence > 0) it is based on the current time.
 	if conn.Sequence > 0 {
-		now := time.Now().UTC()
-		datePath = now.Format("2006/01/02")
+		fileTime = fault.Now().UTC()
 	}
-	err := os.MkdirAll(datePath, 0777)
-	if err != nil {
-		return err
+	writers := conn.writers
+	if writers == nil {
+		writers = &FileWriterFactory{}
 	}
-	id := uuid.FromCookie(conn.ID.CookieUint64())
-	conn.Writer, err = zstd.NewWriter(fmt.Sprintf("%s/%s.%05d.jsonl.zst", datePath, id, conn.Sequence))
+	template := conn.template
+	if template == nil {
+		template = defaultTemplate
+	}
+	f := conn.format.orJSONL()
+	name := template.name(&nameValues{meta: &meta, uuid: conn.UUID(), sequence: conn.Sequence, time: fileTime, format: strings.TrimPrefix(f.ext, ".")})
+	conn.filename = name + protocolSuffix(conn.Protocol) + f.ext
+	if f.open == nil {
+		conn.filename += ".zst"
+	}
+	w, err := writers.NewWriter(conn.filename)
 	if err != nil {
 		return err
 	}
-	conn.writeHeader()
+	conn.written = &countingWriter{WriteCloser: w, bytes: metrics.SaverBytesWritten.WithLabelValues(strings.TrimPrefix(f.ext, "."))}
+	conn.Writer = conn.written
+	if f.open != nil {
+		conn.Writer, err = f.open(conn.written)
+		if err != nil {
+			conn.written.Close()
+			conn.Writer, conn.written = nil, nil
+			return err
+		}
+	}
+	conn.writeHeader(meta)
 	metrics.NewFileCount.Inc()
-	conn.Expiration = conn.Expiration.Add(10 * time.Minute)
+	metrics.SaverOpenFiles.Inc()
+	if FileAgeLimit > 0 {
+		conn.Expiration = conn.Expiration.Add(FileAgeLimit)
+		if now := fault.Now(); conn.Expiration.Before(now) {
+			conn.Expiration = now.Add(FileAgeLimit)
+		}
+	}
 	conn.Sequence++
 	return nil
 }
 
-func (conn *Connection) writeHeader() {
+// protocolName returns the lower case name of a protocol, e.g. "udp", or "" for TCP.
+func protocolName(p inetdiag.Protocol) string {
+	if p == 0 || p == inetdiag.Protocol_IPPROTO_TCP {
+		return ""
+	}
+	name, ok := inetdiag.ProtocolName[int32(p)]
+	if !ok {
+		return fmt.Sprint(uint8(p))
+	}
+	return strings.ToLower(strings.TrimPrefix(name, "IPPROTO_"))
+}
+
+// protocolSuffix returns the file name suffix distinguishing the files of
+// protocols other than TCP, e.g. ".udp".
+func protocolSuffix(p inetdiag.Protocol) string {
+	if name := protocolName(p); name != "" {
+		return "." + name
+	}
+	return ""
+}
+
+func (conn *Connection) writeHeader(meta netlink.Metadata) {
+	meta.UUID = conn.UUID()
+	meta.Sequence = conn.Sequence
+	meta.StartTime = conn.StartTime
 	msg := netlink.ArchivalRecord{
-		Metadata: &netlink.Metadata{
-			UUID:      uuid.FromCookie(conn.ID.CookieUint64()),
-			Sequence:  conn.Sequence,
-			StartTime: conn.StartTime,
-		},
+		Metadata: &meta,
 	}
+	if rw, ok := conn.Writer.(recordWriter); ok {
+		rw.writeRecord(&msg)
+		return
+	}
+	f := conn.format.orJSONL()
 	// FIXME: Error handling
-	bytes, _ := json.Marshal(msg)
+	bytes, _ := f.append(append([]byte{}, f.header...), &msg)
 	conn.Writer.Write(bytes)
-	conn.Writer.Write([]byte("\n"))
 }
 
 type stats struct {
@@ -164,18 +422,22 @@ type stats struct {
 
 func (s *stats) IncTotalCount() {
 	atomic.AddInt64(&s.TotalCount, 1)
+	metrics.SaverSnapshotCount.WithLabelValues("total").Inc()
 }
 
 func (s *stats) IncNewCount() {
 	atomic.AddInt64(&s.NewCount, 1)
+	metrics.SaverSnapshotCount.WithLabelValues("new").Inc()
 }
 
 func (s *stats) IncDiffCount() {
 	atomic.AddInt64(&s.DiffCount, 1)
+	metrics.SaverSnapshotCount.WithLabelValues("diff").Inc()
 }
 
 func (s *stats) IncExpiredCount() {
 	atomic.AddInt64(&s.ExpiredCount, 1)
+	metrics.SaverExpiredCount.Inc()
 }
 
 func (s *stats) Copy() stats {
@@ -196,57 +458,334 @@ type TcpStats struct {
 // Saver provides functionality for saving tcpinfo diffs to connection files.
 // It handles arbitrary connections, and only writes to file when the
 // significant fields change.  (TODO - what does "significant fields" mean).
-// TODO - just export an interface, instead of the implementation.
+// Programs that embed tcp-info may use it through the MessageSaver interface.
 type Saver struct {
-	Host          string // mlabN
-	Pod           string // 3 alpha + 2 decimal
-	FileAgeLimit  time.Duration
+	// The fields accessed atomically come first, so that they are 64-bit aligned on
+	// 32-bit platforms, as sync/atomic requires.
+	sampling uint64 // Bits of the float64 sampling fraction.
+	stats    stats
+
+	Host          string        // mlabN
+	Pod           string        // 3 alpha + 2 decimal
+	Experiment    string        // Name of the experiment, e.g. ndt
+	Boot          bootinfo.Info // The boot of the host, if known, recorded in every file header.
+	FileAgeLimit  time.Duration // Files are rotated after this long.  Zero disables age rotation.
 	MarshalChans  []MarshalChan
-	Done          *sync.WaitGroup // All marshallers will call Done on this.
+	Done          *sync.WaitGroup // Done when Close has completed, and all marshallers have finished.
 	Connections   map[uint64]*Connection
 	ClosingStats  map[uint64]TcpStats // BytesReceived and BytesSent for connections that are closing.
 	ClosingTotals TcpStats
+	// Kernel, if not nil, describes the kernel's inet_diag features, and is recorded
+	// in every file header.  It must be set before MessageSaverLoop is started.
+	Kernel *netlink.Capabilities
+	// MaxFileSize, if positive, is the number of uncompressed bytes after which a
+	// connection continues in a new file.  The file is rotated at the connection's
+	// next snapshot, so files may exceed it by one batch of records.
+	MaxFileSize int64
+	// DeltaInterval, if greater than one, is the interval between the snapshots of a
+	// file written in full.  Those in between are written as deltas from the previous
+	// snapshot, which netlink.NewArchiveReader reconstructs.
+	DeltaInterval int
+	// ColumnBlock, if greater than one, is the number of consecutive snapshots of a
+	// connection buffered in memory, and written together as a single record, in a
+	// columnar layout that compresses better than the individual records.  Any
+	// snapshots remaining when the file is closed are written as a smaller block.
+	// netlink.NewArchiveReader returns the snapshots individually.  It takes
+	// precedence over DeltaInterval.
+	ColumnBlock int
+	// IdleCycles, if positive, is the number of consecutive polling cycles without a
+	// significant change after which a connection is idle, and its snapshots are
+	// only processed every IdleInterval cycles.  This reduces the load of hosts with
+	// many idle connections, but the changes of an idle connection, including those
+	// as it closes, are recorded up to IdleInterval cycles late, or missed.
+	IdleCycles int
+	// IdleInterval is the number of polling cycles between the processed snapshots of
+	// an idle connection.
+	IdleInterval int
+	// ExpiryGraceCycles is the number of consecutive polling cycles a connection may
+	// be missing before it is considered closed, and its file is closed.
+	ExpiryGraceCycles int
+	// CheckpointFile, if not empty, is where the sequence numbers of closed connections are
+	// persisted, so that connections continue their file series across restarts.
+	CheckpointFile string
+	// CheckpointRetention is how long the sequence number of a closed connection is retained.
+	CheckpointRetention time.Duration
+	// DiagnosticsDir, if not empty, is the directory to which the netlink messages
+	// that cannot be parsed are written, with the context needed to reproduce the
+	// failures offline.  See Diagnostic.
+	DiagnosticsDir string
+	// MaxDiagnostics is the number of diagnostic files kept in DiagnosticsDir, of
+	// which the oldest are removed.  Zero keeps DefaultMaxDiagnostics.
+	MaxDiagnostics int
+	// BatchSize is the number of bytes of records accumulated for a connection before
+	// they are written to its compressor.  Zero disables batching.
+	BatchSize int
+	// BatchDelay is the maximum time records are held in a batch before being written.
+	BatchDelay time.Duration
+	// Owners maps UIDs to logical owner or service names, which are recorded in the
+	// file headers, and used as metric labels.  UIDs that are not mapped have the
+	// owner "unknown".
+	Owners map[uint32]string
+	// RecordOwners, if not empty, is the set of owners whose connections are recorded.
+	RecordOwners map[string]bool
+	// CIDRFilters select the connections that are recorded by their addresses.  A
+	// connection must pass every filter.  Other connections are not cached, and are
+	// not included in the byte counts.
+	CIDRFilters []CIDRFilter
+	// PriorityRules assign the connections the Priority of the first rule they match,
+	// or NormalPriority.  If set, snapshots that do not record a state change are
+	// dropped when the marshalling queues are under pressure, lowest priority first,
+	// rather than delaying the polling.
+	PriorityRules []PriorityRule
+	// DropWhenFull, if true, drops the snapshots that would wait for room in a full
+	// marshalling queue, rather than delaying the polling, whatever the priority of
+	// their connection.  Snapshots that are never shed, i.e. the first, final and
+	// state change snapshots, still wait.  The drops are counted by
+	// metrics.MarshalDropCount.
+	DropWhenFull bool
+	// SockOptRules select the connections whose snapshots record the socket options
+	// reported by their applications through the eventsocket.  A connection is
+	// selected if it matches any rule.  See SockOpts.
+	SockOptRules []SockOptRule
+	// WriterFactory creates the writers for all files.  If nil, files are written to
+	// the local file system, with a FileWriterFactory configured by OutputDir,
+	// InProcessCompression and CompressionFrameSize.
+	WriterFactory WriterFactory
+	// OutputDir is the directory under which the files are written, if there is no
+	// WriterFactory.  If empty, they are written under the working directory.
+	OutputDir string
+	// NameTemplate names the connection files.  If nil, DefaultNameTemplate is used.
+	NameTemplate *NameTemplate
+	// InProcessCompression compresses files in process, instead of with one external zstd
+	// process per file.
+	InProcessCompression bool
+	// CompressionFrameSize bounds the uncompressed data buffered by each in-process
+	// compressor.  Zero uses zstd.DefaultFrameSize.
+	CompressionFrameSize int
+	// MinSnapshots is the number of snapshots a connection must have before its file
+	// is created.  Connections that end with fewer snapshots are short flows, which
+	// are discarded, or recorded in the short flow rollup if ShortFlowRollup is set,
+	// unless they are sampled by ShortFlowSampling.
+	MinSnapshots int
+	// MinDuration is how long a connection must have lasted before its file is
+	// created.  Connections that end sooner are short flows, as for MinSnapshots.
+	// Their snapshots are held in memory until then.
+	MinDuration time.Duration
+	// ShortFlowSampling is the fraction of short flows that are written to their own
+	// files, from their held snapshots, when they end.  So all longer connections are
+	// recorded, and a sample of the short ones, whose file headers record the
+	// fraction.  The others are discarded or rolled up.
+	ShortFlowSampling float64
+	// ShortFlowRollup enables the daily short flow rollup files.
+	ShortFlowRollup bool
+	// ElephantBytes, if not zero, is the number of bytes sent and received after
+	// which a connection is an elephant flow, and recorded at the highest fidelity.
+	ElephantBytes uint64
+	// ElephantRate, if positive, is the average rate, in bytes sent and received per
+	// second, above which a connection is an elephant flow.
+	ElephantRate float64
+	// ReconcileInterval is how often the Connections are reconciled with the connection
+	// cache, to detect and repair leaks.  Zero disables reconciliation.
+	ReconcileInterval time.Duration
+	// HostSketchInterval is how often the sketches of the RTT and delivery rate of
+	// all the connections are written to the daily host sketch files.  Zero
+	// disables the files, but the quantiles are still exported as metrics.
+	HostSketchInterval time.Duration
+	// Sinks receive every record written to the connection files.  They are closed
+	// by Close.
+	Sinks []sink.Sink
+	// Derivers compute the Derived fields of the snapshots that are queued, in
+	// order, so a later Deriver with the same Name replaces the value of an
+	// earlier one.
+	Derivers []Deriver
+
+	checkpoint     checkpoint
+	lastCheckpoint time.Time
+	diagnostics    int // The number of diagnostic files written.
+	lastReconcile  time.Time
+	started        bool     // Whether start has been called.
+	reported       TcpStats // The total bytes last reported to Prometheus.
+	closed         TcpStats // The total bytes of the closed connections.
+	lastReport     int64    // The Unix time of the cycle in which the bytes were last reported.
+	audit          auditLog
+	marshallers    *sync.WaitGroup // All marshallers will call Done on this.
+	closeStats     CloseStats
+	excluded       map[uint64]struct{} // Cookies of live connections excluded by sampling or owner.
+	generations    map[uint64]int      // Number of times each cached cookie has been reused.
+	unchanged      map[uint64]int      // Consecutive unchanged snapshots of each cached cookie, for pacing.
+	anon           anonymize.IPAnonymizer
+	shortFlows     dailyFile
+	index          dailyFile
+	hostSketchFile dailyFile
+	hostSketches   hostSketches
+	counterFile    dailyFile
+	lastCounters   *snmp.Counters         // The host counters last recorded.
+	mptcp          map[uint32]*mptcpGroup // The MPTCP connections and subflows, by token.
+	cache          *cache.Cache
+	eventServer    eventsocket.Server
+	sockOpts       sockOptReports
+	format         *format          // The format of the connection files, set by SetOutputFormat.
+	attributes     *attributeFilter // The attributes dropped, set by SetAttributePolicy.
+	queueDepth     int              // The capacity of each marshalling queue.
+}
+
+// Option sets an optional field of a Saver created by NewSaver.
+type Option func(svr *Saver)
 
-	cache       *cache.Cache
-	stats       stats
-	eventServer eventsocket.Server
+// WithOutputDir sets the OutputDir of the Saver.
+func WithOutputDir(dir string) Option {
+	return func(svr *Saver) { svr.OutputDir = dir }
+}
+
+// WithNameTemplate sets the NameTemplate of the Saver.
+func WithNameTemplate(t *NameTemplate) Option {
+	return func(svr *Saver) { svr.NameTemplate = t }
+}
+
+// WithQueueDepth sets the capacity of each marshalling queue of the Saver, which
+// is DefaultQueueDepth by default.  Deeper queues absorb longer stalls of the
+// writers before the polling is delayed, or snapshots are dropped.
+func WithQueueDepth(depth int) Option {
+	return func(svr *Saver) { svr.queueDepth = depth }
 }
 
 // NewSaver creates a new Saver for the given host and pod.  numMarshaller controls
 // how many marshalling goroutines are used to distribute the marshalling workload.
-func NewSaver(host string, pod string, numMarshaller int, srv eventsocket.Server, anon anonymize.IPAnonymizer) *Saver {
-	m := make([]MarshalChan, 0, numMarshaller)
+// The options are applied in order.
+func NewSaver(host string, pod string, numMarshaller int, srv eventsocket.Server, anon anonymize.IPAnonymizer, opts ...Option) *Saver {
 	c := cache.NewCache()
 	// We start with capacity of 500.  This will be reallocated as needed, but this
 	// is not a performance concern.
 	conn := make(map[uint64]*Connection, 500)
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
+	marshallers := &sync.WaitGroup{}
 	ageLim := 10 * time.Minute
 
-	for i := 0; i < numMarshaller; i++ {
-		m = append(m, newMarshaller(wg, anon))
-	}
-
-	return &Saver{
+	svr := &Saver{
 		Host:         host,
 		Pod:          pod,
 		FileAgeLimit: ageLim,
-		MarshalChans: m,
+		MarshalChans: make([]MarshalChan, 0, numMarshaller),
 		Done:         wg,
+		marshallers:  marshallers,
 		Connections:  conn,
 		ClosingStats: make(map[uint64]TcpStats, 100),
-		cache:        c,
-		eventServer:  srv,
+		IdleInterval: 10,
+
+		CheckpointRetention: time.Hour,
+		ReconcileInterval:   time.Minute,
+		BatchSize:           32 * 1024,
+		BatchDelay:          time.Second,
+		checkpoint:          make(checkpoint),
+		sampling:            math.Float64bits(1),
+		excluded:            make(map[uint64]struct{}),
+		generations:         make(map[uint64]int),
+		unchanged:           make(map[uint64]int),
+		mptcp:               make(map[uint32]*mptcpGroup),
+		anon:                anon,
+		shortFlows:          dailyFile{kind: "short_flows"},
+		index:               dailyFile{kind: "index"},
+		hostSketchFile:      dailyFile{kind: "host_sketches"},
+		counterFile:         dailyFile{kind: "host_counters"},
+		cache:               c,
+		eventServer:         srv,
+		queueDepth:          DefaultQueueDepth,
+	}
+	for _, opt := range opts {
+		opt(svr)
+	}
+	metrics.SamplingFraction.Set(svr.Sampling())
+	for i := 0; i < numMarshaller; i++ {
+		svr.MarshalChans = append(svr.MarshalChans, newMarshaller(marshallers, anon, svr.queueDepth))
 	}
+	return svr
+}
+
+// metadata returns the saver level metadata for the next file header of conn.
+func (svr *Saver) metadata(conn *Connection) netlink.Metadata {
+	meta := netlink.Metadata{
+		Machine:     svr.Host,
+		Site:        svr.Pod,
+		Experiment:  svr.Experiment,
+		BootID:      svr.Boot.ID,
+		BootTime:    svr.Boot.Time,
+		Clock:       bootinfo.Clock,
+		ClockSource: svr.Boot.ClockSource,
+		Audit:       svr.audit.since(conn.lastHeader),
+		Kernel:      svr.Kernel,
+	}
+	if conn.elephant {
+		meta.Elephant = true
+	} else if svr.attributes != nil {
+		meta.AttributePolicy = svr.attributes.policy
+	}
+	if owner, ok := svr.Owners[conn.UID]; ok {
+		meta.Owner = owner
+	}
+	if s := svr.Sampling(); s < 1 {
+		meta.Sampling = s
+	}
+	meta.Protocol = protocolName(conn.Protocol)
+	meta.MPTCPToken = conn.mptcpToken
+	conn.lastHeader = time.Now()
+	return meta
+}
+
+// owner returns the owner name for a UID.
+func (svr *Saver) owner(uid uint32) string {
+	if owner, ok := svr.Owners[uid]; ok {
+		return owner
+	}
+	return "unknown"
+}
+
+// SetSampling sets the fraction of new connections that will be recorded.  It
+// is safe to call concurrently with MessageSaverLoop.  Connections already being
+// recorded (or excluded) are not affected.
+func (svr *Saver) SetSampling(fraction float64) {
+	atomic.StoreUint64(&svr.sampling, math.Float64bits(fraction))
+	metrics.SamplingFraction.Set(fraction)
+}
+
+// Sampling returns the fraction of new connections that will be recorded.
+func (svr *Saver) Sampling() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&svr.sampling))
+}
+
+// sampled returns true if the connection with the given cookie should be recorded.
+// The decision is a deterministic function of the cookie, so that it is stable
+// for the lifetime of the connection.
+func (svr *Saver) sampled(cookie uint64) bool {
+	fraction := svr.Sampling()
+	if fraction >= 1 {
+		return true
+	}
+	return float64(mix(cookie)) < fraction*math.MaxUint64
+}
+
+// mix is the splitmix64 finalizer, which spreads the mostly sequential kernel
+// cookies for sampling.
+func mix(h uint64) uint64 {
+	h += 0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
+
+// MarshalChanFor returns the MarshalChan that handles all tasks for the connection
+// with the given cookie.
+func (svr *Saver) MarshalChanFor(cookie uint64) MarshalChan {
+	return svr.MarshalChans[cookie%uint64(len(svr.MarshalChans))]
 }
 
 // queue queues a single ArchivalRecord to the appropriate marshalling queue, based on the
-// connection Cookie.
-func (svr *Saver) queue(msg *netlink.ArchivalRecord) error {
+// connection Cookie.  stateChange is true if msg is the first snapshot of the connection,
+// or its state differs from the previous one, so that it is never shed.
+func (svr *Saver) queue(msg *netlink.ArchivalRecord, stateChange bool) error {
 	idm, err := msg.RawIDM.Parse()
 	if err != nil {
-		log.Println(err)
+		loglevel.Limitedln(loglevel.Error, loglevel.Failure, err)
 		// TODO error metric
 	}
 	cookie := idm.ID.Cookie()
@@ -256,69 +795,248 @@ func (svr *Saver) queue(msg *netlink.ArchivalRecord) error {
 	if len(svr.MarshalChans) < 1 {
 		return ErrNoMarshallers
 	}
-	q := svr.MarshalChans[int(cookie%uint64(len(svr.MarshalChans)))]
+	q := svr.MarshalChanFor(cookie)
 	conn, ok := svr.Connections[cookie]
 	if !ok {
+		if _, skip := svr.excluded[cookie]; skip {
+			return nil
+		}
+		owner := svr.owner(idm.IDiagUID)
+		if len(svr.RecordOwners) > 0 && !svr.RecordOwners[owner] {
+			svr.excluded[cookie] = struct{}{}
+			metrics.ExcludedOwnerConnectionCount.Inc()
+			return nil
+		}
+		if !svr.sampled(cookie) {
+			svr.excluded[cookie] = struct{}{}
+			metrics.UnsampledConnectionCount.Inc()
+			return nil
+		}
+		metrics.OwnerConnectionCount.WithLabelValues(owner).Inc()
 		// Create a new connection for first time cookies.  For late connections already
 		// terminating, log some info for debugging purposes.
-		if idm.IDiagState >= uint8(tcp.FIN_WAIT1) {
+		if msg.IsTCP() && idm.IDiagState >= uint8(tcp.FIN_WAIT1) {
 			s, r := msg.GetStats()
-			log.Println("Starting:", msg.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), TcpStats{s, r})
+			loglevel.Limitedln(loglevel.Info, loglevel.Connection, "Starting:", msg.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), TcpStats{s, r})
 		}
 		conn = newConnection(idm, msg.Timestamp)
-		svr.eventServer.FlowCreated(msg.Timestamp, uuid.FromCookie(cookie), idm.ID.GetSockID())
+		if !msg.IsTCP() {
+			conn.Protocol = msg.Protocol
+		}
+		conn.writers = svr.writerFactory()
+		conn.format = svr.format
+		conn.template = svr.NameTemplate
+		if cp, ok := svr.checkpoint[cookie]; ok {
+			// This cookie was seen before, so continue the existing file series.
+			conn.Sequence = cp.Sequence
+			conn.StartTime = cp.StartTime
+			if cp.Generation > 0 {
+				svr.generations[cookie] = cp.Generation
+			}
+			delete(svr.checkpoint, cookie)
+		}
+		conn.Generation = svr.generations[cookie]
+		conn.priority = svr.priority(idm, owner)
+		if svr.probed(idm, owner) {
+			svr.watchSockOpts(conn)
+		}
+		svr.eventServer.FlowCreated(msg.Timestamp, conn.UUID(), idm.ID.GetSockID())
 		svr.Connections[cookie] = conn
 	} else {
 		//log.Println("Diff inode:", inode)
 	}
-	if time.Now().After(conn.Expiration) && conn.Writer != nil {
-		q <- Task{nil, conn.Writer} // Close the previous file.
-		conn.Writer = nil
+	conn.snapshots++
+	svr.joinMPTCP(cookie, conn, msg)
+	if len(svr.Derivers) > 0 {
+		msg.Derived, conn.derivedFrom = derive(svr.Derivers, conn.derivedFrom, msg)
+	}
+	if len(svr.Sinks) > 0 {
+		conn.appLimited.observe(msg)
+		conn.rtt.observe(msg)
+	}
+	if f, ok := conn.Writer.(failer); ok && f.Err() != nil {
+		// The compressor has failed, so continue in a new file segment.
+		log.Println("Restarting compressor for", cookie, f.Err())
+		metrics.CompressorRestartCount.Inc()
+		svr.closeFile(conn)
+	}
+	if conn.Writer != nil && svr.expired(conn) {
+		svr.closeFile(conn) // Close the previous file.
 	}
 	if conn.Writer == nil {
-		err := conn.Rotate(svr.Host, svr.Pod, svr.FileAgeLimit)
+		// Files are not created until the handshake completes, so that connections
+		// that never complete it do not produce files.  The most recent handshake
+		// snapshot is held, and written first once the file is created.
+		if s := tcp.State(idm.IDiagState); s == tcp.SYN_SENT || s == tcp.SYN_RECV {
+			conn.pending = append(conn.pending[:0], msg)
+			return nil
+		}
+		// Nor are they created until the connection has MinSnapshots snapshots, and
+		// has lasted MinDuration.
+		if len(conn.pending)+1 < svr.MinSnapshots || msg.Timestamp.Sub(conn.StartTime) < svr.MinDuration {
+			conn.pending = append(conn.pending, msg)
+			return nil
+		}
+		err := conn.Rotate(svr.metadata(conn), svr.FileAgeLimit)
 		if err != nil {
 			return err
 		}
+		if svr.BatchSize > 0 && conn.format.orJSONL().open == nil {
+			// Formats that encode records together buffer them anyway.
+			conn.Writer = newBatchWriter(conn.Writer, svr.BatchSize, svr.BatchDelay)
+		}
+		for _, p := range conn.pending {
+			q <- svr.task(conn, p)
+		}
+		conn.pending = nil
+	} else if svr.shed(conn, q, stateChange) {
+		return nil
 	}
-	q <- Task{msg, conn.Writer}
+	msg.SockOpts = svr.newSockOpts(conn)
+	if svr.DropWhenFull && !stateChange {
+		select {
+		case q <- svr.task(conn, msg):
+		default:
+			metrics.MarshalDropCount.Inc()
+			return nil
+		}
+	} else {
+		q <- svr.task(conn, msg)
+	}
+	conn.last = msg
 	return nil
 }
 
+// expired returns true if the current file of conn has reached the age or size
+// limit, and should be rotated.
+func (svr *Saver) expired(conn *Connection) bool {
+	if svr.FileAgeLimit > 0 && fault.Now().After(conn.Expiration) {
+		return true
+	}
+	return svr.MaxFileSize > 0 && conn.written != nil && conn.written.size() >= svr.MaxFileSize
+}
+
+// task returns the Task that writes msg to the current file of conn, and publishes
+// it to the Sinks.
+func (svr *Saver) task(conn *Connection, msg *netlink.ArchivalRecord) Task {
+	t := Task{Message: msg, Writer: conn.Writer, format: conn.format, delta: svr.DeltaInterval, block: svr.ColumnBlock}
+	if conn.format.orJSONL().rows {
+		t.delta, t.block = 0, 0
+	}
+	if len(svr.Sinks) > 0 {
+		t.UUID = conn.UUID()
+		t.Sinks = svr.Sinks
+	}
+	return t
+}
+
 func (svr *Saver) endConn(cookie uint64) {
-	svr.eventServer.FlowDeleted(time.Now(), uuid.FromCookie(cookie))
-	q := svr.MarshalChans[cookie%uint64(len(svr.MarshalChans))]
 	conn, ok := svr.Connections[cookie]
-	if ok && conn.Writer != nil {
-		q <- Task{nil, conn.Writer}
-		delete(svr.Connections, cookie)
+	var final *eventsocket.Counters
+	if ok {
+		final = finalCounters(conn)
+		svr.leaveMPTCP(cookie, conn)
+		svr.forgetSockOpts(conn)
 	}
+	if fs, ok := svr.eventServer.(eventsocket.FinalServer); ok {
+		fs.FlowDeletedWithCounters(time.Now(), svr.uuid(cookie), final)
+	} else {
+		svr.eventServer.FlowDeleted(time.Now(), svr.uuid(cookie))
+	}
+	if !ok {
+		return
+	}
+	if conn.Writer != nil {
+		svr.checkpoint[cookie] = checkpointEntry{Sequence: conn.Sequence, StartTime: conn.StartTime, Expired: time.Now(), Generation: conn.Generation}
+		svr.closeFile(conn)
+	} else if len(conn.pending) > 0 {
+		// The connection ended before its file was created.
+		last := conn.pending[len(conn.pending)-1]
+		idm, err := last.RawIDM.Parse()
+		if err == nil && (tcp.State(idm.IDiagState) == tcp.SYN_SENT || tcp.State(idm.IDiagState) == tcp.SYN_RECV) {
+			metrics.HandshakeOnlyCount.Inc()
+		} else if svr.shortFlowSampled(cookie) {
+			svr.saveShortFlow(conn)
+		} else {
+			svr.endShortFlow(conn)
+		}
+	}
+	// A connection whose file could not be created has neither a file nor held
+	// snapshots, but is still removed.
+	delete(svr.Connections, cookie)
 }
 
-// Handle a bundle of messages.
+// saveCheckpoint prunes old entries from the checkpoint, and persists it to the
+// CheckpointFile, if there is one.
+func (svr *Saver) saveCheckpoint() {
+	svr.checkpoint.prune(time.Now().Add(-svr.CheckpointRetention))
+	if svr.CheckpointFile == "" {
+		return
+	}
+	err := svr.checkpoint.save(svr.CheckpointFile)
+	if err != nil {
+		log.Println("Could not save checkpoint:", err)
+		metrics.ErrorCount.WithLabelValues("checkpoint save").Inc()
+	}
+	svr.lastCheckpoint = time.Now()
+}
+
+// interpolate returns the time at which the i'th of n messages in a dump was
+// generated, assuming they are generated at a constant rate between the start
+// of the dump and its end.  If start is zero, it returns end.
+func interpolate(start, end time.Time, i, n int) time.Time {
+	if start.IsZero() || !start.Before(end) {
+		return end
+	}
+	// The middle of the message's share of the dump.
+	return start.Add(end.Sub(start) * time.Duration(2*i+1) / time.Duration(2*n))
+}
+
+// Handle a bundle of messages of the given protocol, which is zero for TCP, dumped
+// between start and end.
 // Returns the bytes sent and received on all non-local connections.
-func (svr *Saver) handleType(t time.Time, msgs []*netlink.NetlinkMessage) (uint64, uint64) {
+func (svr *Saver) handleType(start, end time.Time, protocol inetdiag.Protocol, msgs []*netlink.NetlinkMessage) (uint64, uint64) {
 	var liveSent, liveReceived uint64
-	for _, msg := range msgs {
+	for i, msg := range msgs {
 		// In swap and queue, we want to track the total speed of all connections
 		// every second.
 		if msg == nil {
-			log.Println("Nil message")
+			loglevel.Limitedln(loglevel.Error, loglevel.Skip, "Nil message")
+			continue
+		}
+		if cached, skip := svr.paced(msg); skip {
+			s, r := cached.GetStats()
+			liveSent += s
+			liveReceived += r
+			svr.hostSketches.observe(cached)
 			continue
 		}
 		ar, err := netlink.MakeArchivalRecord(msg, true)
 		if ar == nil {
+			if errors.Is(err, netlink.ErrStrict) {
+				logFatal(err)
+				continue
+			}
 			if err != nil {
-				log.Println(err)
+				loglevel.Limitedln(loglevel.Error, loglevel.Failure, err)
+				svr.saveDiagnostic(msg, err, interpolate(start, end, i, len(msgs)), protocol)
 			}
 			continue
 		}
-		ar.Timestamp = t
+		if !svr.recorded(ar) {
+			continue
+		}
+		ar.Timestamp = interpolate(start, end, i, len(msgs))
+		ar.Protocol = protocol
+		if !svr.elephant(ar) {
+			svr.attributes.apply(ar)
+		}
 
 		// Note: If GetStats shows up in profiling, might want to move to once/second code.
 		s, r := ar.GetStats()
 		liveSent += s
 		liveReceived += r
+		svr.hostSketches.observe(ar)
 		svr.swapAndQueue(ar)
 	}
 
@@ -327,104 +1045,158 @@ func (svr *Saver) handleType(t time.Time, msgs []*netlink.NetlinkMessage) (uint6
 
 // MessageSaverLoop runs a loop to receive batches of ArchivalRecords.  Local connections
 func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
+	svr.Run(context.Background(), readerChannel)
+}
+
+// Run receives batches of messages from readerChannel, until it is closed, or the
+// context is canceled, and then closes the Saver, which ends all the connections,
+// and waits for the marshallers to write their remaining tasks and close all the
+// files, so that none is left with a truncated zstd frame.  Done is done once the
+// Saver is closed.  The sender of readerChannel should stop when the context is
+// canceled, as the collector does.
+func (svr *Saver) Run(ctx context.Context, readerChannel <-chan netlink.MessageBlock) {
+	svr.start()
+	Serve(ctx, svr, readerChannel)
+}
+
+// start prepares the Saver to process messages, once.  It must be called from the
+// goroutine that queues the messages.
+func (svr *Saver) start() {
+	if svr.started {
+		return
+	}
+	svr.started = true
 	log.Println("Starting Saver")
+	svr.lastReport = time.Time{}.Unix()
+	svr.cache.GraceCycles = svr.ExpiryGraceCycles
+	svr.lastReconcile = time.Now()
+	if svr.CheckpointFile != "" {
+		cp, err := loadCheckpoint(svr.CheckpointFile)
+		if err != nil {
+			log.Println("Could not load checkpoint:", err)
+			metrics.ErrorCount.WithLabelValues("checkpoint load").Inc()
+		}
+		svr.checkpoint = cp
+		svr.lastCheckpoint = time.Now()
+	}
+}
 
-	var reported, closed TcpStats
-	lastReportTime := time.Time{}.Unix()
-	closeLogCount := 10000
-
-	for msgs := range readerChannel {
-
-		// Handle v4 and v6 messages, and return the total bytes sent and received.
-		// TODO - we only need to collect these stats if this is a reporting cycle.
-		// NOTE: Prior to April 2020, we were not using UTC here.  The servers
-		// are configured to use UTC time, so this should not make any difference.
-		s4, r4 := svr.handleType(msgs.V4Time.UTC(), msgs.V4Messages)
-		s6, r6 := svr.handleType(msgs.V6Time.UTC(), msgs.V6Messages)
-
-		// Note that the connections that have closed may have had traffic that
-		// we never see, and therefore can't account for in metrics.
-		residual := svr.cache.EndCycle()
-
-		// Remove all missing connections from the cache.
-		// Also keep a metric of the total cumulative send and receive bytes.
-		for cookie := range residual {
-			ar := residual[cookie]
-			var stats TcpStats
-			var ok bool
-			if !ar.HasDiagInfo() {
-				stats, ok = svr.ClosingStats[cookie]
-				if ok {
-					// Remove the stats from closing.
-					svr.ClosingTotals.Sent -= stats.Sent
-					svr.ClosingTotals.Received -= stats.Received
-					delete(svr.ClosingStats, cookie)
-				} else {
-					log.Println("Missing stats for", cookie)
-				}
+// QueueMessages processes the messages of one polling cycle, and queues the
+// records of the connections that changed to the marshallers.  It must not be
+// called concurrently, or after Close.
+func (svr *Saver) QueueMessages(msgs netlink.MessageBlock) {
+	svr.start()
+	// Handle v4 and v6 messages, and return the total bytes sent and received.
+	// TODO - we only need to collect these stats if this is a reporting cycle.
+	// NOTE: Prior to April 2020, we were not using UTC here.  The servers
+	// are configured to use UTC time, so this should not make any difference.
+	s4, r4 := svr.handleType(msgs.V4Start.UTC(), msgs.V4Time.UTC(), 0, msgs.V4Messages)
+	s6, r6 := svr.handleType(msgs.V6Start.UTC(), msgs.V6Time.UTC(), 0, msgs.V6Messages)
+	// Other protocols, e.g. UDP, have no TCPInfo, so no bytes sent and received.
+	for _, other := range msgs.Other {
+		svr.handleType(other.Start.UTC(), other.Time.UTC(), other.Protocol, other.Messages)
+	}
+	svr.endHostCycle(msgs.V4Time.UTC())
+	svr.writeHostCounters(msgs.Host)
+
+	// Note that the connections that have closed may have had traffic that
+	// we never see, and therefore can't account for in metrics.
+	residual := svr.cache.EndCycle()
+
+	// Remove all missing connections from the cache.
+	// Also keep a metric of the total cumulative send and receive bytes.
+	for cookie := range residual {
+		ar := residual[cookie]
+		var stats TcpStats
+		var ok bool
+		// Other protocols have no TCPInfo, so GetStats returns zeros.
+		if ar.IsTCP() && !ar.HasDiagInfo() {
+			stats, ok = svr.ClosingStats[cookie]
+			if ok {
+				// Remove the stats from closing.
+				svr.ClosingTotals.Sent -= stats.Sent
+				svr.ClosingTotals.Received -= stats.Received
+				delete(svr.ClosingStats, cookie)
 			} else {
-				stats.Sent, stats.Received = ar.GetStats()
-			}
-			closed.Sent += stats.Sent
-			closed.Received += stats.Received
-
-			if closeLogCount > 0 {
-				idm, err := ar.RawIDM.Parse()
-				if err != nil {
-					log.Println("Closed:", ar.Timestamp.Format("15:04:05.000"), cookie, "idm parse error", stats)
-				} else {
-					log.Println("Closed:", ar.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), stats)
-				}
-				closeLogCount--
+				loglevel.Limitedln(loglevel.Error, loglevel.Skip, "Missing stats for", cookie)
 			}
+		} else {
+			stats.Sent, stats.Received = ar.GetStats()
+		}
+		svr.closed.Sent += stats.Sent
+		svr.closed.Received += stats.Received
 
-			svr.endConn(cookie)
-			svr.stats.IncExpiredCount()
-		}
-
-		// Every second, update the total throughput for the past second.
-		if msgs.V4Time.Unix() > lastReportTime {
-			// This is the total bytes since program start.
-			totalSent := closed.Sent + svr.ClosingTotals.Sent + s4 + s6
-			totalReceived := closed.Received + svr.ClosingTotals.Received + r4 + r6
-
-			// NOTE: We are seeing occasions when total < reported.  This messes up prometheus, so
-			// we detect that and skip reporting.
-			// This seems to be persistent, not just a momentary glitch.  The total may drop by 500KB,
-			// and only recover after many seconds of gradual increases (on idle workstation).
-			// This workaround seems to also cure the 2<<67 reports.
-			// We also check for increments larger than 10x the maxSwitchSpeed.
-			// TODO: This can all be discarded when we are confident the bug has been fixed.
-			if totalSent > 10*maxSwitchSpeed/8+reported.Sent || totalSent < reported.Sent {
-				// Some bug in the accounting!!
-				log.Println("Skipping BytesSent report due to bad accounting", totalSent, reported.Sent, closed.Sent, svr.ClosingTotals.Sent, s4, s6)
-				if totalSent < reported.Sent {
-					metrics.ErrorCount.WithLabelValues("totalSent < reportedSent").Inc()
-				} else {
-					metrics.ErrorCount.WithLabelValues("totalSent-reportedSent exceeds network capacity").Inc()
-				}
+		idm, err := ar.RawIDM.Parse()
+		if err != nil {
+			loglevel.Limitedln(loglevel.Info, loglevel.Connection, "Closed:", ar.Timestamp.Format("15:04:05.000"), cookie, "idm parse error", stats)
+		} else {
+			loglevel.Limitedln(loglevel.Info, loglevel.Connection, "Closed:", ar.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), stats)
+		}
+
+		svr.summarize(cookie, ar, stats)
+		svr.flushFinal(cookie, ar)
+		svr.endConn(cookie)
+		delete(svr.excluded, cookie)
+		delete(svr.generations, cookie)
+		delete(svr.unchanged, cookie)
+		svr.stats.IncExpiredCount()
+	}
+
+	// Every second, update the total throughput for the past second.
+	if msgs.V4Time.Unix() > svr.lastReport {
+		// This is the total bytes since program start.
+		totalSent := svr.closed.Sent + svr.ClosingTotals.Sent + s4 + s6
+		totalReceived := svr.closed.Received + svr.ClosingTotals.Received + r4 + r6
+
+		// NOTE: We are seeing occasions when total < reported.  This messes up prometheus, so
+		// we detect that and skip reporting.
+		// This seems to be persistent, not just a momentary glitch.  The total may drop by 500KB,
+		// and only recover after many seconds of gradual increases (on idle workstation).
+		// This workaround seems to also cure the 2<<67 reports.
+		// We also check for increments larger than 10x the maxSwitchSpeed.
+		// TODO: This can all be discarded when we are confident the bug has been fixed.
+		if totalSent > 10*maxSwitchSpeed/8+svr.reported.Sent || totalSent < svr.reported.Sent {
+			// Some bug in the accounting!!
+			log.Println("Skipping BytesSent report due to bad accounting", totalSent, svr.reported.Sent, svr.closed.Sent, svr.ClosingTotals.Sent, s4, s6)
+			if totalSent < svr.reported.Sent {
+				metrics.ErrorCount.WithLabelValues("totalSent < reportedSent").Inc()
 			} else {
-				metrics.SendRateHistogram.Observe(8 * float64(totalSent-reported.Sent))
-				reported.Sent = totalSent // the total bytes reported to prometheus.
+				metrics.ErrorCount.WithLabelValues("totalSent-reportedSent exceeds network capacity").Inc()
 			}
+		} else {
+			metrics.SendRateHistogram.Observe(8 * float64(totalSent-svr.reported.Sent))
+			svr.reported.Sent = totalSent // the total bytes reported to prometheus.
+		}
 
-			if totalReceived > 10*maxSwitchSpeed/8+reported.Received || totalReceived < reported.Received {
-				// Some bug in the accounting!!
-				log.Println("Skipping BytesReceived report due to bad accounting", totalReceived, reported.Received, closed.Received, svr.ClosingTotals.Received, r4, r6)
-				if totalReceived < reported.Received {
-					metrics.ErrorCount.WithLabelValues("totalReceived < reportedReceived").Inc()
-				} else {
-					metrics.ErrorCount.WithLabelValues("totalReceived-reportedReceived exceeds network capacity").Inc()
-				}
+		if totalReceived > 10*maxSwitchSpeed/8+svr.reported.Received || totalReceived < svr.reported.Received {
+			// Some bug in the accounting!!
+			log.Println("Skipping BytesReceived report due to bad accounting", totalReceived, svr.reported.Received, svr.closed.Received, svr.ClosingTotals.Received, r4, r6)
+			if totalReceived < svr.reported.Received {
+				metrics.ErrorCount.WithLabelValues("totalReceived < reportedReceived").Inc()
 			} else {
-				metrics.ReceiveRateHistogram.Observe(8 * float64(totalReceived-reported.Received))
-				reported.Received = totalReceived // the total bytes reported to prometheus.
+				metrics.ErrorCount.WithLabelValues("totalReceived-reportedReceived exceeds network capacity").Inc()
 			}
-
-			lastReportTime = msgs.V4Time.Unix()
+		} else {
+			metrics.ReceiveRateHistogram.Observe(8 * float64(totalReceived-svr.reported.Received))
+			svr.reported.Received = totalReceived // the total bytes reported to prometheus.
 		}
+
+		svr.lastReport = msgs.V4Time.Unix()
+	}
+
+	queued := 0
+	for i, c := range svr.MarshalChans {
+		queued += len(c)
+		metrics.MarshalQueueLength.WithLabelValues(strconv.Itoa(i)).Set(float64(len(c)))
+	}
+	metrics.SaverQueuedTasks.Set(float64(queued))
+
+	if time.Since(svr.lastCheckpoint) > time.Minute {
+		svr.saveCheckpoint()
+	}
+	if svr.ReconcileInterval > 0 && time.Since(svr.lastReconcile) > svr.ReconcileInterval {
+		svr.reconcile()
 	}
-	svr.Close()
 }
 
 func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
@@ -432,24 +1204,44 @@ func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
 	old, err := svr.cache.Update(pm)
 	if err != nil {
 		// TODO metric
-		log.Println(err)
+		loglevel.Limitedln(loglevel.Error, loglevel.Failure, err)
 		return
 	}
 	if old == nil {
 		svr.stats.IncNewCount()
 		metrics.SnapshotCount.Inc()
-		err := svr.queue(pm)
+		err := svr.queue(pm, true)
 		if err != nil {
-			log.Println(err, "Connections", len(svr.Connections))
+			loglevel.Limitedln(loglevel.Error, loglevel.Failure, err, "Connections", len(svr.Connections))
 		}
 	} else {
 		pmIDM, err := pm.RawIDM.Parse()
 		if err != nil {
 			// TODO metric
-			log.Println(err)
+			loglevel.Limitedln(loglevel.Error, loglevel.Failure, err)
+			return
+		}
+		oldIDM, err := old.RawIDM.Parse()
+		if err != nil {
+			// TODO metric
+			loglevel.Limitedln(loglevel.Error, loglevel.Failure, err)
 			return
 		}
-		if !pm.HasDiagInfo() {
+		if reused(oldIDM, pmIDM) {
+			// This is a new connection, so it is recorded from scratch.
+			svr.restart(pmIDM.ID.Cookie(), old)
+			svr.stats.IncNewCount()
+			metrics.SnapshotCount.Inc()
+			err := svr.queue(pm, true)
+			if err != nil {
+				loglevel.Limitedln(loglevel.Error, loglevel.Failure, err, "Connections", len(svr.Connections))
+			}
+			return
+		}
+		if pm.IsTCP() {
+			svr.validate(pm, pmIDM, oldIDM)
+		}
+		if pm.IsTCP() && !pm.HasDiagInfo() {
 			// If the previous record has DiagInfo, store the send/receive stats.
 			// We will use them when we close the connection.
 			if old.HasDiagInfo() {
@@ -457,42 +1249,124 @@ func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
 				svr.ClosingStats[pmIDM.ID.Cookie()] = TcpStats{Sent: sOld, Received: rOld}
 				svr.ClosingTotals.Sent += sOld
 				svr.ClosingTotals.Received += rOld
-				log.Println("Closing:", pm.Timestamp.Format("15:04:05.000"), pmIDM.ID.Cookie(), tcp.State(pmIDM.IDiagState), TcpStats{sOld, rOld})
+				loglevel.Limitedln(loglevel.Info, loglevel.Connection, "Closing:", pm.Timestamp.Format("15:04:05.000"), pmIDM.ID.Cookie(), tcp.State(pmIDM.IDiagState), TcpStats{sOld, rOld})
 			}
 		}
 
 		change, err := pm.Compare(old)
 		if err != nil {
 			// TODO metric
-			log.Println(err)
+			loglevel.Limitedln(loglevel.Error, loglevel.Failure, err)
 			return
 		}
-		if change > netlink.NoMajorChange {
+		svr.paceChange(pmIDM.ID.Cookie(), change > netlink.NoMajorChange)
+		if change > netlink.NoMajorChange || svr.isElephant(pmIDM.ID.Cookie()) {
 			svr.stats.IncDiffCount()
 			metrics.SnapshotCount.Inc()
-			err := svr.queue(pm)
+			err := svr.queue(pm, change == netlink.IDiagStateChange)
 			if err != nil {
 				// TODO metric
-				log.Println(err)
+				loglevel.Limitedln(loglevel.Error, loglevel.Failure, err)
 			}
+		} else if conn, ok := svr.Connections[pmIDM.ID.Cookie()]; ok && len(svr.Sinks) > 0 {
+			// Snapshots that are not written are still RTT samples.
+			conn.rtt.observe(pm)
 		}
 	}
 }
 
+// validate marks pm with an anomaly if its state could not follow the state of
+// the previous snapshot of the same connection.
+func (svr *Saver) validate(pm *netlink.ArchivalRecord, pmIDM, oldIDM *inetdiag.InetDiagMsg) {
+	from, to := tcp.State(oldIDM.IDiagState), tcp.State(pmIDM.IDiagState)
+	if tcp.ValidTransition(from, to) {
+		return
+	}
+	transition := from.String() + "->" + to.String()
+	pm.Anomaly = "state " + transition
+	metrics.StateAnomalyCount.WithLabelValues(transition).Inc()
+	loglevel.Limitedln(loglevel.Error, loglevel.Failure, "Invalid state transition", transition, "for", pmIDM.ID.Cookie())
+}
+
+// CloseStats describes the work done by Close to shut down the Saver.
+type CloseStats struct {
+	ConnectionsClosed int           // Connections still open when Close was called.
+	TasksFlushed      int           // Tasks queued to the marshallers when they were closed.
+	Duration          time.Duration // Time from the start of Close until all files were closed.
+}
+
 // Close shuts down all the marshallers, and waits for all files to be closed.
+// The statistics of the shutdown are logged, exported as metrics, and available
+// from CloseStats once Done.
 func (svr *Saver) Close() {
+	start := time.Now()
 	log.Println("Terminating Saver")
 	log.Println("Total of", len(svr.Connections), "connections active.")
-	for i := range svr.Connections {
-		svr.endConn(i)
+	stats := CloseStats{ConnectionsClosed: len(svr.Connections)}
+	for cookie := range svr.Connections {
+		// The last snapshot seen of each open connection is its final snapshot.
+		svr.flushFinal(cookie, svr.cache.Touch(cookie))
+		svr.endConn(cookie)
 	}
+	svr.saveCheckpoint()
+	svr.shortFlows.close()
+	svr.index.close()
+	svr.writeHostSketches()
+	svr.hostSketchFile.close()
+	svr.counterFile.close()
 	log.Println("Closing Marshallers")
 	for i := range svr.MarshalChans {
+		stats.TasksFlushed += len(svr.MarshalChans[i])
 		close(svr.MarshalChans[i])
 	}
+	svr.marshallers.Wait()
+	if c, ok := svr.WriterFactory.(io.Closer); ok {
+		err := c.Close()
+		if err != nil {
+			log.Println("Could not close writer factory:", err)
+		}
+	}
+	for _, s := range svr.Sinks {
+		err := s.Close()
+		if err != nil {
+			log.Println("Could not close sink:", err)
+		}
+	}
+	stats.Duration = time.Since(start)
+	log.Printf("Saver closed %d connections, and flushed %d tasks, in %v\n",
+		stats.ConnectionsClosed, stats.TasksFlushed, stats.Duration)
+	metrics.ShutdownConnectionsClosed.Set(float64(stats.ConnectionsClosed))
+	metrics.ShutdownTasksFlushed.Set(float64(stats.TasksFlushed))
+	metrics.ShutdownDuration.Set(stats.Duration.Seconds())
+	svr.closeStats = stats
 	svr.Done.Done()
 }
 
+// Stats returns the counts of the snapshots processed so far.
+func (svr *Saver) Stats() Stats {
+	return Stats(svr.stats.Copy())
+}
+
+// CloseStats returns the statistics of the shutdown.  It must not be called
+// until Done.
+func (svr *Saver) CloseStats() CloseStats {
+	return svr.closeStats
+}
+
+// Sizes are the numbers of connections held in the state of a Saver, which should
+// follow the number of live connections.
+type Sizes struct {
+	Connections int // Connections being recorded.
+	Cached      int // Connections in the cache, whether recorded or not.
+	Excluded    int // Connections excluded by sampling or owner.
+}
+
+// Sizes returns the sizes of the state of the Saver.  It must be called from the
+// goroutine that queues the messages, e.g. by a MessageSaver that wraps the Saver.
+func (svr *Saver) Sizes() Sizes {
+	return Sizes{Connections: len(svr.Connections), Cached: svr.cache.Len(), Excluded: len(svr.excluded)}
+}
+
 // LogCacheStats prints out some basic cache stats.
 // TODO(https://github.com/m-lab/tcp-info/issues/32) - should also export all of these as Prometheus metrics.
 func (svr *Saver) LogCacheStats(localCount, errCount int) {
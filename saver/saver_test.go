@@ -1,16 +1,24 @@
 package saver_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,15 +26,25 @@ import (
 
 	"github.com/m-lab/tcp-info/eventsocket"
 
+	"github.com/go-test/deep"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/anonymizer"
+	"github.com/m-lab/tcp-info/bootinfo"
+	"github.com/m-lab/tcp-info/framed"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/snmp"
+	"github.com/m-lab/tcp-info/tcp"
 	"github.com/m-lab/tcp-info/zstd"
+	"github.com/m-lab/uuid"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 // TODO Tests:
@@ -145,6 +163,25 @@ func (msg *TestMsg) setBytesReceived(value uint64) *TestMsg {
 	return msg
 }
 
+// rtattr returns a netlink attribute, padded to 4 bytes.
+func rtattr(typ uint16, value []byte) []byte {
+	b := make([]byte, 4, 4+len(value)+3)
+	binary.LittleEndian.PutUint16(b, uint16(4+len(value)))
+	binary.LittleEndian.PutUint16(b[2:], typ)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// addAttr appends an attribute to the message.
+func (msg *TestMsg) addAttr(typ uint16, value []byte) *TestMsg {
+	msg.Data = append(msg.Data, rtattr(typ, value)...)
+	msg.Header.Len = uint32(16 + len(msg.Data))
+	return msg
+}
+
 func verifySizeBetween(t *testing.T, minSize, maxSize int64, pattern string) {
 	names, err := filepath.Glob(pattern)
 	rtx.Must(err, "Could not Glob pattern %s", pattern)
@@ -206,6 +243,17 @@ func (*countingEventSocket) Serve(context.Context) error
 func (c *countingEventSocket) FlowCreated(t time.Time, uuid string, id inetdiag.SockID) { c.opens++ }
 func (c *countingEventSocket) FlowDeleted(t time.Time, uuid string)                     { c.closes++ }
 
+// finalEventSocket is an eventsocket.FinalServer, which records the final counters.
+type finalEventSocket struct {
+	countingEventSocket
+	finals []*eventsocket.Counters
+}
+
+func (c *finalEventSocket) FlowDeletedWithCounters(t time.Time, uuid string, final *eventsocket.Counters) {
+	c.closes++
+	c.finals = append(c.finals, final)
+}
+
 func TestHistograms(t *testing.T) {
 	dir, err := ioutil.TempDir("", "tcp-info_saver_TestBasic")
 	rtx.Must(err, "Could not create tempdir")
@@ -214,7 +262,7 @@ func TestHistograms(t *testing.T) {
 	rtx.Must(err, "Could not get working directory")
 	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
 	defer func() {
-		os.RemoveAll(dir)
+		// os.RemoveAll(dir) KEEP
 		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
 	}()
 	eventCounts := &countingEventSocket{}
@@ -318,6 +366,18 @@ func TestHistograms(t *testing.T) {
 	metrics.SnapshotCount.Collect(c)
 	checkCounter(t, c, 4)
 
+	// The saver's own counts are exported too.
+	metrics.SaverSnapshotCount.WithLabelValues("new").Collect(c)
+	checkCounter(t, c, 2)
+	metrics.SaverSnapshotCount.WithLabelValues("diff").Collect(c)
+	checkCounter(t, c, 2)
+	metrics.SaverExpiredCount.Collect(c)
+	checkCounter(t, c, 2)
+	metrics.SaverBytesWritten.WithLabelValues("jsonl").Collect(c)
+	if v := counterValue(<-c); v <= 0 {
+		t.Error("Expected the bytes written to the JSONL files, got", v)
+	}
+
 	close(c)
 
 	// We have to use a range-based size verification because different versions of
@@ -328,6 +388,38 @@ func TestHistograms(t *testing.T) {
 	verifySizeBetween(t, 350, 450, "2018/02/06/*_00000000000000EB.00000.jsonl.zst")
 }
 
+func TestFinalCounters(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	events := &finalEventSocket{}
+	svr := saver.NewSaver("foo", "bar", 1, events, anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 11234, 1).setBytesReceived(1000).setBytesSent(2000)
+	m2 := msg(t, 235, 2).setBytesReceived(20000).setBytesSent(100000)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}}
+	// The first connection closes, and then the second.
+	date = date.Add(time.Second)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m2.NetlinkMessage}}
+	date = date.Add(time.Second)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	// The close events of a FinalServer have the counters of the last snapshots.
+	if events.closes != 2 {
+		t.Fatal("Expected 2 close events, got", events.closes)
+	}
+	for i, want := range []eventsocket.Counters{{BytesSent: 2000, BytesReceived: 1000}, {BytesSent: 100000, BytesReceived: 20000}} {
+		got := events.finals[i]
+		if got == nil || got.BytesSent != want.BytesSent || got.BytesReceived != want.BytesReceived {
+			t.Errorf("Close %d has final counters %+v, want %+v", i, got, want)
+		}
+	}
+}
+
 // TODO - this file contains connection data from a connection with FIN_WAIT2 and no DiagInfo.
 // Need to create fake NetlinkMessage stream, and send to saver, and test behavior.
 func TestFinWait2NotImplemented(t *testing.T) {
@@ -363,3 +455,2725 @@ func TestFinWait2NotImplemented(t *testing.T) {
 func assertSaverIsACacheLogger(s *saver.Saver) {
 	func(csl saver.CacheLogger) {}(s)
 }
+
+func TestReopenOnReturn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestReopenOnReturn")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1234, 1)
+	run := func(blocks []netlink.MessageBlock) {
+		svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+		svr.Boot, _ = bootinfo.Read()
+		svr.CheckpointFile = "checkpoint.json"
+		svr.Kernel = &netlink.Capabilities{Attributes: []string{"MemInfo", "TCPInfo"}, TCPInfoLength: 232}
+		svrChan := make(chan netlink.MessageBlock, 0)
+		go svr.MessageSaverLoop(svrChan)
+		for _, mb := range blocks {
+			svrChan <- mb
+		}
+		close(svrChan)
+		svr.Done.Wait()
+	}
+
+	// The connection is seen, expires, and then returns.
+	present := netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	missing := netlink.MessageBlock{V4Time: date, V6Time: date}
+	run([]netlink.MessageBlock{present, missing, present})
+	verifySizeBetween(t, 1, 1000, "2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	verifySizeBetween(t, 1, 1000, "*/*/*/*_00000000000004D2.00001.jsonl.zst")
+
+	// The header should identify the machine and site.
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) < 1 || records[0].Metadata == nil {
+		t.Fatal("Missing metadata in", names[0])
+	}
+	if records[0].Metadata.Machine != "foo" || records[0].Metadata.Site != "bar" {
+		t.Errorf("Wrong metadata %+v", records[0].Metadata)
+	}
+	// It should also identify the boot and clocks, as far as they are known.
+	boot, _ := bootinfo.Read()
+	if records[0].Metadata.BootID != boot.ID || !records[0].Metadata.BootTime.Equal(boot.Time) ||
+		records[0].Metadata.Clock != bootinfo.Clock || records[0].Metadata.ClockSource != boot.ClockSource {
+		t.Errorf("Wrong boot metadata %+v", records[0].Metadata)
+	}
+	// And the kernel's capabilities.
+	if k := records[0].Metadata.Kernel; k == nil || len(k.Attributes) != 2 || k.TCPInfoLength != 232 {
+		t.Errorf("Wrong kernel metadata %+v", k)
+	}
+
+	// After a restart, the connection continues from the checkpoint.
+	run([]netlink.MessageBlock{present})
+	verifySizeBetween(t, 1, 1000, "*/*/*/*_00000000000004D2.00002.jsonl.zst")
+}
+
+func TestSampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestSampling")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.SetSampling(0.5)
+	svr.Audit("sampling", "0.5", "test")
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	mb := netlink.MessageBlock{V4Time: date, V6Time: date}
+	for cookie := uint64(1); cookie <= 200; cookie++ {
+		mb.V4Messages = append(mb.V4Messages, &msg(t, cookie, 1).NetlinkMessage)
+	}
+	svrChan <- mb
+	// The second send blocks until the first block has been processed.
+	mb.V4Time = mb.V4Time.Add(time.Second)
+	svrChan <- mb
+	// Reducing the sampling should not affect connections already being recorded.
+	svr.SetSampling(0)
+	mb.V4Time = mb.V4Time.Add(time.Second)
+	svrChan <- mb
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) < 50 || len(names) > 150 {
+		t.Error("Expected about half of the connections to be recorded, got", len(names))
+	}
+
+	// The header should record the sampling, but not the audit event, which
+	// happened before the connection was created.
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	meta := records[0].Metadata
+	if meta == nil || meta.Sampling != 0.5 || len(meta.Audit) != 0 {
+		t.Errorf("Wrong metadata %+v", meta)
+	}
+}
+
+func TestAuditHeaders(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.MaxFileSize = 1
+	var m dto.Metric
+	rtx.Must(metrics.SamplingFraction.Write(&m), "Could not read gauge")
+	if m.GetGauge().GetValue() != 1 {
+		t.Error("SamplingFraction should start at 1, not", m.GetGauge().GetValue())
+	}
+	svr.Audit("sampling", "1", "before")
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	send := func(m *TestMsg) {
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	send(msg(t, 1, 1))
+	// The unchanged snapshot blocks until the connection has been created.
+	send(msg(t, 1, 1))
+	svr.Audit("sampling", "1", "during")
+	// The changed snapshot is written to a new file, as the first one is full.
+	send(msg(t, 1, 1).setBytesReceived(1000))
+	close(svrChan)
+	svr.Done.Wait()
+
+	for i, want := range []string{"", "during"} {
+		var name string
+		var f *memFile
+		for n := range mem.files {
+			if strings.HasSuffix(n, fmt.Sprintf("_0000000000000001.%05d.jsonl.zst", i)) {
+				name, f = n, mem.files[n]
+			}
+		}
+		if f == nil {
+			t.Fatal("Missing file", i)
+		}
+		records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+		rtx.Must(err, "Could not read %s", name)
+		var got string
+		for _, e := range records[0].Metadata.Audit {
+			got += e.Source
+		}
+		if got != want {
+			t.Errorf("%s: audit events from %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestReconcile")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+	// A file in place of the output directory causes the file creation to fail,
+	// which leaves a connection without a writer.
+	rtx.Must(ioutil.WriteFile("bar", nil, 0644), "Could not create file")
+
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.ReconcileInterval = time.Nanosecond
+
+	orphans := metrics.OrphanCount.WithLabelValues("connection")
+	before := counterValue(orphans)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1234, 1)
+	svr.QueueMessages(netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}})
+	svr.QueueMessages(netlink.MessageBlock{V4Time: date, V6Time: date})
+	// The connection without a writer is removed when it ends, so it is not an orphan.
+	if len(svr.Connections) != 0 {
+		t.Error("Ended connection was not removed:", len(svr.Connections))
+	}
+	if counterValue(orphans) != before {
+		t.Error("Expected no orphaned connection, got", counterValue(orphans)-before)
+	}
+
+	// A connection that is not in the cache is removed by reconcile.
+	svr.Connections[99] = &saver.Connection{}
+	svr.QueueMessages(netlink.MessageBlock{V4Time: date, V6Time: date})
+	svr.Close()
+	svr.Done.Wait()
+
+	if len(svr.Connections) != 0 {
+		t.Error("Orphaned connection was not removed:", len(svr.Connections))
+	}
+	if counterValue(orphans) != before+1 {
+		t.Error("Expected one orphaned connection, got", counterValue(orphans)-before)
+	}
+}
+
+// recordingWriter records the timestamps of the records written to it, and
+// whether it has been closed.
+type recordingWriter struct {
+	times       []time.Time
+	closed      bool
+	writesAfter int // Number of writes after Close.
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.closed {
+		w.writesAfter++
+	}
+	if len(b) > 1 {
+		var ar netlink.ArchivalRecord
+		rtx.Must(json.Unmarshal(b, &ar), "Could not unmarshal record")
+		w.times = append(w.times, ar.Timestamp)
+	}
+	return len(b), nil
+}
+
+func (w *recordingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestMarshalChanOrdering(t *testing.T) {
+	svr := saver.NewSaver("", "", 3, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	start := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	const cookies, rounds = 50, 20
+	var writers [cookies][2]*recordingWriter
+	for c := range writers {
+		writers[c] = [2]*recordingWriter{{}, {}}
+	}
+	// Interleave data tasks for many cookies, rotating each connection to a new
+	// writer halfway through.
+	for r := 0; r < rounds; r++ {
+		for c := 0; c < cookies; c++ {
+			cookie := uint64(c + 1)
+			q := svr.MarshalChanFor(cookie)
+			w := writers[c][r*2/rounds]
+			if r == rounds/2 {
+				q <- saver.Task{Message: nil, Writer: writers[c][0]}
+			}
+			ar := msg(t, cookie, 1).mustAR()
+			ar.Timestamp = start.Add(time.Duration(r) * time.Second)
+			q <- saver.Task{Message: ar, Writer: w}
+		}
+	}
+	for c := range writers {
+		svr.MarshalChanFor(uint64(c + 1)) <- saver.Task{Message: nil, Writer: writers[c][1]}
+	}
+	svr.Close()
+	svr.Done.Wait()
+
+	for c := range writers {
+		for i, w := range writers[c] {
+			if !w.closed || w.writesAfter > 0 {
+				t.Errorf("Cookie %d writer %d: closed %v with %d writes after close", c+1, i, w.closed, w.writesAfter)
+			}
+			if len(w.times) != rounds/2 {
+				t.Errorf("Cookie %d writer %d: expected %d records, got %d", c+1, i, rounds/2, len(w.times))
+				continue
+			}
+			for j := range w.times {
+				expected := start.Add(time.Duration(i*rounds/2+j) * time.Second)
+				if !w.times[j].Equal(expected) {
+					t.Errorf("Cookie %d writer %d: record %d out of order: %v", c+1, i, j, w.times[j])
+					break
+				}
+			}
+		}
+	}
+}
+
+// countingWriter counts the calls to Write.
+type countingWriter struct {
+	lock   sync.Mutex
+	writes int
+	bytes  int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.writes++
+	w.bytes += len(b)
+	return len(b), nil
+}
+
+func (w *countingWriter) Close() error { return nil }
+
+func (w *countingWriter) counts() (int, int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writes, w.bytes
+}
+
+func TestBatchWriter(t *testing.T) {
+	cw := &countingWriter{}
+	bw := saver.NewBatchWriter(cw, 100, time.Hour)
+	for i := 0; i < 10; i++ {
+		bw.Write(make([]byte, 30))
+	}
+	// Batches are written as soon as they reach 100 bytes.
+	if writes, bytes := cw.counts(); writes != 2 || bytes != 240 {
+		t.Error("Expected 2 writes of 240 bytes, got", writes, bytes)
+	}
+	bw.Close()
+	if writes, bytes := cw.counts(); writes != 3 || bytes != 300 {
+		t.Error("Expected 3 writes of 300 bytes, got", writes, bytes)
+	}
+
+	// The marshaller flushes batches that have been pending for too long.
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	cw = &countingWriter{}
+	bw = saver.NewBatchWriter(cw, 1<<20, 10*time.Millisecond)
+	ar := msg(t, 1234, 1).mustAR()
+	svr.MarshalChanFor(1234) <- saver.Task{Message: ar, Writer: bw}
+	svr.MarshalChanFor(1234) <- saver.Task{Message: ar, Writer: bw}
+	deadline := time.Now().Add(5 * time.Second)
+	for writes, _ := cw.counts(); writes == 0 && time.Now().Before(deadline); writes, _ = cw.counts() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if writes, _ := cw.counts(); writes != 1 {
+		t.Error("Expected both records in one delayed write, got", writes)
+	}
+	svr.Close()
+	svr.Done.Wait()
+}
+
+func TestInProcessCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestInProcessCompression")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.InProcessCompression = true
+	svr.CompressionFrameSize = 1000
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		m := msg(t, 1234, 1).setByte(20, byte(100+i))
+		t := date.Add(time.Duration(i) * time.Second)
+		svrChan <- netlink.MessageBlock{V4Time: t, V6Time: t, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	// One header, and one record for each change.
+	if len(records) != 11 {
+		t.Error("Expected 11 records, got", len(records))
+	}
+}
+
+func TestHandshakeOnlyConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestHandshakeOnlyConnection")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	synRecv := func(m *TestMsg) *TestMsg {
+		m.Data[1] = byte(tcp.SYN_RECV) // IDiagState
+		return m
+	}
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// Connection 1 never completes the handshake, and connection 2 does.
+	m1 := synRecv(msg(t, 1, 1))
+	m2 := synRecv(msg(t, 2, 1))
+	m2a := msg(t, 2, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}}
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m2a.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 || !strings.Contains(names[0], "_0000000000000002.00000") {
+		t.Fatal("Expected one file for connection 2, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	// The header, the handshake snapshot, and the established snapshot.
+	if len(records) != 3 {
+		t.Error("Expected 3 records, got", len(records))
+	}
+}
+
+func TestStateAnomaly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestStateAnomaly")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// The same cookie goes from TIME_WAIT back to ESTABLISHED.
+	m1 := msg(t, 1, 1)
+	m1.Data[1] = byte(tcp.TIME_WAIT) // IDiagState
+	m2 := msg(t, 1, 1)
+	m2.Data[1] = byte(tcp.ESTABLISHED)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m2.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	// The header, the TIME_WAIT snapshot, and the anomalous snapshot.
+	if len(records) != 3 {
+		t.Fatal("Expected 3 records, got", len(records))
+	}
+	if records[1].Anomaly != "" {
+		t.Error("Unexpected anomaly", records[1].Anomaly)
+	}
+	if records[2].Anomaly != "state TIME_WAIT->ESTABLISHED" {
+		t.Error("Expected anomaly, got", records[2].Anomaly)
+	}
+}
+
+func TestCookieReuse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestCookieReuse")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// The second connection has the same cookie, but a different port.
+	m1 := msg(t, 1, 1)
+	m2 := msg(t, 1, 2)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m2.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	sort.Strings(names)
+	if len(names) != 2 {
+		t.Fatal("Expected two files, got", names)
+	}
+	// The file of the second connection sorts first.
+	if !strings.HasSuffix(names[0], "_0000000000000001-1.00000.jsonl.zst") ||
+		!strings.HasSuffix(names[1], "_0000000000000001.00000.jsonl.zst") {
+		t.Fatal("Wrong file names", names)
+	}
+	for i, name := range names {
+		rdr := zstd.NewReader(name)
+		records, err := netlink.LoadAllArchivalRecords(rdr)
+		rdr.Close()
+		rtx.Must(err, "Could not read %s", name)
+		if len(records) != 2 {
+			t.Fatal("Expected 2 records, got", len(records))
+		}
+		if !strings.HasSuffix(name, records[0].Metadata.UUID+".00000.jsonl.zst") {
+			t.Error("Wrong UUID", records[0].Metadata.UUID, "for", name)
+		}
+		idm, err := records[1].RawIDM.Parse()
+		rtx.Must(err, "Could not parse")
+		// setDPort writes the low byte first.
+		if idm.ID.IDiagDPort[0] != byte(2-i) {
+			t.Error("Wrong port", idm.ID.IDiagDPort, "in", name)
+		}
+	}
+}
+
+func TestMinSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestMinSnapshots")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.MinSnapshots = 3
+	svr.ShortFlowRollup = true
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// Connection 1 has 2 snapshots, and connection 2 has 3.
+	for i := 0; i < 3; i++ {
+		mb := netlink.MessageBlock{V4Time: date, V6Time: date}
+		m2 := msg(t, 2, 1).setByte(20, byte(100+i))
+		mb.V4Messages = append(mb.V4Messages, &m2.NetlinkMessage)
+		if i < 2 {
+			m1 := msg(t, 1, 1).setByte(20, byte(100+i)).setBytesSent(1234)
+			mb.V4Messages = append(mb.V4Messages, &m1.NetlinkMessage)
+		}
+		svrChan <- mb
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 || !strings.Contains(names[0], "_0000000000000002.00000") {
+		t.Fatal("Expected one file for connection 2, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 4 {
+		t.Error("Expected header and 3 snapshots, got", len(records))
+	}
+
+	// Connection 1 should be in the rollup.
+	names, err = filepath.Glob("daily/*/*/*/short_flows_*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one rollup file, got", names)
+	}
+	rdr = zstd.NewReader(names[0])
+	b, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	var sf saver.ShortFlow
+	rtx.Must(json.Unmarshal(b, &sf), "Could not unmarshal %s", string(b))
+	if sf.ID.CookieUint64() != 1 || sf.Snapshots != 2 || sf.BytesSent != 1234 || sf.FinalState != "ESTABLISHED" {
+		t.Errorf("Wrong short flow %+v", sf)
+	}
+}
+
+func TestStratifiedSampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestStratifiedSampling")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.MinDuration = 10 * time.Second
+	svr.ShortFlowSampling = 0.5
+	svr.ShortFlowRollup = true
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	// Connections 1 to 100 last a second, and connection 1000 lasts 20 seconds.
+	const short = 100
+	start := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, d := range []time.Duration{0, time.Second, 10 * time.Second, 20 * time.Second} {
+		date := start.Add(d)
+		mb := netlink.MessageBlock{V4Time: date, V6Time: date}
+		m := msg(t, 1000, 1).setByte(20, byte(100+i))
+		mb.V4Messages = append(mb.V4Messages, &m.NetlinkMessage)
+		for c := uint64(1); i < 2 && c <= short; c++ {
+			m := msg(t, c, 1).setByte(20, byte(100+i))
+			mb.V4Messages = append(mb.V4Messages, &m.NetlinkMessage)
+		}
+		svrChan <- mb
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	files := make(map[uint64]bool)
+	for _, name := range names {
+		rdr := zstd.NewReader(name)
+		records, err := netlink.LoadAllArchivalRecords(rdr)
+		rdr.Close()
+		rtx.Must(err, "Could not read %s", name)
+		idm, err := records[len(records)-1].RawIDM.Parse()
+		rtx.Must(err, "Could not parse %s", name)
+		cookie := idm.ID.Cookie()
+		files[cookie] = true
+		want, sampling := 4, 0.0
+		if cookie != 1000 {
+			want, sampling = 2, 0.5
+		}
+		if len(records) != want+1 || records[0].Metadata.ShortFlowSampling != sampling {
+			t.Errorf("%s: expected %d snapshots and ShortFlowSampling %v, got %d and %v",
+				name, want, sampling, len(records)-1, records[0].Metadata.ShortFlowSampling)
+		}
+	}
+	if !files[1000] {
+		t.Error("The long connection was not recorded")
+	}
+	if n := len(files) - 1; n < short/4 || n > 3*short/4 {
+		t.Error("Expected about half of the short connections to be recorded, got", n)
+	}
+
+	// The other short connections are in the rollup.
+	names, err = filepath.Glob("daily/*/*/*/short_flows_*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one rollup file, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	dec := json.NewDecoder(rdr)
+	rolled := 0
+	for {
+		var sf saver.ShortFlow
+		if err := dec.Decode(&sf); err != nil {
+			break
+		}
+		rolled++
+		if files[sf.ID.CookieUint64()] {
+			t.Error("Connection", sf.ID.CookieUint64(), "is in both a file and the rollup")
+		}
+	}
+	rdr.Close()
+	if rolled+len(files) != short+1 {
+		t.Errorf("Expected %d short connections, got %d files and %d rolled up", short, len(files)-1, rolled)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestIndex")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1234, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("daily/*/*/*/index_*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one index file, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	b, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	var entry saver.IndexEntry
+	rtx.Must(json.Unmarshal(b, &entry), "Could not unmarshal %s", string(b))
+	if entry.ID.CookieUint64() != 1234 || entry.Sequence != 0 || !entry.StartTime.Equal(date) {
+		t.Errorf("Wrong index entry %+v", entry)
+	}
+	if _, err := os.Stat(entry.Path); err != nil || !strings.HasPrefix(entry.Path, "2018/02/06/"+entry.UUID) {
+		t.Error("Index path does not match the connection file:", entry.Path, err)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestOwners")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.Owners = map[uint32]string{1000: "ndt"}
+	svr.RecordOwners = map[string]bool{"ndt": true}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	withUID := func(m *TestMsg, uid uint32) *TestMsg {
+		binary.LittleEndian.PutUint32(m.Data[64:68], uid) // IDiagUID
+		return m
+	}
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := withUID(msg(t, 1, 1), 1000)
+	m2 := withUID(msg(t, 2, 1), 2000)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 || !strings.Contains(names[0], "_0000000000000001.00000") {
+		t.Fatal("Expected one file for connection 1, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	if records[0].Metadata == nil || records[0].Metadata.Owner != "ndt" {
+		t.Errorf("Wrong metadata %+v", records[0].Metadata)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestUDP")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	// The same counter changes are recorded for TCP, but not for UDP, which has no
+	// TCPInfo, so only its first snapshot, and its final one on close, are written.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for _, retransmits := range []byte{0, 1, 2} {
+		tcpMsg := msg(t, 1, 1).setByte(2, retransmits)
+		udpMsg := msg(t, 2, 1).setByte(2, retransmits)
+		svrChan <- netlink.MessageBlock{
+			V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&tcpMsg.NetlinkMessage},
+			Other: []netlink.ProtocolMessages{{Protocol: inetdiag.Protocol_IPPROTO_UDP, Time: date, Messages: []*netlink.NetlinkMessage{&udpMsg.NetlinkMessage}}},
+		}
+		date = date.Add(10 * time.Millisecond)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	for _, tt := range []struct {
+		pattern   string
+		protocol  string
+		snapshots int
+	}{
+		{"2018/02/06/*_0000000000000001.00000.jsonl.zst", "", 3},
+		{"2018/02/06/*_0000000000000002.00000.udp.jsonl.zst", "udp", 2},
+	} {
+		names, err := filepath.Glob(tt.pattern)
+		rtx.Must(err, "Could not glob")
+		if len(names) != 1 {
+			t.Fatal("Expected one file for", tt.pattern, "got", names)
+		}
+		rdr := zstd.NewReader(names[0])
+		records, err := netlink.LoadAllArchivalRecords(rdr)
+		rdr.Close()
+		rtx.Must(err, "Could not read %s", names[0])
+		if records[0].Metadata == nil || records[0].Metadata.Protocol != tt.protocol {
+			t.Errorf("Wrong metadata %+v", records[0].Metadata)
+		}
+		if len(records)-1 != tt.snapshots {
+			t.Errorf("%s has %d snapshots, want %d", names[0], len(records)-1, tt.snapshots)
+		}
+	}
+}
+
+func TestInterpolatedTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestInterpolatedTimestamps")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	// The v4 dump took 20ms, and the v6 dump has no start time.
+	start := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	end := start.Add(20 * time.Millisecond)
+	var v4 []*netlink.NetlinkMessage
+	for cookie := uint64(1); cookie <= 4; cookie++ {
+		v4 = append(v4, &msg(t, cookie, 1).NetlinkMessage)
+	}
+	v6 := msg(t, 5, 1)
+	svrChan <- netlink.MessageBlock{
+		V4Start: start, V4Time: end, V4Messages: v4,
+		V6Time: end, V6Messages: []*netlink.NetlinkMessage{&v6.NetlinkMessage},
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	want := map[string]time.Duration{
+		"0000000000000001": 2500 * time.Microsecond,
+		"0000000000000002": 7500 * time.Microsecond,
+		"0000000000000003": 12500 * time.Microsecond,
+		"0000000000000004": 17500 * time.Microsecond,
+		"0000000000000005": 20 * time.Millisecond,
+	}
+	for cookie, offset := range want {
+		names, err := filepath.Glob("2018/02/06/*_" + cookie + ".00000.jsonl.zst")
+		rtx.Must(err, "Could not glob")
+		if len(names) != 1 {
+			t.Fatal("Expected one file for", cookie, "got", names)
+		}
+		rdr := zstd.NewReader(names[0])
+		records, err := netlink.LoadAllArchivalRecords(rdr)
+		rdr.Close()
+		rtx.Must(err, "Could not read %s", names[0])
+		if got := records[1].Timestamp.Sub(start); got != offset {
+			t.Errorf("Snapshot of %s is at %v, want %v", cookie, got, offset)
+		}
+	}
+}
+
+// memFile is an in-memory file, created by memFiles.
+type memFile struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *memFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+// memFiles is a WriterFactory keeping the files in memory.
+type memFiles struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+func (m *memFiles) NewWriter(name string) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := &memFile{}
+	m.files[name] = f
+	return f, nil
+}
+
+func TestWriterFactory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestWriterFactory")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	mem := &memFiles{files: map[string]*memFile{}}
+	identity, err := saver.ParseNameTemplate(saver.IdentityNameTemplate)
+	rtx.Must(err, "Could not parse template")
+	svr := saver.NewSaver("mlab1", "lga03", 1, eventsocket.NullServer(), anonymize.New(anonymize.None), saver.WithNameTemplate(identity))
+	svr.WriterFactory = mem
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m := msg(t, 1, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var name string
+	for n, f := range mem.files {
+		if strings.HasSuffix(n, "_0000000000000001.00000.jsonl.zst") {
+			name = n
+			if !f.closed {
+				t.Error("The file was not closed")
+			}
+		}
+	}
+	if !strings.HasPrefix(name, "lga03/mlab1/2018/02/06/") {
+		t.Fatal("Expected a connection file in the date directory, got", mem.files)
+	}
+	records, err := netlink.LoadAllArchivalRecords(&mem.files[name].Buffer)
+	rtx.Must(err, "Could not read %s", name)
+	if len(records) != 2 || records[0].Metadata == nil || records[1].RawIDM == nil {
+		t.Errorf("Expected a header and a snapshot, got %d records", len(records))
+	}
+	// Nothing was written to the file system.
+	names, err := filepath.Glob("*")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 0 {
+		t.Error("Unexpected files", names)
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	if err := svr.SetOutputFormat("xml"); !errors.Is(err, saver.ErrUnknownFormat) {
+		t.Error("Expected ErrUnknownFormat, got", err)
+	}
+	rtx.Must(svr.SetOutputFormat(saver.Framed), "Could not set the output format")
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m := msg(t, 1, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var b []byte
+	for n, f := range mem.files {
+		if strings.HasSuffix(n, "_0000000000000001.00000.framed.zst") {
+			b = f.Bytes()
+		}
+	}
+	if !bytes.HasPrefix(b, framed.Magic) {
+		t.Fatal("The file does not start with the framed magic")
+	}
+	// The schema, the header and the snapshot.
+	var frames [][]byte
+	for b = b[len(framed.Magic):]; len(b) > 0; {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || uint64(len(b)-size) < n {
+			t.Fatal("Truncated frame")
+		}
+		frames = append(frames, b[size:size+int(n)])
+		b = b[size+int(n):]
+	}
+	if len(frames) != 3 || !strings.Contains(string(frames[0]), "message Row {") {
+		t.Fatalf("Expected the schema and two rows, got %q", frames)
+	}
+	// The first row has the UUID and Metadata, and the second the ID and Snapshot.
+	for i, want := range [][]protowire.Number{{1, 5}, {3, 4}} {
+		var got []protowire.Number
+		for b := frames[i+1]; len(b) > 0; {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal("Bad tag", protowire.ParseError(n))
+			}
+			m := protowire.ConsumeFieldValue(num, typ, b[n:])
+			if m < 0 {
+				t.Fatal("Bad field", protowire.ParseError(m))
+			}
+			if typ == protowire.BytesType && m > 1 {
+				got = append(got, num)
+			}
+			b = b[n+m:]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Row %d has fields %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestCSVFormat(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.DeltaInterval = 2 // Not used for CSV rows.
+	rtx.Must(svr.SetOutputFormat(saver.CSV), "Could not set the output format")
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		m := msg(t, 1, 1).setBytesReceived(uint64(1000 * i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V6Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var b []byte
+	for n, f := range mem.files {
+		if strings.HasSuffix(n, "_0000000000000001.00000.csv.zst") {
+			b = f.Bytes()
+		}
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 4 || lines[0] != "timestamp,state,rtt,cwnd,bytes_acked,bytes_received,retransmits,pacing_rate" {
+		t.Fatalf("Expected the column names and 3 rows, got %q", lines)
+	}
+	for i, line := range lines[1:] {
+		fields := strings.Split(line, ",")
+		if len(fields) != 8 {
+			t.Fatalf("Row %d has %d columns: %q", i, len(fields), line)
+		}
+		ts := time.Date(2018, 02, 06, 11, 12, 13+i, 0, time.UTC).Format(time.RFC3339Nano)
+		if fields[0] != ts || fields[1] != "ESTABLISHED" || fields[5] != fmt.Sprint(1000*i) {
+			t.Errorf("Wrong row %d: %q", i, line)
+		}
+	}
+}
+
+func TestParquetFormat(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.BatchSize = 1 << 20 // Not used for Parquet files.
+	rtx.Must(svr.SetOutputFormat(saver.Parquet), "Could not set the output format")
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		m := msg(t, 1, 1).setBytesReceived(uint64(1000 * i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V6Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var name string
+	for n := range mem.files {
+		// The file compresses its own pages, so it is not named .zst.
+		if strings.HasSuffix(n, "_0000000000000001.00000.parquet") {
+			name = n
+		}
+	}
+	f := mem.files[name]
+	if f == nil || !f.closed {
+		t.Fatal("Expected a closed Parquet file, got", mem.files)
+	}
+	b := f.Bytes()
+	if !bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+		t.Fatal("Not a Parquet file")
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if n <= 0 || n > len(b)-12 {
+		t.Fatal("Wrong footer length", n)
+	}
+	// The footer is not compressed, so it includes the header, and the schema.
+	footer := string(b[len(b)-8-n:])
+	for _, s := range []string{"tcp-info.metadata", strings.Split(filepath.Base(name), ".")[0], "InetDiagMsg", "TCPInfo", "BytesReceived"} {
+		if !strings.Contains(footer, s) {
+			t.Errorf("The footer does not contain %q", s)
+		}
+	}
+}
+
+func TestCloseStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestCloseStats")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 2, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	mb := netlink.MessageBlock{V4Time: date, V6Time: date}
+	for cookie := uint64(1); cookie <= 5; cookie++ {
+		mb.V4Messages = append(mb.V4Messages, &msg(t, cookie, 1).NetlinkMessage)
+	}
+	svrChan <- mb
+	close(svrChan)
+	svr.Done.Wait()
+
+	stats := svr.CloseStats()
+	if stats.ConnectionsClosed != 5 || stats.Duration <= 0 {
+		t.Errorf("Wrong close stats %+v", stats)
+	}
+}
+
+// recordingSink records the Records published to it.
+type recordingSink struct {
+	mu      sync.Mutex
+	records []sink.Record
+	closed  bool
+}
+
+func (s *recordingSink) Publish(r sink.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestSinks")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 2, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	s := &recordingSink{}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1, 1)
+	m2 := msg(t, 2, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if !s.closed {
+		t.Error("Sink was not closed")
+	}
+	if len(s.records) != 2 {
+		t.Fatal("Expected 2 records, got", len(s.records))
+	}
+	sort.Slice(s.records, func(i, j int) bool { return s.records[i].UUID < s.records[j].UUID })
+	for i, r := range s.records {
+		if !strings.HasSuffix(r.UUID, fmt.Sprintf("_%016X", i+1)) || r.Type != sink.Snapshot {
+			t.Errorf("Wrong record %+v", r)
+		}
+		// The data is the same JSON line as is written to the file.
+		records, err := netlink.LoadAllArchivalRecords(bytes.NewReader(r.Data))
+		rtx.Must(err, "Could not parse %q", r.Data)
+		if len(records) != 1 || records[0].RawIDM == nil {
+			t.Error("Missing RawIDM in", string(r.Data))
+		}
+	}
+}
+
+func TestShortFlowSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestShortFlowSink")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.MinSnapshots = 2
+	svr.ShortFlowRollup = true
+	s := &recordingSink{}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	// The connection has too few snapshots for a file, so only its rollup is published.
+	if len(s.records) != 1 || s.records[0].Type != sink.ShortFlow {
+		t.Fatalf("Wrong records %+v", s.records)
+	}
+	var sf saver.ShortFlow
+	rtx.Must(json.Unmarshal(s.records[0].Data, &sf), "Could not parse %q", s.records[0].Data)
+	if sf.UUID != s.records[0].UUID || sf.Snapshots != 1 {
+		t.Errorf("Wrong short flow %+v", sf)
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestSummaries")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	s := &recordingSink{}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	// The connection is missing from the next block, so it has closed.
+	date = date.Add(time.Second)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var summaries []sink.Record
+	for _, r := range s.records {
+		if r.Type == sink.ConnectionSummary {
+			summaries = append(summaries, r)
+		}
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("Wrong records %+v", s.records)
+	}
+	var sum sink.Summary
+	rtx.Must(json.Unmarshal(summaries[0].Data, &sum), "Could not parse %q", summaries[0].Data)
+	if sum.UUID != summaries[0].UUID || !strings.HasSuffix(sum.UUID, "_0000000000000001") ||
+		sum.Snapshots != 1 || sum.FinalState != "ESTABLISHED" || sum.BytesSent == 0 {
+		t.Errorf("Wrong summary %+v", sum)
+	}
+}
+
+func TestAppLimited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestAppLimited")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	s := &recordingSink{}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	start := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	date := start
+	// The app limited flag, and the delivery rate, of each snapshot.
+	for _, sample := range []struct{ limited, rate byte }{{1, 10}, {1, 20}, {0, 50}, {1, 5}} {
+		m := msg(t, 1, 1).setByte(7, sample.limited).setByte(160, sample.rate).setByte(161, 0).setByte(162, 0)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var sum sink.Summary
+	for _, r := range s.records {
+		if r.Type == sink.ConnectionSummary {
+			rtx.Must(json.Unmarshal(r.Data, &sum), "Could not parse %q", r.Data)
+		}
+	}
+	// The first period ends with the sample that was not app limited, and the second
+	// with the last snapshot.
+	want := []sink.AppLimitedPeriod{
+		{Start: start, End: start.Add(2 * time.Second), MaxDeliveryRate: 20},
+		{Start: start.Add(3 * time.Second), End: start.Add(3 * time.Second), MaxDeliveryRate: 5},
+	}
+	if diff := deep.Equal(sum.AppLimited, want); diff != nil {
+		t.Error("Wrong periods", diff)
+	}
+	if sum.AppLimitedTime != 2*time.Second || sum.MaxDeliveryRate != 50 {
+		t.Errorf("Wrong summary %+v", sum)
+	}
+}
+
+func TestRTTPercentiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestRTTPercentiles")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	s := &recordingSink{}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// RTTs of 1ms to 100ms, each in two snapshots, and none before the first sample.
+	for i := 0; i <= 100; i++ {
+		rtt := i * 1000
+		for j := 0; j < 2; j++ {
+			m := msg(t, 1, 1).setByte(68, byte(rtt)).setByte(69, byte(rtt>>8)).setByte(70, byte(rtt>>16)).setByte(71, 0)
+			svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+			date = date.Add(time.Second)
+		}
+	}
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var sum sink.Summary
+	for _, r := range s.records {
+		if r.Type == sink.ConnectionSummary {
+			rtx.Must(json.Unmarshal(r.Data, &sum), "Could not parse %q", r.Data)
+		}
+	}
+	if sum.RTT == nil {
+		t.Fatal("Missing RTT percentiles")
+	}
+	// The second snapshot of each RTT has no significant change, so it is not
+	// written, but it is sampled.
+	if sum.RTT.Samples != 200 || sum.Snapshots != 101 {
+		t.Errorf("Expected 200 samples, got %d, from %d snapshots", sum.RTT.Samples, sum.Snapshots)
+	}
+	for _, p := range []struct{ got, want uint32 }{{sum.RTT.P50, 50500}, {sum.RTT.P95, 95000}, {sum.RTT.P99, 99000}} {
+		if math.Abs(float64(p.got)-float64(p.want)) > 0.02*float64(p.want) {
+			t.Errorf("Got percentile %d, want about %d", p.got, p.want)
+		}
+	}
+}
+
+func TestHostSketches(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.HostSketchInterval = 2 * time.Second
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// Two connections, with RTTs of 10ms and 30ms, and delivery rates of 1000 and
+	// 3000 bytes per second.
+	m1 := msg(t, 1, 1).setByte(68, 0x10).setByte(69, 0x27).setByte(160, 0xE8).setByte(161, 0x03).setByte(162, 0)
+	m2 := msg(t, 2, 2).setByte(68, 0x30).setByte(69, 0x75).setByte(160, 0xB8).setByte(161, 0x0B).setByte(162, 0)
+	for i := 0; i < 4; i++ {
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	c := make(chan prometheus.Metric, 1)
+	metrics.HostRTT.WithLabelValues("0.5").Collect(c)
+	var mm dto.Metric
+	(<-c).Write(&mm)
+	if v := mm.GetGauge().GetValue(); math.Abs(v-0.01) > 0.0001 {
+		t.Error("Expected a median RTT of 10ms, got", v)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var records []saver.HostSketches
+	for name, f := range mem.files {
+		if !strings.Contains(name, "/host_sketches_") {
+			continue
+		}
+		dec := json.NewDecoder(&f.Buffer)
+		for dec.More() {
+			var hs saver.HostSketches
+			rtx.Must(dec.Decode(&hs), "Could not decode %s", name)
+			records = append(records, hs)
+		}
+	}
+	// The first interval ends with the cycle 2s after it started, and the rest is
+	// written when the saver closes.
+	if len(records) != 2 || records[0].Cycles != 3 || records[1].Cycles != 1 || !records[1].End.Equal(date.Add(-time.Second)) {
+		t.Fatalf("Wrong records %+v", records)
+	}
+	rtt, rate := records[0].RTT, records[0].DeliveryRate
+	if rtt.Count() != 6 || math.Abs(rtt.Quantile(0.5)-10000) > 100 || math.Abs(rtt.Quantile(0.9)-30000) > 300 {
+		t.Error("Wrong RTTs", rtt.Count(), rtt.Quantile(0.5), rtt.Quantile(0.9))
+	}
+	if rate.Count() != 6 || rate.Quantile(1) != 3000 {
+		t.Error("Wrong delivery rates", rate.Count(), rate.Quantile(1))
+	}
+}
+
+func TestHostCounters(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("mlab1", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	s := &recordingSink{}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// The counters are recorded in the first cycle, and when they change, but not
+	// when they are unchanged, or were not collected.
+	counters := []*snmp.Counters{
+		{RetransSegs: 10, ListenDrops: 1},
+		{RetransSegs: 10, ListenDrops: 1},
+		nil,
+		{RetransSegs: 12, ListenDrops: 1},
+		{RetransSegs: 12, ListenDrops: 3},
+	}
+	for _, c := range counters {
+		if c != nil {
+			c.Timestamp = date
+		}
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, Host: c}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var records []snmp.Counters
+	for name, f := range mem.files {
+		if !strings.Contains(name, "/host_counters_") {
+			continue
+		}
+		dec := json.NewDecoder(&f.Buffer)
+		for dec.More() {
+			var c snmp.Counters
+			rtx.Must(dec.Decode(&c), "Could not decode %s", name)
+			records = append(records, c)
+		}
+	}
+	if len(records) != 3 || records[0].RetransSegs != 10 || records[1].RetransSegs != 12 || records[2].ListenDrops != 3 {
+		t.Fatalf("Wrong records %+v", records)
+	}
+	if !records[1].Timestamp.Equal(counters[3].Timestamp) {
+		t.Error("Wrong timestamp", records[1].Timestamp)
+	}
+	published := 0
+	for _, r := range s.records {
+		if r.Type == sink.HostCounters {
+			published++
+			if r.UUID != "mlab1" {
+				t.Error("Wrong UUID", r.UUID)
+			}
+		}
+	}
+	if published != 3 {
+		t.Error("Expected 3 published records, got", published)
+	}
+}
+
+func TestMPTCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestMPTCP")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	s := &recordingSink{}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	// The MPTCP socket has the token 0x01020304 in its mptcp_info, and the subflow has
+	// it as the local token in its ULP attribute.
+	const token = 0x01020304
+	msk := msg(t, 2, 1).setByte(12, 0x04).setByte(13, 0x03).setByte(14, 0x02).setByte(15, 0x01)
+	tok := make([]byte, 4)
+	binary.LittleEndian.PutUint32(tok, token)
+	ulp := append(rtattr(inetdiag.INET_ULP_INFO_NAME, []byte("mptcp\x00")),
+		rtattr(inetdiag.INET_ULP_INFO_MPTCP|0x8000, rtattr(inetdiag.MPTCP_SUBFLOW_ATTR_TOKEN_LOC, tok))...)
+	subflow := msg(t, 1, 1).addAttr(inetdiag.INET_DIAG_ULP_INFO, ulp)
+	plain := msg(t, 3, 1)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	svrChan <- netlink.MessageBlock{
+		V4Time: date, V6Time: date,
+		V4Messages: []*netlink.NetlinkMessage{&subflow.NetlinkMessage, &plain.NetlinkMessage},
+		Other:      []netlink.ProtocolMessages{{Protocol: inetdiag.Protocol_IPPROTO_MPTCP, Time: date, Messages: []*netlink.NetlinkMessage{&msk.NetlinkMessage}}},
+	}
+	date = date.Add(time.Second)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	for _, tt := range []struct {
+		pattern  string
+		protocol string
+		token    uint32
+	}{
+		{"2018/02/06/*_0000000000000001.00000.jsonl.zst", "", token},
+		{"2018/02/06/*_0000000000000002.00000.mptcp.jsonl.zst", "mptcp", token},
+		{"2018/02/06/*_0000000000000003.00000.jsonl.zst", "", 0},
+	} {
+		names, err := filepath.Glob(tt.pattern)
+		rtx.Must(err, "Could not glob")
+		if len(names) != 1 {
+			t.Fatal("Expected one file for", tt.pattern, "got", names)
+		}
+		rdr := zstd.NewReader(names[0])
+		records, err := netlink.LoadAllArchivalRecords(rdr)
+		rdr.Close()
+		rtx.Must(err, "Could not read %s", names[0])
+		if md := records[0].Metadata; md == nil || md.Protocol != tt.protocol || md.MPTCPToken != tt.token {
+			t.Errorf("Wrong metadata %+v", records[0].Metadata)
+		}
+	}
+
+	summaries := map[string]sink.Summary{}
+	for _, r := range s.records {
+		if r.Type == sink.ConnectionSummary {
+			var sum sink.Summary
+			rtx.Must(json.Unmarshal(r.Data, &sum), "Could not parse %q", r.Data)
+			summaries[sum.UUID[len(sum.UUID)-16:]] = sum
+		}
+	}
+	sf, conn, other := summaries["0000000000000001"], summaries["0000000000000002"], summaries["0000000000000003"]
+	if sf.MPTCP == nil || sf.MPTCP.Token != token || len(sf.MPTCP.Subflows) != 0 {
+		t.Errorf("Wrong subflow summary %+v", sf.MPTCP)
+	}
+	if conn.MPTCP == nil || conn.MPTCP.Token != token || len(conn.MPTCP.Subflows) != 1 || conn.MPTCP.Subflows[0] != sf.UUID {
+		t.Errorf("Wrong MPTCP summary %+v", conn.MPTCP)
+	}
+	if other.UUID == "" || other.MPTCP != nil {
+		t.Errorf("Wrong summary %+v", other)
+	}
+}
+
+func TestDerivers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestDerivers")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.Derivers = []saver.Deriver{
+		{Name: "sent", Derive: func(previous, current *snapshot.Snapshot) (float64, bool) {
+			if previous == nil {
+				return 0, false
+			}
+			return float64(current.TCPInfo.BytesSent - previous.TCPInfo.BytesSent), true
+		}},
+		{Name: "rtt", Derive: func(previous, current *snapshot.Snapshot) (float64, bool) {
+			return float64(current.TCPInfo.RTT) / 1000, true
+		}},
+		{Name: "nan", Derive: func(previous, current *snapshot.Snapshot) (float64, bool) {
+			return math.NaN(), true
+		}},
+	}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, sent := range []uint64{1000, 3000, 3500} {
+		// The retransmits change too, since a change of BytesSent alone is not recorded.
+		m := msg(t, 1, 1).setBytesSent(sent).setByte(2, byte(i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_0000000000000001.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 4 {
+		t.Fatal("Wrong number of records", len(records))
+	}
+	for i, want := range []map[string]float64{
+		{"rtt": 18.479},
+		{"rtt": 18.479, "sent": 2000},
+		{"rtt": 18.479, "sent": 500},
+	} {
+		if diff := deep.Equal(records[i+1].Derived, want); diff != nil {
+			t.Errorf("Snapshot %d has the wrong derived fields: %v", i, diff)
+		}
+	}
+}
+
+func TestReprocessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestReprocessor")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	sent := saver.Deriver{Name: "sent", Derive: func(previous, current *snapshot.Snapshot) (float64, bool) {
+		if previous == nil {
+			return 0, false
+		}
+		return float64(current.TCPInfo.BytesSent - previous.TCPInfo.BytesSent), true
+	}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	s := &recordingSink{}
+	svr.Sinks = []sink.Sink{s}
+	svr.Derivers = []saver.Deriver{sent}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, n := range []uint64{1000, 3000, 3500} {
+		m := msg(t, 1, 1).setBytesSent(n).setByte(2, byte(i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var live sink.Summary
+	for _, r := range s.records {
+		if r.Type == sink.ConnectionSummary {
+			rtx.Must(json.Unmarshal(r.Data, &live), "Could not parse %q", r.Data)
+		}
+	}
+	names, err := filepath.Glob("2018/02/06/*_0000000000000001.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+
+	// A new deriver is applied to the existing file, and the summary is the same.
+	double := saver.Deriver{Name: "double", Derive: func(previous, current *snapshot.Snapshot) (float64, bool) {
+		return 2 * float64(current.TCPInfo.BytesSent), true
+	}}
+	r := saver.NewReprocessor([]saver.Deriver{sent, double})
+	r.Add(records[0].Metadata, records[1:])
+	sc := r.Sidecar()
+	if sc.UUID != live.UUID || len(sc.Derivers) != 2 || sc.Reprocessed.IsZero() {
+		t.Errorf("Wrong sidecar %+v", sc)
+	}
+	if diff := deep.Equal(sc.Summary, live); diff != nil {
+		t.Error("The summaries differ:", diff)
+	}
+	if len(sc.Snapshots) != 3 || sc.Snapshots[0].Derived["double"] != 2000 || sc.Snapshots[2].Derived["sent"] != 500 {
+		t.Errorf("Wrong derived snapshots %+v", sc.Snapshots)
+	}
+	for i, ds := range sc.Snapshots {
+		if ds.Derived["sent"] != records[i+1].Derived["sent"] || !ds.Timestamp.Equal(records[i+1].Timestamp) {
+			t.Errorf("Snapshot %d differs: %+v, %+v", i, ds, records[i+1].Derived)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStrict")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+	var fatal []string
+	defer saver.SetLogFatal(func(v ...interface{}) { fatal = append(fatal, fmt.Sprint(v...)) })()
+	defer netlink.SetStrict(false)
+
+	run := func() {
+		svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+		svrChan := make(chan netlink.MessageBlock, 0)
+		go svr.MessageSaverLoop(svrChan)
+		date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+		m := msg(t, 0, 1)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		close(svrChan)
+		svr.Done.Wait()
+	}
+
+	// A socket without a cookie is logged and skipped.
+	run()
+	if len(fatal) != 0 {
+		t.Error("Expected no fatal errors, got", fatal)
+	}
+
+	// In strict mode, it is fatal.
+	netlink.SetStrict(true)
+	run()
+	if len(fatal) != 1 || !strings.Contains(fatal[0], "socket has no cookie") {
+		t.Error("Expected a fatal error for the cookie, got", fatal)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDiagnostics")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.DiagnosticsDir = "diagnostics"
+	svr.MaxDiagnostics = 2
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		// The last attribute claims to be longer than the message.
+		m := msg(t, uint64(i+1), 1)
+		m.Data = append(m.Data, 0xFF, 0x00, 0x01, 0x00)
+		good := msg(t, 100, 2)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&good.NetlinkMessage, &m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	// Only the newest diagnostics are kept.
+	names, err := filepath.Glob("diagnostics/*.diagnostic.json")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 2 {
+		t.Fatal("Expected 2 diagnostics, got", names)
+	}
+	b, err := ioutil.ReadFile(names[1])
+	rtx.Must(err, "Could not read %s", names[1])
+	var d saver.Diagnostic
+	rtx.Must(json.Unmarshal(b, &d), "Could not parse %s", names[1])
+	if d.Cycle != 2 || !d.Timestamp.Equal(date.Add(-time.Second)) || d.Kernel != svr.Boot.Kernel || d.BootID != svr.Boot.ID || len(d.HexDump) == 0 {
+		t.Errorf("Wrong diagnostic %+v", d)
+	}
+
+	// The message reproduces the error.
+	_, err = netlink.MakeArchivalRecord(d.Message, false)
+	if err == nil || err.Error() != d.Error {
+		t.Errorf("Expected error %q, got %v", d.Error, err)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRunContext")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svrChan := make(chan netlink.MessageBlock)
+	go svr.Run(ctx, svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		m := msg(t, 1, 1).setByte(2, byte(i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+
+	// The channel is never closed, but canceling the context closes the Saver, and
+	// all its files, while the connection is still open.
+	cancel()
+	svr.Done.Wait()
+	if stats := svr.CloseStats(); stats.ConnectionsClosed != 1 {
+		t.Errorf("Expected 1 connection closed, got %+v", stats)
+	}
+	names, err := filepath.Glob("2018/02/06/*_0000000000000001.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr, err := zstd.NewInProcessReader(names[0])
+	rtx.Must(err, "Could not open %s", names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 4 {
+		t.Errorf("Expected the header and 3 snapshots, got %d records", len(records))
+	}
+}
+
+func TestTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestTempFiles")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	for _, f := range []*saver.FileWriterFactory{{}, {InProcess: true}} {
+		name := "2018/02/06/file.00000.jsonl.zst"
+		w, err := f.NewWriter(name)
+		rtx.Must(err, "Could not create %s", name)
+		_, err = w.Write([]byte("{}\n"))
+		rtx.Must(err, "Could not write %s", name)
+		// The file has its temporary name until it is closed.
+		if _, err := os.Stat(name + saver.TempSuffix); err != nil {
+			t.Error("Missing temporary file", err)
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Error("The file should not have its final name", err)
+		}
+		rtx.Must(w.Close(), "Could not close %s", name)
+		if _, err := os.Stat(name + saver.TempSuffix); !os.IsNotExist(err) {
+			t.Error("The temporary file was not renamed", err)
+		}
+		rdr, err := zstd.NewInProcessReader(name)
+		rtx.Must(err, "Could not open %s", name)
+		b, err := ioutil.ReadAll(rdr)
+		rdr.Close()
+		rtx.Must(err, "Could not read %s", name)
+		if string(b) != "{}\n" {
+			t.Errorf("Wrong contents %q", b)
+		}
+		rtx.Must(os.Remove(name), "Could not remove %s", name)
+	}
+}
+
+// failedFile is a file whose writer reports an asynchronous failure.
+type failedFile struct {
+	*os.File
+}
+
+func (f failedFile) Err() error {
+	return errors.New("compressor failed")
+}
+
+func TestRenamingWriterFailure(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file.00000.jsonl.zst")
+	f, err := os.Create(name + saver.TempSuffix)
+	rtx.Must(err, "Could not create %s", name)
+	w := saver.NewRenamingWriter(failedFile{f}, name+saver.TempSuffix, name)
+	if err := w.Close(); err == nil {
+		t.Error("Close should have returned the failure")
+	}
+	// The file is left with its temporary name, for recovery.
+	if _, err := os.Stat(name + saver.TempSuffix); err != nil {
+		t.Error("Missing temporary file", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("The failed file should not have its final name", err)
+	}
+}
+
+func TestSockOpts(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.SockOptRules = []saver.SockOptRule{{Owners: map[string]bool{"unknown": true}}}
+	ignored := counterValue(metrics.SockOptReportCount.WithLabelValues("ignored"))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	send := func(i int) {
+		m := msg(t, 1, 1).setBytesSent(uint64(1000*i)).setByte(2, byte(i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	send(0)
+	// The unchanged snapshot is not recorded, but ensures that the connection is open.
+	send(0)
+	opts := map[string]int64{"SO_SNDBUF": 87040}
+	svr.SockOpts(&eventsocket.SockOpts{UUID: uuid.FromCookie(1), Options: opts})
+	svr.SockOpts(&eventsocket.SockOpts{UUID: uuid.FromCookie(2), Options: opts})
+	send(1)
+	send(2)
+	close(svrChan)
+	svr.Done.Wait()
+
+	var records []*netlink.ArchivalRecord
+	for n, f := range mem.files {
+		if strings.HasSuffix(n, "_0000000000000001.00000.jsonl.zst") {
+			var err error
+			records, err = netlink.LoadAllArchivalRecords(&f.Buffer)
+			rtx.Must(err, "Could not read %s", n)
+		}
+	}
+	if len(records) != 4 {
+		t.Fatal("Wrong number of records", len(records))
+	}
+	// The report is recorded once, in the first snapshot written after it.
+	for i, want := range []map[string]int64{nil, opts, nil} {
+		if diff := deep.Equal(records[i+1].SockOpts, want); diff != nil {
+			t.Errorf("Snapshot %d has the wrong socket options: %v", i, diff)
+		}
+	}
+	// The report for a connection that is not open is ignored.
+	if got := counterValue(metrics.SockOptReportCount.WithLabelValues("ignored")); got != ignored+1 {
+		t.Errorf("Expected %v ignored reports, got %v", ignored+1, got)
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	for _, bad := range []string{"{uuid}", "{seq}", "{uuid}.{seq", "{uuid}.{seq}.{port}", "../{uuid}.{seq}"} {
+		if _, err := saver.ParseNameTemplate(bad); !errors.Is(err, saver.ErrBadTemplate) {
+			t.Errorf("ParseNameTemplate(%q) = %v, want ErrBadTemplate", bad, err)
+		}
+	}
+
+	// The daily files are placed under the directories identifying the Saver.
+	meta := &netlink.Metadata{Experiment: "ndt", Site: "lga03", Machine: "mlab1"}
+	for text, want := range map[string]string{
+		saver.DefaultNameTemplate:            "",
+		saver.IdentityNameTemplate:           "ndt/lga03/mlab1/",
+		"{host}-{pod}/x/{date}/{uuid}.{seq}": "mlab1-lga03/x/",
+		"{format}/{host}/{uuid}.{seq}":       "",
+	} {
+		tmpl, err := saver.ParseNameTemplate(text)
+		rtx.Must(err, "Could not parse template")
+		if got := tmpl.SaverDir(meta); got != want {
+			t.Errorf("SaverDir of %q = %q, want %q", text, got, want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestNameTemplate")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	tmpl, err := saver.ParseNameTemplate("{format}/{experiment}/{host}-{pod}/{date}/{timestamp}_{uuid}.{seq}")
+	rtx.Must(err, "Could not parse template")
+	if tmpl.String() != "{format}/{experiment}/{host}-{pod}/{date}/{timestamp}_{uuid}.{seq}" {
+		t.Error("Wrong template text", tmpl)
+	}
+	svr := saver.NewSaver("mlab1", "lga03", 1, eventsocket.NullServer(), anonymize.New(anonymize.None),
+		saver.WithOutputDir(filepath.Join(dir, "out")), saver.WithNameTemplate(tmpl))
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m := msg(t, 1, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	// The empty experiment is omitted.
+	name := filepath.Join(dir, "out/jsonl/mlab1-lga03/2018/02/06/20180206T111213Z_"+uuid.FromCookie(1)+".00000.jsonl.zst")
+	rdr, err := zstd.NewInProcessReader(name)
+	rtx.Must(err, "Could not open %s", name)
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", name)
+	if len(records) != 2 {
+		t.Error("Expected a header and a snapshot, got", len(records))
+	}
+}
+
+func TestQueueMessages(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	// The Saver can be used through the interface, without Run.
+	var ms saver.MessageSaver = svr
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1, 1)
+	m2 := msg(t, 2, 2)
+	ms.QueueMessages(netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}})
+	m1 = msg(t, 1, 1).setByte(2, 3)
+	ms.QueueMessages(netlink.MessageBlock{V4Time: date.Add(time.Second), V6Time: date.Add(time.Second), V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}})
+	ms.Close()
+	svr.Done.Wait()
+
+	want := saver.Stats{TotalCount: 3, NewCount: 2, DiffCount: 1, ExpiredCount: 1}
+	if got := ms.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	n := 0
+	for name := range mem.files {
+		if strings.HasSuffix(name, ".00000.jsonl.zst") {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Error("Expected 2 connection files, got", mem.files)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		ageLim  time.Duration
+		maxSize int64
+		want    int // The number of files.
+	}{
+		{name: "neither", want: 1},
+		{name: "age", ageLim: time.Nanosecond, want: 3},
+		{name: "size", maxSize: 1, want: 3},
+		{name: "large size", maxSize: 1 << 20, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := &memFiles{files: map[string]*memFile{}}
+			svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+			svr.WriterFactory = mem
+			svr.FileAgeLimit = tt.ageLim
+			svr.MaxFileSize = tt.maxSize
+			svrChan := make(chan netlink.MessageBlock, 0)
+			go svr.MessageSaverLoop(svrChan)
+			date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+			for i := 0; i < 3; i++ {
+				m := msg(t, 1, 1).setByte(20, byte(100+i))
+				svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+			}
+			close(svrChan)
+			svr.Done.Wait()
+
+			var names []string
+			for n, f := range mem.files {
+				if strings.Contains(n, "_0000000000000001.") {
+					names = append(names, n)
+					if !f.closed {
+						t.Error("File was not closed", n)
+					}
+				}
+			}
+			sort.Strings(names)
+			if len(names) != tt.want {
+				t.Fatalf("Expected %d files, got %v", tt.want, names)
+			}
+			for i, n := range names {
+				if !strings.HasSuffix(n, fmt.Sprintf(".%05d.jsonl.zst", i)) {
+					t.Errorf("Expected sequence %05d, got %s", i, n)
+				}
+			}
+		})
+	}
+}
+
+func TestAttributePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		wantErr error
+		want    []int // The attribute types in the record.
+		policy  *netlink.AttributePolicy
+	}{
+		{
+			name: "none",
+			want: []int{1, 2, 4, 5, 6, 7, 8, 17},
+		},
+		{
+			name:   "deny",
+			deny:   []string{"skmeminfo", "17"},
+			want:   []int{1, 2, 4, 5, 6, 8},
+			policy: &netlink.AttributePolicy{Deny: []string{"SKMemInfo", "ClassID"}},
+		},
+		{
+			name:   "allow",
+			allow:  []string{"TCPInfo", "Congestion", "Shutdown"},
+			deny:   []string{"Shutdown"},
+			want:   []int{2, 4},
+			policy: &netlink.AttributePolicy{Allow: []string{"TCPInfo", "Congestion", "Shutdown"}, Deny: []string{"Shutdown"}},
+		},
+		{
+			name:    "unknown",
+			deny:    []string{"foobar"},
+			wantErr: saver.ErrUnknownAttribute,
+		},
+		{
+			name:    "out of range",
+			deny:    []string{"100"},
+			wantErr: saver.ErrUnknownAttribute,
+		},
+		{
+			name:    "deny TCPInfo",
+			deny:    []string{"TCPInfo"},
+			wantErr: saver.ErrRequiredAttribute,
+		},
+		{
+			name:    "allow without TCPInfo",
+			allow:   []string{"MemInfo"},
+			wantErr: saver.ErrRequiredAttribute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := &memFiles{files: map[string]*memFile{}}
+			svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+			svr.WriterFactory = mem
+			err := svr.SetAttributePolicy(tt.allow, tt.deny)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SetAttributePolicy() = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			svrChan := make(chan netlink.MessageBlock, 0)
+			go svr.MessageSaverLoop(svrChan)
+			date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+			m := msg(t, 1, 1)
+			svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+			close(svrChan)
+			svr.Done.Wait()
+
+			var records []*netlink.ArchivalRecord
+			for n, f := range mem.files {
+				if strings.HasSuffix(n, "_0000000000000001.00000.jsonl.zst") {
+					records, err = netlink.LoadAllArchivalRecords(&f.Buffer)
+					rtx.Must(err, "Could not read %s", n)
+				}
+			}
+			if len(records) != 2 {
+				t.Fatalf("Expected a header and a snapshot, got %d records", len(records))
+			}
+			if diff := deep.Equal(records[0].Metadata.AttributePolicy, tt.policy); diff != nil {
+				t.Error("Wrong policy", diff)
+			}
+			var got []int
+			for typ, a := range records[1].Attributes {
+				if a != nil {
+					got = append(got, typ)
+				}
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error("Wrong attributes", diff)
+			}
+		})
+	}
+}
+
+func TestDeltaInterval(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.DeltaInterval = 3
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		m := msg(t, 1, 1).setByte(20, byte(100+i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var b []byte
+	for n, f := range mem.files {
+		if strings.HasSuffix(n, "_0000000000000001.00000.jsonl.zst") {
+			b = f.Bytes()
+		}
+	}
+	// The header, then full, delta, delta, full, delta.
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Expected 6 records, got %d", len(lines))
+	}
+	for i, line := range lines {
+		want := i == 2 || i == 3 || i == 5
+		if strings.Contains(line, `"Delta"`) != want {
+			t.Errorf("Record %d: %s", i, line)
+		}
+	}
+	records, err := netlink.LoadAllArchivalRecords(bytes.NewReader(b))
+	rtx.Must(err, "Could not read records")
+	for i, rec := range records[1:] {
+		if got := rec.Attributes[inetdiag.INET_DIAG_INFO][20]; got != byte(100+i) {
+			t.Errorf("Snapshot %d has %d, want %d", i, got, 100+i)
+		}
+	}
+}
+
+func TestColumnBlock(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.ColumnBlock = 3
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		m := msg(t, 1, 1).setByte(20, byte(100+i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var b []byte
+	for n, f := range mem.files {
+		if strings.HasSuffix(n, "_0000000000000001.00000.jsonl.zst") {
+			b = f.Bytes()
+		}
+	}
+	// The header, a block of three snapshots, and the remaining two, written when
+	// the file is closed.
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(lines))
+	}
+	for i, line := range lines[1:] {
+		if !strings.Contains(line, `"Columns"`) {
+			t.Errorf("Record %d: %s", i+1, line)
+		}
+	}
+	records, err := netlink.LoadAllArchivalRecords(bytes.NewReader(b))
+	rtx.Must(err, "Could not read records")
+	if len(records) != 6 {
+		t.Fatalf("Expected 6 records, got %d", len(records))
+	}
+	for i, rec := range records[1:] {
+		if got := rec.Attributes[inetdiag.INET_DIAG_INFO][20]; got != byte(100+i) {
+			t.Errorf("Snapshot %d has %d, want %d", i, got, 100+i)
+		}
+	}
+}
+
+func TestIdlePacing(t *testing.T) {
+	for _, idle := range []int{0, 2} {
+		mem := &memFiles{files: map[string]*memFile{}}
+		svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+		svr.WriterFactory = mem
+		svr.IdleCycles = idle
+		svr.IdleInterval = 4
+		svrChan := make(chan netlink.MessageBlock, 0)
+		go svr.MessageSaverLoop(svrChan)
+		date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+		// The connection is idle after the first three snapshots, and the cycles
+		// in which its snapshots are processed are 3 and 7, so the change in cycle 4
+		// is only recorded in cycle 7.
+		for i := 0; i < 8; i++ {
+			m := msg(t, 1, 1)
+			if i >= 4 {
+				m.setByte(20, 100)
+			}
+			at := date.Add(time.Duration(i) * time.Second)
+			svrChan <- netlink.MessageBlock{V4Time: at, V6Time: at, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		}
+		close(svrChan)
+		svr.Done.Wait()
+
+		var files []string
+		var records []*netlink.ArchivalRecord
+		for n, f := range mem.files {
+			if !strings.Contains(n, "_0000000000000001.") {
+				continue
+			}
+			files = append(files, n)
+			var err error
+			records, err = netlink.LoadAllArchivalRecords(bytes.NewReader(f.Bytes()))
+			rtx.Must(err, "Could not read records")
+		}
+		// The connection is never closed while it is idle.  Without pacing, the
+		// final snapshot of cycle 7 is written when the saver is closed.
+		want := 3
+		if idle == 0 {
+			want = 4
+		}
+		if len(files) != 1 || len(records) != want {
+			t.Fatalf("IdleCycles %d: got files %v, and %d records", idle, files, len(records))
+		}
+		at := date.Add(4 * time.Second)
+		if idle > 0 {
+			at = date.Add(7 * time.Second)
+		}
+		if !records[2].Timestamp.Equal(at) {
+			t.Errorf("IdleCycles %d: change recorded at %v, want %v", idle, records[2].Timestamp, at)
+		}
+	}
+}
+
+func TestIdlePacingStateChange(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.IdleCycles = 2
+	svr.IdleInterval = 4
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// The connection is idle from cycle 3, and starts closing in cycle 4, which
+	// would be skipped if its state had not changed.
+	for i := 0; i < 7; i++ {
+		m := msg(t, 1, 1)
+		if i >= 4 {
+			m.Data[1] = byte(tcp.FIN_WAIT1) // IDiagState
+		}
+		at := date.Add(time.Duration(i) * time.Second)
+		svrChan <- netlink.MessageBlock{V4Time: at, V6Time: at, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var records []*netlink.ArchivalRecord
+	for n, f := range mem.files {
+		if strings.Contains(n, "_0000000000000001.") {
+			var err error
+			records, err = netlink.LoadAllArchivalRecords(bytes.NewReader(f.Bytes()))
+			rtx.Must(err, "Could not read records")
+		}
+	}
+	// The first record is the header.
+	if len(records) < 3 {
+		t.Fatal("Expected the state change to be recorded, got", len(records)-1, "snapshots")
+	}
+	idm, err := records[2].RawIDM.Parse()
+	rtx.Must(err, "Could not parse")
+	if tcp.State(idm.IDiagState) != tcp.FIN_WAIT1 || !records[2].Timestamp.Equal(date.Add(4*time.Second)) {
+		t.Errorf("State change recorded at %v in %v, want %v", records[2].Timestamp, tcp.State(idm.IDiagState), date.Add(4*time.Second))
+	}
+}
+
+func TestCIDRFilter(t *testing.T) {
+	cidrs := func(s ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, c := range s {
+			_, n, err := net.ParseCIDR(c)
+			rtx.Must(err, "Bad CIDR %s", c)
+			nets = append(nets, n)
+		}
+		return nets
+	}
+	src, dst := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name   string
+		filter saver.CIDRFilter
+		want   bool
+	}{
+		{"empty", saver.CIDRFilter{}, true},
+		{"allow either", saver.CIDRFilter{Allow: cidrs("2001:db8::/32")}, true},
+		{"allow source", saver.CIDRFilter{Direction: saver.SourceAddress, Allow: cidrs("192.0.2.0/24")}, true},
+		{"allow other source", saver.CIDRFilter{Direction: saver.SourceAddress, Allow: cidrs("2001:db8::/32")}, false},
+		{"deny either", saver.CIDRFilter{Deny: cidrs("192.0.2.0/30")}, false},
+		{"deny destination", saver.CIDRFilter{Direction: saver.DestinationAddress, Deny: cidrs("192.0.2.0/24")}, true},
+		{"allow and deny", saver.CIDRFilter{Allow: cidrs("192.0.2.0/24"), Deny: cidrs("192.0.2.0/31")}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Pass(src, dst); got != tt.want {
+			t.Errorf("%s: Pass() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Connections that do not pass are not recorded.
+	m := msg(t, 1, 1)
+	idm, err := m.mustAR().RawIDM.Parse()
+	rtx.Must(err, "Could not parse")
+	for _, filter := range []saver.CIDRFilter{
+		{Direction: saver.DestinationAddress, Allow: cidrs("192.0.2.0/24")},
+		{Direction: saver.DestinationAddress, Deny: []*net.IPNet{{IP: idm.ID.DstIP(), Mask: net.CIDRMask(64, 128)}}},
+	} {
+		mem := &memFiles{files: map[string]*memFile{}}
+		svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+		svr.WriterFactory = mem
+		svr.CIDRFilters = []saver.CIDRFilter{filter}
+		svrChan := make(chan netlink.MessageBlock, 0)
+		go svr.MessageSaverLoop(svrChan)
+		date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		close(svrChan)
+		svr.Done.Wait()
+		for n := range mem.files {
+			if strings.Contains(n, "_0000000000000001.") {
+				t.Errorf("Connection to %s recorded with filter %+v", idm.ID.DstIP(), filter)
+			}
+		}
+	}
+}
+
+// gatedSink blocks Publish until its gate is closed, stalling the marshaller.
+type gatedSink struct {
+	recordingSink
+	gate chan struct{}
+}
+
+func (s *gatedSink) Publish(r sink.Record) {
+	<-s.gate
+	s.recordingSink.Publish(r)
+}
+
+func TestPriorityShedding(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svr.PriorityRules = []saver.PriorityRule{{Priority: saver.LowPriority}}
+	s := &gatedSink{gate: make(chan struct{})}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	dropped := metrics.PriorityDropCount.WithLabelValues("low")
+	before := counterValue(dropped)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// Every snapshot changes, but the marshaller is stalled, so the saver would block
+	// once the queue is full if snapshots were not shed.
+	const cycles = 300
+	for i := 0; i < cycles; i++ {
+		m := msg(t, 1, 1)
+		if i%2 == 1 {
+			m.setByte(20, 100)
+		}
+		if i == cycles-1 {
+			m.mustAR().RawIDM[1] = uint8(tcp.FIN_WAIT1)
+		}
+		at := date.Add(time.Duration(i) * time.Second)
+		svrChan <- netlink.MessageBlock{V4Time: at, V6Time: at, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	}
+	close(s.gate)
+	close(svrChan)
+	svr.Done.Wait()
+
+	// Low priority snapshots are shed once the queue is half full.
+	if len(s.records) < 50 || len(s.records) > 53 {
+		t.Fatal("Expected about 52 records, got", len(s.records))
+	}
+	if d := counterValue(dropped) - before; int(d) != cycles-len(s.records) {
+		t.Error("Expected", cycles-len(s.records), "dropped snapshots, got", d)
+	}
+	// The state change is never shed.
+	last := s.records[len(s.records)-1]
+	records, err := netlink.LoadAllArchivalRecords(bytes.NewReader(last.Data))
+	rtx.Must(err, "Could not parse %q", last.Data)
+	idm, err := records[0].RawIDM.Parse()
+	rtx.Must(err, "Could not parse RawIDM")
+	if tcp.State(idm.IDiagState) != tcp.FIN_WAIT1 {
+		t.Error("State change was dropped, last state", tcp.State(idm.IDiagState))
+	}
+}
+
+func TestDropWhenFull(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None), saver.WithQueueDepth(10))
+	if cap(svr.MarshalChans[0]) != 10 {
+		t.Fatal("Expected a queue depth of 10, got", cap(svr.MarshalChans[0]))
+	}
+	svr.WriterFactory = mem
+	svr.DropWhenFull = true
+	s := &gatedSink{gate: make(chan struct{})}
+	svr.Sinks = []sink.Sink{s}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	before := counterValue(metrics.MarshalDropCount)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// Every snapshot changes, but the marshaller is stalled, so the saver would block
+	// once the queue is full if snapshots were not dropped.
+	const cycles = 100
+	for i := 0; i < cycles; i++ {
+		m := msg(t, 1, 1)
+		if i%2 == 1 {
+			m.setByte(20, 100)
+		}
+		if i == cycles-1 {
+			m.mustAR().RawIDM[1] = uint8(tcp.FIN_WAIT1)
+		}
+		at := date.Add(time.Duration(i) * time.Second)
+		svrChan <- netlink.MessageBlock{V4Time: at, V6Time: at, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	}
+	close(s.gate)
+	close(svrChan)
+	svr.Done.Wait()
+
+	// Snapshots are dropped once the queue is full, whatever their priority.
+	if len(s.records) < 11 || len(s.records) > 13 {
+		t.Fatal("Expected about 12 records, got", len(s.records))
+	}
+	if d := counterValue(metrics.MarshalDropCount) - before; int(d) != cycles-len(s.records) {
+		t.Error("Expected", cycles-len(s.records), "dropped snapshots, got", d)
+	}
+	// The state change waits for room in the queue.
+	last := s.records[len(s.records)-1]
+	records, err := netlink.LoadAllArchivalRecords(bytes.NewReader(last.Data))
+	rtx.Must(err, "Could not parse %q", last.Data)
+	idm, err := records[0].RawIDM.Parse()
+	rtx.Must(err, "Could not parse RawIDM")
+	if tcp.State(idm.IDiagState) != tcp.FIN_WAIT1 {
+		t.Error("State change was dropped, last state", tcp.State(idm.IDiagState))
+	}
+}
+
+func TestFinalSnapshot(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// Only LastDataSent changes, which Compare ignores, so only the first snapshot
+	// is written until the connection ends.
+	for i := 0; i < 3; i++ {
+		m := msg(t, 1, 1).setByte(44, byte(i))
+		at := date.Add(time.Duration(i) * time.Second)
+		svrChan <- netlink.MessageBlock{V4Time: at, V6Time: at, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	}
+	for i := 3; i < 5; i++ {
+		at := date.Add(time.Duration(i) * time.Second)
+		svrChan <- netlink.MessageBlock{V4Time: at, V6Time: at}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var records []*netlink.ArchivalRecord
+	for n, f := range mem.files {
+		if strings.Contains(n, "_0000000000000001.") {
+			var err error
+			records, err = netlink.LoadAllArchivalRecords(bytes.NewReader(f.Bytes()))
+			rtx.Must(err, "Could not read records")
+		}
+	}
+	// The first record is the header.
+	if len(records) != 3 {
+		t.Fatal("Expected the first and final snapshots, got", len(records)-1)
+	}
+	if !records[1].Timestamp.Equal(date) || !records[2].Timestamp.Equal(date.Add(2*time.Second)) {
+		t.Error("Wrong snapshots", records[1].Timestamp, records[2].Timestamp)
+	}
+	if records[2].Attributes[inetdiag.INET_DIAG_INFO][44] != 2 {
+		t.Error("The final snapshot is not the last one seen")
+	}
+}
+
+func TestFinalSnapshotOnClose(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// The connection is still open when the saver is closed, and its last snapshot
+	// was not written, as only LastDataSent changed.
+	for i := 0; i < 3; i++ {
+		m := msg(t, 1, 1).setByte(44, byte(i))
+		at := date.Add(time.Duration(i) * time.Second)
+		svrChan <- netlink.MessageBlock{V4Time: at, V6Time: at, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var records []*netlink.ArchivalRecord
+	for n, f := range mem.files {
+		if strings.Contains(n, "_0000000000000001.") {
+			var err error
+			records, err = netlink.LoadAllArchivalRecords(bytes.NewReader(f.Bytes()))
+			rtx.Must(err, "Could not read records")
+		}
+	}
+	// The first record is the header.
+	if len(records) != 3 {
+		t.Fatal("Expected the first and final snapshots, got", len(records)-1)
+	}
+	if !records[2].Timestamp.Equal(date.Add(2*time.Second)) || records[2].Attributes[inetdiag.INET_DIAG_INFO][44] != 2 {
+		t.Error("The final snapshot is not the last one seen", records[2].Timestamp)
+	}
+}
+
+func TestCachedConnections(t *testing.T) {
+	mem := &memFiles{files: map[string]*memFile{}}
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.WriterFactory = mem
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 2, 1).setBytesSent(1000)
+	m2 := msg(t, 1, 2).setBytesReceived(2000)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}}
+	// The second block is only received once the first has been cached.  The cache
+	// may be read while the saver runs.
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}}
+	conns := svr.CachedConnections()
+	close(svrChan)
+	svr.Done.Wait()
+
+	if len(conns) != 2 {
+		t.Fatal("Expected 2 connections, got", conns)
+	}
+	if conns[0].ID.Cookie != 1 || conns[0].BytesReceived != 2000 || conns[0].State != "ESTABLISHED" ||
+		!conns[0].LastUpdate.Equal(date) {
+		t.Error("Wrong connection", conns[0])
+	}
+	if conns[1].ID.Cookie != 2 || conns[1].BytesSent != 1000 {
+		t.Error("Wrong connection", conns[1])
+	}
+}
+
+func TestAnonymization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestAnonymization")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	anon, err := anonymizer.New(anonymizer.Config{Method: anonymizer.Truncate})
+	rtx.Must(err, "Could not create anonymizer")
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anon)
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1234, 1)
+	orig := append([]byte(nil), m1.Data...)
+	m2 := m1.copy().setBytesReceived(1000)
+	for _, m := range []*TestMsg{m1, m2, m2.copy().setBytesReceived(2000)} {
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V6Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if !bytes.Equal(m1.Data, orig) {
+		t.Error("The cached message was modified")
+	}
+	// The connection is recorded in a single file, as the anonymized addresses in
+	// the files do not affect the detection of reused cookies.
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 4 {
+		t.Fatal("Expected a header and 3 snapshots, got", len(records))
+	}
+	for _, r := range records[1:] {
+		idm, err := r.RawIDM.Parse()
+		rtx.Must(err, "Could not parse")
+		for _, ip := range []net.IP{idm.ID.SrcIP(), idm.ID.DstIP()} {
+			if !bytes.Equal(ip[6:], make([]byte, 10)) {
+				t.Error("Address not truncated to /48:", ip)
+			}
+		}
+	}
+}
+
+func TestElephantFlows(t *testing.T) {
+	tests := []struct {
+		name  string
+		bytes uint64
+		rate  float64
+	}{
+		{name: "bytes", bytes: 5000},
+		{name: "rate", rate: 3000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := &memFiles{files: map[string]*memFile{}}
+			svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+			svr.WriterFactory = mem
+			svr.ElephantBytes = tt.bytes
+			svr.ElephantRate = tt.rate
+			rtx.Must(svr.SetAttributePolicy(nil, []string{"skmeminfo"}), "Bad policy")
+			svrChan := make(chan netlink.MessageBlock, 0)
+			go svr.MessageSaverLoop(svrChan)
+
+			// The connection becomes an elephant with its fourth snapshot, after which
+			// the unchanged snapshots are also recorded.
+			date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+			for _, received := range []uint64{0, 1000, 1000, 10000, 10000, 10000} {
+				m := msg(t, 1, 1).setBytesSent(0).setBytesReceived(received)
+				svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V6Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+				date = date.Add(time.Second)
+			}
+			close(svrChan)
+			svr.Done.Wait()
+
+			var names []string
+			for n := range mem.files {
+				if strings.Contains(n, "_0000000000000001.") {
+					names = append(names, n)
+				}
+			}
+			sort.Strings(names)
+			if len(names) != 2 {
+				t.Fatal("Expected 2 files, got", names)
+			}
+			for i, want := range []struct {
+				snapshots int
+				elephant  bool
+			}{{2, false}, {3, true}} {
+				records, err := netlink.LoadAllArchivalRecords(&mem.files[names[i]].Buffer)
+				rtx.Must(err, "Could not read %s", names[i])
+				if len(records) != want.snapshots+1 {
+					t.Fatalf("%s: expected %d snapshots, got %d", names[i], want.snapshots, len(records)-1)
+				}
+				meta := records[0].Metadata
+				if meta.Elephant != want.elephant || (meta.AttributePolicy == nil) != want.elephant {
+					t.Errorf("%s: wrong header %+v", names[i], meta)
+				}
+				for _, r := range records[1:] {
+					hasMemInfo := len(r.Attributes) > inetdiag.INET_DIAG_SKMEMINFO && r.Attributes[inetdiag.INET_DIAG_SKMEMINFO] != nil
+					if hasMemInfo != want.elephant {
+						t.Errorf("%s: SKMemInfo present %v, want %v", names[i], hasMemInfo, want.elephant)
+					}
+				}
+			}
+		})
+	}
+}
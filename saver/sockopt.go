@@ -0,0 +1,108 @@
+package saver
+
+import (
+	"net"
+	"sync"
+
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// The applications of the connections selected by the SockOptRules may report the
+// socket options they read with getsockopt, e.g. SO_SNDBUF or TCP_NOTSENT_LOWAT,
+// to the eventsocket server.  The latest report for each connection is recorded
+// in the SockOpts field of the next snapshot of the connection that is written, so
+// that the application's view of the connection and the kernel's are in the same
+// record stream.  Reports for connections that are not selected, or not open, are
+// ignored.
+
+// SockOptRule selects connections whose snapshots record the socket options
+// reported by their applications.  A connection matches if its owner is in Owners,
+// when Owners is not empty, and its addresses pass the CIDRFilter.
+type SockOptRule struct {
+	Owners map[string]bool
+	CIDRFilter
+}
+
+// sockOptReports holds the latest report for each selected connection, by UUID.
+// The connections are added and removed by the MessageSaverLoop goroutine, and the
+// reports stored by the goroutines reading the eventsocket clients.
+type sockOptReports struct {
+	lock   sync.Mutex
+	latest map[string]*eventsocket.SockOpts
+}
+
+// probed returns true if the connection matches any of the SockOptRules.
+func (svr *Saver) probed(idm *inetdiag.InetDiagMsg, owner string) bool {
+	var src, dst net.IP
+	for i := range svr.SockOptRules {
+		r := &svr.SockOptRules[i]
+		if len(r.Owners) > 0 && !r.Owners[owner] {
+			continue
+		}
+		if src == nil {
+			src, dst = idm.ID.SrcIP(), idm.ID.DstIP()
+		}
+		if r.Pass(src, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// SockOpts keeps the socket options reported for a connection selected by the
+// SockOptRules, until its next snapshot is written.  It implements
+// eventsocket.SockOptHandler, and is safe to call concurrently with
+// MessageSaverLoop.
+func (svr *Saver) SockOpts(opts *eventsocket.SockOpts) {
+	r := &svr.sockOpts
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.latest[opts.UUID]; !ok {
+		metrics.SockOptReportCount.WithLabelValues("ignored").Inc()
+		return
+	}
+	r.latest[opts.UUID] = opts
+	metrics.SockOptReportCount.WithLabelValues("kept").Inc()
+}
+
+// watchSockOpts starts keeping the reports for conn.
+func (svr *Saver) watchSockOpts(conn *Connection) {
+	r := &svr.sockOpts
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.latest == nil {
+		r.latest = make(map[string]*eventsocket.SockOpts)
+	}
+	r.latest[conn.UUID()] = nil
+	conn.probed = true
+}
+
+// forgetSockOpts stops keeping the reports for conn, when it is closed.
+func (svr *Saver) forgetSockOpts(conn *Connection) {
+	if !conn.probed {
+		return
+	}
+	r := &svr.sockOpts
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.latest, conn.UUID())
+}
+
+// newSockOpts returns the options of the latest report for conn, or nil if it has
+// no report that has not been recorded.
+func (svr *Saver) newSockOpts(conn *Connection) map[string]int64 {
+	if !conn.probed {
+		return nil
+	}
+	r := &svr.sockOpts
+	r.lock.Lock()
+	opts := r.latest[conn.UUID()]
+	r.lock.Unlock()
+	if opts == nil || opts == conn.sockOpts {
+		return nil
+	}
+	conn.sockOpts = opts
+	return opts.Options
+}
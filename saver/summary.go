@@ -0,0 +1,52 @@
+package saver
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/sink"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// summarize publishes the sink.Summary of a recorded connection that has closed, to
+// the Sinks.  last is the last snapshot of the connection, and stats its final
+// byte counts.
+func (svr *Saver) summarize(cookie uint64, last *netlink.ArchivalRecord, stats TcpStats) {
+	if len(svr.Sinks) == 0 {
+		return
+	}
+	conn, ok := svr.Connections[cookie]
+	if !ok {
+		return // The connection was excluded.
+	}
+	idm, err := last.RawIDM.Parse()
+	if err != nil {
+		return
+	}
+	sum := sink.Summary{
+		UUID:          conn.UUID(),
+		ID:            svr.anonymizeID(conn.ID),
+		Owner:         svr.Owners[conn.UID],
+		StartTime:     conn.StartTime,
+		EndTime:       last.Timestamp,
+		FinalState:    tcp.State(idm.IDiagState).String(),
+		Snapshots:     conn.snapshots,
+		BytesSent:     stats.Sent,
+		BytesReceived: stats.Received,
+	}
+	// The last snapshot may not have been queued, if it had no significant change.
+	conn.appLimited.observe(last)
+	conn.appLimited.summarize(&sum)
+	conn.rtt.observe(last)
+	conn.rtt.summarize(&sum)
+	sum.MPTCP = svr.mptcpSummary(cookie, conn)
+	b, err := json.Marshal(sum)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	for _, s := range svr.Sinks {
+		s.Publish(sink.Record{UUID: sum.UUID, Type: sink.ConnectionSummary, Time: time.Now(), Data: b})
+	}
+}
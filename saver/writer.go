@@ -0,0 +1,133 @@
+package saver
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/m-lab/tcp-info/fault"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// WriterFactory creates the writers for the files written by the Saver, so that
+// they may be written somewhere other than the local file system, e.g. to cloud
+// storage, or kept in memory.  If it implements io.Closer, the Saver closes it
+// after closing all the files.
+type WriterFactory interface {
+	// NewWriter returns a writer for the named file.  The name is a slash
+	// separated path relative to the output directory, which identifies the
+	// connection UUID, the sequence number, and the date of the file, e.g.
+	// ndt/2019/04/01/<uuid>.00000.jsonl.zst.  The records written are not
+	// compressed, so the writer is responsible for compressing the files whose
+	// names end in .zst.  Files in formats that compress their own data, e.g.
+	// <uuid>.00000.parquet, are written as they are.  If the
+	// writer implements Err() error, the Saver uses it to detect asynchronous
+	// failures, and continues the connection in a new file.
+	NewWriter(name string) (io.WriteCloser, error)
+}
+
+// WriterFactoryFunc adapts a function to a WriterFactory.
+type WriterFactoryFunc func(name string) (io.WriteCloser, error)
+
+// NewWriter calls f(name).
+func (f WriterFactoryFunc) NewWriter(name string) (io.WriteCloser, error) {
+	return f(name)
+}
+
+// TempSuffix is appended to the names of the files written by a FileWriterFactory
+// until they are successfully closed, so that a file with its final name is
+// always complete.  Files left with the suffix by a crash are repaired, or
+// quarantined, by the recovery package at startup.
+const TempSuffix = ".tmp"
+
+// FileWriterFactory writes files in the local file system, under its Dir,
+// compressing those named .zst.  It is the default WriterFactory.
+type FileWriterFactory struct {
+	// Dir is the directory under which files are written.  If empty, they are
+	// written under the working directory.
+	Dir string
+	// InProcess compresses files in process, instead of with one external zstd
+	// process per file.
+	InProcess bool
+	// FrameSize bounds the uncompressed data buffered by each in-process
+	// compressor.  Zero uses zstd.DefaultFrameSize.
+	FrameSize int
+}
+
+// NewWriter creates the directory of the named file, if necessary, and returns
+// a writer for the file, which compresses it if the name ends in .zst.  The file
+// is written with the TempSuffix, and renamed when it is closed without error.
+func (f *FileWriterFactory) NewWriter(name string) (io.WriteCloser, error) {
+	if err := fault.Error(fault.FileCreate); err != nil {
+		return nil, err
+	}
+	name = filepath.Join(f.Dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(name), 0777)
+	if err != nil {
+		return nil, err
+	}
+	tmp := name + TempSuffix
+	var w io.WriteCloser
+	if !strings.HasSuffix(name, ".zst") {
+		w, err = os.Create(tmp)
+	} else if !f.InProcess {
+		w, err = zstd.NewWriter(tmp)
+	} else {
+		w, err = zstd.NewInProcessWriter(tmp, f.FrameSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fault.Writer(fault.FileWrite, &renamingWriter{WriteCloser: w, tmp: tmp, name: name}), nil
+}
+
+// renamingWriter renames its file from tmp to name once it is closed without
+// error.  A file that cannot be closed, or whose writer failed, keeps its
+// temporary name, so that it is repaired by the recovery package.
+type renamingWriter struct {
+	io.WriteCloser
+	tmp, name string
+}
+
+// Err returns the error reported by the underlying writer, if it has an Err method.
+func (w *renamingWriter) Err() error {
+	if f, ok := w.WriteCloser.(failer); ok {
+		return f.Err()
+	}
+	return nil
+}
+
+// Close closes the file, and renames it if it is complete.  The file is synced
+// before it is renamed, and its directory after, so that a crash cannot leave a
+// file with its final name that is incomplete, or lose the rename.
+func (w *renamingWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err == nil {
+		err = w.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncPath(w.tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(w.tmp, w.name); err != nil {
+		return err
+	}
+	return syncPath(filepath.Dir(w.name))
+}
+
+// syncPath flushes the file or directory at path to disk.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
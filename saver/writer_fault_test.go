@@ -0,0 +1,136 @@
+//go:build faults
+// +build faults
+
+package saver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/fault"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// runFaulty saves three changing snapshots of a connection, calling between before
+// each but the first, and returns the number of records in each of its files.
+func runFaulty(t *testing.T, svr *saver.Saver, between func()) []int {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_faults")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr.InProcessCompression = true
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			between()
+		}
+		m := msg(t, 1, 1).setBytesReceived(uint64(1000 * i))
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V6Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("*/*/*/*_0000000000000001.*.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	sort.Strings(names)
+	var counts []int
+	for _, name := range names {
+		rdr, err := zstd.NewInProcessReader(name)
+		rtx.Must(err, "Could not open %s", name)
+		records, err := netlink.LoadAllArchivalRecords(rdr)
+		rdr.Close()
+		rtx.Must(err, "Could not read %s", name)
+		counts = append(counts, len(records))
+	}
+	return counts
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFailedWrite(t *testing.T) {
+	defer fault.Reset()
+	// The header is written, and then the first snapshot fails.
+	fault.Inject(fault.FileWrite, fault.Fault{After: 1, Count: 1})
+	restarts := counterValue(metrics.CompressorRestartCount)
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	counts := runFaulty(t, svr, func() {
+		// The snapshot is written by the marshaller, so wait for it to fail.
+		for fault.Fired(fault.FileWrite) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	// The failed file keeps its header, and the connection continues in a new one.
+	if want := []int{1, 3}; !equal(counts, want) {
+		t.Errorf("Expected files with %v records, got %v", want, counts)
+	}
+	if d := counterValue(metrics.CompressorRestartCount) - restarts; d != 1 {
+		t.Error("Expected 1 compressor restart, got", d)
+	}
+}
+
+func TestFailedCreate(t *testing.T) {
+	defer fault.Reset()
+	fault.Inject(fault.FileCreate, fault.Fault{Count: 1})
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	counts := runFaulty(t, svr, func() {})
+	// The first snapshot is lost, and the file is created for the second.
+	if want := []int{3}; !equal(counts, want) {
+		t.Errorf("Expected files with %v records, got %v", want, counts)
+	}
+}
+
+func TestClockJump(t *testing.T) {
+	defer fault.Reset()
+	// The clock is first read when the file is created, and jumps past its
+	// expiration when the second snapshot is queued.
+	fault.Inject(fault.Clock, fault.Fault{Skew: 2 * time.Hour, After: 1, Count: 1})
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	svr.FileAgeLimit = time.Hour
+	counts := runFaulty(t, svr, func() {})
+	if want := []int{2, 3}; !equal(counts, want) {
+		t.Errorf("Expected files with %v records, got %v", want, counts)
+	}
+}
+
+func TestSlowCompressor(t *testing.T) {
+	defer fault.Reset()
+	fault.Inject(fault.Compress, fault.Fault{Delay: 100 * time.Millisecond})
+	svr := saver.NewSaver("", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	counts := runFaulty(t, svr, func() {})
+	if want := []int{4}; !equal(counts, want) {
+		t.Errorf("Expected files with %v records, got %v", want, counts)
+	}
+	if fault.Fired(fault.Compress) == 0 {
+		t.Error("The compressor was not slowed")
+	}
+}
@@ -0,0 +1,152 @@
+// Package savertest provides an in-memory fake of the saver, so that programs that
+// embed tcp-info can unit test their use of it without touching the filesystem.
+package savertest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/cache"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+)
+
+// Saver is a saver.MessageSaver that keeps the records of each connection in
+// memory.  Like the saver, it records the first snapshot of each connection, and
+// those that changed significantly, but it does not sample, filter, or rotate.
+// Its methods may be called concurrently.
+type Saver struct {
+	lock    sync.Mutex
+	cache   *cache.Cache
+	blocks  []netlink.MessageBlock
+	records map[uint64][]*netlink.ArchivalRecord
+	ended   map[uint64]bool
+	stats   saver.Stats
+	closed  bool
+}
+
+// NewSaver returns a new, empty Saver.
+func NewSaver() *Saver {
+	return &Saver{
+		cache:   cache.NewCache(),
+		records: make(map[uint64][]*netlink.ArchivalRecord),
+		ended:   make(map[uint64]bool),
+	}
+}
+
+// QueueMessages records the messages of one polling cycle.  Messages that cannot be
+// parsed, and those of local connections, are ignored.  It panics if the Saver is
+// closed, as the saver must not be used after Close.
+func (s *Saver) QueueMessages(msgs netlink.MessageBlock) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		panic("savertest: QueueMessages called after Close")
+	}
+	s.blocks = append(s.blocks, msgs)
+	s.add(msgs.V4Time, msgs.V4Messages)
+	s.add(msgs.V6Time, msgs.V6Messages)
+	for _, other := range msgs.Other {
+		s.add(other.Time, other.Messages)
+	}
+	for cookie := range s.cache.EndCycle() {
+		s.ended[cookie] = true
+		s.stats.ExpiredCount++
+	}
+}
+
+// add records the snapshots in msgs, received at t.
+func (s *Saver) add(t time.Time, msgs []*netlink.NetlinkMessage) {
+	for _, msg := range msgs {
+		ar, err := netlink.MakeArchivalRecord(msg, true)
+		if ar == nil || err != nil {
+			continue
+		}
+		idm, err := ar.RawIDM.Parse()
+		if err != nil {
+			continue
+		}
+		ar.Timestamp = t.UTC()
+		old, err := s.cache.Update(ar)
+		if err != nil {
+			continue
+		}
+		s.stats.TotalCount++
+		cookie := idm.ID.Cookie()
+		if old == nil {
+			s.stats.NewCount++
+			delete(s.ended, cookie)
+			s.records[cookie] = append(s.records[cookie], ar)
+			continue
+		}
+		change, err := ar.Compare(old)
+		if err == nil && change > netlink.NoMajorChange {
+			s.stats.DiffCount++
+			s.records[cookie] = append(s.records[cookie], ar)
+		}
+	}
+}
+
+// Close marks the Saver closed.  The records remain available.
+func (s *Saver) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+}
+
+// Stats returns the counts of the snapshots recorded so far.
+func (s *Saver) Stats() saver.Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// LogCacheStats does nothing, so that the Saver may also be the Logger of a
+// collector.Collector.
+func (s *Saver) LogCacheStats(localCount, errCount int) {}
+
+// Closed returns true if Close has been called.
+func (s *Saver) Closed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// Blocks returns the message blocks queued so far, in order.
+func (s *Saver) Blocks() []netlink.MessageBlock {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]netlink.MessageBlock(nil), s.blocks...)
+}
+
+// Cookies returns the cookies of all the connections recorded so far, in
+// increasing order.
+func (s *Saver) Cookies() []uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cookies := make([]uint64, 0, len(s.records))
+	for cookie := range s.records {
+		cookies = append(cookies, cookie)
+	}
+	sort.Slice(cookies, func(i, j int) bool { return cookies[i] < cookies[j] })
+	return cookies
+}
+
+// Records returns the recorded snapshots of the connection with the given cookie,
+// in order, or nil if there are none.
+func (s *Saver) Records(cookie uint64) []*netlink.ArchivalRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*netlink.ArchivalRecord(nil), s.records[cookie]...)
+}
+
+// Ended returns true if the connection with the given cookie was recorded, and
+// has since disappeared from the polls.
+func (s *Saver) Ended(cookie uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ended[cookie]
+}
+
+var _ saver.MessageSaver = &Saver{}
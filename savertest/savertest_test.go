@@ -0,0 +1,63 @@
+package savertest_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/savertest"
+)
+
+// msg returns a netlink message for an established TCP socket with the given
+// cookie, and bytes acked.
+func msg(t *testing.T, cookie uint64, acked byte) *netlink.NetlinkMessage {
+	const j = `{"Header":{"Len":356,"Type":20,"Flags":2,"Seq":1,"Pid":148940},"Data":"CgEAAOpWE6cmIAAAEAMEFbM+nWqBv4ehJgf4sEANDAoAAAAAAAAAgQAAAAAdWwAAAAAAAAAAAAAAAAAAAAAAAAAAAAC13zIBBQAIAAAAAAAFAAUAIAAAAAUABgAgAAAAFAABAAAAAAAAAAAAAAAAAAAAAAAoAAcAAAAAAICiBQAAAAAAALQAAAAAAAAAAAAAAAAAAAAAAAAAAAAArAACAAEAAAAAB3gBQIoDAECcAABEBQAAuAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAUCEAAAAAAAAgIQAAQCEAANwFAACsywIAJW8AAIRKAAD///9/CgAAAJQFAAADAAAALMkAAIBwAAAAAAAALnUOAAAAAAD///////////ayBAAAAAAASfQPAAAAAADMEQAANRMAAAAAAABiNQAAxAsAAGMIAABX5AUAAAAAAAoABABjdWJpYwAAAA=="}`
+	nm := netlink.NetlinkMessage{}
+	rtx.Must(json.Unmarshal([]byte(j), &nm), "Could not unmarshal message")
+	nm.Data = append([]byte(nil), nm.Data...)
+	binary.LittleEndian.PutUint64(nm.Data[44:52], cookie)
+	// The low byte of the TCPInfo BytesAcked, a significant change.
+	nm.Data[280] = acked
+	return &nm
+}
+
+func TestSaver(t *testing.T) {
+	s := savertest.NewSaver()
+	var ms saver.MessageSaver = s
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+
+	// Two connections, of which the second closes, and the first changes once.
+	ms.QueueMessages(netlink.MessageBlock{V4Time: date, V6Time: date, V6Messages: []*netlink.NetlinkMessage{msg(t, 1, 0), msg(t, 2, 0)}})
+	ms.QueueMessages(netlink.MessageBlock{V4Time: date.Add(time.Second), V6Time: date.Add(time.Second), V6Messages: []*netlink.NetlinkMessage{msg(t, 1, 0)}})
+	ms.QueueMessages(netlink.MessageBlock{V4Time: date.Add(2 * time.Second), V6Time: date.Add(2 * time.Second), V6Messages: []*netlink.NetlinkMessage{msg(t, 1, 7)}})
+	ms.Close()
+
+	if !s.Closed() || len(s.Blocks()) != 3 {
+		t.Error("Expected a closed saver with 3 blocks, got", s.Closed(), len(s.Blocks()))
+	}
+	if c := s.Cookies(); len(c) != 2 || c[0] != 1 || c[1] != 2 {
+		t.Error("Wrong cookies", c)
+	}
+	records := s.Records(1)
+	if len(records) != 2 || !records[1].Timestamp.Equal(date.Add(2*time.Second)) {
+		t.Errorf("Wrong records %+v", records)
+	}
+	if s.Ended(1) || !s.Ended(2) {
+		t.Error("Expected only connection 2 to have ended")
+	}
+	want := saver.Stats{TotalCount: 4, NewCount: 2, DiffCount: 1, ExpiredCount: 1}
+	if got := ms.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic after Close")
+		}
+	}()
+	ms.QueueMessages(netlink.MessageBlock{})
+}
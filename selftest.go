@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// Errors returned by selfTest.
+var (
+	ErrNoTestAddress     = errors.New("no non-loopback address available for the test connection")
+	ErrConnectionMissing = errors.New("test connection was not found in any output file")
+)
+
+// testAddress returns a non-loopback local address.  Loopback connections are
+// not recorded, so the test connection must use one of the host's other addresses.
+func testAddress() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+			continue
+		}
+		return ip, nil
+	}
+	return nil, ErrNoTestAddress
+}
+
+// findConnection searches the output files under dir for snapshots of the
+// connection with the given local port.  It returns the name of the file, and
+// the number of snapshots found.
+func findConnection(dir string, port uint16) (string, int, error) {
+	var found string
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		// Only connection files, not e.g. the daily index files.
+		if ok, _ := filepath.Match("*.[0-9][0-9][0-9][0-9][0-9].jsonl.zst", info.Name()); !ok {
+			return nil
+		}
+		rdr := zstd.NewReader(path)
+		defer rdr.Close()
+		_, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+		if err != nil {
+			return fmt.Errorf("could not parse %s: %w", path, err)
+		}
+		for _, s := range snaps {
+			if s.InetDiagMsg == nil {
+				continue
+			}
+			if s.InetDiagMsg.ID.SPort() == port || s.InetDiagMsg.ID.DPort() == port {
+				found = path
+				count++
+			}
+		}
+		return nil
+	})
+	return found, count, err
+}
+
+// selfTest opens a local TCP connection, runs the collector and saver while it
+// is open, and verifies that the connection was recorded in an output file that
+// can be read back.  It writes into a temporary directory, which is removed.
+func selfTest(ctx context.Context) error {
+	ip, err := testAddress()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			io.Copy(conn, conn) // Echo until closed.
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("tcp-info selftest"))
+	if err != nil {
+		return err
+	}
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	log.Println("Test connection", conn.LocalAddr(), "->", conn.RemoteAddr())
+
+	dir, err := ioutil.TempDir("", "tcp-info-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// The saver writes relative to the working directory.
+	if oldDir, err := os.Getwd(); err == nil {
+		defer os.Chdir(oldDir)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		return err
+	}
+
+	svrChan := make(chan netlink.MessageBlock, 2)
+	svr := saver.NewSaver("selftest", "", 1, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	go svr.MessageSaverLoop(svrChan)
+	c := &collector.Collector{Output: svrChan, Reps: 10, Logger: svr}
+	c.Run(ctx)
+	// Close the connection, and poll a few more times to observe the close.
+	conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	c.Run(ctx)
+	close(svrChan)
+	svr.Done.Wait()
+
+	filename, count, err := findConnection(dir, port)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrConnectionMissing
+	}
+	log.Println("Found", count, "snapshots of the test connection in", filepath.Base(filename))
+	return nil
+}
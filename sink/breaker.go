@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// Circuit breaker parameters, shared by all sinks.
+var (
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+// breaker is a circuit breaker for the destination of a sink.  After
+// breakerThreshold consecutive failures it opens, and records are dropped without
+// being sent, so that an outage does not hold up the sink's queue.  After
+// breakerCooldown, a single send is allowed.  If it succeeds the breaker closes,
+// and otherwise it stays open for another cooldown.
+//
+// A breaker is safe for concurrent use, e.g. by the uploaders of a GCS.
+type breaker struct {
+	name     string
+	mu       sync.Mutex
+	failures int       // Consecutive failures.
+	opened   time.Time // When the breaker last opened, or zero if it is closed.
+}
+
+func newBreaker(name string) *breaker {
+	metrics.SinkBreakerOpen.WithLabelValues(name).Set(0)
+	return &breaker{name: name}
+}
+
+// allow returns whether a send should be attempted.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.opened.IsZero() {
+		return true
+	}
+	return time.Since(b.opened) >= breakerCooldown
+}
+
+// record records the result of a send.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if !b.opened.IsZero() {
+			metrics.SinkBreakerOpen.WithLabelValues(b.name).Set(0)
+		}
+		b.failures = 0
+		b.opened = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.opened = time.Now()
+		metrics.SinkBreakerOpen.WithLabelValues(b.name).Set(1)
+	}
+}
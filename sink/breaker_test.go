@@ -0,0 +1,93 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	defer func(min time.Duration, threshold int, cooldown time.Duration) {
+		minBackoff, breakerThreshold, breakerCooldown = min, threshold, cooldown
+	}(minBackoff, breakerThreshold, breakerCooldown)
+	minBackoff = time.Millisecond
+	breakerThreshold = 3
+	breakerCooldown = 50 * time.Millisecond
+
+	b := newBreaker("test")
+	attempts := 0
+	fail := func(ctx context.Context) error {
+		attempts++
+		return errors.New("unavailable")
+	}
+	// The send is retried until the breaker opens.
+	if err := retry(context.Background(), b, fail); err != errRejected || attempts != 3 {
+		t.Fatal("Expected errRejected after 3 attempts, got", err, attempts)
+	}
+	// While the breaker is open, nothing is sent.
+	if err := retry(context.Background(), b, fail); err != errRejected || attempts != 3 {
+		t.Fatal("Expected errRejected without an attempt, got", err, attempts)
+	}
+	// After the cooldown, a single failed attempt reopens it.
+	time.Sleep(breakerCooldown)
+	if err := retry(context.Background(), b, fail); err != errRejected || attempts != 4 {
+		t.Fatal("Expected errRejected after 1 attempt, got", err, attempts)
+	}
+	// A successful attempt closes it.
+	time.Sleep(breakerCooldown)
+	err := retry(context.Background(), b, func(ctx context.Context) error { return nil })
+	if err != nil || !b.allow() || b.failures != 0 {
+		t.Error("Breaker should be closed, got", err, b.failures)
+	}
+	if result(nil) != "published" || result(errRejected) != "rejected" || result(context.Canceled) != "dropped" {
+		t.Error("Wrong results")
+	}
+}
+
+func TestQueue(t *testing.T) {
+	defer func(threshold int) { breakerThreshold = threshold }(breakerThreshold)
+	breakerThreshold = 2
+
+	block := make(chan struct{})
+	var written, failed int64
+	q := newQueue("test", 2, func(r Record) error {
+		if string(r.Data) == "fail" {
+			atomic.AddInt64(&failed, 1)
+			return errors.New("unavailable")
+		}
+		<-block
+		atomic.AddInt64(&written, 1)
+		return nil
+	})
+	// A blocked destination does not block publish.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		q.publish(Record{Data: []byte("ok")})
+	}
+	if time.Since(start) > time.Second {
+		t.Error("publish blocked")
+	}
+	close(block)
+	for atomic.LoadInt64(&written) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The records that did not fit in the buffer were dropped.
+	if d := q.dropped.load(); d < 7 || d > 8 {
+		t.Error("Expected 7 or 8 dropped records, got", d)
+	}
+
+	// After breakerThreshold failures, records are rejected without being written.
+	for i := 0; i < 2; i++ {
+		q.publish(Record{Data: []byte("fail")})
+		for atomic.LoadInt64(&failed) <= int64(i) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	q.publish(Record{Data: []byte("fail")})
+	q.close()
+	if failed != 2 {
+		t.Error("Expected 2 failed writes, got", failed)
+	}
+}
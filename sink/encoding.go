@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Encodings of the Record data published by the network sinks.  They are
+// independent of the zstd compression of the connection files, and favor speed
+// over size.
+const (
+	Identity = "identity" // Not compressed.  It is the default.
+	Snappy   = "snappy"   // The Snappy block format.
+	LZ4      = "lz4"      // The LZ4 frame format.
+)
+
+// ErrUnknownEncoding is returned for an encoding other than Identity, Snappy or LZ4.
+var ErrUnknownEncoding = errors.New("unknown sink encoding")
+
+// encoder compresses the data of a Record.  The data is not modified.
+type encoder func(b []byte) ([]byte, error)
+
+// newEncoder returns the encoder for the encoding.
+func newEncoder(encoding string) (encoder, error) {
+	switch encoding {
+	case "", Identity:
+		return func(b []byte) ([]byte, error) { return b, nil }, nil
+	case Snappy:
+		return func(b []byte) ([]byte, error) { return s2.EncodeSnappy(nil, b), nil }, nil
+	case LZ4:
+		return func(b []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w := lz4.NewWriter(&buf)
+			if _, err := w.Write(b); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownEncoding, encoding)
+}
+
+// Decode returns the data of a Record published with the encoding, which is given
+// by the Content-Encoding header of NATS messages, and the encoding attribute of
+// Pub/Sub messages.  An empty encoding is Identity.
+func Decode(encoding string, b []byte) ([]byte, error) {
+	switch encoding {
+	case "", Identity:
+		return b, nil
+	case Snappy:
+		return s2.Decode(nil, b)
+	case LZ4:
+		return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(b)))
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownEncoding, encoding)
+}
+
+// Negotiate returns the first of the offered encodings, in order of the sender's
+// preference, that is also supported by the receiver, or Identity if there is none.
+func Negotiate(offered, supported []string) string {
+	for _, o := range offered {
+		for _, s := range supported {
+			if strings.TrimSpace(o) == strings.TrimSpace(s) {
+				return strings.TrimSpace(o)
+			}
+		}
+	}
+	return Identity
+}
+
+// CheckEncodings returns ErrUnknownEncoding if any of the encodings is unknown.
+func CheckEncodings(encodings []string) error {
+	for _, e := range encodings {
+		if _, err := newEncoder(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
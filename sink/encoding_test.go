@@ -0,0 +1,136 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestEncodings(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"Timestamp":"2019-06-05T15:47:07.806Z","RawIDM":"CgEAAOpWE6cmIAAAEAMEFbM+nWqBv4eh"}`+"\n"), 20)
+	for _, encoding := range []string{"", Identity, Snappy, LZ4} {
+		encode, err := newEncoder(encoding)
+		if err != nil {
+			t.Fatal(encoding, err)
+		}
+		b, err := encode(data)
+		if err != nil {
+			t.Fatal(encoding, err)
+		}
+		if (encoding == Snappy || encoding == LZ4) && len(b) >= len(data)/4 {
+			t.Errorf("%s: %d bytes compressed to %d", encoding, len(data), len(b))
+		}
+		got, err := Decode(encoding, b)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: Decode returned %d bytes, %v", encoding, len(got), err)
+		}
+	}
+	if _, err := newEncoder("gzip"); !errors.Is(err, ErrUnknownEncoding) {
+		t.Error("newEncoder(gzip) returned", err)
+	}
+	if _, err := Decode("gzip", data); !errors.Is(err, ErrUnknownEncoding) {
+		t.Error("Decode(gzip) returned", err)
+	}
+	if err := CheckEncodings([]string{LZ4, "zstd"}); !errors.Is(err, ErrUnknownEncoding) {
+		t.Error("CheckEncodings returned", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		offered, supported []string
+		want               string
+	}{
+		{[]string{LZ4, Snappy}, []string{Snappy, LZ4}, LZ4},
+		{[]string{LZ4, Snappy}, []string{Snappy}, Snappy},
+		{[]string{" lz4", "snappy "}, []string{"snappy"}, Snappy},
+		{[]string{LZ4}, []string{Snappy}, Identity},
+		{nil, []string{Snappy}, Identity},
+	}
+	for _, tt := range tests {
+		if got := Negotiate(tt.offered, tt.supported); got != tt.want {
+			t.Errorf("Negotiate(%q, %q) = %q, want %q", tt.offered, tt.supported, got, tt.want)
+		}
+	}
+
+	// The request offers the encodings, and the receiver's reply chooses one.
+	var request *nats.Msg
+	answer := func(supported []string) func(*nats.Msg) (*nats.Msg, error) {
+		return func(m *nats.Msg) (*nats.Msg, error) {
+			request = m
+			return encodingReply(m, supported), nil
+		}
+	}
+	if got := negotiate(answer([]string{Snappy}), "tcpinfo", []string{LZ4, Snappy}); got != Snappy {
+		t.Error("negotiate returned", got)
+	}
+	if request.Subject != "tcpinfo-encoding" || request.Header.Get(acceptEncodingHeader) != "lz4,snappy" {
+		t.Errorf("Wrong request %+v", request)
+	}
+	// Without a receiver, or with an unexpected reply, records are not compressed.
+	noResponders := func(*nats.Msg) (*nats.Msg, error) { return nil, nats.ErrNoResponders }
+	if got := negotiate(noResponders, "tcpinfo", []string{LZ4}); got != Identity {
+		t.Error("negotiate returned", got)
+	}
+	bogus := func(*nats.Msg) (*nats.Msg, error) {
+		reply := nats.NewMsg("")
+		reply.Header.Set(contentEncodingHeader, "gzip")
+		return reply, nil
+	}
+	if got := negotiate(bogus, "tcpinfo", []string{LZ4}); got != Identity {
+		t.Error("negotiate returned", got)
+	}
+}
+
+func TestNATSEncoding(t *testing.T) {
+	msgs := make(chan *nats.Msg, 1)
+	n := newNATS("tcpinfo", 1, 10, LZ4, func(ctx context.Context, msg *nats.Msg) error {
+		msgs <- msg
+		return nil
+	})
+	n.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("hello, hello, hello\n")})
+	n.Close()
+	msg := <-msgs
+	if msg.Header.Get(contentEncodingHeader) != LZ4 {
+		t.Error("Wrong header", msg.Header)
+	}
+	got, err := Decode(msg.Header.Get(contentEncodingHeader), msg.Data)
+	if err != nil || string(got) != "hello, hello, hello\n" {
+		t.Errorf("Decode returned %q, %v", got, err)
+	}
+}
+
+func TestPubSubEncoding(t *testing.T) {
+	defer func(url string) { PubSubTokenURL = url }(PubSubTokenURL)
+	sent := make(chan []pubsubMessage, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token":"secret","expires_in":3599}`))
+			return
+		}
+		var req struct{ Messages []pubsubMessage }
+		json.NewDecoder(r.Body).Decode(&req)
+		sent <- req.Messages
+	}))
+	defer srv.Close()
+	PubSubTokenURL = srv.URL + "/token"
+
+	p := NewPubSub(PubSubSettings{Endpoint: srv.URL, Topic: "projects/p/topics/t", CountThreshold: 1, ByteThreshold: 1000, DelayThreshold: time.Hour, BufferSize: 10, Encoding: Snappy})
+	p.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("1\n")})
+	p.Close()
+	msgs := <-sent
+	if len(msgs) != 1 || msgs[0].Attributes["encoding"] != Snappy {
+		t.Fatalf("Wrong messages %+v", msgs)
+	}
+	got, err := Decode(msgs[0].Attributes["encoding"], msgs[0].Data)
+	if err != nil || string(got) != "1\n" {
+		t.Errorf("Decode returned %q, %v", got, err)
+	}
+}
@@ -0,0 +1,458 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// GCSTokenURL is the GCE metadata server URL of the access token for the default
+// service account, which is used to authenticate to Cloud Storage.
+var GCSTokenURL = PubSubTokenURL
+
+// GCSSettings configures a GCS uploader.
+type GCSSettings struct {
+	// Endpoint is the Cloud Storage JSON API endpoint.
+	Endpoint string
+	// Bucket is the name of the bucket, e.g. my-project-tcpinfo, until it is
+	// changed with SetBucket.
+	Bucket string
+	// Prefix is prepended to the name of each object, e.g. "tcpinfo/".
+	Prefix string
+
+	Uploaders  int // Concurrent uploads.
+	BufferSize int // Files waiting for an uploader.  Files are dropped if it is full.
+	FrameSize  int // Uncompressed bytes per zstd frame.  Zero uses zstd.DefaultFrameSize.
+	// ChunkSize bounds the compressed bytes buffered for each open file.  Larger
+	// files are streamed in chunks of ChunkSize, which is rounded down to a multiple
+	// of 256 KiB, the granularity of resumable uploads.
+	ChunkSize int
+}
+
+// DefaultGCSSettings are the defaults for the endpoint, uploaders, buffer and
+// chunks.
+var DefaultGCSSettings = GCSSettings{
+	Endpoint:   "https://storage.googleapis.com",
+	Uploaders:  4,
+	BufferSize: 1000,
+	ChunkSize:  1 << 20,
+}
+
+// gcsQuantum is the granularity of the chunks of a resumable upload, other than
+// the last.
+const gcsQuantum = 256 << 10
+
+// maxPendingChunks bounds the chunks of a file waiting for upload.  A file that
+// falls further behind is dropped, so that a slow upload cannot hold an unbounded
+// amount of data in memory.
+const maxPendingChunks = 4
+
+// GCS writes the connection files directly to a Google Cloud Storage bucket, with
+// the JSON API.  It implements saver.WriterFactory.
+//
+// Each file is compressed in memory while it is written, and streamed to the
+// object with the same name as the file in the archive tree, following the Prefix.
+// A file that is smaller than the ChunkSize when it is closed, e.g. when the
+// connection ends or the file is rotated, is uploaded with a single request.
+// Larger files are streamed with a resumable upload, in chunks of ChunkSize, so
+// that each open file buffers less than ChunkSize of compressed data, and at most
+// maxPendingChunks chunks waiting for upload.  Each chunk is retried until it
+// succeeds.  Files are dropped if the buffer is full, if their uploads fall too
+// far behind, while the circuit breaker is open, or if they cannot be uploaded
+// within closeTimeout of Close.  The writer of a file that is dropped while it is
+// open reports it with its Err method, so that the Saver continues the connection
+// in a new file.
+type GCS struct {
+	dropped  counter // Files dropped because the buffer was full, or they fell behind.
+	settings GCSSettings
+	client   *http.Client
+	uploads  chan *gcsUpload
+	breaker  *breaker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	token  metadataToken
+
+	mu     sync.Mutex // Protects bucket.
+	bucket string     // The bucket of new files.
+}
+
+// errUploadDropped is reported by the writer of a file whose upload was dropped.
+var errUploadDropped = errors.New("upload dropped")
+
+// gcsUpload is the upload of a file.  Its chunks are sent in order, by one
+// uploader at a time.
+type gcsUpload struct {
+	name   string
+	bucket string
+
+	mu      sync.Mutex // Protects the fields below.
+	chunks  []gcsChunk // Waiting to be sent, including the one being sent.
+	queued  bool       // Whether it is queued for, or being sent by, an uploader.
+	dropped bool
+
+	// The resumable upload session, used only by the uploader sending the upload.
+	session string // The session URI, or empty before the first chunk is sent.
+	offset  int64  // The offset in the file of the chunk being sent.
+	resync  bool   // Whether to query the bytes persisted before sending the chunk.
+}
+
+// gcsChunk is a chunk of a file.  The last one is final, and may have any size.
+type gcsChunk struct {
+	data  []byte
+	final bool
+}
+
+// NewGCS returns a GCS uploader with the settings.
+func NewGCS(settings GCSSettings) *GCS {
+	if settings.Uploaders < 1 {
+		settings.Uploaders = 1
+	}
+	if settings.ChunkSize < gcsQuantum {
+		settings.ChunkSize = gcsQuantum
+	}
+	settings.ChunkSize -= settings.ChunkSize % gcsQuantum
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &GCS{
+		settings: settings,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		uploads:  make(chan *gcsUpload, settings.BufferSize),
+		breaker:  newBreaker("gcs"),
+		ctx:      ctx,
+		cancel:   cancel,
+		bucket:   settings.Bucket,
+	}
+	g.wg.Add(settings.Uploaders)
+	for i := 0; i < settings.Uploaders; i++ {
+		go g.run()
+	}
+	return g
+}
+
+// NewWriter returns a writer that streams the named file, compressing it if the
+// name ends in .zst.
+func (g *GCS) NewWriter(name string) (io.WriteCloser, error) {
+	g.mu.Lock()
+	bucket := g.bucket
+	g.mu.Unlock()
+	f := &gcsFile{gcs: g, upload: &gcsUpload{name: name, bucket: bucket}}
+	if strings.HasSuffix(name, ".zst") {
+		f.w = zstd.NewInProcessStreamWriter(&f.buf, g.settings.FrameSize)
+	} else {
+		f.w = nopCloser{&f.buf}
+	}
+	return f, nil
+}
+
+// SetBucket changes the bucket to which new files are uploaded, e.g. when the
+// fleet configuration changes.  The files already open are still uploaded to the
+// previous bucket.
+func (g *GCS) SetBucket(bucket string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.bucket = bucket
+}
+
+// gcsFile is a file being written, whose data is queued for upload in chunks.
+type gcsFile struct {
+	w      io.WriteCloser // The compressor, or a nopCloser, writing to buf.
+	gcs    *GCS
+	upload *gcsUpload
+	buf    bytes.Buffer
+}
+
+// nopCloser writes files that are not compressed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Write writes b to the file, and queues the chunks of the file that are complete.
+func (f *gcsFile) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	for f.buf.Len() >= f.gcs.settings.ChunkSize {
+		chunk := make([]byte, f.gcs.settings.ChunkSize)
+		f.buf.Read(chunk)
+		f.gcs.queue(f.upload, gcsChunk{data: chunk})
+	}
+	return n, err
+}
+
+// Err returns errUploadDropped if the upload of the file was dropped.
+func (f *gcsFile) Err() error {
+	f.upload.mu.Lock()
+	defer f.upload.mu.Unlock()
+	if f.upload.dropped {
+		return errUploadDropped
+	}
+	return nil
+}
+
+// Close flushes the compressor, and queues the rest of the file for upload.
+func (f *gcsFile) Close() error {
+	err := f.w.Close()
+	if err != nil {
+		f.upload.mu.Lock()
+		f.gcs.dropLocked(f.upload, "dropped")
+		f.upload.mu.Unlock()
+		return err
+	}
+	f.gcs.queue(f.upload, gcsChunk{data: f.buf.Bytes(), final: true})
+	return nil
+}
+
+// queue adds a chunk to the upload, and queues the upload for an uploader if it is
+// not already queued.  The upload is dropped if the buffer is full, or if it has
+// too many chunks waiting.
+func (g *GCS) queue(u *gcsUpload, c gcsChunk) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.dropped {
+		return
+	}
+	if len(u.chunks) >= maxPendingChunks {
+		g.dropped.inc()
+		g.dropLocked(u, "dropped")
+		return
+	}
+	u.chunks = append(u.chunks, c)
+	if u.queued {
+		return
+	}
+	select {
+	case g.uploads <- u:
+		u.queued = true
+	default:
+		g.dropped.inc()
+		g.dropLocked(u, "dropped")
+	}
+}
+
+// dropLocked drops the rest of the upload, counting it with the SinkRecordCount
+// result.  u.mu must be held.
+func (g *GCS) dropLocked(u *gcsUpload, result string) {
+	if u.dropped {
+		return
+	}
+	u.dropped = true
+	u.chunks = nil
+	metrics.UploadFailureCount.WithLabelValues("dropped").Inc()
+	metrics.SinkRecordCount.WithLabelValues("gcs", result).Inc()
+}
+
+// run sends the queued uploads, until the uploads channel is closed.
+func (g *GCS) run() {
+	defer g.wg.Done()
+	for u := range g.uploads {
+		g.send(u)
+	}
+}
+
+// send sends the chunks of u, until it has none waiting.
+func (g *GCS) send(u *gcsUpload) {
+	for {
+		u.mu.Lock()
+		if u.dropped || len(u.chunks) == 0 {
+			u.queued = false
+			u.mu.Unlock()
+			return
+		}
+		c := u.chunks[0]
+		u.mu.Unlock()
+		err := retry(g.ctx, g.breaker, func(ctx context.Context) error {
+			err := g.put(ctx, u, c)
+			if err != nil {
+				u.resync = u.session != ""
+				metrics.UploadFailureCount.WithLabelValues("failed").Inc()
+			}
+			return err
+		})
+		u.mu.Lock()
+		if err != nil {
+			log.Println("Could not upload", u.name, "to GCS:", err)
+			g.dropLocked(u, result(err))
+			u.queued = false
+			u.mu.Unlock()
+			return
+		}
+		u.chunks = u.chunks[1:]
+		u.mu.Unlock()
+		u.offset += int64(len(c.data))
+		if c.final {
+			metrics.SinkRecordCount.WithLabelValues("gcs", "published").Inc()
+		}
+	}
+}
+
+// contentType returns the content type of the object of a file.
+func contentType(name string) string {
+	if strings.HasSuffix(name, ".zst") {
+		return "application/zstd"
+	}
+	return "application/octet-stream"
+}
+
+// statusError returns the error for an unexpected response to a request for an
+// upload.
+func (g *GCS) statusError(u *gcsUpload, resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("upload %s to %s: %s: %s", u.name, u.bucket, resp.Status, msg)
+}
+
+// put makes a single attempt to send a chunk of u.  A file that is a single chunk
+// is uploaded with a single request, and larger files with a resumable upload.
+func (g *GCS) put(ctx context.Context, u *gcsUpload, c gcsChunk) error {
+	token, err := g.token.get(ctx, g.client, GCSTokenURL)
+	if err != nil {
+		return err
+	}
+	if u.session == "" && c.final {
+		return g.media(ctx, token, u, c.data)
+	}
+	if u.session == "" {
+		if err := g.start(ctx, token, u); err != nil {
+			return err
+		}
+	}
+	data := c.data
+	if u.resync {
+		// Part of the chunk may have been persisted by a failed attempt.
+		persisted, done, err := g.persisted(ctx, u)
+		if err != nil || done {
+			return err
+		}
+		if skip := persisted - u.offset; skip > 0 && skip <= int64(len(data)) {
+			data = data[skip:]
+		}
+		u.resync = false
+	}
+	first := u.offset + int64(len(c.data)-len(data))
+	last := u.offset + int64(len(c.data)) - 1
+	total := "*"
+	if c.final {
+		total = strconv.FormatInt(last+1, 10)
+	}
+	rng := fmt.Sprintf("bytes %d-%d/%s", first, last, total)
+	if len(data) == 0 {
+		rng = "bytes */" + total
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.session, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Range", rng)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case c.final && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated):
+		return nil
+	case !c.final && resp.StatusCode == http.StatusPermanentRedirect:
+		// 308 Resume Incomplete.
+		return nil
+	}
+	return g.statusError(u, resp)
+}
+
+// media uploads a whole file with a single request.
+func (g *GCS) media(ctx context.Context, token string, u *gcsUpload, data []byte) error {
+	target := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		g.settings.Endpoint, url.PathEscape(u.bucket), url.QueryEscape(g.settings.Prefix+u.name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", contentType(u.name))
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return g.statusError(u, resp)
+	}
+	return nil
+}
+
+// start starts the resumable upload session of u.
+func (g *GCS) start(ctx context.Context, token string, u *gcsUpload) error {
+	target := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s",
+		g.settings.Endpoint, url.PathEscape(u.bucket), url.QueryEscape(g.settings.Prefix+u.name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Upload-Content-Type", contentType(u.name))
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Location") == "" {
+		return g.statusError(u, resp)
+	}
+	u.session = resp.Header.Get("Location")
+	return nil
+}
+
+// persisted queries the number of bytes of u persisted by its session, and whether
+// the upload is complete.
+func (g *GCS) persisted(ctx context.Context, u *gcsUpload) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.session, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", "bytes */*")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return 0, true, nil
+	case http.StatusPermanentRedirect:
+		// The Range header, e.g. bytes=0-42, is missing if nothing is persisted.
+		var last int64 = -1
+		if rng := resp.Header.Get("Range"); rng != "" {
+			if _, err := fmt.Sscanf(rng, "bytes=0-%d", &last); err != nil {
+				return 0, false, fmt.Errorf("upload %s: bad range %q", u.name, rng)
+			}
+		}
+		return last + 1, false, nil
+	}
+	return 0, false, g.statusError(u, resp)
+}
+
+// Close uploads the queued files, giving up after closeTimeout.  It must be called
+// after all the writers are closed.
+func (g *GCS) Close() error {
+	close(g.uploads)
+	timer := time.AfterFunc(closeTimeout, g.cancel)
+	g.wg.Wait()
+	timer.Stop()
+	g.cancel()
+	if dropped := g.dropped.load(); dropped > 0 {
+		log.Println("GCS uploader dropped", dropped, "files because the buffer was full")
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kzstd "github.com/klauspost/compress/zstd"
+)
+
+func TestGCS(t *testing.T) {
+	defer func(min time.Duration, url string) {
+		minBackoff = min
+		GCSTokenURL = url
+	}(minBackoff, GCSTokenURL)
+	minBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	failures := 1
+	objects := map[string][]byte{}
+	sessions := map[string][]byte{}
+	types := map[string]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"access_token":"secret","expires_in":3599,"token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/upload/storage/v1/b/bucket/o", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		switch r.URL.Query().Get("uploadType") {
+		case "resumable":
+			sessions[name] = []byte{}
+			types[name] = r.Header.Get("X-Upload-Content-Type")
+			w.Header().Set("Location", "http://"+r.Host+"/session?name="+url.QueryEscape(name))
+			return
+		case "media":
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		objects[r.URL.Query().Get("name")] = b
+		types[r.URL.Query().Get("name")] = r.Header.Get("Content-Type")
+		w.Write([]byte(`{}`))
+	})
+	// The chunks of a resumable upload.  The first chunk fails after part of it is
+	// persisted.
+	chunkFailures := 1
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		name := r.URL.Query().Get("name")
+		data, ok := sessions[name]
+		b, err := ioutil.ReadAll(r.Body)
+		if !ok || err != nil || r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rng := r.Header.Get("Content-Range")
+		total := strings.TrimPrefix(rng, "bytes */")
+		if total == rng {
+			var first, last int
+			if _, err := fmt.Sscanf(rng, "bytes %d-%d/%s", &first, &last, &total); err != nil || first != len(data) || last-first+1 != len(b) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if chunkFailures > 0 && len(b) > 1000 {
+			chunkFailures--
+			sessions[name] = append(data, b[:1000]...)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data = append(data, b...)
+		sessions[name] = data
+		if total == "*" {
+			if len(data) > 0 {
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(data)-1))
+			}
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		if strconv.Itoa(len(data)) != total {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		objects[name] = data
+		w.WriteHeader(http.StatusCreated)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	GCSTokenURL = srv.URL + "/token"
+
+	g := NewGCS(GCSSettings{
+		Endpoint:   srv.URL,
+		Bucket:     "bucket",
+		Prefix:     "tcpinfo/",
+		Uploaders:  2,
+		BufferSize: 10,
+		ChunkSize:  gcsQuantum + 1,
+	})
+	for _, name := range []string{"ndt/2019/04/01/a.00000.jsonl.zst", "ndt/2019/04/01/b.00000.jsonl.zst", "ndt/2019/04/01/c.00000.parquet"} {
+		w, err := g.NewWriter(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(name + "\n"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A file larger than a chunk is streamed with a resumable upload.
+	large := make([]byte, 600*1024)
+	rand.New(rand.NewSource(1)).Read(large)
+	w, err := g.NewWriter("ndt/2019/04/01/d.00000.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(large); i += 10000 {
+		end := i + 10000
+		if end > len(large) {
+			end = len(large)
+		}
+		w.Write(large[i:end])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+
+	if !bytes.Equal(objects["tcpinfo/ndt/2019/04/01/d.00000.parquet"], large) {
+		t.Errorf("Wrong content for the large file, %d bytes", len(objects["tcpinfo/ndt/2019/04/01/d.00000.parquet"]))
+	}
+	if chunkFailures != 0 {
+		t.Error("The failed chunk was not resumed")
+	}
+	delete(objects, "tcpinfo/ndt/2019/04/01/d.00000.parquet")
+	// One upload fails, and is retried.
+	if len(objects) != 3 {
+		t.Fatalf("Wrong objects %v", objects)
+	}
+	dec, err := kzstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	for _, name := range []string{"ndt/2019/04/01/a.00000.jsonl.zst", "ndt/2019/04/01/b.00000.jsonl.zst"} {
+		b, err := dec.DecodeAll(objects["tcpinfo/"+name], nil)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if string(b) != name+"\n" || types["tcpinfo/"+name] != "application/zstd" {
+			t.Errorf("Wrong content for %s: %q %s", name, b, types["tcpinfo/"+name])
+		}
+	}
+	// Files not named .zst are not compressed.
+	name := "tcpinfo/ndt/2019/04/01/c.00000.parquet"
+	if string(objects[name]) != "ndt/2019/04/01/c.00000.parquet\n" || types[name] != "application/octet-stream" {
+		t.Errorf("Wrong content for %s: %q %s", name, objects[name], types[name])
+	}
+}
+
+func TestGCSSetBucket(t *testing.T) {
+	defer func(url string) {
+		GCSTokenURL = url
+	}(GCSTokenURL)
+
+	var mu sync.Mutex
+	var paths []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"secret","expires_in":3599,"token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/upload/storage/v1/b/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	GCSTokenURL = srv.URL + "/token"
+
+	g := NewGCS(GCSSettings{Endpoint: srv.URL, Bucket: "old", Uploaders: 1, BufferSize: 10, ChunkSize: gcsQuantum})
+	open, _ := g.NewWriter("a.parquet")
+	g.SetBucket("new")
+	// The file that was already open is still uploaded to the old bucket.
+	write := func(w io.WriteCloser) {
+		w.Write([]byte("x"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(open)
+	w, _ := g.NewWriter("b.parquet")
+	write(w)
+	g.Close()
+
+	want := []string{"/upload/storage/v1/b/old/o", "/upload/storage/v1/b/new/o"}
+	if len(paths) != 2 || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("Wrong uploads %v, want %v", paths, want)
+	}
+}
+
+func TestGCSBufferFull(t *testing.T) {
+	// No uploaders are reading, so the second file is dropped.
+	g := &GCS{uploads: make(chan *gcsUpload, 1), settings: GCSSettings{ChunkSize: gcsQuantum}}
+	for i := 0; i < 2; i++ {
+		w, _ := g.NewWriter("x.jsonl.zst")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(g.uploads) != 1 || g.dropped.load() != 1 {
+		t.Errorf("Expected 1 queued and 1 dropped file, got %d and %d", len(g.uploads), g.dropped.load())
+	}
+}
+
+func TestGCSPendingChunks(t *testing.T) {
+	// No uploaders are reading, so a file is dropped once it has too many chunks
+	// waiting, and its writer reports it.
+	g := &GCS{uploads: make(chan *gcsUpload, 1), settings: GCSSettings{ChunkSize: gcsQuantum}}
+	w, _ := g.NewWriter("x.parquet")
+	chunk := make([]byte, gcsQuantum)
+	for i := 0; i < maxPendingChunks; i++ {
+		w.Write(chunk)
+	}
+	f := w.(*gcsFile)
+	if f.Err() != nil || len(f.upload.chunks) != maxPendingChunks {
+		t.Fatal("Expected the chunks to be waiting, got", f.Err(), len(f.upload.chunks))
+	}
+	w.Write(chunk)
+	if f.Err() != errUploadDropped || len(f.upload.chunks) != 0 || g.dropped.load() != 1 {
+		t.Error("Expected the file to be dropped, got", f.Err(), len(f.upload.chunks), g.dropped.load())
+	}
+	// The buffered data is still bounded by the chunk size.
+	if f.buf.Len() >= gcsQuantum {
+		t.Error("Too much data buffered", f.buf.Len())
+	}
+}
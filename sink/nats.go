@@ -0,0 +1,212 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+// NATS publishes Records to NATS JetStream, on the subject
+//
+//	<subject>.<type>.<partition>
+//
+// where the partition is a hash of the connection UUID, so that all the records of a
+// connection are on one subject, in order.  The stream must already exist, e.g. with
+// the subjects "tcpinfo.>".
+//
+// Each Record is retried until JetStream acknowledges it, so delivery is at least
+// once while the server is available.  The message ID is derived from the Record,
+// so that JetStream can discard duplicates.  Records are dropped if the buffer is
+// full, while the circuit breaker is open, or if they cannot be delivered within
+// closeTimeout of Close.
+//
+// The Record data may be compressed with an encoding negotiated with the receivers.
+// NewNATS offers the encodings in a request on the subject <subject>-encoding, which
+// must not be captured by the stream, with the Accept-Encoding header listing them
+// in order of preference, e.g. "lz4,snappy".  A receiver replies with its choice in
+// the Content-Encoding header, e.g. with AnswerEncoding.  If no receiver replies
+// within negotiateTimeout, the data is not compressed.  Compressed messages have
+// the encoding in their Content-Encoding header, and are decoded with Decode.
+type NATS struct {
+	dropped    counter // Records dropped because the buffer was full.
+	subject    string
+	partitions uint64
+	records    chan Record
+	publish    func(ctx context.Context, msg *nats.Msg) error
+	conn       *nats.Conn
+	breaker    *breaker
+	encoding   string // The negotiated encoding.
+	encode     encoder
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Headers of the encoding negotiation, and of the compressed messages.
+const (
+	acceptEncodingHeader  = "Accept-Encoding"
+	contentEncodingHeader = "Content-Encoding"
+)
+
+// negotiateTimeout is how long NewNATS waits for a receiver to choose an encoding.
+var negotiateTimeout = time.Second
+
+// NewNATS connects to the NATS server at url, and returns a NATS sink that buffers
+// up to bufferSize Records.  The data is compressed with the first of encodings
+// that a receiver supports, if any.
+func NewNATS(url, subject string, partitions int, bufferSize int, encodings []string) (*NATS, error) {
+	err := CheckEncodings(encodings)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := nats.Connect(url, nats.Name("tcp-info"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	encoding := negotiate(func(msg *nats.Msg) (*nats.Msg, error) {
+		return nc.RequestMsg(msg, negotiateTimeout)
+	}, subject, encodings)
+	n := newNATS(subject, partitions, bufferSize, encoding, func(ctx context.Context, msg *nats.Msg) error {
+		_, err := js.PublishMsg(msg, nats.Context(ctx))
+		return err
+	})
+	n.conn = nc
+	return n, nil
+}
+
+func newNATS(subject string, partitions int, bufferSize int, encoding string, publish func(context.Context, *nats.Msg) error) *NATS {
+	if partitions < 1 {
+		partitions = 1
+	}
+	encode, err := newEncoder(encoding)
+	if err != nil {
+		// The encoding is one of those offered, which have been checked.
+		log.Println("Could not encode NATS records:", err)
+		encoding = Identity
+		encode, _ = newEncoder(Identity)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &NATS{
+		subject:    subject,
+		partitions: uint64(partitions),
+		records:    make(chan Record, bufferSize),
+		publish:    publish,
+		breaker:    newBreaker("nats"),
+		encoding:   encoding,
+		encode:     encode,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Publish queues r for delivery, or drops it if the buffer is full.
+func (n *NATS) Publish(r Record) {
+	select {
+	case n.records <- r:
+	default:
+		n.dropped.inc()
+		metrics.SinkRecordCount.WithLabelValues("nats", "dropped").Inc()
+	}
+}
+
+// msg returns the NATS message for r, or an error if it cannot be encoded.
+func (n *NATS) msg(r Record) (*nats.Msg, error) {
+	partition := hash([]byte(r.UUID)) % n.partitions
+	msg := nats.NewMsg(fmt.Sprintf("%s.%s.%d", n.subject, r.Type, partition))
+	msg.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s-%016x", r.UUID, hash(r.Data)))
+	data, err := n.encode(r.Data)
+	if err != nil {
+		return nil, err
+	}
+	if n.encoding != Identity {
+		msg.Header.Set(contentEncodingHeader, n.encoding)
+	}
+	msg.Data = data
+	return msg, nil
+}
+
+// negotiate returns the encoding chosen by a receiver from those offered, or
+// Identity if no receiver replies to the request.
+func negotiate(request func(*nats.Msg) (*nats.Msg, error), subject string, offered []string) string {
+	if len(offered) == 0 {
+		return Identity
+	}
+	msg := nats.NewMsg(subject + "-encoding")
+	msg.Header.Set(acceptEncodingHeader, strings.Join(offered, ","))
+	reply, err := request(msg)
+	if err != nil {
+		log.Println("No NATS receiver chose an encoding, so records are not compressed:", err)
+		return Identity
+	}
+	// The receiver may only choose one of the offered encodings.
+	encoding := Negotiate([]string{reply.Header.Get(contentEncodingHeader)}, offered)
+	log.Println("NATS records are published with the encoding", encoding)
+	return encoding
+}
+
+// AnswerEncoding replies to the encoding requests of NATS sinks publishing with the
+// subject prefix, with the first of their offered encodings that is supported.  It
+// is used by receivers written in Go.
+func AnswerEncoding(nc *nats.Conn, subject string, supported []string) (*nats.Subscription, error) {
+	return nc.Subscribe(subject+"-encoding", func(m *nats.Msg) {
+		m.RespondMsg(encodingReply(m, supported))
+	})
+}
+
+// encodingReply returns the reply to the encoding request m.
+func encodingReply(m *nats.Msg, supported []string) *nats.Msg {
+	reply := nats.NewMsg(m.Reply)
+	reply.Header.Set(contentEncodingHeader, Negotiate(strings.Split(m.Header.Get(acceptEncodingHeader), ","), supported))
+	return reply
+}
+
+// run delivers the Records in order, until the records channel is closed.
+func (n *NATS) run() {
+	defer close(n.done)
+	for r := range n.records {
+		msg, err := n.msg(r)
+		if err != nil {
+			log.Println("Could not encode NATS record:", err)
+			metrics.SinkRecordCount.WithLabelValues("nats", "dropped").Inc()
+			continue
+		}
+		err = retry(n.ctx, n.breaker, func(ctx context.Context) error {
+			return n.publish(ctx, msg)
+		})
+		metrics.SinkRecordCount.WithLabelValues("nats", result(err)).Inc()
+		if err == nil {
+			metrics.SinkLag.WithLabelValues("nats").Set(time.Since(r.Time).Seconds())
+		}
+	}
+}
+
+// Close delivers the buffered Records, giving up after closeTimeout, and closes
+// the connection.
+func (n *NATS) Close() error {
+	close(n.records)
+	timer := time.AfterFunc(closeTimeout, n.cancel)
+	<-n.done
+	timer.Stop()
+	n.cancel()
+	if dropped := n.dropped.load(); dropped > 0 {
+		log.Println("NATS sink dropped", dropped, "records because the buffer was full")
+	}
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestNATS(t *testing.T) {
+	defer func(min time.Duration) { minBackoff = min }(minBackoff)
+	minBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	var msgs []*nats.Msg
+	failures := 2
+	n := newNATS("tcpinfo", 4, 10, Identity, func(ctx context.Context, msg *nats.Msg) error {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs = append(msgs, msg)
+		if failures > 0 {
+			failures--
+			return errors.New("no responders")
+		}
+		return nil
+	})
+	n.Publish(Record{UUID: "host_1_0000000000000001", Type: Snapshot, Time: time.Now(), Data: []byte("a\n")})
+	n.Publish(Record{UUID: "host_1_0000000000000001", Type: Snapshot, Time: time.Now(), Data: []byte("b\n")})
+	n.Close()
+
+	// The first record is retried until it succeeds, and then the second is sent.
+	if len(msgs) != 4 {
+		t.Fatal("Expected 4 attempts, got", len(msgs))
+	}
+	for i, want := range []string{"a\n", "a\n", "a\n", "b\n"} {
+		if string(msgs[i].Data) != want {
+			t.Errorf("Message %d is %q, want %q", i, msgs[i].Data, want)
+		}
+		if !strings.HasPrefix(msgs[i].Subject, "tcpinfo.snapshot.") || msgs[i].Subject != msgs[0].Subject {
+			t.Error("Wrong subject", msgs[i].Subject)
+		}
+	}
+	// Retries have the same ID, so that JetStream discards duplicates.
+	id := msgs[0].Header.Get(nats.MsgIdHdr)
+	if !strings.HasPrefix(id, "host_1_0000000000000001-") || msgs[2].Header.Get(nats.MsgIdHdr) != id ||
+		msgs[3].Header.Get(nats.MsgIdHdr) == id {
+		t.Error("Wrong message IDs", id, msgs[2].Header.Get(nats.MsgIdHdr), msgs[3].Header.Get(nats.MsgIdHdr))
+	}
+}
+
+func TestNATSBufferFull(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	n := newNATS("tcpinfo", 1, 1, Identity, func(ctx context.Context, msg *nats.Msg) error {
+		started <- struct{}{}
+		<-block
+		return nil
+	})
+	n.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("1")})
+	<-started
+	// The first record is being published, so the second fills the buffer.
+	n.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("2")})
+	n.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("3")})
+	close(block)
+	n.Close()
+	if n.dropped.load() != 1 {
+		t.Error("Expected 1 dropped record, got", n.dropped.load())
+	}
+}
+
+func TestNATSCloseTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { closeTimeout = timeout }(closeTimeout)
+	closeTimeout = 10 * time.Millisecond
+
+	n := newNATS("tcpinfo", 1, 10, Identity, func(ctx context.Context, msg *nats.Msg) error {
+		return errors.New("unavailable")
+	})
+	n.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("1")})
+	n.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("2")})
+	done := make(chan struct{})
+	go func() {
+		n.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not give up on undeliverable records")
+	}
+}
@@ -0,0 +1,238 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/m-lab/tcp-info/loglevel"
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// PubSubTokenURL is the GCE metadata server URL of the access token for the
+// default service account, which is used to authenticate to Pub/Sub.
+var PubSubTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// PubSubSettings configures a PubSub sink.  A batch is published when it reaches any
+// of the thresholds.
+type PubSubSettings struct {
+	// Endpoint is the Pub/Sub API endpoint.  Message ordering requires a regional
+	// endpoint, e.g. https://us-east1-pubsub.googleapis.com.
+	Endpoint string
+	// Topic is the full topic name, e.g. projects/my-project/topics/tcpinfo.
+	Topic string
+
+	CountThreshold int           // Records per batch.  Pub/Sub allows at most 1000.
+	ByteThreshold  int           // Bytes of record data per batch.
+	DelayThreshold time.Duration // Time the first record of a batch may wait.
+	BufferSize     int           // Records buffered.  Records are dropped if it is full.
+	// Encoding compresses the data of each message, e.g. with Snappy, and is given
+	// by the encoding attribute.  Pub/Sub cannot negotiate it, so every subscriber
+	// must support it.  Empty is Identity.
+	Encoding string
+}
+
+// DefaultPubSubSettings are the defaults for the batch thresholds and buffer.
+var DefaultPubSubSettings = PubSubSettings{
+	Endpoint:       "https://pubsub.googleapis.com",
+	CountThreshold: 100,
+	ByteThreshold:  1000000,
+	DelayThreshold: 100 * time.Millisecond,
+	BufferSize:     10000,
+}
+
+// PubSub publishes Records to a Google Cloud Pub/Sub topic, with the REST API.
+//
+// Each message has the connection UUID as its ordering key, and the UUID and
+// record type as attributes, so that subscribers with message ordering enabled
+// receive the records of each connection in order.  Batches are published in order,
+// and each is retried until it succeeds, so delivery is at least once while Pub/Sub
+// is available.  Only throttled requests and server errors are retried, and batches
+// that Pub/Sub rejects otherwise, e.g. with 403 Forbidden, are dropped.  Records are
+// also dropped if the buffer is full, while the circuit breaker is open, or if they
+// cannot be delivered within closeTimeout of Close.
+type PubSub struct {
+	dropped  counter // Records dropped because the buffer was full.
+	settings PubSubSettings
+	client   *http.Client
+	records  chan Record
+	breaker  *breaker
+	encode   encoder
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	token  metadataToken
+}
+
+// NewPubSub returns a PubSub sink with the settings.
+// An unknown Encoding, which CheckEncodings reports, is treated as Identity.
+func NewPubSub(settings PubSubSettings) *PubSub {
+	if settings.CountThreshold < 1 || settings.CountThreshold > 1000 {
+		settings.CountThreshold = 1000
+	}
+	encode, err := newEncoder(settings.Encoding)
+	if err != nil {
+		log.Println("Could not encode Pub/Sub records:", err)
+		settings.Encoding = Identity
+		encode, _ = newEncoder(Identity)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PubSub{
+		settings: settings,
+		client:   &http.Client{Timeout: time.Minute},
+		records:  make(chan Record, settings.BufferSize),
+		breaker:  newBreaker("pubsub"),
+		encode:   encode,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish queues r for delivery, or drops it if the buffer is full.
+func (p *PubSub) Publish(r Record) {
+	select {
+	case p.records <- r:
+	default:
+		p.dropped.inc()
+		metrics.SinkRecordCount.WithLabelValues("pubsub", "dropped").Inc()
+	}
+}
+
+// run accumulates batches of Records and publishes them, until the records
+// channel is closed.
+func (p *PubSub) run() {
+	defer close(p.done)
+	var batch []Record
+	size := 0
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	flush := func() {
+		if len(batch) > 0 {
+			p.send(batch)
+		}
+		batch = nil
+		size = 0
+	}
+	for {
+		select {
+		case r, ok := <-p.records:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(p.settings.DelayThreshold)
+			}
+			batch = append(batch, r)
+			size += len(r.Data)
+			if len(batch) >= p.settings.CountThreshold || size >= p.settings.ByteThreshold {
+				timer.Stop()
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// pubsubMessage is a PubsubMessage, as defined by the REST API.
+type pubsubMessage struct {
+	Data        []byte            `json:"data"` // Base64 encoded by encoding/json.
+	Attributes  map[string]string `json:"attributes"`
+	OrderingKey string            `json:"orderingKey"`
+}
+
+// send publishes a batch, retrying until it succeeds or the sink is closed.
+func (p *PubSub) send(batch []Record) {
+	req := struct {
+		Messages []pubsubMessage `json:"messages"`
+	}{}
+	for _, r := range batch {
+		data, err := p.encode(r.Data)
+		if err != nil {
+			log.Println("Could not encode Pub/Sub record:", err)
+			metrics.SinkRecordCount.WithLabelValues("pubsub", "dropped").Inc()
+			continue
+		}
+		attributes := map[string]string{"uuid": r.UUID, "type": r.Type}
+		if p.settings.Encoding != "" && p.settings.Encoding != Identity {
+			attributes["encoding"] = p.settings.Encoding
+		}
+		req.Messages = append(req.Messages, pubsubMessage{
+			Data:        data,
+			Attributes:  attributes,
+			OrderingKey: r.UUID,
+		})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		// This should never happen.
+		log.Println("Could not marshal Pub/Sub batch:", err)
+		metrics.SinkRecordCount.WithLabelValues("pubsub", "dropped").Add(float64(len(batch)))
+		return
+	}
+	err = retry(p.ctx, p.breaker, func(ctx context.Context) error {
+		return p.post(ctx, body)
+	})
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		loglevel.Limitedln(loglevel.Error, loglevel.Failure, "Dropped a Pub/Sub batch:", err)
+	}
+	metrics.SinkRecordCount.WithLabelValues("pubsub", result(err)).Add(float64(len(batch)))
+	if err == nil {
+		metrics.SinkLag.WithLabelValues("pubsub").Set(time.Since(batch[0].Time).Seconds())
+	}
+}
+
+// post makes a single publish request.
+func (p *PubSub) post(ctx context.Context, body []byte) error {
+	token, err := p.token.get(ctx, p.client, PubSubTokenURL)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s:publish", p.settings.Endpoint, p.settings.Topic)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("publish to %s: %s: %s", p.settings.Topic, resp.Status, msg)
+		if !retryable(resp.StatusCode) {
+			return &permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// Close publishes the buffered Records, giving up after closeTimeout.
+func (p *PubSub) Close() error {
+	close(p.records)
+	timer := time.AfterFunc(closeTimeout, p.cancel)
+	<-p.done
+	timer.Stop()
+	p.cancel()
+	if dropped := p.dropped.load(); dropped > 0 {
+		log.Println("Pub/Sub sink dropped", dropped, "records because the buffer was full")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package sink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestPubSub(t *testing.T) {
+	defer func(min time.Duration, url string) {
+		minBackoff = min
+		PubSubTokenURL = url
+	}(minBackoff, PubSubTokenURL)
+	minBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	tokens := 0
+	failures := 1
+	var batches [][]pubsubMessage
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"access_token":"secret","expires_in":3599,"token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/v1/projects/p/topics/t:publish", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var req struct{ Messages []pubsubMessage }
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		batches = append(batches, req.Messages)
+		w.Write([]byte(`{"messageIds":["1"]}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	PubSubTokenURL = srv.URL + "/token"
+
+	p := NewPubSub(PubSubSettings{
+		Endpoint:       srv.URL,
+		Topic:          "projects/p/topics/t",
+		CountThreshold: 2,
+		ByteThreshold:  1000,
+		DelayThreshold: time.Hour,
+		BufferSize:     10,
+	})
+	p.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("1\n")})
+	p.Publish(Record{UUID: "b", Type: Snapshot, Data: []byte("2\n")})
+	p.Publish(Record{UUID: "a", Type: ShortFlow, Data: []byte("3\n")})
+	p.Close()
+
+	// The first batch is full, and is retried once.  The second is sent by Close.
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("Wrong batches %+v", batches)
+	}
+	if tokens != 1 {
+		t.Error("Expected the token to be cached, got", tokens, "requests")
+	}
+	m := batches[1][0]
+	if string(m.Data) != "3\n" || m.OrderingKey != "a" || m.Attributes["uuid"] != "a" || m.Attributes["type"] != ShortFlow {
+		t.Errorf("Wrong message %+v", m)
+	}
+	if string(batches[0][1].Data) != "2\n" || batches[0][1].OrderingKey != "b" {
+		t.Errorf("Wrong message %+v", batches[0][1])
+	}
+}
+
+func TestPubSubDelay(t *testing.T) {
+	defer func(url string) { PubSubTokenURL = url }(PubSubTokenURL)
+	sent := make(chan int, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token":"secret","expires_in":3599}`))
+			return
+		}
+		var req struct{ Messages []pubsubMessage }
+		json.NewDecoder(r.Body).Decode(&req)
+		sent <- len(req.Messages)
+	}))
+	defer srv.Close()
+	PubSubTokenURL = srv.URL + "/token"
+
+	p := NewPubSub(PubSubSettings{
+		Endpoint:       srv.URL,
+		Topic:          "projects/p/topics/t",
+		CountThreshold: 100,
+		ByteThreshold:  1000,
+		DelayThreshold: 10 * time.Millisecond,
+		BufferSize:     10,
+	})
+	defer p.Close()
+	p.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("1\n")})
+	// The batch is sent when its first record has waited for the DelayThreshold.
+	select {
+	case n := <-sent:
+		if n != 1 {
+			t.Error("Expected 1 message, got", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batch was not sent after the delay")
+	}
+}
+
+func TestPubSubPermanentError(t *testing.T) {
+	defer func(min time.Duration, url string) {
+		minBackoff = min
+		PubSubTokenURL = url
+	}(minBackoff, PubSubTokenURL)
+	minBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token":"secret","expires_in":3599}`))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	PubSubTokenURL = srv.URL + "/token"
+
+	failed := metrics.SinkRecordCount.WithLabelValues("pubsub", "failed")
+	var m dto.Metric
+	failed.Write(&m)
+	before := m.GetCounter().GetValue()
+	p := NewPubSub(PubSubSettings{
+		Endpoint:       srv.URL,
+		Topic:          "projects/p/topics/t",
+		CountThreshold: 2,
+		ByteThreshold:  1000,
+		DelayThreshold: time.Hour,
+		BufferSize:     10,
+	})
+	p.Publish(Record{UUID: "a", Type: Snapshot, Data: []byte("1\n")})
+	p.Publish(Record{UUID: "b", Type: Snapshot, Data: []byte("2\n")})
+	p.Close()
+
+	// The forbidden batch is dropped without being retried.
+	if requests != 1 {
+		t.Error("Expected 1 request, got", requests)
+	}
+	failed.Write(&m)
+	if m.GetCounter().GetValue() != before+2 {
+		t.Error("Expected 2 failed records, got", m.GetCounter().GetValue()-before)
+	}
+}
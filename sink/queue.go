@@ -0,0 +1,89 @@
+package sink
+
+import (
+	"log"
+	"time"
+
+	"github.com/m-lab/tcp-info/loglevel"
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// queue buffers the Records of a sink that writes synchronously, and writes them
+// on its own goroutine, so that a slow destination cannot block the marshallers.
+// Records are dropped if the buffer is full, or while the circuit breaker is open.
+type queue struct {
+	dropped counter // Records dropped because the buffer was full.
+	name    string
+	records chan Record
+	write   func(Record) error
+	breaker *breaker
+	stop    chan struct{} // Closed to stop writing the Records that are left.
+	done    chan struct{} // Closed when run returns.
+}
+
+func newQueue(name string, bufferSize int, write func(Record) error) *queue {
+	q := &queue{
+		name:    name,
+		records: make(chan Record, bufferSize),
+		write:   write,
+		breaker: newBreaker(name),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// publish queues r to be written, or drops it if the buffer is full.
+func (q *queue) publish(r Record) {
+	select {
+	case q.records <- r:
+	default:
+		q.dropped.inc()
+		metrics.SinkRecordCount.WithLabelValues(q.name, "dropped").Inc()
+	}
+}
+
+// run writes the Records in order, until the records channel is closed.  Once stop
+// is closed, the Records that are left are dropped.
+func (q *queue) run() {
+	defer close(q.done)
+	for r := range q.records {
+		select {
+		case <-q.stop:
+			metrics.SinkRecordCount.WithLabelValues(q.name, "dropped").Inc()
+			continue
+		default:
+		}
+		if !q.breaker.allow() {
+			metrics.SinkRecordCount.WithLabelValues(q.name, "rejected").Inc()
+			continue
+		}
+		err := q.write(r)
+		q.breaker.record(err)
+		if err != nil {
+			loglevel.Limitedln(loglevel.Error, loglevel.Failure, "Could not write to", q.name, err)
+			metrics.SinkRecordCount.WithLabelValues(q.name, "dropped").Inc()
+			continue
+		}
+		metrics.SinkRecordCount.WithLabelValues(q.name, "published").Inc()
+		metrics.SinkLag.WithLabelValues(q.name).Set(time.Since(r.Time).Seconds())
+	}
+}
+
+// close writes the buffered Records, for at most closeTimeout.  After that, the
+// Records that are left are dropped.  It returns once run has returned, after the
+// write in progress, if any, so that the destination can then be closed.
+func (q *queue) close() {
+	close(q.records)
+	select {
+	case <-q.done:
+	case <-time.After(closeTimeout):
+		log.Println("Gave up writing the buffered records to", q.name)
+		close(q.stop)
+		<-q.done
+	}
+	if dropped := q.dropped.load(); dropped > 0 {
+		log.Println(q.name, "sink dropped", dropped, "records because the buffer was full")
+	}
+}
@@ -0,0 +1,41 @@
+package sink
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueClose(t *testing.T) {
+	defer func(timeout time.Duration) { closeTimeout = timeout }(closeTimeout)
+	closeTimeout = 10 * time.Millisecond
+
+	// The first write blocks until it is released, after the close timeout.
+	release := make(chan struct{})
+	written := 0
+	q := newQueue("test", 10, func(r Record) error {
+		if written == 0 {
+			<-release
+		}
+		written++
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		q.publish(Record{})
+	}
+	closed := make(chan struct{})
+	go func() {
+		q.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("close returned during a write")
+	case <-time.After(5 * closeTimeout):
+	}
+	close(release)
+	<-closed
+	// The records left after the timeout are dropped.
+	if written != 1 {
+		t.Error("Expected 1 record written, got", written)
+	}
+}
@@ -0,0 +1,131 @@
+// Package sink publishes the records written by the saver to streaming systems,
+// in addition to the connection files.
+package sink
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-lab/tcp-info/loglevel"
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// Record types.
+const (
+	Snapshot          = "snapshot"      // An ArchivalRecord, as written to a connection file.
+	ShortFlow         = "short_flow"    // A saver.ShortFlow, as written to the short flow rollup.
+	ConnectionSummary = "summary"       // A Summary of a closed connection.
+	HostCounters      = "host_counters" // The snmp.Counters of a polling cycle, with the host as the UUID.
+)
+
+// Retry and shutdown parameters, shared by all sinks.
+var (
+	minBackoff   = 100 * time.Millisecond
+	maxBackoff   = 10 * time.Second
+	closeTimeout = 10 * time.Second
+)
+
+// Record is a marshalled record, published to each Sink.
+type Record struct {
+	UUID string    // UUID of the connection, used to partition and order the records.
+	Type string    // Type of the record, e.g. Snapshot.
+	Time time.Time // Time the record was published to the Sink, for measuring lag.
+	Data []byte    // The JSON encoded record.  It must not be modified.
+}
+
+// Sink publishes Records to a streaming system.  Publish is called by the saver's
+// marshallers, so it must not block.  Each sink has its own buffer, and drops
+// Records when it is full, so that a failing sink cannot slow the connection files
+// or the other sinks.
+type Sink interface {
+	Publish(r Record)
+	// Close delivers or drops the published Records, and releases all resources.
+	Close() error
+}
+
+// hash returns a hash of b, used for partitioning and deduplication.
+func hash(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// counter counts the Records or files that a sink drops because its buffer is
+// full.  It is accessed atomically, so it is the first field of the sinks, for the
+// 64-bit alignment that atomic operations need on 32-bit platforms.
+type counter struct {
+	n int64
+}
+
+func (c *counter) inc() { atomic.AddInt64(&c.n, 1) }
+
+func (c *counter) load() int64 { return atomic.LoadInt64(&c.n) }
+
+// errRejected is returned by retry when the circuit breaker is open.
+var errRejected = errors.New("circuit breaker is open")
+
+// permanentError is an error that retrying cannot fix, e.g. a request rejected as
+// invalid, or for a topic that does not exist.  retry returns it without retrying.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// retryable returns whether a request that failed with an HTTP status code may
+// succeed if it is retried, i.e. for 429 Too Many Requests and server errors.
+func retryable(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// retry calls send until it succeeds, with exponential backoff, until ctx is done,
+// or until the breaker opens.  It returns nil if send succeeded.
+func retry(ctx context.Context, b *breaker, send func(context.Context) error) error {
+	backoff := minBackoff
+	for {
+		if !b.allow() {
+			return errRejected
+		}
+		err := send(ctx)
+		b.record(err)
+		var permanent *permanentError
+		if err == nil || errors.As(err, &permanent) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		loglevel.Limitedln(loglevel.Error, loglevel.Failure, "Could not publish to", b.name, err)
+		metrics.SinkRecordCount.WithLabelValues(b.name, "retried").Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// result returns the SinkRecordCount result for records that were sent with the
+// error err.
+func result(err error) string {
+	switch err {
+	case nil:
+		return "published"
+	case errRejected:
+		return "rejected"
+	}
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return "failed"
+	}
+	return "dropped"
+}
@@ -0,0 +1,126 @@
+package sink
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// Summary is the summary of a closed connection, published as a Record of type
+// ConnectionSummary.  The addresses are anonymized like those in the connection files.
+type Summary struct {
+	UUID          string
+	ID            inetdiag.SockID
+	Owner         string `json:",omitempty"`
+	StartTime     time.Time
+	EndTime       time.Time // Timestamp of the last snapshot.
+	FinalState    string
+	Snapshots     int // Number of significant snapshots of the connection.
+	BytesSent     uint64
+	BytesReceived uint64
+	// AppLimited are the periods in which the sender was application limited, i.e.
+	// its delivery rate samples were limited by the data the application supplied,
+	// not by the network, so throughput measured in them understates what the
+	// network could carry.  Only the first periods are listed, but AppLimitedTime
+	// is the total duration of all of them.
+	AppLimited     []AppLimitedPeriod `json:",omitempty"`
+	AppLimitedTime time.Duration      `json:",omitempty"`
+	// MaxDeliveryRate is the highest delivery rate of the samples that were not
+	// application limited, in bytes per second.
+	MaxDeliveryRate uint64 `json:",omitempty"`
+	// RTT is the distribution of the smoothed RTT over the snapshots of the
+	// connection, if any reported one.
+	RTT *RTTPercentiles `json:",omitempty"`
+	// MPTCP identifies the MPTCP connection of an MPTCP socket, or of a TCP subflow
+	// of one.
+	MPTCP *MPTCPSummary `json:",omitempty"`
+}
+
+// MPTCPSummary groups an MPTCP connection with its TCP subflows.
+type MPTCPSummary struct {
+	Token uint32 // The local token of the MPTCP connection.
+	// Subflows are the UUIDs of the recorded subflows of an MPTCP connection.  It is
+	// empty in the summaries of the subflows.
+	Subflows []string `json:",omitempty"`
+}
+
+// RTTPercentiles are percentiles of the smoothed RTT of a connection, in
+// microseconds, estimated from a sketch of every snapshot taken while the
+// connection was recorded, including those that were not written to its files.
+type RTTPercentiles struct {
+	Samples uint64 // Number of snapshots with an RTT.
+	P50     uint32
+	P95     uint32
+	P99     uint32
+}
+
+// AppLimitedPeriod is a period of consecutive snapshots whose delivery rate samples
+// were application limited.
+type AppLimitedPeriod struct {
+	Start time.Time // Timestamp of the first snapshot in the period.
+	// End is the timestamp of the first later snapshot that was not application
+	// limited, or of the last snapshot of the connection.
+	End time.Time
+	// MaxDeliveryRate is the highest delivery rate in the period, in bytes per second.
+	MaxDeliveryRate uint64
+}
+
+// field is a named value of a Summary, for log entries.
+type field struct {
+	name, value string
+}
+
+// fields returns the fields of s, in a fixed order.
+func (s *Summary) fields() []field {
+	fs := []field{
+		{"uuid", s.UUID},
+		{"src", s.ID.SrcIP},
+		{"sport", strconv.Itoa(int(s.ID.SPort))},
+		{"dst", s.ID.DstIP},
+		{"dport", strconv.Itoa(int(s.ID.DPort))},
+		{"start", s.StartTime.UTC().Format(time.RFC3339Nano)},
+		{"end", s.EndTime.UTC().Format(time.RFC3339Nano)},
+		{"duration", s.EndTime.Sub(s.StartTime).String()},
+		{"state", s.FinalState},
+		{"snapshots", strconv.Itoa(s.Snapshots)},
+		{"bytes_sent", strconv.FormatUint(s.BytesSent, 10)},
+		{"bytes_received", strconv.FormatUint(s.BytesReceived, 10)},
+	}
+	if s.Owner != "" {
+		fs = append(fs, field{"owner", s.Owner})
+	}
+	if s.AppLimitedTime > 0 {
+		fs = append(fs, field{"app_limited", s.AppLimitedTime.String()})
+	}
+	if s.RTT != nil {
+		for _, p := range []struct {
+			name string
+			us   uint32
+		}{{"rtt_p50", s.RTT.P50}, {"rtt_p95", s.RTT.P95}, {"rtt_p99", s.RTT.P99}} {
+			fs = append(fs, field{p.name, (time.Duration(p.us) * time.Microsecond).String()})
+		}
+	}
+	if s.MPTCP != nil {
+		fs = append(fs, field{"mptcp_token", fmt.Sprintf("%08x", s.MPTCP.Token)})
+		if len(s.MPTCP.Subflows) > 0 {
+			fs = append(fs, field{"subflows", strconv.Itoa(len(s.MPTCP.Subflows))})
+		}
+	}
+	return fs
+}
+
+// logfmt formats the fields of s as key=value pairs, quoting values as needed.
+func (s *Summary) logfmt() string {
+	parts := []string{}
+	for _, f := range s.fields() {
+		v := f.value
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", f.name, v))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,114 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+// DefaultJournalSocket is the socket of the journald native protocol.
+const DefaultJournalSocket = "/run/systemd/journal/socket"
+
+// decodeSummary decodes the Summary in the Data of a ConnectionSummary Record.
+func decodeSummary(r Record) (*Summary, error) {
+	var s Summary
+	err := json.Unmarshal(r.Data, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Syslog writes one entry for each closed connection to syslog, with the Summary
+// fields formatted as key=value pairs.  Other Records are ignored.  Entries are
+// buffered, and dropped if the buffer is full.
+type Syslog struct {
+	w *syslog.Writer
+	q *queue
+}
+
+// NewSyslog connects to the syslog server at raddr, using network, e.g. "udp", or
+// to the local syslog server if network is empty.  Up to bufferSize entries are
+// buffered.
+func NewSyslog(network, raddr string, bufferSize int) (*Syslog, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "tcp-info")
+	if err != nil {
+		return nil, err
+	}
+	s := &Syslog{w: w}
+	s.q = newQueue("syslog", bufferSize, s.write)
+	return s, nil
+}
+
+// Publish queues the entry for a ConnectionSummary.
+func (s *Syslog) Publish(r Record) {
+	if r.Type == ConnectionSummary {
+		s.q.publish(r)
+	}
+}
+
+func (s *Syslog) write(r Record) error {
+	sum, err := decodeSummary(r)
+	if err != nil {
+		return err
+	}
+	return s.w.Info("connection closed " + sum.logfmt())
+}
+
+// Close writes the buffered entries, and closes the connection to the syslog server.
+func (s *Syslog) Close() error {
+	s.q.close()
+	return s.w.Close()
+}
+
+// Journal writes one entry for each closed connection to the systemd journal, with
+// the Summary fields as journal fields named TCPINFO_<NAME>, e.g. TCPINFO_UUID.
+// Other Records are ignored.  Entries are buffered, and dropped if the buffer is
+// full.
+type Journal struct {
+	conn net.Conn
+	q    *queue
+}
+
+// NewJournal connects to the journald native protocol socket, e.g.
+// DefaultJournalSocket.  Up to bufferSize entries are buffered.
+func NewJournal(socket string, bufferSize int) (*Journal, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{conn: conn}
+	j.q = newQueue("journal", bufferSize, j.write)
+	return j, nil
+}
+
+// Publish queues the entry for a ConnectionSummary.
+func (j *Journal) Publish(r Record) {
+	if r.Type == ConnectionSummary {
+		j.q.publish(r)
+	}
+}
+
+func (j *Journal) write(r Record) error {
+	sum, err := decodeSummary(r)
+	if err != nil {
+		return err
+	}
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "MESSAGE=connection closed %s\n", sum.logfmt())
+	b.WriteString("PRIORITY=6\nSYSLOG_IDENTIFIER=tcp-info\n")
+	for _, f := range sum.fields() {
+		// Newlines are replaced, so that the simple field format can be used.
+		fmt.Fprintf(&b, "TCPINFO_%s=%s\n", strings.ToUpper(f.name), strings.ReplaceAll(f.value, "\n", " "))
+	}
+	_, err = j.conn.Write([]byte(b.String()))
+	return err
+}
+
+// Close writes the buffered entries, and closes the journal socket.
+func (j *Journal) Close() error {
+	j.q.close()
+	return j.conn.Close()
+}
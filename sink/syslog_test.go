@@ -0,0 +1,95 @@
+package sink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+func testSummary(t *testing.T) Record {
+	start := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	sum := Summary{
+		UUID:          "host_1_0000000000000001",
+		ID:            inetdiag.SockID{SPort: 443, DPort: 1234, SrcIP: "10.0.0.1", DstIP: "10.0.0.2"},
+		Owner:         "ndt server",
+		StartTime:     start,
+		EndTime:       start.Add(1500 * time.Millisecond),
+		FinalState:    "CLOSE",
+		Snapshots:     3,
+		BytesSent:     1000,
+		BytesReceived: 200,
+	}
+	b, err := json.Marshal(sum)
+	rtx.Must(err, "Could not marshal")
+	return Record{UUID: sum.UUID, Type: ConnectionSummary, Data: b}
+}
+
+func TestSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer pc.Close()
+
+	s, err := NewSyslog("udp", pc.LocalAddr().String(), 10)
+	rtx.Must(err, "Could not dial syslog")
+	s.Publish(Record{UUID: "x", Type: Snapshot, Data: []byte("{}")}) // Ignored.
+	s.Publish(testSummary(t))
+	rtx.Must(s.Close(), "Could not close")
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	rtx.Must(err, "Could not read")
+	entry := string(buf[:n])
+	want := `tcp-info[` // The tag, followed by the pid.
+	if !strings.Contains(entry, want) {
+		t.Errorf("Entry %q does not contain %q", entry, want)
+	}
+	want = `connection closed uuid=host_1_0000000000000001 src=10.0.0.1 sport=443 dst=10.0.0.2 dport=1234 ` +
+		`start=2018-02-06T11:12:13Z end=2018-02-06T11:12:14.5Z duration=1.5s state=CLOSE snapshots=3 ` +
+		`bytes_sent=1000 bytes_received=200 owner="ndt server"`
+	if !strings.HasSuffix(strings.TrimSpace(entry), want) {
+		t.Errorf("Entry %q does not end with %q", entry, want)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestJournal")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+	pc, err := net.ListenPacket("unixgram", socket)
+	rtx.Must(err, "Could not listen")
+	defer pc.Close()
+
+	j, err := NewJournal(socket, 10)
+	rtx.Must(err, "Could not dial journal")
+	j.Publish(Record{UUID: "x", Type: Snapshot, Data: []byte("{}")}) // Ignored.
+	j.Publish(testSummary(t))
+	rtx.Must(j.Close(), "Could not close")
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	rtx.Must(err, "Could not read")
+	fields := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			t.Fatalf("Bad field %q", line)
+		}
+		fields[kv[0]] = kv[1]
+	}
+	if !strings.HasPrefix(fields["MESSAGE"], "connection closed uuid=host_1_0000000000000001") ||
+		fields["SYSLOG_IDENTIFIER"] != "tcp-info" || fields["TCPINFO_UUID"] != "host_1_0000000000000001" ||
+		fields["TCPINFO_STATE"] != "CLOSE" || fields["TCPINFO_BYTES_SENT"] != "1000" || fields["TCPINFO_OWNER"] != "ndt server" {
+		t.Errorf("Wrong fields %v", fields)
+	}
+}
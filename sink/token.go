@@ -0,0 +1,51 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// metadataToken is an access token for the default service account, from the GCE
+// metadata server, which is cached until shortly before it expires.
+type metadataToken struct {
+	mu      sync.Mutex // Protects the token.
+	token   string
+	expires time.Time
+}
+
+// get returns the cached token, or requests a new one from url.
+func (t *metadataToken) get(ctx context.Context, client *http.Client, url string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("access token: %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tok)
+	if err != nil {
+		return "", err
+	}
+	t.token = tok.AccessToken
+	t.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return t.token, nil
+}
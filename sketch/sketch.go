@@ -0,0 +1,225 @@
+// Package sketch estimates the quantiles of a distribution of positive values,
+// e.g. RTTs, within a bounded relative error, in much less memory than the values
+// themselves.  As in DDSketch, values are counted in buckets whose bounds grow
+// geometrically, so any quantile is estimated within RelativeAccuracy of a value
+// at that rank.  Sketches of different connections or cycles can be merged.
+package sketch
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+// RelativeAccuracy is the largest relative error of the estimated quantiles.
+const RelativeAccuracy = 0.01
+
+// MaxBuckets bounds the buckets of a sketch.  When values span a wider range, the
+// lowest buckets are merged, so only the lowest quantiles lose accuracy.  512
+// buckets span a ratio of about 28000 between the smallest and largest values,
+// e.g. from 10µs to 280ms.
+const MaxBuckets = 512
+
+// Errors returned when decoding sketches.
+var (
+	ErrAccuracy     = errors.New("sketch has a different relative accuracy")
+	ErrInconsistent = errors.New("sketch counts are inconsistent")
+)
+
+var (
+	gamma    = (1 + RelativeAccuracy) / (1 - RelativeAccuracy)
+	logGamma = math.Log(gamma)
+)
+
+// Sketch is a quantile sketch.  The zero value is an empty sketch.  A Sketch is not
+// safe for concurrent use.
+type Sketch struct {
+	// counts are the counts of the buckets from offset.  Bucket i holds the
+	// values in (gamma^(i-1), gamma^i].
+	counts []uint32
+	offset int
+	zeros  uint64 // The count of values that are not positive.
+	count  uint64
+	min    float64
+	max    float64
+}
+
+// index returns the bucket of the positive value v.
+func index(v float64) int {
+	return int(math.Ceil(math.Log(v) / logGamma))
+}
+
+// value returns the estimate of the values in bucket i, which is within
+// RelativeAccuracy of all of them.
+func value(i int) float64 {
+	return 2 * math.Pow(gamma, float64(i)) / (gamma + 1)
+}
+
+// Add adds a value to the sketch.
+func (s *Sketch) Add(v float64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	if !(v > 0) {
+		s.zeros++
+		return
+	}
+	i := index(v)
+	s.cover(i, i)
+	s.inc(i, 1)
+}
+
+// cover grows the buckets to include buckets lo to hi.  If there would be more
+// than MaxBuckets, the lowest are merged into the lowest bucket that is kept.
+func (s *Sketch) cover(lo, hi int) {
+	if len(s.counts) == 0 {
+		s.counts = make([]uint32, hi-lo+1)
+		s.offset = lo
+		return
+	}
+	top := s.offset + len(s.counts) - 1
+	if lo >= s.offset && hi <= top {
+		return
+	}
+	if lo > s.offset {
+		lo = s.offset
+	}
+	if hi < top {
+		hi = top
+	}
+	if hi-lo+1 > MaxBuckets {
+		lo = hi - MaxBuckets + 1
+	}
+	if lo == s.offset {
+		s.counts = append(s.counts, make([]uint32, hi-top)...)
+		return
+	}
+	grown := make([]uint32, hi-lo+1)
+	for j, c := range s.counts {
+		i := s.offset + j
+		if i < lo {
+			i = lo
+		}
+		grown[i-lo] += c
+	}
+	s.counts, s.offset = grown, lo
+}
+
+// inc adds n to the count of bucket i, or of the lowest bucket, if i is below it.
+func (s *Sketch) inc(i int, n uint32) {
+	if i < s.offset {
+		i = s.offset
+	}
+	s.counts[i-s.offset] += n
+}
+
+// Count returns the number of values added to the sketch.
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+// Quantile returns an estimate of the q quantile of the values, for q between 0
+// and 1, or zero if the sketch is empty.  The minimum and maximum are exact.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zeros {
+		return s.min
+	}
+	seen := s.zeros
+	est := s.max
+	for j, c := range s.counts {
+		seen += uint64(c)
+		if seen > rank {
+			est = value(s.offset + j)
+			break
+		}
+	}
+	return math.Max(s.min, math.Min(s.max, est))
+}
+
+// Merge adds the values of o to the sketch.
+func (s *Sketch) Merge(o *Sketch) {
+	if o.count == 0 {
+		return
+	}
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.count == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.count += o.count
+	s.zeros += o.zeros
+	if len(o.counts) == 0 {
+		return
+	}
+	s.cover(o.offset, o.offset+len(o.counts)-1)
+	for j, c := range o.counts {
+		s.inc(o.offset+j, c)
+	}
+}
+
+// Reset empties the sketch.
+func (s *Sketch) Reset() {
+	*s = Sketch{}
+}
+
+// encoded is the JSON encoding of a Sketch.  Counts are the counts of the buckets
+// from Offset, where bucket i holds the values in (g^(i-1), g^i], and g is
+// (1+RelativeAccuracy)/(1-RelativeAccuracy).  Zeros is the count of values that
+// are not positive.
+type encoded struct {
+	RelativeAccuracy float64
+	Count            uint64
+	Zeros            uint64 `json:",omitempty"`
+	Min              float64
+	Max              float64
+	Offset           int
+	Counts           []uint32
+}
+
+// MarshalJSON encodes the sketch, e.g. to be merged with those of other hosts.
+func (s *Sketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&encoded{
+		RelativeAccuracy: RelativeAccuracy,
+		Count:            s.count,
+		Zeros:            s.zeros,
+		Min:              s.min,
+		Max:              s.max,
+		Offset:           s.offset,
+		Counts:           s.counts,
+	})
+}
+
+// UnmarshalJSON decodes a sketch encoded by MarshalJSON.
+func (s *Sketch) UnmarshalJSON(b []byte) error {
+	var e encoded
+	if err := json.Unmarshal(b, &e); err != nil {
+		return err
+	}
+	if e.RelativeAccuracy != RelativeAccuracy {
+		return ErrAccuracy
+	}
+	var total uint64
+	for _, c := range e.Counts {
+		total += uint64(c)
+	}
+	if total+e.Zeros != e.Count || len(e.Counts) > MaxBuckets {
+		return ErrInconsistent
+	}
+	*s = Sketch{counts: e.Counts, offset: e.Offset, zeros: e.Zeros, count: e.Count, min: e.Min, max: e.Max}
+	return nil
+}
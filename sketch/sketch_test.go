@@ -0,0 +1,144 @@
+package sketch_test
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/sketch"
+)
+
+// exact returns the q quantile of the sorted values, by the rank Quantile uses.
+func exact(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func check(t *testing.T, s *sketch.Sketch, values []float64) {
+	t.Helper()
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	if s.Count() != uint64(len(sorted)) {
+		t.Fatalf("Count() = %d, want %d", s.Count(), len(sorted))
+	}
+	for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.95, 0.99, 0.999, 1} {
+		want := exact(sorted, q)
+		got := s.Quantile(q)
+		if math.Abs(got-want) > sketch.RelativeAccuracy*want+1e-9 {
+			t.Errorf("Quantile(%v) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	s := &sketch.Sketch{}
+	if s.Quantile(0.5) != 0 {
+		t.Error("An empty sketch should have zero quantiles")
+	}
+	var values []float64
+	for i := 0; i < 100000; i++ {
+		// Log normal RTTs, in microseconds, around 20ms.
+		v := math.Exp(rng.NormFloat64()*0.8 + math.Log(20000))
+		values = append(values, v)
+		s.Add(v)
+	}
+	check(t, s, values)
+
+	s.Reset()
+	if s.Count() != 0 || s.Quantile(1) != 0 {
+		t.Error("Reset should empty the sketch")
+	}
+	// Values that are not positive are counted, at the minimum.
+	values = []float64{0, 0, 5, 7, 1000}
+	for _, v := range values {
+		s.Add(v)
+	}
+	check(t, s, values)
+}
+
+func TestMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	a, b, all := &sketch.Sketch{}, &sketch.Sketch{}, &sketch.Sketch{}
+	var values []float64
+	for i := 0; i < 10000; i++ {
+		// Two hosts, with different ranges.
+		v := 100 + rng.Float64()*1000
+		a.Add(v)
+		w := 5000 + rng.Float64()*100000
+		b.Add(w)
+		values = append(values, v, w)
+		all.Add(v)
+		all.Add(w)
+	}
+	a.Merge(b)
+	check(t, a, values)
+	for _, q := range []float64{0.1, 0.5, 0.99} {
+		if a.Quantile(q) != all.Quantile(q) {
+			t.Errorf("Merged Quantile(%v) = %v, want %v", q, a.Quantile(q), all.Quantile(q))
+		}
+	}
+	empty := &sketch.Sketch{}
+	empty.Merge(&sketch.Sketch{})
+	empty.Merge(b)
+	if empty.Count() != b.Count() || empty.Quantile(0.5) != b.Quantile(0.5) {
+		t.Error("Merging into an empty sketch should copy it")
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	s := &sketch.Sketch{}
+	var values []float64
+	// Values over a ratio of 10^8, more than the buckets can span.
+	for v := 1.0; v < 1e8; v *= 1.001 {
+		s.Add(v)
+		values = append(values, v)
+	}
+	// The high quantiles are accurate, and the low ones are too high.
+	for _, q := range []float64{0.9, 0.99} {
+		want := exact(values, q)
+		if got := s.Quantile(q); math.Abs(got-want) > sketch.RelativeAccuracy*want {
+			t.Errorf("Quantile(%v) = %v, want %v", q, got, want)
+		}
+	}
+	if s.Quantile(0) != 1 || s.Quantile(0.01) < exact(values, 0.01) {
+		t.Error("Wrong low quantiles", s.Quantile(0), s.Quantile(0.01))
+	}
+
+	// Lower values are counted in the lowest bucket.
+	s.Add(0.5)
+	if s.Quantile(0) != 0.5 || s.Count() != uint64(len(values)+1) {
+		t.Error("Wrong minimum", s.Quantile(0))
+	}
+}
+
+func TestJSON(t *testing.T) {
+	s := &sketch.Sketch{}
+	for _, v := range []float64{0, 3, 30, 300, 3000} {
+		s.Add(v)
+	}
+	b, err := json.Marshal(s)
+	rtx.Must(err, "Could not marshal")
+	got := &sketch.Sketch{}
+	rtx.Must(json.Unmarshal(b, got), "Could not unmarshal %s", b)
+	for _, q := range []float64{0, 0.3, 0.5, 0.9, 1} {
+		if got.Quantile(q) != s.Quantile(q) {
+			t.Errorf("Quantile(%v) = %v, want %v", q, got.Quantile(q), s.Quantile(q))
+		}
+	}
+	if got.Count() != 5 {
+		t.Error("Wrong count", got.Count())
+	}
+
+	if err := json.Unmarshal([]byte(`{"RelativeAccuracy":0.02}`), got); err != sketch.ErrAccuracy {
+		t.Error("Expected ErrAccuracy, got", err)
+	}
+	if err := json.Unmarshal([]byte(`{"RelativeAccuracy":0.01,"Count":3,"Counts":[1]}`), got); err != sketch.ErrInconsistent {
+		t.Error("Expected ErrInconsistent, got", err)
+	}
+	if err := json.Unmarshal([]byte(`[]`), got); err == nil {
+		t.Error("Expected an error")
+	}
+}
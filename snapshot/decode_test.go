@@ -0,0 +1,121 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// TestDecoders checks that the native decoder decodes the kernel corpus as the
+// unsafe decoder does.
+func TestDecoders(t *testing.T) {
+	defer inetdiag.SetDecoder(inetdiag.Unsafe)
+	for _, name := range []string{"linux-4.9", "linux-5.4", "linux-6.18"} {
+		records, want := loadKernel(t, name)
+		inetdiag.SetDecoder(inetdiag.Native)
+		for i, ar := range records {
+			_, got, err := snapshot.Decode(ar)
+			rtx.Must(err, "Could not decode %s", name)
+			if diff := deep.Equal(got, want[i]); diff != nil {
+				t.Errorf("%s %d: the native decoder differs: %v", name, i, diff)
+			}
+		}
+		inetdiag.SetDecoder(inetdiag.Unsafe)
+	}
+}
+
+// TestBigEndian checks the decoding of attributes saved on a big endian host.
+func TestBigEndian(t *testing.T) {
+	defer inetdiag.SetDecoder(inetdiag.Unsafe)
+	info := tcp.LinuxTCPInfo{State: 1, WScale: 0x77, RTT: 12345, PacingRate: 1 << 40, BytesReceived: 99, BytesSent: 1000}
+	var b bytes.Buffer
+	rtx.Must(binary.Write(&b, binary.BigEndian, &info), "Could not encode")
+	ar := &netlink.ArchivalRecord{RawIDM: make([]byte, 72)}
+	ar.RawIDM[0] = inetdiag.AF_INET
+	binary.BigEndian.PutUint32(ar.RawIDM[64:], 1000)
+	ar.Attributes = make([][]byte, inetdiag.INET_DIAG_MAX)
+	ar.Attributes[inetdiag.INET_DIAG_INFO] = b.Bytes()
+	ar.Attributes[inetdiag.INET_DIAG_MARK] = []byte{0, 0, 1, 2}
+	// bw_lo and bw_hi, then min_rtt, pacing_gain and cwnd_gain.
+	ar.Attributes[inetdiag.INET_DIAG_BBRINFO] = []byte{0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 4, 0, 0, 1, 0, 0, 0, 2, 0}
+
+	inetdiag.SetDecoder(inetdiag.BigEndian)
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode")
+	if diff := deep.Equal(snap.TCPInfo, &info); diff != nil {
+		t.Error("Wrong TCPInfo", diff)
+	}
+	if snap.InetDiagMsg.IDiagUID != 1000 || snap.Mark != 0x0102 {
+		t.Error("Wrong UID or mark", snap.InetDiagMsg.IDiagUID, snap.Mark)
+	}
+	want := inetdiag.BBRInfo{BW: 1<<32 | 3, MinRTT: 4, PacingGain: 256, CwndGain: 512}
+	if *snap.BBRInfo != want {
+		t.Errorf("BBRInfo = %+v, want %+v", *snap.BBRInfo, want)
+	}
+	if snap.NotFullyParsed != 0 {
+		t.Errorf("NotFullyParsed %#x", snap.NotFullyParsed)
+	}
+
+	// Longer attributes are decoded, but not fully parsed, and shorter ones are
+	// padded with zeros.
+	ar.Attributes[inetdiag.INET_DIAG_INFO] = append(b.Bytes(), 1, 2, 3, 4)
+	ar.Attributes[inetdiag.INET_DIAG_MEMINFO] = []byte{0, 0, 0, 5}
+	_, snap, err = snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode")
+	if snap.TCPInfo.BytesSent != 1000 || snap.NotFullyParsed != 1<<(inetdiag.INET_DIAG_INFO-1) {
+		t.Errorf("Wrong long TCPInfo %d %#x", snap.TCPInfo.BytesSent, snap.NotFullyParsed)
+	}
+	if *snap.MemInfo != (inetdiag.MemInfo{Rmem: 5}) {
+		t.Errorf("Wrong short MemInfo %+v", *snap.MemInfo)
+	}
+}
+
+// TestMPTCP checks the decoding of the mptcp_info of an MPTCP socket, which has
+// padding that binary.Read would not skip, and of the ULP state of a subflow.
+func TestMPTCP(t *testing.T) {
+	defer inetdiag.SetDecoder(inetdiag.Unsafe)
+	info := make([]byte, 96)
+	info[0] = 2
+	binary.LittleEndian.PutUint32(info[12:], 0x01020304)
+	binary.LittleEndian.PutUint64(info[16:], 1<<40)
+	binary.LittleEndian.PutUint32(info[44:], 7)
+	binary.LittleEndian.PutUint64(info[56:], 5000)
+	info[80] = 3
+	binary.LittleEndian.PutUint32(info[84:], 100)
+	want := inetdiag.MPTCPInfo{Subflows: 2, Token: 0x01020304, WriteSeq: 1 << 40, Retransmits: 7, BytesSent: 5000, SubflowsTotal: 3, LastDataSent: 100}
+
+	msk := &netlink.ArchivalRecord{RawIDM: make([]byte, 72), Protocol: inetdiag.Protocol_IPPROTO_MPTCP}
+	msk.RawIDM[0] = inetdiag.AF_INET
+	msk.Attributes = make([][]byte, inetdiag.INET_DIAG_MAX)
+	msk.Attributes[inetdiag.INET_DIAG_INFO] = info
+
+	// The name of the ULP, and the local token of the subflow.
+	ulp := []byte{
+		10, 0, 1, 0, 'm', 'p', 't', 'c', 'p', 0, 0, 0,
+		12, 0, 3, 0x80, 8, 0, 2, 0, 4, 3, 2, 1,
+	}
+	subflow := &netlink.ArchivalRecord{RawIDM: msk.RawIDM, Protocol: inetdiag.Protocol_IPPROTO_TCP}
+	subflow.Attributes = make([][]byte, inetdiag.INET_DIAG_ULP_INFO+1)
+	subflow.Attributes[inetdiag.INET_DIAG_ULP_INFO] = ulp
+
+	for _, d := range []inetdiag.Decoder{inetdiag.Unsafe, inetdiag.Native} {
+		inetdiag.SetDecoder(d)
+		_, snap, err := snapshot.Decode(msk)
+		rtx.Must(err, "Could not decode")
+		if snap.MPTCPInfo == nil || *snap.MPTCPInfo != want || snap.TCPInfo != nil || snap.NotFullyParsed != 0 {
+			t.Errorf("Wrong MPTCPInfo %+v %#x", snap.MPTCPInfo, snap.NotFullyParsed)
+		}
+		_, snap, err = snapshot.Decode(subflow)
+		rtx.Must(err, "Could not decode")
+		if snap.MPTCPSubflow == nil || snap.MPTCPSubflow.TokenLoc != 0x01020304 || snap.NotFullyParsed != 0 {
+			t.Errorf("Wrong MPTCPSubflow %+v %#x", snap.MPTCPSubflow, snap.NotFullyParsed)
+		}
+	}
+}
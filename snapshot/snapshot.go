@@ -3,10 +3,14 @@
 package snapshot
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"reflect"
+	"strings"
 	"time"
 	"unsafe"
 
@@ -48,7 +52,12 @@ func Decode(ar *netlink.ArchivalRecord) (*netlink.Metadata, *Snapshot, error) {
 		case inetdiag.INET_DIAG_MEMINFO:
 			result.MemInfo, ok = rta.toMemInfo()
 		case inetdiag.INET_DIAG_INFO:
+			if ar.IsMPTCP() {
+				result.MPTCPInfo, ok = rta.toMPTCPInfo()
+				break
+			}
 			result.TCPInfo, ok = rta.toLinuxTCPInfo()
+			result.TCPInfoLength = len(rta)
 		case inetdiag.INET_DIAG_VEGASINFO:
 			result.VegasInfo, ok = rta.toVegasInfo()
 		case inetdiag.INET_DIAG_CONG:
@@ -85,6 +94,10 @@ func Decode(ar *netlink.ArchivalRecord) (*netlink.Metadata, *Snapshot, error) {
 			result.ClassID, ok = rta.toClassID()
 		case inetdiag.INET_DIAG_MD5SIG:
 			missingDecodeLog.Println("MD5SIGnot handled", len(rta))
+		case inetdiag.INET_DIAG_ULP_INFO:
+			// Only the ULP of MPTCP subflows is decoded, not e.g. that of TLS.
+			sf, err := netlink.ParseMPTCPSubflow(rta)
+			result.MPTCPSubflow, ok = sf, sf != nil && err == nil
 		default:
 			metrics.NetlinkNotDecoded.WithLabelValues(fmt.Sprint(t)).Inc()
 			missingDecodeLog.Println("unhandled attribute type:", t)
@@ -123,8 +136,66 @@ func maybeCopy(src []byte, size int, msgType string) (unsafe.Pointer, bool) {
 	return unsafe.Pointer(&src[0]), len(src) == size
 }
 
+// decode decodes src into v, a pointer to a struct of fixed size fields, field by
+// field in the given byte order, for the decoders other than inetdiag.Unsafe.
+// Like maybeCopy, it pads short values with zeros, and returns false if src is
+// larger than the struct.
+func decode(src []byte, v interface{}, order binary.ByteOrder, msgType string) bool {
+	size := binary.Size(v)
+	if len(src) < size {
+		data := make([]byte, size)
+		copy(data, src)
+		src = data
+	} else if len(src) > size {
+		metrics.LargeNetlinkMsgTotal.WithLabelValues(msgType).Inc()
+	}
+	// This can't fail, as src is at least as large as v.
+	binary.Read(bytes.NewReader(src), order, v)
+	return len(src) == size
+}
+
+// decodeAligned is like decode, for structs that, like struct mptcp_info, have
+// padding between their fields, which binary.Read does not skip.  Each field is
+// decoded from its offset in the struct, which must have only integer fields.
+func decodeAligned(src []byte, v interface{}, order binary.ByteOrder, msgType string) bool {
+	rv := reflect.ValueOf(v).Elem()
+	size := int(rv.Type().Size())
+	ok := true
+	if len(src) < size {
+		data := make([]byte, size)
+		copy(data, src)
+		src = data
+	} else if len(src) > size {
+		metrics.LargeNetlinkMsgTotal.WithLabelValues(msgType).Inc()
+		ok = false
+	}
+	for i := 0; i < rv.NumField(); i++ {
+		b := src[rv.Type().Field(i).Offset:]
+		f := rv.Field(i)
+		switch f.Type().Size() {
+		case 1:
+			f.SetUint(uint64(b[0]))
+		case 2:
+			f.SetUint(uint64(order.Uint16(b)))
+		case 4:
+			f.SetUint(uint64(order.Uint32(b)))
+		case 8:
+			if f.Kind() == reflect.Int64 {
+				f.SetInt(int64(order.Uint64(b)))
+			} else {
+				f.SetUint(order.Uint64(b))
+			}
+		}
+	}
+	return ok
+}
+
 // toMemInfo maps the raw RouteAttrValue onto a MemInfo.
 func (raw RouteAttrValue) toMemInfo() (*inetdiag.MemInfo, bool) {
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		v := &inetdiag.MemInfo{}
+		return v, decode(raw, v, order, "MemInfo")
+	}
 	structSize := (int)(unsafe.Sizeof(inetdiag.MemInfo{}))
 	data, ok := maybeCopy(raw, structSize, "MemInfo")
 	if !ok {
@@ -136,6 +207,10 @@ func (raw RouteAttrValue) toMemInfo() (*inetdiag.MemInfo, bool) {
 // toLinuxTCPInfo maps the raw RouteAttrValue into a LinuxTCPInfo struct.
 // For older data, it may have to copy the bytes.
 func (raw RouteAttrValue) toLinuxTCPInfo() (*tcp.LinuxTCPInfo, bool) {
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		v := &tcp.LinuxTCPInfo{}
+		return v, decode(raw, v, order, "TCPInfo")
+	}
 	structSize := (int)(unsafe.Sizeof(tcp.LinuxTCPInfo{}))
 	data, ok := maybeCopy(raw, structSize, "TCPInfo")
 	if !ok {
@@ -144,9 +219,25 @@ func (raw RouteAttrValue) toLinuxTCPInfo() (*tcp.LinuxTCPInfo, bool) {
 	return (*tcp.LinuxTCPInfo)(data), ok
 }
 
+// toMPTCPInfo maps the raw RouteAttrValue onto an MPTCPInfo.
+// For older data, it may have to copy the bytes.
+func (raw RouteAttrValue) toMPTCPInfo() (*inetdiag.MPTCPInfo, bool) {
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		v := &inetdiag.MPTCPInfo{}
+		return v, decodeAligned(raw, v, order, "MPTCPInfo")
+	}
+	structSize := (int)(unsafe.Sizeof(inetdiag.MPTCPInfo{}))
+	data, ok := maybeCopy(raw, structSize, "MPTCPInfo")
+	return (*inetdiag.MPTCPInfo)(data), ok
+}
+
 // toVegasInfo maps the raw RouteAttrValue onto a VegasInfo.
 // For older data, it may have to copy the bytes.
 func (raw RouteAttrValue) toVegasInfo() (*inetdiag.VegasInfo, bool) {
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		v := &inetdiag.VegasInfo{}
+		return v, decode(raw, v, order, "VegasInfo")
+	}
 	structSize := (int)(unsafe.Sizeof(inetdiag.VegasInfo{}))
 	data, ok := maybeCopy(raw, structSize, "VegasInfo")
 	return (*inetdiag.VegasInfo)(data), ok
@@ -155,8 +246,9 @@ func (raw RouteAttrValue) toVegasInfo() (*inetdiag.VegasInfo, bool) {
 // CongestionAlgorithm returns the congestion algorithm string
 // INET_DIAG_CONG
 func (raw RouteAttrValue) CongestionAlgorithm() (string, bool) {
-	// This is sometimes empty, but that is valid, so we return true.
-	return string(raw[:len(raw)-1]), true
+	// This is sometimes empty, but that is valid, so we return true.  The name is
+	// NUL terminated.
+	return strings.TrimRight(string(raw), "\x00"), true
 }
 
 func (raw RouteAttrValue) toUint8() (uint8, bool) {
@@ -184,6 +276,10 @@ func (raw RouteAttrValue) toClassID() (uint8, bool) {
 // toSockMemInfo maps the raw RouteAttrValue onto a SockMemInfo.
 // For older data, it may have to copy the bytes.
 func (raw RouteAttrValue) toSockMemInfo() (*inetdiag.SocketMemInfo, bool) {
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		v := &inetdiag.SocketMemInfo{}
+		return v, decode(raw, v, order, "SockMemInfo")
+	}
 	structSize := (int)(unsafe.Sizeof(inetdiag.SocketMemInfo{}))
 	data, ok := maybeCopy(raw, structSize, "SockMemInfo")
 	return (*inetdiag.SocketMemInfo)(data), ok
@@ -196,6 +292,10 @@ func (raw RouteAttrValue) toShutdown() (uint8, bool) {
 // toVegasInfo maps the raw RouteAttrValue onto a VegasInfo.
 // For older data, it may have to copy the bytes.
 func (raw RouteAttrValue) toDCTCPInfo() (*inetdiag.DCTCPInfo, bool) {
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		v := &inetdiag.DCTCPInfo{}
+		return v, decode(raw, v, order, "DCTCPInfo")
+	}
 	structSize := (int)(unsafe.Sizeof(inetdiag.DCTCPInfo{}))
 	data, ok := maybeCopy(raw, structSize, "DCTCPInfo")
 	return (*inetdiag.DCTCPInfo)(data), ok
@@ -210,12 +310,25 @@ func (raw RouteAttrValue) toMark() (uint32, bool) {
 	if raw == nil || len(raw) != 4 {
 		return 0, false
 	}
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		return order.Uint32(raw), true
+	}
 	return *(*uint32)(unsafe.Pointer(&raw[0])), true
 }
 
 // toBBRInfo maps the raw RouteAttrValue onto a BBRInfo.
 // For older data, it may have to copy the bytes.
 func (raw RouteAttrValue) toBBRInfo() (*inetdiag.BBRInfo, bool) {
+	if order := inetdiag.CurrentDecoder().ByteOrder(); order != nil {
+		v := &inetdiag.BBRInfo{}
+		ok := decode(raw, v, order, "BBRInfo")
+		if order == binary.BigEndian {
+			// The bandwidth is two __u32, with the low half first.
+			bw := uint64(v.BW)
+			v.BW = int64(bw<<32 | bw>>32)
+		}
+		return v, ok
+	}
 	structSize := (int)(unsafe.Sizeof(inetdiag.BBRInfo{}))
 	data, ok := maybeCopy(raw, structSize, "BBRInfo")
 	return (*inetdiag.BBRInfo)(data), ok
@@ -237,22 +350,27 @@ type Snapshot struct {
 	InetDiagMsg *inetdiag.InetDiagMsg `csv:"-"`
 
 	// From INET_DIAG_CONG message.
-	CongestionAlgorithm string `csv:",omitempty"`
+	CongestionAlgorithm string `csv:",omitempty" kernel:"INET_DIAG_CONG"`
 
 	// See https://tools.ietf.org/html/rfc3168
 	// TODO Do we need to record whether these are present and zero, vs absent?
-	TOS     uint8 `csv:",omitempty"`
-	TClass  uint8 `csv:",omitempty"`
-	ClassID uint8 `csv:",omitempty"`
+	TOS     uint8 `csv:",omitempty" kernel:"INET_DIAG_TOS"`
+	TClass  uint8 `csv:",omitempty" kernel:"INET_DIAG_TCLASS"`
+	ClassID uint8 `csv:",omitempty" kernel:"INET_DIAG_CLASS_ID"`
 
 	// TODO Do we need to record present and zero, vs absent?
-	Shutdown uint8 `csv:",omitempty"`
+	Shutdown uint8 `csv:",omitempty" kernel:"INET_DIAG_SHUTDOWN"`
 
 	// From INET_DIAG_PROTOCOL message.
 	// TODO Do we need to record present and zero, vs absent?
-	Protocol inetdiag.Protocol `csv:",omitempty"`
+	Protocol inetdiag.Protocol `csv:",omitempty" kernel:"INET_DIAG_PROTOCOL"`
+
+	Mark uint32 `csv:",omitempty" kernel:"INET_DIAG_MARK"`
 
-	Mark uint32 `csv:",omitempty"`
+	// TCPInfoLength is the length of the struct tcp_info the kernel reported, which
+	// is shorter on older kernels.  The TCPInfo fields beyond it are zero, but not
+	// valid.
+	TCPInfoLength int `csv:",omitempty" units:"bytes" kernel:"INET_DIAG_INFO"`
 
 	// TCPInfo contains data from struct tcp_info.
 	TCPInfo *tcp.LinuxTCPInfo `csv:"-"`
@@ -266,6 +384,55 @@ type Snapshot struct {
 	VegasInfo *inetdiag.VegasInfo `csv:"-"`
 	DCTCPInfo *inetdiag.DCTCPInfo `csv:"-"`
 	BBRInfo   *inetdiag.BBRInfo   `csv:"-"`
+
+	// Data obtained from the INET_DIAG_INFO of MPTCP sockets, in place of TCPInfo,
+	// and from the INET_DIAG_ULP_INFO of their TCP subflows.
+	MPTCPInfo    *inetdiag.MPTCPInfo        `csv:"-"`
+	MPTCPSubflow *inetdiag.MPTCPSubflowInfo `csv:"-"`
+}
+
+// ValidTCPInfoFields returns the names of the TCPInfo fields that the kernel
+// filled in, or nil if there is no TCPInfo.
+func (s *Snapshot) ValidTCPInfoFields() []string {
+	if s.TCPInfo == nil {
+		return nil
+	}
+	return tcp.ValidFields(s.TCPInfoLength)
+}
+
+// NormalizedTCPInfo returns the TCPInfo with its times as time.Durations, and its
+// rates in bytes per second, or nil if there is no TCPInfo.
+func (s *Snapshot) NormalizedTCPInfo() *tcp.NormalizedTCPInfo {
+	if s.TCPInfo == nil {
+		return nil
+	}
+	n := s.TCPInfo.Normalized()
+	return &n
+}
+
+// Row is the row for each snapshot in the exported formats, e.g. Arrow, Avro and
+// nl-proto.  The socket ID is not exported from the Snapshot's InetDiagMsg, so it
+// is added here, along with the connection UUID.
+type Row struct {
+	UUID     string
+	Sequence int
+	ID       *inetdiag.SockID
+	Snapshot Snapshot
+}
+
+// NewRow returns the Row of the snapshot s of the connection described by meta,
+// which may be nil.
+func NewRow(meta *netlink.Metadata, s *Snapshot) *Row {
+	row := &Row{Snapshot: *s}
+	if meta != nil {
+		row.UUID = meta.UUID
+		row.Sequence = meta.Sequence
+	}
+	if s.InetDiagMsg != nil {
+		id := s.InetDiagMsg.ID.GetSockID()
+		row.ID = &id
+	}
+	return row
 }
 
 // ConnectionLog contains a Metadata and slice of Snapshots.
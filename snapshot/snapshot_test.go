@@ -1,14 +1,19 @@
 package snapshot_test
 
 import (
+	"bytes"
 	"io"
 	"log"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/go-test/deep"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
 	"github.com/m-lab/tcp-info/zstd"
 )
 
@@ -149,3 +154,144 @@ func TestLoadAll(t *testing.T) {
 	}
 
 }
+
+// loadKernel returns the records and snapshots of a kernel in the corpus.
+func loadKernel(t *testing.T, name string) ([]*netlink.ArchivalRecord, []*snapshot.Snapshot) {
+	rdr := zstd.NewReader("testdata/kernels/" + name + ".zst")
+	defer rdr.Close()
+	raw := netlink.NewRawReader(rdr)
+	var records []*netlink.ArchivalRecord
+	var snaps []*snapshot.Snapshot
+	for {
+		ar, err := raw.Next()
+		if err == io.EOF {
+			break
+		}
+		rtx.Must(err, "Could not read %s", name)
+		_, snap, err := snapshot.Decode(ar)
+		rtx.Must(err, "Could not decode %s", name)
+		records = append(records, ar)
+		snaps = append(snaps, snap)
+	}
+	return records, snaps
+}
+
+// tcpInfoBytes returns the bytes of the decoded tcp_info.
+func tcpInfoBytes(info *tcp.LinuxTCPInfo) []byte {
+	return (*[unsafe.Sizeof(tcp.LinuxTCPInfo{})]byte)(unsafe.Pointer(info))[:]
+}
+
+// TestKernelCorpus checks that the dumps of each kernel in testdata/kernels decode
+// as they always have.  Each dump has three snapshots of an IPv4 loopback
+// connection, and three of an IPv6 one.  See testdata/kernels/README.md.
+func TestKernelCorpus(t *testing.T) {
+	const latest = "linux-6.18"
+	const (
+		// The attributes of all kernels: MemInfo, TCPInfo, Congestion, TOS,
+		// SKMemInfo, Shutdown, Mark and BBRInfo.
+		base = 0xc0db
+		// ClassID, from 4.15.
+		classID = 1 << (inetdiag.INET_DIAG_CLASS_ID - 1)
+		// CGroupID and SockOpt, from 5.9 and 5.10, which are not decoded.
+		newer  = 0x300000
+		tclass = 1 << (inetdiag.INET_DIAG_TCLASS - 1)
+		info   = 1 << (inetdiag.INET_DIAG_INFO - 1)
+	)
+	tests := []struct {
+		name           string
+		tcpInfo        int
+		observed       uint32 // For the IPv4 connection.  IPv6 also has TClass.
+		notFullyParsed uint32
+	}{
+		{name: "linux-4.9", tcpInfo: 168, observed: base},
+		{name: "linux-4.14", tcpInfo: 192, observed: base},
+		{name: "linux-4.19", tcpInfo: 224, observed: base | classID},
+		{name: "linux-5.4", tcpInfo: 232, observed: base | classID},
+		{name: "linux-5.10", tcpInfo: 232, observed: base | classID | newer, notFullyParsed: newer},
+		{name: "linux-5.15", tcpInfo: 232, observed: base | classID | newer, notFullyParsed: newer},
+		{name: "linux-6.1", tcpInfo: 232, observed: base | classID | newer, notFullyParsed: newer},
+		// Kernels with a longer tcp_info than LinuxTCPInfo flag it as not fully parsed.
+		{name: "linux-6.6", tcpInfo: 240, observed: base | classID | newer, notFullyParsed: newer | info},
+		{name: latest, tcpInfo: 280, observed: base | classID | newer, notFullyParsed: newer | info},
+	}
+	_, want := loadKernel(t, latest)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, snaps := loadKernel(t, tt.name)
+			if len(snaps) != len(want) {
+				t.Fatalf("Expected %d snapshots, got %d", len(want), len(snaps))
+			}
+			for i, snap := range snaps {
+				if n := len(records[i].Attributes[inetdiag.INET_DIAG_INFO]); n != tt.tcpInfo {
+					t.Errorf("%d: tcp_info is %d bytes, not %d", i, n, tt.tcpInfo)
+				}
+				observed := tt.observed
+				if i >= 3 {
+					observed |= tclass
+				}
+				if snap.Observed != observed {
+					t.Errorf("%d: Observed %#x, want %#x", i, snap.Observed, observed)
+				}
+				if snap.NotFullyParsed != tt.notFullyParsed {
+					t.Errorf("%d: NotFullyParsed %#x, want %#x", i, snap.NotFullyParsed, tt.notFullyParsed)
+				}
+				if snap.TCPInfoLength != tt.tcpInfo {
+					t.Errorf("%d: TCPInfoLength %d, want %d", i, snap.TCPInfoLength, tt.tcpInfo)
+				}
+				valid := snap.ValidTCPInfoFields()
+				if tcp.FieldValid("BusyTime", tt.tcpInfo) != (tt.tcpInfo >= 192) || len(valid) == 0 || valid[0] != "State" {
+					t.Errorf("%d: wrong valid fields %v", i, valid)
+				}
+
+				// The fields the kernel reports decode as in the latest kernel, and
+				// the others are zero.
+				got := tcpInfoBytes(snap.TCPInfo)
+				n := tt.tcpInfo
+				if n > len(got) {
+					n = len(got)
+				}
+				if !bytes.Equal(got[:n], tcpInfoBytes(want[i].TCPInfo)[:n]) {
+					t.Errorf("%d: tcp_info differs from %s", i, latest)
+				}
+				if !bytes.Equal(got[n:], make([]byte, len(got)-n)) {
+					t.Errorf("%d: tcp_info fields beyond %d bytes are not zero", i, n)
+				}
+				a, b := *snap, *want[i]
+				a.TCPInfo, b.TCPInfo = nil, nil
+				a.Observed, b.Observed = 0, 0
+				a.NotFullyParsed, b.NotFullyParsed = 0, 0
+				a.TCPInfoLength, b.TCPInfoLength = 0, 0
+				if tt.observed&classID == 0 {
+					b.ClassID = 0
+				}
+				if diff := deep.Equal(a, b); diff != nil {
+					t.Errorf("%d: differs from %s: %v", i, latest, diff)
+				}
+
+				// Each snapshot of a connection differs from the previous one.
+				if i%3 > 0 {
+					change, err := records[i].Compare(records[i-1])
+					if err != nil || change == netlink.NoMajorChange {
+						t.Errorf("%d: Compare returned %v, %v", i, change, err)
+					}
+				}
+			}
+			// Bytes sent are only reported from 4.19.
+			if sent := snaps[2].TCPInfo.BytesSent; (tt.tcpInfo >= 224) != (sent > 0) {
+				t.Errorf("BytesSent is %d for a %d byte tcp_info", sent, tt.tcpInfo)
+			}
+		})
+	}
+}
+
+func TestNormalizedTCPInfo(t *testing.T) {
+	s := snapshot.Snapshot{}
+	if s.NormalizedTCPInfo() != nil {
+		t.Error("Expected nil without TCPInfo")
+	}
+	s.TCPInfo = &tcp.LinuxTCPInfo{RTT: 1500, DeliveryRate: 1000}
+	n := s.NormalizedTCPInfo()
+	if n == nil || n.RTT != 1500*time.Microsecond || n.DeliveryRate != 1000 || n.Raw.RTT != 1500 {
+		t.Errorf("Wrong normalized TCPInfo %+v", n)
+	}
+}
@@ -0,0 +1,160 @@
+//go:build ignore
+// +build ignore
+
+// generate captures the inet_diag dumps of loopback connections on the running
+// kernel, and derives the dumps of older kernels from them.  Run it as root, from
+// this directory, with
+//
+//	go run generate.go
+//
+// The tcp_info struct and the inet_diag attributes have only ever been extended,
+// so the dump of an older kernel is the same dump, with tcp_info truncated to the
+// length of that kernel's struct, and without the attributes it did not have.  The
+// derived dumps should be replaced by captures from the real kernels, when they
+// are available.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+var name = flag.String("name", "", "Name of the running kernel, e.g. linux-6.18.  Required.")
+
+// Attribute types newer than those in package inetdiag.
+const (
+	ulpInfo = 19 // INET_DIAG_ULP_INFO, 5.3.
+	sockopt = 22 // INET_DIAG_SOCKOPT, 5.10.
+)
+
+// kernels are the kernels derived from the capture, with the length of their
+// tcp_info, and their largest inet_diag attribute type.
+var kernels = []struct {
+	name    string
+	tcpInfo int
+	maxAttr int
+}{
+	{"linux-4.9", 168, inetdiag.INET_DIAG_BBRINFO},
+	{"linux-4.14", 192, inetdiag.INET_DIAG_BBRINFO},
+	{"linux-4.19", 224, inetdiag.INET_DIAG_MD5SIG},
+	{"linux-5.4", 232, ulpInfo},
+	{"linux-5.10", 232, sockopt},
+	{"linux-5.15", 232, sockopt},
+	{"linux-6.1", 232, sockopt},
+	{"linux-6.6", 240, sockopt},
+}
+
+// connection returns a loopback connection, and its local port.
+func connection(network, addr string) (net.Conn, net.Conn, uint16) {
+	l, err := net.Listen(network, addr)
+	rtx.Must(err, "Could not listen on %s", addr)
+	defer l.Close()
+	c, err := net.Dial(network, l.Addr().String())
+	rtx.Must(err, "Could not dial")
+	s, err := l.Accept()
+	rtx.Must(err, "Could not accept")
+	return c, s, uint16(c.LocalAddr().(*net.TCPAddr).Port)
+}
+
+// dump returns the messages of the sockets with the local port.
+func dump(family uint8, port uint16) []*netlink.NetlinkMessage {
+	res, err := collector.OneType(family)
+	rtx.Must(err, "Could not dump")
+	var msgs []*netlink.NetlinkMessage
+	for _, m := range res {
+		raw, _ := inetdiag.SplitInetDiagMsg(m.Data)
+		idm, err := raw.Parse()
+		rtx.Must(err, "Could not parse")
+		if idm.ID.SPort() == port {
+			msgs = append(msgs, &netlink.NetlinkMessage{Header: m.Header, Data: m.Data})
+		}
+	}
+	return msgs
+}
+
+// capture returns three snapshots of a loopback connection: idle, after a short
+// write, and after a larger exchange.
+func capture(family uint8, network, addr string) []*netlink.NetlinkMessage {
+	c, s, port := connection(network, addr)
+	defer c.Close()
+	defer s.Close()
+	buf := make([]byte, 100000)
+	msgs := dump(family, port)
+	for _, n := range []int{1000, len(buf)} {
+		_, err := c.Write(buf[:n])
+		rtx.Must(err, "Could not write")
+		_, err = io.ReadFull(s, buf[:n])
+		rtx.Must(err, "Could not read")
+		time.Sleep(10 * time.Millisecond)
+		msgs = append(msgs, dump(family, port)...)
+	}
+	return msgs
+}
+
+// derive returns a copy of msg as the kernel would have sent it.
+func derive(msg *netlink.NetlinkMessage, tcpInfo, maxAttr int) *netlink.NetlinkMessage {
+	raw, attrs := inetdiag.SplitInetDiagMsg(msg.Data)
+	rtas, err := netlink.ParseRouteAttr(attrs)
+	rtx.Must(err, "Could not parse attributes")
+	data := append([]byte{}, raw...)
+	for _, a := range rtas {
+		if int(a.Attr.Type) > maxAttr {
+			continue
+		}
+		v := a.Value
+		if a.Attr.Type == inetdiag.INET_DIAG_INFO && len(v) > tcpInfo {
+			v = v[:tcpInfo]
+		}
+		hdr := make([]byte, netlink.SizeofRtAttr)
+		binary.LittleEndian.PutUint16(hdr[0:2], uint16(netlink.SizeofRtAttr+len(v)))
+		binary.LittleEndian.PutUint16(hdr[2:4], a.Attr.Type)
+		data = append(append(data, hdr...), v...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	out := &netlink.NetlinkMessage{Header: msg.Header, Data: data}
+	out.Header.Len = uint32(syscall.SizeofNlMsghdr + len(data))
+	return out
+}
+
+// write writes the messages, as naked binary netlink messages, to a zstd file.
+func write(name string, msgs []*netlink.NetlinkMessage) {
+	w, err := zstd.NewWriter(name + ".zst")
+	rtx.Must(err, "Could not create %s", name)
+	for _, m := range msgs {
+		rtx.Must(binary.Write(w, binary.LittleEndian, m.Header), "Could not write")
+		_, err = w.Write(m.Data)
+		rtx.Must(err, "Could not write")
+	}
+	rtx.Must(w.Close(), "Could not close %s", name)
+	log.Println("Wrote", len(msgs), "messages to", name)
+}
+
+func main() {
+	flag.Parse()
+	if *name == "" {
+		log.Fatal("-name is required")
+	}
+	msgs := capture(syscall.AF_INET, "tcp4", "127.0.0.1:0")
+	msgs = append(msgs, capture(syscall.AF_INET6, "tcp6", "[::1]:0")...)
+	write(*name, msgs)
+	for _, k := range kernels {
+		var derived []*netlink.NetlinkMessage
+		for _, m := range msgs {
+			derived = append(derived, derive(m, k.tcpInfo, k.maxAttr))
+		}
+		write(k.name, derived)
+	}
+}
@@ -0,0 +1,141 @@
+// Package snmp reads the host-wide TCP MIB counters of the kernel, e.g. the
+// retransmitted segments and the listen queue drops, so that the per-connection
+// snapshots can be interpreted against the congestion and drops of the whole host.
+package snmp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoTable is returned when a counter table is missing from its file.
+var ErrNoTable = errors.New("missing counter table")
+
+// The files the Counters are read from.  These are variables so that tests may
+// replace them.
+var (
+	SNMPFile    = "/proc/net/snmp"
+	NetstatFile = "/proc/net/netstat"
+)
+
+// Counters are the host-wide TCP counters, which are cumulative since boot, except
+// for CurrEstab.  Counters that the kernel does not report are zero.
+type Counters struct {
+	Timestamp time.Time // When the counters were read.
+
+	// From the Tcp table of /proc/net/snmp.
+	ActiveOpens  int64
+	PassiveOpens int64
+	AttemptFails int64
+	EstabResets  int64
+	CurrEstab    int64 // The number of connections currently established.
+	InSegs       int64
+	OutSegs      int64
+	RetransSegs  int64
+	InErrs       int64
+	OutRsts      int64
+
+	// From the TcpExt table of /proc/net/netstat.
+	ListenOverflows   int64
+	ListenDrops       int64
+	TCPTimeouts       int64
+	TCPSynRetrans     int64
+	TCPLostRetransmit int64
+	TCPBacklogDrop    int64
+}
+
+// fields returns the counters of c by table and name.
+func (c *Counters) fields() map[string]map[string]*int64 {
+	return map[string]map[string]*int64{
+		"Tcp": {
+			"ActiveOpens":  &c.ActiveOpens,
+			"PassiveOpens": &c.PassiveOpens,
+			"AttemptFails": &c.AttemptFails,
+			"EstabResets":  &c.EstabResets,
+			"CurrEstab":    &c.CurrEstab,
+			"InSegs":       &c.InSegs,
+			"OutSegs":      &c.OutSegs,
+			"RetransSegs":  &c.RetransSegs,
+			"InErrs":       &c.InErrs,
+			"OutRsts":      &c.OutRsts,
+		},
+		"TcpExt": {
+			"ListenOverflows":   &c.ListenOverflows,
+			"ListenDrops":       &c.ListenDrops,
+			"TCPTimeouts":       &c.TCPTimeouts,
+			"TCPSynRetrans":     &c.TCPSynRetrans,
+			"TCPLostRetransmit": &c.TCPLostRetransmit,
+			"TCPBacklogDrop":    &c.TCPBacklogDrop,
+		},
+	}
+}
+
+// Equal returns true if c and o have the same counts, regardless of when they were
+// read.
+func (c *Counters) Equal(o *Counters) bool {
+	a, b := *c, *o
+	a.Timestamp, b.Timestamp = time.Time{}, time.Time{}
+	return a == b
+}
+
+// Read returns the current Counters.
+func Read() (*Counters, error) {
+	c := &Counters{Timestamp: time.Now()}
+	fields := c.fields()
+	for _, f := range []struct{ file, table string }{{SNMPFile, "Tcp"}, {NetstatFile, "TcpExt"}} {
+		values, err := readTable(f.file, f.table)
+		if err != nil {
+			return nil, err
+		}
+		for name, p := range fields[f.table] {
+			*p = values[name]
+		}
+	}
+	return c, nil
+}
+
+// readTable reads the named table of file, which is a line of counter names,
+// followed by a line of their values, both prefixed by the table name and a colon.
+func readTable(file, table string) (map[string]int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	prefix := table + ":"
+	s := bufio.NewScanner(f)
+	// The TcpExt lines are longer than the default buffer on recent kernels.
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var names []string
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0] != prefix {
+			continue
+		}
+		if names == nil {
+			names = fields[1:]
+			continue
+		}
+		if len(fields)-1 != len(names) {
+			return nil, fmt.Errorf("%s: %s has %d names and %d values", file, table, len(names), len(fields)-1)
+		}
+		values := make(map[string]int64, len(names))
+		for i, name := range names {
+			v, err := strconv.ParseInt(fields[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s %s: %w", file, table, name, err)
+			}
+			values[name] = v
+		}
+		return values, nil
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: %s in %s", ErrNoTable, table, file)
+}
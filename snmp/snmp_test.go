@@ -0,0 +1,93 @@
+package snmp_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/snmp"
+)
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRead")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	defer func(s, n string) {
+		snmp.SNMPFile, snmp.NetstatFile = s, n
+	}(snmp.SNMPFile, snmp.NetstatFile)
+
+	snmp.SNMPFile = filepath.Join(dir, "snmp")
+	snmp.NetstatFile = filepath.Join(dir, "netstat")
+	rtx.Must(ioutil.WriteFile(snmp.SNMPFile, []byte(
+		"Ip: Forwarding DefaultTTL\nIp: 1 64\n"+
+			"Tcp: RtoAlgorithm RtoMin RtoMax MaxConn ActiveOpens PassiveOpens AttemptFails EstabResets CurrEstab InSegs OutSegs RetransSegs InErrs OutRsts InCsumErrors\n"+
+			"Tcp: 1 200 120000 -1 16123 16084 1 31395 2 250025 251369 7 3 15746 0\n"+
+			"Udp: InDatagrams\nUdp: 5\n"), 0644), "Could not write")
+	// TCPBacklogDrop is missing, as on older kernels.
+	rtx.Must(ioutil.WriteFile(snmp.NetstatFile, []byte(
+		"TcpExt: SyncookiesSent ListenOverflows ListenDrops TCPTimeouts TCPSynRetrans TCPLostRetransmit\n"+
+			"TcpExt: 0 4 5 6 8 9\n"+
+			"IpExt: InNoRoutes\nIpExt: 0\n"), 0644), "Could not write")
+
+	c, err := snmp.Read()
+	rtx.Must(err, "Could not read")
+	if c.Timestamp.IsZero() {
+		t.Error("Missing timestamp")
+	}
+	want := snmp.Counters{
+		Timestamp:    c.Timestamp,
+		ActiveOpens:  16123,
+		PassiveOpens: 16084,
+		AttemptFails: 1,
+		EstabResets:  31395,
+		CurrEstab:    2,
+		InSegs:       250025,
+		OutSegs:      251369,
+		RetransSegs:  7,
+		InErrs:       3,
+		OutRsts:      15746,
+
+		ListenOverflows:   4,
+		ListenDrops:       5,
+		TCPTimeouts:       6,
+		TCPSynRetrans:     8,
+		TCPLostRetransmit: 9,
+	}
+	if *c != want {
+		t.Errorf("Read() = %+v, want %+v", *c, want)
+	}
+
+	// Counters read at different times are equal if their counts are.
+	c2, err := snmp.Read()
+	rtx.Must(err, "Could not read")
+	if !c.Equal(c2) {
+		t.Error("Expected equal counters", c, c2)
+	}
+	c2.RetransSegs++
+	if c.Equal(c2) {
+		t.Error("Expected different counters", c, c2)
+	}
+
+	// A missing table is an error.
+	rtx.Must(ioutil.WriteFile(snmp.NetstatFile, []byte("IpExt: InNoRoutes\nIpExt: 0\n"), 0644), "Could not write")
+	if _, err := snmp.Read(); !errors.Is(err, snmp.ErrNoTable) {
+		t.Error("Expected ErrNoTable, got", err)
+	}
+	// As is a malformed one.
+	rtx.Must(ioutil.WriteFile(snmp.NetstatFile, []byte("TcpExt: ListenDrops ListenOverflows\nTcpExt: 1\n"), 0644), "Could not write")
+	if _, err := snmp.Read(); err == nil {
+		t.Error("Expected an error for a short table")
+	}
+	rtx.Must(ioutil.WriteFile(snmp.NetstatFile, []byte("TcpExt: ListenDrops\nTcpExt: x\n"), 0644), "Could not write")
+	if _, err := snmp.Read(); err == nil {
+		t.Error("Expected an error for a bad value")
+	}
+	// And a missing file.
+	rtx.Must(os.Remove(snmp.SNMPFile), "Could not remove")
+	if _, err := snmp.Read(); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/m-lab/go/anonymize"
+
+	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/saver"
+)
+
+var (
+	soakDuration    = flag.Duration("soak.duration", time.Hour, "How long the soak test should run.")
+	soakConnections = flag.Int("soak.connections", 100, "Number of concurrent connections maintained by the soak test.")
+	soakChurn       = flag.Int("soak.churn", 10, "Number of connections the soak test replaces every 100 msec.")
+	soakMaxHeap     = flag.Uint64("soak.max-heap", 512<<20, "Maximum heap in use, in bytes, before the soak test fails.")
+	soakMaxRoutines = flag.Int("soak.max-goroutines", 1000, "Maximum number of goroutines before the soak test fails.")
+	soakMaxFDs      = flag.Int("soak.max-fds", 2048, "Maximum number of open file descriptors before the soak test fails.")
+	soakMaxConns    = flag.Int("soak.max-connections", 0, "Maximum number of connections held by the saver, or its cache, before the soak test fails.  Zero means twice the sum of -soak.connections and -soak.churn, as both ends of each connection are local.")
+)
+
+// soakLimits are the resource ceilings asserted during a soak test.
+type soakLimits struct {
+	Heap       uint64 // Bytes of heap in use.
+	Goroutines int
+	FDs        int // Open file descriptors, including the soak test connections.
+	// Connections held by the saver, by its cache, or as excluded.  Each of them
+	// should follow the number of live connections.  Zero means twice the number of
+	// connections maintained and replaced, as both ends of each connection are local.
+	Connections int
+}
+
+// countFDs returns the number of open file descriptors, or -1 if it can't be determined.
+func countFDs() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// check returns an error if the process currently exceeds any of the limits.
+func (l soakLimits) check() error {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	if ms.HeapInuse > l.Heap {
+		return fmt.Errorf("heap in use %d exceeds %d", ms.HeapInuse, l.Heap)
+	}
+	if n := runtime.NumGoroutine(); n > l.Goroutines {
+		return fmt.Errorf("goroutine count %d exceeds %d", n, l.Goroutines)
+	}
+	if n := countFDs(); n > l.FDs {
+		return fmt.Errorf("open file count %d exceeds %d", n, l.FDs)
+	}
+	return nil
+}
+
+// checkSaver returns an error if the state of the saver exceeds the limits.
+func (l soakLimits) checkSaver(s saver.Sizes) error {
+	if s.Connections > l.Connections {
+		return fmt.Errorf("saver connection count %d exceeds %d", s.Connections, l.Connections)
+	}
+	if s.Cached > l.Connections {
+		return fmt.Errorf("cache size %d exceeds %d", s.Cached, l.Connections)
+	}
+	if s.Excluded > l.Connections {
+		return fmt.Errorf("excluded connection count %d exceeds %d", s.Excluded, l.Connections)
+	}
+	return nil
+}
+
+// soakSaver checks the state of the saver after every polling cycle, in the
+// goroutine that changes it, and reports the first limit exceeded on errC.
+type soakSaver struct {
+	*saver.Saver
+	limits soakLimits
+	errC   chan error
+}
+
+func (s *soakSaver) QueueMessages(msgs netlink.MessageBlock) {
+	s.Saver.QueueMessages(msgs)
+	if err := s.limits.checkSaver(s.Sizes()); err != nil {
+		select {
+		case s.errC <- err:
+		default:
+		}
+	}
+}
+
+// churner maintains a pool of connections to a local echo server, replacing the
+// oldest connections on every step.
+type churner struct {
+	ln    net.Listener
+	conns []net.Conn
+}
+
+func newChurner(ip net.IP) (*churner, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn) // Echo until closed.
+				conn.Close()
+			}()
+		}
+	}()
+	return &churner{ln: ln}, nil
+}
+
+// step closes the oldest replace connections, then opens new connections until
+// there are size connections.
+func (c *churner) step(size, replace int) error {
+	if replace > len(c.conns) {
+		replace = len(c.conns)
+	}
+	for _, conn := range c.conns[:replace] {
+		conn.Close()
+	}
+	c.conns = append(c.conns[:0], c.conns[replace:]...)
+	for len(c.conns) < size {
+		conn, err := net.Dial("tcp", c.ln.Addr().String())
+		if err != nil {
+			return err
+		}
+		c.conns = append(c.conns, conn)
+		_, err = conn.Write([]byte("tcp-info soak"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *churner) close() {
+	c.ln.Close()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+}
+
+// soakTest runs the collector and saver against a continuously churning pool of
+// local connections for the given duration, and returns an error as soon as any
+// of the limits is exceeded.  Output files are written into a temporary directory,
+// which is removed.
+func soakTest(ctx context.Context, duration time.Duration, size, replace int, limits soakLimits) error {
+	ip, err := testAddress()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "tcp-info-soak")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// The saver writes relative to the working directory.
+	if oldDir, err := os.Getwd(); err == nil {
+		defer os.Chdir(oldDir)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		return err
+	}
+
+	c, err := newChurner(ip)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if limits.Connections == 0 {
+		limits.Connections = 2 * (size + replace)
+	}
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	svrChan := make(chan netlink.MessageBlock, 2)
+	svr := saver.NewSaver("soak", "", 3, eventsocket.NullServer(), anonymize.New(anonymize.None))
+	ss := &soakSaver{Saver: svr, limits: limits, errC: make(chan error, 1)}
+	go saver.Serve(ctx, ss, svrChan)
+	col := &collector.Collector{Output: svrChan, Logger: svr}
+	collectorDone := make(chan struct{})
+	go func() {
+		col.Run(ctx)
+		close(svrChan)
+		close(collectorDone)
+	}()
+
+	churnTicker := time.NewTicker(100 * time.Millisecond)
+	defer churnTicker.Stop()
+	checkTicker := time.NewTicker(time.Second)
+	defer checkTicker.Stop()
+	steps := 0
+	for err == nil && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-churnTicker.C:
+			err = c.step(size, replace)
+			steps++
+		case <-checkTicker.C:
+			err = limits.check()
+		case err = <-ss.errC:
+		}
+	}
+	if err == nil {
+		err = limits.check()
+	}
+	cancel()
+	<-collectorDone
+	svr.Done.Wait()
+	if err != nil {
+		return err
+	}
+	log.Println("Soak test completed", steps, "churn steps")
+	return nil
+}
@@ -0,0 +1,68 @@
+package tcp
+
+import (
+	"reflect"
+	"strings"
+)
+
+// The kernel appends new fields to struct tcp_info from time to time, and reports
+// the length of the struct it filled in, so older kernels report shorter structs.
+// LinuxTCPInfo is the longest known struct.  Shorter structs are padded with
+// zeros, and the fields beyond their length are not valid, rather than zero.
+
+// SizeofLinuxTCPInfo is the length of the struct tcp_info that LinuxTCPInfo holds.
+const SizeofLinuxTCPInfo = 232
+
+// Field describes a field of LinuxTCPInfo.
+type Field struct {
+	Name   string // The name of the LinuxTCPInfo field, e.g. "BusyTime".
+	Offset int    // The offset of the field in struct tcp_info.
+	Size   int
+}
+
+// End returns the length of a struct tcp_info that includes the field.
+func (f Field) End() int {
+	return f.Offset + f.Size
+}
+
+// fields are the fields of LinuxTCPInfo, in order.
+var fields = func() []Field {
+	t := reflect.TypeOf(LinuxTCPInfo{})
+	fields := make([]Field, t.NumField())
+	for i := range fields {
+		f := t.Field(i)
+		fields[i] = Field{Name: f.Name, Offset: int(f.Offset), Size: int(f.Type.Size())}
+	}
+	return fields
+}()
+
+// Fields returns the fields of LinuxTCPInfo, in order.
+func Fields() []Field {
+	return append([]Field{}, fields...)
+}
+
+// ValidFields returns the names of the LinuxTCPInfo fields that lie wholly within
+// a struct tcp_info of the given length.
+func ValidFields(length int) []string {
+	var names []string
+	for _, f := range fields {
+		if f.End() > length {
+			break
+		}
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// FieldValid returns whether the named field lies wholly within a struct tcp_info
+// of the given length.  The name is that of the LinuxTCPInfo field, or its csv
+// tag, e.g. "TCP.BusyTime".
+func FieldValid(name string, length int) bool {
+	name = strings.TrimPrefix(name, "TCP.")
+	for _, f := range fields {
+		if f.Name == name {
+			return f.End() <= length
+		}
+	}
+	return false
+}
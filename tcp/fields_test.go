@@ -0,0 +1,61 @@
+package tcp_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func TestFields(t *testing.T) {
+	if tcp.SizeofLinuxTCPInfo != unsafe.Sizeof(tcp.LinuxTCPInfo{}) {
+		t.Error("Wrong SizeofLinuxTCPInfo", unsafe.Sizeof(tcp.LinuxTCPInfo{}))
+	}
+	fields := tcp.Fields()
+	last := fields[len(fields)-1]
+	if fields[0].Name != "State" || last.Name != "SndWnd" || last.End() != tcp.SizeofLinuxTCPInfo {
+		t.Errorf("Wrong fields %+v ... %+v", fields[0], last)
+	}
+	if f := fields[8]; f.Name != "RTO" || f.Offset != 8 || f.Size != 4 {
+		t.Errorf("Wrong RTO field %+v", f)
+	}
+}
+
+func TestValidFields(t *testing.T) {
+	all := len(tcp.Fields())
+	tests := []struct {
+		length int
+		count  int
+		last   string
+	}{
+		{0, 0, ""},
+		{7, 7, "WScale"},
+		{104, 32, "TotalRetrans"}, // linux 3.x
+		{168, 43, "DeliveryRate"}, // linux 4.9
+		{192, 46, "SndBufLimited"},
+		{224, 52, "ReordSeen"},
+		{232, all, "SndWnd"},
+		{280, all, "SndWnd"}, // linux 6.x, with fields LinuxTCPInfo doesn't have.
+	}
+	for _, tt := range tests {
+		got := tcp.ValidFields(tt.length)
+		last := ""
+		if len(got) > 0 {
+			last = got[len(got)-1]
+		}
+		if len(got) != tt.count || last != tt.last {
+			t.Errorf("ValidFields(%d) = %d fields to %q, want %d to %q", tt.length, len(got), last, tt.count, tt.last)
+		}
+	}
+	if diff := deep.Equal(tcp.ValidFields(12), []string{"State", "CAState", "Retransmits", "Probes", "Backoff", "Options", "WScale", "AppLimited", "RTO"}); diff != nil {
+		t.Error(diff)
+	}
+
+	if !tcp.FieldValid("DeliveryRate", 168) || !tcp.FieldValid("TCP.DeliveryRate", 168) {
+		t.Error("DeliveryRate should be valid in linux 4.9")
+	}
+	if tcp.FieldValid("BusyTime", 168) || tcp.FieldValid("NoSuchField", 280) {
+		t.Error("BusyTime should not be valid in linux 4.9")
+	}
+}
@@ -56,81 +56,81 @@ func (x State) String() string {
 // It corresponds to the struct tcp_info in
 // https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/include/uapi/linux/tcp.h
 type LinuxTCPInfo struct {
-	State       uint8 `csv:"TCP.State"`
-	CAState     uint8 `csv:"TCP.CAState"`
-	Retransmits uint8 `csv:"TCP.Retransmits"`
-	Probes      uint8 `csv:"TCP.Probes"`
-	Backoff     uint8 `csv:"TCP.Backoff"`
-	Options     uint8 `csv:"TCP.Options"`
-	WScale      uint8 `csv:"TCP.WScale"`     //snd_wscale : 4, tcpi_rcv_wscale : 4;
-	AppLimited  uint8 `csv:"TCP.AppLimited"` //delivery_rate_app_limited:1;
-
-	RTO    uint32 `csv:"TCP.RTO"` // offset 8
-	ATO    uint32 `csv:"TCP.ATO"`
-	SndMSS uint32 `csv:"TCP.SndMSS"`
-	RcvMSS uint32 `csv:"TCP.RcvMSS"`
-
-	Unacked uint32 `csv:"TCP.Unacked"` // offset 24
-	Sacked  uint32 `csv:"TCP.Sacked"`
-	Lost    uint32 `csv:"TCP.Lost"`
-	Retrans uint32 `csv:"TCP.Retrans"`
-	Fackets uint32 `csv:"TCP.Fackets"`
+	State       uint8 `csv:"TCP.State" kernel:"tcpi_state"`
+	CAState     uint8 `csv:"TCP.CAState" kernel:"tcpi_ca_state"`
+	Retransmits uint8 `csv:"TCP.Retransmits" kernel:"tcpi_retransmits"`
+	Probes      uint8 `csv:"TCP.Probes" kernel:"tcpi_probes"`
+	Backoff     uint8 `csv:"TCP.Backoff" kernel:"tcpi_backoff"`
+	Options     uint8 `csv:"TCP.Options" kernel:"tcpi_options"`
+	WScale      uint8 `csv:"TCP.WScale" kernel:"tcpi_snd_wscale,tcpi_rcv_wscale"`    //snd_wscale : 4, tcpi_rcv_wscale : 4;
+	AppLimited  uint8 `csv:"TCP.AppLimited" kernel:"tcpi_delivery_rate_app_limited"` //delivery_rate_app_limited:1;
+
+	RTO    uint32 `csv:"TCP.RTO" units:"us" kernel:"tcpi_rto"` // offset 8
+	ATO    uint32 `csv:"TCP.ATO" units:"us" kernel:"tcpi_ato"`
+	SndMSS uint32 `csv:"TCP.SndMSS" units:"bytes" kernel:"tcpi_snd_mss"`
+	RcvMSS uint32 `csv:"TCP.RcvMSS" units:"bytes" kernel:"tcpi_rcv_mss"`
+
+	Unacked uint32 `csv:"TCP.Unacked" units:"packets" kernel:"tcpi_unacked"` // offset 24
+	Sacked  uint32 `csv:"TCP.Sacked" units:"packets" kernel:"tcpi_sacked"`
+	Lost    uint32 `csv:"TCP.Lost" units:"packets" kernel:"tcpi_lost"`
+	Retrans uint32 `csv:"TCP.Retrans" units:"packets" kernel:"tcpi_retrans"`
+	Fackets uint32 `csv:"TCP.Fackets" units:"packets" kernel:"tcpi_fackets"`
 
 	/* Times. */
 	// These seem to be elapsed time, so they increase on almost every sample.
 	// We can probably use them to get more info about intervals between samples.
-	LastDataSent uint32 `csv:"TCP.LastDataSent"` // offset 44
-	LastAckSent  uint32 `csv:"TCP.LastAckSent"`  /* Not remembered, sorry. */ // offset 48
-	LastDataRecv uint32 `csv:"TCP.LastDataRecv"` // offset 52
-	LastAckRecv  uint32 `csv:"TCP.LastDataRecv"` // offset 56
+	LastDataSent uint32 `csv:"TCP.LastDataSent" units:"ms" kernel:"tcpi_last_data_sent"` // offset 44
+	LastAckSent  uint32 `csv:"TCP.LastAckSent" units:"ms" kernel:"tcpi_last_ack_sent"`   /* Not remembered, sorry. */ // offset 48
+	LastDataRecv uint32 `csv:"TCP.LastDataRecv" units:"ms" kernel:"tcpi_last_data_recv"` // offset 52
+	LastAckRecv  uint32 `csv:"TCP.LastDataRecv" units:"ms" kernel:"tcpi_last_ack_recv"`  // offset 56
 
 	/* Metrics. */
-	PMTU        uint32 `csv:"TCP.PMTU"`
-	RcvSsThresh uint32 `csv:"TCP.RcvSsThresh"`
-	RTT         uint32 `csv:"TCP.RTT"`
-	RTTVar      uint32 `csv:"TCP.RTTVar"`
-	SndSsThresh uint32 `csv:"TCP.SndSsThresh"`
-	SndCwnd     uint32 `csv:"TCP.SndCwnd"`
-	AdvMSS      uint32 `csv:"TCP.AdvMSS"`
-	Reordering  uint32 `csv:"TCP.Reordering"`
+	PMTU        uint32 `csv:"TCP.PMTU" units:"bytes" kernel:"tcpi_pmtu"`
+	RcvSsThresh uint32 `csv:"TCP.RcvSsThresh" units:"bytes" kernel:"tcpi_rcv_ssthresh"`
+	RTT         uint32 `csv:"TCP.RTT" units:"us" kernel:"tcpi_rtt"`
+	RTTVar      uint32 `csv:"TCP.RTTVar" units:"us" kernel:"tcpi_rttvar"`
+	SndSsThresh uint32 `csv:"TCP.SndSsThresh" units:"packets" kernel:"tcpi_snd_ssthresh"`
+	SndCwnd     uint32 `csv:"TCP.SndCwnd" units:"packets" kernel:"tcpi_snd_cwnd"`
+	AdvMSS      uint32 `csv:"TCP.AdvMSS" units:"bytes" kernel:"tcpi_advmss"`
+	Reordering  uint32 `csv:"TCP.Reordering" units:"packets" kernel:"tcpi_reordering"`
 
-	RcvRTT   uint32 `csv:"TCP.RcvRTT"`
-	RcvSpace uint32 `csv:"TCP.RcvSpace"`
+	RcvRTT   uint32 `csv:"TCP.RcvRTT" units:"us" kernel:"tcpi_rcv_rtt"`
+	RcvSpace uint32 `csv:"TCP.RcvSpace" units:"bytes" kernel:"tcpi_rcv_space"`
 
-	TotalRetrans uint32 `csv:"TCP.TotalRetrans"`
+	TotalRetrans uint32 `csv:"TCP.TotalRetrans" units:"packets" kernel:"tcpi_total_retrans"`
 
-	PacingRate    int64 `csv:"TCP.PacingRate"`    // This is often -1, so better for it to be signed
-	MaxPacingRate int64 `csv:"TCP.MaxPacingRate"` // This is often -1, so better to be signed.
+	PacingRate    int64 `csv:"TCP.PacingRate" units:"bytes/s" kernel:"tcpi_pacing_rate"`        // This is often -1, so better for it to be signed
+	MaxPacingRate int64 `csv:"TCP.MaxPacingRate" units:"bytes/s" kernel:"tcpi_max_pacing_rate"` // This is often -1, so better to be signed.
 
 	// NOTE: In linux, these are uint64, but we make them int64 here for compatibility with BigQuery
-	BytesAcked    int64 `csv:"TCP.BytesAcked"`    /* RFC4898 tcpEStatsAppHCThruOctetsAcked */
-	BytesReceived int64 `csv:"TCP.BytesReceived"` /* RFC4898 tcpEStatsAppHCThruOctetsReceived */
-	SegsOut       int32 `csv:"TCP.SegsOut"`       /* RFC4898 tcpEStatsPerfSegsOut */
-	SegsIn        int32 `csv:"TCP.SegsIn"`        /* RFC4898 tcpEStatsPerfSegsIn */
+	BytesAcked    int64 `csv:"TCP.BytesAcked" units:"bytes" kernel:"tcpi_bytes_acked"`       /* RFC4898 tcpEStatsAppHCThruOctetsAcked */
+	BytesReceived int64 `csv:"TCP.BytesReceived" units:"bytes" kernel:"tcpi_bytes_received"` /* RFC4898 tcpEStatsAppHCThruOctetsReceived */
+	SegsOut       int32 `csv:"TCP.SegsOut" units:"segments" kernel:"tcpi_segs_out"`          /* RFC4898 tcpEStatsPerfSegsOut */
+	SegsIn        int32 `csv:"TCP.SegsIn" units:"segments" kernel:"tcpi_segs_in"`            /* RFC4898 tcpEStatsPerfSegsIn */
 
-	NotsentBytes uint32 `csv:"TCP.NotsentBytes"`
-	MinRTT       uint32 `csv:"TCP.MinRTT"`
-	DataSegsIn   uint32 `csv:"TCP.DataSegsIn"`  /* RFC4898 tcpEStatsDataSegsIn */
-	DataSegsOut  uint32 `csv:"TCP.DataSegsOut"` /* RFC4898 tcpEStatsDataSegsOut */
+	NotsentBytes uint32 `csv:"TCP.NotsentBytes" units:"bytes" kernel:"tcpi_notsent_bytes"`
+	MinRTT       uint32 `csv:"TCP.MinRTT" units:"us" kernel:"tcpi_min_rtt"`
+	DataSegsIn   uint32 `csv:"TCP.DataSegsIn" units:"segments" kernel:"tcpi_data_segs_in"`   /* RFC4898 tcpEStatsDataSegsIn */
+	DataSegsOut  uint32 `csv:"TCP.DataSegsOut" units:"segments" kernel:"tcpi_data_segs_out"` /* RFC4898 tcpEStatsDataSegsOut */
 
 	// NOTE: In linux, this is uint64, but we make it int64 here for compatibility with BigQuery
-	DeliveryRate int64 `csv:"TCP.DeliveryRate"`
+	DeliveryRate int64 `csv:"TCP.DeliveryRate" units:"bytes/s" kernel:"tcpi_delivery_rate"`
 
-	BusyTime      int64 `csv:"TCP.BusyTime"`      /* Time (usec) busy sending data */
-	RWndLimited   int64 `csv:"TCP.RWndLimited"`   /* Time (usec) limited by receive window */
-	SndBufLimited int64 `csv:"TCP.SndBufLimited"` /* Time (usec) limited by send buffer */
+	BusyTime      int64 `csv:"TCP.BusyTime" units:"us" kernel:"tcpi_busy_time"`           /* Time (usec) busy sending data */
+	RWndLimited   int64 `csv:"TCP.RWndLimited" units:"us" kernel:"tcpi_rwnd_limited"`     /* Time (usec) limited by receive window */
+	SndBufLimited int64 `csv:"TCP.SndBufLimited" units:"us" kernel:"tcpi_sndbuf_limited"` /* Time (usec) limited by send buffer */
 
-	Delivered   uint32 `csv:"TCP.Delivered"`
-	DeliveredCE uint32 `csv:"TCP.DeliveredCE"`
+	Delivered   uint32 `csv:"TCP.Delivered" units:"packets" kernel:"tcpi_delivered"`
+	DeliveredCE uint32 `csv:"TCP.DeliveredCE" units:"packets" kernel:"tcpi_delivered_ce"`
 
 	// NOTE: In linux, these are uint64, but we make them int64 here for compatibility with BigQuery
-	BytesSent    int64 `csv:"TCP.BytesSent"`    /* RFC4898 tcpEStatsPerfHCDataOctetsOut */
-	BytesRetrans int64 `csv:"TCP.BytesRetrans"` /* RFC4898 tcpEStatsPerfOctetsRetrans */
+	BytesSent    int64 `csv:"TCP.BytesSent" units:"bytes" kernel:"tcpi_bytes_sent"`       /* RFC4898 tcpEStatsPerfHCDataOctetsOut */
+	BytesRetrans int64 `csv:"TCP.BytesRetrans" units:"bytes" kernel:"tcpi_bytes_retrans"` /* RFC4898 tcpEStatsPerfOctetsRetrans */
 
-	DSackDups uint32 `csv:"TCP.DSackDups"` /* RFC4898 tcpEStatsStackDSACKDups */
-	ReordSeen uint32 `csv:"TCP.ReordSeen"` /* reordering events seen */
+	DSackDups uint32 `csv:"TCP.DSackDups" units:"packets" kernel:"tcpi_dsack_dups"` /* RFC4898 tcpEStatsStackDSACKDups */
+	ReordSeen uint32 `csv:"TCP.ReordSeen" kernel:"tcpi_reord_seen"`                 /* reordering events seen */
 
-	RcvOooPack uint32 `csv:"TCP.RcvOooPack"` /* Out-of-order packets received */
+	RcvOooPack uint32 `csv:"TCP.RcvOooPack" units:"packets" kernel:"tcpi_rcv_ooopack"` /* Out-of-order packets received */
 
-	SndWnd uint32 `csv:"TCP.SndWnd"` /* peer's advertised receive window after scaling (bytes) */
+	SndWnd uint32 `csv:"TCP.SndWnd" units:"bytes" kernel:"tcpi_snd_wnd"` /* peer's advertised receive window after scaling (bytes) */
 }
@@ -35,3 +35,27 @@ func TestState_String(t *testing.T) {
 		})
 	}
 }
+
+func TestValidTransition(t *testing.T) {
+	tests := []struct {
+		from, to tcp.State
+		want     bool
+	}{
+		{tcp.ESTABLISHED, tcp.ESTABLISHED, true},
+		{tcp.SYN_SENT, tcp.ESTABLISHED, true},
+		{tcp.ESTABLISHED, tcp.TIME_WAIT, true}, // Via FIN_WAIT1, which may not be observed.
+		{tcp.ESTABLISHED, tcp.LAST_ACK, true},
+		{tcp.FIN_WAIT1, tcp.CLOSE, true},
+		{tcp.TIME_WAIT, tcp.ESTABLISHED, false},
+		{tcp.CLOSE, tcp.SYN_SENT, false},
+		{tcp.ESTABLISHED, tcp.SYN_RECV, false},
+		{tcp.CLOSE_WAIT, tcp.FIN_WAIT2, false},
+		{tcp.INVALID, tcp.ESTABLISHED, false},
+		{tcp.ESTABLISHED, tcp.State(99), false},
+	}
+	for _, tt := range tests {
+		if got := tcp.ValidTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("ValidTransition(%v, %v) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package tcp
+
+// next lists the states a connection may move to directly from each state,
+// following RFC 793 and the Linux implementation.  CLOSE is terminal, since
+// sockets in CLOSE state are not hashed, and so are not reported again even if
+// they are reused.
+var next = map[State][]State{
+	ESTABLISHED: {FIN_WAIT1, CLOSE_WAIT, CLOSE},
+	SYN_SENT:    {ESTABLISHED, SYN_RECV, CLOSE},
+	SYN_RECV:    {ESTABLISHED, FIN_WAIT1, CLOSE},
+	FIN_WAIT1:   {FIN_WAIT2, CLOSING, TIME_WAIT, CLOSE},
+	FIN_WAIT2:   {TIME_WAIT, CLOSE},
+	TIME_WAIT:   {CLOSE},
+	CLOSE:       {},
+	CLOSE_WAIT:  {LAST_ACK, CLOSE},
+	LAST_ACK:    {CLOSE},
+	LISTEN:      {SYN_SENT, CLOSE},
+	CLOSING:     {TIME_WAIT, CLOSE},
+}
+
+// reachable[from][to] is true if a connection in state from may later be
+// observed in state to.  Because connections are polled, intermediate states
+// may not be observed, so this is the transitive closure of next.
+var reachable = func() map[State]map[State]bool {
+	r := make(map[State]map[State]bool, len(next))
+	for from := range next {
+		seen := map[State]bool{from: true}
+		stack := []State{from}
+		for len(stack) > 0 {
+			s := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, n := range next[s] {
+				if !seen[n] {
+					seen[n] = true
+					stack = append(stack, n)
+				}
+			}
+		}
+		r[from] = seen
+	}
+	return r
+}()
+
+// ValidTransition returns true if a connection observed in state from may be
+// observed in state to in a later snapshot.  Transitions from or to unknown states
+// are considered invalid.
+func ValidTransition(from, to State) bool {
+	return reachable[from][to]
+}
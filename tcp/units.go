@@ -0,0 +1,90 @@
+package tcp
+
+import (
+	"math"
+	"time"
+)
+
+// The fields of struct tcp_info mix units: times in microseconds, e.g. RTT, or in
+// milliseconds, e.g. LastDataSent, and sizes in bytes, or in packets or segments.
+// The units of each LinuxTCPInfo field are in its units tag.  Normalized converts
+// the times to time.Durations, and the rates to Rates, so that analyses need not
+// remember which field has which units.
+
+// Rate is a rate in bytes per second.
+type Rate float64
+
+// Unlimited is the Rate of a PacingRate or MaxPacingRate that is not limited, which
+// the kernel reports as ~0.
+var Unlimited = Rate(math.Inf(1))
+
+// BitsPerSecond returns the rate in bits per second.
+func (r Rate) BitsPerSecond() float64 {
+	return float64(r) * 8
+}
+
+// NormalizedTCPInfo is a LinuxTCPInfo with its times as time.Durations, and its
+// rates as Rates.  The other fields are already in bytes, or in packets or
+// segments, so they are only in Raw, which holds the raw values of all the fields.
+type NormalizedTCPInfo struct {
+	Raw LinuxTCPInfo
+
+	RTO time.Duration
+	ATO time.Duration
+
+	LastDataSent time.Duration
+	LastAckSent  time.Duration
+	LastDataRecv time.Duration
+	LastAckRecv  time.Duration
+
+	RTT    time.Duration
+	RTTVar time.Duration
+	RcvRTT time.Duration
+	MinRTT time.Duration
+
+	BusyTime      time.Duration
+	RWndLimited   time.Duration
+	SndBufLimited time.Duration
+
+	PacingRate    Rate
+	MaxPacingRate Rate
+	DeliveryRate  Rate
+}
+
+// pacingRate returns the Rate of a pacing rate, which is ~0 if it is unlimited.
+func pacingRate(r int64) Rate {
+	if r == -1 {
+		return Unlimited
+	}
+	return Rate(r)
+}
+
+// Normalized returns the fields of info in normalized units.
+func (info *LinuxTCPInfo) Normalized() NormalizedTCPInfo {
+	us := func(v uint32) time.Duration { return time.Duration(v) * time.Microsecond }
+	ms := func(v uint32) time.Duration { return time.Duration(v) * time.Millisecond }
+	return NormalizedTCPInfo{
+		Raw: *info,
+
+		RTO: us(info.RTO),
+		ATO: us(info.ATO),
+
+		LastDataSent: ms(info.LastDataSent),
+		LastAckSent:  ms(info.LastAckSent),
+		LastDataRecv: ms(info.LastDataRecv),
+		LastAckRecv:  ms(info.LastAckRecv),
+
+		RTT:    us(info.RTT),
+		RTTVar: us(info.RTTVar),
+		RcvRTT: us(info.RcvRTT),
+		MinRTT: us(info.MinRTT),
+
+		BusyTime:      time.Duration(info.BusyTime) * time.Microsecond,
+		RWndLimited:   time.Duration(info.RWndLimited) * time.Microsecond,
+		SndBufLimited: time.Duration(info.SndBufLimited) * time.Microsecond,
+
+		PacingRate:    pacingRate(info.PacingRate),
+		MaxPacingRate: pacingRate(info.MaxPacingRate),
+		DeliveryRate:  Rate(info.DeliveryRate),
+	}
+}
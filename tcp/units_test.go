@@ -0,0 +1,44 @@
+package tcp_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func TestNormalized(t *testing.T) {
+	info := tcp.LinuxTCPInfo{RTT: 12500, LastDataSent: 30, BusyTime: 2000000, PacingRate: -1, MaxPacingRate: 1000, DeliveryRate: 125000, SndCwnd: 10}
+	n := info.Normalized()
+	if n.RTT != 12500*time.Microsecond || n.LastDataSent != 30*time.Millisecond || n.BusyTime != 2*time.Second {
+		t.Errorf("Wrong times %v %v %v", n.RTT, n.LastDataSent, n.BusyTime)
+	}
+	if n.PacingRate != tcp.Unlimited || n.MaxPacingRate != 1000 || n.DeliveryRate.BitsPerSecond() != 1e6 {
+		t.Errorf("Wrong rates %v %v %v", n.PacingRate, n.MaxPacingRate, n.DeliveryRate)
+	}
+	if n.Raw != info {
+		t.Error("The raw values should be preserved")
+	}
+}
+
+// Every field with units of time or rate is normalized.
+func TestNormalizedFields(t *testing.T) {
+	raw := reflect.TypeOf(tcp.LinuxTCPInfo{})
+	norm := reflect.TypeOf(tcp.NormalizedTCPInfo{})
+	want := map[string]reflect.Type{
+		"us":      reflect.TypeOf(time.Duration(0)),
+		"ms":      reflect.TypeOf(time.Duration(0)),
+		"bytes/s": reflect.TypeOf(tcp.Rate(0)),
+	}
+	for i := 0; i < raw.NumField(); i++ {
+		f := raw.Field(i)
+		typ, ok := want[f.Tag.Get("units")]
+		if !ok {
+			continue
+		}
+		if nf, ok := norm.FieldByName(f.Name); !ok || nf.Type != typ {
+			t.Errorf("NormalizedTCPInfo.%s should be a %v", f.Name, typ)
+		}
+	}
+}
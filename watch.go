@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/m-lab/tcp-info/manifest"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/watch"
+)
+
+var (
+	watchCommand  = flag.String("watch.command", "", "Command run by \"tcp-info watch\" for each finalized file, e.g. \"gsutil cp {} gs://bucket/{}\".  Each {} is replaced by the path of the file under -output, which is appended if there is no {}.")
+	watchPattern  = flag.String("watch.pattern", "*.jsonl.zst", "Pattern of the names of the files exported by \"tcp-info watch\".")
+	watchParallel = flag.Int("watch.parallel", 4, "Maximum number of -watch.command processes run concurrently.")
+	watchManifest = flag.Bool("watch.manifest", false, "Append the size and SHA256 of each finalized file to the manifest of its directory, before running -watch.command.")
+)
+
+// ErrNoCommand is returned when "tcp-info watch" has no export command.
+var ErrNoCommand = errors.New("-watch.command is required")
+
+// exportCommand returns the command exporting the file at path, with each {} in
+// command replaced by path, or with path appended if there is no {}.
+func exportCommand(command []string, path string) *exec.Cmd {
+	args := make([]string, 0, len(command)+1)
+	replaced := false
+	for _, arg := range command[1:] {
+		if strings.Contains(arg, "{}") {
+			arg = strings.ReplaceAll(arg, "{}", path)
+			replaced = true
+		}
+		args = append(args, arg)
+	}
+	if !replaced {
+		args = append(args, path)
+	}
+	return exec.Command(command[0], args...)
+}
+
+// export runs the export command for one file, and logs any failure.
+func export(command []string, path string) {
+	out, err := exportCommand(command, path).CombinedOutput()
+	if err != nil {
+		log.Println("Could not export", path, err, strings.TrimSpace(string(out)))
+		metrics.ExportFileCount.WithLabelValues("error").Inc()
+		return
+	}
+	metrics.ExportFileCount.WithLabelValues("ok").Inc()
+}
+
+// runWatch runs command for each file matching pattern that is finalized under
+// root, with up to parallel commands at once, until ctx is cancelled.  Commands
+// already queued are completed before it returns.  If withManifest is true, each
+// file is first added to the manifest of its directory.
+func runWatch(ctx context.Context, root string, command []string, pattern string, parallel int, withManifest bool) error {
+	if len(command) == 0 {
+		return ErrNoCommand
+	}
+	w, err := watch.New(root)
+	if err != nil {
+		return err
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	files := make(chan string, 1024)
+	wg := sync.WaitGroup{}
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				export(command, path)
+			}
+		}()
+	}
+	log.Println("Exporting files finalized under", root, "with", command)
+	err = w.Run(ctx, pattern, func(path string) {
+		// The manifest itself may match the pattern, and is exported without
+		// adding it to itself.
+		if withManifest && filepath.Base(path) != manifest.FileName {
+			err := manifest.Append(path)
+			if err != nil {
+				log.Println("Could not add", path, "to the manifest", err)
+			}
+		}
+		files <- path
+	})
+	close(files)
+	wg.Wait()
+	return err
+}
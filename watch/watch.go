@@ -0,0 +1,13 @@
+// Package watch watches the archive tree written by tcp-info, and reports each
+// file as soon as it is finalized, so that files can be converted or uploaded
+// with low latency, instead of by periodic batch jobs.
+//
+// A file is finalized when it is closed after writing, or moved into the tree.
+// Each connection file, and each daily file, is written once, and never
+// reopened, so each file is reported once.
+package watch
+
+import "errors"
+
+// ErrUnsupported is returned on platforms without inotify.
+var ErrUnsupported = errors.New("watching is only supported on Linux")
@@ -0,0 +1,16 @@
+package watch
+
+import "context"
+
+// Watcher does nothing, but needed for compiling on Darwin.
+type Watcher struct{}
+
+// New returns ErrUnsupported on Darwin.
+func New(root string) (*Watcher, error) {
+	return nil, ErrUnsupported
+}
+
+// Run returns ErrUnsupported on Darwin.
+func (w *Watcher) Run(ctx context.Context, pattern string, found func(path string)) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,129 @@
+package watch
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The events watched in each directory.  New directories are reported by
+// IN_CREATE, and finalized files by IN_CLOSE_WRITE or IN_MOVED_TO.
+const mask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// Watcher watches all the directories of a tree with inotify.
+type Watcher struct {
+	fd   int
+	file *os.File
+	dirs map[int32]string // The directory of each watch descriptor.
+}
+
+// New creates a Watcher for the tree under root, which watches all the existing
+// directories when it returns.
+func New(root string) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// The file is non-blocking, so reads use the runtime poller, and Close
+	// interrupts a pending Read.
+	w := &Watcher{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), dirs: map[int32]string{}}
+	err = w.addTree(root)
+	if err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// addTree watches dir, and all the directories under it.
+func (w *Watcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, mask)
+		if err != nil {
+			return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+// Run calls found with the path of each finalized file whose name matches
+// pattern, until ctx is cancelled.  Directories created in the tree, e.g. for a
+// new day, are watched as soon as they are reported.  A file that is closed
+// before its new directory is watched is missed, but the saver creates each
+// file immediately after its directory, and keeps it open while the connection
+// is open.  Run closes the Watcher when it returns.
+func (w *Watcher) Run(ctx context.Context, pattern string, found func(path string)) error {
+	defer w.file.Close()
+	_, err := filepath.Match(pattern, "")
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		w.file.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += unix.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+int(ev.Len)]), "\x00")
+			off += int(ev.Len)
+			w.handle(ev.Wd, ev.Mask, name, pattern, found)
+		}
+	}
+}
+
+func (w *Watcher) handle(wd int32, evMask uint32, name string, pattern string, found func(path string)) {
+	if evMask&unix.IN_Q_OVERFLOW != 0 {
+		log.Println("Inotify queue overflowed, so some finalized files were missed")
+		return
+	}
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return
+	}
+	if evMask&unix.IN_IGNORED != 0 {
+		// The directory was removed.
+		delete(w.dirs, wd)
+		return
+	}
+	path := filepath.Join(dir, name)
+	if evMask&unix.IN_ISDIR != 0 {
+		if evMask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			err := w.addTree(path)
+			if err != nil {
+				log.Println("Could not watch", path, err)
+			}
+		}
+		return
+	}
+	if evMask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) == 0 {
+		return
+	}
+	if ok, _ := filepath.Match(pattern, name); ok {
+		found(path)
+	}
+}
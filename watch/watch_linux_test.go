@@ -0,0 +1,93 @@
+package watch_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/watch"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWatcher")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.MkdirAll(filepath.Join(dir, "2019/03/31"), 0777), "Could not mkdir")
+
+	w, err := watch.New(dir)
+	rtx.Must(err, "Could not create watcher")
+	ctx, cancel := context.WithCancel(context.Background())
+	found := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx, "*.jsonl.zst", func(path string) { found <- path })
+	}()
+	next := func() string {
+		select {
+		case path := <-found:
+			rel, err := filepath.Rel(dir, path)
+			rtx.Must(err, "Bad path %s", path)
+			return rel
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a file")
+			return ""
+		}
+	}
+
+	// Files in existing directories.
+	rtx.Must(ioutil.WriteFile(filepath.Join(dir, "2019/03/31/a.00000.jsonl.zst"), nil, 0666), "Could not write")
+	rtx.Must(ioutil.WriteFile(filepath.Join(dir, "2019/03/31/ignored.txt"), nil, 0666), "Could not write")
+	if f := next(); f != "2019/03/31/a.00000.jsonl.zst" {
+		t.Error("Wrong file", f)
+	}
+
+	// Files in a new tree of directories, once they are watched.
+	day := filepath.Join(dir, "2019/04/01")
+	rtx.Must(os.MkdirAll(day, 0777), "Could not mkdir")
+	for i := 0; ; i++ {
+		canary := fmt.Sprintf("canary%d.jsonl.zst", i)
+		rtx.Must(ioutil.WriteFile(filepath.Join(day, canary), nil, 0666), "Could not write")
+		select {
+		case <-found:
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	tmp := filepath.Join(dir, "b.tmp")
+	rtx.Must(ioutil.WriteFile(tmp, nil, 0666), "Could not write")
+	rtx.Must(os.Rename(tmp, filepath.Join(day, "b.00000.jsonl.zst")), "Could not rename")
+	if f := next(); f != "2019/04/01/b.00000.jsonl.zst" {
+		t.Error("Wrong file", f)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error("Run should return nil when cancelled, not", err)
+	}
+	select {
+	case f := <-found:
+		t.Error("Unexpected file", f)
+	default:
+	}
+}
+
+func TestBadPattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBadPattern")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	w, err := watch.New(dir)
+	rtx.Must(err, "Could not create watcher")
+	if w.Run(context.Background(), "[", func(string) {}) == nil {
+		t.Error("Run should fail with a bad pattern")
+	}
+	if _, err := watch.New("/does/not/exist"); err == nil {
+		t.Error("New should fail for a missing directory")
+	}
+}
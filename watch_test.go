@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/manifest"
+)
+
+func TestExportCommand(t *testing.T) {
+	cmd := exportCommand([]string{"gsutil", "cp", "{}", "gs://bucket/{}"}, "2019/04/01/a.jsonl.zst")
+	want := []string{"gsutil", "cp", "2019/04/01/a.jsonl.zst", "gs://bucket/2019/04/01/a.jsonl.zst"}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("Args %v, want %v", cmd.Args, want)
+	}
+	cmd = exportCommand([]string{"arrowtool"}, "a.jsonl.zst")
+	want = []string{"arrowtool", "a.jsonl.zst"}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("Args %v, want %v", cmd.Args, want)
+	}
+}
+
+func TestRunWatch(t *testing.T) {
+	if runWatch(context.Background(), ".", nil, "*", 1, false) != ErrNoCommand {
+		t.Error("Should require a command")
+	}
+
+	dir, err := ioutil.TempDir("", "TestRunWatch")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	rtx.Must(os.Mkdir(src, 0777), "Could not mkdir")
+	rtx.Must(os.Mkdir(dst, 0777), "Could not mkdir")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- runWatch(ctx, src, []string{"cp", "{}", dst}, "*.jsonl.zst", 2, true)
+	}()
+	// runWatch starts watching asynchronously, so write the file until it is copied.
+	start := time.Now()
+	for {
+		rtx.Must(ioutil.WriteFile(filepath.Join(src, "a.00000.jsonl.zst"), []byte("data"), 0666), "Could not write")
+		time.Sleep(10 * time.Millisecond)
+		if _, err := os.Stat(filepath.Join(dst, "a.00000.jsonl.zst")); err == nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The file was not exported")
+		}
+	}
+	rtx.Must(ioutil.WriteFile(filepath.Join(src, "b.txt"), nil, 0666), "Could not write")
+	cancel()
+	rtx.Must(<-done, "runWatch failed")
+	if _, err := os.Stat(filepath.Join(dst, "b.txt")); err == nil {
+		t.Error("b.txt should not have been exported")
+	}
+	entries, err := manifest.Load(src)
+	rtx.Must(err, "Could not load manifest")
+	if entries["a.00000.jsonl.zst"].Size != 4 || len(entries) != 1 {
+		t.Errorf("Wrong manifest %+v", entries)
+	}
+}
@@ -0,0 +1,158 @@
+package zstd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	kzstd "github.com/klauspost/compress/zstd"
+
+	"github.com/m-lab/tcp-info/fault"
+)
+
+// DefaultFrameSize is the default number of uncompressed bytes buffered by an
+// in-process writer before they are compressed.
+const DefaultFrameSize = 64 * 1024
+
+// The encoder shared by all in-process writers.  EncodeAll is safe for concurrent
+// use, and the encoder holds at most GOMAXPROCS sets of compression state, no
+// matter how many writers are open.
+var (
+	sharedEncoder     *kzstd.Encoder
+	sharedEncoderOnce sync.Once
+)
+
+func encoder() *kzstd.Encoder {
+	sharedEncoderOnce.Do(func() {
+		var err error
+		sharedEncoder, err = kzstd.NewWriter(nil,
+			kzstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0)),
+			kzstd.WithEncoderLevel(kzstd.SpeedDefault),
+			kzstd.WithWindowSize(256*1024),
+			kzstd.WithLowerEncoderMem(true))
+		if err != nil {
+			panic(err) // Only possible with invalid options.
+		}
+	})
+	return sharedEncoder
+}
+
+// inProcessWriter compresses into a file without an external process.  Writes
+// are buffered up to frameSize bytes, and each full buffer is compressed by the
+// shared encoder as an independent zstd frame.  A sequence of frames is a valid
+// zstd stream, so the files can be read by any zstd decoder.
+//
+// The memory used by each writer is bounded by its frame buffer, plus a small
+// file buffer, independent of the compressor state.
+type inProcessWriter struct {
+	f    io.Closer // The file, or nil if the writer does not own its output.
+	out  *bufio.Writer
+	buf  []byte
+	size int
+}
+
+// NewInProcessWriter creates a writer that compresses in process, and writes to
+// filename.  Uncompressed data is buffered, and compressed in frames of up to
+// frameSize bytes.  A frameSize of zero or less uses DefaultFrameSize.  It is not
+// safe for concurrent use.
+func NewInProcessWriter(filename string, frameSize int) (io.WriteCloser, error) {
+	if frameSize <= 0 {
+		frameSize = DefaultFrameSize
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &inProcessWriter{f: f, out: bufio.NewWriterSize(f, 4096), size: frameSize}, nil
+}
+
+// NewInProcessStreamWriter creates a writer like NewInProcessWriter, that writes
+// the compressed frames to w instead of to a file.  Close does not close w.
+func NewInProcessStreamWriter(w io.Writer, frameSize int) io.WriteCloser {
+	if frameSize <= 0 {
+		frameSize = DefaultFrameSize
+	}
+	return &inProcessWriter{out: bufio.NewWriterSize(w, 4096), size: frameSize}
+}
+
+// dstPool holds buffers for compressed frames, shared by all writers.
+var dstPool = sync.Pool{New: func() interface{} { return make([]byte, 0, DefaultFrameSize/2) }}
+
+func (w *inProcessWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	fault.Sleep(fault.Compress)
+	dst := encoder().EncodeAll(w.buf, dstPool.Get().([]byte)[:0])
+	_, err := w.out.Write(dst)
+	dstPool.Put(dst[:0])
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *inProcessWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.size)
+		}
+		k := w.size - len(w.buf)
+		if k > len(b) {
+			k = len(b)
+		}
+		w.buf = append(w.buf, b[:k]...)
+		b = b[k:]
+		n += k
+		if len(w.buf) >= w.size {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close compresses any buffered data, and closes the file.
+func (w *inProcessWriter) Close() error {
+	err := w.flush()
+	if err == nil {
+		err = w.out.Flush()
+	}
+	if w.f == nil {
+		return err
+	}
+	closeErr := w.f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// fileReadCloser closes both the decoder and the file.
+type fileReadCloser struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (r fileReadCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.f.Close()
+}
+
+// NewInProcessReader returns a reader that decompresses filename without an
+// external process.  Unlike NewReader, errors, including a truncated file, are
+// returned to the caller, after all data that could be decoded has been read.
+func NewInProcessReader(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	d, err := kzstd.NewReader(f, kzstd.WithDecoderConcurrency(1), kzstd.WithDecoderLowmem(true))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fileReadCloser{d.IOReadCloser(), f}, nil
+}
@@ -2,13 +2,17 @@
 package zstd
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"sync"
+	"sync/atomic"
 
 	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/fault"
 )
 
 // Variables to allow whitebox mocking for testing error conditions.
@@ -42,27 +46,69 @@ func NewReader(filename string) io.ReadCloser {
 	return pipeR
 }
 
-type waitingWriteCloser struct {
-	io.WriteCloser
-	wg *sync.WaitGroup
+// ErrProcessExited is returned by Writer methods when the zstd process has
+// exited before the Writer was closed.  Data written before the error may not
+// have been written to the file.
+var ErrProcessExited = errors.New("zstd process exited unexpectedly")
+
+// Writer pipes all writes through an external zstd process, and monitors the
+// process, so that a process failure is reported instead of silently dropping
+// data.
+type Writer struct {
+	pipeW   *os.File
+	done    chan struct{} // Closed when the process has exited.
+	exitErr error         // The result of cmd.Wait, valid after done is closed.
+	closing int32         // Set atomically when Close is called.
+}
+
+// Err returns an error wrapping ErrProcessExited if the zstd process has exited
+// before Close was called, and nil otherwise.  It is safe to call concurrently
+// with Write.
+func (w *Writer) Err() error {
+	select {
+	case <-w.done:
+		if atomic.LoadInt32(&w.closing) == 0 {
+			return fmt.Errorf("%w: %v", ErrProcessExited, w.exitErr)
+		}
+	default:
+	}
+	return nil
+}
+
+// Write writes b to the zstd process.
+func (w *Writer) Write(b []byte) (int, error) {
+	if err := w.Err(); err != nil {
+		return 0, err
+	}
+	fault.Sleep(fault.Compress)
+	n, err := w.pipeW.Write(b)
+	if err != nil {
+		if exitErr := w.Err(); exitErr != nil {
+			return n, exitErr
+		}
+	}
+	return n, err
 }
 
-func (w waitingWriteCloser) Close() error {
-	err := w.WriteCloser.Close()
+// Close closes the pipe to the zstd process, and waits for the process to
+// finish writing to disk.  It returns the error of the process, if it failed, as
+// the file is then incomplete.
+func (w *Writer) Close() error {
+	atomic.StoreInt32(&w.closing, 1)
+	err := w.pipeW.Close()
 	if err != nil {
 		return err
 	}
-	w.wg.Wait()
-	return nil
+	<-w.done
+	return w.exitErr
 }
 
 // NewWriter creates a writer piped to an external zstd process writing to
 // filename. It returns a WriteCloser that pipes all writes through a zstd
 // compression process. Upon Close(), the returned WriteCloser will wait for the
-// zstd process to finish writing to disk.
+// zstd process to finish writing to disk.  The returned value is a *Writer, whose
+// Err method reports whether the process has failed.
 func NewWriter(filename string) (io.WriteCloser, error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
 	pipeR, pipeW, err := osPipe()
 	if err != nil {
 		return nil, err
@@ -74,6 +120,7 @@ func NewWriter(filename string) (io.WriteCloser, error) {
 	cmd := exec.Command(zstdCommand)
 	cmd.Stdin = pipeR
 	cmd.Stdout = f
+	w := &Writer{pipeW: pipeW, done: make(chan struct{})}
 
 	go func() {
 		err := cmd.Run()
@@ -81,8 +128,10 @@ func NewWriter(filename string) (io.WriteCloser, error) {
 			log.Println("ZSTD error", filename, err)
 		}
 		pipeR.Close()
-		wg.Done()
+		f.Close()
+		w.exitErr = err
+		close(w.done)
 	}()
 
-	return waitingWriteCloser{pipeW, &wg}, nil
+	return w, nil
 }
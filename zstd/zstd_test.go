@@ -1,11 +1,14 @@
 package zstd_test
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"testing"
 
+	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/zstd"
 )
 
@@ -54,3 +57,82 @@ func TestWriterReader(t *testing.T) {
 		}
 	}
 }
+
+func TestInProcessWriter(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestInProcessWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte((i * 37) % 256)
+	}
+
+	// A small frame size produces many frames, which should read back as one stream.
+	w, err := zstd.NewInProcessWriter(tmpdir+"/test.zst", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += 300 {
+		end := i + 300
+		if end > len(data) {
+			end = len(data)
+		}
+		w.Write(data[i:end])
+	}
+	rtx.Must(w.Close(), "Could not close")
+
+	r := zstd.NewReader(tmpdir + "/test.zst")
+	read, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, read) {
+		t.Error("Data mismatch, read", len(read), "bytes")
+	}
+
+	_, err = zstd.NewInProcessWriter("/this/file/is/uncreateable", 0)
+	if err == nil {
+		t.Error("Should have had an error on an uncreateable file")
+	}
+}
+
+func TestInProcessReaderTruncated(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestInProcessReaderTruncated")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tmpdir)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte((i * 37) % 256)
+	}
+	w, err := zstd.NewInProcessWriter(tmpdir+"/test.zst", 1000)
+	rtx.Must(err, "Could not create writer")
+	w.Write(data)
+	rtx.Must(w.Close(), "Could not close")
+
+	r, err := zstd.NewInProcessReader(tmpdir + "/test.zst")
+	rtx.Must(err, "Could not create reader")
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(data, read) {
+		t.Error("Data mismatch", len(read), err)
+	}
+
+	// Truncating the file should result in an error, after the complete frames.
+	info, err := os.Stat(tmpdir + "/test.zst")
+	rtx.Must(err, "Could not stat")
+	rtx.Must(os.Truncate(tmpdir+"/test.zst", info.Size()-10), "Could not truncate")
+	r, err = zstd.NewInProcessReader(tmpdir + "/test.zst")
+	rtx.Must(err, "Could not create reader")
+	read, err = ioutil.ReadAll(r)
+	r.Close()
+	if err == nil {
+		t.Error("Expected an error for a truncated file")
+	}
+	if len(read) != 9000 || !bytes.Equal(data[:9000], read) {
+		t.Error("Expected the 9 complete frames, got", len(read))
+	}
+}
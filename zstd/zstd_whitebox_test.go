@@ -48,3 +48,35 @@ func TestZstdFailure(t *testing.T) {
 		t.Error("Closing the pipe twice is not a failure?")
 	}
 }
+
+func TestProcessExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestProcessExit")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	// "false" exits immediately, without reading its input.
+	zstdCommand = "false"
+	defer func() {
+		zstdCommand = "zstd"
+	}()
+
+	wc, err := NewWriter(dir + "/file.zst")
+	rtx.Must(err, "WriteCloser could not be created")
+	w := wc.(*Writer)
+	<-w.done
+	if !errors.Is(w.Err(), ErrProcessExited) {
+		t.Error("Expected ErrProcessExited, got", w.Err())
+	}
+	_, err = w.Write([]byte("foobar"))
+	if !errors.Is(err, ErrProcessExited) {
+		t.Error("Expected ErrProcessExited, got", err)
+	}
+	// Close reports the failure of the process.
+	if err := w.Close(); err == nil {
+		t.Error("Close should have returned the exit error")
+	}
+	// After Close, the exit is expected.
+	if w.Err() != nil {
+		t.Error("Expected nil error after Close, got", w.Err())
+	}
+}